@@ -0,0 +1,112 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"sort"
+	"time"
+)
+
+// ActiveBuild describes a build that is running right now, or that is held
+// until maintenance is turned off: the Environment being built (like
+// "users/foo/env-1"), its Stage, the wr Deployment and JobID of its build job
+// (once added to wr), when it was Requested, and how many ElapsedSeconds it has
+// been since then.
+type ActiveBuild struct {
+	Environment        string
+	Stage              BuildStage
+	Deployment         string
+	JobID              string
+	Requested          *time.Time
+	ElapsedSeconds     int
+	HeldForMaintenance bool
+}
+
+// ActiveBuilds returns the builds we're doing right now, followed by those held
+// for maintenance, each oldest request first. Unlike QueryStatus(), builds that
+// have finished aren't included.
+func (b *Builder) ActiveBuilds() []ActiveBuild {
+	b.mu.Lock()
+	running := make([]string, 0, len(b.runningEnvironments))
+
+	for envPath := range b.runningEnvironments {
+		running = append(running, envPath)
+	}
+	b.mu.Unlock()
+
+	now := time.Now()
+
+	return append(b.activeBuilds(running, false, now), b.activeBuilds(b.maintenance.queuedPaths(), true, now)...)
+}
+
+// activeBuilds returns an ActiveBuild for each of the given full environment
+// paths, based on their statuses, sorted by when they were requested.
+func (b *Builder) activeBuilds(envPaths []string, held bool, now time.Time) []ActiveBuild {
+	b.statusMu.RLock()
+	defer b.statusMu.RUnlock()
+
+	active := make([]ActiveBuild, len(envPaths))
+
+	for i, envPath := range envPaths {
+		active[i] = ActiveBuild{Environment: envPath, Stage: BuildStageRequested, HeldForMaintenance: held}
+
+		status, ok := b.statuses[envPath]
+		if !ok {
+			continue
+		}
+
+		active[i].Stage = status.Stage()
+		active[i].Deployment = status.Deployment
+		active[i].JobID = status.JobID
+
+		if status.Requested != nil {
+			requested := *status.Requested
+			active[i].Requested = &requested
+			active[i].ElapsedSeconds = int(now.Sub(requested).Seconds())
+		}
+	}
+
+	sort.SliceStable(active, func(i, j int) bool {
+		return requestedBefore(active[i], active[j])
+	})
+
+	return active
+}
+
+// requestedBefore returns true if a was requested before b, treating unknown
+// request times as earliest, and otherwise ordering by environment.
+func requestedBefore(a, b ActiveBuild) bool {
+	switch {
+	case a.Requested == nil && b.Requested == nil:
+		return a.Environment < b.Environment
+	case a.Requested == nil:
+		return true
+	case b.Requested == nil:
+		return false
+	case a.Requested.Equal(*b.Requested):
+		return a.Environment < b.Environment
+	default:
+		return a.Requested.Before(*b.Requested)
+	}
+}
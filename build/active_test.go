@@ -0,0 +1,77 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+)
+
+func TestActiveBuilds(t *testing.T) {
+	Convey("Given a Builder with running, held and finished builds", t, func() {
+		builder, err := New(&config.Config{}, &s3mock.MockS3{}, wrmock.NewMockWR(0, 0))
+		So(err, ShouldBeNil)
+		So(builder.ActiveBuilds(), ShouldBeEmpty)
+
+		hourAgo := time.Now().Add(-time.Hour)
+		minuteAgo := time.Now().Add(-time.Minute)
+
+		builder.statuses = map[string]*Status{
+			"users/foo/queued-1":   {Name: "users/foo/queued-1", Requested: &minuteAgo, Deployment: "production", JobID: "a"},
+			"users/foo/building-1": {Name: "users/foo/building-1", Requested: &hourAgo, JobID: "b", BuildStart: &minuteAgo},
+			"users/foo/done-1":     {Name: "users/foo/done-1", Requested: &hourAgo, BuildDone: &minuteAgo},
+			"users/foo/held-1":     {Name: "users/foo/held-1", Requested: &minuteAgo},
+		}
+		builder.runningEnvironments = map[string]bool{"users/foo/queued-1": true, "users/foo/building-1": true}
+
+		def := getExampleDefinition()
+		def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion = "users/foo/", "held", "1"
+		builder.maintenance.queued = []*Definition{def}
+
+		Convey("you can see what it's doing right now", func() {
+			active := builder.ActiveBuilds()
+			So(len(active), ShouldEqual, 3)
+
+			So(active[0].Environment, ShouldEqual, "users/foo/building-1")
+			So(active[0].Stage, ShouldEqual, BuildStageBuilding)
+			So(active[0].JobID, ShouldEqual, "b")
+			So(active[0].ElapsedSeconds, ShouldBeBetweenOrEqual, 3600, 3610)
+			So(active[0].HeldForMaintenance, ShouldBeFalse)
+
+			So(active[1].Environment, ShouldEqual, "users/foo/queued-1")
+			So(active[1].Stage, ShouldEqual, BuildStageQueued)
+			So(active[1].Deployment, ShouldEqual, "production")
+			So(active[1].ElapsedSeconds, ShouldBeBetweenOrEqual, 60, 70)
+
+			So(active[2].Environment, ShouldEqual, "users/foo/held-1")
+			So(active[2].Stage, ShouldEqual, BuildStageRequested)
+			So(active[2].HeldForMaintenance, ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,87 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/git"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+// ErrImageNotOffline is returned by air-gapped builds that would need to pull
+// an image from the internet.
+const ErrImageNotOffline = internal.Error("image not available to air-gapped builds")
+
+// setRepoAndImages sets the custom spack repo details and the image bootstraps
+// of the given vars. Air-gapped builds get the repo from the configured
+// tarball, and their images must be local copies or from the registry mirror,
+// otherwise ErrImageNotOffline is returned.
+func (b *Builder) setRepoAndImages(ctx context.Context, vars *templateVars) error {
+	airGapped := b.config.AirGapped.Enabled
+
+	if airGapped {
+		vars.RepoTarball = b.config.AirGapped.RepoTarball
+	} else {
+		repoRef, err := git.GetLatestCommit(ctx, b.config.CustomSpackRepo)
+		if err != nil {
+			return err
+		}
+
+		vars.RepoRef = repoRef
+	}
+
+	buildImage, finalImage := vars.BuildImage, vars.FinalImage
+	vars.BuildBootstrap, vars.BuildImage = b.bootstrap(buildImage)
+	vars.FinalBootstrap, vars.FinalImage = b.bootstrap(finalImage)
+
+	if !airGapped {
+		return nil
+	}
+
+	if !b.isOffline(vars.BuildBootstrap, vars.BuildImage) {
+		return fmt.Errorf("%w: %s", ErrImageNotOffline, buildImage)
+	}
+
+	if !b.isOffline(vars.FinalBootstrap, vars.FinalImage) {
+		return fmt.Errorf("%w: %s", ErrImageNotOffline, finalImage)
+	}
+
+	return nil
+}
+
+// isOffline returns true if the given bootstrap agent and From value (as
+// returned by bootstrap()) don't need internet access: a local image, or one
+// from our registry mirror.
+func (b *Builder) isOffline(bootstrap, from string) bool {
+	if bootstrap == bootstrapLocalImage {
+		return true
+	}
+
+	registry := strings.TrimSuffix(b.config.Images.Registry, "/")
+
+	return registry != "" && strings.HasPrefix(from, registry+"/")
+}
@@ -0,0 +1,94 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestAirGapped(t *testing.T) {
+	Convey("Given an air-gapped Builder", t, func() {
+		var conf config.Config
+		conf.CustomSpackRepo = "http://0.0.0.0:1234/unreachable"
+		conf.Spack.BuildImage = "spack/ubuntu-jammy:latest"
+		conf.Spack.FinalImage = "ubuntu:22.04"
+		conf.Images.Registry = "mirror.example.org"
+		conf.AirGapped.Enabled = true
+		conf.AirGapped.RepoTarball = "/path/to/repo.tar.gz"
+
+		builder, err := New(&conf, &s3mock.MockS3{}, nil)
+		So(err, ShouldBeNil)
+
+		def := getExampleDefinition()
+
+		Convey("builds use the repo tarball and images from the registry mirror", func() {
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldStartWith, "Bootstrap: docker\nFrom: mirror.example.org/spack/ubuntu-jammy:latest\n")
+			So(defFile, ShouldContainSubstring, "\t/path/to/repo.tar.gz /opt/custom-spack-repo.tar.gz\n\n%post\n")
+			So(defFile, ShouldContainSubstring, "\ttmpDir=\"$(mktemp -d)\"\n"+
+				"\ttar -xzf /opt/custom-spack-repo.tar.gz -C \"$tmpDir\"\n\trm /opt/custom-spack-repo.tar.gz\n"+
+				"\tspack repo add \"$tmpDir\"\n")
+			So(defFile, ShouldNotContainSubstring, "git clone")
+		})
+
+		Convey("builds fail if they need an image that isn't available offline", func() {
+			conf.Profiles = map[string]config.Profile{"quay": {FinalImage: "quay.io/org/image:1"}}
+			def.Profile = "quay"
+
+			_, err := builder.generateSingularityDef(context.Background(), def)
+			So(errors.Is(err, ErrImageNotOffline), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "quay.io/org/image:1")
+
+			conf.Images.Registry = ""
+			def.Profile = ""
+
+			_, err = builder.generateSingularityDef(context.Background(), def)
+			So(errors.Is(err, ErrImageNotOffline), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "spack/ubuntu-jammy:latest")
+
+			Convey("unless there are local copies", func() {
+				conf.Images.LocalDir = t.TempDir()
+
+				for _, image := range []string{"spack/ubuntu-jammy:latest", "ubuntu:22.04"} {
+					err = os.WriteFile(localImagePath(conf.Images.LocalDir, image), []byte("sif"), 0600)
+					So(err, ShouldBeNil)
+				}
+
+				defFile, err := builder.generateSingularityDef(context.Background(), def)
+				So(err, ShouldBeNil)
+				So(defFile, ShouldStartWith, "Bootstrap: localimage\nFrom: "+
+					filepath.Join(conf.Images.LocalDir, "spack_ubuntu-jammy_latest.sif")+"\n")
+			})
+		})
+	})
+}
@@ -0,0 +1,180 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+// PackageReport describes how often each package is installed across the
+// Environments (versions) in the configured moduleInstallDir whose spack.lock
+// could be read; Skipped counts those whose couldn't. Packages are sorted by
+// the number of environments they are in, most first.
+type PackageReport struct {
+	Environments int
+	Skipped      int
+	Packages     []PackageCount
+}
+
+// PackageCount describes how many Environments a package is installed in, in
+// how many of them it was requested (rather than being a dependency) as a
+// Root, and how many environments each of its Versions is installed in, most
+// first.
+type PackageCount struct {
+	Name         string
+	Environments int
+	Roots        int
+	Versions     []VersionCount
+}
+
+// VersionCount describes how many Environments a version of a package is
+// installed in.
+type VersionCount struct {
+	Version      string
+	Environments int
+}
+
+// PackageAnalytics reports how many installed environments each package and
+// version is installed in, according to their spack.locks (see Metadata()),
+// so you can see which packages are worth pre-building in to the binary cache
+// and which custom recipes are most worth maintaining. Returns an error if the
+// installed environments couldn't be listed.
+func (b *Builder) PackageAnalytics(ctx context.Context) (*PackageReport, error) {
+	envs, err := b.installedEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PackageReport{Packages: []PackageCount{}}
+	counts := make(map[string]*packageTally)
+
+	for _, env := range envs {
+		sl, errs := b.environmentSpackLock(ctx, env[0], env[1])
+		if errs != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			report.Skipped++
+
+			continue
+		}
+
+		report.Environments++
+
+		tallySpackLock(counts, sl)
+	}
+
+	for name, tally := range counts {
+		report.Packages = append(report.Packages, tally.count(name))
+	}
+
+	sort.Slice(report.Packages, func(i, j int) bool {
+		if report.Packages[i].Environments != report.Packages[j].Environments {
+			return report.Packages[i].Environments > report.Packages[j].Environments
+		}
+
+		return report.Packages[i].Name < report.Packages[j].Name
+	})
+
+	return report, nil
+}
+
+func (b *Builder) environmentSpackLock(ctx context.Context, envPath, version string) (*SpackLock, error) {
+	metadata, err := b.Metadata(ctx, envPath, version)
+	if err != nil {
+		return nil, err
+	}
+
+	sl := new(SpackLock)
+
+	return sl, json.Unmarshal([]byte(metadata.SpackLock), sl)
+}
+
+// packageTally counts the environments a package is in, as a root, and per
+// version.
+type packageTally struct {
+	environments int
+	roots        int
+	versions     map[string]int
+}
+
+// tallySpackLock adds the packages in the given spack.lock of an environment
+// to the given counts, counting each package and version once.
+func tallySpackLock(counts map[string]*packageTally, sl *SpackLock) {
+	roots := make(map[string]bool, len(sl.Roots))
+
+	for _, root := range sl.Roots {
+		roots[root.Hash] = true
+	}
+
+	seen := make(map[string]bool)
+	seenRoot := make(map[string]bool)
+	seenVersion := make(map[ConcreteSpec]bool)
+
+	for hash, spec := range sl.ConcreteSpecs {
+		tally, ok := counts[spec.Name]
+		if !ok {
+			tally = &packageTally{versions: make(map[string]int)}
+			counts[spec.Name] = tally
+		}
+
+		if !seen[spec.Name] {
+			seen[spec.Name] = true
+			tally.environments++
+		}
+
+		if roots[hash] && !seenRoot[spec.Name] {
+			seenRoot[spec.Name] = true
+			tally.roots++
+		}
+
+		if !seenVersion[spec] {
+			seenVersion[spec] = true
+			tally.versions[spec.Version]++
+		}
+	}
+}
+
+// count returns the tally as a PackageCount for the named package, with its
+// versions sorted by environments, most first, then newest first.
+func (t *packageTally) count(name string) PackageCount {
+	pc := PackageCount{Name: name, Environments: t.environments, Roots: t.roots}
+
+	for version, n := range t.versions {
+		pc.Versions = append(pc.Versions, VersionCount{Version: version, Environments: n})
+	}
+
+	sort.Slice(pc.Versions, func(i, j int) bool {
+		if pc.Versions[i].Environments != pc.Versions[j].Environments {
+			return pc.Versions[i].Environments > pc.Versions[j].Environments
+		}
+
+		return compareVersions(pc.Versions[i].Version, pc.Versions[j].Version) > 0
+	})
+
+	return pc
+}
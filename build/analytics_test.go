@@ -0,0 +1,90 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+)
+
+func TestPackageAnalytics(t *testing.T) {
+	Convey("Given a Builder with installed environments", t, func() {
+		ms3 := &mapS3{files: map[string]string{
+			"users/foo/env/1/" + core.SpackLockFile: `{"roots":[{"hash":"a"}],"concrete_specs":{` +
+				`"a":{"name":"xxhash","version":"0.8.1"},"b":{"name":"zlib","version":"1.3"}}}`,
+			"users/foo/env/2/" + core.SpackLockFile: `{"roots":[{"hash":"a"},{"hash":"c"}],"concrete_specs":{` +
+				`"a":{"name":"xxhash","version":"0.8.2"},"b":{"name":"zlib","version":"1.3"},` +
+				`"c":{"name":"zlib","version":"1.2"}}}`,
+			"groups/hgi/r/1/" + core.SpackLockFile: `{"roots":[{"hash":"a"}],"concrete_specs":{` +
+				`"a":{"name":"r","version":"4.4"},"b":{"name":"zlib","version":"1.2"}}}`,
+		}}
+
+		for _, env := range []string{"users/foo/env/1/", "users/foo/env/2/", "groups/hgi/r/1/"} {
+			ms3.files[env+core.SoftpackYaml] = "yml data"
+		}
+
+		conf := &config.Config{}
+		conf.Module.ModuleInstallDir = "/modules"
+
+		builder, err := New(conf, ms3, nil)
+		So(err, ShouldBeNil)
+
+		mfs := fsmock.New()
+		builder.inst.fs = mfs
+
+		for _, module := range []string{"users/foo/env/1", "users/foo/env/2", "groups/hgi/r/1", "groups/hgi/broken/1"} {
+			So(mfs.MkdirAll(filepath.Dir("/modules/"+module), dirPerms), ShouldBeNil)
+			So(builder.inst.installFile(strings.NewReader("module"), "/modules/"+module), ShouldBeNil)
+		}
+
+		Convey("you can see how many environments each package and version is in", func() {
+			report, err := builder.PackageAnalytics(context.Background())
+			So(err, ShouldBeNil)
+			So(report, ShouldResemble, &PackageReport{
+				Environments: 3,
+				Skipped:      1,
+				Packages: []PackageCount{
+					{Name: "zlib", Environments: 3, Roots: 1, Versions: []VersionCount{
+						{Version: "1.3", Environments: 2},
+						{Version: "1.2", Environments: 2},
+					}},
+					{Name: "xxhash", Environments: 2, Roots: 2, Versions: []VersionCount{
+						{Version: "0.8.2", Environments: 1},
+						{Version: "0.8.1", Environments: 1},
+					}},
+					{Name: "r", Environments: 1, Roots: 1, Versions: []VersionCount{
+						{Version: "4.4", Environments: 1},
+					}},
+				},
+			})
+		})
+	})
+}
@@ -0,0 +1,125 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const ErrInvalidArtefact = internal.Error("extra artefacts need plain file names that aren't default artefacts, " +
+	"and only optional default artefacts can be suppressed")
+
+// defaultArtefacts are the basenames of the artefacts sent to core for
+// successful builds. The spack.yaml is only sent for builds of one.
+var defaultArtefacts = []string{ //nolint:gochecknoglobals
+	core.SpackLockFile,
+	core.SoftpackYaml,
+	core.SingularityDefBasename,
+	core.BuilderOut,
+	core.ModuleForCoreBasename,
+	core.UsageBasename,
+	core.SpackYAMLBasename,
+	core.ProvenanceBasename,
+}
+
+// coreOnlyArtefacts are the defaultArtefacts that are only sent to core, and
+// not also stored in the build's S3 location.
+var coreOnlyArtefacts = []string{core.ModuleForCoreBasename} //nolint:gochecknoglobals
+
+// requiredArtefacts are the defaultArtefacts that core needs to describe and
+// load environments, so can't be suppressed.
+var requiredArtefacts = []string{core.SoftpackYaml, core.ModuleForCoreBasename} //nolint:gochecknoglobals
+
+// validateArtefacts returns ErrInvalidArtefact if any of the given extra
+// artefact names aren't plain file names or are default artefacts, or if any of
+// the suppressed names aren't optional default artefacts.
+func validateArtefacts(extra, suppress []string) error {
+	for _, name := range extra {
+		if !config.IsPlainFileName(name) || slices.Contains(defaultArtefacts, name) {
+			return ErrInvalidArtefact
+		}
+	}
+
+	for _, name := range suppress {
+		if !slices.Contains(defaultArtefacts, name) || slices.Contains(requiredArtefacts, name) {
+			return ErrInvalidArtefact
+		}
+	}
+
+	return nil
+}
+
+func (d *Definition) validateArtefacts() error {
+	extra := make([]string, 0, len(d.ExtraArtefacts))
+
+	for name := range d.ExtraArtefacts {
+		extra = append(extra, name)
+	}
+
+	return validateArtefacts(extra, d.SuppressArtefacts)
+}
+
+func validateArtefactsConfig(conf config.Artefacts) error {
+	extra := make([]string, len(conf.Extra))
+
+	for i, artefact := range conf.Extra {
+		extra[i] = artefact.Name
+	}
+
+	return validateArtefacts(extra, conf.Suppress)
+}
+
+// coreArtefacts returns the given default artefacts for the given Definition's
+// build, without those suppressed by the config or Definition, and with the
+// extra artefacts of the config (read from their paths now) and Definition
+// added. The Definition's extra artefacts replace any of the config's with the
+// same name.
+func (b *Builder) coreArtefacts(def *Definition, artefacts map[string]io.Reader) (map[string]io.Reader, error) {
+	for _, name := range append(slices.Clip(b.config.Artefacts.Suppress), def.SuppressArtefacts...) {
+		delete(artefacts, name)
+	}
+
+	for _, extra := range b.config.Artefacts.Extra {
+		data, err := os.ReadFile(extra.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		artefacts[extra.Name] = bytes.NewReader(data)
+	}
+
+	for name, content := range def.ExtraArtefacts {
+		artefacts[name] = strings.NewReader(content)
+	}
+
+	return artefacts, nil
+}
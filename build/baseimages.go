@@ -0,0 +1,172 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+const (
+	baseImagePrefix    = "base-"
+	baseImageHashChars = 12
+	defExt             = ".def"
+	baseImageDefPerms  = 0644
+)
+
+//go:embed baseimage.tmpl
+var baseImageTmplStr string
+var baseImageTmpl = template.Must(template.New("").Parse(baseImageTmplStr)) //nolint:gochecknoglobals
+
+// baseImagePath returns the path of the SIF file in images.localDir that the
+// given base image is built to. The name includes a hash of what the image is
+// built from, so that changing the base image's packages, or the build image
+// or processor target, results in a new image being built.
+func (b *Builder) baseImagePath(base config.BaseImage) string {
+	hash := sha256.Sum256([]byte(strings.Join(append([]string{
+		b.config.Spack.BuildImage, b.config.Spack.ProcessorTarget,
+	}, base.Packages...), "\n")))
+
+	return filepath.Join(b.config.Images.LocalDir,
+		baseImagePrefix+base.Name+"-"+hex.EncodeToString(hash[:])[:baseImageHashChars]+sifExt)
+}
+
+// builtBaseImage returns the base image that the given Definition's build
+// should start from, and the path to its SIF file: the one providing the most
+// of its packages out of those that have been built by BuildBaseImages().
+// Returns nil if none have been built, or match.
+func (b *Builder) builtBaseImage(def *Definition) (*config.BaseImage, string) {
+	var built []config.BaseImage
+
+	for _, base := range b.config.Spack.BaseImages {
+		if _, err := os.Stat(b.baseImagePath(base)); err == nil {
+			built = append(built, base)
+		}
+	}
+
+	base := def.BaseImage(built)
+	if base == nil {
+		return nil, ""
+	}
+
+	return base, b.baseImagePath(*base)
+}
+
+// BuildBaseImages adds a job to the default wr deployment that builds each of
+// the configured spack.baseImages that hasn't been built yet, from
+// spack.buildImage, to a SIF file in images.localDir. The singularity
+// definition files for them are written alongside. Once a base image has been
+// built, builds that need all of its packages start from it.
+//
+// Does nothing if they have all been built already.
+func (b *Builder) BuildBaseImages(ctx context.Context) error {
+	var builds []wr.ImageBuild
+
+	for _, base := range b.config.Spack.BaseImages {
+		dest := b.baseImagePath(base)
+		if _, err := os.Stat(dest); err == nil {
+			continue
+		}
+
+		defPath, err := b.writeBaseImageDef(ctx, base, strings.TrimSuffix(dest, sifExt)+defExt)
+		if err != nil {
+			return err
+		}
+
+		builds = append(builds, wr.ImageBuild{Def: defPath, Dest: dest})
+	}
+
+	if len(builds) == 0 {
+		return nil
+	}
+
+	var sing config.SingularityBuild
+
+	if b.config.Singularity != nil {
+		sing = *b.config.Singularity
+	}
+
+	wrInput, err := wr.BuildImagesWRInput(builds, sing.Fakeroot, sing.Flags)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.runnerFor(config.DefaultWRDeployment).Add(wrInput)
+
+	return err
+}
+
+// writeBaseImageDef writes the singularity definition file for the given base
+// image to the given path, and returns the path.
+func (b *Builder) writeBaseImageDef(ctx context.Context, base config.BaseImage, path string) (string, error) {
+	singDef, err := b.generateBaseImageDef(ctx, base)
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), dirPerms); err != nil {
+		return "", err
+	}
+
+	return path, os.WriteFile(path, []byte(singDef), baseImageDefPerms)
+}
+
+// generateBaseImageDef returns a singularity definition file that installs the
+// given base image's packages with spack, in to the same install tree that
+// builds use, on top of spack.buildImage.
+func (b *Builder) generateBaseImageDef(ctx context.Context, base config.BaseImage) (string, error) {
+	vars := &templateVars{
+		S3BinaryCache:   b.config.S3.BinaryCache,
+		Mirrors:         b.config.Spack.Mirrors,
+		RepoURL:         b.config.CustomSpackRepo,
+		ProcessorTarget: b.config.Spack.ProcessorTarget,
+		BuildImage:      b.config.Spack.BuildImage,
+		FinalImage:      b.config.Spack.FinalImage,
+		BaseImage:       base.Name,
+		Packages:        make([]core.Package, len(base.Packages)),
+	}
+
+	for i, name := range base.Packages {
+		vars.Packages[i] = core.Package{Name: name}
+	}
+
+	if err := b.setRepoAndImages(ctx, vars); err != nil {
+		return "", err
+	}
+
+	var w strings.Builder
+	err := baseImageTmpl.Execute(&w, vars)
+
+	return w.String(), err
+}
@@ -0,0 +1,189 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	ErrBrokenPackagesFetch = internal.Error("failed to fetch broken packages")
+
+	brokenHookName = "brokenPackages"
+)
+
+// brokenPackages checks Definitions against the configured denylist of broken
+// package versions, including those fetched from the denylist URL.
+type brokenPackages struct {
+	conf   config.BrokenPackages
+	client *http.Client
+
+	mu        sync.Mutex
+	fetched   []config.BrokenPackage
+	fetchedAt time.Time
+}
+
+// newBrokenPackages returns a brokenPackages for the given config, or nil if
+// there is no denylist configured.
+func newBrokenPackages(conf config.BrokenPackages, client *http.Client) *brokenPackages {
+	if conf.URL == "" && len(conf.Packages) == 0 {
+		return nil
+	}
+
+	return &brokenPackages{conf: conf, client: client}
+}
+
+// checkBrokenPackages returns a *PolicyRejection if any of the packages in the
+// given Definition are on the denylist of broken packages. Packages without a
+// version only match denylisted specs without a version.
+func (b *Builder) checkBrokenPackages(ctx context.Context, def *Definition) error {
+	if b.broken == nil {
+		return nil
+	}
+
+	denylist := b.broken.denylist(ctx)
+
+	var reasons []string
+
+	for _, pkg := range def.Packages {
+		if broken := matchBrokenPackage(denylist, pkg.Name, pkg.Version); broken != nil {
+			reasons = append(reasons, brokenReason(pkg.Name, pkg.Version, broken.Reason))
+		}
+	}
+
+	if len(reasons) > 0 {
+		return &PolicyRejection{Hook: brokenHookName, Reasons: reasons}
+	}
+
+	return nil
+}
+
+// matchBrokenPackage returns the first of the given BrokenPackages that matches
+// the given package name and version, or nil if none do.
+func matchBrokenPackage(denylist []config.BrokenPackage, name, version string) *config.BrokenPackage {
+	for i, broken := range denylist {
+		brokenName, brokenVersion := broken.NameAndVersion()
+		if brokenName != name {
+			continue
+		}
+
+		if brokenVersion == "" {
+			return &denylist[i]
+		}
+
+		if version == "" {
+			continue
+		}
+
+		if matched, err := path.Match(brokenVersion, version); err == nil && matched {
+			return &denylist[i]
+		}
+	}
+
+	return nil
+}
+
+// brokenReason describes why the given package can't be built, eg.
+// "r-seurat@5.0.0 is known to be broken: use 4.4 instead".
+func brokenReason(name, version, reason string) string {
+	spec := name
+	if version != "" {
+		spec += "@" + version
+	}
+
+	if reason == "" {
+		return spec + " is known to be broken"
+	}
+
+	return spec + " is known to be broken: " + reason
+}
+
+// denylist returns the configured broken packages, followed by those most
+// recently fetched from the denylist URL, fetching them again if they're older
+// than the refresh interval. If they can't be fetched, the previously fetched
+// ones continue to be used until the next refresh.
+func (b *brokenPackages) denylist(ctx context.Context) []config.BrokenPackage {
+	if b.conf.URL == "" {
+		return b.conf.Packages
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Since(b.fetchedAt) >= b.conf.RefreshInterval() {
+		b.fetchedAt = time.Now()
+
+		fetched, err := b.fetch(ctx)
+		if err != nil {
+			loggerFromContext(ctx).Warn(string(ErrBrokenPackagesFetch), "url", b.conf.URL, "err", err)
+		} else {
+			b.fetched = fetched
+		}
+	}
+
+	denylist := make([]config.BrokenPackage, 0, len(b.conf.Packages)+len(b.fetched))
+
+	return append(append(denylist, b.conf.Packages...), b.fetched...)
+}
+
+// fetch gets and validates the YAML list of broken packages at the denylist
+// URL.
+func (b *brokenPackages) fetch(ctx context.Context) ([]config.BrokenPackage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.conf.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrBrokenPackagesFetch, resp.Status)
+	}
+
+	var pkgs []config.BrokenPackage
+
+	if err = yaml.NewDecoder(resp.Body).Decode(&pkgs); err != nil {
+		return nil, err
+	}
+
+	if err = config.ValidateBrokenPackages(pkgs); err != nil {
+		return nil, err
+	}
+
+	return pkgs, nil
+}
@@ -0,0 +1,136 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestBrokenPackages(t *testing.T) {
+	Convey("Matching broken packages considers versions and globs", t, func() {
+		denylist := []config.BrokenPackage{
+			{Spec: "r-seurat@5.0.*", Reason: "use 4.4"},
+			{Spec: "xxhash"},
+		}
+
+		So(matchBrokenPackage(denylist, "r-seurat", "5.0.0"), ShouldEqual, &denylist[0])
+		So(matchBrokenPackage(denylist, "r-seurat", "4.4"), ShouldBeNil)
+		So(matchBrokenPackage(denylist, "r-seurat", ""), ShouldBeNil)
+		So(matchBrokenPackage(denylist, "xxhash", ""), ShouldEqual, &denylist[1])
+		So(matchBrokenPackage(denylist, "xxhash", "0.8.1"), ShouldEqual, &denylist[1])
+		So(matchBrokenPackage(denylist, "zlib", "1"), ShouldBeNil)
+
+		So(brokenReason("r-seurat", "5.0.0", "use 4.4"), ShouldEqual, "r-seurat@5.0.0 is known to be broken: use 4.4")
+		So(brokenReason("xxhash", "", ""), ShouldEqual, "xxhash is known to be broken")
+	})
+
+	Convey("Given a builder with a broken packages denylist", t, func() {
+		var fetches atomic.Int32
+
+		remote := "- spec: py-anndata@3.*\n  reason: needs a newer python\n"
+		status := http.StatusOK
+
+		denylistServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			fetches.Add(1)
+			w.WriteHeader(status)
+			w.Write([]byte(remote)) //nolint:errcheck
+		}))
+
+		defer denylistServer.Close()
+
+		_, conf, _, mwr := newTestBuilder(t, func(conf *config.Config) {
+			conf.Broken.Packages = []config.BrokenPackage{{Spec: "r-seurat@5.0.0", Reason: "use 4.4"}}
+		})
+
+		def := getExampleDefinition()
+
+		build := func() error {
+			builder, err := New(conf, &s3mock.MockS3{}, mwr)
+			So(err, ShouldBeNil)
+
+			return builder.Build(context.Background(), def)
+		}
+
+		Convey("builds of other package versions are allowed", func() {
+			So(build(), ShouldBeNil)
+			So(waitFor(func() bool { return mwr.GetLastCmd() != "" }), ShouldBeTrue)
+		})
+
+		Convey("builds of broken package versions are rejected with the reasons", func() {
+			def.Packages = append(def.Packages, core.Package{Name: "r-seurat", Version: "5.0.0"})
+
+			err := build()
+			So(err, ShouldWrap, ErrPolicyRejected)
+
+			var rejection *PolicyRejection
+
+			So(errors.As(err, &rejection), ShouldBeTrue)
+			So(rejection.Hook, ShouldEqual, "brokenPackages")
+			So(rejection.Reasons, ShouldResemble, []string{"r-seurat@5.0.0 is known to be broken: use 4.4"})
+			So(mwr.GetLastCmd(), ShouldBeBlank)
+		})
+
+		Convey("broken packages are also fetched from the URL, which is cached", func() {
+			conf.Broken.URL = denylistServer.URL
+
+			builder, err := New(conf, &s3mock.MockS3{}, mwr)
+			So(err, ShouldBeNil)
+
+			var rejection *PolicyRejection
+
+			So(errors.As(builder.checkBrokenPackages(context.Background(), def), &rejection), ShouldBeTrue)
+			So(rejection.Reasons, ShouldResemble, []string{"py-anndata@3.14 is known to be broken: needs a newer python"})
+
+			remote = "[]"
+
+			So(errors.As(builder.checkBrokenPackages(context.Background(), def), &rejection), ShouldBeTrue)
+			So(fetches.Load(), ShouldEqual, 1)
+
+			Convey("and refetched after the refresh interval, keeping the old list on failure", func() {
+				builder.broken.fetchedAt = time.Time{}
+				status = http.StatusInternalServerError
+
+				So(errors.As(builder.checkBrokenPackages(context.Background(), def), &rejection), ShouldBeTrue)
+				So(fetches.Load(), ShouldEqual, 2)
+
+				builder.broken.fetchedAt = time.Time{}
+				status = http.StatusOK
+
+				So(builder.checkBrokenPackages(context.Background(), def), ShouldBeNil)
+				So(fetches.Load(), ShouldEqual, 3)
+			})
+		})
+	})
+}
@@ -31,11 +31,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log/slog"
-	"mime/multipart"
 	"net/http"
-	"net/url"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"sync"
 	"text/template"
@@ -43,15 +43,16 @@ import (
 
 	"github.com/wtsi-hgi/go-softpack-builder/config"
 	"github.com/wtsi-hgi/go-softpack-builder/core"
-	"github.com/wtsi-hgi/go-softpack-builder/git"
 	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
 	"github.com/wtsi-hgi/go-softpack-builder/s3"
 	"github.com/wtsi-hgi/go-softpack-builder/wr"
 )
 
 const (
-	uploadEndpoint = "/upload"
 	ErrBuildFailed = "environment build failed"
+
+	defaultRetries = 2
 )
 
 //go:embed singularity.tmpl
@@ -70,9 +71,34 @@ func init() { //nolint:gochecknoinits
 const (
 	ErrInvalidJSON         = internal.Error("invalid spack lock JSON")
 	ErrEnvironmentBuilding = internal.Error("build already running for environment")
+	ErrBuildNotRunning     = internal.Error("no build running for environment")
+
+	ErrInvalidEnvPath       = internal.Error("invalid environment path")
+	ErrInvalidEnvName       = internal.Error("invalid environment name")
+	ErrInvalidVersion       = internal.Error("environment version required")
+	ErrInvalidVersionFormat = internal.Error("invalid environment version")
+	ErrInvalidRequester     = internal.Error("invalid requester")
+	ErrInvalidReplacement   = internal.Error("invalid replacement environment")
+	ErrInvalidLabel         = internal.Error("invalid label")
+)
 
-	ErrInvalidEnvPath = internal.Error("invalid environment path")
-	ErrInvalidVersion = internal.Error("environment version required")
+// validPathComponent matches the user or group part of environment paths, and
+// environment names and versions. These are used to make file paths, so must
+// start with an alphanumeric (which rules out dot segments) and only contain
+// alphanumerics, dots, underscores, pluses and hyphens.
+var validPathComponent = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`) //nolint:gochecknoglobals
+
+// validRequester matches usernames, which may be email addresses. They are
+// passed to wr jobs in their environment, so can't contain quotes or spaces.
+var validRequester = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@+-]*$`) //nolint:gochecknoglobals
+
+// validLabelKey and validLabelValue match the keys and values of labels. They
+// are written to softpack.yml files and passed to hooks in their environment as
+// a comma separated list of key=value, so can't contain quotes, spaces, commas
+// or equals signs.
+var (
+	validLabelKey   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)     //nolint:gochecknoglobals
+	validLabelValue = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/@+-]*$`) //nolint:gochecknoglobals
 )
 
 // Definition describes the environment a user wanted to create, which
@@ -80,12 +106,76 @@ const (
 // such as "mainpackage", and EnvironmentVersion, such as "1". The given
 // Packages will be installed for this Environment, and the Description will
 // become the help text for making use of the Packages.
+//
+// Parent is set by the Builder to the full environment path of a previously
+// installed version of this environment, if this one requests all of that
+// version's packages.
+//
+// If Force is set, an existing installation of this EnvironmentVersion will be
+// archived and replaced, instead of causing the install to fail.
+//
+// Profile is the name of the configured build profile to use; blank means the
+// default profile.
+//
+// If RStudio is set and the environment has R, an RStudio Server launcher
+// script will be installed alongside the executables.
+//
+// If TestCommand is set, it is run inside the built image as part of the build
+// job, and the build fails if it fails.
+//
+// ProcessorTarget overrides the profile's processor target, and must be one of
+// the configured spack.processorTargets. Build() sets it to the target actually
+// used.
+//
+// FatTargets are additional x86-64 microarchitecture levels (from
+// spack.processorTargets, above ProcessorTarget) to also build for in the same
+// image, with the best one the CPU supports being used at runtime.
+//
+// Externals are the names of configured spack.externals, system-provided
+// packages that spack should use instead of building them.
+//
+// Conflicts and Prereqs are the names of modules that the environment's module
+// can't be loaded alongside, or needs to be loaded first, respectively. Build()
+// adds the configured module conflicts and prereqs to them.
+//
+// Requester is the username of the user who requested the build, as
+// authenticated by core, if known. It is recorded in the build's Status, logs
+// and wr job, so builds can be attributed to users.
+//
+// AutoUpgrade opts the environment in to having new versions proposed when
+// newer versions of its root packages become available; see ProposeUpgrades().
+//
+// ExtraArtefacts are additional files (keyed on their file names, with their
+// contents as values) to send to core along with the default artefacts of a
+// successful build, and SuppressArtefacts are the names of default artefacts
+// (like "builder.out") not to send.
+//
+// SpackYAML is the spack.yaml of an existing spack environment to build instead
+// of one generated from Packages, which should be those of its specs (see
+// ParseSpackYAML()). Our view and config settings are injected in to it, and
+// the original is kept as an artefact.
 type Definition struct {
 	EnvironmentPath    string
 	EnvironmentName    string
 	EnvironmentVersion string
 	Description        string
 	Packages           core.Packages
+	Parent             string
+	Force              bool
+	Profile            string
+	RStudio            bool
+	TestCommand        string
+	ProcessorTarget    string
+	FatTargets         []string
+	Externals          []string
+	Conflicts          []string
+	Prereqs            []string
+	Requester          string
+	AutoUpgrade        bool
+	ExtraArtefacts     map[string]string
+	SuppressArtefacts  []string
+	SpackYAML          string
+	Labels             map[string]string
 }
 
 // FullEnvironmentPath returns the complete environment path: the location under
@@ -123,53 +213,320 @@ func (d *Definition) Interpreters() []string {
 	return interpreters
 }
 
-// Validate returns an error if the Path is invalid, if Version isn't set, if
-// there are no packages defined, or if any package has no name.
+// BaseImage returns the configured base image whose packages are all included
+// in our Packages. If more than one matches, the one providing the most
+// packages is returned. Returns nil if none match.
+func (d *Definition) BaseImage(bases []config.BaseImage) *config.BaseImage {
+	names := make(map[string]bool, len(d.Packages))
+
+	for _, pkg := range d.Packages {
+		names[pkg.Name] = true
+	}
+
+	var best *config.BaseImage
+
+	for i, base := range bases {
+		if !containsAll(names, base.Packages) {
+			continue
+		}
+
+		if best == nil || len(base.Packages) > len(best.Packages) {
+			best = &bases[i]
+		}
+	}
+
+	return best
+}
+
+func containsAll(names map[string]bool, pkgs []string) bool {
+	for _, pkg := range pkgs {
+		if !names[pkg] {
+			return false
+		}
+	}
+
+	return len(pkgs) > 0
+}
+
+// Validate returns an error if the Path, Name, Version or Requester are
+// invalid, if there are no packages defined, or if any package has no name.
 func (d *Definition) Validate() error {
-	epParts := strings.Split(d.EnvironmentPath, "/")
-	if len(epParts) != 2 && !(epParts[0] == "groups" || epParts[0] == "users") {
+	if err := d.ValidateEnvironment(); err != nil {
+		return err
+	}
+
+	if err := d.validateRequester(); err != nil {
+		return err
+	}
+
+	if err := config.ValidateModuleNames(d.Conflicts, d.Prereqs); err != nil {
+		return err
+	}
+
+	if err := d.validateArtefacts(); err != nil {
+		return err
+	}
+
+	if err := ValidateLabels(d.Labels); err != nil {
+		return err
+	}
+
+	if d.SpackYAML != "" {
+		if _, err := ParseSpackYAML(d.SpackYAML); err != nil {
+			return err
+		}
+	}
+
+	return d.Packages.Validate()
+}
+
+func (d *Definition) validateRequester() error {
+	if d.Requester != "" && !validRequester.MatchString(d.Requester) {
+		return ErrInvalidRequester
+	}
+
+	return nil
+}
+
+// ValidateLabels returns ErrInvalidLabel if any of the given labels have a key
+// or value that isn't made of alphanumerics, dots, underscores and hyphens
+// (values may also contain colons, slashes, @s and pluses), starting with an
+// alphanumeric.
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !validLabelKey.MatchString(key) || !validLabelValue.MatchString(value) {
+			return ErrInvalidLabel
+		}
+	}
+
+	return nil
+}
+
+// ParseLabel parses a "key=value" label, returning ErrInvalidLabel if it isn't
+// in that format or isn't valid according to ValidateLabels().
+func ParseLabel(label string) (string, string, error) {
+	key, value, ok := strings.Cut(label, "=")
+	if !ok {
+		return "", "", ErrInvalidLabel
+	}
+
+	return key, value, ValidateLabels(map[string]string{key: value})
+}
+
+// LabelList returns our Labels as a comma separated list of "key=value",
+// sorted by key.
+func (d *Definition) LabelList() string {
+	keys := make([]string, 0, len(d.Labels))
+
+	for key := range d.Labels {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	for i, key := range keys {
+		keys[i] = key + "=" + d.Labels[key]
+	}
+
+	return strings.Join(keys, ",")
+}
+
+// ValidateEnvironment is like Validate(), but only checks the environment path,
+// name and version, not the packages. The path must be "users/[user]" or
+// "groups/[group]" (with an optional trailing slash).
+func (d *Definition) ValidateEnvironment() error {
+	epParts := strings.Split(strings.TrimSuffix(d.EnvironmentPath, "/"), "/")
+	if len(epParts) != 2 || !(epParts[0] == "groups" || epParts[0] == "users") ||
+		!validPathComponent.MatchString(epParts[1]) {
 		return ErrInvalidEnvPath
 	}
 
+	if !validPathComponent.MatchString(d.EnvironmentName) {
+		return ErrInvalidEnvName
+	}
+
 	if d.EnvironmentVersion == "" {
 		return ErrInvalidVersion
 	}
 
-	return d.Packages.Validate()
+	if !validPathComponent.MatchString(d.EnvironmentVersion) {
+		return ErrInvalidVersionFormat
+	}
+
+	return nil
+}
+
+// ValidateEnvironmentPath returns an error if the given full environment path
+// (eg. "users/user/env") and version are not valid according to
+// Definition.ValidateEnvironment().
+func ValidateEnvironmentPath(envPath, version string) error {
+	d := new(Definition)
+	d.EnvironmentPath, d.EnvironmentName = path.Split(envPath)
+	d.EnvironmentVersion = version
+
+	return d.ValidateEnvironment()
+}
+
+// ValidateReplacement returns an error if the given replacement environment for
+// a deprecated environment (eg. "users/foo/bar-2", optionally followed by
+// "/version") isn't blank and contains anything but valid path components.
+func ValidateReplacement(replacement string) error {
+	if replacement == "" {
+		return nil
+	}
+
+	parts := strings.Split(replacement, "/")
+	if len(parts) < 3 || len(parts) > 4 || !(parts[0] == "groups" || parts[0] == "users") { //nolint:gomnd
+		return ErrInvalidReplacement
+	}
+
+	for _, part := range parts[1:] {
+		if !validPathComponent.MatchString(part) {
+			return ErrInvalidReplacement
+		}
+	}
+
+	return nil
 }
 
 type S3 interface {
-	UploadData(data io.Reader, dest string) error
-	OpenFile(source string) (io.ReadCloser, error)
+	UploadData(ctx context.Context, data io.Reader, dest string) error
+	OpenFile(ctx context.Context, source string) (io.ReadCloser, error)
 }
 
 type Runner interface {
 	Add(deployment string) (string, error)
-	WaitForRunning(id string) error
-	Wait(id string) (wr.WRJobStatus, error)
+	WaitForRunning(ctx context.Context, id string) error
+	Wait(ctx context.Context, id string) (wr.WRJobStatus, error)
 	Status(id string) (wr.WRJobStatus, error)
+	DetailedStatus(id string) (*wr.JobDetails, error)
+	Kick(id string) error
+	Kill(ctx context.Context, id string) error
 }
 
-// The status of an individual build – when it was requested, when it started
+// Status describes an individual build: when it was requested, when it started
 // actually being built, and when its build finished.
 type Status struct {
-	Name       string
-	Requested  *time.Time
+	// Name is the full environment path of the build, eg. "users/foo/env-1".
+	Name string
+
+	// Requester is the username of the user who last requested the build, if
+	// known.
+	Requester string
+
+	// BuildID identifies the latest build attempt in gsb's logs.
+	BuildID string
+
+	// BuildPath is the S3 working directory of the latest build attempt, whose
+	// artefacts are moved to the environment version's location once it
+	// finishes.
+	BuildPath string
+
+	// Requested is when the build was requested.
+	Requested *time.Time
+
+	// BuildStart is when the build started actually being built.
 	BuildStart *time.Time
-	BuildDone  *time.Time
+
+	// BuildDone is when the build finished.
+	BuildDone *time.Time
+
+	// Deployment is the name of the configured wr deployment the build was
+	// routed to.
+	Deployment string
+
+	// JobID is the build's wr job ID, once it has been added to wr.
+	JobID string
+
+	// WRState is the last known state of the build's wr job.
+	WRState wr.WRJobStatus `json:",omitempty"`
+
+	// WR contains the wr job's state, exit code and resource usage.
+	WR *wr.JobDetails
+
+	// Failure classifies why the wr job got buried, if it did.
+	Failure wr.Failure
+
+	// Retries is how many times the build was retried following a transient
+	// failure.
+	Retries int
+
+	// Error describes why the build failed, if it failed after being added to
+	// wr.
+	Error string
+
+	// Publication describes the publication of the installed build, if CVMFS
+	// publication is configured.
+	Publication *Publication
+
+	// Cache says, once the build has succeeded, how many packages it installed
+	// from the binary cache and how many it built from source.
+	Cache *CacheUse
+
+	// Packages says, if the build failed, which requested packages were built
+	// before the failure.
+	Packages *PackageResults
+
+	// Hooks describes the running of any configured post-build hooks.
+	Hooks []HookResult
+
+	// Provenance records how the build was made: its build ID and the images
+	// and custom spack repo it used. It is recorded when the build is
+	// submitted, and completed when the build succeeds.
+	Provenance *Provenance
+
+	// Queue estimates how long the build's wr job will wait, while it is
+	// waiting to run.
+	Queue *QueueEstimate
+
+	// Owner is the account that owns the environment, and who to contact about
+	// it.
+	Owner *Owner
+
+	// Labels are the key=value labels given in the build's Definition, which
+	// builds can be filtered by.
+	Labels map[string]string
+
+	// Step is what gsb is doing to install the environment
+	// (BuildStageInstallingModule or BuildStageUploadingArtefacts) once its wr
+	// job has succeeded, until it is finished.
+	Step BuildStage `json:",omitempty"`
 }
 
-// Builder lets you do builds given config, S3 and a wr runner.
+// Builder lets you do builds given config, S3 and wr runners.
 type Builder struct {
-	config *config.Config
-	s3     S3
-	runner Runner
+	config        *config.Config
+	s3            S3
+	runners       map[string]Runner
+	inst          *installer
+	coreClient    *http.Client
+	artefacts     *artefactSender
+	replicator    *replicator
+	publisher     *publisher
+	statusWebhook *statusWebhook
+	maintenance   *maintenance
+	quotas        *quotas
+	upgrader      upgrader
+	broken        *brokenPackages
+	teams         *teamContacts
+
+	imageRefreshes   *scheduler
+	upgradeProposals *scheduler
 
 	mu                  sync.Mutex
 	runningEnvironments map[string]bool
+	buildCancels        map[string]*cancellation
+	proposedUpgrades    map[string]bool
 
 	statusMu sync.RWMutex
 	statuses map[string]*Status
+	logTails map[string]*logTail
+
+	imageDigests imageDigests
+	cacheUses    cacheUses
+	statusSubs   statusSubscribers
+	definitions  map[string]*Definition
+	singDefs     map[string]*SubmittedDefinition
 
 	runnerPollInterval time.Duration
 }
@@ -177,12 +534,15 @@ type Builder struct {
 // New takes the s3 build cache URL, the repo and checkout reference of your
 // custom spack repo, and returns a Builder. Optionally, supply objects that
 // satisfy the S3 and Runner interfaces; if nil, these default to using the s3
-// and wr packages.
+// and wr packages. If the config enables replication, an s3 S3 for the replica
+// location is also created. The Runner is used for the default wr deployment; builds
+// routed to any of the config's WRDeployments use a wr Runner for that
+// deployment.
 func New(config *config.Config, s3helper S3, runner Runner) (*Builder, error) {
 	if s3helper == nil {
 		var err error
 
-		s3helper, err = s3.New(config.S3.BuildBase)
+		s3helper, err = s3.New(config.S3.BuildBase, config.Timeouts.S3())
 		if err != nil {
 			return nil, err
 		}
@@ -192,239 +552,904 @@ func New(config *config.Config, s3helper S3, runner Runner) (*Builder, error) {
 		runner = wr.New(config.WRDeployment)
 	}
 
-	return &Builder{
+	inst, err := newInstallerFromConfig(fsys.OS{}, config)
+	if err != nil {
+		return nil, err
+	}
+
+	rep, err := newReplicatorFromConfig(config, s3helper)
+	if err != nil {
+		return nil, err
+	}
+
+	maint, err := newMaintenance(config.Server.MaintenanceFile)
+	if err != nil {
+		return nil, err
+	}
+
+	quotas, err := newQuotas(config.Quotas)
+	if err != nil {
+		return nil, err
+	}
+
+	upgrader, err := newUpgraderFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	imageRefreshes, err := newScheduler(config.Images.Schedule, config.Images.RefreshInterval())
+	if err != nil {
+		return nil, err
+	}
+
+	upgradeProposals, err := newScheduler(config.Upgrades.Schedule, config.Upgrades.Interval())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validateArtefactsConfig(config.Artefacts); err != nil {
+		return nil, err
+	}
+
+	coreClient := &http.Client{Timeout: config.Timeouts.Core()}
+
+	webhook, err := newStatusWebhookFromConfig(config, coreClient)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Builder{
 		config:              config,
 		s3:                  s3helper,
-		runner:              runner,
+		runners:             newRunners(config, runner),
+		inst:                inst,
+		coreClient:          coreClient,
+		artefacts:           newArtefactSender(config, coreClient),
+		replicator:          rep,
+		publisher:           newPublisherFromConfig(config),
+		statusWebhook:       webhook,
+		maintenance:         maint,
+		quotas:              quotas,
+		upgrader:            upgrader,
+		broken:              newBrokenPackages(config.Broken, coreClient),
+		teams:               newTeamContacts(config.Teams, coreClient),
+		imageRefreshes:      imageRefreshes,
+		upgradeProposals:    upgradeProposals,
 		runningEnvironments: make(map[string]bool),
+		buildCancels:        make(map[string]*cancellation),
+		proposedUpgrades:    make(map[string]bool),
 		statuses:            make(map[string]*Status),
+		logTails:            make(map[string]*logTail),
+		definitions:         make(map[string]*Definition),
+		singDefs:            make(map[string]*SubmittedDefinition),
+		imageDigests:        imageDigests{digests: make(map[string]imageDigest)},
+		statusSubs:          newStatusSubscribers(),
 		runnerPollInterval:  1 * time.Second,
+	}
+
+	b.recordQueuedStatuses()
+
+	return b, nil
+}
+
+// newRunners returns the given runner for the default wr deployment, along with
+// wr Runners for each of the configured additional deployments, keyed on their
+// names.
+func newRunners(conf *config.Config, runner Runner) map[string]Runner {
+	runners := map[string]Runner{config.DefaultWRDeployment: runner}
+
+	for _, deployment := range conf.WRDeployments {
+		runners[deployment.Name] = wr.NewRemote(deployment.Deployment, deployment.ManagerHost, deployment.ManagerPort)
+	}
+
+	return runners
+}
+
+type templateVars struct {
+	S3BinaryCache       string
+	Mirrors             []config.Mirror
+	RepoURL             string
+	RepoRef             string
+	RepoTarball         string
+	ProcessorTarget     string
+	BuildBootstrap      string
+	BuildImage          string
+	BaseImage           string
+	FinalBootstrap      string
+	FinalImage          string
+	BuildJobs           int
+	Reuse               bool
+	ExtraExes           []string
+	Packages            []core.Package
+	DefaultPackages     []core.Package
+	FatTargets          []fatTarget
+	Externals           []config.External
+	BrokeredCredentials bool
+	SpackYAML           string
+	RLibsStrategy       string
+	Xvfb                bool
+}
+
+// Status returns the status of all known builds, in the order they were
+// requested. The wr details of builds that haven't finished yet are retrieved
+// from wr at the time of this call.
+func (b *Builder) Status() []Status {
+	statuses, _ := b.QueryStatus(StatusQuery{}) //nolint:errcheck
+
+	return statuses
+}
+
+func (b *Builder) statusSnapshot() []Status {
+	b.statusMu.RLock()
+	defer b.statusMu.RUnlock()
+
+	statuses := make([]Status, 0, len(b.statuses))
+
+	for _, status := range b.statuses {
+		statuses = append(statuses, *status)
+	}
+
+	return statuses
+}
+
+func (b *Builder) addLiveWRDetails(status *Status, loads queueLoads) {
+	if status.JobID == "" || status.BuildDone != nil {
+		return
+	}
+
+	details, err := b.runnerFor(status.Deployment).DetailedStatus(status.JobID)
+	if err != nil {
+		return
+	}
+
+	status.WR = details
+	status.WRState = details.Status()
+
+	b.addQueueEstimate(status, loads)
+}
+
+// Build uploads a singularity.def generated by GenerateSingularityDef() to S3
+// and adds a job to wr to build the image. You'll need a wr manager running
+// that can run jobs with root and access the S3, ie. a cloud deployment.
+//
+// The given context applies to the work done before this returns. The rest of
+// the build happens in the background, and keeps going after the context is
+// cancelled; use Cancel() to stop it.
+//
+// Logs about the build are tagged with a new build ID, and the most recent are
+// available from LogTail().
+//
+// Any configured pre-build hooks may modify the Definition, or reject it with a
+// *PolicyRejection, as will any of its packages being on the configured denylist
+// of broken packages.
+func (b *Builder) Build(ctx context.Context, def *Definition) (err error) {
+	requested := *def
+
+	owner, release, err := b.validateAndAdmit(ctx, def)
+	if err != nil {
+		return err
+	}
+
+	if held, errh := b.holdForMaintenance(def, &requested); held || errh != nil {
+		release()
+
+		return errh
+	}
+
+	var fn func()
+
+	fn, err = b.protectEnvironment(def.FullEnvironmentPath(), &err)
+	if err != nil {
+		release()
+
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			release()
+		}
+
+		fn()
+	}()
+
+	b.buildStatus(def)
+	b.rememberDefinition(def)
+
+	bl := b.newBuildLog(def)
+	ctx = contextWithBuildLog(ctx, bl)
+
+	var singDef string
+
+	s3Path := filepath.Join(def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+	workPath := buildWorkPath(s3Path, bl.id)
+	singDefParentPath := filepath.Join(b.config.S3.BuildBase, workPath)
+
+	status := b.buildStatus(def)
+
+	b.statusMu.Lock()
+	status.BuildPath = singDefParentPath
+	status.Owner = owner
+	b.statusMu.Unlock()
+
+	def.Parent = b.findParent(ctx, def)
+
+	if singDef, err = b.generateAndUploadSingularityDef(ctx, def, workPath); err != nil {
+		return err
+	}
+
+	wrInput, err := b.generateWRInput(ctx, def, singDef, singDefParentPath)
+	if err != nil {
+		return err
+	}
+
+	if err = b.supplyCredentials(ctx, workPath); err != nil {
+		return err
+	}
+
+	buildCtx := b.cancellableBuildContext(ctx, def.FullEnvironmentPath())
+
+	go b.startBuild(buildCtx, def, wrInput, s3Path, workPath, singDef, singDefParentPath)
+
+	return nil
+}
+
+// newBuildLog creates a buildLog for a new build of the given environment,
+// recording its ID in the environment's status and making its logs available
+// to LogTail(). The results of any previous build, including its retries, are
+// cleared from the status.
+func (b *Builder) newBuildLog(def *Definition) *buildLog {
+	status := b.buildStatus(def)
+	buildID := newBuildID()
+	bl := newBuildLog(buildID, def.FullEnvironmentPath())
+
+	b.statusMu.Lock()
+	status.BuildID = buildID
+	status.BuildStart = nil
+	status.BuildDone = nil
+	status.JobID = ""
+	status.WRState = wr.WRJobStatusInvalid
+	status.WR = nil
+	status.Failure = wr.FailureNone
+	status.Retries = 0
+	status.Error = ""
+	status.Publication = nil
+	status.Cache = nil
+	status.Packages = nil
+	status.Hooks = nil
+	status.Provenance = nil
+	status.Step = ""
+	b.logTails[status.Name] = bl.tail
+	b.statusMu.Unlock()
+
+	if def.Requester != "" {
+		bl.With("requester", def.Requester)
+	}
+
+	bl.Logger().Debug("build requested", "packages", len(def.Packages), "force", def.Force, "profile", def.Profile)
+
+	return bl
+}
+
+// generateWRInput returns the wr input for building the given singularity
+// definition file in the given S3 location, reserving the resources and using
+// the limit groups and singularity build options of def's profile, and
+// picking up credentials from our credentials broker, if any (see
+// supplyCredentials()).
+func (b *Builder) generateWRInput(ctx context.Context, def *Definition, singDef,
+	singDefParentPath string) (string, error) {
+	profile, err := b.config.BuildProfile(def.Profile, def.ProcessorTarget)
+	if err != nil {
+		return "", err
+	}
+
+	hash := fmt.Sprintf("%X", sha256.Sum256([]byte(singDef)))
+
+	opts := wr.BuildOptions{
+		Resources: wr.Resources{
+			Memory: profile.Memory,
+			Time:   profile.Time,
+			CPUs:   profile.CPUs,
+			Disk:   profile.Disk,
+		},
+		TestCmd:      def.TestCommand,
+		LimitGroups:  b.config.LimitGroups(profile),
+		Credentials:  b.config.S3.CredentialsBroker != "",
+		Requester:    def.Requester,
+		MaxMinutes:   b.config.Timeouts.BuildMinutes,
+		StallMinutes: b.config.Timeouts.StallMinutes,
+	}
+
+	if sing := profile.Singularity; sing != nil {
+		opts.Fakeroot = sing.Fakeroot
+		opts.BuildFlags = sing.Flags
+		opts.TmpDir = sing.TmpDir
+	}
+
+	return wr.SingularityBuildInS3WRInput(singDefParentPath, hash, opts)
+}
+
+func (b *Builder) buildStatus(def *Definition) *Status {
+	b.statusMu.Lock()
+	defer b.statusMu.Unlock()
+
+	name := filepath.Join(def.EnvironmentPath, def.EnvironmentName) + "-" + def.EnvironmentVersion
+
+	status, exists := b.statuses[name]
+	if !exists {
+		now := time.Now()
+		status = &Status{
+			Name:      name,
+			Requested: &now,
+		}
+
+		b.statuses[name] = status
+	}
+
+	status.Requester = def.Requester
+	status.Labels = def.Labels
+
+	return status
+}
+
+// validateAndAdmit returns an error if the given Definition isn't valid or is
+// rejected by policy, otherwise filling in its defaults and reserving room for
+// its build in its accounts' quotas. It returns the environment's Owner, and a
+// function to release the reservation if the build doesn't go ahead after all.
+func (b *Builder) validateAndAdmit(ctx context.Context, def *Definition) (*Owner, func(), error) {
+	profile, err := b.validateDefinition(ctx, def)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	def.ProcessorTarget = profile.ProcessorTarget
+	def.AutoUpgrade = def.AutoUpgrade || b.takeProposedUpgrade(def)
+	def.Conflicts = mergeModuleNames(b.config.Module.Conflicts, def.Conflicts)
+	def.Prereqs = mergeModuleNames(b.config.Module.Prereqs, def.Prereqs)
+
+	owner := b.owner(ctx, def)
+
+	release, err := b.reserveQuotas(ctx, def, owner)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return owner, release, nil
+}
+
+// validateDefinition returns an error if the given Definition isn't valid, is
+// rejected by a pre-build hook (which may also modify it) or contains broken
+// packages. Otherwise it returns the build profile it should use.
+func (b *Builder) validateDefinition(ctx context.Context, def *Definition) (config.Profile, error) {
+	if err := def.ValidateEnvironment(); err != nil {
+		return config.Profile{}, err
+	}
+
+	if err := def.validateRequester(); err != nil {
+		return config.Profile{}, err
+	}
+
+	if err := b.runPreBuildHooks(ctx, def); err != nil {
+		return config.Profile{}, err
+	}
+
+	if err := b.checkBrokenPackages(ctx, def); err != nil {
+		return config.Profile{}, err
+	}
+
+	profile, err := b.config.BuildProfile(def.Profile, def.ProcessorTarget)
+	if err != nil {
+		return config.Profile{}, err
+	}
+
+	if _, err = b.fatTargets(def, profile); err != nil {
+		return config.Profile{}, err
+	}
+
+	if _, err = b.config.Externals(def.Externals); err != nil {
+		return config.Profile{}, err
+	}
+
+	return profile, config.ValidateModuleNames(def.Conflicts, def.Prereqs)
+}
+
+func (b *Builder) protectEnvironment(envPath string, err *error) (func(), error) {
+	b.mu.Lock()
+
+	if b.runningEnvironments[envPath] {
+		b.mu.Unlock()
+
+		return nil, ErrEnvironmentBuilding
+	}
+
+	b.runningEnvironments[envPath] = true
+
+	b.mu.Unlock()
+
+	return func() {
+		if *err != nil {
+			b.unprotectEnvironment(envPath)
+		}
 	}, nil
 }
 
-type templateVars struct {
-	S3BinaryCache   string
-	RepoURL         string
-	RepoRef         string
-	ProcessorTarget string
-	BuildImage      string
-	FinalImage      string
-	ExtraExes       []string
-	Packages        []core.Package
+func (b *Builder) unprotectEnvironment(envPath string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.runningEnvironments, envPath)
+
+	if b.quotas != nil {
+		b.quotas.finish(envPath)
+	}
+
+	if c, ok := b.buildCancels[envPath]; ok {
+		c.cancel()
+		delete(b.buildCancels, envPath)
+		close(c.done)
+	}
+}
+
+func (b *Builder) generateAndUploadSingularityDef(ctx context.Context, def *Definition,
+	s3Path string) (string, error) {
+	vars, err := b.singularityDefVars(ctx, def)
+	if err != nil {
+		return "", err
+	}
+
+	b.recordProvenance(def, vars)
+
+	singDef, err := executeSingularityTmpl(vars)
+	if err != nil {
+		return "", err
+	}
+
+	b.rememberSingularityDef(def, singDef, vars)
+
+	singDefUploadPath := filepath.Join(s3Path, core.SingularityDefBasename)
+
+	err = b.s3.UploadData(ctx, strings.NewReader(singDef), singDefUploadPath)
+
+	return singDef, err
+}
+
+// generateSingularityDef uses our configured S3 binary cache and custom spack
+// repo details, and the images, processor target and build jobs of the
+// Definition's profile, to create a singularity definition file that will use
+// Spack to build the Packages in the Definition, or its SpackYAML, along with
+// any configured default packages.
+//
+// Base images are only used if the profile's build image is the one they were
+// built from, the configured spack.buildImage. Images are bootstrapped from
+// local copies or a registry mirror, if configured.
+func (b *Builder) generateSingularityDef(ctx context.Context, def *Definition) (string, error) {
+	vars, err := b.singularityDefVars(ctx, def)
+	if err != nil {
+		return "", err
+	}
+
+	return executeSingularityTmpl(vars)
+}
+
+// singularityDefVars returns the templateVars that generateSingularityDef()
+// uses.
+func (b *Builder) singularityDefVars(ctx context.Context, def *Definition) (*templateVars, error) {
+	profile, err := b.config.BuildProfile(def.Profile, def.ProcessorTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	fatTargets, err := b.fatTargets(def, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	externals, err := b.config.Externals(def.Externals)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := &templateVars{
+		S3BinaryCache:       b.config.S3.BinaryCache,
+		Mirrors:             b.config.Spack.Mirrors,
+		RepoURL:             b.config.CustomSpackRepo,
+		ProcessorTarget:     profile.ProcessorTarget,
+		BuildImage:          profile.BuildImage,
+		FinalImage:          profile.FinalImage,
+		BuildJobs:           profile.Jobs(),
+		Reuse:               def.Parent != "",
+		ExtraExes:           def.Interpreters(),
+		Packages:            def.Packages,
+		DefaultPackages:     b.defaultPackages(def),
+		FatTargets:          fatTargets,
+		Externals:           externals,
+		BrokeredCredentials: b.config.S3.CredentialsBroker != "",
+	}
+
+	vars.RLibsStrategy = b.rLibsStrategy(vars.Packages, vars.DefaultPackages)
+	vars.Xvfb = b.needsXvfb(vars.Packages, vars.DefaultPackages)
+
+	if base, path := b.builtBaseImage(def); base != nil && profile.BuildImage == b.config.Spack.BuildImage {
+		vars.BuildImage = path
+		vars.BaseImage = base.Name
+		vars.Reuse = true
+	}
+
+	if err = b.setRepoAndImages(ctx, vars); err != nil {
+		return nil, err
+	}
+
+	if def.SpackYAML != "" {
+		if vars.SpackYAML, err = injectSpackYAML(def.SpackYAML, vars); err != nil {
+			return nil, err
+		}
+	}
+
+	return vars, nil
 }
 
-// Status returns the status of all known builds.
-func (b *Builder) Status() []Status {
-	b.statusMu.RLock()
-	defer b.statusMu.RUnlock()
+// rLibsStrategy returns the configured strategy for dealing with R_LIBS
+// (defaulting to config.RLibsSymlink) if any of the given packages are R or R
+// packages, otherwise returns blank since no strategy is needed.
+func (b *Builder) rLibsStrategy(pkgSets ...[]core.Package) string {
+	for _, pkgs := range pkgSets {
+		for _, pkg := range pkgs {
+			if pkg.Name != "r" && !strings.HasPrefix(pkg.Name, "r-") {
+				continue
+			}
+
+			if b.config.Spack.RLibsStrategy == "" {
+				return config.RLibsSymlink
+			}
+
+			return b.config.Spack.RLibsStrategy
+		}
+	}
 
-	statuses := make([]Status, 0, len(b.statuses))
+	return ""
+}
 
-	for _, status := range b.statuses {
-		statuses = append(statuses, *status)
+// needsXvfb returns true if the installation of the given packages should be
+// done with xvfb-run providing a virtual X server, according to our config's
+// spack.xvfbPackages.
+func (b *Builder) needsXvfb(pkgSets ...[]core.Package) bool {
+	var names []string
+
+	for _, pkgs := range pkgSets {
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Name)
+		}
 	}
 
-	return statuses
+	return b.config.NeedsXvfb(names...)
 }
 
-// Build uploads a singularity.def generated by GenerateSingularityDef() to S3
-// and adds a job to wr to build the image. You'll need a wr manager running
-// that can run jobs with root and access the S3, ie. a cloud deployment.
-func (b *Builder) Build(def *Definition) (err error) {
-	b.buildStatus(def)
+func executeSingularityTmpl(vars *templateVars) (string, error) {
+	var w strings.Builder
+	err := singularityTmpl.Execute(&w, vars)
 
-	var fn func()
+	return w.String(), err
+}
 
-	fn, err = b.protectEnvironment(def.FullEnvironmentPath(), &err)
-	if err != nil {
-		return err
+func (b *Builder) startBuild(ctx context.Context, def *Definition, wrInput, s3Path, workPath, singDef,
+	singDefParentPath string) {
+	defer b.unprotectEnvironment(def.FullEnvironmentPath())
+
+	err := b.asyncBuild(ctx, def, wrInput, s3Path, workPath, singDef)
+	if ctx.Err() != nil {
+		b.stopCancelledBuild(ctx, def, workPath)
 	}
 
-	defer fn()
+	if err != nil {
+		loggerFromContext(ctx).Error("Async part of build failed", "err", err.Error(), "s3Path", singDefParentPath)
 
-	var singDef, wrInput string
+		status := b.buildStatus(def)
 
-	s3Path := filepath.Join(def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+		b.statusMu.Lock()
+		status.Error = err.Error()
+		status.Step = ""
+		b.statusMu.Unlock()
 
-	if singDef, err = b.generateAndUploadSingularityDef(def, s3Path); err != nil {
-		return err
+		b.notifyStatusChange(ctx, status)
 	}
 
-	hash := fmt.Sprintf("%X", sha256.Sum256([]byte(singDef)))
+	b.runHooks(ctx, def, err)
+}
 
-	singDefParentPath := filepath.Join(b.config.S3.BuildBase, s3Path)
+func (b *Builder) asyncBuild(ctx context.Context, def *Definition, wrInput, s3Path, workPath, singDef string) error {
+	status := b.buildStatus(def)
+	runner := b.routeBuild(ctx, def, status)
 
-	wrInput, err = wr.SingularityBuildInS3WRInput(singDefParentPath, hash)
+	jobID, err := b.addJob(ctx, runner, status, wrInput)
 	if err != nil {
 		return err
 	}
 
-	go b.startBuild(def, wrInput, s3Path, singDef, singDefParentPath)
-
-	return nil
-}
-
-func (b *Builder) buildStatus(def *Definition) *Status {
-	b.statusMu.Lock()
-	defer b.statusMu.Unlock()
+	wrStatus, err := b.runJob(ctx, runner, status, workPath, jobID)
+	if err != nil || wrStatus != wr.WRJobStatusComplete {
+		return b.handleFailedBuild(ctx, def, status, s3Path, workPath, err)
+	}
 
-	name := filepath.Join(def.EnvironmentPath, def.EnvironmentName) + "-" + def.EnvironmentVersion
+	if err = b.promoteBuild(ctx, workPath, s3Path, builtFiles[:], false); err != nil {
+		return err
+	}
 
-	status, exists := b.statuses[name]
-	if !exists {
-		now := time.Now()
-		status = &Status{
-			Name:      name,
-			Requested: &now,
-		}
+	b.recordCacheUse(ctx, status, s3Path)
 
-		b.statuses[name] = status
+	exes, err := b.getExes(ctx, s3Path)
+	if err != nil {
+		return err
 	}
 
-	return status
-}
+	moduleFileData, err := b.installEnvironment(ctx, def, s3Path, exes)
+	if err != nil {
+		return err
+	}
 
-func (b *Builder) protectEnvironment(envPath string, err *error) (func(), error) {
-	b.mu.Lock()
+	loggerFromContext(ctx).Debug("installed environment", "exes", len(exes))
 
-	if b.runningEnvironments[envPath] {
-		b.mu.Unlock()
+	b.setStep(ctx, status, BuildStageUploadingArtefacts)
 
-		return nil, ErrEnvironmentBuilding
+	if err = b.prepareArtifactsFromS3AndSendToCoreAndS3(ctx, def, s3Path, moduleFileData, singDef, exes); err != nil {
+		return err
 	}
 
-	b.runningEnvironments[envPath] = true
+	b.setStep(ctx, status, "")
 
-	b.mu.Unlock()
+	b.publishToCVMFS(ctx, def)
+	b.replicate(ctx, def, s3Path)
 
-	return func() {
-		if *err != nil {
-			b.unprotectEnvironment(envPath)
-		}
-	}, nil
+	return nil
 }
 
-func (b *Builder) unprotectEnvironment(envPath string) {
-	b.mu.Lock()
-	delete(b.runningEnvironments, envPath)
-	b.mu.Unlock()
+// setStep records the given Step in the status, and notifies about the change
+// of stage.
+func (b *Builder) setStep(ctx context.Context, status *Status, step BuildStage) {
+	b.statusMu.Lock()
+	status.Step = step
+	b.statusMu.Unlock()
+
+	b.notifyStatusChange(ctx, status)
 }
 
-func (b *Builder) generateAndUploadSingularityDef(def *Definition, s3Path string) (string, error) {
-	singDef, err := b.generateSingularityDef(def)
-	if err != nil {
-		return "", err
-	}
+// routeBuild returns the Runner for the wr deployment the build of the given
+// Definition should run in, recording the deployment's name in the status.
+func (b *Builder) routeBuild(ctx context.Context, def *Definition, status *Status) Runner {
+	deployment := b.config.WRDeploymentFor(def.Profile, def.ProcessorTarget, def.FullEnvironmentPath())
 
-	singDefUploadPath := filepath.Join(s3Path, core.SingularityDefBasename)
+	b.statusMu.Lock()
+	status.Deployment = deployment
+	b.statusMu.Unlock()
 
-	err = b.s3.UploadData(strings.NewReader(singDef), singDefUploadPath)
+	loggerFromContext(ctx).Debug("routed build to wr deployment", "deployment", deployment)
 
-	return singDef, err
+	return b.runnerFor(deployment)
 }
 
-// generateSingularityDef uses our configured S3 binary cache and custom spack
-// repo details to create a singularity definition file that will use Spack to
-// build the Packages in the Definition.
-func (b *Builder) generateSingularityDef(def *Definition) (string, error) {
-	repoRef, err := git.GetLatestCommit(b.config.CustomSpackRepo)
+// runnerFor returns the Runner for the named wr deployment, falling back to
+// the default deployment's.
+func (b *Builder) runnerFor(deployment string) Runner {
+	if runner, ok := b.runners[deployment]; ok {
+		return runner
+	}
+
+	return b.runners[config.DefaultWRDeployment]
+}
+
+// addJob adds the build job to wr, recording its ID in the status and adding
+// it to the build's logger.
+func (b *Builder) addJob(ctx context.Context, runner Runner, status *Status, wrInput string) (string, error) {
+	jobID, err := runner.Add(wrInput)
 	if err != nil {
 		return "", err
 	}
 
-	var w strings.Builder
-	err = singularityTmpl.Execute(&w, &templateVars{
-		S3BinaryCache:   b.config.S3.BinaryCache,
-		RepoURL:         b.config.CustomSpackRepo,
-		RepoRef:         repoRef,
-		ProcessorTarget: b.config.Spack.ProcessorTarget,
-		BuildImage:      b.config.Spack.BuildImage,
-		FinalImage:      b.config.Spack.FinalImage,
-		ExtraExes:       def.Interpreters(),
-		Packages:        def.Packages,
-	})
-
-	return w.String(), err
-}
+	b.statusMu.Lock()
+	status.JobID = jobID
+	b.statusMu.Unlock()
 
-func (b *Builder) startBuild(def *Definition, wrInput, s3Path, singDef, singDefParentPath string) {
-	defer b.unprotectEnvironment(def.FullEnvironmentPath())
+	b.notifyStatusChange(ctx, status)
 
-	if err := b.asyncBuild(def, wrInput, s3Path, singDef); err != nil {
-		slog.Error("Async part of build failed", "err", err.Error(), "s3Path", singDefParentPath)
+	if bl := buildLogFromContext(ctx); bl != nil {
+		bl.With("jobID", jobID)
 	}
+
+	loggerFromContext(ctx).Debug("added build job to wr")
+
+	return jobID, nil
 }
 
-func (b *Builder) asyncBuild(def *Definition, wrInput, s3Path, singDef string) error {
-	status := b.buildStatus(def)
+// runJob waits for the given wr job to start running and then exit, recording
+// the times in the status. If the job succeeded, the status's Step becomes
+// BuildStageInstallingModule.
+func (b *Builder) runJob(ctx context.Context, runner Runner, status *Status,
+	workPath, jobID string) (wr.WRJobStatus, error) {
+	logger := loggerFromContext(ctx)
 
-	jobID, err := b.runner.Add(wrInput)
-	if err != nil {
-		return err
+	if err := runner.WaitForRunning(ctx, jobID); err != nil {
+		return wr.WRJobStatusInvalid, err
 	}
 
-	err = b.runner.WaitForRunning(jobID)
-	if err != nil {
-		return err
-	}
+	logger.Debug("build job started running")
 
 	b.statusMu.Lock()
 	buildStart := time.Now()
 	status.BuildStart = &buildStart
+	status.WRState = wr.WRJobStatusRunning
 	b.statusMu.Unlock()
 
-	wrStatus, err := b.runner.Wait(jobID)
+	b.notifyStatusChange(ctx, status)
+
+	wrStatus, err := b.waitForJob(ctx, runner, status, workPath, jobID)
 
 	b.statusMu.Lock()
 	buildDone := time.Now()
 	status.BuildDone = &buildDone
+
+	if err == nil && wrStatus == wr.WRJobStatusComplete {
+		status.Step = BuildStageInstallingModule
+	}
 	b.statusMu.Unlock()
 
-	if err != nil || wrStatus != wr.WRJobStatusComplete {
-		b.addLogToRepo(s3Path, def.FullEnvironmentPath())
+	b.notifyStatusChange(ctx, status)
+
+	logger.Debug("build job exited", "status", wrStatus.String())
+
+	return wrStatus, err
+}
+
+// handleFailedBuild moves the definition and build log out of the build's
+// working directory, records which packages were built, and sends the log to
+// core, unless the build was cancelled, and returns the given error, or
+// ErrBuildFailed if nil. If the log isn't in S3 (eg. because the job's S3 mount
+// failed), the output wr captured for the job is sent to core instead.
+func (b *Builder) handleFailedBuild(ctx context.Context, def *Definition, status *Status, s3Path, workPath string,
+	err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	logs := b.failureLogs(ctx, workPath)
+
+	if errp := b.promoteBuild(ctx, workPath, s3Path,
+		append([]string{core.SingularityDefBasename, core.BuilderOut}, logs...), true); errp != nil {
+		loggerFromContext(ctx).Error("error moving failed build files", "err", errp)
+	}
+
+	b.recordPackageResults(ctx, def, status, s3Path)
+
+	b.statusMu.Lock()
+	var wrOutput string
+	if status.WR != nil {
+		wrOutput = status.WR.Output()
+	}
+	b.statusMu.Unlock()
+
+	b.addLogToRepo(ctx, s3Path, def.FullEnvironmentPath(), wrOutput, logs)
+
+	if err == nil {
+		err = internal.Error(ErrBuildFailed)
+	}
+
+	return err
+}
 
-		if err == nil {
-			err = internal.Error(ErrBuildFailed)
+// waitForJob waits for the given wr job to exit. If it gets buried for a
+// transient reason (or because it stalled, if so configured), it is kicked to
+// retry it, up to the configured number of retries, with fresh credentials put
+// in its working directory workPath. The wr details and failure classification
+// of the final attempt are recorded in the status.
+func (b *Builder) waitForJob(ctx context.Context, runner Runner, status *Status,
+	workPath, jobID string) (wr.WRJobStatus, error) {
+	for {
+		wrStatus, err := runner.Wait(ctx, jobID)
+		if err != nil {
+			return wrStatus, err
 		}
 
-		return err
+		details, _ := runner.DetailedStatus(jobID) //nolint:errcheck
+		failure := classifyFailure(wrStatus, details)
+
+		b.statusMu.Lock()
+		status.WRState = wrStatus
+		status.WR = details
+		status.Failure = failure
+		retry := b.retryable(failure) && status.Retries < b.maxRetries()
+		b.statusMu.Unlock()
+
+		if !retry {
+			return wrStatus, nil
+		}
+
+		loggerFromContext(ctx).Info("retrying build after "+string(failure)+" failure", "reason", details.FailReason)
+
+		if err = b.supplyCredentials(ctx, workPath); err != nil {
+			return wrStatus, err
+		}
+
+		if err = runner.Kick(jobID); err != nil {
+			return wrStatus, err
+		}
+
+		b.statusMu.Lock()
+		status.Retries++
+		b.statusMu.Unlock()
 	}
+}
 
-	exes, err := b.getExes(s3Path)
-	if err != nil {
-		return err
+func classifyFailure(wrStatus wr.WRJobStatus, details *wr.JobDetails) wr.Failure {
+	if wrStatus != wr.WRJobStatusBuried {
+		return wr.FailureNone
 	}
 
-	moduleFileData := def.ToModule(b.config.Module.ScriptsInstallDir, b.config.Module.Dependencies, exes)
+	if details == nil || details.Status() != wr.WRJobStatusBuried {
+		return wr.FailureBuild
+	}
 
-	if err = b.prepareAndInstallArtifacts(def, s3Path, moduleFileData, exes); err != nil {
-		return err
+	return details.Classify()
+}
+
+// retryable returns true if builds that failed in the given way should be
+// retried.
+func (b *Builder) retryable(failure wr.Failure) bool {
+	return failure == wr.FailureTransient || (failure == wr.FailureStall && b.config.Timeouts.RetryStalls)
+}
+
+func (b *Builder) maxRetries() int {
+	if b.config.WRRetries == 0 {
+		return defaultRetries
 	}
 
-	return b.prepareArtifactsFromS3AndSendToCoreAndS3(def, s3Path, moduleFileData, singDef, exes)
+	return b.config.WRRetries
 }
 
-func (b *Builder) addLogToRepo(s3Path, environmentPath string) {
-	log, err := b.s3.OpenFile(filepath.Join(s3Path, core.BuilderOut))
+func (b *Builder) addLogToRepo(ctx context.Context, s3Path, environmentPath, wrOutput string,
+	logs []string) {
+	artifacts := make(map[string]io.Reader, len(logs)+1) //nolint:misspell
+
+	rc, err := b.s3.OpenFile(ctx, filepath.Join(s3Path, core.BuilderOut))
 	if err != nil {
-		slog.Error("error getting build log file", "err", err)
+		loggerFromContext(ctx).Error("error getting build log file", "err", err)
+
+		if wrOutput != "" {
+			artifacts[core.BuilderOut] = strings.NewReader(wrOutput)
+		}
+	} else {
+		defer rc.Close()
+
+		artifacts[core.BuilderOut] = rc
+	}
+
+	for _, log := range logs {
+		lrc, err := b.s3.OpenFile(ctx, filepath.Join(s3Path, log))
+		if err != nil {
+			loggerFromContext(ctx).Warn("error getting package build log file", "file", log, "err", err)
+
+			continue
+		}
 
+		defer lrc.Close()
+
+		artifacts[log] = lrc
+	}
+
+	if len(artifacts) == 0 {
 		return
 	}
 
-	if err := b.addArtifactsToRepo(map[string]io.Reader{
-		core.BuilderOut: log,
-	}, environmentPath); err != nil {
-		slog.Error("error sending build log file to core", "err", err)
+	if err := b.addArtifactsToRepo(ctx, artifacts, environmentPath); err != nil {
+		loggerFromContext(ctx).Error("error sending build log file to core", "err", err)
 	}
 }
 
-func (b *Builder) getExes(s3Path string) ([]string, error) {
-	exeData, err := b.s3.OpenFile(filepath.Join(s3Path, core.ExesBasename))
+func (b *Builder) getExes(ctx context.Context, s3Path string) ([]string, error) {
+	exeData, err := b.s3.OpenFile(ctx, filepath.Join(s3Path, core.ExesBasename))
 	if err != nil {
 		return nil, err
 	}
 
+	defer exeData.Close()
+
 	buf, err := io.ReadAll(exeData)
 	if err != nil {
 		return nil, err
@@ -433,61 +1458,131 @@ func (b *Builder) getExes(s3Path string) ([]string, error) {
 	return strings.Split(strings.TrimSpace(string(buf)), "\n"), nil
 }
 
-func (b *Builder) prepareAndInstallArtifacts(def *Definition, s3Path,
+// installEnvironment installs the given Definition's module and scripts, with
+// the scripts placed by placeScripts(), returning the module file contents.
+func (b *Builder) installEnvironment(ctx context.Context, def *Definition, s3Path string,
+	exes []string) (string, error) {
+	scriptsBase, err := b.placeScripts(ctx, def)
+	if err != nil {
+		return "", err
+	}
+
+	moduleFileData := def.ToModule(scriptsBase, b.config.Module.Dependencies, exes)
+
+	if err = b.validateModule(ctx, moduleFileData); err != nil {
+		return "", err
+	}
+
+	return moduleFileData, b.prepareAndInstallArtifacts(ctx, def, s3Path, scriptsBase, moduleFileData, exes)
+}
+
+func (b *Builder) prepareAndInstallArtifacts(ctx context.Context, def *Definition, s3Path, scriptsBase,
 	moduleFileData string, exes []string) error {
-	imageData, err := b.s3.OpenFile(filepath.Join(s3Path, core.ImageBasename))
+	imageData, err := b.s3.OpenFile(ctx, filepath.Join(s3Path, core.ImageBasename))
 	if err != nil {
 		return err
 	}
 
 	defer imageData.Close()
 
-	return installModule(b.config.Module.ScriptsInstallDir, b.config.Module.ModuleInstallDir, def,
-		strings.NewReader(moduleFileData), imageData, exes, b.config.Module.WrapperScript)
+	image := &countingReader{r: imageData}
+
+	if err = b.inst.installModule(scriptsBase, b.config.Module.ModuleInstallDir, def,
+		strings.NewReader(moduleFileData), image, exes, b.config.Module.WrapperScript); err != nil {
+		return err
+	}
+
+	b.recordInstalledImage(ctx, def, image.n)
+
+	if err = b.inst.updateDefaultVersion(ModuleDirFromName(b.config.Module.ModuleInstallDir, def.EnvironmentPath,
+		def.EnvironmentName), b.config.Module.DefaultVersion); err != nil {
+		return err
+	}
+
+	if err = b.installKernelSpecs(def); err != nil {
+		return err
+	}
+
+	if err = b.installCompletions(def, exes); err != nil {
+		return err
+	}
+
+	return b.installRStudio(def)
 }
 
-func (b *Builder) prepareArtifactsFromS3AndSendToCoreAndS3(def *Definition, s3Path,
+func (b *Builder) prepareArtifactsFromS3AndSendToCoreAndS3(ctx context.Context, def *Definition, s3Path,
 	moduleFileData, singDef string, exes []string) error {
-	logData, lockData, err := b.getArtifactDataFromS3(s3Path)
+	logData, lockData, err := b.getArtifactDataFromS3(ctx, s3Path)
 	if err != nil {
 		return err
 	}
 
-	concreteSpackYAMLFile, err := b.generateAndUploadSoftpackYAML(lockData, def.Description, exes, s3Path)
+	defer logData.Close()
+
+	concreteSpackYAMLFile, err := b.generateAndUploadSoftpackYAML(ctx, lockData, def, exes, s3Path)
 	if err != nil {
 		return err
 	}
 
-	readme, err := b.generateAndUploadUsageFile(def, s3Path)
+	readme, err := b.generateAndUploadUsageFile(ctx, def, s3Path)
 	if err != nil {
 		return err
 	}
 
-	return b.addArtifactsToRepo(
-		map[string]io.Reader{
-			core.SpackLockFile:          bytes.NewReader(lockData),
-			core.SoftpackYaml:           strings.NewReader(concreteSpackYAMLFile),
-			core.SingularityDefBasename: strings.NewReader(singDef),
-			core.BuilderOut:             logData,
-			core.ModuleForCoreBasename:  strings.NewReader(moduleFileData),
-			core.UsageBasename:          strings.NewReader(readme),
-		},
-		def.FullEnvironmentPath(),
-	)
+	defaults := map[string]io.Reader{
+		core.SpackLockFile:          bytes.NewReader(lockData),
+		core.SoftpackYaml:           strings.NewReader(concreteSpackYAMLFile),
+		core.SingularityDefBasename: strings.NewReader(singDef),
+		core.BuilderOut:             logData,
+		core.ModuleForCoreBasename:  strings.NewReader(moduleFileData),
+		core.UsageBasename:          strings.NewReader(readme),
+	}
+
+	if def.SpackYAML != "" {
+		if err = b.s3.UploadData(ctx, strings.NewReader(def.SpackYAML),
+			filepath.Join(s3Path, core.SpackYAMLBasename)); err != nil {
+			return err
+		}
+
+		defaults[core.SpackYAMLBasename] = strings.NewReader(def.SpackYAML)
+	}
+
+	provenance, err := b.generateAndUploadProvenance(ctx, def, s3Path)
+	if err != nil {
+		return err
+	}
+
+	defaults[core.ProvenanceBasename] = bytes.NewReader(provenance)
+
+	artefacts, err := b.coreArtefacts(def, defaults)
+	if err != nil {
+		return err
+	}
+
+	if err = b.addArtifactsToRepo(ctx, artefacts, def.FullEnvironmentPath()); err != nil {
+		return err
+	}
+
+	b.cacheMetadata(ctx, filepath.Join(def.EnvironmentPath, def.EnvironmentName), def.EnvironmentVersion,
+		[][]byte{[]byte(concreteSpackYAMLFile), lockData})
+
+	return nil
 }
 
-func (b *Builder) getArtifactDataFromS3(s3Path string) (io.Reader, []byte, error) {
-	logData, err := b.s3.OpenFile(filepath.Join(s3Path, core.BuilderOut))
+func (b *Builder) getArtifactDataFromS3(ctx context.Context, s3Path string) (io.ReadCloser, []byte, error) {
+	lockFile, err := b.s3.OpenFile(ctx, filepath.Join(s3Path, core.SpackLockFile))
 	if err != nil {
 		return nil, nil, err
 	}
 
-	lockFile, err := b.s3.OpenFile(filepath.Join(s3Path, core.SpackLockFile))
+	lockData, err := io.ReadAll(lockFile)
+	lockFile.Close()
+
 	if err != nil {
 		return nil, nil, err
 	}
 
-	lockData, err := io.ReadAll(lockFile)
+	logData, err := b.s3.OpenFile(ctx, filepath.Join(s3Path, core.BuilderOut))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -495,14 +1590,21 @@ func (b *Builder) getArtifactDataFromS3(s3Path string) (io.Reader, []byte, error
 	return logData, lockData, nil
 }
 
-func (b *Builder) generateAndUploadSoftpackYAML(lockData []byte, description string,
+func (b *Builder) generateAndUploadSoftpackYAML(ctx context.Context, lockData []byte, def *Definition,
 	exes []string, s3Path string) (string, error) {
-	concreteSoftpackYAMLFile, err := SpackLockToSoftPackYML(lockData, description, exes)
+	concreteSoftpackYAMLFile, err := spackLockToSoftPackYML(lockData, softpackTemplateVars{
+		Description:     descriptionLines(def.Description),
+		Exes:            exes,
+		Parent:          def.Parent,
+		ProcessorTarget: def.ProcessorTarget,
+		AutoUpgrade:     def.AutoUpgrade,
+		Labels:          def.Labels,
+	}, packageNames(b.defaultPackages(def)))
 	if err != nil {
 		return "", err
 	}
 
-	if err = b.s3.UploadData(strings.NewReader(concreteSoftpackYAMLFile),
+	if err = b.s3.UploadData(ctx, strings.NewReader(concreteSoftpackYAMLFile),
 		filepath.Join(s3Path, core.SoftpackYaml)); err != nil {
 		return "", err
 	}
@@ -522,9 +1624,14 @@ type SpackLock struct {
 }
 
 type softpackTemplateVars struct {
-	Description []string
-	Packages    []ConcreteSpec
-	Exes        []string
+	Description     []string
+	Packages        []ConcreteSpec
+	DefaultPackages []ConcreteSpec
+	Exes            []string
+	Parent          string
+	ProcessorTarget string
+	AutoUpgrade     bool
+	Labels          map[string]string
 }
 
 // SpackLockToSoftPackYML uses the given spackLockData to generate a
@@ -544,105 +1651,60 @@ type softpackTemplateVars struct {
 //   - supplied_package_2@v1.1
 //   - ...
 func SpackLockToSoftPackYML(spackLockData []byte, desc string, exes []string) (string, error) {
+	return spackLockToSoftPackYML(spackLockData, softpackTemplateVars{
+		Description: descriptionLines(desc),
+		Exes:        exes,
+	}, nil)
+}
+
+// spackLockToSoftPackYML is like SpackLockToSoftPackYML, but with all the
+// template vars given, and the root specs with the given defaultPackages names
+// listed separately from the requested packages.
+func spackLockToSoftPackYML(spackLockData []byte, vars softpackTemplateVars,
+	defaultPackages map[string]bool) (string, error) {
 	var sl SpackLock
 
 	if err := json.Unmarshal(spackLockData, &sl); err != nil {
 		return "", err
 	}
 
-	concreteSpecs := make([]ConcreteSpec, len(sl.Roots))
+	concreteSpecs := make([]ConcreteSpec, 0, len(sl.Roots))
 
-	for i, root := range sl.Roots {
+	for _, root := range sl.Roots {
 		concrete, ok := sl.ConcreteSpecs[root.Hash]
 		if !ok {
 			return "", ErrInvalidJSON
 		}
 
-		concreteSpecs[i] = concrete
+		if defaultPackages[concrete.Name] {
+			vars.DefaultPackages = append(vars.DefaultPackages, concrete)
+		} else {
+			concreteSpecs = append(concreteSpecs, concrete)
+		}
 	}
 
 	var sb strings.Builder
 
-	if err := softpackTmpl.Execute(&sb, softpackTemplateVars{
-		Description: strings.Split(desc, "\n"),
-		Packages:    concreteSpecs,
-		Exes:        exes,
-	}); err != nil {
+	vars.Packages = concreteSpecs
+
+	if err := softpackTmpl.Execute(&sb, vars); err != nil {
 		return "", err
 	}
 
 	return sb.String(), nil
 }
 
-func (b *Builder) generateAndUploadUsageFile(def *Definition, s3Path string) (string, error) {
-	readme := def.ModuleUsage(b.config.Module.LoadPath)
+func (b *Builder) generateAndUploadUsageFile(ctx context.Context, def *Definition, s3Path string) (string, error) {
+	readme := def.ModuleUsage(b.config.Module.LoadPath, b.config.Module.KernelsDir, b.completionsDir(def))
 
-	if err := b.s3.UploadData(strings.NewReader(readme), filepath.Join(s3Path, core.UsageBasename)); err != nil {
+	if err := b.s3.UploadData(ctx, strings.NewReader(readme), filepath.Join(s3Path, core.UsageBasename)); err != nil {
 		return "", err
 	}
 
 	return readme, nil
 }
 
-func (b *Builder) addArtifactsToRepo(artifacts map[string]io.Reader, envPath string) error { //nolint:misspell
-	pr, pw := io.Pipe()
-	writer := multipart.NewWriter(pw)
-	errCh := make(chan error, 1)
-
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	defer cancelFunc()
-
-	go func() {
-		errCh <- sendFormFiles(artifacts, writer, pw) //nolint:misspell
-	}()
-
-	defer pw.Close()
-
-	uploadURL := strings.TrimSuffix(b.config.CoreURL, "/") + uploadEndpoint + "?" + url.QueryEscape(envPath)
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, pr)
-	if err != nil {
-		return err
-	}
-
-	req.Header.Add("Content-Type", writer.FormDataContentType())
-
-	resp, err := http.DefaultClient.Do(req)
-	slog.Debug("addArtifactsToRepo", "url", b.config.CoreURL+uploadEndpoint+"?"+url.QueryEscape(envPath), "err", err)
-
-	if err != nil {
-		return err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		var sb strings.Builder
-
-		io.Copy(&sb, resp.Body) //nolint:errcheck
-
-		return internal.Error(sb.String())
-	}
-
-	return <-errCh
-}
-
-func sendFormFiles(artifacts map[string]io.Reader, //nolint:misspell
-	writer *multipart.Writer, writerInput io.Closer) error {
-	for name, r := range artifacts { //nolint:misspell
-		part, err := writer.CreateFormFile("file", name)
-		if err != nil {
-			return err
-		}
-
-		_, err = io.Copy(part, r)
-		if err != nil {
-			return err
-		}
-	}
-
-	err := writer.Close()
-	if err != nil {
-		return err
-	}
-
-	return writerInput.Close()
+func (b *Builder) addArtifactsToRepo(ctx context.Context, artifacts map[string]io.Reader, //nolint:misspell
+	envPath string) error {
+	return b.artefacts.send(ctx, artifacts, envPath) //nolint:misspell
 }
@@ -24,7 +24,10 @@
 package build
 
 import (
+	"context"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -63,8 +66,8 @@ func (m *modifyRunner) Add(_ string) (string, error) {
 	return jobID, err
 }
 
-func (m *modifyRunner) Wait(id string) (wr.WRJobStatus, error) {
-	status, err := m.Runner.Wait(id)
+func (m *modifyRunner) Wait(ctx context.Context, id string) (wr.WRJobStatus, error) {
+	status, err := m.Runner.Wait(ctx, id)
 
 	return status, err
 }
@@ -73,6 +76,103 @@ func (m *modifyRunner) Status(id string) (wr.WRJobStatus, error) {
 	return m.Runner.Status(id)
 }
 
+func TestDefinitionValidation(t *testing.T) {
+	Convey("Definitions with unsafe paths, names or versions are invalid", t, func() {
+		for _, test := range [...]struct {
+			envPath, name, version string
+			err                    error
+		}{
+			{"users/user/", "env", "1", nil},
+			{"groups/hgi", "env", "1.0_beta+2", nil},
+			{"users/../../etc/", "env", "1", ErrInvalidEnvPath},
+			{"users/../", "env", "1", ErrInvalidEnvPath},
+			{"users/./", "env", "1", ErrInvalidEnvPath},
+			{"users/", "env", "1", ErrInvalidEnvPath},
+			{"users/a/b/", "env", "1", ErrInvalidEnvPath},
+			{"other/user/", "env", "1", ErrInvalidEnvPath},
+			{"/users/user/", "env", "1", ErrInvalidEnvPath},
+			{"users/user/", "", "1", ErrInvalidEnvName},
+			{"users/user/", "..", "1", ErrInvalidEnvName},
+			{"users/user/", "a/b", "1", ErrInvalidEnvName},
+			{"users/user/", ".hidden", "1", ErrInvalidEnvName},
+			{"users/user/", "env", "", ErrInvalidVersion},
+			{"users/user/", "env", "../1", ErrInvalidVersionFormat},
+			{"users/user/", "env", "1 2", ErrInvalidVersionFormat},
+		} {
+			def := &Definition{
+				EnvironmentPath:    test.envPath,
+				EnvironmentName:    test.name,
+				EnvironmentVersion: test.version,
+			}
+
+			So(def.ValidateEnvironment(), ShouldEqual, test.err)
+		}
+
+		So(ValidateEnvironmentPath("users/user/env", "1"), ShouldBeNil)
+		So(ValidateEnvironmentPath("users/user/../../env", "1"), ShouldEqual, ErrInvalidEnvPath)
+		So(ValidateEnvironmentPath("users/user/env", ".."), ShouldEqual, ErrInvalidVersionFormat)
+	})
+
+	Convey("Definitions with package names or versions that could inject commands are invalid", t, func() {
+		for _, test := range [...]struct {
+			name, version string
+			err           error
+		}{
+			{"xxhash", "0.8.1", nil},
+			{"py-anndata", "", nil},
+			{"r-seurat", "4.4:", nil},
+			{"libfoo", "git.v1.0=1.0", nil},
+			{"", "1", core.ErrNoPackageName},
+			{`x"; rm -rf /; "`, "", core.ErrInvalidPackageName},
+			{"[exec rm -rf /]", "", core.ErrInvalidPackageName},
+			{"$(touch /tmp/pwned)", "", core.ErrInvalidPackageName},
+			{"`reboot`", "", core.ErrInvalidPackageName},
+			{"xxhash\nEOF\nreboot", "", core.ErrInvalidPackageName},
+			{"-xxhash", "", core.ErrInvalidPackageName},
+			{"xxhash", "1 2", core.ErrInvalidPackageVersion},
+			{"xxhash", "1;reboot", core.ErrInvalidPackageVersion},
+			{"xxhash", "$HOME", core.ErrInvalidPackageVersion},
+			{"xxhash", "1\"}", core.ErrInvalidPackageVersion},
+		} {
+			def := getExampleDefinition()
+			def.Packages = core.Packages{{Name: test.name, Version: test.version}}
+
+			So(def.Validate(), ShouldEqual, test.err)
+		}
+	})
+
+	Convey("Definitions can have labels with safe keys and values", t, func() {
+		def := getExampleDefinition()
+		def.Labels = map[string]string{"project": "cancer-atlas", "tier": "production", "owner.email": "a@b.org"}
+		So(def.Validate(), ShouldBeNil)
+		So(def.LabelList(), ShouldEqual, "owner.email=a@b.org,project=cancer-atlas,tier=production")
+
+		for key, value := range map[string]string{
+			"":        "x",
+			"x":       "",
+			"a b":     "x",
+			"a=b":     "x",
+			"z":       "a,b",
+			"$(boom)": "x",
+			"y":       "\"quoted\"",
+		} {
+			def.Labels = map[string]string{key: value}
+			So(def.Validate(), ShouldEqual, ErrInvalidLabel)
+		}
+
+		key, value, err := ParseLabel("tier=production")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "tier")
+		So(value, ShouldEqual, "production")
+
+		_, _, err = ParseLabel("tier")
+		So(err, ShouldEqual, ErrInvalidLabel)
+
+		_, _, err = ParseLabel("tier=a b")
+		So(err, ShouldEqual, ErrInvalidLabel)
+	})
+}
+
 func TestBuilder(t *testing.T) {
 	Convey("Given binary cache and spack repo details and a Definition", t, func() {
 		ms3 := &s3mock.MockS3{}
@@ -99,7 +199,7 @@ func TestBuilder(t *testing.T) {
 		def := getExampleDefinition()
 
 		Convey("You can generate a singularity .def", func() {
-			defFile, err := builder.generateSingularityDef(def)
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
 
 			So(err, ShouldBeNil)
 			//nolint:lll
@@ -118,7 +218,7 @@ Stage: build
 
 	# Create the manifest file for the installation in /opt/spack-environment
 	mkdir /opt/spack-environment && cd /opt/spack-environment
-	cat << EOF > spack.yaml
+	cat << 'EOF' > spack.yaml
 spack:
   # add package specs to the specs list
   specs:
@@ -143,6 +243,7 @@ EOF
 	spack mirror add s3cache "s3://spack"
 	spack buildcache keys --install --trust
 	if bash -c "type -P xvfb-run" > /dev/null; then
+		echo "Installing with xvfb-run providing a virtual X server"
 		xvfb-run -a spack -e . install --fail-fast
 	else
 		spack -e . install --fail-fast
@@ -202,13 +303,326 @@ Stage: final
 				expectedSubstring := "git clone \"" + repoURL + "\" \"$tmpDir\"\n" +
 					"\tgit -C \"$tmpDir\" checkout \"" + repoCommit + "\""
 
-				defFile, err := builder.generateSingularityDef(def)
+				defFile, err := builder.generateSingularityDef(context.Background(), def)
 
 				So(err, ShouldBeNil)
 				So(defFile, ShouldContainSubstring, expectedSubstring)
 			})
 		})
 
+		Convey("Builds can use additional spack mirrors", func() {
+			conf.Spack.Mirrors = []config.Mirror{
+				{Name: "source", URL: "https://mirror.example.org/spack", Type: "source"},
+				{Name: "upstream", URL: "https://binaries.spack.io/v0.21.0", Type: "binary", TrustKeys: true},
+				{Name: "local", URL: "file:///mirror", Unsigned: true, KeyFile: "/path/to/key.pub"},
+			}
+
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldContainSubstring, "\t/home/ubuntu/spack/opt/spack/gpg /opt/spack/opt/spack/gpg\n"+
+				"\t/path/to/key.pub /opt/spack-mirror-keys/local.pub\n\n%post\n")
+			So(defFile, ShouldContainSubstring, "\tspack mirror add s3cache \"s3://spack\"\n"+
+				"\tspack mirror add --type binary upstream \"https://binaries.spack.io/v0.21.0\"\n"+
+				"\tspack buildcache keys --install --trust\n"+
+				"\tspack mirror add --type source source \"https://mirror.example.org/spack\"\n"+
+				"\tspack mirror add --unsigned local \"file:///mirror\"\n"+
+				"\tspack gpg trust /opt/spack-mirror-keys/local.pub\n"+
+				"\tif bash -c")
+		})
+
+		Convey("Builds can use configured system-provided packages", func() {
+			conf.Spack.Externals = []config.External{
+				{Name: "slurm", Spec: "slurm@23.02.6", Prefix: "/usr"},
+				{Name: "cuda", Prefix: "/usr/local/cuda"},
+			}
+			def.Externals = []string{"slurm", "cuda"}
+
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldContainSubstring, "    install_tree: /opt/software\n"+
+				"  packages:\n"+
+				"    slurm:\n      buildable: false\n      externals:\n"+
+				"      - spec: \"slurm@23.02.6\"\n        prefix: \"/usr\"\n"+
+				"    cuda:\n      buildable: false\n      externals:\n"+
+				"      - spec: \"cuda\"\n        prefix: \"/usr/local/cuda\"\nEOF\n")
+
+			def.Externals = []string{"lsf"}
+
+			_, err = builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldWrap, config.ErrUnknownExternal)
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldWrap, config.ErrUnknownExternal)
+		})
+
+		Convey("Builds only use xvfb if they include configured packages that need it", func() {
+			conf.Spack.XvfbPackages = []string{"r-rgl", "py-pyqt*"}
+
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldNotContainSubstring, "xvfb")
+			So(defFile, ShouldContainSubstring, "\tspack buildcache keys --install --trust\n"+
+				"\tspack -e . install --fail-fast || {\n")
+
+			def.Packages = append(def.Packages, core.Package{Name: "py-pyqt5"})
+
+			defFile, err = builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldContainSubstring, "\t\txvfb-run -a spack -e . install --fail-fast\n")
+		})
+
+		Convey("Builds of R packages use the configured R_LIBS strategy", func() {
+			const symlinkHack = "\tln -s /opt/software/__spack_path_placeholder__/"
+			const envFileHack = "\techo \"export R_ENVIRON=$renviron;\" >> \"$mods\"\n"
+
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldContainSubstring, symlinkHack)
+			So(defFile, ShouldNotContainSubstring, envFileHack)
+
+			conf.Spack.RLibsStrategy = config.RLibsEnvFile
+
+			defFile, err = builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldNotContainSubstring, symlinkHack)
+			So(defFile, ShouldContainSubstring, "\tspack env activate --sh -d . >> "+
+				"/opt/spack-environment/environment_modifications.sh\n\n"+
+				"\t# Move the overly long R_LIBS env var (>128K) in to files R reads instead\n")
+			So(defFile, ShouldContainSubstring, envFileHack)
+
+			conf.Spack.RLibsStrategy = config.RLibsNone
+
+			defFile, err = builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldNotContainSubstring, symlinkHack)
+			So(defFile, ShouldNotContainSubstring, envFileHack)
+
+			conf.Spack.RLibsStrategy = config.RLibsSymlink
+			def.Packages = []core.Package{{Name: "xxhash", Version: "0.8.1"}}
+
+			defFile, err = builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldNotContainSubstring, "R_LIBS")
+			So(defFile, ShouldContainSubstring, "%post\n\t# Create the manifest file")
+		})
+
+		Convey("Builds can use an existing spack.yaml, which is kept as an artefact", func() {
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+			conf.Module.LoadPath = moduleLoadPrefix
+			ms3.Exes = "xxhsum\n"
+
+			def.SpackYAML = "spack:\n  specs:\n  - xxhash@0.8.1 +pic\n"
+			def.Packages, err = ParseSpackYAML(def.SpackYAML)
+			So(err, ShouldBeNil)
+			So(def.Validate(), ShouldBeNil)
+
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldContainSubstring, "\tcat << 'EOF' > spack.yaml\nspack:\n  concretizer:\n"+
+				"    unify: true\n  config:\n    install_tree: /opt/software\n  specs:\n"+
+				"    - xxhash@0.8.1 +pic arch=None-None-x86_64_v4\n  view: /opt/view\nEOF\n")
+			So(defFile, ShouldContainSubstring, `for pkg in "xxhash"; do`)
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			mwr.SetComplete()
+
+			ok := waitFor(func() bool {
+				_, okg := mc.GetFile(filepath.Join(def.getRepoPath(), core.SoftpackYaml))
+
+				return okg
+			})
+			So(ok, ShouldBeTrue)
+
+			data, ok := mc.GetFile(filepath.Join(def.getRepoPath(), core.SpackYAMLBasename))
+			So(ok, ShouldBeTrue)
+			So(data, ShouldEqual, def.SpackYAML)
+
+			def.SpackYAML = "spack:\n  specs:\n  - xxhash\n  include:\n  - /etc/spack.yaml\n"
+			So(def.Validate(), ShouldEqual, ErrInvalidSpackYAML)
+		})
+
+		Convey("Builds declare configured and requested module conflicts and prereqs", func() {
+			conf.Module.Conflicts = []string{"openmpi"}
+			conf.Module.Prereqs = []string{"cuda"}
+			def.Conflicts = []string{"mpich", "openmpi"}
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(def.Conflicts, ShouldResemble, []string{"openmpi", "mpich"})
+			So(def.Prereqs, ShouldResemble, []string{"cuda"})
+
+			def.Prereqs = []string{"a b"}
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldEqual, config.ErrModuleName)
+		})
+
+		Convey("Base images are built once, and builds whose packages include those of one start from it", func() {
+			conf.Images.LocalDir = t.TempDir()
+			conf.Spack.BaseImages = []config.BaseImage{
+				{Name: "r", Packages: []string{"r-seurat"}},
+				{Name: "r-py", Packages: []string{"r-seurat", "py-anndata"}},
+				{Name: "other", Packages: []string{"r-seurat", "samtools"}},
+			}
+
+			base := def.BaseImage(conf.Spack.BaseImages)
+			So(base, ShouldNotBeNil)
+			So(base.Name, ShouldEqual, "r-py")
+
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldStartWith, "Bootstrap: docker\nFrom: spack/ubuntu-jammy:v0.20.1\n")
+			So(defFile, ShouldNotContainSubstring, "reuse: true")
+
+			err = builder.BuildBaseImages(context.Background())
+			So(err, ShouldBeNil)
+
+			var job struct {
+				Cmd    string
+				RepGrp string `json:"rep_grp"`
+			}
+
+			err = json.NewDecoder(strings.NewReader(mwr.GetLastCmd())).Decode(&job)
+			So(err, ShouldBeNil)
+			So(job.RepGrp, ShouldEqual, wr.BaseImageRepGroup)
+
+			rPyPath := builder.baseImagePath(conf.Spack.BaseImages[1])
+			So(filepath.Dir(rPyPath), ShouldEqual, conf.Images.LocalDir)
+			So(filepath.Base(rPyPath), ShouldStartWith, "base-r-py-")
+			So(rPyPath, ShouldEndWith, ".sif")
+			So(job.Cmd, ShouldContainSubstring, "sudo singularity build --force '"+rPyPath+".tmp' '"+
+				strings.TrimSuffix(rPyPath, ".sif")+".def'")
+
+			baseDef, err := os.ReadFile(strings.TrimSuffix(rPyPath, ".sif") + ".def")
+			So(err, ShouldBeNil)
+			So(string(baseDef), ShouldStartWith, "Bootstrap: docker\nFrom: spack/ubuntu-jammy:v0.20.1\n")
+			So(string(baseDef), ShouldContainSubstring, "\tspack install --fail-fast "+
+				"r-seurat arch=None-None-x86_64_v4 py-anndata arch=None-None-x86_64_v4\n")
+			So(string(baseDef), ShouldContainSubstring, "\trm -rf /root/.aws\n")
+
+			for _, base := range conf.Spack.BaseImages[:2] {
+				err = os.WriteFile(builder.baseImagePath(base), nil, 0600)
+				So(err, ShouldBeNil)
+			}
+
+			defFile, err = builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldStartWith, "Bootstrap: localimage\nFrom: "+rPyPath+"\nStage: build\n")
+			So(defFile, ShouldContainSubstring, "\t# Built on top of the \"r-py\" base environment image.\n")
+			So(defFile, ShouldContainSubstring, "    unify: true\n    reuse: true\n")
+
+			mwr.Cmd = ""
+			err = builder.BuildBaseImages(context.Background())
+			So(err, ShouldBeNil)
+			So(mwr.GetLastCmd(), ShouldNotContainSubstring, "base-r-py-")
+			So(mwr.GetLastCmd(), ShouldContainSubstring, "base-other-")
+
+			conf.Spack.BaseImages[1].Packages = append(conf.Spack.BaseImages[1].Packages, "py-numpy")
+			So(builder.baseImagePath(conf.Spack.BaseImages[1]), ShouldNotEqual, rPyPath)
+
+			defFile, err = builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldStartWith, "Bootstrap: localimage\nFrom: "+
+				builder.baseImagePath(conf.Spack.BaseImages[0])+"\nStage: build\n")
+		})
+
+		Convey("Builds can use a configured profile", func() {
+			conf.Images.LocalDir = t.TempDir()
+			conf.Spack.BaseImages = []config.BaseImage{{Name: "r", Packages: []string{"r-seurat"}}}
+
+			err = os.WriteFile(builder.baseImagePath(conf.Spack.BaseImages[0]), nil, 0600)
+			So(err, ShouldBeNil)
+
+			conf.Profiles = map[string]config.Profile{
+				"gpu": {
+					BuildImage:      "spack/ubuntu-jammy-cuda:v0.20.1",
+					ProcessorTarget: "x86_64_v3",
+					Memory:          "64G",
+					Time:            "12h",
+					CPUs:            8,
+					Disk:            100,
+					LimitGroups:     []string{"gpu:2"},
+					Singularity:     &config.SingularityBuild{Fakeroot: true, Flags: []string{"--disable-cache"}},
+				},
+			}
+			def.Profile = "gpu"
+
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldStartWith, "Bootstrap: docker\nFrom: spack/ubuntu-jammy-cuda:v0.20.1\nStage: build\n")
+			So(defFile, ShouldContainSubstring, "arch=None-None-x86_64_v3")
+			So(defFile, ShouldContainSubstring, "From: ubuntu:22.04\nStage: final\n")
+			So(defFile, ShouldContainSubstring, "    install_tree: /opt/software\n    build_jobs: 8\nEOF\n")
+
+			wrInput, err := builder.generateWRInput(context.Background(), def, defFile, "some_path/env")
+			So(err, ShouldBeNil)
+			So(wrInput, ShouldContainSubstring, `"memory": "64G", "time": "12h", "cpus": 8, "disk": 100}`)
+			So(wrInput, ShouldContainSubstring, "if singularity build --fakeroot --disable-cache --bind $TMPDIR:/tmp ")
+			So(wrInput, ShouldContainSubstring, `"limit_grps": ["gpu:2"], `)
+
+			def.Profile = ""
+			conf.Singularity = &config.SingularityBuild{TmpDir: "/scratch/gsb-$$"}
+			conf.WRLimitGroups = map[string][]string{"x86_64_v4": {"avx512"}}
+
+			wrInput, err = builder.generateWRInput(context.Background(), def, defFile, "some_path/env")
+			So(err, ShouldBeNil)
+			So(wrInput, ShouldContainSubstring, "if sudo singularity build --bind /scratch/gsb-$$:/tmp ")
+			So(wrInput, ShouldContainSubstring, `"limit_grps": ["s3cache", "avx512"], `)
+
+			def.Profile = "gpu"
+
+			Convey("but not an unknown one", func() {
+				def.Profile = "unknown"
+
+				_, err = builder.generateSingularityDef(context.Background(), def)
+				So(err, ShouldEqual, config.ErrUnknownProfile)
+
+				err = builder.Build(context.Background(), def)
+				So(err, ShouldEqual, config.ErrUnknownProfile)
+				So(ms3.Def, ShouldBeBlank)
+			})
+
+			Convey("with a processor target override from the allowlist", func() {
+				conf.Spack.ProcessorTargets = []string{"x86_64_v4"}
+				def.ProcessorTarget = "x86_64_v4"
+
+				defFile, err = builder.generateSingularityDef(context.Background(), def)
+				So(err, ShouldBeNil)
+				So(defFile, ShouldContainSubstring, "arch=None-None-x86_64_v4")
+
+				def.ProcessorTarget = "zen4"
+
+				err = builder.Build(context.Background(), def)
+				So(err, ShouldEqual, config.ErrUnknownTarget)
+				So(ms3.Def, ShouldBeBlank)
+			})
+		})
+
+		Convey("Builds are attributed to the user who requested them", func() {
+			def.Requester = "user@example.com"
+
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			ok := waitFor(func() bool {
+				return strings.Contains(mwr.GetLastCmd(), `"GSB_REQUESTER=user@example.com"`)
+			})
+			So(ok, ShouldBeTrue)
+
+			status, err := builder.StatusDetail(filepath.Join(def.EnvironmentPath, def.EnvironmentName),
+				def.EnvironmentVersion)
+			So(err, ShouldBeNil)
+			So(status.Requester, ShouldEqual, "user@example.com")
+
+			def.Requester = "user\" rm -rf ~"
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldEqual, ErrInvalidRequester)
+		})
+
 		var logWriter tests.ConcurrentStringBuilder
 		slog.SetDefault(slog.New(slog.NewTextHandler(&logWriter, &slog.HandlerOptions{Level: slog.LevelInfo})))
 
@@ -219,19 +633,28 @@ Stage: final
 			conf.Module.LoadPath = moduleLoadPrefix
 			conf.Spack.ProcessorTarget = "x86_64_v4"
 			ms3.Exes = "xxhsum\nxxh32sum\nxxh64sum\nxxh128sum\nR\nRscript\npython\n"
-			err := builder.Build(def)
+			err := builder.Build(context.Background(), def)
 			So(err, ShouldBeNil)
 
-			So(ms3.Def, ShouldEqual, filepath.Join(def.getS3Path(), "singularity.def"))
+			So(ms3.Def, ShouldStartWith, filepath.Join(def.getS3Path(), buildsDirName)+"/")
+			So(ms3.Def, ShouldEndWith, "/singularity.def")
 			So(ms3.Data, ShouldContainSubstring, "specs:\n  - xxhash@0.8.1 arch=None-None-x86_64_v4\n"+
 				"  - r-seurat@4 arch=None-None-x86_64_v4\n  - py-anndata@3.14 arch=None-None-x86_64_v4\n  view")
 
 			mwr.SetRunning()
-			_, err = mwr.Wait("")
+			_, err = mwr.Wait(context.Background(), "")
 			So(err, ShouldBeNil)
 			hash := fmt.Sprintf("%X", sha256.Sum256([]byte(ms3.Data)))
 			So(mwr.GetLastCmd(), ShouldContainSubstring, "echo doing build with hash "+hash+"; if sudo singularity build")
 
+			var job struct {
+				RepGroup string `json:"rep_grp"`
+			}
+
+			So(json.Unmarshal([]byte(mwr.GetLastCmd()), &job), ShouldBeNil)
+			So(job.RepGroup, ShouldContainSubstring, "/"+buildsDirName+"/")
+			So(wr.IsEnvRepGroup(job.RepGroup, filepath.Join(conf.S3.BuildBase, def.getS3Path())), ShouldBeTrue)
+
 			modulePath := filepath.Join(conf.Module.ModuleInstallDir,
 				def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
 			scriptsPath := filepath.Join(conf.Module.ScriptsInstallDir,
@@ -320,6 +743,7 @@ packages:
   - xxhash@0.8.1
   - py-anndata@3.14
   - r-seurat@4
+processor_target: x86_64_v4
 `
 
 			// softpack-web relies on softpack.yml files having this particular
@@ -336,7 +760,15 @@ packages:
 				core.BuilderOut:             "output",
 				core.UsageBasename:          expectedReadmeContent,
 			} {
-				data, okg := mc.GetFile(filepath.Join(def.getRepoPath(), file))
+				var data string
+
+				okg := waitFor(func() bool {
+					var found bool
+
+					data, found = mc.GetFile(filepath.Join(def.getRepoPath(), file))
+
+					return found
+				})
 				So(okg, ShouldBeTrue)
 				So(data, ShouldContainSubstring, expectedData)
 			}
@@ -348,20 +780,364 @@ packages:
 			So(ms3.Readme, ShouldContainSubstring, expectedReadmeContent)
 		})
 
+		Convey("Builds of a superset of a previous version reuse it and record parentage", func() {
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+			conf.Module.WrapperScript = "/path/to/wrapper"
+			conf.Module.LoadPath = moduleLoadPrefix
+			ms3.Exes = "xxhsum\n"
+
+			moduleDir := ModuleDirFromName(conf.Module.ModuleInstallDir, def.EnvironmentPath, def.EnvironmentName)
+			err := os.MkdirAll(moduleDir, dirPerms)
+			So(err, ShouldBeNil)
+			err = os.WriteFile(filepath.Join(moduleDir, "0.8.0"), []byte("module"), perms)
+			So(err, ShouldBeNil)
+
+			So(builder.findParent(context.Background(), def), ShouldEqual, "groups/hgi/xxhash-0.8.0")
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(ms3.Data, ShouldContainSubstring, "    unify: true\n    reuse: true\n")
+
+			mwr.SetComplete()
+
+			ok := waitFor(func() bool {
+				_, okg := mc.GetFile(filepath.Join(def.getRepoPath(), core.SoftpackYaml))
+
+				return okg
+			})
+			So(ok, ShouldBeTrue)
+			So(ms3.SoftpackYML, ShouldEndWith, "  - r-seurat@4\nparent: groups/hgi/xxhash-0.8.0\n"+
+				"processor_target: x86_64_v4\n")
+
+			Convey("but not if packages were removed", func() {
+				def.Packages = def.Packages[:1]
+				So(builder.findParent(context.Background(), def), ShouldBeBlank)
+			})
+		})
+
+		Convey("Builds record their provenance", func() {
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+			conf.Module.LoadPath = moduleLoadPrefix
+			ms3.Exes = "xxhsum\n"
+
+			registry := newMockRegistry()
+			defer registry.Close()
+
+			registryScheme = "http"
+			defer func() { registryScheme = "https" }()
+
+			buildImage := strings.TrimPrefix(registry.URL, "http://") + "/spack/ubuntu-jammy:v0.20.1"
+			conf.Spack.BuildImage = buildImage
+			conf.Spack.FinalImage = "ubuntu@" + testImageDigest
+			conf.Images.ResolveDigests = true
+
+			GSBVersion = "v1.2.3"
+			defer func() { GSBVersion = "" }()
+
+			def.Labels = map[string]string{"project": "atlas"}
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			status, err := builder.StatusDetail(filepath.Join(def.EnvironmentPath, def.EnvironmentName),
+				def.EnvironmentVersion)
+			So(err, ShouldBeNil)
+			So(status.Provenance, ShouldNotBeNil)
+			So(status.Provenance.InvocationID, ShouldEqual, status.BuildID)
+			So(status.Provenance.RLibsStrategy, ShouldEqual, config.RLibsSymlink)
+			So(status.Labels, ShouldResemble, map[string]string{"project": "atlas"})
+			So(status.Provenance.ResolvedDependencies[0].Digest, ShouldBeNil)
+
+			mwr.SetComplete()
+
+			var data string
+
+			ok := waitFor(func() bool {
+				var found bool
+
+				data, found = mc.GetFile(filepath.Join(def.getRepoPath(), core.ProvenanceBasename))
+
+				return found
+			})
+			So(ok, ShouldBeTrue)
+
+			var prov Provenance
+
+			err = json.Unmarshal([]byte(data), &prov)
+			So(err, ShouldBeNil)
+			So(prov.BuildType, ShouldEqual, provenanceBuildType)
+			So(prov.BuilderVersion, ShouldEqual, "v1.2.3")
+			So(prov.Environment, ShouldEqual, def.FullEnvironmentPath())
+			So(prov.ProcessorTarget, ShouldEqual, "x86_64_v4")
+			So(prov.Labels, ShouldResemble, map[string]string{"project": "atlas"})
+			So(prov.WRDeployment, ShouldEqual, config.DefaultWRDeployment)
+			So(prov.InvocationID, ShouldEqual, status.BuildID)
+			So(prov.JobID, ShouldNotBeBlank)
+			So(prov.StartedOn, ShouldNotBeNil)
+			So(prov.FinishedOn, ShouldNotBeNil)
+			So(prov.ResolvedDependencies, ShouldResemble, []ProvenanceDependency{
+				{Name: "buildImage", URI: "docker://" + buildImage, Digest: map[string]string{"sha256": "0123456789abcdef"}},
+				{Name: "finalImage", URI: "docker://ubuntu@" + testImageDigest,
+					Digest: map[string]string{"sha256": "0123456789abcdef"}},
+				{Name: "customSpackRepo", URI: "git+" + gmhttp.URL, Digest: map[string]string{"gitCommit": commitHash}},
+			})
+
+			So(waitFor(func() bool {
+				status, err = builder.StatusDetail(filepath.Join(def.EnvironmentPath, def.EnvironmentName),
+					def.EnvironmentVersion)
+
+				return err == nil && status.Provenance.JobID != ""
+			}), ShouldBeTrue)
+		})
+
+		Convey("Builds can send extra artefacts to core and suppress optional ones", func() {
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+			conf.Module.LoadPath = moduleLoadPrefix
+			ms3.Exes = "xxhsum\n"
+
+			licence := filepath.Join(t.TempDir(), "LICENSE")
+			err = os.WriteFile(licence, []byte("site licence"), perms)
+			So(err, ShouldBeNil)
+
+			conf.Artefacts.Extra = []config.ExtraArtefact{
+				{Name: "LICENSE", Path: licence},
+				{Name: "metadata.json", Path: licence},
+			}
+			conf.Artefacts.Suppress = []string{core.UsageBasename}
+			def.ExtraArtefacts = map[string]string{"metadata.json": `{"institute":"sanger"}`}
+			def.SuppressArtefacts = []string{core.BuilderOut}
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			mwr.SetComplete()
+
+			ok := waitFor(func() bool {
+				_, okg := mc.GetFile(filepath.Join(def.getRepoPath(), core.SoftpackYaml))
+
+				return okg
+			})
+			So(ok, ShouldBeTrue)
+
+			data, ok := mc.GetFile(filepath.Join(def.getRepoPath(), "LICENSE"))
+			So(ok, ShouldBeTrue)
+			So(data, ShouldEqual, "site licence")
+
+			data, ok = mc.GetFile(filepath.Join(def.getRepoPath(), "metadata.json"))
+			So(ok, ShouldBeTrue)
+			So(data, ShouldEqual, `{"institute":"sanger"}`)
+
+			for _, file := range []string{core.UsageBasename, core.BuilderOut} {
+				_, ok = mc.GetFile(filepath.Join(def.getRepoPath(), file))
+				So(ok, ShouldBeFalse)
+			}
+
+			Convey("but not with invalid names", func() {
+				for _, test := range []struct {
+					extra    map[string]string
+					suppress []string
+				}{
+					{map[string]string{"a/b": ""}, nil},
+					{map[string]string{".hidden": ""}, nil},
+					{map[string]string{core.SoftpackYaml: ""}, nil},
+					{nil, []string{core.SoftpackYaml}},
+					{nil, []string{core.ModuleForCoreBasename}},
+					{nil, []string{"unknown"}},
+				} {
+					def.ExtraArtefacts = test.extra
+					def.SuppressArtefacts = test.suppress
+
+					So(def.Validate(), ShouldEqual, ErrInvalidArtefact)
+				}
+
+				conf.Artefacts.Suppress = []string{core.SoftpackYaml}
+
+				_, err = New(&conf, ms3, mwr)
+				So(err, ShouldEqual, ErrInvalidArtefact)
+			})
+		})
+
+		Convey("Artefacts can be uploaded to core in chunks, resuming failed chunks", func() {
+			builder.artefacts.retryWait = time.Millisecond
+			conf.Artefacts.Upload.ChunkSizeMB = 1
+			big := strings.Repeat("0123456789", 250000)
+			envPath := "groups/hgi/env-1"
+
+			mc.ChunkFailures = 2
+
+			err = builder.addArtifactsToRepo(context.Background(), map[string]io.Reader{ //nolint:misspell
+				core.SoftpackYaml: strings.NewReader("yml"),
+				"big":             strings.NewReader(big),
+				"empty":           strings.NewReader(""),
+			}, envPath)
+			So(err, ShouldBeNil)
+			So(mc.Chunks, ShouldEqual, 7)
+
+			for file, expected := range map[string]string{core.SoftpackYaml: "yml", "big": big, "empty": ""} {
+				data, ok := mc.GetFile(filepath.Join(envPath, file))
+				So(ok, ShouldBeTrue)
+				So(data, ShouldEqual, expected)
+			}
+
+			Convey("but give up after too many retries", func() {
+				conf.Artefacts.Upload.Retries = 1
+				mc.ChunkFailures = 2
+
+				err = builder.addArtifactsToRepo(context.Background(), map[string]io.Reader{ //nolint:misspell
+					"other": strings.NewReader("data"),
+				}, envPath)
+				So(err, ShouldNotBeNil)
+
+				_, ok := mc.GetFile(filepath.Join(envPath, "other"))
+				So(ok, ShouldBeFalse)
+			})
+		})
+
 		Convey("Build returns an error if the upload fails", func() {
 			ms3.Fail = true
-			err := builder.Build(def)
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Build returns an error if its context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			err := builder.Build(ctx, def)
 			So(err, ShouldNotBeNil)
+			So(builder.Cancel(def.getRepoPath()), ShouldEqual, ErrBuildNotRunning)
+		})
+
+		Convey("A duplicate build request doesn't change the running build's status or definition", func() {
+			def.Requester = "first@example.com"
+			def.Labels = map[string]string{"project": "first"}
+
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			dup := *def
+			dup.Requester = "second@example.com"
+			dup.Labels = map[string]string{"project": "second"}
+			dup.Force = true
+
+			err = builder.Build(context.Background(), &dup)
+			So(err, ShouldEqual, ErrEnvironmentBuilding)
+
+			status := builder.Status()[0]
+			So(status.Requester, ShouldEqual, "first@example.com")
+			So(status.Labels, ShouldResemble, map[string]string{"project": "first"})
+
+			builder.statusMu.RLock()
+			stored := builder.definitions[def.FullEnvironmentPath()]
+			builder.statusMu.RUnlock()
+
+			So(stored.Requester, ShouldEqual, "first@example.com")
+			So(stored.Labels, ShouldResemble, map[string]string{"project": "first"})
+			So(stored.Force, ShouldBeFalse)
+		})
+
+		Convey("Running builds can be cancelled", func() {
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldEqual, ErrEnvironmentBuilding)
+
+			ok := waitFor(func() bool {
+				return mwr.GetLastCmd() != ""
+			})
+			So(ok, ShouldBeTrue)
+
+			So(builder.Cancel(def.getRepoPath()), ShouldBeNil)
+			So(mwr.Kills, ShouldEqual, 1)
+			So(strings.Contains(logWriter.String(), context.Canceled.Error()), ShouldBeTrue)
+
+			for path := range ms3.Files {
+				So(path, ShouldNotContainSubstring, "/"+buildsDirName+"/")
+			}
+
+			So(builder.Cancel(def.getRepoPath()), ShouldEqual, ErrBuildNotRunning)
+
+			_, ok = mc.GetFile(filepath.Join(def.getRepoPath(), core.BuilderOut))
+			So(ok, ShouldBeFalse)
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(builder.Cancel(def.getRepoPath()), ShouldBeNil)
+
+			ok = waitFor(func() bool {
+				return builder.Cancel(def.getRepoPath()) == ErrBuildNotRunning
+			})
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Cancelled builds stay protected until their wr job has been stopped", func() {
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			ok := waitFor(func() bool {
+				return mwr.GetLastCmd() != ""
+			})
+			So(ok, ShouldBeTrue)
+
+			errKill := internal.Error("kill failed")
+
+			mwr.Lock()
+			mwr.KillErr = errKill
+			mwr.Unlock()
+
+			So(builder.Cancel(def.getRepoPath()), ShouldEqual, errKill)
+			So(builder.Build(context.Background(), def), ShouldEqual, ErrEnvironmentBuilding)
+			So(mwr.Kills, ShouldEqual, 0)
+
+			mwr.Lock()
+			mwr.KillErr = nil
+			mwr.Unlock()
+
+			So(builder.Cancel(def.getRepoPath()), ShouldBeNil)
+			So(mwr.Kills, ShouldEqual, 1)
+			So(builder.Cancel(def.getRepoPath()), ShouldEqual, ErrBuildNotRunning)
+		})
+
+		Convey("Builds are run in the wr deployment they are routed to", func() {
+			conf.Profiles = map[string]config.Profile{"gpu": {Memory: "64G"}}
+			conf.WRDeployments = []config.WRDeployment{{Name: "gpu-dc", Profiles: []string{"gpu"}}}
+			gpuWR := wrmock.NewMockWR(1*time.Millisecond, 10*time.Millisecond)
+			builder.runners["gpu-dc"] = gpuWR
+			def.Profile = "gpu"
+
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			ok := waitFor(func() bool {
+				return gpuWR.GetLastCmd() != ""
+			})
+			So(ok, ShouldBeTrue)
+			So(mwr.GetLastCmd(), ShouldBeBlank)
+
+			status, err := builder.StatusDetail(filepath.Join(def.EnvironmentPath, def.EnvironmentName), def.EnvironmentVersion)
+			So(err, ShouldBeNil)
+			So(status.Deployment, ShouldEqual, "gpu-dc")
+
+			So(builder.Cancel(def.getRepoPath()), ShouldBeNil)
+
+			ok = waitFor(func() bool {
+				return builder.Cancel(def.getRepoPath()) == ErrBuildNotRunning
+			})
+			So(ok, ShouldBeTrue)
 		})
 
 		Convey("Build logs an error if the run fails", func() {
 			mwr.Fail = true
 
-			err := builder.Build(def)
+			err := builder.Build(context.Background(), def)
 			So(err, ShouldBeNil)
 
 			mwr.SetComplete()
-			_, err = mwr.Wait("")
+			_, err = mwr.Wait(context.Background(), "")
 			So(err, ShouldBeNil)
 
 			ok := waitFor(func() bool {
@@ -372,14 +1148,287 @@ packages:
 			logLines := strings.Split(logWriter.String(), "\n")
 			So(len(logLines), ShouldEqual, 2)
 
+			statuses := builder.Status()
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].BuildID, ShouldNotBeBlank)
+
 			So(logLines[0], ShouldContainSubstring,
-				"msg=\"Async part of build failed\" err=\""+ErrBuildFailed+"\" s3Path=some_path/"+def.getS3Path())
+				"msg=\"Async part of build failed\" buildID="+statuses[0].BuildID+
+					" envPath="+def.getRepoPath()+" jobID=abc123"+
+					" err=\""+ErrBuildFailed+"\" s3Path=some_path/"+def.getS3Path())
+
+			tail, err := builder.LogTail(def.getRepoPath())
+			So(err, ShouldBeNil)
+			So(len(tail), ShouldBeGreaterThan, 2)
+			So(tail[0], ShouldContainSubstring, "msg=\"build requested\" buildID="+statuses[0].BuildID)
+			So(tail[len(tail)-1], ShouldContainSubstring, "msg=\"Async part of build failed\"")
+
+			_, err = builder.LogTail("users/foo/unbuilt-1")
+			So(err, ShouldEqual, ErrNoLogTail)
+
+			ok = waitFor(func() bool {
+				return builder.Status()[0].Error != ""
+			})
+			So(ok, ShouldBeTrue)
+			So(builder.Status()[0].Error, ShouldEqual, ErrBuildFailed)
+			So(builder.Status()[0].State(), ShouldEqual, BuildStateFailed)
 
 			data, ok := mc.GetFile(filepath.Join(def.getRepoPath(), core.BuilderOut))
 			So(ok, ShouldBeTrue)
 			So(data, ShouldContainSubstring, "output")
 		})
 
+		Convey("You can wait for a build to finish", func() {
+			defer func(interval time.Duration) { buildWaitPollInterval = interval }(buildWaitPollInterval)
+			buildWaitPollInterval = time.Millisecond
+			mwr.Fail = true
+
+			envPath := filepath.Join(def.EnvironmentPath, def.EnvironmentName)
+
+			_, err := builder.WaitForBuild(context.Background(), envPath, def.EnvironmentVersion)
+			So(err, ShouldEqual, ErrUnknownBuild)
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			_, err = builder.WaitForBuild(ctx, envPath, def.EnvironmentVersion)
+			So(err, ShouldEqual, context.DeadlineExceeded)
+
+			mwr.SetComplete()
+
+			detail, err := builder.WaitForBuild(context.Background(), envPath, def.EnvironmentVersion)
+			So(err, ShouldBeNil)
+			So(detail.State, ShouldEqual, BuildStateFailed)
+			So(detail.Error, ShouldEqual, ErrBuildFailed)
+			So(detail.Artefacts, ShouldContainKey, core.BuilderOut)
+		})
+
+		Convey("The package build logs of a failed build are sent to core", func() {
+			mwr.Fail = true
+			ms3.Logs = map[string]string{
+				"spack-build-out.txt": "make: *** [all] Error 2",
+				"spack-build-env.txt": "PATH=/bin",
+			}
+
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			mwr.SetComplete()
+
+			var data string
+
+			ok := waitFor(func() bool {
+				var okg bool
+				data, okg = mc.GetFile(filepath.Join(def.getRepoPath(), "logs", "spack-build-out.txt"))
+
+				return okg
+			})
+			So(ok, ShouldBeTrue)
+			So(data, ShouldEqual, "make: *** [all] Error 2")
+
+			data, ok = mc.GetFile(filepath.Join(def.getRepoPath(), "logs", "spack-build-env.txt"))
+			So(ok, ShouldBeTrue)
+			So(data, ShouldEqual, "PATH=/bin")
+
+			data, ok = mc.GetFile(filepath.Join(def.getRepoPath(), core.BuilderOut))
+			So(ok, ShouldBeTrue)
+			So(data, ShouldEqual, "output")
+		})
+
+		Convey("If a failed build's log isn't in S3, wr's output for the job is sent to core", func() {
+			mwr.Fail = true
+			mwr.StdErr = "fuse mount failed"
+			ms3.NoLog = true
+
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			mwr.SetComplete()
+
+			var data string
+
+			ok := waitFor(func() bool {
+				var okg bool
+				data, okg = mc.GetFile(filepath.Join(def.getRepoPath(), core.BuilderOut))
+
+				return okg
+			})
+			So(ok, ShouldBeTrue)
+			So(data, ShouldEqual, "fuse mount failed")
+			So(builder.Status()[0].WR.StdErr, ShouldEqual, "fuse mount failed")
+		})
+
+		Convey("Builds buried for transient reasons are retried", func() {
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+			conf.Module.WrapperScript = "/path/to/wrapper"
+			ms3.Exes = "xxhsum\n"
+			mwr.Fail = true
+			mwr.FailTransient = true
+
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			mwr.SetRunning()
+
+			ok := waitFor(func() bool {
+				statuses := builder.Status()
+
+				return len(statuses) == 1 && statuses[0].BuildDone != nil
+			})
+			So(ok, ShouldBeTrue)
+
+			statuses := builder.Status()
+			So(statuses[0].Retries, ShouldEqual, 1)
+			So(statuses[0].Failure, ShouldEqual, wr.FailureNone)
+			So(mwr.Kicks, ShouldEqual, 1)
+
+			ok = waitFor(func() bool {
+				_, okg := mc.GetFile(filepath.Join(def.getRepoPath(), core.SoftpackYaml))
+
+				return okg
+			})
+			So(ok, ShouldBeTrue)
+
+			ok = waitFor(func() bool {
+				return builder.Status()[0].Stage() == BuildStageDone
+			})
+			So(ok, ShouldBeTrue)
+			So(builder.Status()[0].WRState, ShouldEqual, wr.WRJobStatusComplete)
+		})
+
+		Convey("Builds that ran out of retries are retried again when requeued", func() {
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+			conf.Module.WrapperScript = "/path/to/wrapper"
+			conf.WRRetries = 1
+			ms3.Exes = "xxhsum\n"
+			mwr.Fail = true
+			mwr.FailTransient = true
+			mwr.KeepFailing = true
+
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			mwr.SetRunning()
+
+			ok := waitFor(func() bool {
+				return builder.Status()[0].BuildDone != nil
+			})
+			So(ok, ShouldBeTrue)
+
+			status := builder.Status()[0]
+			So(status.Retries, ShouldEqual, 1)
+			So(status.Failure, ShouldEqual, wr.FailureTransient)
+			So(status.State(), ShouldEqual, BuildStateFailed)
+
+			mwr.Lock()
+			So(mwr.Kicks, ShouldEqual, 1)
+			mwr.KeepFailing = false
+			mwr.Unlock()
+
+			ok = waitFor(func() bool {
+				err = builder.Requeue(context.Background(), def.FullEnvironmentPath())
+
+				return !errors.Is(err, ErrEnvironmentBuilding)
+			})
+			So(ok, ShouldBeTrue)
+			So(err, ShouldBeNil)
+
+			ok = waitFor(func() bool {
+				return builder.Status()[0].Stage() == BuildStageDone
+			})
+			So(ok, ShouldBeTrue)
+
+			status = builder.Status()[0]
+			So(status.Retries, ShouldEqual, 1)
+			So(status.Failure, ShouldEqual, wr.FailureNone)
+			So(status.Error, ShouldBeBlank)
+
+			mwr.RLock()
+			So(mwr.Kicks, ShouldEqual, 2)
+			mwr.RUnlock()
+		})
+
+		Convey("Builds buried for non-transient reasons are not retried", func() {
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+			mwr.Fail = true
+
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			mwr.SetRunning()
+
+			ok := waitFor(func() bool {
+				statuses := builder.Status()
+
+				return len(statuses) == 1 && statuses[0].BuildDone != nil
+			})
+			So(ok, ShouldBeTrue)
+
+			statuses := builder.Status()
+			So(statuses[0].Retries, ShouldEqual, 0)
+			So(statuses[0].Failure, ShouldEqual, wr.FailureBuild)
+			So(statuses[0].WR.FailReason, ShouldEqual, "command exited non-zero")
+			So(statuses[0].WRState, ShouldEqual, wr.WRJobStatusBuried)
+			So(statuses[0].Stage(), ShouldEqual, BuildStageFailed)
+			So(mwr.Kicks, ShouldEqual, 0)
+
+			ok = waitFor(func() bool {
+				return strings.Contains(logWriter.String(), ErrBuildFailed)
+			})
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Builds can be killed by a watchdog if they stall", func() {
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+			conf.Module.WrapperScript = "/path/to/wrapper"
+			conf.Timeouts.BuildMinutes = 240
+			conf.Timeouts.StallMinutes = 30
+			ms3.Exes = "xxhsum\n"
+			mwr.Fail = true
+			mwr.StdErr = "gsb watchdog: build stalled: no output for 30 minutes"
+
+			waitForBuildDone := func() Status {
+				err := builder.Build(context.Background(), def)
+				So(err, ShouldBeNil)
+
+				mwr.SetRunning()
+
+				ok := waitFor(func() bool {
+					statuses := builder.Status()
+
+					return len(statuses) == 1 && statuses[0].BuildDone != nil
+				})
+				So(ok, ShouldBeTrue)
+
+				return builder.Status()[0]
+			}
+
+			Convey("which are not retried by default", func() {
+				status := waitForBuildDone()
+				So(mwr.GetLastCmd(), ShouldContainSubstring, "-mmin +30")
+				So(mwr.GetLastCmd(), ShouldContainSubstring, "gsbstart) / 60 )) -ge 240")
+				So(status.Failure, ShouldEqual, wr.FailureStall)
+				So(status.Retries, ShouldEqual, 0)
+				So(mwr.Kicks, ShouldEqual, 0)
+			})
+
+			Convey("which are retried if configured", func() {
+				conf.Timeouts.RetryStalls = true
+
+				status := waitForBuildDone()
+				So(status.Failure, ShouldEqual, wr.FailureNone)
+				So(status.Retries, ShouldEqual, 1)
+				So(mwr.Kicks, ShouldEqual, 1)
+			})
+		})
+
 		Convey("You can't run the same build simultaneously", func() {
 			_, err := exec.LookPath("wr")
 			if err != nil {
@@ -399,20 +1448,20 @@ packages:
 				Runner: wr.New("development"),
 			}
 
-			builder.runner = mr
+			builder.runners[config.DefaultWRDeployment] = mr
 
-			err = builder.Build(def)
+			err = builder.Build(context.Background(), def)
 			jobID1 := mr.LastJobID
 			So(err, ShouldBeNil)
 
-			err = builder.Build(def)
+			err = builder.Build(context.Background(), def)
 			jobID2 := mr.LastJobID
 			So(err, ShouldNotBeNil)
 			So(err, ShouldEqual, ErrEnvironmentBuilding)
 
-			_, err = mr.Wait(jobID1)
+			_, err = mr.Wait(context.Background(), jobID1)
 			So(err, ShouldBeNil)
-			_, err = mr.Wait(jobID2)
+			_, err = mr.Wait(context.Background(), jobID2)
 			So(err, ShouldBeNil)
 		})
 
@@ -424,7 +1473,7 @@ packages:
 			conf.Module.LoadPath = moduleLoadPrefix
 			ms3.Exes = "xxhsum\nxxh32sum\nxxh64sum\nxxh128sum\n"
 
-			err := builder.Build(def)
+			err := builder.Build(context.Background(), def)
 			So(err, ShouldBeNil)
 
 			mwr.SetComplete()
@@ -445,7 +1494,7 @@ packages:
 			conf.Module.ModuleInstallDir = t.TempDir()
 			conf.Module.ScriptsInstallDir = t.TempDir()
 
-			err = builder.Build(def)
+			err = builder.Build(context.Background(), def)
 			So(err, ShouldBeNil)
 
 			ok = waitFor(func() bool {
@@ -453,13 +1502,48 @@ packages:
 			})
 			So(ok, ShouldBeTrue)
 
-			expectedLog = "\"Async part of build failed\" err=\"an error\\n\""
+			expectedLog = "jobID=abc123 err=\"an error\\n\""
 
 			So(logWriter.String(), ShouldContainSubstring, expectedLog)
 		})
 	})
 }
 
+// newTestBuilder returns a Builder that uses a mock custom spack repo, S3 and
+// wr (whose jobs take 10ms), along with the config, S3 and wr it uses. The
+// config has the binary cache, build base, images and processor target most
+// tests expect, and mutate, if not nil, can change it before the Builder is
+// created.
+func newTestBuilder(t *testing.T, mutate func(*config.Config)) (*Builder, *config.Config,
+	*s3mock.MockS3, *wrmock.MockWR) {
+	t.Helper()
+
+	gm, _ := gitmock.New()
+	gmhttp := httptest.NewServer(gm)
+
+	t.Cleanup(gmhttp.Close)
+
+	conf := new(config.Config)
+	conf.S3.BinaryCache = "s3://spack"
+	conf.S3.BuildBase = "some_path"
+	conf.CustomSpackRepo = gmhttp.URL
+	conf.Spack.BuildImage = "spack/ubuntu-jammy:v0.20.1"
+	conf.Spack.FinalImage = "ubuntu:22.04"
+	conf.Spack.ProcessorTarget = "x86_64_v4"
+
+	if mutate != nil {
+		mutate(conf)
+	}
+
+	ms3 := &s3mock.MockS3{}
+	mwr := wrmock.NewMockWR(1*time.Millisecond, 10*time.Millisecond)
+
+	builder, err := New(conf, ms3, mwr)
+	So(err, ShouldBeNil)
+
+	return builder, conf, ms3, mwr
+}
+
 func getExampleDefinition() *Definition {
 	return &Definition{
 		EnvironmentPath:    "groups/hgi/",
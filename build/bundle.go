@@ -0,0 +1,132 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const (
+	ErrNoArtefacts = internal.Error("no build artefacts for environment")
+
+	bundlePerms = 0644
+)
+
+// bundledFiles are the build artefacts included in an ArtefactsBundle(), if
+// they exist.
+var bundledFiles = [...]string{ //nolint:gochecknoglobals
+	core.SoftpackYaml,
+	core.SpackLockFile,
+	core.SingularityDefBasename,
+	core.UsageBasename,
+	core.BuilderOut,
+}
+
+// ArtefactsBundle returns a gzipped tar of the build artefacts (softpack.yml,
+// spack.lock, singularity.def, README.md and builder.out) of the given
+// environment (a path like "users/foo/env", as per StatusDetail()) and
+// version, read from the S3 build location. The files are in a directory named
+// after the environment and version. Artefacts that don't exist, such as those
+// of a failed build, are left out. Returns ErrNoArtefacts if none of them
+// exist.
+func (b *Builder) ArtefactsBundle(ctx context.Context, envPath, version string) ([]byte, error) {
+	if err := ValidateEnvironmentPath(envPath, version); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	dir := path.Base(envPath) + "-" + version
+	now := time.Now()
+	found := 0
+
+	for _, basename := range bundledFiles {
+		data, err := b.readS3File(ctx, filepath.Join(envPath, version, basename))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			continue
+		}
+
+		if err = addToTar(tw, path.Join(dir, basename), data, now); err != nil {
+			return nil, err
+		}
+
+		found++
+	}
+
+	if found == 0 {
+		return nil, ErrNoArtefacts
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (b *Builder) readS3File(ctx context.Context, s3Path string) ([]byte, error) {
+	rc, err := b.s3.OpenFile(ctx, s3Path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+func addToTar(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    bundlePerms,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(data)
+
+	return err
+}
@@ -0,0 +1,99 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+func TestArtefactsBundle(t *testing.T) {
+	Convey("Given a Builder with artefacts in S3", t, func() {
+		ms3 := &mapS3{files: map[string]string{
+			"users/foo/env/1/" + core.SingularityDefBasename: "def data",
+			"users/foo/env/1/" + core.BuilderOut:             "log data",
+			"users/foo/env/1/" + core.ImageBasename:          "image data",
+		}}
+
+		builder, err := New(&config.Config{}, ms3, nil)
+		So(err, ShouldBeNil)
+
+		Convey("you can get a tar.gz of those that exist, without the image", func() {
+			bundle, err := builder.ArtefactsBundle(context.Background(), "users/foo/env", "1")
+			So(err, ShouldBeNil)
+			So(untar(bundle), ShouldResemble, map[string]string{
+				"env-1/" + core.SingularityDefBasename: "def data",
+				"env-1/" + core.BuilderOut:             "log data",
+			})
+
+			ms3.files["users/foo/env/1/"+core.SoftpackYaml] = "yml data"
+			ms3.files["users/foo/env/1/"+core.SpackLockFile] = "lock data"
+			ms3.files["users/foo/env/1/"+core.UsageBasename] = "readme data"
+
+			bundle, err = builder.ArtefactsBundle(context.Background(), "users/foo/env", "1")
+			So(err, ShouldBeNil)
+			So(len(untar(bundle)), ShouldEqual, 5)
+		})
+
+		Convey("you get an error for environments without artefacts", func() {
+			_, err := builder.ArtefactsBundle(context.Background(), "users/foo/env", "2")
+			So(err, ShouldEqual, ErrNoArtefacts)
+
+			_, err = builder.ArtefactsBundle(context.Background(), "users/foo/../env", "1")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func untar(data []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	So(err, ShouldBeNil)
+
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		So(err, ShouldBeNil)
+
+		content, err := io.ReadAll(tr)
+		So(err, ShouldBeNil)
+
+		files[hdr.Name] = string(content)
+	}
+
+	return files
+}
@@ -0,0 +1,180 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// cacheHistoryLength is the number of recent builds whose binary cache use is
+// combined in to the BinaryCacheStatus.
+const cacheHistoryLength = 20
+
+var (
+	spackCacheInstallRegexp  = regexp.MustCompile(`^==> Extracting (\S+) from binary cache`) //nolint:gochecknoglobals
+	spackSourceInstallRegexp = regexp.MustCompile(`^==> No binary for (\S+) found`)          //nolint:gochecknoglobals
+)
+
+// CacheUse counts the packages a build installed from the binary cache, and
+// those it had to build from source, according to spack's output in its
+// builder.out.
+type CacheUse struct {
+	FromCache  int
+	FromSource int
+}
+
+// HitRate returns the fraction of installed packages that came from the binary
+// cache. Returns 1 if nothing was installed.
+func (c CacheUse) HitRate() float64 {
+	total := c.FromCache + c.FromSource
+	if total == 0 {
+		return 1
+	}
+
+	return float64(c.FromCache) / float64(total)
+}
+
+// parseCacheUse counts the distinct packages that spack install output says
+// were extracted from a binary cache or installed from source.
+func parseCacheUse(r io.Reader) (CacheUse, error) {
+	fromCache := make(map[string]bool)
+	fromSource := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if m := spackCacheInstallRegexp.FindStringSubmatch(line); m != nil {
+			fromCache[m[1]] = true
+		} else if m := spackSourceInstallRegexp.FindStringSubmatch(line); m != nil {
+			fromSource[m[1]] = true
+		}
+	}
+
+	return CacheUse{FromCache: len(fromCache), FromSource: len(fromSource)}, scanner.Err()
+}
+
+// BinaryCacheStatus reports on the binary cache use of the last RecentBuilds
+// successful builds (up to 20). HitRate is the fraction of the packages they
+// installed that came from the cache, and Low is true if that is below the
+// configured spack.minCacheHitRate, which usually means the cache's index is
+// broken.
+type BinaryCacheStatus struct {
+	RecentBuilds int
+	FromCache    int
+	FromSource   int
+	HitRate      float64
+	Low          bool
+}
+
+type cacheUses struct {
+	mu     sync.Mutex
+	recent []CacheUse
+}
+
+// add records the given use, forgetting the oldest if we have more than
+// cacheHistoryLength, and returns the resulting status.
+func (c *cacheUses) add(use CacheUse, minHitRate float64) BinaryCacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.recent = append(c.recent, use)
+	if len(c.recent) > cacheHistoryLength {
+		c.recent = c.recent[1:]
+	}
+
+	return c.statusWhileLocked(minHitRate)
+}
+
+func (c *cacheUses) status(minHitRate float64) BinaryCacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.statusWhileLocked(minHitRate)
+}
+
+func (c *cacheUses) statusWhileLocked(minHitRate float64) BinaryCacheStatus {
+	var total CacheUse
+
+	for _, use := range c.recent {
+		total.FromCache += use.FromCache
+		total.FromSource += use.FromSource
+	}
+
+	hitRate := total.HitRate()
+
+	return BinaryCacheStatus{
+		RecentBuilds: len(c.recent),
+		FromCache:    total.FromCache,
+		FromSource:   total.FromSource,
+		HitRate:      hitRate,
+		Low:          hitRate < minHitRate,
+	}
+}
+
+// BinaryCacheStatus reports on the binary cache use of recent successful
+// builds.
+func (b *Builder) BinaryCacheStatus() BinaryCacheStatus {
+	return b.cacheUses.status(b.config.Spack.MinCacheHitRate)
+}
+
+// recordCacheUse parses the builder.out of the successful build in the given S3
+// location, and records its binary cache use in the given status and our
+// recent history. Logs a warning if the recent hit rate has become low.
+func (b *Builder) recordCacheUse(ctx context.Context, status *Status, s3Path string) {
+	logger := loggerFromContext(ctx)
+
+	rc, err := b.s3.OpenFile(ctx, filepath.Join(s3Path, core.BuilderOut))
+	if err != nil {
+		logger.Warn("could not read build log to count binary cache use", "err", err)
+
+		return
+	}
+
+	defer rc.Close()
+
+	use, err := parseCacheUse(rc)
+	if err != nil {
+		logger.Warn("could not count binary cache use", "err", err)
+
+		return
+	}
+
+	b.statusMu.Lock()
+	status.Cache = &use
+	b.statusMu.Unlock()
+
+	cacheStatus := b.cacheUses.add(use, b.config.Spack.MinCacheHitRate)
+	if cacheStatus.Low {
+		logger.Warn("binary cache hit rate of recent builds is low; is the cache index broken?",
+			"hitRate", cacheStatus.HitRate, "recentBuilds", cacheStatus.RecentBuilds)
+	}
+}
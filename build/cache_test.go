@@ -0,0 +1,109 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+const exampleSpackInstallOutput = `==> Installing zlib-1.2.13-abcdefg [1/3]
+==> Fetching https://cache.example.org/build_cache/zlib-1.2.13-abcdefg.spec.json.sig
+==> Extracting zlib-1.2.13-abcdefg from binary cache
+==> zlib: Successfully installed zlib-1.2.13-abcdefg
+[+] /opt/software/linux-ubuntu22.04-x86_64_v3/gcc-11.4.0/zlib-1.2.13-abcdefg
+==> Installing xxhash-0.8.1-hijklmn [2/3]
+==> No binary for xxhash-0.8.1-hijklmn found: installing from source
+==> Fetching https://github.com/Cyan4973/xxHash/archive/v0.8.1.tar.gz
+==> xxhash: Successfully installed xxhash-0.8.1-hijklmn
+[+] /opt/software/linux-ubuntu22.04-x86_64_v3/gcc-11.4.0/xxhash-0.8.1-hijklmn
+==> Installing bzip2-1.0.8-opqrstu [3/3]
+==> Extracting bzip2-1.0.8-opqrstu from binary cache
+==> Extracting bzip2-1.0.8-opqrstu from binary cache
+`
+
+func TestCacheUse(t *testing.T) {
+	Convey("You can count the packages spack installed from the binary cache and source", t, func() {
+		use, err := parseCacheUse(strings.NewReader(exampleSpackInstallOutput))
+		So(err, ShouldBeNil)
+		So(use, ShouldResemble, CacheUse{FromCache: 2, FromSource: 1})
+		So(use.HitRate(), ShouldAlmostEqual, 2.0/3)
+
+		use, err = parseCacheUse(strings.NewReader("output"))
+		So(err, ShouldBeNil)
+		So(use, ShouldResemble, CacheUse{})
+		So(use.HitRate(), ShouldEqual, 1)
+	})
+
+	Convey("Given a Builder with a minimum cache hit rate", t, func() {
+		ms3 := &mapS3{files: map[string]string{
+			"users/foo/env/1/" + core.BuilderOut: exampleSpackInstallOutput,
+			"users/foo/env/2/" + core.BuilderOut: "==> Extracting zlib-1.2.13-abcdefg from binary cache\n",
+		}}
+
+		var conf config.Config
+		conf.Spack.MinCacheHitRate = 0.5
+
+		builder, err := New(&conf, ms3, nil)
+		So(err, ShouldBeNil)
+		So(builder.BinaryCacheStatus(), ShouldResemble, BinaryCacheStatus{HitRate: 1})
+
+		Convey("you can record the cache use of builds and see the recent hit rate", func() {
+			status := &Status{}
+			builder.recordCacheUse(context.Background(), status, "users/foo/env/1")
+			So(status.Cache, ShouldResemble, &CacheUse{FromCache: 2, FromSource: 1})
+
+			builder.recordCacheUse(context.Background(), &Status{}, "users/foo/env/2")
+			So(builder.BinaryCacheStatus(), ShouldResemble, BinaryCacheStatus{
+				RecentBuilds: 2,
+				FromCache:    3,
+				FromSource:   1,
+				HitRate:      0.75,
+			})
+
+			for range [cacheHistoryLength]struct{}{} {
+				builder.cacheUses.add(CacheUse{FromSource: 1}, conf.Spack.MinCacheHitRate)
+			}
+
+			So(builder.BinaryCacheStatus(), ShouldResemble, BinaryCacheStatus{
+				RecentBuilds: cacheHistoryLength,
+				FromSource:   cacheHistoryLength,
+				HitRate:      0,
+				Low:          true,
+			})
+		})
+
+		Convey("builds without a readable log aren't recorded", func() {
+			status := &Status{}
+			builder.recordCacheUse(context.Background(), status, "users/foo/env/3")
+			So(status.Cache, ShouldBeNil)
+			So(builder.BinaryCacheStatus().RecentBuilds, ShouldEqual, 0)
+		})
+	})
+}
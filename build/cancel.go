@@ -0,0 +1,134 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"time"
+)
+
+// killTimeout is how long we wait for a cancelled build's wr job to be killed.
+const killTimeout = 5 * time.Minute
+
+// cancellation lets Cancel() stop the background part of a build, and find out
+// whether its wr job was stopped: err is set before done is closed, which
+// happens when the build's environment stops being protected, or when stopping
+// the job fails.
+type cancellation struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+func newCancellation(cancel context.CancelFunc) *cancellation {
+	return &cancellation{cancel: cancel, done: make(chan struct{}), err: ErrBuildNotRunning}
+}
+
+// cancellableBuildContext returns a context for the background part of the
+// build of the given environment, that won't be cancelled along with the given
+// context, but will be by Cancel().
+func (b *Builder) cancellableBuildContext(ctx context.Context, envPath string) context.Context {
+	buildCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+	b.mu.Lock()
+	b.buildCancels[envPath] = newCancellation(cancel)
+	b.mu.Unlock()
+
+	return buildCtx
+}
+
+// Cancel stops the running build of the given environment (a full environment
+// path like "users/foo/env-1", as per Status.Name): gsb stops waiting on and
+// installing it, its wr job is killed and removed from wr, and its S3 working
+// directory is removed.
+//
+// Only returns once the wr job has been stopped. If that fails, the error is
+// returned and the environment remains protected from new builds, so that it
+// can't end up with 2 jobs; try cancelling again. Returns ErrBuildNotRunning
+// if there's no such build.
+func (b *Builder) Cancel(envPath string) error {
+	b.mu.Lock()
+	c, ok := b.buildCancels[envPath]
+	b.mu.Unlock()
+
+	if !ok {
+		return ErrBuildNotRunning
+	}
+
+	c.cancel()
+	<-c.done
+
+	return c.err
+}
+
+// stopCancelledBuild kills and removes the wr job of the given cancelled build,
+// then removes the build's working directory. If the job can't be stopped, the
+// error is passed back to Cancel() and we wait to be cancelled again before
+// retrying.
+func (b *Builder) stopCancelledBuild(ctx context.Context, def *Definition, workPath string) {
+	envPath := def.FullEnvironmentPath()
+	ctx = context.WithoutCancel(ctx)
+
+	for {
+		err := b.killJob(ctx, b.buildStatus(def))
+
+		b.mu.Lock()
+		c := b.buildCancels[envPath]
+
+		if err == nil {
+			c.err = nil
+			b.mu.Unlock()
+
+			break
+		}
+
+		loggerFromContext(ctx).Error("failed to stop cancelled build job", "err", err)
+
+		retryCtx, retry := context.WithCancel(ctx)
+		b.buildCancels[envPath] = newCancellation(retry)
+		c.err = err
+		close(c.done)
+		b.mu.Unlock()
+
+		<-retryCtx.Done()
+	}
+
+	b.removeWorkDir(ctx, workPath, nil)
+}
+
+// killJob kills and removes the wr job recorded in the given status, if any.
+func (b *Builder) killJob(ctx context.Context, status *Status) error {
+	b.statusMu.RLock()
+	jobID, deployment := status.JobID, status.Deployment
+	b.statusMu.RUnlock()
+
+	if jobID == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, killTimeout)
+	defer cancel()
+
+	return b.runnerFor(deployment).Kill(ctx, jobID)
+}
@@ -0,0 +1,111 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	_ "embed"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+const (
+	// CompletionBashBasename is the name of the bash completion script
+	// installed in to scripts directories when completions are enabled.
+	CompletionBashBasename = "completion.bash"
+
+	// CompletionZshBasename is the name of the zsh completion script installed
+	// alongside the bash one, which uses it via bashcompinit.
+	CompletionZshBasename = "completion.zsh"
+)
+
+//go:embed completion.tmpl
+var completionTmplStr string
+var completionTmpl = template.Must(template.New("").Parse(completionTmplStr)) //nolint:gochecknoglobals
+
+var nonIdentifierChars = regexp.MustCompile(`[^A-Za-z0-9_]`) //nolint:gochecknoglobals
+
+// completionScript returns the contents of a bash completion script for the
+// given exes that, the first time each is completed, loads the completion
+// script the exe installed inside the given image, if any.
+func (d *Definition) completionScript(image string, exes []string) string {
+	quoted := make([]string, len(exes))
+
+	for n, exe := range exes {
+		quoted[n] = shellQuote(exe)
+	}
+
+	var sb strings.Builder
+
+	completionTmpl.Execute(&sb, struct { //nolint:errcheck
+		Environment string
+		Function    string
+		Image       string
+		Exes        []string
+	}{
+		Environment: d.FullEnvironmentPath(),
+		Function:    "_gsb_complete_" + nonIdentifierChars.ReplaceAllString(d.FullEnvironmentPath(), "_"),
+		Image:       shellQuote(image),
+		Exes:        quoted,
+	})
+
+	return sb.String()
+}
+
+// shellQuote returns the given string single-quoted for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// completionsDir returns the scripts directory of the given environment if
+// completions are enabled, otherwise blank.
+func (b *Builder) completionsDir(def *Definition) string {
+	if !b.config.Module.Completions {
+		return ""
+	}
+
+	return b.scriptsDir(def)
+}
+
+// installCompletions installs bash and zsh completion scripts for the given
+// exes in to the given environment's scripts directory, if completions are
+// enabled.
+func (b *Builder) installCompletions(def *Definition, exes []string) error {
+	scriptsDir := b.completionsDir(def)
+	if scriptsDir == "" || len(exes) == 0 {
+		return nil
+	}
+
+	bashPath := filepath.Join(scriptsDir, CompletionBashBasename)
+	script := def.completionScript(filepath.Join(scriptsDir, core.ImageBasename), exes)
+
+	if err := b.inst.replaceFile(strings.NewReader(script), bashPath); err != nil {
+		return err
+	}
+
+	return b.inst.replaceFile(strings.NewReader("autoload -U +X bashcompinit && bashcompinit\nsource "+
+		shellQuote(bashPath)+"\n"), filepath.Join(scriptsDir, CompletionZshBasename))
+}
@@ -0,0 +1,98 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestCompletion(t *testing.T) {
+	Convey("Given a Builder and a Definition", t, func() {
+		var conf config.Config
+		conf.Module.ScriptsInstallDir = t.TempDir()
+
+		builder, err := New(&conf, &s3mock.MockS3{}, nil)
+		So(err, ShouldBeNil)
+
+		def := getExampleDefinition()
+		scriptsDir := ScriptsDirFromNameAndVersion(conf.Module.ScriptsInstallDir,
+			def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+		So(os.MkdirAll(scriptsDir, dirPerms), ShouldBeNil)
+
+		bashPath := filepath.Join(scriptsDir, CompletionBashBasename)
+		exes := []string{"xxhsum", "R"}
+
+		Convey("completion scripts are only installed if enabled", func() {
+			So(builder.installCompletions(def, exes), ShouldBeNil)
+			So(builder.completionsDir(def), ShouldBeBlank)
+
+			_, err = os.Stat(bashPath)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("when enabled, completion defers to scripts inside the image", func() {
+			conf.Module.Completions = true
+
+			So(builder.installCompletions(def, exes), ShouldBeNil)
+			So(builder.completionsDir(def), ShouldEqual, scriptsDir)
+
+			zsh, errr := os.ReadFile(filepath.Join(scriptsDir, CompletionZshBasename))
+			So(errr, ShouldBeNil)
+			So(string(zsh), ShouldContainSubstring, "bashcompinit\nsource '"+bashPath+"'\n")
+
+			So(def.ModuleUsage("softpack", "", scriptsDir), ShouldContainSubstring,
+				"source "+bashPath+"\n")
+
+			root := t.TempDir()
+			binDir := t.TempDir()
+			writeExecutable(t, filepath.Join(binDir, "singularity"),
+				"#!/bin/bash\nshift 2\nexec \"${@//\\/opt\\/view/"+root+"/opt/view}\"\n")
+			writeExecutable(t, filepath.Join(root, "opt/view/share/bash-completion/completions/xxhsum"),
+				"_xxhsum() { COMPREPLY=($(compgen -W '--check --help' -- \"$2\")); }\n"+
+					"complete -F _xxhsum xxhsum\n")
+
+			t.Setenv("PATH", binDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+			out, errr := exec.Command("bash", "-c", `
+				source "$1"
+				for exe in xxhsum R; do
+					spec="$(complete -p "$exe")"
+					fn="${spec#*-F }"; fn="${fn%% *}"
+					"$fn" "$exe" --ch "$exe"
+					echo "$exe: $? $(complete -p "$exe" 2>/dev/null)"
+				done
+				_xxhsum xxhsum --ch xxhsum
+				echo "${COMPREPLY[@]}"
+			`, "bash", bashPath).CombinedOutput()
+			So(errr, ShouldBeNil)
+			So(string(out), ShouldEqual, "xxhsum: 124 complete -F _xxhsum xxhsum\nR: 124 \n--check\n")
+		})
+	})
+}
@@ -0,0 +1,117 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const ErrIncompleteCredentials = internal.Error("credentials broker gave incomplete credentials")
+
+// credentialsBasename is the name of the file in a build's working directory
+// that brokered credentials are put in, for the build's wr job to move out of
+// S3 when it starts.
+const credentialsBasename = "gsb-credentials"
+
+// brokeredCredentials are the AWS credential_process style JSON output of a
+// credentials broker.
+type brokeredCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+// credentialsFile returns the contents of an AWS credentials file containing
+// our credentials as the default profile.
+func (c brokeredCredentials) credentialsFile() string {
+	file := "[default]\naws_access_key_id = " + c.AccessKeyID +
+		"\naws_secret_access_key = " + c.SecretAccessKey + "\n"
+
+	if c.SessionToken != "" {
+		file += "aws_session_token = " + c.SessionToken + "\n"
+	}
+
+	return file
+}
+
+// supplyCredentials runs the configured credentials broker, if any, and puts
+// the credentials it gives in the build working directory workPath, for the
+// build's wr job to take when it starts. This is done before the job is added
+// and again before each retry, so that every attempt gets freshly minted
+// credentials, and they are never part of the wr job itself.
+func (b *Builder) supplyCredentials(ctx context.Context, workPath string) error {
+	if b.config.S3.CredentialsBroker == "" {
+		return nil
+	}
+
+	creds, err := b.brokerCredentials(ctx, filepath.Join(b.config.S3.BuildBase, workPath))
+	if err != nil {
+		return err
+	}
+
+	return b.s3.UploadData(ctx, strings.NewReader(creds), filepath.Join(workPath, credentialsBasename))
+}
+
+// brokerCredentials runs the configured credentials broker to get short-lived
+// credentials for the build whose artefacts will be at the given S3 path.
+// Returns them as the contents of an AWS credentials file.
+func (b *Builder) brokerCredentials(ctx context.Context, s3Path string) (string, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", b.config.S3.CredentialsBroker)
+	cmd.Env = append(os.Environ(),
+		"GSB_BUILD_PATH="+s3Path,
+		"GSB_BINARY_CACHE="+b.config.S3.BinaryCache,
+	)
+
+	var stderr strings.Builder
+
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("credentials broker failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var creds brokeredCredentials
+
+	if err = json.Unmarshal(out, &creds); err != nil {
+		return "", fmt.Errorf("credentials broker gave invalid JSON: %w", err)
+	}
+
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return "", ErrIncompleteCredentials
+	}
+
+	loggerFromContext(ctx).Debug("brokered build credentials", "expiration", creds.Expiration)
+
+	return creds.credentialsFile(), nil
+}
@@ -0,0 +1,125 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+func TestCredentialsBroker(t *testing.T) {
+	Convey("Given a Builder with a credentials broker", t, func() {
+		mints := filepath.Join(t.TempDir(), "mints")
+
+		builder, conf, ms3, mwr := newTestBuilder(t, func(conf *config.Config) {
+			conf.S3.BuildBase = "builds"
+			conf.S3.CredentialsBroker = `echo >> ` + mints + `; printf '{"Version": 1, "AccessKeyId": "key-%s-%s", ` +
+				`"SecretAccessKey": "secret", "SessionToken": "token"}' "$GSB_BUILD_PATH $GSB_BINARY_CACHE" ` +
+				`$(wc -l < ` + mints + `)`
+		})
+
+		def := getExampleDefinition()
+		workPath := "users/foo/env/1/.builds/id"
+		credsPath := filepath.Join(workPath, credentialsBasename)
+
+		Convey("builds get its credentials instead of the long-lived ones", func() {
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldContainSubstring, "%files\n\t/home/ubuntu/.aws/config /root/.aws/config\n")
+			So(defFile, ShouldContainSubstring, "%post\n\t# Use the short-lived credentials supplied for this "+
+				"build, kept out of the image.\n\texport AWS_SHARED_CREDENTIALS_FILE=/tmp/gsb-aws/credentials\n")
+
+			wrInput, err := builder.generateWRInput(context.Background(), def, defFile, "builds/"+workPath)
+			So(err, ShouldBeNil)
+
+			var job struct {
+				Cmd string
+				Env []string
+			}
+
+			err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&job)
+			So(err, ShouldBeNil)
+			So(job.Cmd, ShouldContainSubstring, "mv "+credentialsBasename+" ")
+			So(job.Env, ShouldBeNil)
+			So(wrInput, ShouldNotContainSubstring, "secret")
+
+			err = builder.supplyCredentials(context.Background(), workPath)
+			So(err, ShouldBeNil)
+			So(ms3.Files[credsPath], ShouldEqual, "[default]\naws_access_key_id = key-builds/"+workPath+
+				" s3://spack-1\naws_secret_access_key = secret\naws_session_token = token\n")
+
+			Convey("and retried jobs get fresh ones", func() {
+				mwr.Fail = true
+				mwr.FailTransient = true
+
+				wrStatus, err := builder.waitForJob(context.Background(), mwr, builder.buildStatus(def), workPath, "id")
+				So(err, ShouldBeNil)
+				So(wrStatus, ShouldEqual, wr.WRJobStatusComplete)
+				So(mwr.Kicks, ShouldEqual, 1)
+				So(ms3.Files[credsPath], ShouldContainSubstring, "s3://spack-2\n")
+			})
+		})
+
+		Convey("builds fail if it fails or gives bad credentials", func() {
+			var err error
+
+			for _, broker := range []string{
+				"echo oops >&2; false",
+				"echo not json",
+				`echo '{"AccessKeyId": "key"}'`,
+			} {
+				conf.S3.CredentialsBroker = broker
+
+				err = builder.supplyCredentials(context.Background(), workPath)
+				So(err, ShouldNotBeNil)
+			}
+
+			So(err, ShouldEqual, ErrIncompleteCredentials)
+		})
+
+		Convey("builds without one use the long-lived credentials", func() {
+			conf.S3.CredentialsBroker = ""
+
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldContainSubstring, "%files\n\t/home/ubuntu/.aws /root/.aws\n")
+			So(defFile, ShouldNotContainSubstring, "AWS_SHARED_CREDENTIALS_FILE")
+
+			wrInput, err := builder.generateWRInput(context.Background(), def, defFile, "builds/"+workPath)
+			So(err, ShouldBeNil)
+			So(wrInput, ShouldNotContainSubstring, credentialsBasename)
+
+			err = builder.supplyCredentials(context.Background(), workPath)
+			So(err, ShouldBeNil)
+			So(ms3.Files, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,197 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const (
+	ErrInvalidCron = internal.Error("invalid cron expression")
+
+	cronFields = 5
+
+	// cronSearchYears is how far ahead cronSchedule.next() looks for a
+	// matching time, beyond which it assumes there isn't one (eg. for the 30th
+	// of February).
+	cronSearchYears = 5
+)
+
+// cronField is the set of values (up to 63) a cron field matches.
+type cronField uint64
+
+func (f cronField) has(value int) bool {
+	return f&(1<<uint(value)) != 0
+}
+
+// cronBounds are the minimum and maximum values of each cron field. Day of
+// week 7 is Sunday, the same as 0.
+var cronBounds = [cronFields][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}} //nolint:gochecknoglobals
+
+// cronSchedule is a parsed standard 5 field cron expression.
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+
+	// domAny and dowAny are true if the day of month or week fields were "*",
+	// since if both are restricted, days matching either are matched.
+	domAny, dowAny bool
+}
+
+// parseCron parses a cron expression made of 5 space separated fields: minute,
+// hour, day of month, month and day of week. Each field is a comma separated
+// list of "*", a number or a range like "1-5", optionally followed by a step
+// like "/15".
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != cronFields {
+		return nil, ErrInvalidCron
+	}
+
+	var parsed [cronFields]cronField
+
+	for i, field := range fields {
+		f, err := parseCronField(field, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, err
+		}
+
+		parsed[i] = f
+	}
+
+	if parsed[4].has(7) {
+		parsed[4] |= 1
+	}
+
+	return &cronSchedule{
+		minute: parsed[0],
+		hour:   parsed[1],
+		dom:    parsed[2],
+		month:  parsed[3],
+		dow:    parsed[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, low, high int) (cronField, error) {
+	var f cronField
+
+	for _, part := range strings.Split(field, ",") {
+		first, last, step, err := parseCronPart(part, low, high)
+		if err != nil {
+			return 0, err
+		}
+
+		for v := first; v <= last; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+
+	return f, nil
+}
+
+// parseCronPart parses one comma separated part of a cron field, returning the
+// range of values it covers and the step between them.
+func parseCronPart(part string, low, high int) (int, int, int, error) {
+	rng, stepStr, hasStep := strings.Cut(part, "/")
+	step := 1
+
+	if hasStep {
+		var err error
+
+		if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+			return 0, 0, 0, ErrInvalidCron
+		}
+	}
+
+	if rng == "*" {
+		return low, high, step, nil
+	}
+
+	firstStr, lastStr, isRange := strings.Cut(rng, "-")
+
+	first, err := strconv.Atoi(firstStr)
+	if err != nil {
+		return 0, 0, 0, ErrInvalidCron
+	}
+
+	last := first
+
+	switch {
+	case isRange:
+		if last, err = strconv.Atoi(lastStr); err != nil {
+			return 0, 0, 0, ErrInvalidCron
+		}
+	case hasStep:
+		last = high
+	}
+
+	if first < low || last > high || first > last {
+		return 0, 0, 0, ErrInvalidCron
+	}
+
+	return first, last, step, nil
+}
+
+// next returns the first time after t that matches the schedule, in t's
+// location. Returns false if there isn't one in the next few years.
+func (c *cronSchedule) next(t time.Time) (time.Time, bool) {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	end := t.AddDate(cronSearchYears, 0, 0)
+
+	for t.Before(end) {
+		switch {
+		case !c.month.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !c.hour.has(t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case !c.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// matchesDay returns true if t's day matches our day of month and day of week
+// fields. If both are restricted, a day matching either of them is matched.
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom.has(t.Day())
+	dow := c.dow.has(int(t.Weekday()))
+
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+
+	return dom || dow
+}
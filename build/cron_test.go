@@ -0,0 +1,76 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCron(t *testing.T) {
+	Convey("Invalid cron expressions can't be parsed", t, func() {
+		for _, expr := range []string{
+			"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+			"* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "1-a * * * *", "1,,2 * * * *",
+		} {
+			_, err := parseCron(expr)
+			So(err, ShouldEqual, ErrInvalidCron)
+		}
+	})
+
+	Convey("Cron expressions give the next matching time", t, func() {
+		from := time.Date(2024, 1, 5, 10, 7, 30, 0, time.UTC) // a Friday
+
+		for _, test := range []struct {
+			expr string
+			next time.Time
+		}{
+			{"* * * * *", time.Date(2024, 1, 5, 10, 8, 0, 0, time.UTC)},
+			{"*/15 * * * *", time.Date(2024, 1, 5, 10, 15, 0, 0, time.UTC)},
+			{"30 2 * * *", time.Date(2024, 1, 6, 2, 30, 0, 0, time.UTC)},
+			{"0 9 * * 1-5", time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC)},
+			{"0 0 * * 7", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+			{"0 0 1,15 * *", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+			{"0 0 20 * 6", time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC)},
+			{"0 12 1 3 *", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+			{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+			{"5-10/5 22 * * *", time.Date(2024, 1, 5, 22, 5, 0, 0, time.UTC)},
+		} {
+			c, err := parseCron(test.expr)
+			So(err, ShouldBeNil)
+
+			next, ok := c.next(from)
+			So(ok, ShouldBeTrue)
+			So(next, ShouldEqual, test.next)
+		}
+
+		c, err := parseCron("0 0 30 2 *")
+		So(err, ShouldBeNil)
+
+		_, ok := c.next(from)
+		So(ok, ShouldBeFalse)
+	})
+}
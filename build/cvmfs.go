@@ -0,0 +1,158 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+)
+
+// PublicationState describes how far a build has got in being published to
+// CernVM-FS.
+type PublicationState string
+
+const (
+	PublicationPublishing PublicationState = "publishing"
+	PublicationPublished  PublicationState = "published"
+	PublicationFailed     PublicationState = "failed"
+)
+
+// Publication describes the publication of an installed build to CernVM-FS.
+// Done is when publication finished, and Error says why it failed, if it did.
+type Publication struct {
+	State PublicationState
+	Done  *time.Time
+	Error string
+}
+
+// publisher publishes installed scripts directories to a CernVM-FS repository,
+// one at a time, since a repository can only have one open transaction.
+type publisher struct {
+	mu           sync.Mutex
+	conf         config.CVMFS
+	scriptsBases []string
+}
+
+// newPublisherFromConfig returns a publisher for the configured CVMFS
+// repository, or nil if CVMFS publication isn't configured.
+func newPublisherFromConfig(conf *config.Config) *publisher {
+	if !conf.CVMFS.Enabled() {
+		return nil
+	}
+
+	p := &publisher{conf: conf.CVMFS}
+
+	for _, target := range conf.ScriptsTargets() {
+		p.scriptsBases = append(p.scriptsBases, target.Dir)
+	}
+
+	return p
+}
+
+// publish runs our publish command to publish the given scripts directory,
+// which must be inside one of our scriptsBases.
+func (p *publisher) publish(ctx context.Context, scriptsDir string) error {
+	rel, err := p.relativeScriptsDir(scriptsDir)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", p.conf.Command())
+	cmd.Env = append(os.Environ(),
+		"GSB_CVMFS_REPO="+p.conf.Repository,
+		"GSB_SCRIPTS_DIR="+scriptsDir,
+		"GSB_CVMFS_DEST="+filepath.Join(p.conf.PublishDir(), rel),
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cvmfs publication failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// relativeScriptsDir returns the path of the given scripts directory relative
+// to whichever of our scriptsBases it is in.
+func (p *publisher) relativeScriptsDir(scriptsDir string) (string, error) {
+	var (
+		rel string
+		err error
+	)
+
+	for _, base := range p.scriptsBases {
+		rel, err = filepath.Rel(base, scriptsDir)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			return rel, nil
+		}
+	}
+
+	return rel, err
+}
+
+// publishToCVMFS publishes the installed scripts directory of the given
+// Definition to CernVM-FS if configured, recording progress in the build's
+// status. Failure to publish doesn't fail the build, since the environment is
+// still installed locally.
+func (b *Builder) publishToCVMFS(ctx context.Context, def *Definition) {
+	if b.publisher == nil {
+		return
+	}
+
+	status := b.buildStatus(def)
+
+	b.statusMu.Lock()
+	status.Publication = &Publication{State: PublicationPublishing}
+	b.statusMu.Unlock()
+
+	scriptsDir := b.scriptsDir(def)
+	err := b.publisher.publish(ctx, scriptsDir)
+	done := time.Now()
+
+	publication := &Publication{State: PublicationPublished, Done: &done}
+
+	if err != nil {
+		publication.State = PublicationFailed
+		publication.Error = err.Error()
+
+		loggerFromContext(ctx).Error("publishing to cvmfs failed", "err", err)
+	} else {
+		loggerFromContext(ctx).Debug("published to cvmfs")
+	}
+
+	b.statusMu.Lock()
+	status.Publication = publication
+	b.statusMu.Unlock()
+}
@@ -0,0 +1,108 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestCVMFS(t *testing.T) {
+	Convey("Given a Builder configured to publish to CVMFS", t, func() {
+		var conf config.Config
+		conf.Module.ScriptsInstallDir = t.TempDir()
+		conf.CVMFS.Repository = "softpack.example.org"
+		conf.CVMFS.Dir = filepath.Join(t.TempDir(), "cvmfs")
+		conf.CVMFS.PublishCommand = `mkdir -p "$(dirname "$GSB_CVMFS_DEST")" && ` +
+			`cp -a "$GSB_SCRIPTS_DIR" "$GSB_CVMFS_DEST" && echo "$GSB_CVMFS_REPO" > "$GSB_CVMFS_DEST/repo"`
+
+		builder, err := New(&conf, &s3mock.MockS3{}, nil)
+		So(err, ShouldBeNil)
+
+		def := getExampleDefinition()
+		scriptsDir := ScriptsDirFromNameAndVersion(conf.Module.ScriptsInstallDir,
+			def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+		So(os.MkdirAll(scriptsDir, 0755), ShouldBeNil)
+		So(os.WriteFile(filepath.Join(scriptsDir, core.ImageBasename), []byte("image"), 0600), ShouldBeNil)
+
+		envPath := filepath.Join(def.EnvironmentPath, def.EnvironmentName)
+
+		Convey("installed environments are published, with the result in their status", func() {
+			builder.publishToCVMFS(context.Background(), def)
+
+			dest := filepath.Join(conf.CVMFS.Dir, "groups/hgi/xxhash/0.8.1"+ScriptsDirSuffix)
+
+			data, err := os.ReadFile(filepath.Join(dest, core.ImageBasename))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "image")
+
+			data, err = os.ReadFile(filepath.Join(dest, "repo"))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "softpack.example.org\n")
+
+			detail, err := builder.StatusDetail(envPath, def.EnvironmentVersion)
+			So(err, ShouldBeNil)
+			So(detail.Publication, ShouldNotBeNil)
+			So(detail.Publication.State, ShouldEqual, PublicationPublished)
+			So(detail.Publication.Done, ShouldNotBeNil)
+			So(detail.Publication.Error, ShouldBeBlank)
+
+			Convey("which is reset by the next build", func() {
+				builder.newBuildLog(def)
+
+				detail, err = builder.StatusDetail(envPath, def.EnvironmentVersion)
+				So(err, ShouldBeNil)
+				So(detail.Publication, ShouldBeNil)
+			})
+		})
+
+		Convey("publication failures are recorded in the status", func() {
+			builder.publisher.conf.PublishCommand = "echo no transaction; exit 3"
+
+			builder.publishToCVMFS(context.Background(), def)
+
+			detail, err := builder.StatusDetail(envPath, def.EnvironmentVersion)
+			So(err, ShouldBeNil)
+			So(detail.Publication.State, ShouldEqual, PublicationFailed)
+			So(detail.Publication.Error, ShouldContainSubstring, "no transaction")
+		})
+	})
+
+	Convey("Builders without CVMFS configured don't publish", t, func() {
+		builder, err := New(&config.Config{}, &s3mock.MockS3{}, nil)
+		So(err, ShouldBeNil)
+
+		def := getExampleDefinition()
+		builder.publishToCVMFS(context.Background(), def)
+
+		So(builder.buildStatus(def).Publication, ShouldBeNil)
+	})
+}
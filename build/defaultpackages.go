@@ -0,0 +1,59 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// defaultPackages returns the configured spack.defaultPackages that are added
+// to every environment, apart from any that the given Definition requests
+// itself (in which case its requested version is used).
+func (b *Builder) defaultPackages(def *Definition) core.Packages {
+	requested := packageNames(def.Packages)
+
+	var pkgs core.Packages
+
+	for _, spec := range b.config.Spack.DefaultPackages {
+		name, version, _ := strings.Cut(spec, "@")
+		if !requested[name] {
+			pkgs = append(pkgs, core.Package{Name: name, Version: version})
+		}
+	}
+
+	return pkgs
+}
+
+// packageNames returns a set of the names of the given packages.
+func packageNames(pkgs core.Packages) map[string]bool {
+	names := make(map[string]bool, len(pkgs))
+
+	for _, pkg := range pkgs {
+		names[pkg.Name] = true
+	}
+
+	return names
+}
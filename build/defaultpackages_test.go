@@ -0,0 +1,79 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+func TestDefaultPackages(t *testing.T) {
+	Convey("Given a builder with default packages", t, func() {
+		builder, _, _, _ := newTestBuilder(t, func(conf *config.Config) {
+			conf.Spack.DefaultPackages = []string{"ca-certificates-mozilla", "site-profile@1.0", "xxhash@0.8.0"}
+		})
+
+		def := getExampleDefinition()
+
+		Convey("they're added to every environment, unless requested", func() {
+			So(builder.defaultPackages(def), ShouldResemble, core.Packages{
+				{Name: "ca-certificates-mozilla"}, {Name: "site-profile", Version: "1.0"},
+			})
+
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldContainSubstring, "  - py-anndata@3.14 arch=None-None-x86_64_v4\n"+
+				"  - ca-certificates-mozilla arch=None-None-x86_64_v4\n"+
+				"  - site-profile@1.0 arch=None-None-x86_64_v4\n  view: /opt/view\n")
+			So(defFile, ShouldContainSubstring, `for pkg in "xxhash" "r-seurat" "py-anndata"; do`)
+
+			def.SpackYAML = "spack:\n  specs:\n  - xxhash@0.8.1\n"
+
+			defFile, err = builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldContainSubstring, "  specs:\n    - xxhash@0.8.1 arch=None-None-x86_64_v4\n"+
+				"    - ca-certificates-mozilla arch=None-None-x86_64_v4\n"+
+				"    - site-profile@1.0 arch=None-None-x86_64_v4\n")
+		})
+
+		Convey("they're listed separately in softpack.yml", func() {
+			lock := `{"roots":[{"hash":"a"},{"hash":"b"}],"concrete_specs":{` +
+				`"a":{"name":"xxhash","version":"0.8.1"},"b":{"name":"site-profile","version":"1.0"}}}`
+
+			yml, err := spackLockToSoftPackYML([]byte(lock), softpackTemplateVars{Description: []string{"desc"}},
+				packageNames(builder.defaultPackages(def)))
+			So(err, ShouldBeNil)
+			So(yml, ShouldEndWith, "packages:\n  - xxhash@0.8.1\nsite_packages:\n  - site-profile@1.0\n")
+
+			parsed, err := ParseSoftpackYML(strings.NewReader(yml))
+			So(err, ShouldBeNil)
+			So(parsed.Packages, ShouldResemble, core.Packages{{Name: "xxhash", Version: "0.8.1"}})
+		})
+	})
+}
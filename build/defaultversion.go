@@ -0,0 +1,125 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
+)
+
+const (
+	tclVersionBasename  = ".version"
+	lmodDefaultBasename = "default"
+)
+
+// UpdateDefaultVersion makes the newest version installed in the given module
+// directory of an environment its default, as configured by the config's
+// module.defaultVersion, so that loading the environment without a version
+// loads the newest one. It is a no-op if defaultVersion isn't configured.
+func UpdateDefaultVersion(filesystem fsys.FS, conf *config.Config, moduleDir string) error {
+	i, err := newInstallerFromConfig(filesystem, conf)
+	if err != nil {
+		return err
+	}
+
+	return i.updateDefaultVersion(moduleDir, conf.Module.DefaultVersion)
+}
+
+// updateDefaultVersion atomically replaces the tcl .version file or Lmod
+// default symlink (depending on style) in moduleDir so that it names the newest
+// version there, or removes it if there are no versions left.
+func (i *installer) updateDefaultVersion(moduleDir, style string) error {
+	if style == "" {
+		return nil
+	}
+
+	newest, err := i.newestModuleVersion(moduleDir)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(moduleDir, tclVersionBasename)
+	if style == config.DefaultVersionLmod {
+		path = filepath.Join(moduleDir, lmodDefaultBasename)
+	}
+
+	switch {
+	case newest == "":
+		if err = i.fs.Remove(path); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	case style == config.DefaultVersionLmod:
+		return i.replaceSymlink(newest, path)
+	default:
+		return i.replaceFile(strings.NewReader("#%Module1.0\nset ModulesVersion \""+newest+"\"\n"), path)
+	}
+}
+
+// newestModuleVersion returns the newest version of the module files in the
+// given directory, ignoring hidden files (such as archived installations) and
+// any Lmod default symlink. Returns a blank string if there are none.
+func (i *installer) newestModuleVersion(moduleDir string) (string, error) {
+	entries, err := i.fs.ReadDir(moduleDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	var newest string
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if entry.IsDir() || strings.HasPrefix(name, ".") || name == lmodDefaultBasename {
+			continue
+		}
+
+		if newest == "" || compareVersions(name, newest) > 0 {
+			newest = name
+		}
+	}
+
+	return newest, nil
+}
+
+// replaceSymlink atomically replaces whatever is at the given path with a
+// symlink to target, by creating the symlink alongside it and then renaming.
+func (i *installer) replaceSymlink(target, path string) error {
+	newPath := hiddenPath(path, newSuffix)
+
+	i.fs.Remove(newPath)
+
+	if err := i.fs.Symlink(target, newPath); err != nil {
+		return err
+	}
+
+	return i.fs.Rename(newPath, path)
+}
@@ -0,0 +1,103 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+)
+
+func TestDefaultVersion(t *testing.T) {
+	Convey("Given an environment with several installed versions", t, func() {
+		mfs := fsmock.New()
+		moduleDir := "/modules/groups/hgi/xxhash"
+
+		So(mfs.MkdirAll(moduleDir, dirPerms), ShouldBeNil)
+
+		inst := newInstaller(mfs)
+
+		for _, version := range []string{"1.9", "1.10", "1", ".1.11.archived-20240101T000000"} {
+			So(inst.installFile(strings.NewReader("module"), filepath.Join(moduleDir, version)), ShouldBeNil)
+		}
+
+		tclPath := filepath.Join(moduleDir, tclVersionBasename)
+		lmodPath := filepath.Join(moduleDir, lmodDefaultBasename)
+
+		Convey("nothing is made the default if not configured", func() {
+			So(inst.updateDefaultVersion(moduleDir, ""), ShouldBeNil)
+			So(mfs.Exists(tclPath), ShouldBeFalse)
+			So(mfs.Exists(lmodPath), ShouldBeFalse)
+		})
+
+		Convey("a tcl .version file can name the newest version", func() {
+			So(inst.updateDefaultVersion(moduleDir, config.DefaultVersionTcl), ShouldBeNil)
+
+			data, err := mfs.ReadFile(tclPath)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "#%Module1.0\nset ModulesVersion \"1.10\"\n")
+
+			So(inst.installFile(strings.NewReader("module"), filepath.Join(moduleDir, "2")), ShouldBeNil)
+			So(inst.updateDefaultVersion(moduleDir, config.DefaultVersionTcl), ShouldBeNil)
+
+			data, err = mfs.ReadFile(tclPath)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "#%Module1.0\nset ModulesVersion \"2\"\n")
+			So(mfs.Exists(hiddenPath(tclPath, newSuffix)), ShouldBeFalse)
+		})
+
+		Convey("an Lmod default symlink can point to the newest version", func() {
+			So(inst.updateDefaultVersion(moduleDir, config.DefaultVersionLmod), ShouldBeNil)
+
+			dest, err := mfs.Readlink(lmodPath)
+			So(err, ShouldBeNil)
+			So(dest, ShouldEqual, "1.10")
+
+			So(inst.fs.Remove(filepath.Join(moduleDir, "1.10")), ShouldBeNil)
+			So(inst.updateDefaultVersion(moduleDir, config.DefaultVersionLmod), ShouldBeNil)
+
+			dest, err = mfs.Readlink(lmodPath)
+			So(err, ShouldBeNil)
+			So(dest, ShouldEqual, "1.9")
+		})
+
+		Convey("the default is removed once there are no versions left", func() {
+			conf := &config.Config{}
+			conf.Module.DefaultVersion = config.DefaultVersionTcl
+
+			So(UpdateDefaultVersion(mfs, conf, moduleDir), ShouldBeNil)
+			So(mfs.Exists(tclPath), ShouldBeTrue)
+
+			for _, version := range []string{"1.9", "1.10", "1"} {
+				So(inst.fs.Remove(filepath.Join(moduleDir, version)), ShouldBeNil)
+			}
+
+			So(UpdateDefaultVersion(mfs, conf, moduleDir), ShouldBeNil)
+			So(mfs.Exists(tclPath), ShouldBeFalse)
+		})
+	})
+}
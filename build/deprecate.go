@@ -0,0 +1,95 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// Deprecate marks the installed environment described by def's path, name and
+// version as deprecated, suggesting the given replacement environment (eg.
+// "users/foo/bar-2") if not blank. Nothing is removed: a warning that is shown
+// when the module is loaded is added to the installed module file, the usage
+// README is regenerated with a deprecation notice and uploaded to S3, and both
+// are sent to core.
+func (b *Builder) Deprecate(ctx context.Context, def *Definition, replacement string) error {
+	if err := def.ValidateEnvironment(); err != nil {
+		return err
+	}
+
+	if err := ValidateReplacement(replacement); err != nil {
+		return err
+	}
+
+	moduleFileData, err := b.addDeprecationWarningToModule(def, replacement)
+	if err != nil {
+		return err
+	}
+
+	readme := def.DeprecatedModuleUsage(b.config.Module.LoadPath, b.config.Module.KernelsDir,
+		b.completionsDir(def), replacement)
+	s3Path := filepath.Join(def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+
+	if err = b.s3.UploadData(ctx, strings.NewReader(readme), filepath.Join(s3Path, core.UsageBasename)); err != nil {
+		return err
+	}
+
+	return b.addArtifactsToRepo(ctx,
+		map[string]io.Reader{
+			core.ModuleForCoreBasename: strings.NewReader(moduleFileData),
+			core.UsageBasename:         strings.NewReader(readme),
+		},
+		def.FullEnvironmentPath(),
+	)
+}
+
+// addDeprecationWarningToModule replaces any existing deprecation warning in
+// def's installed module file with a new one, and returns the new contents of
+// the module file.
+func (b *Builder) addDeprecationWarningToModule(def *Definition, replacement string) (string, error) {
+	modulePath := filepath.Join(ModuleDirFromName(b.config.Module.ModuleInstallDir,
+		def.EnvironmentPath, def.EnvironmentName), def.EnvironmentVersion)
+
+	f, err := b.inst.fs.Open(modulePath)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := io.ReadAll(f)
+	f.Close()
+
+	if err != nil {
+		return "", err
+	}
+
+	module, _, _ := strings.Cut(string(data), deprecationMarker)
+	module = strings.TrimRight(module, "\n") + "\n" + def.ModuleDeprecationWarning(replacement)
+
+	return module, b.inst.replaceFile(strings.NewReader(module), modulePath)
+}
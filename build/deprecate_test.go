@@ -0,0 +1,130 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/coremock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+)
+
+func TestDeprecate(t *testing.T) {
+	Convey("Given a Builder and an installed environment", t, func() {
+		ms3 := &s3mock.MockS3{}
+		mc := coremock.NewMockCore()
+		msc := httptest.NewServer(mc)
+
+		defer msc.Close()
+
+		var conf config.Config
+		conf.CoreURL = msc.URL
+		conf.Module.ModuleInstallDir = "/modules"
+		conf.Module.LoadPath = "HGI/softpack"
+
+		builder, err := New(&conf, ms3, wrmock.NewMockWR(0, 0))
+		So(err, ShouldBeNil)
+
+		mfs := fsmock.New()
+		builder.inst.fs = mfs
+
+		def := getExampleDefinition()
+		moduleFile := def.ToModule("/scripts", nil, []string{"xxhsum"})
+		moduleDir := ModuleDirFromName(conf.Module.ModuleInstallDir, def.EnvironmentPath, def.EnvironmentName)
+		modulePath := filepath.Join(moduleDir, def.EnvironmentVersion)
+
+		So(mfs.MkdirAll(moduleDir, dirPerms), ShouldBeNil)
+		writeMockFile(mfs, modulePath, moduleFile)
+
+		Convey("You can Deprecate() it, adding a warning to the module and README", func() {
+			err = builder.Deprecate(context.Background(), def, "groups/hgi/xxhash-0.8.2")
+			So(err, ShouldBeNil)
+
+			data, err := mfs.ReadFile(modulePath)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldStartWith, moduleFile)
+			So(string(data), ShouldContainSubstring, `puts stderr "WARNING: groups/hgi/xxhash-0.8.1 is `+
+				`deprecated; please use groups/hgi/xxhash-0.8.2 instead."`)
+
+			mode, err := mfs.Mode(modulePath)
+			So(err, ShouldBeNil)
+			So(mode, ShouldEqual, fs.FileMode(perms))
+
+			So(ms3.Readme, ShouldStartWith, "# Usage\n\n**This environment is deprecated; "+
+				"please use groups/hgi/xxhash-0.8.2 instead.**\n\nTo use this environment")
+
+			coreModule, ok := mc.GetFile(filepath.Join(def.getRepoPath(), core.ModuleForCoreBasename))
+			So(ok, ShouldBeTrue)
+			So(coreModule, ShouldEqual, string(data))
+
+			coreReadme, ok := mc.GetFile(filepath.Join(def.getRepoPath(), core.UsageBasename))
+			So(ok, ShouldBeTrue)
+			So(coreReadme, ShouldEqual, ms3.Readme)
+
+			Convey("and deprecating again replaces the warning", func() {
+				err = builder.Deprecate(context.Background(), def, "")
+				So(err, ShouldBeNil)
+
+				data, err = mfs.ReadFile(modulePath)
+				So(err, ShouldBeNil)
+				So(strings.Count(string(data), deprecationMarker), ShouldEqual, 1)
+				So(string(data), ShouldContainSubstring, `"WARNING: groups/hgi/xxhash-0.8.1 is deprecated."`)
+				So(string(data), ShouldNotContainSubstring, "0.8.2")
+				So(ms3.Readme, ShouldStartWith, "# Usage\n\n**This environment is deprecated.**\n")
+			})
+		})
+
+		Convey("Deprecate() fails for invalid or uninstalled environments", func() {
+			def.EnvironmentVersion = ""
+			So(builder.Deprecate(context.Background(), def, ""), ShouldEqual, ErrInvalidVersion)
+
+			def.EnvironmentVersion = "1"
+			for _, replacement := range []string{
+				"users/foo", "other/foo/bar", "users/foo/../bar", `users/foo/bar" ; exec rm -rf / ; "`,
+				"users/foo/[exec rm]", "users/foo/bar/1/2",
+			} {
+				So(builder.Deprecate(context.Background(), def, replacement), ShouldEqual, ErrInvalidReplacement)
+			}
+
+			So(ValidateReplacement("groups/hgi/xxhash-2"), ShouldBeNil)
+			So(ValidateReplacement("groups/hgi/xxhash/2"), ShouldBeNil)
+
+			def.EnvironmentVersion = "2"
+			err = builder.Deprecate(context.Background(), def, "")
+			So(errors.Is(err, fs.ErrNotExist), ShouldBeTrue)
+			So(ms3.Readme, ShouldBeBlank)
+		})
+	})
+}
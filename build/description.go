@@ -0,0 +1,147 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// moduleHelpWidth is the width, in characters, that descriptions are
+	// wrapped to in module help.
+	moduleHelpWidth = 80
+
+	tabWidth = 4
+)
+
+var (
+	mdLinkRegexp     = regexp.MustCompile(`!?\[([^\]]*)\]\(([^)\s]*)\)`) //nolint:gochecknoglobals
+	mdHeadingRegexp  = regexp.MustCompile(`^\s*#{1,6}\s+`)               //nolint:gochecknoglobals
+	mdEmphasisRegexp = regexp.MustCompile("\\*\\*|__|`")                 //nolint:gochecknoglobals
+
+	tclEscaper = strings.NewReplacer( //nolint:gochecknoglobals
+		`\`, `\\`, `"`, `\"`, `$`, `\$`, `[`, `\[`, `]`, `\]`, `{`, `\{`, `}`, `\}`,
+	)
+)
+
+// descriptionLines returns the lines of the given description, tidied up so
+// that they can be safely included in a softpack.yml: Windows line endings,
+// invalid UTF-8 and control characters are removed, tabs become spaces,
+// trailing space is removed from every line, and leading and trailing space
+// from the description as a whole.
+func descriptionLines(desc string) []string {
+	desc = strings.ToValidUTF8(strings.ReplaceAll(desc, "\r\n", "\n"), "")
+	desc = strings.ReplaceAll(desc, "\t", strings.Repeat(" ", tabWidth))
+	desc = strings.Map(func(r rune) rune {
+		if r != '\n' && unicode.IsControl(r) {
+			return -1
+		}
+
+		return r
+	}, desc)
+
+	lines := strings.Split(strings.TrimSpace(desc), "\n")
+
+	for i, line := range lines {
+		lines[i] = strings.TrimRightFunc(line, unicode.IsSpace)
+	}
+
+	return lines
+}
+
+// moduleHelpLines returns the descriptionLines() of the given description with
+// markdown formatting stripped, wrapped to moduleHelpWidth, and escaped for use
+// in double quoted tcl strings in the body of a proc.
+func moduleHelpLines(desc string) []string {
+	var lines []string
+
+	for _, line := range descriptionLines(desc) {
+		for _, wrapped := range wrapLine(stripMarkdown(line), moduleHelpWidth) {
+			lines = append(lines, tclEscape(wrapped))
+		}
+	}
+
+	return lines
+}
+
+// stripMarkdown removes markdown heading markers, bold and code markers from
+// the given line, and turns links and images in to their text followed by
+// their URL in brackets.
+func stripMarkdown(line string) string {
+	line = mdHeadingRegexp.ReplaceAllString(line, "")
+	line = mdLinkRegexp.ReplaceAllString(line, "$1 ($2)")
+
+	return mdEmphasisRegexp.ReplaceAllString(line, "")
+}
+
+// wrapLine splits the given line in to lines no longer than width characters,
+// breaking at spaces where possible, with continuation lines indented like the
+// original.
+func wrapLine(line string, width int) []string {
+	if utf8.RuneCountInString(line) <= width {
+		return []string{line}
+	}
+
+	indent := line[:len(line)-len(strings.TrimLeft(line, " "))]
+	if utf8.RuneCountInString(indent) >= width/2 {
+		indent = ""
+	}
+
+	var lines []string
+
+	for utf8.RuneCountInString(line) > width {
+		runes := []rune(line)
+		cut := strings.LastIndex(string(runes[:width+1]), " ")
+
+		if cut <= len(indent) {
+			cut = len(string(runes[:width]))
+		}
+
+		lines = append(lines, strings.TrimRight(line[:cut], " "))
+		line = indent + strings.TrimLeft(line[cut:], " ")
+	}
+
+	return append(lines, line)
+}
+
+// tclEscapeAll returns tclEscape() of each of the given strings.
+func tclEscapeAll(strs []string) []string {
+	escaped := make([]string, len(strs))
+
+	for i, s := range strs {
+		escaped[i] = tclEscape(s)
+	}
+
+	return escaped
+}
+
+// tclEscape escapes the characters in the given string that are special in
+// double quoted tcl strings, and braces so that they don't unbalance an
+// enclosing braced proc body.
+func tclEscape(s string) string {
+	return tclEscaper.Replace(s)
+}
@@ -0,0 +1,69 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDescription(t *testing.T) {
+	Convey("Descriptions are tidied up for softpack.yml", t, func() {
+		So(descriptionLines(""), ShouldResemble, []string{""})
+		So(descriptionLines("\r\n  indented first\r\n\tsecond \x07line  \n\n\xffthird\n\n"), ShouldResemble,
+			[]string{"indented first", "    second line", "", "third"})
+	})
+
+	Convey("Descriptions are made safe and readable for module help", t, func() {
+		So(moduleHelpLines("## Usage\nRun `foo --bar` on **all** [the docs](https://example.com)"),
+			ShouldResemble, []string{"Usage", "Run foo --bar on all the docs (https://example.com)"})
+
+		So(moduleHelpLines(`costs $5 [each] {or "more"} \o/`), ShouldResemble,
+			[]string{`costs \$5 \[each\] \{or \"more\"\} \\o/`})
+
+		long := strings.Repeat("word ", 30)
+		So(moduleHelpLines("intro\n  - "+long), ShouldResemble, []string{
+			"intro",
+			"  - " + strings.Repeat("word ", 14) + "word",
+			"  " + strings.Repeat("word ", 14) + "word",
+		})
+
+		So(wrapLine(strings.Repeat("é", 100), 80), ShouldResemble,
+			[]string{strings.Repeat("é", 80), strings.Repeat("é", 20)})
+	})
+
+	Convey("Softpack.yml descriptions survive being parsed back", t, func() {
+		lock := `{"roots":[{"hash":"a"}],"concrete_specs":{"a":{"name":"xxhash","version":"0.8.1"}}}`
+		desc := "  starts indented: with a colon\n# and a heading\n\n- and a list"
+
+		yml, err := SpackLockToSoftPackYML([]byte(lock), desc, []string{"xxhsum"})
+		So(err, ShouldBeNil)
+
+		def, err := ParseSoftpackYML(strings.NewReader(yml))
+		So(err, ShouldBeNil)
+		So(def.Description, ShouldEqual, strings.TrimSpace(desc))
+	})
+}
@@ -0,0 +1,153 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// DiskUsageReport describes the installed size of every environment in the
+// configured moduleInstallDir: the total Bytes, the usage of each Owner
+// ("users/foo" or "groups/bar"), and of each environment version, both sorted
+// largest first.
+type DiskUsageReport struct {
+	Bytes        int64
+	Owners       []OwnerDiskUsage
+	Environments []EnvironmentDiskUsage
+}
+
+// OwnerDiskUsage describes the total installed size of the Environments of an
+// Owner.
+type OwnerDiskUsage struct {
+	Owner        string
+	Environments int
+	Bytes        int64
+}
+
+// EnvironmentDiskUsage describes the installed size of an Environment
+// ("users/foo/env-1"): the Bytes in its scripts directory, of which ImageBytes
+// are its image.
+type EnvironmentDiskUsage struct {
+	Environment string
+	Owner       string
+	Bytes       int64
+	ImageBytes  int64
+}
+
+// DiskUsage reports the installed size (image plus scripts) of every
+// environment in the configured moduleInstallDir, wherever their scripts were
+// placed, aggregated by the users and groups that own them. Returns an error
+// if the installed environments couldn't be listed.
+func (b *Builder) DiskUsage() (*DiskUsageReport, error) {
+	envs, err := b.installedEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DiskUsageReport{Owners: []OwnerDiskUsage{}, Environments: make([]EnvironmentDiskUsage, len(envs))}
+	owners := make(map[string]*OwnerDiskUsage)
+
+	for i, env := range envs {
+		usage := b.environmentDiskUsage(env[0], env[1])
+		report.Environments[i] = usage
+		report.Bytes += usage.Bytes
+
+		owner, ok := owners[usage.Owner]
+		if !ok {
+			owner = &OwnerDiskUsage{Owner: usage.Owner}
+			owners[usage.Owner] = owner
+		}
+
+		owner.Environments++
+		owner.Bytes += usage.Bytes
+	}
+
+	for _, owner := range owners {
+		report.Owners = append(report.Owners, *owner)
+	}
+
+	sort.Slice(report.Owners, func(i, j int) bool {
+		if report.Owners[i].Bytes != report.Owners[j].Bytes {
+			return report.Owners[i].Bytes > report.Owners[j].Bytes
+		}
+
+		return report.Owners[i].Owner < report.Owners[j].Owner
+	})
+
+	sort.SliceStable(report.Environments, func(i, j int) bool {
+		return report.Environments[i].Bytes > report.Environments[j].Bytes
+	})
+
+	return report, nil
+}
+
+func (b *Builder) environmentDiskUsage(envPath, version string) EnvironmentDiskUsage {
+	dir, name := path.Split(envPath)
+	scriptsDir := ScriptsDir(b.inst.fs, b.config, dir, name, version)
+	usage := EnvironmentDiskUsage{Environment: envPath + "-" + version, Owner: path.Dir(envPath)}
+
+	usage.Bytes = b.dirSize(scriptsDir, func(filePath string, size int64) {
+		if filePath == filepath.Join(scriptsDir, core.ImageBasename) {
+			usage.ImageBytes = size
+		}
+	})
+
+	return usage
+}
+
+// dirSize returns the total size of the regular files in the given directory
+// and its sub-directories, calling cb with the path and size of each. Symlinks
+// aren't followed, and unreadable directories are skipped.
+func (b *Builder) dirSize(dir string, cb func(filePath string, size int64)) int64 {
+	entries, err := b.inst.fs.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+
+	var total int64
+
+	for _, entry := range entries {
+		entryPath := filepath.Join(dir, entry.Name())
+
+		switch {
+		case entry.IsDir():
+			total += b.dirSize(entryPath, cb)
+		case entry.Type()&fs.ModeType == 0:
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+
+			cb(entryPath, info.Size())
+			total += info.Size()
+		}
+	}
+
+	return total
+}
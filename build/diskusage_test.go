@@ -0,0 +1,93 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+)
+
+func TestDiskUsage(t *testing.T) {
+	Convey("Given a Builder with installed environments", t, func() {
+		var conf config.Config
+		conf.Module.ModuleInstallDir = "/modules"
+		conf.Module.ScriptsInstallDir = "/scripts"
+		conf.Module.ScriptsOverflow = []config.ScriptsTarget{{Dir: "/overflow"}}
+
+		builder, err := New(&conf, &s3mock.MockS3{}, wrmock.NewMockWR(0, 0))
+		So(err, ShouldBeNil)
+
+		mfs := fsmock.New()
+		builder.inst.fs = mfs
+
+		for _, env := range []struct {
+			scriptsBase, dir, name, version string
+			imageSize                       int
+		}{
+			{"/scripts", "groups/hgi", "xxhash", "0.8.1", 100},
+			{"/overflow", "groups/hgi", "xxhash", "0.8.2", 200},
+			{"/scripts", "users/foo", "env", "1", 50},
+		} {
+			moduleDir := ModuleDirFromName(conf.Module.ModuleInstallDir, env.dir, env.name)
+			scriptsDir := ScriptsDirFromNameAndVersion(env.scriptsBase, env.dir, env.name, env.version)
+
+			So(mfs.MkdirAll(moduleDir, dirPerms), ShouldBeNil)
+			So(mfs.MkdirAll(scriptsDir, dirPerms), ShouldBeNil)
+			writeMockFile(mfs, filepath.Join(moduleDir, env.version), "module")
+			writeMockFile(mfs, filepath.Join(scriptsDir, core.ImageBasename), strings.Repeat("i", env.imageSize))
+			writeMockFile(mfs, filepath.Join(scriptsDir, WrapperBasename), "wrap")
+			So(mfs.Symlink(WrapperBasename, filepath.Join(scriptsDir, "exe")), ShouldBeNil)
+		}
+
+		Convey("you can get their DiskUsage, aggregated by owner", func() {
+			report, err := builder.DiskUsage()
+			So(err, ShouldBeNil)
+			So(report.Bytes, ShouldEqual, 362)
+			So(report.Owners, ShouldResemble, []OwnerDiskUsage{
+				{Owner: "groups/hgi", Environments: 2, Bytes: 308},
+				{Owner: "users/foo", Environments: 1, Bytes: 54},
+			})
+			So(report.Environments, ShouldResemble, []EnvironmentDiskUsage{
+				{Environment: "groups/hgi/xxhash-0.8.2", Owner: "groups/hgi", Bytes: 204, ImageBytes: 200},
+				{Environment: "groups/hgi/xxhash-0.8.1", Owner: "groups/hgi", Bytes: 104, ImageBytes: 100},
+				{Environment: "users/foo/env-1", Owner: "users/foo", Bytes: 54, ImageBytes: 50},
+			})
+		})
+
+		Convey("DiskUsage fails if the modules can't be listed", func() {
+			So(mfs.RemoveAll(conf.Module.ModuleInstallDir), ShouldBeNil)
+
+			_, err = builder.DiskUsage()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
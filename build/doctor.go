@@ -0,0 +1,239 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+// The checks made by Doctor(), in the order they're made.
+const (
+	DoctorCheckDef      = "generate and upload singularity definition"
+	DoctorCheckSubmit   = "submit build job to wr"
+	DoctorCheckBuild    = "build job completes"
+	DoctorCheckS3       = "artefacts appear in S3"
+	DoctorCheckInstall  = "install module and image"
+	DoctorCheckVerified = "verify installation"
+)
+
+var doctorChecks = [...]string{ //nolint:gochecknoglobals
+	DoctorCheckDef,
+	DoctorCheckSubmit,
+	DoctorCheckBuild,
+	DoctorCheckS3,
+	DoctorCheckInstall,
+	DoctorCheckVerified,
+}
+
+// DoctorCheck is the outcome of one of the steps of Doctor(). A check that
+// wasn't made because an earlier one failed is Skipped.
+type DoctorCheck struct {
+	Name    string
+	Err     error
+	Skipped bool
+}
+
+// Passed returns true if the check was made and succeeded.
+func (d DoctorCheck) Passed() bool {
+	return !d.Skipped && d.Err == nil
+}
+
+// doctor holds the state passed between the checks of Doctor().
+type doctor struct {
+	def      *Definition
+	status   *Status
+	runner   Runner
+	s3Path   string
+	workPath string
+	singDef  string
+	jobID    string
+	exes     []string
+}
+
+// Doctor builds and installs the given (ideally tiny, throwaway) environment
+// to exercise the whole stack end to end, returning the outcome of each step:
+// that a singularity definition can be generated and uploaded, that the build
+// job can be submitted to wr and completes, that its artefacts appear in S3,
+// and that the module and image can be installed and then verified.
+//
+// Unlike Build(), this waits for the build to finish and nothing is sent to
+// core, so you'll want the Builder's module and scripts install dirs to be
+// scratch locations. Checks after the first failure are skipped.
+func (b *Builder) Doctor(ctx context.Context, def *Definition) []DoctorCheck {
+	checks := make([]DoctorCheck, len(doctorChecks))
+
+	for i, name := range doctorChecks {
+		checks[i] = DoctorCheck{Name: name, Skipped: true}
+	}
+
+	d, err := b.startDoctor(def)
+	if err != nil {
+		checks[0] = DoctorCheck{Name: doctorChecks[0], Err: err}
+
+		return checks
+	}
+
+	defer b.unprotectEnvironment(def.FullEnvironmentPath())
+
+	steps := [...]func(context.Context, *doctor) error{
+		b.doctorDef,
+		b.doctorSubmit,
+		b.doctorBuild,
+		b.doctorS3,
+		b.doctorInstall,
+		b.doctorVerify,
+	}
+
+	for i, step := range steps {
+		checks[i] = DoctorCheck{Name: doctorChecks[i], Err: step(ctx, d)}
+
+		if checks[i].Err != nil {
+			break
+		}
+	}
+
+	return checks
+}
+
+func (b *Builder) startDoctor(def *Definition) (*doctor, error) {
+	if err := def.ValidateEnvironment(); err != nil {
+		return nil, err
+	}
+
+	def.Force = true
+	def.Conflicts = mergeModuleNames(b.config.Module.Conflicts, def.Conflicts)
+	def.Prereqs = mergeModuleNames(b.config.Module.Prereqs, def.Prereqs)
+
+	var err error
+
+	if _, err = b.protectEnvironment(def.FullEnvironmentPath(), &err); err != nil {
+		return nil, err
+	}
+
+	s3Path := filepath.Join(def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+
+	return &doctor{
+		def:      def,
+		status:   b.buildStatus(def),
+		s3Path:   s3Path,
+		workPath: buildWorkPath(s3Path, newBuildID()),
+	}, nil
+}
+
+func (b *Builder) doctorDef(ctx context.Context, d *doctor) error {
+	var err error
+
+	d.singDef, err = b.generateAndUploadSingularityDef(ctx, d.def, d.workPath)
+
+	return err
+}
+
+func (b *Builder) doctorSubmit(ctx context.Context, d *doctor) error {
+	wrInput, err := b.generateWRInput(ctx, d.def, d.singDef, filepath.Join(b.config.S3.BuildBase, d.workPath))
+	if err != nil {
+		return err
+	}
+
+	if err = b.supplyCredentials(ctx, d.workPath); err != nil {
+		return err
+	}
+
+	d.runner = b.routeBuild(ctx, d.def, d.status)
+	d.jobID, err = b.addJob(ctx, d.runner, d.status, wrInput)
+
+	return err
+}
+
+func (b *Builder) doctorBuild(ctx context.Context, d *doctor) error {
+	wrStatus, err := b.runJob(ctx, d.runner, d.status, d.workPath, d.jobID)
+	if err != nil {
+		return err
+	}
+
+	if wrStatus != wr.WRJobStatusComplete {
+		return fmt.Errorf("%s: wr job %s %s", ErrBuildFailed, d.jobID, wrStatus)
+	}
+
+	return nil
+}
+
+func (b *Builder) doctorS3(ctx context.Context, d *doctor) error {
+	if err := b.promoteBuild(ctx, d.workPath, d.s3Path, builtFiles[:], false); err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, basename := range builtFiles {
+		f, err := b.s3.OpenFile(ctx, filepath.Join(d.s3Path, basename))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", basename, err))
+
+			continue
+		}
+
+		f.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b *Builder) doctorInstall(ctx context.Context, d *doctor) error {
+	var err error
+
+	d.exes, err = b.getExes(ctx, d.s3Path)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.installEnvironment(ctx, d.def, d.s3Path, d.exes)
+
+	return err
+}
+
+func (b *Builder) doctorVerify(_ context.Context, d *doctor) error {
+	dir, name := path.Split(filepath.Join(d.def.EnvironmentPath, d.def.EnvironmentName))
+	version := d.def.EnvironmentVersion
+	scriptsDir := ScriptsDir(b.inst.fs, b.config, dir, name, version)
+	modulePath := filepath.Join(ModuleDirFromName(b.config.Module.ModuleInstallDir, dir, name), version)
+
+	v := &Verification{Environment: d.def.FullEnvironmentPath()}
+
+	b.verifyModule(v, modulePath, scriptsDir)
+	b.verifyImage(v, scriptsDir)
+	b.verifyExes(v, scriptsDir, d.exes)
+
+	if len(v.Problems) > 0 {
+		return errors.New(strings.Join(v.Problems, "; "))
+	}
+
+	return nil
+}
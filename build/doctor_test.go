@@ -0,0 +1,108 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+func TestDoctor(t *testing.T) {
+	Convey("Given a builder with scratch install dirs", t, func() {
+		builder, conf, ms3, mwr := newTestBuilder(t, func(conf *config.Config) {
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+		})
+		ms3.Exes = "zlib-flate"
+
+		def := &Definition{
+			EnvironmentPath:    "users/gsb-doctor/",
+			EnvironmentName:    "doctor",
+			EnvironmentVersion: "1",
+			Packages:           core.Packages{{Name: "zlib"}},
+		}
+
+		ctx := context.Background()
+
+		Convey("Doctor builds, installs and verifies a throwaway environment", func() {
+			mwr.SetRunning()
+
+			checks := builder.Doctor(ctx, def)
+			So(len(checks), ShouldEqual, len(doctorChecks))
+
+			for i, check := range checks {
+				So(check.Name, ShouldEqual, doctorChecks[i])
+				So(check.Err, ShouldBeNil)
+				So(check.Passed(), ShouldBeTrue)
+			}
+
+			So(mwr.GetLastCmd(), ShouldContainSubstring, "users/gsb-doctor/doctor/1")
+
+			scriptsDir := ScriptsDirFromNameAndVersion(conf.Module.ScriptsInstallDir, "users/gsb-doctor", "doctor", "1")
+			_, err := os.Stat(filepath.Join(scriptsDir, "zlib-flate"))
+			So(err, ShouldBeNil)
+
+			status := builder.Status()
+			So(len(status), ShouldEqual, 1)
+			So(status[0].JobID, ShouldEqual, "abc123")
+			So(status[0].BuildDone, ShouldNotBeNil)
+
+			So(builder.Doctor(ctx, def)[0].Err, ShouldBeNil)
+		})
+
+		Convey("Doctor skips the remaining checks after a failure", func() {
+			mwr.Fail = true
+			mwr.SetRunning()
+
+			checks := builder.Doctor(ctx, def)
+			So(checks[0].Passed(), ShouldBeTrue)
+			So(checks[1].Passed(), ShouldBeTrue)
+			So(checks[2].Name, ShouldEqual, DoctorCheckBuild)
+			So(checks[2].Err, ShouldNotBeNil)
+			So(checks[2].Err.Error(), ShouldContainSubstring, ErrBuildFailed)
+
+			for _, check := range checks[3:] {
+				So(check.Skipped, ShouldBeTrue)
+				So(check.Passed(), ShouldBeFalse)
+			}
+		})
+
+		Convey("Doctor fails if the environment is already being built", func() {
+			var errp error
+
+			_, err := builder.protectEnvironment(def.FullEnvironmentPath(), &errp)
+			So(err, ShouldBeNil)
+
+			checks := builder.Doctor(ctx, def)
+			So(checks[0].Err, ShouldEqual, ErrEnvironmentBuilding)
+			So(checks[1].Skipped, ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,87 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const ErrFatTarget = internal.Error("fat image targets must be x86-64 microarchitecture levels above the " +
+	"profile's processor target")
+
+// x86Levels are the processor targets that fat images can include builds for,
+// in ascending order. These are the x86-64 microarchitecture levels that glibc
+// can tell us a CPU supports, so the best build can be chosen at runtime.
+var x86Levels = [...]string{"x86_64", "x86_64_v2", "x86_64_v3", "x86_64_v4"} //nolint:gochecknoglobals
+
+// fatTarget is an additional processor target built in to a fat image. HWCap
+// is glibc's name for it.
+type fatTarget struct {
+	Name  string
+	HWCap string
+}
+
+// fatTargets returns the FatTargets of the given Definition, best first, after
+// checking they're all in the configured spack.processorTargets and are x86-64
+// microarchitecture levels above the given profile's processor target.
+func (b *Builder) fatTargets(def *Definition, profile config.Profile) ([]fatTarget, error) {
+	if len(def.FatTargets) == 0 {
+		return nil, nil
+	}
+
+	base := slices.Index(x86Levels[:], profile.ProcessorTarget)
+	if base == -1 {
+		return nil, ErrFatTarget
+	}
+
+	levels := make([]int, 0, len(def.FatTargets))
+
+	for _, target := range def.FatTargets {
+		if !slices.Contains(b.config.Spack.ProcessorTargets, target) {
+			return nil, config.ErrUnknownTarget
+		}
+
+		level := slices.Index(x86Levels[:], target)
+		if level <= base {
+			return nil, ErrFatTarget
+		}
+
+		levels = append(levels, level)
+	}
+
+	slices.Sort(levels)
+	levels = slices.Compact(levels)
+	targets := make([]fatTarget, len(levels))
+
+	for n, level := range levels {
+		name := x86Levels[level]
+		targets[len(levels)-1-n] = fatTarget{Name: name, HWCap: strings.ReplaceAll(name, "_", "-")}
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,101 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+)
+
+func TestFatTargets(t *testing.T) {
+	Convey("Given a Builder with an allowlist of processor targets", t, func() {
+		builder, conf, ms3, _ := newTestBuilder(t, func(conf *config.Config) {
+			conf.Spack.ProcessorTarget = "x86_64_v2"
+			conf.Spack.ProcessorTargets = []string{"x86_64", "x86_64_v2", "x86_64_v3", "x86_64_v4", "neoverse_v2"}
+		})
+
+		def := getExampleDefinition()
+
+		profile, err := conf.Profile("")
+		So(err, ShouldBeNil)
+
+		Convey("fat targets are returned best first", func() {
+			def.FatTargets = []string{"x86_64_v3", "x86_64_v4", "x86_64_v3"}
+
+			targets, err := builder.fatTargets(def, profile)
+			So(err, ShouldBeNil)
+			So(targets, ShouldResemble, []fatTarget{
+				{Name: "x86_64_v4", HWCap: "x86-64-v4"},
+				{Name: "x86_64_v3", HWCap: "x86-64-v3"},
+			})
+
+			Convey("and built in to the image, chosen between at runtime", func() {
+				defFile, err := builder.generateSingularityDef(context.Background(), def)
+				So(err, ShouldBeNil)
+				So(defFile, ShouldContainSubstring, "cd /opt/spack-environment/targets/x86_64_v4\n"+
+					"\tsed -e 's/ arch=None-None-x86_64_v2$/ arch=None-None-x86_64_v4/' "+
+					"-e 's@^  view: /opt/view$@  view: /opt/views/x86_64_v4@' /opt/spack-environment/spack.yaml > spack.yaml\n")
+				So(defFile, ShouldContainSubstring, "\t/opt/view /opt\n\t/opt/views /opt\n")
+				So(defFile, ShouldContainSubstring, `
+if echo "$gsb_hwcaps" | grep -q "x86-64-v4 (supported"; then
+	. /opt/spack-environment/targets/x86_64_v4/environment_modifications.sh
+elif echo "$gsb_hwcaps" | grep -q "x86-64-v3 (supported"; then
+	. /opt/spack-environment/targets/x86_64_v3/environment_modifications.sh
+else
+	. /opt/spack-environment/environment_modifications.sh
+fi
+`)
+				So(defFile, ShouldNotContainSubstring, "cat /opt/spack-environment/environment_modifications.sh")
+			})
+		})
+
+		Convey("fat targets must be allowed x86-64 levels above the profile's target", func() {
+			for _, test := range []struct {
+				target, fat string
+				err         error
+			}{
+				{"x86_64_v2", "zen4", config.ErrUnknownTarget},
+				{"x86_64_v2", "neoverse_v2", ErrFatTarget},
+				{"x86_64_v2", "x86_64_v2", ErrFatTarget},
+				{"x86_64_v2", "x86_64", ErrFatTarget},
+				{"neoverse_v2", "x86_64_v4", ErrFatTarget},
+				{"", "x86_64_v4", ErrFatTarget},
+				{"x86_64", "x86_64_v2", nil},
+			} {
+				profile.ProcessorTarget = test.target
+				def.FatTargets = []string{test.fat}
+
+				_, err = builder.fatTargets(def, profile)
+				So(err, ShouldEqual, test.err)
+			}
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldEqual, ErrFatTarget)
+			So(ms3.Def, ShouldBeBlank)
+		})
+	})
+}
@@ -0,0 +1,276 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+// The outcomes of a build given to hooks.
+const (
+	HookOutcomeSucceeded = "succeeded"
+	HookOutcomeFailed    = "failed"
+	HookOutcomeCancelled = "cancelled"
+)
+
+// hookWaitDelay is how long we wait for the output of a hook that timed out,
+// in case its command left behind children that keep its output open.
+const hookWaitDelay = 100 * time.Millisecond
+
+const (
+	ErrPolicyRejected = internal.Error("build rejected by policy")
+	ErrPreBuildHook   = internal.Error("pre-build hook failed")
+
+	errHookTimeout = internal.Error("timed out")
+)
+
+// HookResult describes the running of a configured post-build hook. Done is
+// when it finished, and Error says why it failed, if it did.
+type HookResult struct {
+	Name  string
+	Done  *time.Time
+	Error string
+}
+
+// runHooks runs the configured hooks, in order, after the build of the given
+// Definition finished with the given error, recording the result of each in the
+// build's status. Each hook may take up to its configured timeout, and failure
+// of one is logged but doesn't stop the others or affect the build.
+func (b *Builder) runHooks(ctx context.Context, def *Definition, buildErr error) {
+	if len(b.config.Hooks) == 0 {
+		return
+	}
+
+	outcome := HookOutcomeSucceeded
+
+	switch {
+	case ctx.Err() != nil:
+		outcome = HookOutcomeCancelled
+	case buildErr != nil:
+		outcome = HookOutcomeFailed
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	status := b.buildStatus(def)
+
+	for _, hook := range b.config.Hooks {
+		b.statusMu.RLock()
+		statusJSON, err := json.Marshal(status)
+		b.statusMu.RUnlock()
+
+		if err == nil {
+			err = b.runHook(ctx, hook, def, outcome, buildErr, statusJSON)
+		}
+
+		done := time.Now()
+		result := HookResult{Name: hook.Name, Done: &done}
+
+		if err != nil {
+			result.Error = err.Error()
+
+			loggerFromContext(ctx).Error("post-build hook failed", "hook", hook.Name, "err", err)
+		} else {
+			loggerFromContext(ctx).Debug("ran post-build hook", "hook", hook.Name)
+		}
+
+		b.statusMu.Lock()
+		status.Hooks = append(slices.Clip(status.Hooks), result)
+		b.statusMu.Unlock()
+	}
+
+	b.notifyStatusChange(ctx, status)
+}
+
+// runHook runs the given post-build hook's command, giving it the build's
+// details in GSB_* environment variables and its status as JSON on stdin.
+func (b *Builder) runHook(ctx context.Context, hook config.Hook, def *Definition, outcome string,
+	buildErr error, statusJSON []byte) error {
+	var errMsg string
+
+	if buildErr != nil {
+		errMsg = buildErr.Error()
+	}
+
+	stdout, stderr, err := b.execHook(ctx, hook, def, statusJSON, "GSB_OUTCOME="+outcome, "GSB_ERROR="+errMsg)
+	if err != nil && !errors.Is(err, errHookTimeout) {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(stdout)+string(stderr)))
+	}
+
+	return err
+}
+
+// execHook runs the given hook's command with the given stdin, and GSB_*
+// environment variables describing the given Definition along with the given
+// extra ones, returning its stdout and stderr. If it takes longer than the
+// hook's timeout, the error is errHookTimeout.
+func (b *Builder) execHook(ctx context.Context, hook config.Hook, def *Definition, stdin []byte,
+	env ...string) ([]byte, []byte, error) {
+	if timeout := hook.Timeout(); timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	owner := b.owner(ctx, def)
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.Command)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = hookWaitDelay
+	cmd.Env = append(os.Environ(),
+		"GSB_HOOK="+hook.Name,
+		"GSB_ENVIRONMENT="+def.FullEnvironmentPath(),
+		"GSB_ENV_PATH="+def.EnvironmentPath,
+		"GSB_ENV_NAME="+def.EnvironmentName,
+		"GSB_ENV_VERSION="+def.EnvironmentVersion,
+		"GSB_REQUESTER="+def.Requester,
+		"GSB_S3_PATH="+filepath.Join(def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion),
+		"GSB_SCRIPTS_DIR="+b.scriptsDir(def),
+		"GSB_OWNER="+owner.Account,
+		"GSB_CONTACTS="+strings.Join(owner.Contacts, ","),
+		"GSB_LABELS="+def.LabelList(),
+	)
+	cmd.Env = append(cmd.Env, env...)
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, nil, fmt.Errorf("%w after %s", errHookTimeout, hook.Timeout())
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// PolicyRejection is the error returned by Build() when a pre-build hook (or the
+// broken packages denylist, as Hook "brokenPackages") rejects a Definition,
+// naming the Hook and giving its Reasons. It Is() ErrPolicyRejected.
+type PolicyRejection struct {
+	Hook    string
+	Reasons []string
+}
+
+// Error implements error.
+func (p *PolicyRejection) Error() string {
+	return fmt.Sprintf("%s (%s): %s", ErrPolicyRejected, p.Hook, strings.Join(p.Reasons, "; "))
+}
+
+// Is lets errors.Is() match ErrPolicyRejected.
+func (p *PolicyRejection) Is(target error) bool {
+	return target == ErrPolicyRejected //nolint:errorlint
+}
+
+// runPreBuildHooks runs the configured pre-build hooks, in order, giving each
+// the Definition as JSON on stdin, along with the same GSB_* environment
+// variables as post-build hooks (apart from GSB_OUTCOME and GSB_ERROR).
+//
+// A hook that exits 0 accepts the Definition, and may modify it by printing a
+// replacement as JSON, though it can't change the environment path, name,
+// version or requester. A hook that exits non-zero rejects it, giving one reason
+// per line of its output, and we return a *PolicyRejection without running the
+// remaining hooks. A hook that can't be run, times out or prints invalid JSON
+// results in an ErrPreBuildHook error, so builds aren't allowed through
+// unchecked.
+func (b *Builder) runPreBuildHooks(ctx context.Context, def *Definition) error {
+	for _, hook := range b.config.PreBuildHooks {
+		defJSON, err := json.Marshal(def)
+		if err != nil {
+			return err
+		}
+
+		stdout, stderr, err := b.execHook(ctx, hook, def, defJSON)
+
+		var exitErr *exec.ExitError
+
+		switch {
+		case errors.As(err, &exitErr):
+			return &PolicyRejection{Hook: hook.Name, Reasons: rejectionReasons(stdout, stderr)}
+		case err != nil:
+			return fmt.Errorf("%w: %s: %w", ErrPreBuildHook, hook.Name, err)
+		}
+
+		if err = updateDefinition(def, stdout); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrPreBuildHook, hook.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// rejectionReasons returns the non-blank lines of the given stdout, or else
+// stderr, of a rejecting pre-build hook.
+func rejectionReasons(stdout, stderr []byte) []string {
+	for _, out := range [][]byte{stdout, stderr} {
+		var reasons []string
+
+		for _, line := range strings.Split(string(out), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				reasons = append(reasons, line)
+			}
+		}
+
+		if len(reasons) > 0 {
+			return reasons
+		}
+	}
+
+	return []string{"no reason given"}
+}
+
+// updateDefinition replaces the given Definition with the one JSON encoded in
+// the given output of a pre-build hook, if any, keeping its identity.
+func updateDefinition(def *Definition, out []byte) error {
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil
+	}
+
+	var updated Definition
+
+	if err := json.Unmarshal(out, &updated); err != nil {
+		return err
+	}
+
+	updated.EnvironmentPath = def.EnvironmentPath
+	updated.EnvironmentName = def.EnvironmentName
+	updated.EnvironmentVersion = def.EnvironmentVersion
+	updated.Requester = def.Requester
+
+	*def = updated
+
+	return nil
+}
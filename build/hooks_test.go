@@ -0,0 +1,218 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/coremock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestHooks(t *testing.T) {
+	Convey("Given a builder with post-build hooks", t, func() {
+		msc := httptest.NewServer(coremock.NewMockCore())
+
+		defer msc.Close()
+
+		tmp := t.TempDir()
+		first := filepath.Join(tmp, "first")
+		last := filepath.Join(tmp, "last")
+
+		builder, conf, ms3, mwr := newTestBuilder(t, func(conf *config.Config) {
+			conf.CoreURL = msc.URL
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+			conf.Hooks = []config.Hook{
+				{Name: "notify", Command: `echo "$GSB_HOOK $GSB_ENVIRONMENT $GSB_OUTCOME" > ` + first +
+					` && cat >> ` + first},
+				{Name: "broken", Command: "echo oops; exit 1"},
+				{Name: "slow", Command: "sleep 5", TimeoutSeconds: 1},
+				{Name: "scan", Command: `echo "$GSB_OUTCOME $GSB_ERROR" > ` + last},
+			}
+		})
+		ms3.Exes = "xxhsum"
+
+		def := getExampleDefinition()
+		def.Packages = def.Packages[:1]
+
+		hookResults := func() []HookResult {
+			var hooks []HookResult
+
+			waitFor(func() bool {
+				status := builder.Status()
+				if len(status) != 1 {
+					return false
+				}
+
+				hooks = status[0].Hooks
+
+				return len(hooks) == len(conf.Hooks)
+			})
+
+			return hooks
+		}
+
+		Convey("they are all run in order after a successful build, with failures isolated", func() {
+			mwr.SetRunning()
+
+			So(builder.Build(context.Background(), def), ShouldBeNil)
+
+			hooks := hookResults()
+			So(len(hooks), ShouldEqual, 4)
+			So(hooks[0].Name, ShouldEqual, "notify")
+			So(hooks[0].Error, ShouldBeBlank)
+			So(hooks[0].Done, ShouldNotBeNil)
+			So(hooks[1].Name, ShouldEqual, "broken")
+			So(hooks[1].Error, ShouldEqual, "exit status 1: oops")
+			So(hooks[2].Name, ShouldEqual, "slow")
+			So(hooks[2].Error, ShouldEqual, "timed out after 1s")
+			So(hooks[3].Name, ShouldEqual, "scan")
+			So(hooks[3].Error, ShouldBeBlank)
+
+			data, errr := os.ReadFile(first)
+			So(errr, ShouldBeNil)
+			So(string(data), ShouldStartWith, "notify groups/hgi/xxhash-0.8.1 succeeded\n")
+			So(string(data), ShouldContainSubstring, `"Name":"groups/hgi/xxhash-0.8.1"`)
+			So(string(data), ShouldContainSubstring, `"JobID":"abc123"`)
+
+			data, errr = os.ReadFile(last)
+			So(errr, ShouldBeNil)
+			So(string(data), ShouldEqual, "succeeded \n")
+		})
+
+		Convey("they are told about failed builds", func() {
+			mwr.Fail = true
+			mwr.SetRunning()
+
+			So(builder.Build(context.Background(), def), ShouldBeNil)
+
+			hooks := hookResults()
+			So(len(hooks), ShouldEqual, 4)
+
+			data, errr := os.ReadFile(last)
+			So(errr, ShouldBeNil)
+			So(string(data), ShouldEqual, "failed "+ErrBuildFailed+"\n")
+		})
+	})
+}
+
+func TestPreBuildHooks(t *testing.T) {
+	Convey("Given a builder with pre-build hooks", t, func() {
+		_, conf, _, mwr := newTestBuilder(t, func(conf *config.Config) {
+			conf.PreBuildHooks = []config.Hook{
+				{Name: "description", Command: `grep -q '"Description":"some help text"' || ` +
+					`{ echo "description too short"; exit 1; }`},
+			}
+		})
+
+		def := getExampleDefinition()
+
+		build := func() error {
+			builder, err := New(conf, &s3mock.MockS3{}, mwr)
+			So(err, ShouldBeNil)
+
+			return builder.Build(context.Background(), def)
+		}
+
+		Convey("they get the Definition and can accept it", func() {
+			So(build(), ShouldBeNil)
+			So(waitFor(func() bool { return mwr.GetLastCmd() != "" }), ShouldBeTrue)
+		})
+
+		Convey("they can reject it with reasons, stopping later hooks", func() {
+			conf.PreBuildHooks = append(conf.PreBuildHooks,
+				config.Hook{Name: "denylist", Command: `echo "r-seurat is denied"; echo; echo "$GSB_ENV_NAME"; exit 1`},
+				config.Hook{Name: "never", Command: "echo never >&2; exit 1"},
+			)
+
+			err := build()
+			So(err, ShouldWrap, ErrPolicyRejected)
+
+			var rejection *PolicyRejection
+
+			So(errors.As(err, &rejection), ShouldBeTrue)
+			So(rejection.Hook, ShouldEqual, "denylist")
+			So(rejection.Reasons, ShouldResemble, []string{"r-seurat is denied", "xxhash"})
+			So(err.Error(), ShouldEqual, "build rejected by policy (denylist): r-seurat is denied; xxhash")
+			So(mwr.GetLastCmd(), ShouldBeBlank)
+
+			def.Description = "short"
+			conf.PreBuildHooks = conf.PreBuildHooks[:1]
+
+			So(errors.As(build(), &rejection), ShouldBeTrue)
+			So(rejection.Reasons, ShouldResemble, []string{"description too short"})
+		})
+
+		Convey("they can apply policies based on its labels", func() {
+			conf.PreBuildHooks = []config.Hook{{Name: "tiers", Command: `cat > /dev/null; ` +
+				`echo ",$GSB_LABELS," | grep -q ",tier=production," || { echo "unknown tier: $GSB_LABELS"; exit 1; }`}}
+
+			def.Labels = map[string]string{"tier": "production", "project": "atlas"}
+
+			So(build(), ShouldBeNil)
+
+			def.Labels["tier"] = "dev"
+
+			var rejection *PolicyRejection
+
+			So(errors.As(build(), &rejection), ShouldBeTrue)
+			So(rejection.Reasons, ShouldResemble, []string{"unknown tier: project=atlas,tier=dev"})
+		})
+
+		Convey("they can modify it, but not change its identity", func() {
+			conf.PreBuildHooks = append(conf.PreBuildHooks, config.Hook{Name: "modify", Command: `cat > /dev/null; ` +
+				`echo '{"EnvironmentName":"other","Description":"changed","Packages":[{"name":"zlib"}]}'`})
+
+			So(build(), ShouldBeNil)
+			So(def.EnvironmentName, ShouldEqual, "xxhash")
+			So(def.EnvironmentVersion, ShouldEqual, "0.8.1")
+			So(def.Description, ShouldEqual, "changed")
+			So(def.Packages, ShouldResemble, core.Packages{{Name: "zlib"}})
+		})
+
+		Convey("hooks that fail to run properly stop the build", func() {
+			for _, hook := range []config.Hook{
+				{Name: "invalid", Command: "echo nope"},
+				{Name: "slow", Command: "sleep 5", TimeoutSeconds: 1},
+			} {
+				conf.PreBuildHooks = []config.Hook{hook}
+
+				err := build()
+				So(err, ShouldWrap, ErrPreBuildHook)
+				So(err.Error(), ShouldStartWith, "pre-build hook failed: "+hook.Name+": ")
+			}
+
+			So(mwr.GetLastCmd(), ShouldBeBlank)
+		})
+	})
+}
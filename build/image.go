@@ -0,0 +1,163 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const ErrNoImage = internal.Error("no image for environment")
+
+// Image is a built singularity image being read from its installed location or
+// from S3. Close() it when you're done.
+//
+// If the image was opened from its installed location, the ReadCloser is also
+// an io.ReadSeeker, and Size, ModTime and SHA256 (hex encoded) are set.
+// Otherwise Size is -1, and ModTime and SHA256 are zero.
+type Image struct {
+	io.ReadCloser
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+}
+
+// imageDigest caches the sha256 of an installed image, valid while the image
+// has the same size and modification time.
+type imageDigest struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+type imageDigests struct {
+	mu      sync.Mutex
+	digests map[string]imageDigest
+}
+
+// Image opens the singularity image of the given environment (a path like
+// "users/foo/env", as per StatusDetail()) and version, from the scripts
+// directory it was installed to, or failing that from the S3 build location.
+// Returns an error wrapping ErrNoImage if it can't be found in either.
+func (b *Builder) Image(ctx context.Context, envPath, version string) (*Image, error) {
+	if err := ValidateEnvironmentPath(envPath, version); err != nil {
+		return nil, err
+	}
+
+	dir, name := path.Split(envPath)
+	installed := filepath.Join(ScriptsDir(b.inst.fs, b.config, dir, name, version), core.ImageBasename)
+
+	img, err := b.openInstalledImage(installed)
+	if err == nil {
+		return img, nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	rc, err := b.s3.OpenFile(ctx, filepath.Join(envPath, version, core.ImageBasename))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoImage, err)
+	}
+
+	return &Image{ReadCloser: rc, Size: -1}, nil
+}
+
+// openInstalledImage opens the image at the given path, returning an Image
+// with its size, modification time and sha256 if they can be determined.
+func (b *Builder) openInstalledImage(imagePath string) (*Image, error) {
+	rc, err := b.inst.fs.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{ReadCloser: rc, Size: -1}
+
+	statter, ok := rc.(interface{ Stat() (fs.FileInfo, error) })
+	if !ok {
+		return img, nil
+	}
+
+	info, err := statter.Stat()
+	if err != nil {
+		rc.Close()
+
+		return nil, err
+	}
+
+	img.Size = info.Size()
+	img.ModTime = info.ModTime()
+
+	img.SHA256, err = b.imageSHA256(imagePath, img.Size, img.ModTime)
+	if err != nil {
+		rc.Close()
+
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// imageSHA256 returns the hex encoded sha256 of the image at the given path,
+// calculating it only if we haven't already done so for an image there with
+// the given size and modification time.
+func (b *Builder) imageSHA256(imagePath string, size int64, modTime time.Time) (string, error) {
+	b.imageDigests.mu.Lock()
+	defer b.imageDigests.mu.Unlock()
+
+	if d, ok := b.imageDigests.digests[imagePath]; ok && d.size == size && d.modTime.Equal(modTime) {
+		return d.sum, nil
+	}
+
+	f, err := b.inst.fs.Open(imagePath)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	b.imageDigests.digests[imagePath] = imageDigest{size: size, modTime: modTime, sum: sum}
+
+	return sum, nil
+}
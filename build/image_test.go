@@ -0,0 +1,110 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestImage(t *testing.T) {
+	Convey("Given a Builder with an installed image", t, func() {
+		var conf config.Config
+		conf.Module.ScriptsInstallDir = t.TempDir()
+
+		ms3 := &s3mock.MockS3{}
+
+		builder, err := New(&conf, ms3, nil)
+		So(err, ShouldBeNil)
+
+		imagePath := filepath.Join(ScriptsDirFromNameAndVersion(conf.Module.ScriptsInstallDir,
+			"users/foo/", "env", "1"), core.ImageBasename)
+		So(os.MkdirAll(filepath.Dir(imagePath), 0755), ShouldBeNil)
+		So(os.WriteFile(imagePath, []byte("image data"), 0600), ShouldBeNil)
+
+		Convey("you can open it with its size, modification time and sha256", func() {
+			img, err := builder.Image(context.Background(), "users/foo/env", "1")
+			So(err, ShouldBeNil)
+
+			defer img.Close()
+
+			_, ok := img.ReadCloser.(io.ReadSeeker)
+			So(ok, ShouldBeTrue)
+			So(img.Size, ShouldEqual, 10)
+			So(img.ModTime.IsZero(), ShouldBeFalse)
+			So(img.SHA256, ShouldEqual, fmt.Sprintf("%x", sha256.Sum256([]byte("image data"))))
+
+			data, err := io.ReadAll(img)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "image data")
+
+			Convey("and the sha256 is recalculated if the image changes", func() {
+				So(os.WriteFile(imagePath, []byte("new image data"), 0600), ShouldBeNil)
+				So(os.Chtimes(imagePath, time.Now(), time.Now().Add(time.Minute)), ShouldBeNil)
+
+				img, err = builder.Image(context.Background(), "users/foo/env", "1")
+				So(err, ShouldBeNil)
+
+				defer img.Close()
+
+				So(img.SHA256, ShouldEqual, fmt.Sprintf("%x", sha256.Sum256([]byte("new image data"))))
+			})
+		})
+
+		Convey("images that aren't installed are read from S3", func() {
+			img, err := builder.Image(context.Background(), "users/foo/env", "2")
+			So(err, ShouldBeNil)
+
+			defer img.Close()
+
+			So(img.Size, ShouldEqual, -1)
+			So(img.SHA256, ShouldBeBlank)
+
+			data, err := io.ReadAll(img)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "image")
+
+			builder.s3 = &mapS3{files: make(map[string]string)}
+
+			_, err = builder.Image(context.Background(), "users/foo/env", "2")
+			So(err, ShouldWrap, ErrNoImage)
+		})
+
+		Convey("invalid environments are rejected", func() {
+			_, err := builder.Image(context.Background(), "users/env", "1")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,152 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+const (
+	bootstrapDocker     = "docker"
+	bootstrapLocalImage = "localimage"
+	dockerHubNamespace  = "library/"
+	sifExt              = ".sif"
+)
+
+// mirroredImage returns the docker image reference to bootstrap from for the
+// given image. If registry is set and the image doesn't name a registry host,
+// it is pulled from the registry mirror instead of Docker Hub, with official
+// images getting their implicit "library/" namespace.
+func mirroredImage(registry, image string) string {
+	if registry == "" || hasRegistryHost(image) {
+		return image
+	}
+
+	if !strings.Contains(image, "/") {
+		image = dockerHubNamespace + image
+	}
+
+	return strings.TrimSuffix(registry, "/") + "/" + image
+}
+
+func hasRegistryHost(image string) bool {
+	first, _, found := strings.Cut(image, "/")
+
+	return found && (strings.ContainsAny(first, ".:") || first == "localhost")
+}
+
+// localImagePath returns the path of the SIF file in dir that image refreshes
+// pull the given image to.
+func localImagePath(dir, image string) string {
+	return filepath.Join(dir, strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(image)+sifExt)
+}
+
+// bootstrap returns the singularity definition file Bootstrap agent and From
+// value to use for the given image: the image itself if it is the path of a
+// local SIF file (eg. a base image built by BuildBaseImages()), a local SIF copy
+// if one has been pulled by RefreshImages(), otherwise the image from docker,
+// via any registry mirror.
+func (b *Builder) bootstrap(image string) (string, string) {
+	if filepath.IsAbs(image) {
+		return bootstrapLocalImage, image
+	}
+
+	if dir := b.config.Images.LocalDir; dir != "" {
+		path := localImagePath(dir, image)
+
+		if _, err := os.Stat(path); err == nil {
+			return bootstrapLocalImage, path
+		}
+	}
+
+	return bootstrapDocker, mirroredImage(b.config.Images.Registry, image)
+}
+
+// refreshedImages returns the sorted unique build and final images of the
+// spack section and all profiles.
+func (b *Builder) refreshedImages() []string {
+	images := []string{b.config.Spack.BuildImage, b.config.Spack.FinalImage}
+
+	for _, profile := range b.config.Profiles {
+		images = append(images, profile.BuildImage, profile.FinalImage)
+	}
+
+	images = slices.DeleteFunc(images, func(image string) bool { return image == "" })
+	slices.Sort(images)
+
+	return slices.Compact(images)
+}
+
+// RefreshImages adds a job to the default wr deployment that pulls all the
+// configured build and final images to SIF files in the configured
+// images.localDir, for builds to bootstrap from. Does nothing if that isn't
+// configured.
+func (b *Builder) RefreshImages() error {
+	dir := b.config.Images.LocalDir
+	if dir == "" {
+		return nil
+	}
+
+	images := b.refreshedImages()
+	pulls := make([]wr.ImagePull, len(images))
+
+	for i, image := range images {
+		pulls[i] = wr.ImagePull{
+			Source: bootstrapDocker + "://" + mirroredImage(b.config.Images.Registry, image),
+			Dest:   localImagePath(dir, image),
+		}
+	}
+
+	wrInput, err := wr.PullImagesWRInput(pulls)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.runnerFor(config.DefaultWRDeployment).Add(wrInput)
+
+	return err
+}
+
+// RefreshImagesPeriodically calls RefreshImages() now, and then every
+// images.refreshHours (or at the times of the images.schedule cron expression,
+// if set), until the given context is cancelled. Does nothing if
+// images.localDir isn't configured.
+func (b *Builder) RefreshImagesPeriodically(ctx context.Context) {
+	if b.config.Images.LocalDir == "" {
+		return
+	}
+
+	b.imageRefreshes.run(ctx, true, func() {
+		if err := b.RefreshImages(); err != nil {
+			loggerFromContext(ctx).Error("failed to add image refresh job", "err", err)
+		}
+	})
+}
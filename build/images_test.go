@@ -0,0 +1,123 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+func TestMirroredImage(t *testing.T) {
+	Convey("Images without a registry host are pulled from a configured mirror", t, func() {
+		for _, test := range [...]struct {
+			registry, image, expected string
+		}{
+			{"", "ubuntu:22.04", "ubuntu:22.04"},
+			{"mirror.example.org", "ubuntu:22.04", "mirror.example.org/library/ubuntu:22.04"},
+			{"mirror.example.org/", "spack/ubuntu-jammy:latest", "mirror.example.org/spack/ubuntu-jammy:latest"},
+			{"mirror.example.org", "quay.io/org/image:1", "quay.io/org/image:1"},
+			{"mirror.example.org", "localhost/image:1", "localhost/image:1"},
+			{"mirror.example.org", "registry:5000/image:1", "registry:5000/image:1"},
+		} {
+			So(mirroredImage(test.registry, test.image), ShouldEqual, test.expected)
+		}
+	})
+}
+
+func TestImages(t *testing.T) {
+	Convey("Given a Builder with local images configured", t, func() {
+		builder, conf, _, mwr := newTestBuilder(t, func(conf *config.Config) {
+			conf.Spack.BuildImage = "spack/ubuntu-jammy:latest"
+			conf.Profiles = map[string]config.Profile{
+				"gpu": {BuildImage: "spack/ubuntu-jammy-cuda:latest"},
+				"cpu": {Memory: "8G"},
+			}
+			conf.Images.Registry = "mirror.example.org"
+			conf.Images.LocalDir = t.TempDir()
+		})
+
+		def := getExampleDefinition()
+
+		Convey("you can add a job to refresh them", func() {
+			So(builder.refreshedImages(), ShouldResemble, []string{
+				"spack/ubuntu-jammy-cuda:latest",
+				"spack/ubuntu-jammy:latest",
+				"ubuntu:22.04",
+			})
+
+			err := builder.RefreshImages()
+			So(err, ShouldBeNil)
+
+			var job struct {
+				Cmd    string
+				RepGrp string `json:"rep_grp"`
+			}
+
+			err = json.NewDecoder(strings.NewReader(mwr.GetLastCmd())).Decode(&job)
+			So(err, ShouldBeNil)
+			So(job.RepGrp, ShouldEqual, wr.ImageRefreshRepGroup)
+			So(job.Cmd, ShouldContainSubstring, "singularity pull --force '"+
+				filepath.Join(conf.Images.LocalDir, "ubuntu_22.04.sif.tmp")+
+				"' 'docker://mirror.example.org/library/ubuntu:22.04'")
+		})
+
+		Convey("you can refresh them periodically", func() {
+			conf.Images.LocalDir = ""
+			builder.RefreshImagesPeriodically(context.Background())
+			So(mwr.GetLastCmd(), ShouldBeBlank)
+
+			conf.Images.LocalDir = t.TempDir()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			builder.RefreshImagesPeriodically(ctx)
+			So(mwr.GetLastCmd(), ShouldContainSubstring, wr.ImageRefreshRepGroup)
+		})
+
+		Convey("builds bootstrap from the mirror until there are local copies", func() {
+			defFile, err := builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldStartWith, "Bootstrap: docker\nFrom: mirror.example.org/spack/ubuntu-jammy:latest\n")
+			So(defFile, ShouldContainSubstring, "Bootstrap: docker\nFrom: mirror.example.org/library/ubuntu:22.04\n")
+
+			localBuildImage := filepath.Join(conf.Images.LocalDir, "spack_ubuntu-jammy_latest.sif")
+			err = os.WriteFile(localBuildImage, []byte("sif"), 0600)
+			So(err, ShouldBeNil)
+
+			defFile, err = builder.generateSingularityDef(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(defFile, ShouldStartWith, "Bootstrap: localimage\nFrom: "+localBuildImage+"\n")
+			So(defFile, ShouldContainSubstring, "Bootstrap: docker\nFrom: mirror.example.org/library/ubuntu:22.04\n")
+		})
+	})
+}
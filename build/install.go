@@ -24,13 +24,22 @@
 package build
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
+	"io/fs"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/wtsi-hgi/go-softpack-builder/config"
 	"github.com/wtsi-hgi/go-softpack-builder/core"
 	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
 )
 
 const (
@@ -40,47 +49,239 @@ const (
 	perms    = 0644
 	dirPerms = 0755
 	flags    = os.O_EXCL | os.O_CREATE | os.O_WRONLY
+
+	newSuffix         = ".new"
+	archiveSuffix     = ".archived-"
+	archiveTimeFormat = "20060102T150405"
+
+	unchangedID = -1
+
+	// UsageWrapperBasename is the name of the script installed in to scripts
+	// directories, when usage logging is enabled, that logs exe invocations
+	// before sourcing the configured wrapper script.
+	UsageWrapperBasename = ".gsb-usage-wrapper"
+
+	// WrapperBasename is the name of the script installed in to scripts
+	// directories, when no wrapper script is configured, that runs exes inside
+	// the environment's image.
+	WrapperBasename = ".gsb-wrapper"
+
+	execPerms = 0111
 )
 
-func installModule(scriptInstallBase, moduleInstallBase string, def *Definition, module,
-	image io.Reader, exes []string, wrapperScript string) (err error) {
-	var scriptsDir, moduleDir string
+// installer installs module files and scripts on to a filesystem, giving
+// everything it creates the configured permissions, group and ACL. If a
+// usageSpoolDir or usageSyslog is configured, exes will log their use. Any
+// wrapperBinds are bound in to images by the wrapper script we generate.
+type installer struct {
+	fs            fsys.FS
+	fileMode      fs.FileMode
+	dirMode       fs.FileMode
+	gid           int
+	acl           []string
+	usageSpoolDir string
+	usageSyslog   bool
+	wrapperBinds  []string
+}
+
+// newInstaller returns an installer with the default permissions and no group
+// or ACL changes.
+func newInstaller(filesystem fsys.FS) *installer {
+	return &installer{
+		fs:       filesystem,
+		fileMode: perms,
+		dirMode:  dirPerms,
+		gid:      unchangedID,
+	}
+}
+
+// newInstallerFromConfig returns an installer using the permissions, group,
+// setgid and ACL options in the module section of the given config.
+func newInstallerFromConfig(filesystem fsys.FS, conf *config.Config) (*installer, error) {
+	i := newInstaller(filesystem)
+
+	if mode, err := config.ParseMode(conf.Module.FilePerms); err != nil {
+		return nil, err
+	} else if mode != 0 {
+		i.fileMode = mode
+	}
+
+	if mode, err := config.ParseMode(conf.Module.DirPerms); err != nil {
+		return nil, err
+	} else if mode != 0 {
+		i.dirMode = mode
+	}
+
+	if conf.Module.SetGID {
+		i.dirMode |= fs.ModeSetgid
+	}
+
+	i.acl = conf.Module.ACL
+	i.usageSpoolDir = conf.Module.UsageLog.SpoolDir
+	i.usageSyslog = conf.Module.UsageLog.Syslog
+	i.wrapperBinds = conf.Module.Wrapper.Binds
+
+	if conf.Module.Group == "" {
+		return i, nil
+	}
 
-	scriptsDir, moduleDir, err = makeModuleDirs(scriptInstallBase, moduleInstallBase, def)
+	group, err := user.LookupGroup(conf.Module.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	i.gid, err = strconv.Atoi(group.Gid)
+
+	return i, err
+}
+
+func (i *installer) installModule(scriptInstallBase, moduleInstallBase string, def *Definition, module,
+	image io.Reader, exes []string, wrapperScript string) error {
+	scriptsDir, moduleDir, err := i.makeModuleDirs(scriptInstallBase, moduleInstallBase, def)
 	if err != nil {
 		return err
 	}
 
 	modulePath := filepath.Join(moduleDir, def.EnvironmentVersion)
 
+	if def.Force {
+		return i.reinstallModule(def, modulePath, scriptsDir, module, image, exes, wrapperScript)
+	}
+
+	return i.installFiles(def, modulePath, scriptsDir, module, image, exes, wrapperScript)
+}
+
+// usageWrapper returns the contents of a script that logs the use of the exe
+// it is invoked as, before sourcing the given wrapperScript.
+func (i *installer) usageWrapper(def *Definition, wrapperScript string) string {
+	var sb strings.Builder
+
+	usageWrapperTmpl.Execute(&sb, struct { //nolint:errcheck
+		Environment   string
+		SpoolDir      string
+		Syslog        bool
+		WrapperScript string
+		Relative      bool
+	}{
+		Environment:   def.FullEnvironmentPath(),
+		SpoolDir:      i.usageSpoolDir,
+		Syslog:        i.usageSyslog,
+		WrapperScript: wrapperScript,
+		Relative:      !filepath.IsAbs(wrapperScript),
+	})
+
+	return sb.String()
+}
+
+func (i *installer) installFiles(def *Definition, modulePath, scriptsDir string, module, image io.Reader,
+	exes []string, wrapperScript string) (err error) {
 	defer func() {
 		if err != nil {
-			os.Remove(modulePath)
-			os.RemoveAll(scriptsDir)
+			i.fs.Remove(modulePath)
+			i.fs.RemoveAll(scriptsDir)
 		}
 	}()
 
-	if err = installFile(module, modulePath); err != nil {
+	if err = i.installFile(module, modulePath); err != nil {
+		return err
+	}
+
+	if err = i.installImage(image, scriptsDir); err != nil {
+		return err
+	}
+
+	if wrapperScript, err = i.installWrapper(wrapperScript, scriptsDir); err != nil {
+		return err
+	}
+
+	if wrapperScript, err = i.installUsageWrapper(def, wrapperScript, scriptsDir); err != nil {
+		return err
+	}
+
+	return i.createExeSymlinks(wrapperScript, scriptsDir, exes)
+}
+
+// reinstallModule installs the module file and scripts alongside any existing
+// installation, then archives the existing installation before renaming the new
+// files in to place, so that users never see a partial installation.
+func (i *installer) reinstallModule(def *Definition, modulePath, scriptsDir string, module, image io.Reader,
+	exes []string, wrapperScript string) error {
+	newModulePath := hiddenPath(modulePath, newSuffix)
+	newScriptsDir := hiddenPath(scriptsDir, newSuffix)
+
+	i.fs.Remove(newModulePath)
+
+	err := i.makeStagingDir(newScriptsDir)
+	if err != nil {
+		return err
+	}
+
+	if err = i.installFiles(def, newModulePath, newScriptsDir, module, image, exes, wrapperScript); err != nil {
+		return err
+	}
+
+	if err = archiveInstallation(i.fs, modulePath, scriptsDir); err != nil {
+		i.fs.Remove(newModulePath)
+		i.fs.RemoveAll(newScriptsDir)
+
+		return err
+	}
+
+	if err = i.fs.Rename(newScriptsDir, scriptsDir); err != nil {
+		return err
+	}
+
+	return i.fs.Rename(newModulePath, modulePath)
+}
+
+// makeStagingDir creates a fresh, empty directory at the given path.
+func (i *installer) makeStagingDir(dir string) error {
+	if err := i.fs.RemoveAll(dir); err != nil {
 		return err
 	}
 
-	if err = installFile(image, filepath.Join(scriptsDir, core.ImageBasename)); err != nil {
+	if err := i.fs.MkdirAll(dir, dirPerms); err != nil {
 		return err
 	}
 
-	return createExeSymlinks(wrapperScript, scriptsDir, exes)
+	return i.setPermissions(dir, i.dirMode, i.acl)
 }
 
-func makeModuleDirs(scriptInstallBase, moduleInstallBase string, def *Definition) (string, string, error) {
+// archiveInstallation renames an existing module file and scripts directory to
+// hidden names with a timestamp suffix. An empty scripts directory is simply
+// removed.
+func archiveInstallation(filesystem fsys.FS, modulePath, scriptsDir string) error {
+	suffix := archiveSuffix + time.Now().Format(archiveTimeFormat)
+
+	err := filesystem.Rename(modulePath, hiddenPath(modulePath, suffix))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err = filesystem.Remove(scriptsDir); err == nil || errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return filesystem.Rename(scriptsDir, hiddenPath(scriptsDir, suffix))
+}
+
+// hiddenPath returns a dot-prefixed version of path's basename, with the given
+// suffix, in the same directory as path.
+func hiddenPath(path, suffix string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+suffix)
+}
+
+func (i *installer) makeModuleDirs(scriptInstallBase, moduleInstallBase string,
+	def *Definition) (string, string, error) {
 	scriptsDir := ScriptsDirFromNameAndVersion(scriptInstallBase, def.EnvironmentPath,
 		def.EnvironmentName, def.EnvironmentVersion)
 	moduleDir := ModuleDirFromName(moduleInstallBase, def.EnvironmentPath, def.EnvironmentName)
 
-	if err := makeDirectory(scriptsDir, scriptInstallBase); err != nil {
+	if err := i.makeDirectory(scriptsDir, scriptInstallBase); err != nil {
 		return "", "", err
 	}
 
-	if err := makeDirectory(moduleDir, moduleInstallBase); err != nil {
+	if err := i.makeDirectory(moduleDir, moduleInstallBase); err != nil {
 		return "", "", err
 	}
 
@@ -100,8 +301,8 @@ func ModuleDirFromName(moduleInstallBase, path, name string) string {
 }
 
 // makeDirectory does a MkdirAll for leafDir, and then makes sure it and it's
-// parents up to baseDir are world accesible.
-func makeDirectory(leafDir, baseDir string) error {
+// parents up to baseDir have our directory permissions, group and ACL.
+func (i *installer) makeDirectory(leafDir, baseDir string) error {
 	leafDir, err := filepath.Abs(leafDir)
 	if err != nil {
 		return err
@@ -115,12 +316,12 @@ func makeDirectory(leafDir, baseDir string) error {
 		return ErrMakeDirectory
 	}
 
-	if err = os.MkdirAll(leafDir, dirPerms); err != nil {
+	if err = i.fs.MkdirAll(leafDir, dirPerms); err != nil {
 		return err
 	}
 
 	for leafDir != baseDir {
-		if err := os.Chmod(leafDir, dirPerms); err != nil {
+		if err := i.setPermissions(leafDir, i.dirMode, i.acl); err != nil {
 			return err
 		}
 
@@ -130,10 +331,10 @@ func makeDirectory(leafDir, baseDir string) error {
 	return nil
 }
 
-func installFile(data io.Reader, path string) (err error) {
-	var f *os.File
+func (i *installer) installFile(data io.Reader, path string) (err error) {
+	var f io.WriteCloser
 
-	f, err = os.OpenFile(path, flags, perms)
+	f, err = i.fs.OpenFile(path, flags, perms)
 	if err != nil {
 		return err
 	}
@@ -148,14 +349,122 @@ func installFile(data io.Reader, path string) (err error) {
 		return err
 	}
 
-	err = os.Chmod(path, perms)
+	err = i.setPermissions(path, i.fileMode, fileACL(i.acl))
 
 	return err
 }
 
-func createExeSymlinks(wrapperScript, scriptsDir string, exes []string) error {
+// setPermissions sets the group (if configured), mode and ACL entries of the
+// given path. The group is set first, since changing it clears setgid.
+func (i *installer) setPermissions(path string, mode fs.FileMode, acl []string) error {
+	if i.gid != unchangedID {
+		if err := i.fs.Chown(path, unchangedID, i.gid); err != nil {
+			return err
+		}
+	}
+
+	if err := i.fs.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	if len(acl) == 0 {
+		return nil
+	}
+
+	return i.fs.SetACL(path, acl)
+}
+
+// fileACL returns the given ACL entries without any default entries, which only
+// apply to directories.
+func fileACL(acl []string) []string {
+	var entries []string
+
+	for _, entry := range acl {
+		if !strings.HasPrefix(entry, "d:") && !strings.HasPrefix(entry, "default:") {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// installUsageWrapper, if usage logging is enabled, installs a usage logging
+// script that sources the given wrapperScript in to the scriptsDir, and returns
+// the relative path exes should be linked to. Otherwise returns wrapperScript
+// unchanged.
+func (i *installer) installUsageWrapper(def *Definition, wrapperScript, scriptsDir string) (string, error) {
+	if i.usageSpoolDir == "" && !i.usageSyslog {
+		return wrapperScript, nil
+	}
+
+	path := filepath.Join(scriptsDir, UsageWrapperBasename)
+
+	if err := i.installFile(strings.NewReader(i.usageWrapper(def, wrapperScript)), path); err != nil {
+		return "", err
+	}
+
+	return UsageWrapperBasename, i.fs.Chmod(path, i.fileMode|execPerms)
+}
+
+// installImage installs the given image in to the scriptsDir, along with a file
+// recording its checksum.
+func (i *installer) installImage(image io.Reader, scriptsDir string) error {
+	h := sha256.New()
+
+	if err := i.installFile(io.TeeReader(image, h), filepath.Join(scriptsDir, core.ImageBasename)); err != nil {
+		return err
+	}
+
+	return i.installFile(strings.NewReader(hex.EncodeToString(h.Sum(nil))+"\n"),
+		filepath.Join(scriptsDir, ImageChecksumBasename))
+}
+
+// installWrapper, if wrapperScript is blank, installs a script that runs exes
+// inside the image in to the scriptsDir, and returns the relative path exes
+// should be linked to. Otherwise returns wrapperScript unchanged.
+func (i *installer) installWrapper(wrapperScript, scriptsDir string) (string, error) {
+	if wrapperScript != "" {
+		return wrapperScript, nil
+	}
+
+	var sb strings.Builder
+
+	wrapperTmpl.Execute(&sb, struct { //nolint:errcheck
+		Binds []string
+		Image string
+	}{
+		Binds: i.wrapperBinds,
+		Image: core.ImageBasename,
+	})
+
+	path := filepath.Join(scriptsDir, WrapperBasename)
+
+	if err := i.installFile(strings.NewReader(sb.String()), path); err != nil {
+		return "", err
+	}
+
+	return WrapperBasename, i.fs.Chmod(path, i.fileMode|execPerms)
+}
+
+// replaceFile atomically replaces the file at the given path with the given
+// data, by writing to a hidden file alongside it and then renaming.
+func (i *installer) replaceFile(data io.Reader, path string) error {
+	newPath := hiddenPath(path, newSuffix)
+
+	i.fs.Remove(newPath)
+
+	if err := i.installFile(data, newPath); err != nil {
+		i.fs.Remove(newPath)
+
+		return err
+	}
+
+	return i.fs.Rename(newPath, path)
+}
+
+func (i *installer) createExeSymlinks(wrapperScript, scriptsDir string, exes []string) error {
 	for _, exe := range exes {
-		if err := os.Symlink(wrapperScript, filepath.Join(scriptsDir, exe)); err != nil {
+		if err := i.fs.Symlink(wrapperScript, filepath.Join(scriptsDir, exe)); err != nil {
 			return err
 		}
 	}
@@ -26,13 +26,19 @@ package build
 import (
 	"errors"
 	"io"
+	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
 	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
 )
 
 func TestInstall(t *testing.T) {
@@ -49,7 +55,7 @@ func TestInstall(t *testing.T) {
 		exes := []string{"a", "b"}
 		wrapperScript := "/path/to/wrapper.script"
 
-		err := installModule(tmpScriptsDir, tmpModulesDir, def,
+		err := newInstaller(fsys.OS{}).installModule(tmpScriptsDir, tmpModulesDir, def,
 			strings.NewReader(moduleFile), strings.NewReader(imageFile), exes, wrapperScript)
 		So(err, ShouldBeNil)
 
@@ -80,7 +86,7 @@ func TestInstall(t *testing.T) {
 
 		leafDir := filepath.Join("base", "sub1", "sub2")
 
-		err = makeDirectory(leafDir, baseDir)
+		err = newInstaller(fsys.OS{}).makeDirectory(leafDir, baseDir)
 		So(err, ShouldBeNil)
 
 		absLeafDir, err := filepath.Abs(leafDir)
@@ -91,11 +97,294 @@ func TestInstall(t *testing.T) {
 
 		Convey("unless baseDir is not a parent of a leafDir", func() {
 			leafDir = filepath.Join("sub1", "sub2")
-			err = makeDirectory(leafDir, baseDir)
+			err = newInstaller(fsys.OS{}).makeDirectory(leafDir, baseDir)
 			So(err, ShouldNotBeNil)
 			So(errors.Is(err, ErrMakeDirectory), ShouldBeTrue)
 		})
 	})
+
+	Convey("Given an in-memory filesystem, you can install a module", t, func() {
+		mfs := fsmock.New()
+		scriptsBase := "/scripts"
+		modulesBase := "/modules"
+
+		So(mfs.MkdirAll(scriptsBase, dirPerms), ShouldBeNil)
+		So(mfs.MkdirAll(modulesBase, dirPerms), ShouldBeNil)
+
+		def := getExampleDefinition()
+		exes := []string{"a", "b"}
+		wrapperScript := "/path/to/wrapper.script"
+		modulePath := filepath.Join(modulesBase, def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+		scriptsDir := filepath.Join(scriptsBase, def.EnvironmentPath, def.EnvironmentName,
+			def.EnvironmentVersion+ScriptsDirSuffix)
+
+		err := newInstaller(mfs).installModule(scriptsBase, modulesBase, def,
+			strings.NewReader("module"), strings.NewReader("image"), exes, wrapperScript)
+		So(err, ShouldBeNil)
+
+		data, err := mfs.ReadFile(modulePath)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "module")
+
+		mode, err := mfs.Mode(modulePath)
+		So(err, ShouldBeNil)
+		So(mode, ShouldEqual, fs.FileMode(perms))
+
+		mode, err = mfs.Mode(filepath.Dir(scriptsDir))
+		So(err, ShouldBeNil)
+		So(mode.Perm(), ShouldEqual, fs.FileMode(dirPerms))
+
+		data, err = mfs.ReadFile(filepath.Join(scriptsDir, core.ImageBasename))
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "image")
+
+		for _, exe := range exes {
+			dest, errr := mfs.Readlink(filepath.Join(scriptsDir, exe))
+			So(errr, ShouldBeNil)
+			So(dest, ShouldEqual, wrapperScript)
+		}
+
+		Convey("but not if the version is already installed", func() {
+			err = newInstaller(mfs).installModule(scriptsBase, modulesBase, def,
+				strings.NewReader("module"), strings.NewReader("image"), exes, wrapperScript)
+			So(errors.Is(err, fs.ErrExist), ShouldBeTrue)
+		})
+
+		Convey("unless forced, which archives the existing installation", func() {
+			def.Force = true
+
+			err = newInstaller(mfs).installModule(scriptsBase, modulesBase, def,
+				strings.NewReader("new module"), strings.NewReader("new image"), []string{"c"}, wrapperScript)
+			So(err, ShouldBeNil)
+
+			data, err = mfs.ReadFile(modulePath)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "new module")
+
+			data, err = mfs.ReadFile(filepath.Join(scriptsDir, core.ImageBasename))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "new image")
+			So(mfs.Exists(filepath.Join(scriptsDir, "a")), ShouldBeFalse)
+			So(mfs.Exists(filepath.Join(scriptsDir, "c")), ShouldBeTrue)
+
+			entries, err := mfs.ReadDir(filepath.Dir(modulePath))
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 2)
+			So(entries[0].Name(), ShouldStartWith, "."+def.EnvironmentVersion+archiveSuffix)
+
+			archived, err := mfs.ReadFile(filepath.Join(filepath.Dir(modulePath), entries[0].Name()))
+			So(err, ShouldBeNil)
+			So(string(archived), ShouldEqual, "module")
+
+			entries, err = mfs.ReadDir(filepath.Dir(scriptsDir))
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 2)
+			So(entries[0].Name(), ShouldStartWith, "."+filepath.Base(scriptsDir)+archiveSuffix)
+
+			archived, err = mfs.ReadFile(filepath.Join(filepath.Dir(scriptsDir), entries[0].Name(), core.ImageBasename))
+			So(err, ShouldBeNil)
+			So(string(archived), ShouldEqual, "image")
+		})
+
+		Convey("and a failed forced reinstall leaves the existing installation in place", func() {
+			def.Force = true
+
+			errRead := errors.New("read failed")
+
+			err = newInstaller(mfs).installModule(scriptsBase, modulesBase, def,
+				strings.NewReader("new module"), iotest.ErrReader(errRead), exes, wrapperScript)
+			So(err, ShouldEqual, errRead)
+
+			data, err = mfs.ReadFile(modulePath)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "module")
+			So(mfs.Exists(filepath.Join(scriptsDir, core.ImageBasename)), ShouldBeTrue)
+
+			entries, err := mfs.ReadDir(filepath.Dir(scriptsDir))
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Permission failures during install are cleaned up after", t, func() {
+		mfs := fsmock.New()
+		scriptsBase := "/scripts"
+		modulesBase := "/modules"
+
+		So(mfs.MkdirAll(scriptsBase, dirPerms), ShouldBeNil)
+		So(mfs.MkdirAll(modulesBase, dirPerms), ShouldBeNil)
+
+		def := getExampleDefinition()
+		modulePath := filepath.Join(modulesBase, def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+		scriptsDir := filepath.Join(scriptsBase, def.EnvironmentPath, def.EnvironmentName,
+			def.EnvironmentVersion+ScriptsDirSuffix)
+
+		So(mfs.MkdirAll(scriptsDir, dirPerms), ShouldBeNil)
+		mfs.Deny(scriptsDir)
+
+		err := newInstaller(mfs).installModule(scriptsBase, modulesBase, def,
+			strings.NewReader("module"), strings.NewReader("image"), nil, "/wrapper")
+		So(errors.Is(err, fs.ErrPermission), ShouldBeTrue)
+		So(mfs.Exists(modulePath), ShouldBeFalse)
+	})
+
+	Convey("Forced installs work when nothing was previously installed", t, func() {
+		mfs := fsmock.New()
+
+		So(mfs.MkdirAll("/scripts", dirPerms), ShouldBeNil)
+		So(mfs.MkdirAll("/modules", dirPerms), ShouldBeNil)
+
+		def := getExampleDefinition()
+		def.Force = true
+
+		err := newInstaller(mfs).installModule("/scripts", "/modules", def,
+			strings.NewReader("module"), strings.NewReader("image"), nil, "/wrapper")
+		So(err, ShouldBeNil)
+
+		entries, err := mfs.ReadDir(filepath.Join("/modules", def.EnvironmentPath, def.EnvironmentName))
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldEqual, 1)
+		So(entries[0].Name(), ShouldEqual, def.EnvironmentVersion)
+
+		entries, err = mfs.ReadDir(filepath.Join("/scripts", def.EnvironmentPath, def.EnvironmentName))
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldEqual, 1)
+		So(entries[0].Name(), ShouldEqual, def.EnvironmentVersion+ScriptsDirSuffix)
+	})
+
+	Convey("Installs can use configured permissions, group and ACL", t, func() {
+		conf := &config.Config{}
+		conf.Module.FilePerms = "0664"
+		conf.Module.DirPerms = "0775"
+		conf.Module.SetGID = true
+		conf.Module.ACL = []string{"g:admins:rwx", "d:g:admins:rwx"}
+
+		mfs := fsmock.New()
+
+		inst, err := newInstallerFromConfig(mfs, conf)
+		So(err, ShouldBeNil)
+
+		inst.gid = 1234
+
+		So(mfs.MkdirAll("/scripts", dirPerms), ShouldBeNil)
+		So(mfs.MkdirAll("/modules", dirPerms), ShouldBeNil)
+
+		def := getExampleDefinition()
+
+		err = inst.installModule("/scripts", "/modules", def,
+			strings.NewReader("module"), strings.NewReader("image"), nil, "/wrapper")
+		So(err, ShouldBeNil)
+
+		moduleDir := filepath.Join("/modules", def.EnvironmentPath, def.EnvironmentName)
+		modulePath := filepath.Join(moduleDir, def.EnvironmentVersion)
+
+		mode, err := mfs.Mode(moduleDir)
+		So(err, ShouldBeNil)
+		So(mode, ShouldEqual, fs.ModeDir|fs.ModeSetgid|0775)
+
+		gid, err := mfs.Group(moduleDir)
+		So(err, ShouldBeNil)
+		So(gid, ShouldEqual, 1234)
+
+		acl, err := mfs.ACL(moduleDir)
+		So(err, ShouldBeNil)
+		So(acl, ShouldResemble, conf.Module.ACL)
+
+		mode, err = mfs.Mode(modulePath)
+		So(err, ShouldBeNil)
+		So(mode, ShouldEqual, fs.FileMode(0664))
+
+		gid, err = mfs.Group(modulePath)
+		So(err, ShouldBeNil)
+		So(gid, ShouldEqual, 1234)
+
+		acl, err = mfs.ACL(modulePath)
+		So(err, ShouldBeNil)
+		So(acl, ShouldResemble, []string{"g:admins:rwx"})
+
+		gid, err = mfs.Group("/modules")
+		So(err, ShouldBeNil)
+		So(gid, ShouldEqual, 0)
+	})
+
+	Convey("Installer config is validated", t, func() {
+		conf := &config.Config{}
+		conf.Module.Group = "root"
+
+		inst, err := newInstallerFromConfig(fsys.OS{}, conf)
+		So(err, ShouldBeNil)
+		So(inst.gid, ShouldEqual, 0)
+		So(inst.fileMode, ShouldEqual, fs.FileMode(perms))
+		So(inst.dirMode, ShouldEqual, fs.FileMode(dirPerms))
+
+		conf.Module.Group = "gsb-no-such-group"
+
+		_, err = newInstallerFromConfig(fsys.OS{}, conf)
+		So(err, ShouldNotBeNil)
+
+		conf.Module.Group = ""
+		conf.Module.FilePerms = "999"
+
+		_, err = newInstallerFromConfig(fsys.OS{}, conf)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Installs can log exe usage", t, func() {
+		tmpDir := t.TempDir()
+		scriptsBase := filepath.Join(tmpDir, "scripts")
+		modulesBase := filepath.Join(tmpDir, "modules")
+		spoolDir := filepath.Join(tmpDir, "spool")
+
+		for _, dir := range []string{scriptsBase, modulesBase, spoolDir} {
+			So(os.Mkdir(dir, dirPerms), ShouldBeNil)
+		}
+
+		wrapperScript := filepath.Join(tmpDir, "wrapper")
+		So(os.WriteFile(wrapperScript, []byte("echo \"$(basename \"$0\") $*\"\n"), perms), ShouldBeNil)
+
+		inst := newInstaller(fsys.OS{})
+		inst.usageSpoolDir = spoolDir
+
+		def := getExampleDefinition()
+
+		err := inst.installModule(scriptsBase, modulesBase, def,
+			strings.NewReader("module"), strings.NewReader("image"), []string{"a"}, wrapperScript)
+		So(err, ShouldBeNil)
+
+		scriptsDir := filepath.Join(scriptsBase, def.EnvironmentPath, def.EnvironmentName,
+			def.EnvironmentVersion+ScriptsDirSuffix)
+
+		dest, err := os.Readlink(filepath.Join(scriptsDir, "a"))
+		So(err, ShouldBeNil)
+		So(dest, ShouldEqual, UsageWrapperBasename)
+
+		info, err := os.Stat(filepath.Join(scriptsDir, UsageWrapperBasename))
+		So(err, ShouldBeNil)
+		So(info.Mode().Perm(), ShouldEqual, fs.FileMode(0755))
+
+		wrapper := readFile(t, filepath.Join(scriptsDir, UsageWrapperBasename))
+		So(wrapper, ShouldContainSubstring, spoolDir)
+		So(wrapper, ShouldNotContainSubstring, "logger")
+
+		cmd := exec.Command(filepath.Join(scriptsDir, "a"), "arg1")
+		cmd.Env = append(os.Environ(), "USER=someuser")
+		out, err := cmd.Output()
+		So(err, ShouldBeNil)
+		So(string(out), ShouldEqual, "a arg1\n")
+
+		logged := readFile(t, filepath.Join(spoolDir, "someuser.tsv"))
+		fields := strings.Split(strings.TrimSpace(logged), "\t")
+		So(len(fields), ShouldEqual, 4)
+		So(fields[1:], ShouldResemble, []string{def.FullEnvironmentPath(), "a", "someuser"})
+
+		Convey("and to syslog", func() {
+			inst.usageSyslog = true
+			inst.usageSpoolDir = ""
+
+			So(inst.usageWrapper(def, wrapperScript), ShouldContainSubstring,
+				`logger -t gsb-usage "env=`+def.FullEnvironmentPath()+` exe=$gsb_exe user=$USER"`)
+		})
+	})
 }
 
 func readFile(t *testing.T, path string) string {
@@ -0,0 +1,168 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// KernelSpecBasename is the name of the file describing a Jupyter kernel,
+	// installed in its own directory within the configured kernels directory.
+	KernelSpecBasename = "kernel.json"
+
+	kernelNamePrefix = "softpack-"
+)
+
+// kernelType describes a kind of Jupyter kernel an environment can provide,
+// by including pkg, launched using exe (one of Interpreters()).
+type kernelType struct {
+	pkg      string
+	exe      string
+	suffix   string
+	language string
+	label    string
+	args     []string
+}
+
+var kernelTypes = [...]kernelType{ //nolint:gochecknoglobals
+	{
+		pkg:      "py-ipykernel",
+		exe:      "python",
+		suffix:   "python",
+		language: "python",
+		label:    "Python",
+		args:     []string{"-m", "ipykernel_launcher", "-f", "{connection_file}"},
+	},
+	{
+		pkg:      "r-irkernel",
+		exe:      "R",
+		suffix:   "r",
+		language: "R",
+		label:    "R",
+		args:     []string{"--slave", "-e", "IRkernel::main()", "--args", "{connection_file}"},
+	},
+}
+
+// KernelSpec is a Jupyter kernel spec, as found in a kernel.json file. Name is
+// the name of the directory the kernel.json is installed in.
+type KernelSpec struct {
+	Name        string   `json:"-"`
+	Argv        []string `json:"argv"`
+	DisplayName string   `json:"display_name"`
+	Language    string   `json:"language"`
+}
+
+// JSON returns the kernel.json contents for this spec.
+func (k KernelSpec) JSON() []byte {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	enc.Encode(k) //nolint:errcheck,errchkjson
+
+	return buf.Bytes()
+}
+
+// KernelSpecs returns specs for the Jupyter kernels provided by our packages
+// (py-ipykernel and r-irkernel), that launch the kernel via the environment's
+// executable wrappers installed in the given scripts directory.
+func (d *Definition) KernelSpecs(scriptsDir string) []KernelSpec {
+	var specs []KernelSpec
+
+	for _, kt := range kernelTypes {
+		if !d.hasPackage(kt.pkg) {
+			continue
+		}
+
+		specs = append(specs, KernelSpec{
+			Name:        kernelName(d.FullEnvironmentPath(), kt),
+			Argv:        append([]string{filepath.Join(scriptsDir, kt.exe)}, kt.args...),
+			DisplayName: d.FullEnvironmentPath() + " (" + kt.label + ")",
+			Language:    kt.language,
+		})
+	}
+
+	return specs
+}
+
+func (d *Definition) hasPackage(name string) bool {
+	for _, pkg := range d.Packages {
+		if pkg.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// kernelName returns a valid Jupyter kernel name for the given kind of kernel
+// in the given environment (eg. "users/foo/env-1").
+func kernelName(fullEnvPath string, kt kernelType) string {
+	name := strings.NewReplacer("/", "-", "+", "_").Replace(fullEnvPath)
+
+	return strings.ToLower(kernelNamePrefix + name + "-" + kt.suffix)
+}
+
+// KernelSpecDirs returns the directories within the given kernels directory
+// that kernel specs for the given environment (eg. "users/foo/env") and
+// version could have been installed to.
+func KernelSpecDirs(kernelsDir, envPath, version string) []string {
+	dirs := make([]string, len(kernelTypes))
+
+	for n, kt := range kernelTypes {
+		dirs[n] = filepath.Join(kernelsDir, kernelName(path.Clean(envPath)+"-"+version, kt))
+	}
+
+	return dirs
+}
+
+// installKernelSpecs installs specs for the Jupyter kernels the given
+// environment provides in to the configured kernels directory, if any.
+func (b *Builder) installKernelSpecs(def *Definition) error {
+	kernelsDir := b.config.Module.KernelsDir
+	if kernelsDir == "" {
+		return nil
+	}
+
+	scriptsDir := b.scriptsDir(def)
+
+	for _, spec := range def.KernelSpecs(scriptsDir) {
+		dir := filepath.Join(kernelsDir, spec.Name)
+
+		if err := b.inst.makeDirectory(dir, kernelsDir); err != nil {
+			return err
+		}
+
+		if err := b.inst.replaceFile(bytes.NewReader(spec.JSON()), filepath.Join(dir, KernelSpecBasename)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestKernels(t *testing.T) {
+	Convey("Given a Definition", t, func() {
+		def := getExampleDefinition()
+		scriptsDir := "/software/envs/groups/hgi/xxhash/0.8.1-scripts"
+
+		Convey("it only has kernel specs if it includes kernel packages", func() {
+			So(def.KernelSpecs(scriptsDir), ShouldBeEmpty)
+
+			def.Packages = append(def.Packages, core.Package{Name: "r-irkernel"}, core.Package{Name: "py-ipykernel"})
+
+			specs := def.KernelSpecs(scriptsDir)
+			So(specs, ShouldResemble, []KernelSpec{
+				{
+					Name: "softpack-groups-hgi-xxhash-0.8.1-python",
+					Argv: []string{scriptsDir + "/python", "-m", "ipykernel_launcher",
+						"-f", "{connection_file}"},
+					DisplayName: "groups/hgi/xxhash-0.8.1 (Python)",
+					Language:    "python",
+				},
+				{
+					Name: "softpack-groups-hgi-xxhash-0.8.1-r",
+					Argv: []string{scriptsDir + "/R", "--slave", "-e", "IRkernel::main()",
+						"--args", "{connection_file}"},
+					DisplayName: "groups/hgi/xxhash-0.8.1 (R)",
+					Language:    "R",
+				},
+			})
+
+			So(string(specs[1].JSON()), ShouldEqual, `{
+  "argv": [
+    "`+scriptsDir+`/R",
+    "--slave",
+    "-e",
+    "IRkernel::main()",
+    "--args",
+    "{connection_file}"
+  ],
+  "display_name": "groups/hgi/xxhash-0.8.1 (R)",
+  "language": "R"
+}
+`)
+
+			So(KernelSpecDirs("/kernels", "groups/hgi/xxhash", "0.8.1"), ShouldResemble, []string{
+				"/kernels/softpack-groups-hgi-xxhash-0.8.1-python",
+				"/kernels/softpack-groups-hgi-xxhash-0.8.1-r",
+			})
+		})
+
+		Convey("kernel specs can be installed to the configured kernels directory", func() {
+			var conf config.Config
+			conf.Module.ScriptsInstallDir = "/software/envs"
+			conf.Module.KernelsDir = filepath.Join(t.TempDir(), "kernels")
+
+			builder, err := New(&conf, &s3mock.MockS3{}, nil)
+			So(err, ShouldBeNil)
+
+			So(builder.installKernelSpecs(def), ShouldBeNil)
+			_, err = os.Stat(conf.Module.KernelsDir)
+			So(err, ShouldNotBeNil)
+
+			def.Packages = append(def.Packages, core.Package{Name: "py-ipykernel"})
+			So(builder.installKernelSpecs(def), ShouldBeNil)
+
+			data, err := os.ReadFile(filepath.Join(conf.Module.KernelsDir,
+				"softpack-groups-hgi-xxhash-0.8.1-python", KernelSpecBasename))
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `"`+scriptsDir+`/python"`)
+		})
+	})
+}
@@ -0,0 +1,226 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const (
+	// LogTailLines is the number of recent log lines kept for each build.
+	LogTailLines = 100
+
+	ErrNoLogTail = internal.Error("no logs for environment")
+
+	buildIDBytes = 8
+)
+
+// logTail is an io.Writer that keeps the most recent lines written to it.
+type logTail struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+}
+
+func newLogTail(size int) *logTail {
+	return &logTail{lines: make([]string, 0, size)}
+}
+
+// Write implements io.Writer, storing each line in p.
+func (l *logTail) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		l.add(line)
+	}
+
+	return len(p), nil
+}
+
+func (l *logTail) add(line string) {
+	if len(l.lines) < cap(l.lines) {
+		l.lines = append(l.lines, line)
+
+		return
+	}
+
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % len(l.lines)
+}
+
+// Lines returns the stored lines, oldest first.
+func (l *logTail) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lines := make([]string, 0, len(l.lines))
+	lines = append(lines, l.lines[l.next:]...)
+
+	return append(lines, l.lines[:l.next]...)
+}
+
+// teeHandler is an slog.Handler that passes records to all of its handlers.
+type teeHandler []slog.Handler
+
+// Enabled implements slog.Handler, returning true if any of our handlers are
+// enabled for the level.
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Handle implements slog.Handler, passing the record to each of our handlers
+// that are enabled for its level.
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// WithAttrs implements slog.Handler.
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+
+	return handlers
+}
+
+// WithGroup implements slog.Handler.
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+
+	return handlers
+}
+
+// buildLog holds the logger for a build, which logs to the default logger, and
+// at all levels to the build's logTail. Its logs have the build ID and
+// environment path as attributes, and later the wr job ID.
+type buildLog struct {
+	id     string
+	mu     sync.RWMutex
+	logger *slog.Logger
+	tail   *logTail
+}
+
+func newBuildLog(buildID, envPath string) *buildLog {
+	tail := newLogTail(LogTailLines)
+	handler := teeHandler{
+		slog.Default().Handler(),
+		slog.NewTextHandler(tail, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	}
+
+	return &buildLog{
+		id:     buildID,
+		logger: slog.New(handler).With("buildID", buildID, "envPath", envPath),
+		tail:   tail,
+	}
+}
+
+// Logger returns the build's current logger.
+func (l *buildLog) Logger() *slog.Logger {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.logger
+}
+
+// With adds the given attributes to the build's logger.
+func (l *buildLog) With(args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.logger = l.logger.With(args...)
+}
+
+type buildLogKey struct{}
+
+func contextWithBuildLog(ctx context.Context, bl *buildLog) context.Context {
+	return context.WithValue(ctx, buildLogKey{}, bl)
+}
+
+func buildLogFromContext(ctx context.Context) *buildLog {
+	bl, _ := ctx.Value(buildLogKey{}).(*buildLog) //nolint:errcheck
+
+	return bl
+}
+
+// loggerFromContext returns the logger of the build the given context is for,
+// or the default logger if it isn't for a build.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if bl := buildLogFromContext(ctx); bl != nil {
+		return bl.Logger()
+	}
+
+	return slog.Default()
+}
+
+func newBuildID() string {
+	b := make([]byte, buildIDBytes)
+	rand.Read(b) //nolint:errcheck
+
+	return hex.EncodeToString(b)
+}
+
+// LogTail returns the most recent (up to LogTailLines) log lines of the latest
+// build of the given environment (a full environment path like
+// "users/foo/env-1", as per Status.Name). Returns ErrNoLogTail if that
+// environment hasn't been built since we started.
+func (b *Builder) LogTail(envPath string) ([]string, error) {
+	b.statusMu.RLock()
+	defer b.statusMu.RUnlock()
+
+	tail, ok := b.logTails[envPath]
+	if !ok {
+		return nil, ErrNoLogTail
+	}
+
+	return tail.Lines(), nil
+}
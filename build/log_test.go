@@ -0,0 +1,76 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/tests"
+)
+
+func TestLogTail(t *testing.T) {
+	Convey("A logTail keeps only the most recent lines", t, func() {
+		tail := newLogTail(3)
+		So(tail.Lines(), ShouldBeEmpty)
+
+		_, err := tail.Write([]byte("a\nb\n"))
+		So(err, ShouldBeNil)
+		So(tail.Lines(), ShouldResemble, []string{"a", "b"})
+
+		for i := 0; i < 4; i++ {
+			_, err = fmt.Fprintf(tail, "%d\n", i)
+			So(err, ShouldBeNil)
+		}
+
+		So(tail.Lines(), ShouldResemble, []string{"1", "2", "3"})
+	})
+
+	Convey("A buildLog logs to the default logger and its tail at all levels", t, func() {
+		var logWriter tests.ConcurrentStringBuilder
+		slog.SetDefault(slog.New(slog.NewTextHandler(&logWriter, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+		bl := newBuildLog("id1", "users/foo/env-1")
+		ctx := contextWithBuildLog(context.Background(), bl)
+
+		loggerFromContext(ctx).Debug("debug msg")
+		bl.With("jobID", "job1")
+		loggerFromContext(ctx).Info("info msg", "key", "val")
+
+		So(logWriter.String(), ShouldNotContainSubstring, "debug msg")
+		So(logWriter.String(), ShouldContainSubstring,
+			`msg="info msg" buildID=id1 envPath=users/foo/env-1 jobID=job1 key=val`)
+
+		lines := bl.tail.Lines()
+		So(len(lines), ShouldEqual, 2)
+		So(lines[0], ShouldContainSubstring, `msg="debug msg" buildID=id1 envPath=users/foo/env-1`)
+		So(lines[0], ShouldNotContainSubstring, "jobID")
+		So(lines[1], ShouldContainSubstring, `msg="info msg" buildID=id1 envPath=users/foo/env-1 jobID=job1 key=val`)
+
+		So(loggerFromContext(context.Background()), ShouldEqual, slog.Default())
+	})
+}
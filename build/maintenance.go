@@ -0,0 +1,322 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+// MaintenanceMode says whether we're accepting new builds.
+type MaintenanceMode string
+
+const (
+	// MaintenanceOff means new builds are started as normal.
+	MaintenanceOff MaintenanceMode = "off"
+
+	// MaintenancePaused means new build requests are rejected with
+	// ErrBuildsPaused.
+	MaintenancePaused MaintenanceMode = "paused"
+
+	// MaintenanceDraining means running builds carry on, but new build
+	// requests are queued, to be started when maintenance is turned off.
+	MaintenanceDraining MaintenanceMode = "draining"
+
+	ErrBuildsPaused           = internal.Error("builds are paused for maintenance")
+	ErrUnknownMaintenanceMode = internal.Error("unknown maintenance mode")
+
+	maintenanceFilePerms = 0600
+
+	// maintenanceQueueSuffix is added to the maintenance file's path to get
+	// where the builds queued while draining are persisted.
+	maintenanceQueueSuffix = ".queue"
+)
+
+// MaintenanceStatus describes our maintenance Mode, how many builds are
+// Running, and how many are Queued waiting for maintenance to be turned off.
+type MaintenanceStatus struct {
+	Mode    MaintenanceMode
+	Running int
+	Queued  int
+}
+
+// maintenance holds our MaintenanceMode and the builds queued while draining,
+// persisting them to files if it has a path.
+type maintenance struct {
+	mu     sync.Mutex
+	path   string
+	mode   MaintenanceMode
+	queued []*Definition
+}
+
+// newMaintenance returns a maintenance that persists its mode to the given
+// file, and its queued builds beside it, starting in the mode and with the
+// queue previously persisted there, if any.
+func newMaintenance(path string) (*maintenance, error) {
+	m := &maintenance{path: path, mode: MaintenanceOff}
+
+	if path == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	m.mode = MaintenanceMode(strings.TrimSpace(string(data)))
+
+	if err = m.mode.validate(); err != nil {
+		return nil, err
+	}
+
+	return m, m.loadQueue()
+}
+
+// loadQueue reads the builds persisted to our queue file, if any.
+func (m *maintenance) loadQueue() error {
+	data, err := os.ReadFile(m.path + maintenanceQueueSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &m.queued)
+}
+
+func (mode MaintenanceMode) validate() error {
+	switch mode {
+	case MaintenanceOff, MaintenancePaused, MaintenanceDraining:
+		return nil
+	default:
+		return ErrUnknownMaintenanceMode
+	}
+}
+
+// setMode persists and changes our mode, returning any queued builds if
+// maintenance has been turned off.
+func (m *maintenance) setMode(mode MaintenanceMode) ([]*Definition, error) {
+	if err := mode.validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.persist(mode); err != nil {
+		return nil, err
+	}
+
+	m.mode = mode
+
+	if mode != MaintenanceOff {
+		return nil, nil
+	}
+
+	queued := m.queued
+	m.queued = nil
+
+	return queued, nil
+}
+
+func (m *maintenance) persist(mode MaintenanceMode) error {
+	if m.path == "" {
+		return nil
+	}
+
+	if mode == MaintenanceOff {
+		for _, path := range []string{m.path, m.path + maintenanceQueueSuffix} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return os.WriteFile(m.path, []byte(mode+"\n"), maintenanceFilePerms)
+}
+
+// persistQueue writes the given queue to our queue file, if we have a path.
+// You must hold the lock.
+func (m *maintenance) persistQueue(queued []*Definition) error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(queued)
+	if err != nil {
+		return err
+	}
+
+	path := m.path + maintenanceQueueSuffix
+	tmp := path + newSuffix
+
+	if err = os.WriteFile(tmp, data, maintenanceFilePerms); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// hold returns ErrBuildsPaused if we're paused, or queues and persists the
+// given build and returns true if we're draining. A queued build replaces any
+// earlier one of the same environment.
+func (m *maintenance) hold(def *Definition) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch m.mode {
+	case MaintenancePaused:
+		return false, ErrBuildsPaused
+	case MaintenanceDraining:
+		queued := append(removeQueued(m.queued, def.FullEnvironmentPath()), def)
+
+		if err := m.persistQueue(queued); err != nil {
+			return false, err
+		}
+
+		m.queued = queued
+
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func removeQueued(queued []*Definition, envPath string) []*Definition {
+	kept := make([]*Definition, 0, len(queued)+1)
+
+	for _, def := range queued {
+		if def.FullEnvironmentPath() != envPath {
+			kept = append(kept, def)
+		}
+	}
+
+	return kept
+}
+
+// isQueued returns true if a build of the given full environment path is
+// queued.
+func (m *maintenance) isQueued(envPath string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, def := range m.queued {
+		if def.FullEnvironmentPath() == envPath {
+			return true
+		}
+	}
+
+	return false
+}
+
+// queuedPaths returns the full environment paths of the queued builds, in the
+// order they were queued.
+func (m *maintenance) queuedPaths() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	paths := make([]string, len(m.queued))
+
+	for i, def := range m.queued {
+		paths[i] = def.FullEnvironmentPath()
+	}
+
+	return paths
+}
+
+func (m *maintenance) status() (MaintenanceMode, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mode, len(m.queued)
+}
+
+// Maintenance returns our current MaintenanceStatus.
+func (b *Builder) Maintenance() MaintenanceStatus {
+	mode, queued := b.maintenance.status()
+
+	b.mu.Lock()
+	running := len(b.runningEnvironments)
+	b.mu.Unlock()
+
+	return MaintenanceStatus{Mode: mode, Running: running, Queued: queued}
+}
+
+// SetMaintenance changes our maintenance mode, persisting it to the configured
+// maintenanceFile so that it survives restarts. Turning maintenance off starts
+// the builds queued while draining (which are persisted beside the
+// maintenanceFile). Returns ErrUnknownMaintenanceMode for an invalid mode.
+func (b *Builder) SetMaintenance(ctx context.Context, mode MaintenanceMode) (MaintenanceStatus, error) {
+	queued, err := b.maintenance.setMode(mode)
+	if err != nil {
+		return b.Maintenance(), err
+	}
+
+	ctx = context.WithoutCancel(ctx)
+
+	for _, def := range queued {
+		if err := b.Build(ctx, def); err != nil {
+			loggerFromContext(ctx).Error("failed to start build queued during maintenance",
+				"envPath", def.FullEnvironmentPath(), "err", err)
+		}
+	}
+
+	return b.Maintenance(), nil
+}
+
+// holdForMaintenance returns ErrBuildsPaused if builds are paused, or queues
+// the build of the given Definition and returns true if we're draining. What
+// is queued is requested, the Definition as it was before any pre-build hooks
+// changed it, since they will run again when the build is started.
+func (b *Builder) holdForMaintenance(def, requested *Definition) (bool, error) {
+	held, err := b.maintenance.hold(requested)
+	if held {
+		b.buildStatus(def)
+	}
+
+	return held, err
+}
+
+// recordQueuedStatuses adds statuses for the builds that were queued for
+// maintenance when we last stopped.
+func (b *Builder) recordQueuedStatuses() {
+	b.maintenance.mu.Lock()
+	queued := b.maintenance.queued
+	b.maintenance.mu.Unlock()
+
+	for _, def := range queued {
+		b.buildStatus(def)
+	}
+}
@@ -0,0 +1,138 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+)
+
+func TestMaintenance(t *testing.T) {
+	Convey("Given a Builder with a maintenance file", t, func() {
+		maintFile := filepath.Join(t.TempDir(), "maintenance")
+
+		builder, conf, ms3, mwr := newTestBuilder(t, func(conf *config.Config) {
+			conf.Server.MaintenanceFile = maintFile
+		})
+		So(builder.Maintenance(), ShouldResemble, MaintenanceStatus{Mode: MaintenanceOff})
+
+		def := getExampleDefinition()
+
+		Convey("you can pause builds, which persists across restarts", func() {
+			status, err := builder.SetMaintenance(context.Background(), MaintenancePaused)
+			So(err, ShouldBeNil)
+			So(status.Mode, ShouldEqual, MaintenancePaused)
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldEqual, ErrBuildsPaused)
+			So(ms3.Def, ShouldBeBlank)
+			So(builder.Status(), ShouldBeEmpty)
+
+			builder, err = New(conf, ms3, mwr)
+			So(err, ShouldBeNil)
+			So(builder.Maintenance().Mode, ShouldEqual, MaintenancePaused)
+
+			_, err = builder.SetMaintenance(context.Background(), MaintenanceOff)
+			So(err, ShouldBeNil)
+
+			_, err = os.Stat(maintFile)
+			So(err, ShouldNotBeNil)
+
+			builder, err = New(conf, ms3, mwr)
+			So(err, ShouldBeNil)
+			So(builder.Maintenance().Mode, ShouldEqual, MaintenanceOff)
+		})
+
+		Convey("you can drain builds, queuing new ones until you resume", func() {
+			_, err := builder.SetMaintenance(context.Background(), MaintenanceDraining)
+			So(err, ShouldBeNil)
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(ms3.Def, ShouldBeBlank)
+			So(builder.Maintenance(), ShouldResemble, MaintenanceStatus{Mode: MaintenanceDraining, Queued: 1})
+
+			statuses := builder.Status()
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].Stage(), ShouldEqual, BuildStageRequested)
+
+			status, err := builder.SetMaintenance(context.Background(), MaintenanceOff)
+			So(err, ShouldBeNil)
+			So(status.Mode, ShouldEqual, MaintenanceOff)
+			So(status.Queued, ShouldEqual, 0)
+			So(status.Running, ShouldEqual, 1)
+			So(ms3.Def, ShouldNotBeBlank)
+		})
+
+		Convey("builds queued while draining survive restarts, as they were before pre-build hooks ran", func() {
+			conf.PreBuildHooks = []config.Hook{{Name: "modify", Command: `grep -q '"Description":"changed"' && ` +
+				`{ echo "already modified"; exit 1; }; echo '{"Description":"changed"}'`}}
+
+			_, err := builder.SetMaintenance(context.Background(), MaintenanceDraining)
+			So(err, ShouldBeNil)
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(def.Description, ShouldEqual, "changed")
+
+			_, err = os.Stat(maintFile + maintenanceQueueSuffix)
+			So(err, ShouldBeNil)
+
+			builder, err = New(conf, ms3, mwr)
+			So(err, ShouldBeNil)
+			So(builder.Maintenance(), ShouldResemble, MaintenanceStatus{Mode: MaintenanceDraining, Queued: 1})
+
+			statuses := builder.Status()
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].Name, ShouldEqual, def.FullEnvironmentPath())
+
+			status, err := builder.SetMaintenance(context.Background(), MaintenanceOff)
+			So(err, ShouldBeNil)
+			So(status.Queued, ShouldEqual, 0)
+			So(status.Running, ShouldEqual, 1)
+			So(ms3.Def, ShouldNotBeBlank)
+
+			_, err = os.Stat(maintFile + maintenanceQueueSuffix)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("you can't set an unknown mode, or start with one in the file", func() {
+			_, err := builder.SetMaintenance(context.Background(), "foo")
+			So(err, ShouldEqual, ErrUnknownMaintenanceMode)
+
+			err = os.WriteFile(maintFile, []byte("foo\n"), 0600)
+			So(err, ShouldBeNil)
+
+			_, err = New(conf, ms3, mwr)
+			So(err, ShouldEqual, ErrUnknownMaintenanceMode)
+		})
+	})
+}
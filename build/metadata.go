@@ -0,0 +1,152 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// metadataFiles are the build artefacts included in Metadata.
+var metadataFiles = [...]string{core.SoftpackYaml, core.SpackLockFile} //nolint:gochecknoglobals
+
+// Metadata is the softpack.yml and spack.lock of a successfully built
+// Environment (eg. "users/foo/env-1").
+type Metadata struct {
+	Environment string
+	SoftpackYML string
+	SpackLock   string
+}
+
+// MetadataCacheDir returns the directory the Metadata of the given environment
+// (a path like "users/foo/env") and version is cached in, in the given
+// metadataCacheDir.
+func MetadataCacheDir(metadataCacheDir, envPath, version string) string {
+	return filepath.Join(metadataCacheDir, envPath, version)
+}
+
+// Metadata returns the Metadata of the given environment (a path like
+// "users/foo/env") and version. If the server metadataCacheDir is configured,
+// it is read from there, and otherwise read from the S3 build location and
+// then cached there. Returns ErrNoArtefacts if the environment hasn't been
+// successfully built.
+func (b *Builder) Metadata(ctx context.Context, envPath, version string) (*Metadata, error) {
+	if err := ValidateEnvironmentPath(envPath, version); err != nil {
+		return nil, err
+	}
+
+	files, err := b.cachedMetadataFiles(envPath, version)
+	if err != nil {
+		if files, err = b.s3MetadataFiles(ctx, envPath, version); err != nil {
+			return nil, err
+		}
+
+		b.cacheMetadata(ctx, envPath, version, files)
+	}
+
+	return &Metadata{
+		Environment: envPath + "-" + version,
+		SoftpackYML: string(files[0]),
+		SpackLock:   string(files[1]),
+	}, nil
+}
+
+// cachedMetadataFiles returns the contents of the metadataFiles of the given
+// environment in the metadataCacheDir, or ErrNoArtefacts if it isn't
+// configured or they aren't all there.
+func (b *Builder) cachedMetadataFiles(envPath, version string) ([][]byte, error) {
+	if b.config.Server.MetadataCacheDir == "" {
+		return nil, ErrNoArtefacts
+	}
+
+	dir := MetadataCacheDir(b.config.Server.MetadataCacheDir, envPath, version)
+	files := make([][]byte, len(metadataFiles))
+
+	for n, basename := range metadataFiles {
+		f, err := b.inst.fs.Open(filepath.Join(dir, basename))
+		if err != nil {
+			return nil, ErrNoArtefacts
+		}
+
+		files[n], err = io.ReadAll(f)
+		f.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// s3MetadataFiles returns the contents of the metadataFiles of the given
+// environment in the S3 build location, or ErrNoArtefacts if they aren't all
+// there.
+func (b *Builder) s3MetadataFiles(ctx context.Context, envPath, version string) ([][]byte, error) {
+	files := make([][]byte, len(metadataFiles))
+
+	for n, basename := range metadataFiles {
+		data, err := b.readS3File(ctx, filepath.Join(envPath, version, basename))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			return nil, ErrNoArtefacts
+		}
+
+		files[n] = data
+	}
+
+	return files, nil
+}
+
+// cacheMetadata writes the given contents of the metadataFiles of the given
+// environment to the metadataCacheDir, if configured, replacing any previously
+// cached. Failures are only logged, since the files can be read from S3 again.
+func (b *Builder) cacheMetadata(ctx context.Context, envPath, version string, files [][]byte) {
+	if b.config.Server.MetadataCacheDir == "" {
+		return
+	}
+
+	dir := MetadataCacheDir(b.config.Server.MetadataCacheDir, envPath, version)
+
+	err := b.inst.fs.MkdirAll(dir, dirPerms)
+
+	for n, basename := range metadataFiles {
+		if err != nil {
+			break
+		}
+
+		err = b.inst.replaceFile(bytes.NewReader(files[n]), filepath.Join(dir, basename))
+	}
+
+	if err != nil {
+		loggerFromContext(ctx).Warn("could not cache environment metadata", "dir", dir, "err", err)
+	}
+}
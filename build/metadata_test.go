@@ -0,0 +1,89 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+)
+
+func TestMetadata(t *testing.T) {
+	Convey("Given a Builder with a built environment in S3", t, func() {
+		ms3 := &mapS3{files: map[string]string{
+			"users/foo/env/1/" + core.SoftpackYaml:  "yml data",
+			"users/foo/env/1/" + core.SpackLockFile: "lock data",
+			"users/foo/env/2/" + core.SoftpackYaml:  "yml data",
+		}}
+
+		conf := &config.Config{}
+
+		builder, err := New(conf, ms3, nil)
+		So(err, ShouldBeNil)
+
+		mfs := fsmock.New()
+		builder.inst.fs = mfs
+		ctx := context.Background()
+		expected := &Metadata{Environment: "users/foo/env-1", SoftpackYML: "yml data", SpackLock: "lock data"}
+
+		Convey("you can get its softpack.yml and spack.lock", func() {
+			metadata, err := builder.Metadata(ctx, "users/foo/env", "1")
+			So(err, ShouldBeNil)
+			So(metadata, ShouldResemble, expected)
+			So(mfs.Exists("users"), ShouldBeFalse)
+		})
+
+		Convey("they are cached in and then read from the configured dir", func() {
+			conf.Server.MetadataCacheDir = "/cache"
+			cached := filepath.Join(MetadataCacheDir("/cache", "users/foo/env", "1"), core.SoftpackYaml)
+
+			metadata, err := builder.Metadata(ctx, "users/foo/env", "1")
+			So(err, ShouldBeNil)
+			So(metadata, ShouldResemble, expected)
+
+			data, err := mfs.ReadFile(cached)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "yml data")
+
+			delete(ms3.files, "users/foo/env/1/"+core.SoftpackYaml)
+
+			metadata, err = builder.Metadata(ctx, "users/foo/env", "1")
+			So(err, ShouldBeNil)
+			So(metadata, ShouldResemble, expected)
+		})
+
+		Convey("you get an error for environments that weren't successfully built", func() {
+			_, err := builder.Metadata(ctx, "users/foo/env", "2")
+			So(err, ShouldEqual, ErrNoArtefacts)
+
+			_, err = builder.Metadata(ctx, "users/foo/../env", "1")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,667 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
+)
+
+const (
+	ErrInvalidRename  = internal.Error("invalid environment rename")
+	ErrMigrationClash = internal.Error("migration destination already exists")
+)
+
+// Rename moves environments whose path is From, or is inside From, to the same
+// place in To, eg. {From: "groups/old", To: "groups/new"} moves
+// "groups/old/env" to "groups/new/env".
+type Rename struct {
+	From string
+	To   string
+}
+
+// ParseRename parses a Rename given as "from=to", eg. "groups/old=groups/new".
+func ParseRename(s string) (Rename, error) {
+	from, to, ok := strings.Cut(s, "=")
+	from, to = path.Clean(from), path.Clean(to)
+
+	if !ok || from == "." || to == "." || strings.HasPrefix(from, "/") || strings.HasPrefix(to, "/") ||
+		strings.HasPrefix(from, "..") || strings.HasPrefix(to, "..") {
+		return Rename{}, ErrInvalidRename
+	}
+
+	return Rename{From: from, To: to}, nil
+}
+
+// apply returns the given environment path renamed, and true, if it is From or
+// is inside From.
+func (r Rename) apply(envPath string) (string, bool) {
+	if envPath == r.From {
+		return r.To, true
+	}
+
+	if rest, ok := strings.CutPrefix(envPath, r.From+"/"); ok {
+		return path.Join(r.To, rest), true
+	}
+
+	return "", false
+}
+
+// Migration describes the move of an installed Environment version (eg.
+// "users/foo/env-1") to NewEnvironment in a new layout: its module file from
+// ModuleFrom to ModuleTo, rewritten to add its new scripts directory to the
+// PATH, and its scripts directory from ScriptsFrom to ScriptsTo. Module holds
+// the original module file, so that the migration can be rolled back.
+type Migration struct {
+	Environment    string
+	NewEnvironment string
+	ModuleFrom     string
+	ModuleTo       string
+	ScriptsFrom    string
+	ScriptsTo      string
+	Module         string
+}
+
+// The Steps of a Migration, in the order they are carried out.
+const (
+	MigrationStepScripts = "scripts"
+	MigrationStepModule  = "module"
+	MigrationStepCore    = "core"
+)
+
+// MigrationStep is a line of a migration journal, written before a Step of a
+// Migration is carried out. Another line, with Done set, is written once it
+// has been, and another with Undone set once it has been rolled back.
+type MigrationStep struct {
+	Step      string
+	Migration Migration
+	Done      bool `json:",omitempty"`
+	Undone    bool `json:",omitempty"`
+}
+
+// MigrationJournal lists the Migrations that were carried out, or that would
+// have been if DryRun, and the Steps of them that were started and haven't
+// been rolled back.
+type MigrationJournal struct {
+	DryRun     bool
+	Migrations []Migration
+	Steps      []MigrationStep
+}
+
+// ReadMigrationJournal reads the lines written by Migrate() and
+// RollbackMigration(), returning a journal of the steps still to be rolled
+// back.
+func ReadMigrationJournal(r io.Reader) (*MigrationJournal, error) {
+	journal := &MigrationJournal{}
+	dec := json.NewDecoder(r)
+
+	for {
+		var step MigrationStep
+
+		err := dec.Decode(&step)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		journal.record(step)
+	}
+
+	return journal, nil
+}
+
+// record updates our Steps with the given journal line. Migrations whose
+// module file has been moved are added to our Migrations.
+func (j *MigrationJournal) record(step MigrationStep) {
+	if !step.Done && !step.Undone {
+		j.Steps = append(j.Steps, step)
+
+		return
+	}
+
+	for n := len(j.Steps) - 1; n >= 0; n-- {
+		if j.Steps[n].Step != step.Step || j.Steps[n].Migration.Environment != step.Migration.Environment {
+			continue
+		}
+
+		if step.Undone {
+			j.Steps = slices.Delete(j.Steps, n, n+1)
+
+			return
+		}
+
+		j.Steps[n].Done = true
+
+		if step.Step == MigrationStepModule {
+			j.Migrations = append(j.Migrations, step.Migration)
+		}
+
+		return
+	}
+}
+
+// migrations returns the distinct Migrations of our Steps, in order.
+func (j *MigrationJournal) migrations() []Migration {
+	var migs []Migration
+
+	for _, step := range j.Steps {
+		if len(migs) == 0 || migs[len(migs)-1].Environment != step.Migration.Environment {
+			migs = append(migs, step.Migration)
+		}
+	}
+
+	return migs
+}
+
+// journaller appends lines to a migration journal, if it has a writer, and
+// records them in a MigrationJournal.
+type journaller struct {
+	enc     *json.Encoder
+	journal *MigrationJournal
+}
+
+func newJournaller(w io.Writer, journal *MigrationJournal) *journaller {
+	j := &journaller{journal: journal}
+
+	if w != nil {
+		j.enc = json.NewEncoder(w)
+	}
+
+	return j
+}
+
+func (j *journaller) write(step MigrationStep) error {
+	if j.enc != nil {
+		if err := j.enc.Encode(step); err != nil {
+			return err
+		}
+	}
+
+	j.journal.record(step)
+
+	return nil
+}
+
+// do journals the given step of the given Migration, then carries it out with
+// fn, journaling it again once it's done.
+func (j *journaller) do(step string, mig Migration, fn func() error) error {
+	if err := j.write(MigrationStep{Step: step, Migration: mig}); err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	return j.write(MigrationStep{Step: step, Migration: mig, Done: true})
+}
+
+// undo carries out fn to roll back the given step, journaling it once it has
+// been.
+func (j *journaller) undo(step MigrationStep, fn func() error) error {
+	if err := fn(); err != nil {
+		return err
+	}
+
+	step.Done, step.Undone = false, true
+
+	return j.write(step)
+}
+
+// CoreRenamer is used to tell core about environments that have been moved.
+type CoreRenamer interface {
+	Rename(ctx context.Context, path, newPath string) error
+}
+
+// installLayout is where and how a config installs environments.
+type installLayout struct {
+	conf *config.Config
+	inst *installer
+}
+
+func newInstallLayout(filesystem fsys.FS, conf *config.Config) (installLayout, error) {
+	inst, err := newInstallerFromConfig(filesystem, conf)
+
+	return installLayout{conf: conf, inst: inst}, err
+}
+
+// scriptsBase returns the directory of the scripts target the given scripts
+// directory is in, or of the n'th target if n isn't negative. Returns the
+// scriptsInstallDir if there's no such target.
+func (l installLayout) scriptsBase(scriptsDir string, n int) string {
+	targets := l.conf.ScriptsTargets()
+
+	if n < 0 {
+		n = scriptsTargetIndex(l.conf, scriptsDir)
+	}
+
+	if n < 0 || n >= len(targets) {
+		return l.conf.Module.ScriptsInstallDir
+	}
+
+	return targets[n].Dir
+}
+
+// scriptsTargetIndex returns the index of the given config's ScriptsTargets()
+// that the given scripts directory is in, or -1 if it isn't in any of them.
+func scriptsTargetIndex(conf *config.Config, scriptsDir string) int {
+	for n, target := range conf.ScriptsTargets() {
+		if isInside(scriptsDir, target.Dir) {
+			return n
+		}
+	}
+
+	return -1
+}
+
+// isInside returns true if the given path is inside dir.
+func isInside(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+
+	return err == nil && rel != "." && !strings.HasPrefix(rel, "..")
+}
+
+// layoutMigrator moves environments between the install layouts of two
+// configs.
+type layoutMigrator struct {
+	fs       fsys.FS
+	from, to installLayout
+	core     CoreRenamer
+}
+
+func newLayoutMigrator(filesystem fsys.FS, from, to *config.Config, cr CoreRenamer) (*layoutMigrator, error) {
+	fromLayout, err := newInstallLayout(filesystem, from)
+	if err != nil {
+		return nil, err
+	}
+
+	toLayout, err := newInstallLayout(filesystem, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return &layoutMigrator{fs: filesystem, from: fromLayout, to: toLayout, core: cr}, nil
+}
+
+// Migrate moves every environment installed in the from config's
+// moduleInstallDir to the layout of the to config: scripts directories are
+// moved from whichever from scripts target they are in to the corresponding to
+// target, module files are moved to the to moduleInstallDir with their PATH
+// rewritten, and default versions are updated in the module directories of
+// both. Environments are also moved to new paths by the first of the given
+// renames that applies to them, and core is told about each rename (unless
+// cr is nil).
+//
+// Nothing is changed if dryRun, or if any environment would be moved on top of
+// an existing one (returning ErrMigrationClash).
+//
+// Each step of each migration is appended to the given journal writer, if not
+// nil, before it is carried out, and again once it is done, so that
+// ReadMigrationJournal() and RollbackMigration() can undo them even if we are
+// interrupted. Also returns a journal of the migrations that were carried out,
+// even if an error is also returned.
+func Migrate(ctx context.Context, filesystem fsys.FS, from, to *config.Config, renames []Rename,
+	cr CoreRenamer, dryRun bool, w io.Writer) (*MigrationJournal, error) {
+	m, err := newLayoutMigrator(filesystem, from, to, cr)
+	if err != nil {
+		return nil, err
+	}
+
+	planned, err := m.plan(renames)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return &MigrationJournal{DryRun: true, Migrations: planned}, nil
+	}
+
+	journal := &MigrationJournal{}
+	j := newJournaller(w, journal)
+
+	for _, mig := range planned {
+		if err = m.migrate(ctx, mig, j); err != nil {
+			break
+		}
+	}
+
+	if errt := m.tidy(journal.migrations(), false); err == nil {
+		err = errt
+	}
+
+	return journal, err
+}
+
+// RollbackMigration undoes the steps in the given journal, read with
+// ReadMigrationJournal() from what Migrate() wrote with the same configs, in
+// reverse order: module files are restored to their original locations and
+// contents, scripts directories are moved back, default versions are updated,
+// and core is told to rename environments back (unless cr is nil). Steps that
+// were started but not done are undone as far as they got.
+//
+// Each step undone is appended to the given journal writer, if not nil, so
+// that an interrupted rollback can be resumed.
+func RollbackMigration(ctx context.Context, filesystem fsys.FS, from, to *config.Config,
+	journal *MigrationJournal, cr CoreRenamer, w io.Writer) error {
+	if journal.DryRun {
+		return nil
+	}
+
+	m, err := newLayoutMigrator(filesystem, from, to, cr)
+	if err != nil {
+		return err
+	}
+
+	migs := journal.migrations()
+	j := newJournaller(w, journal)
+
+	for n := len(journal.Steps) - 1; n >= 0; n-- {
+		step := journal.Steps[n]
+
+		if err = j.undo(step, func() error { return m.rollback(ctx, step) }); err != nil {
+			break
+		}
+	}
+
+	if errt := m.tidy(migs, true); err == nil {
+		err = errt
+	}
+
+	return err
+}
+
+// plan returns the Migrations needed for every installed environment that
+// would be moved, checking that none of them would clash.
+func (m *layoutMigrator) plan(renames []Rename) ([]Migration, error) {
+	envs, err := installedEnvironmentsIn(m.fs, m.from.conf.Module.ModuleInstallDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var planned []Migration
+
+	destinations := make(map[string]bool)
+
+	for _, env := range envs {
+		mig, errp := m.planEnvironment(env[0], env[1], renames)
+		if errp != nil {
+			return nil, errp
+		}
+
+		if mig.ModuleFrom == mig.ModuleTo && mig.ScriptsFrom == mig.ScriptsTo {
+			continue
+		}
+
+		if err = m.checkClash(mig, destinations); err != nil {
+			return nil, err
+		}
+
+		planned = append(planned, mig)
+	}
+
+	return planned, nil
+}
+
+func (m *layoutMigrator) planEnvironment(envPath, version string, renames []Rename) (Migration, error) {
+	newEnvPath := envPath
+
+	for _, r := range renames {
+		if renamed, ok := r.apply(envPath); ok {
+			newEnvPath = renamed
+
+			break
+		}
+	}
+
+	if err := ValidateEnvironmentPath(newEnvPath, version); err != nil {
+		return Migration{}, fmt.Errorf("%w: %s", err, newEnvPath)
+	}
+
+	dir, name := path.Split(envPath)
+	newDir, newName := path.Split(newEnvPath)
+	scriptsFrom := ScriptsDir(m.fs, m.from.conf, dir, name, version)
+	scriptsBase := m.to.scriptsBase("", scriptsTargetIndex(m.from.conf, scriptsFrom))
+
+	return Migration{
+		Environment:    envPath + "-" + version,
+		NewEnvironment: newEnvPath + "-" + version,
+		ModuleFrom:     filepath.Join(ModuleDirFromName(m.from.conf.Module.ModuleInstallDir, dir, name), version),
+		ModuleTo:       filepath.Join(ModuleDirFromName(m.to.conf.Module.ModuleInstallDir, newDir, newName), version),
+		ScriptsFrom:    scriptsFrom,
+		ScriptsTo:      ScriptsDirFromNameAndVersion(scriptsBase, newDir, newName, version),
+	}, nil
+}
+
+// checkClash returns ErrMigrationClash if the given Migration would move an
+// environment on to something that exists, or to where another planned
+// Migration is moving one.
+func (m *layoutMigrator) checkClash(mig Migration, destinations map[string]bool) error {
+	for _, move := range [...][2]string{{mig.ModuleFrom, mig.ModuleTo}, {mig.ScriptsFrom, mig.ScriptsTo}} {
+		if move[0] == move[1] {
+			continue
+		}
+
+		if m.fs.Exists(move[1]) || destinations[move[1]] {
+			return fmt.Errorf("%w: %s", ErrMigrationClash, move[1])
+		}
+
+		destinations[move[1]] = true
+	}
+
+	return nil
+}
+
+// migrate carries out the steps of the given Migration, journaling each.
+func (m *layoutMigrator) migrate(ctx context.Context, mig Migration, j *journaller) error {
+	module, err := m.readFile(mig.ModuleFrom)
+	if err != nil {
+		return err
+	}
+
+	mig.Module = module
+
+	if err = j.do(MigrationStepScripts, mig, func() error {
+		return m.move(m.to, mig.ScriptsFrom, mig.ScriptsTo, m.to.scriptsBase(mig.ScriptsTo, -1))
+	}); err != nil {
+		return err
+	}
+
+	newName := filepath.Base(filepath.Dir(mig.ModuleTo))
+
+	if err = j.do(MigrationStepModule, mig, func() error {
+		return m.replaceModule(m.to, rewriteModule(module, newName, mig.ScriptsTo), mig.ModuleFrom, mig.ModuleTo)
+	}); err != nil {
+		return err
+	}
+
+	return j.do(MigrationStepCore, mig, func() error {
+		return m.notifyCore(ctx, mig.Environment, mig.NewEnvironment)
+	})
+}
+
+// rollback undoes the given step, which may only have been partly done.
+func (m *layoutMigrator) rollback(ctx context.Context, step MigrationStep) error {
+	mig := step.Migration
+
+	switch step.Step {
+	case MigrationStepScripts:
+		if mig.ScriptsFrom == mig.ScriptsTo || !m.fs.Exists(mig.ScriptsTo) || m.fs.Exists(mig.ScriptsFrom) {
+			return nil
+		}
+
+		return m.move(m.from, mig.ScriptsTo, mig.ScriptsFrom, m.from.scriptsBase(mig.ScriptsFrom, -1))
+	case MigrationStepModule:
+		err := m.replaceModule(m.from, mig.Module, mig.ModuleTo, mig.ModuleFrom)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	case MigrationStepCore:
+		if !step.Done {
+			return nil
+		}
+
+		return m.notifyCore(ctx, mig.NewEnvironment, mig.Environment)
+	}
+
+	return nil
+}
+
+func (m *layoutMigrator) readFile(p string) (string, error) {
+	f, err := m.fs.Open(p)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := io.ReadAll(f)
+	f.Close()
+
+	return string(data), err
+}
+
+// move renames from to to, first making to's parent directories (inside base)
+// the way the given layout would. It does nothing if they are the same.
+func (m *layoutMigrator) move(layout installLayout, from, to, base string) error {
+	if from == to {
+		return nil
+	}
+
+	if err := layout.inst.makeDirectory(filepath.Dir(to), base); err != nil {
+		return err
+	}
+
+	return m.fs.Rename(from, to)
+}
+
+// replaceModule installs the given module file at path to the way the given
+// layout would, and removes the one at path from if that's different.
+func (m *layoutMigrator) replaceModule(layout installLayout, module, from, to string) error {
+	if err := layout.inst.makeDirectory(filepath.Dir(to), layout.conf.Module.ModuleInstallDir); err != nil {
+		return err
+	}
+
+	if err := layout.inst.replaceFile(strings.NewReader(module), to); err != nil {
+		return err
+	}
+
+	if from == to {
+		return nil
+	}
+
+	return m.fs.Remove(from)
+}
+
+// rewriteModule returns the given module file with the line adding its scripts
+// directory to the PATH changed to add scriptsDir, and its name changed to the
+// given one.
+func rewriteModule(module, name, scriptsDir string) string {
+	var sb strings.Builder
+
+	scanner := bufio.NewScanner(strings.NewReader(module))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "prepend-path PATH "):
+			line = `prepend-path PATH "` + tclEscape(scriptsDir) + `"`
+		case strings.HasPrefix(line, `module-whatis "Name: `):
+			line = `module-whatis "Name: ` + tclEscape(name) + `"`
+		}
+
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+func (m *layoutMigrator) notifyCore(ctx context.Context, oldEnv, newEnv string) error {
+	if m.core == nil || oldEnv == newEnv {
+		return nil
+	}
+
+	return m.core.Rename(ctx, oldEnv, newEnv)
+}
+
+// tidy updates the default versions of the module directories the given
+// Migrations moved environments out of and in to, and removes any directories
+// they left empty. If rolledBack, the Migrations were undone, so moved
+// environments the other way.
+func (m *layoutMigrator) tidy(migrations []Migration, rolledBack bool) error {
+	src, dst := m.from, m.to
+	if rolledBack {
+		src, dst = dst, src
+	}
+
+	for _, mig := range migrations {
+		moduleOut, moduleIn, scriptsOut := mig.ModuleFrom, mig.ModuleTo, mig.ScriptsFrom
+		if rolledBack {
+			moduleOut, moduleIn, scriptsOut = mig.ModuleTo, mig.ModuleFrom, mig.ScriptsTo
+		}
+
+		if err := dst.inst.updateDefaultVersion(filepath.Dir(moduleIn), dst.conf.Module.DefaultVersion); err != nil {
+			return err
+		}
+
+		if err := src.inst.updateDefaultVersion(filepath.Dir(moduleOut), src.conf.Module.DefaultVersion); err != nil {
+			return err
+		}
+
+		m.removeEmptyDirs(filepath.Dir(moduleOut), src.conf.Module.ModuleInstallDir)
+
+		if mig.ScriptsFrom != mig.ScriptsTo {
+			m.removeEmptyDirs(filepath.Dir(scriptsOut), src.scriptsBase(scriptsOut, -1))
+		}
+	}
+
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents up to, but not including, base,
+// stopping at the first that isn't empty.
+func (m *layoutMigrator) removeEmptyDirs(dir, base string) {
+	for isInside(dir, base) {
+		if err := m.fs.Remove(dir); err != nil {
+			return
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
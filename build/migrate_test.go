@@ -0,0 +1,245 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+)
+
+type mockRenamer struct {
+	renames [][2]string
+	err     error
+}
+
+func (m *mockRenamer) Rename(_ context.Context, path, newPath string) error {
+	m.renames = append(m.renames, [2]string{path, newPath})
+
+	return m.err
+}
+
+func TestMigrate(t *testing.T) {
+	Convey("ParseRename() accepts only relative old=new paths", t, func() {
+		r, err := ParseRename("groups/old=groups/new/")
+		So(err, ShouldBeNil)
+		So(r, ShouldResemble, Rename{From: "groups/old", To: "groups/new"})
+
+		for _, bad := range []string{"groups/old", "=groups/new", "/groups/old=groups/new", "groups/old=../new"} {
+			_, err = ParseRename(bad)
+			So(err, ShouldEqual, ErrInvalidRename)
+		}
+	})
+
+	Convey("Given environments installed in an old layout", t, func() {
+		mfs := fsmock.New()
+		inst := newInstaller(mfs)
+		ctx := context.Background()
+
+		var from, to config.Config
+		from.Module.ModuleInstallDir = "/old/modules"
+		from.Module.ScriptsInstallDir = "/old/scripts"
+		from.Module.DefaultVersion = config.DefaultVersionTcl
+		to.Module.ModuleInstallDir = "/new/modules"
+		to.Module.ScriptsInstallDir = "/new/scripts"
+		to.Module.DefaultVersion = config.DefaultVersionTcl
+
+		for _, env := range [][2]string{{"groups/old/xxhash", "1"}, {"groups/old/xxhash", "2"}, {"users/foo/env", "1"}} {
+			dir, name := filepath.Split(env[0])
+			scriptsDir := ScriptsDirFromNameAndVersion(from.Module.ScriptsInstallDir, dir, name, env[1])
+			moduleDir := ModuleDirFromName(from.Module.ModuleInstallDir, dir, name)
+
+			So(mfs.MkdirAll(scriptsDir, dirPerms), ShouldBeNil)
+			So(mfs.MkdirAll(moduleDir, dirPerms), ShouldBeNil)
+			So(inst.installFile(strings.NewReader("image"), filepath.Join(scriptsDir, "singularity.sif")), ShouldBeNil)
+			So(inst.installFile(strings.NewReader("#%Module\n\nmodule-whatis \"Name: "+name+"\"\n\n"+
+				"prepend-path PATH \""+scriptsDir+"\"\n"), filepath.Join(moduleDir, env[1])), ShouldBeNil)
+			So(inst.updateDefaultVersion(moduleDir, config.DefaultVersionTcl), ShouldBeNil)
+		}
+
+		renames := []Rename{{From: "groups/old", To: "groups/new"}}
+		cr := new(mockRenamer)
+
+		Convey("a dry run lists the moves without making them", func() {
+			journal, err := Migrate(ctx, mfs, &from, &to, renames, cr, true, nil)
+			So(err, ShouldBeNil)
+			So(journal.DryRun, ShouldBeTrue)
+			So(len(journal.Migrations), ShouldEqual, 3)
+			So(journal.Migrations[0], ShouldResemble, Migration{
+				Environment:    "groups/old/xxhash-1",
+				NewEnvironment: "groups/new/xxhash-1",
+				ModuleFrom:     "/old/modules/groups/old/xxhash/1",
+				ModuleTo:       "/new/modules/groups/new/xxhash/1",
+				ScriptsFrom:    "/old/scripts/groups/old/xxhash/1-scripts",
+				ScriptsTo:      "/new/scripts/groups/new/xxhash/1-scripts",
+			})
+			So(journal.Migrations[2].NewEnvironment, ShouldEqual, "users/foo/env-1")
+			So(mfs.Exists("/old/modules/groups/old/xxhash/1"), ShouldBeTrue)
+			So(mfs.Exists("/new/modules"), ShouldBeFalse)
+			So(cr.renames, ShouldBeNil)
+		})
+
+		Convey("environments can be migrated and rolled back", func() {
+			var lines bytes.Buffer
+
+			journal, err := Migrate(ctx, mfs, &from, &to, renames, cr, false, &lines)
+			So(err, ShouldBeNil)
+			So(len(journal.Migrations), ShouldEqual, 3)
+			So(cr.renames, ShouldResemble, [][2]string{
+				{"groups/old/xxhash-1", "groups/new/xxhash-1"},
+				{"groups/old/xxhash-2", "groups/new/xxhash-2"},
+			})
+
+			data, err := mfs.ReadFile("/new/modules/groups/new/xxhash/2")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "#%Module\n\nmodule-whatis \"Name: xxhash\"\n\n"+
+				"prepend-path PATH \"/new/scripts/groups/new/xxhash/2-scripts\"\n")
+
+			data, err = mfs.ReadFile("/new/modules/groups/new/xxhash/.version")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "#%Module1.0\nset ModulesVersion \"2\"\n")
+
+			So(mfs.Exists("/new/scripts/groups/new/xxhash/1-scripts/singularity.sif"), ShouldBeTrue)
+			So(mfs.Exists("/new/modules/users/foo/env/1"), ShouldBeTrue)
+			So(mfs.Exists("/old/modules/groups"), ShouldBeFalse)
+			So(mfs.Exists("/old/scripts/groups"), ShouldBeFalse)
+			So(mfs.Exists("/old/modules"), ShouldBeTrue)
+
+			cr.renames = nil
+
+			journal, err = ReadMigrationJournal(bytes.NewReader(lines.Bytes()))
+			So(err, ShouldBeNil)
+			So(len(journal.Migrations), ShouldEqual, 3)
+			So(len(journal.Steps), ShouldEqual, 9)
+			So(journal.Steps[0].Step, ShouldEqual, MigrationStepScripts)
+			So(journal.Steps[0].Done, ShouldBeTrue)
+			So(journal.Steps[0].Migration.Module, ShouldContainSubstring, "#%Module")
+
+			err = RollbackMigration(ctx, mfs, &from, &to, journal, cr, &lines)
+			So(err, ShouldBeNil)
+			So(journal.Steps, ShouldBeEmpty)
+			So(cr.renames, ShouldResemble, [][2]string{
+				{"groups/new/xxhash-2", "groups/old/xxhash-2"},
+				{"groups/new/xxhash-1", "groups/old/xxhash-1"},
+			})
+
+			data, err = mfs.ReadFile("/old/modules/groups/old/xxhash/2")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, "prepend-path PATH \"/old/scripts/groups/old/xxhash/2-scripts\"")
+			So(mfs.Exists("/old/modules/groups/old/xxhash/.version"), ShouldBeTrue)
+			So(mfs.Exists("/old/scripts/groups/old/xxhash/2-scripts/singularity.sif"), ShouldBeTrue)
+			So(mfs.Exists("/new/modules/groups"), ShouldBeFalse)
+			So(mfs.Exists("/new/scripts/users"), ShouldBeFalse)
+
+			journal, err = ReadMigrationJournal(&lines)
+			So(err, ShouldBeNil)
+			So(journal.Steps, ShouldBeEmpty)
+		})
+
+		Convey("environments just being renamed stay in the same layout", func() {
+			journal, err := Migrate(ctx, mfs, &from, &from, renames, nil, false, nil)
+			So(err, ShouldBeNil)
+			So(len(journal.Migrations), ShouldEqual, 2)
+			So(mfs.Exists("/old/modules/groups/new/xxhash/1"), ShouldBeTrue)
+			So(mfs.Exists("/old/modules/groups/old"), ShouldBeFalse)
+			So(mfs.Exists("/old/modules/users/foo/env/1"), ShouldBeTrue)
+		})
+
+		Convey("nothing is moved if an environment would clash", func() {
+			So(mfs.MkdirAll("/new/scripts/users/foo/env/1-scripts", dirPerms), ShouldBeNil)
+
+			journal, err := Migrate(ctx, mfs, &from, &to, renames, cr, false, nil)
+			So(errors.Is(err, ErrMigrationClash), ShouldBeTrue)
+			So(journal, ShouldBeNil)
+			So(mfs.Exists("/old/modules/groups/old/xxhash/1"), ShouldBeTrue)
+
+			_, err = Migrate(ctx, mfs, &from, &to, []Rename{{From: "users/foo/env", To: "groups/old/xxhash"}}, cr, false,
+				nil)
+			So(errors.Is(err, ErrMigrationClash), ShouldBeTrue)
+		})
+
+		Convey("a failure to notify core is returned with the journal so far", func() {
+			cr.err = errors.New("core down") //nolint:goerr113
+
+			var lines bytes.Buffer
+
+			journal, err := Migrate(ctx, mfs, &from, &to, renames, cr, false, &lines)
+			So(err, ShouldEqual, cr.err)
+			So(len(journal.Migrations), ShouldEqual, 1)
+			So(mfs.Exists("/new/modules/groups/new/xxhash/.version"), ShouldBeTrue)
+			So(mfs.Exists("/old/modules/groups/old/xxhash/2"), ShouldBeTrue)
+
+			Convey("and the unfinished core step isn't undone on rollback", func() {
+				cr.err = nil
+
+				journal, err = ReadMigrationJournal(&lines)
+				So(err, ShouldBeNil)
+				So(len(journal.Steps), ShouldEqual, 3)
+				So(journal.Steps[2].Done, ShouldBeFalse)
+
+				So(RollbackMigration(ctx, mfs, &from, &to, journal, cr, nil), ShouldBeNil)
+				So(cr.renames, ShouldResemble, [][2]string{{"groups/old/xxhash-1", "groups/new/xxhash-1"}})
+				So(mfs.Exists("/old/modules/groups/old/xxhash/1"), ShouldBeTrue)
+				So(mfs.Exists("/old/scripts/groups/old/xxhash/1-scripts/singularity.sif"), ShouldBeTrue)
+				So(mfs.Exists("/new/modules/groups"), ShouldBeFalse)
+			})
+		})
+
+		Convey("a failure part way through a migration is journaled, and can be rolled back", func() {
+			So(mfs.MkdirAll("/new/modules/groups/new", dirPerms), ShouldBeNil)
+			So(inst.installFile(strings.NewReader("not a dir"), "/new/modules/groups/new/xxhash"), ShouldBeNil)
+
+			var lines bytes.Buffer
+
+			_, err := Migrate(ctx, mfs, &from, &to, renames, nil, false, &lines)
+			So(err, ShouldNotBeNil)
+			So(mfs.Exists("/new/scripts/groups/new/xxhash/1-scripts"), ShouldBeTrue)
+			So(mfs.Exists("/old/scripts/groups/old/xxhash/1-scripts"), ShouldBeFalse)
+
+			journal, err := ReadMigrationJournal(&lines)
+			So(err, ShouldBeNil)
+			So(len(journal.Steps), ShouldEqual, 2)
+			So(journal.Steps[0].Done, ShouldBeTrue)
+			So(journal.Steps[1].Step, ShouldEqual, MigrationStepModule)
+			So(journal.Steps[1].Done, ShouldBeFalse)
+			So(journal.Migrations, ShouldBeEmpty)
+
+			So(mfs.Remove("/new/modules/groups/new/xxhash"), ShouldBeNil)
+			So(RollbackMigration(ctx, mfs, &from, &to, journal, nil, nil), ShouldBeNil)
+			So(mfs.Exists("/old/scripts/groups/old/xxhash/1-scripts/singularity.sif"), ShouldBeTrue)
+			So(mfs.Exists("/new/scripts/groups"), ShouldBeFalse)
+
+			data, err := mfs.ReadFile("/old/modules/groups/old/xxhash/1")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, "/old/scripts/groups/old/xxhash/1-scripts")
+		})
+	})
+}
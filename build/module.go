@@ -26,10 +26,14 @@ package build
 import (
 	_ "embed"
 	"path/filepath"
+	"slices"
 	"strings"
 	"text/template"
 )
 
+// deprecationMarker starts the deprecation warning appended to module files.
+const deprecationMarker = "\n# Deprecated by gsb"
+
 //go:embed module.tmpl
 var moduleTmplStr string
 var moduleTmpl *template.Template //nolint:gochecknoglobals
@@ -38,15 +42,28 @@ var moduleTmpl *template.Template //nolint:gochecknoglobals
 var usageTmplStr string
 var usageTmpl *template.Template //nolint:gochecknoglobals
 
+//go:embed usagewrapper.tmpl
+var usageWrapperTmplStr string
+var usageWrapperTmpl *template.Template //nolint:gochecknoglobals
+
+//go:embed wrapper.tmpl
+var wrapperTmplStr string
+var wrapperTmpl *template.Template //nolint:gochecknoglobals
+
 func init() { //nolint:gochecknoinits
-	moduleTmpl = template.Must(template.New("").Parse(moduleTmplStr))
+	moduleTmpl = template.Must(template.New("").Funcs(template.FuncMap{"tcl": tclEscape}).Parse(moduleTmplStr))
 	usageTmpl = template.Must(template.New("").Parse(usageTmplStr))
+	usageWrapperTmpl = template.Must(template.New("").Parse(usageWrapperTmplStr))
+	wrapperTmpl = template.Must(template.New("").Parse(wrapperTmplStr))
 }
 
 // ToModule creates a tcl module based on our packages, and uses installDir to
 // prepend a PATH for the exe wrapper scripts that will be at the installed
 // location of the module. Any supplied module dependencies will be module
-// loaded.
+// loaded, and our Conflicts and Prereqs declared.
+//
+// Our Description becomes the module help, with markdown formatting stripped,
+// long lines wrapped, and tcl special characters escaped.
 func (d *Definition) ToModule(installDir string, deps, exes []string) string {
 	var sb strings.Builder
 
@@ -60,21 +77,90 @@ func (d *Definition) ToModule(installDir string, deps, exes []string) string {
 		InstallDir:   installDir,
 		Dependencies: deps,
 		Definition:   d,
-		Description:  strings.Split(d.Description, "\n"),
-		Exes:         exes,
+		Description:  moduleHelpLines(d.Description),
+		Exes:         tclEscapeAll(exes),
 	})
 
 	return sb.String()
 }
 
+// mergeModuleNames returns the given configured module names followed by any of
+// the requested ones that aren't configured, without duplicates.
+func mergeModuleNames(configured, requested []string) []string {
+	var merged []string
+
+	for _, name := range append(slices.Clone(configured), requested...) {
+		if !slices.Contains(merged, name) {
+			merged = append(merged, name)
+		}
+	}
+
+	return merged
+}
+
 // ModuleUsage returns a markdown formatted usage that tells a user to module
-// load our environment installed in the given loadPath.
-func (d *Definition) ModuleUsage(loadPath string) string {
-	var sb strings.Builder
+// load our environment installed in the given loadPath. If kernelsDir isn't
+// blank, it also describes any Jupyter kernels we provide that were installed
+// there. If completionsDir isn't blank, it also says how to get shell
+// completion using the scripts installed there.
+func (d *Definition) ModuleUsage(loadPath, kernelsDir, completionsDir string) string {
+	return d.moduleUsage(loadPath, kernelsDir, completionsDir, false, "")
+}
+
+// DeprecatedModuleUsage is like ModuleUsage(), but also says that the
+// environment is deprecated, suggesting the given replacement environment if
+// not blank.
+func (d *Definition) DeprecatedModuleUsage(loadPath, kernelsDir, completionsDir, replacement string) string {
+	return d.moduleUsage(loadPath, kernelsDir, completionsDir, true, replacement)
+}
+
+func (d *Definition) moduleUsage(loadPath, kernelsDir, completionsDir string, deprecated bool,
+	replacement string) string {
+	var (
+		sb      strings.Builder
+		kernels []KernelSpec
+	)
+
+	if kernelsDir != "" {
+		kernels = d.KernelSpecs("")
+	}
 
-	usageTmpl.Execute(&sb, filepath.Join( //nolint:errcheck
-		loadPath, d.EnvironmentPath, d.EnvironmentName, d.EnvironmentVersion,
-	))
+	usageTmpl.Execute(&sb, struct { //nolint:errcheck
+		Path        string
+		Deprecated  bool
+		Replacement string
+		Kernels     []KernelSpec
+		KernelsDir  string
+		JupyterPath string
+		Completion  string
+	}{
+		Path:        filepath.Join(loadPath, d.EnvironmentPath, d.EnvironmentName, d.EnvironmentVersion),
+		Deprecated:  deprecated,
+		Replacement: replacement,
+		Kernels:     kernels,
+		KernelsDir:  kernelsDir,
+		JupyterPath: filepath.Dir(kernelsDir),
+		Completion:  completionsDir,
+	})
 
 	return sb.String()
 }
+
+// ModuleDeprecationWarning returns tcl to append to a module file that prints a
+// warning when the module is loaded, saying that this environment is deprecated
+// and suggesting the given replacement environment if not blank.
+func (d *Definition) ModuleDeprecationWarning(replacement string) string {
+	warning := "WARNING: " + d.FullEnvironmentPath() + " is deprecated"
+	if replacement != "" {
+		warning += "; please use " + replacement + " instead"
+	}
+
+	warning = tclEscape(warning)
+
+	return deprecationMarker + `
+if { [module-info mode load] } {
+	puts stderr "` + warning + `."
+}
+module-whatis "Deprecated: ` + strings.TrimPrefix(warning, "WARNING: ") + `"
+`
+}
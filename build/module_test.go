@@ -28,6 +28,7 @@ import (
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
 )
 
 func TestModule(t *testing.T) {
@@ -65,6 +66,45 @@ prepend-path PATH "%s/%s/%s/%s-scripts"
 `, def.Description, def.EnvironmentName, def.EnvironmentVersion,
 			moduleDependencies, installDir, def.EnvironmentPath,
 			def.EnvironmentName, def.EnvironmentVersion))
+
+		def.Conflicts = []string{"openmpi", "mpich"}
+		def.Prereqs = []string{"cuda/12.2"}
+		So(def.ToModule(installDir, []string{moduleDependencies}, nil), ShouldContainSubstring, `
+module load `+moduleDependencies+`
+conflict openmpi
+conflict mpich
+prereq cuda/12.2
+
+prepend-path PATH`)
+
+		def.ProcessorTarget = "x86_64_v4"
+		So(def.ToModule(installDir, nil, []string{"xxhsum"}), ShouldContainSubstring, `	puts stderr "  - xxhsum"
+	puts stderr ""
+	puts stderr "Built for the x86_64_v4 processor target; on older CPUs, programs may"
+	puts stderr "crash with \"Illegal instruction\" (SIGILL)."
+}`)
+	})
+
+	Convey("Values substituted into module files have tcl special characters escaped", t, func() {
+		def := getExampleDefinition()
+		def.Packages = core.Packages{{Name: "x[exec rm -rf /]", Version: `1"$HOME`}}
+		def.ProcessorTarget = "x86_64_v4[exec reboot]"
+
+		module := def.ToModule(`/opt/$dir`, []string{"dep[exec id]"}, []string{`exe"`})
+		So(module, ShouldContainSubstring, `module-whatis "Packages: x\[exec rm -rf /\]@1\"\$HOME"`)
+		So(module, ShouldContainSubstring, `Built for the x86_64_v4\[exec reboot\] processor`)
+		So(module, ShouldContainSubstring, `module load dep\[exec id\]`)
+		So(module, ShouldContainSubstring, `puts stderr "  - exe\""`)
+		So(module, ShouldContainSubstring, `prepend-path PATH "/opt/\$dir/`)
+
+		warning := def.ModuleDeprecationWarning(`users/foo/bar"[exec reboot]`)
+		So(warning, ShouldContainSubstring, `please use users/foo/bar\"\[exec reboot\] instead.`)
+	})
+
+	Convey("Configured module names are merged with requested ones", t, func() {
+		So(mergeModuleNames(nil, nil), ShouldBeNil)
+		So(mergeModuleNames([]string{"openmpi", "mpich"}, []string{"mpich", "intel-mpi"}),
+			ShouldResemble, []string{"openmpi", "mpich", "intel-mpi"})
 	})
 
 	Convey("Given a Definition, you can generate a Usage for a module file", t, func() {
@@ -72,7 +112,7 @@ prepend-path PATH "%s/%s/%s/%s-scripts"
 		moduleLoadPath := "HGI/softpack"
 
 		def := getExampleDefinition()
-		usageFileData := def.ModuleUsage(moduleLoadPath)
+		usageFileData := def.ModuleUsage(moduleLoadPath, "/path/to/jupyter/kernels", "")
 		So(usageFileData, ShouldEqual, `# Usage
 
 To use this environment, run:
@@ -88,5 +128,27 @@ running:
 `+"```"+`
 module help HGI/softpack/groups/hgi/xxhash/0.8.1
 `+"```\n")
+
+		Convey("which describes any Jupyter kernels it provides", func() {
+			def.Packages = append(def.Packages, core.Package{Name: "py-ipykernel"})
+
+			usageFileData = def.ModuleUsage(moduleLoadPath, "/path/to/jupyter/kernels", "")
+			So(usageFileData, ShouldEndWith, "module help HGI/softpack/groups/hgi/xxhash/0.8.1\n"+"```"+`
+
+## Jupyter kernels
+
+This environment provides the following Jupyter kernels, which are available in
+JupyterHub and any other Jupyter configured to use /path/to/jupyter/kernels:
+
+- groups/hgi/xxhash-0.8.1 (Python)
+
+To make them available to your own Jupyter installation, run:
+
+`+"```"+`
+export JUPYTER_PATH=/path/to/jupyter:$JUPYTER_PATH
+`+"```\n")
+
+			So(def.ModuleUsage(moduleLoadPath, "", ""), ShouldNotContainSubstring, "Jupyter")
+		})
 	})
 }
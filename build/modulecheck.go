@@ -0,0 +1,337 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const ErrInvalidModule = internal.Error("generated module file is invalid")
+
+// moduleValidateTimeout is how long module.validateCommand gets to check a
+// module file.
+const moduleValidateTimeout = time.Minute
+
+// validateModule checks the given module file contents are valid tcl before we
+// install them, first with checkTclSyntax(), then by running any configured
+// module.validateCommand. Invalid modules result in an error that Is()
+// ErrInvalidModule and says what was wrong.
+func (b *Builder) validateModule(ctx context.Context, module string) error {
+	if err := checkTclSyntax(module); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidModule, err)
+	}
+
+	if b.config.Module.ValidateCommand == "" {
+		return nil
+	}
+
+	out, err := runModuleValidateCommand(ctx, b.config.Module.ValidateCommand, module)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %s", ErrInvalidModule, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// runModuleValidateCommand runs the given shell command with the given module
+// file contents on its stdin, and written to a temporary file whose path is in
+// $GSB_MODULE_FILE, returning its combined output.
+func runModuleValidateCommand(ctx context.Context, command, module string) ([]byte, error) {
+	f, err := os.CreateTemp("", "gsb-module-*")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err = f.WriteString(module); err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, moduleValidateTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = strings.NewReader(module)
+	cmd.Env = append(os.Environ(), "GSB_MODULE_FILE="+f.Name())
+
+	return cmd.CombinedOutput()
+}
+
+// checkTclSyntax parses the given tcl script the way tclsh would, without
+// running it, returning an error naming the line of the first syntax problem,
+// such as unbalanced braces, brackets or quotes, or extra characters after a
+// close-brace or close-quote. Unlike tclsh, the contents of braced words are
+// also checked as scripts, since in module files they are proc and if bodies.
+func checkTclSyntax(script string) error {
+	c := &tclChecker{s: script}
+
+	return c.script(false)
+}
+
+// tclChecker parses tcl in s, from pos.
+type tclChecker struct {
+	s   string
+	pos int
+}
+
+func (c *tclChecker) errorf(at int, msg string) error {
+	return fmt.Errorf("line %d: %s", strings.Count(c.s[:at], "\n")+1, msg) //nolint:err113
+}
+
+func (c *tclChecker) done() bool {
+	return c.pos >= len(c.s)
+}
+
+func (c *tclChecker) peek() byte {
+	return c.s[c.pos]
+}
+
+// escapedNewline returns true if we're at a backslash-newline, which separates
+// words like a space.
+func (c *tclChecker) escapedNewline() bool {
+	return c.peek() == '\\' && c.pos+1 < len(c.s) && c.s[c.pos+1] == '\n'
+}
+
+// skip moves past any of the given separator characters, and backslash-
+// newlines.
+func (c *tclChecker) skip(separators string) {
+	for !c.done() {
+		switch {
+		case c.escapedNewline():
+			c.pos += 2
+		case strings.IndexByte(separators, c.peek()) >= 0:
+			c.pos++
+		default:
+			return
+		}
+	}
+}
+
+// script parses commands until the end of s, or until and including a
+// close-bracket if nested in a command substitution.
+func (c *tclChecker) script(nested bool) error {
+	start := c.pos
+
+	for {
+		c.skip(" \t\r\n;")
+
+		switch {
+		case c.done() && nested:
+			return c.errorf(start, "missing close-bracket")
+		case c.done():
+			return nil
+		case nested && c.peek() == ']':
+			c.pos++
+
+			return nil
+		case c.peek() == '#':
+			c.comment()
+		default:
+			if err := c.command(nested); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// comment moves past a comment, which may be continued with backslash-newlines.
+func (c *tclChecker) comment() {
+	for !c.done() && c.peek() != '\n' {
+		if c.peek() == '\\' {
+			c.pos++
+		}
+
+		c.pos++
+	}
+}
+
+// command parses the words of a command, up to the newline, semicolon or (if
+// nested) close-bracket that ends it.
+func (c *tclChecker) command(nested bool) error {
+	for {
+		c.skip(" \t\r")
+
+		if c.done() || c.atCommandEnd(nested) {
+			return nil
+		}
+
+		if err := c.word(nested); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *tclChecker) atCommandEnd(nested bool) bool {
+	switch c.peek() {
+	case '\n', ';':
+		return true
+	case ']':
+		return nested
+	}
+
+	return false
+}
+
+func (c *tclChecker) atWordEnd(nested bool) bool {
+	return c.done() || c.escapedNewline() || strings.IndexByte(" \t\r", c.peek()) >= 0 || c.atCommandEnd(nested)
+}
+
+func (c *tclChecker) word(nested bool) error {
+	var (
+		kind string
+		err  error
+	)
+
+	switch c.peek() {
+	case '{':
+		kind, err = "close-brace", c.braced()
+	case '"':
+		kind, err = "close-quote", c.quoted()
+	default:
+		return c.bare(nested)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !c.atWordEnd(nested) {
+		return c.errorf(c.pos, "extra characters after "+kind)
+	}
+
+	return nil
+}
+
+// braced parses a braced word, checking its contents as a script.
+func (c *tclChecker) braced() error {
+	start := c.pos
+	depth := 0
+
+	for ; !c.done(); c.pos++ {
+		switch c.peek() {
+		case '\\':
+			c.pos++
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+
+		if depth == 0 {
+			body := &tclChecker{s: c.s[:c.pos], pos: start + 1}
+			c.pos++
+
+			return body.script(false)
+		}
+	}
+
+	return c.errorf(start, "missing close-brace")
+}
+
+// quoted parses a double quoted word, checking any command substitutions in
+// it.
+func (c *tclChecker) quoted() error {
+	start := c.pos
+	c.pos++
+
+	for !c.done() {
+		switch c.peek() {
+		case '"':
+			c.pos++
+
+			return nil
+		case '[':
+			c.pos++
+
+			if err := c.script(true); err != nil {
+				return err
+			}
+
+			continue
+		case '$':
+			c.variable()
+
+			continue
+		case '\\':
+			c.pos++
+		}
+
+		c.pos++
+	}
+
+	return c.errorf(start, "missing \"")
+}
+
+// bare parses an unquoted word, checking any command substitutions in it.
+func (c *tclChecker) bare(nested bool) error {
+	for !c.atWordEnd(nested) {
+		switch c.peek() {
+		case '[':
+			c.pos++
+
+			if err := c.script(true); err != nil {
+				return err
+			}
+
+			continue
+		case '$':
+			c.variable()
+
+			continue
+		case '\\':
+			c.pos++
+		}
+
+		c.pos++
+	}
+
+	return nil
+}
+
+// variable moves past a $ and, for ${name} variables, their braced name.
+func (c *tclChecker) variable() {
+	c.pos++
+
+	if c.done() || c.peek() != '{' {
+		return
+	}
+
+	if end := strings.IndexByte(c.s[c.pos:], '}'); end >= 0 {
+		c.pos += end + 1
+	}
+}
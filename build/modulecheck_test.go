@@ -0,0 +1,99 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+)
+
+func TestModuleValidation(t *testing.T) {
+	Convey("Generated module files have valid tcl syntax", t, func() {
+		def := getExampleDefinition()
+		def.Description = "Some {unbalanced\" [help] $text with \\ in it;\n\n* and a list } item"
+		def.Conflicts = []string{"foo/1.0"}
+		def.ProcessorTarget = "x86_64_v4"
+
+		module := def.ToModule("/path/to/scripts", []string{"dep/1"}, []string{"xxh[sum", "exe\"2"})
+		So(checkTclSyntax(module), ShouldBeNil)
+		So(checkTclSyntax(module+def.ModuleDeprecationWarning("groups/hgi/xxhash-2")), ShouldBeNil)
+	})
+
+	Convey("Invalid tcl syntax is reported with its line", t, func() {
+		for script, msg := range map[string]string{
+			"#%Module\nproc ModulesHelp { } {\n\tputs stderr \"help\"\n": "line 2: missing close-brace",
+			"#%Module\nproc ModulesHelp { } {\n\tputs stderr \"help}\n":  "line 3: missing \"",
+			"module-whatis \"Name: \"foo\"\n":                            "line 1: extra characters after close-quote",
+			"module-whatis \"a\"\nif { [module-info mode load }\n":       "line 2: missing close-bracket",
+			"proc ModulesHelp { } {\n\tputs stderr \"x\"y\n}\n":          "line 2: extra characters after close-quote",
+			"conflict {foo}bar\n":                                        "line 1: extra characters after close-brace",
+			"module-whatis \"Version: [string length x\"\n":              "line 1: missing close-bracket",
+		} {
+			err := checkTclSyntax(script)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, msg)
+		}
+
+		for _, script := range []string{
+			"# a comment with { and \" in it\nputs ok\n",
+			"set a \\\n\tb; puts ${a}\n",
+			"puts [string map {\"\\{\" x} \"{\"]\n",
+			"puts \"]\"\n",
+		} {
+			So(checkTclSyntax(script), ShouldBeNil)
+		}
+	})
+
+	Convey("Given a Builder, modules are validated before being installed", t, func() {
+		var conf config.Config
+
+		builder, err := New(&conf, &mapS3{}, nil)
+		So(err, ShouldBeNil)
+
+		ctx := context.Background()
+		module := getExampleDefinition().ToModule("/path/to/scripts", nil, []string{"xxhsum"})
+
+		So(builder.validateModule(ctx, module), ShouldBeNil)
+
+		err = builder.validateModule(ctx, module+"\nputs \"oops\n")
+		So(err, ShouldWrap, ErrInvalidModule)
+		So(err.Error(), ShouldEndWith, "missing \"")
+
+		Convey("using a configured command", func() {
+			conf.Module.ValidateCommand = `grep -q "^#%Module" "$GSB_MODULE_FILE" && grep -q xxhsum`
+
+			So(builder.validateModule(ctx, module), ShouldBeNil)
+
+			conf.Module.ValidateCommand = `echo "invalid command name \"puts2\""; exit 1`
+
+			err = builder.validateModule(ctx, module)
+			So(err, ShouldWrap, ErrInvalidModule)
+			So(err.Error(), ShouldStartWith, ErrInvalidModule.Error()+": exit status 1: ")
+			So(err.Error(), ShouldEndWith, "invalid command name \"puts2\"")
+		})
+	})
+}
@@ -0,0 +1,220 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const ErrNoVersionsFile = internal.Error("no spack versionsFile configured")
+
+// Upgrade describes a package in an environment that has a newer version
+// available than the one it was built with.
+type Upgrade struct {
+	Name    string
+	Version string
+	Latest  string
+}
+
+// packageVersions is an entry in the output of
+// `spack list --format version_json`.
+type packageVersions struct {
+	Name     string   `json:"name"`
+	Versions []string `json:"versions"`
+}
+
+// Outdated returns the root packages of the given environment (a path like
+// "users/foo/env", as per StatusDetail()) and version, that have a newer
+// version available in the configured spack versionsFile than the one in the
+// environment's spack.lock. Returns ErrNoVersionsFile if there's no
+// versionsFile configured, or an error wrapping ErrNoArtefacts if the
+// environment has no spack.lock.
+func (b *Builder) Outdated(ctx context.Context, envPath, version string) ([]Upgrade, error) {
+	if err := ValidateEnvironmentPath(envPath, version); err != nil {
+		return nil, err
+	}
+
+	if b.config.Spack.VersionsFile == "" {
+		return nil, ErrNoVersionsFile
+	}
+
+	roots, err := b.rootPackages(ctx, filepath.Join(envPath, version))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, fmt.Errorf("%w: %w", ErrNoArtefacts, err)
+	}
+
+	latest, err := b.latestVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	return outdatedRoots(roots, latest), nil
+}
+
+// outdatedRoots returns an Upgrade for each of the given roots that has a newer
+// version in the given latest versions.
+func outdatedRoots(roots []ConcreteSpec, latest map[string]string) []Upgrade {
+	upgrades := []Upgrade{}
+
+	for _, root := range roots {
+		newest, ok := latest[root.Name]
+		if ok && compareVersions(newest, root.Version) > 0 {
+			upgrades = append(upgrades, Upgrade{Name: root.Name, Version: root.Version, Latest: newest})
+		}
+	}
+
+	return upgrades
+}
+
+// latestVersions reads the configured versionsFile and returns the newest
+// release version of each package in it. Branch versions like "develop" are
+// ignored.
+func (b *Builder) latestVersions() (map[string]string, error) {
+	f, err := b.inst.fs.Open(b.config.Spack.VersionsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var pkgs []packageVersions
+
+	if err = json.NewDecoder(f).Decode(&pkgs); err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]string, len(pkgs))
+
+	for _, pkg := range pkgs {
+		for _, v := range pkg.Versions {
+			if !strings.ContainsFunc(v, unicode.IsDigit) {
+				continue
+			}
+
+			if current, ok := latest[pkg.Name]; !ok || compareVersions(v, current) > 0 {
+				latest[pkg.Name] = v
+			}
+		}
+	}
+
+	return latest, nil
+}
+
+// compareVersions compares spack-style versions a and b component by
+// component, returning -1, 0 or 1 if a is older than, the same as or newer
+// than b. Numeric components compare numerically and are newer than
+// non-numeric ones, and a version is older than any longer version it is a
+// prefix of.
+func compareVersions(a, b string) int {
+	as, bs := versionComponents(a), versionComponents(b)
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := compareVersionComponents(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func versionComponents(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == '.' || r == '-' || r == '_'
+	})
+}
+
+func compareVersionComponents(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareOrdered(an, bn)
+	case aErr == nil:
+		return 1
+	case bErr == nil:
+		return -1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+func compareOrdered(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// rootPackages returns the concrete specs of the root packages in the
+// spack.lock file of the build at the given s3Path.
+func (b *Builder) rootPackages(ctx context.Context, s3Path string) ([]ConcreteSpec, error) {
+	lockData, err := b.readS3File(ctx, filepath.Join(s3Path, core.SpackLockFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var sl SpackLock
+
+	if err = json.Unmarshal(lockData, &sl); err != nil {
+		return nil, err
+	}
+
+	roots := make([]ConcreteSpec, 0, len(sl.Roots))
+
+	for _, root := range sl.Roots {
+		concrete, ok := sl.ConcreteSpecs[root.Hash]
+		if !ok {
+			return nil, ErrInvalidJSON
+		}
+
+		roots = append(roots, concrete)
+	}
+
+	return roots, nil
+}
@@ -0,0 +1,90 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestOutdated(t *testing.T) {
+	Convey("Versions can be compared", t, func() {
+		for _, test := range [...]struct {
+			a, b     string
+			expected int
+		}{
+			{"1.2.3", "1.2.3", 0},
+			{"1.10", "1.9", 1},
+			{"1.2", "1.2.1", -1},
+			{"2024-01-02", "2023-12-31", 1},
+			{"1.0", "1.0rc1", 1},
+			{"1.0a", "1.0b", -1},
+		} {
+			So(compareVersions(test.a, test.b), ShouldEqual, test.expected)
+			So(compareVersions(test.b, test.a), ShouldEqual, -test.expected)
+		}
+	})
+
+	Convey("Given a Builder and a built environment", t, func() {
+		var conf config.Config
+
+		builder, err := New(&conf, &s3mock.MockS3{}, nil)
+		So(err, ShouldBeNil)
+
+		Convey("you can't get upgrade advice without a versionsFile", func() {
+			_, err = builder.Outdated(context.Background(), "groups/hgi/xxhash", "0.8.1")
+			So(err, ShouldEqual, ErrNoVersionsFile)
+		})
+
+		Convey("you can get upgrade advice for its root packages", func() {
+			conf.Spack.VersionsFile = filepath.Join(t.TempDir(), "versions.json")
+			So(os.WriteFile(conf.Spack.VersionsFile, []byte(`[
+				{"name": "xxhash", "versions": ["develop", "0.8.2", "0.8.1", "0.7.4"]},
+				{"name": "r-seurat", "versions": ["4"]},
+				{"name": "py-anndata", "versions": ["3.9", "3.10"]},
+				{"name": "zlib", "versions": ["1.3"]}
+			]`), 0600), ShouldBeNil)
+
+			upgrades, err := builder.Outdated(context.Background(), "groups/hgi/xxhash", "0.8.1")
+			So(err, ShouldBeNil)
+			So(upgrades, ShouldResemble, []Upgrade{
+				{Name: "xxhash", Version: "0.8.1", Latest: "0.8.2"},
+			})
+
+			Convey("but not for unbuilt environments", func() {
+				builder.s3 = &mapS3{files: map[string]string{}}
+
+				_, err = builder.Outdated(context.Background(), "groups/hgi/xxhash", "0.8.1")
+				So(errors.Is(err, ErrNoArtefacts), ShouldBeTrue)
+			})
+		})
+	})
+}
@@ -0,0 +1,106 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// findParent looks for the most recently installed other version of the given
+// environment, and if all of its root packages are also requested by def,
+// returns its full environment path. Returns an empty string if there is no
+// such parent.
+func (b *Builder) findParent(ctx context.Context, def *Definition) string {
+	version := b.latestOtherVersion(def)
+	if version == "" {
+		return ""
+	}
+
+	names, err := b.rootPackageNames(ctx, filepath.Join(def.EnvironmentPath, def.EnvironmentName, version))
+	if err != nil {
+		return ""
+	}
+
+	requested := make(map[string]bool, len(def.Packages))
+
+	for _, pkg := range def.Packages {
+		requested[pkg.Name] = true
+	}
+
+	if !containsAll(requested, names) {
+		return ""
+	}
+
+	return filepath.Join(def.EnvironmentPath, def.EnvironmentName+"-"+version)
+}
+
+// latestOtherVersion returns the version of the most recently installed module
+// file for def's environment, ignoring def's own version.
+func (b *Builder) latestOtherVersion(def *Definition) string {
+	entries, err := b.inst.fs.ReadDir(ModuleDirFromName(b.config.Module.ModuleInstallDir,
+		def.EnvironmentPath, def.EnvironmentName))
+	if err != nil {
+		return ""
+	}
+
+	var (
+		latest     string
+		latestTime time.Time
+	)
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || entry.Name() == def.EnvironmentVersion {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().Before(latestTime) {
+			continue
+		}
+
+		latest, latestTime = entry.Name(), info.ModTime()
+	}
+
+	return latest
+}
+
+// rootPackageNames returns the names of the root packages in the spack.lock
+// file of the build at the given s3Path.
+func (b *Builder) rootPackageNames(ctx context.Context, s3Path string) ([]string, error) {
+	roots, err := b.rootPackages(ctx, s3Path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(roots))
+
+	for n, root := range roots {
+		names[n] = root.Name
+	}
+
+	return names, nil
+}
@@ -0,0 +1,135 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+var (
+	spackInstalledRegexp = regexp.MustCompile(`^\[\+\] (\S+)$`)                         //nolint:gochecknoglobals
+	spackSuccessRegexp   = regexp.MustCompile(`^==> \S+: Successfully installed (\S+)`) //nolint:gochecknoglobals
+	spackFailedRegexp    = regexp.MustCompile(`^==> Error: Failed to install (\S+)`)    //nolint:gochecknoglobals
+)
+
+// PackageResults says which of an environment's requested packages spack
+// installed before its build failed, and which packages (requested or
+// dependencies) spack failed to install, according to its output in
+// builder.out. This lets users split their environment to make progress.
+type PackageResults struct {
+	Built  []string
+	Failed []string
+}
+
+// parsePackageResults parses spack install output, returning which of the
+// given requested packages were installed, and which packages failed to
+// install.
+func parsePackageResults(r io.Reader, requested core.Packages) (*PackageResults, error) {
+	installed := make(map[string]bool)
+	failed := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if m := spackInstalledRegexp.FindStringSubmatch(line); m != nil {
+			installed[installedPackageName(path.Base(m[1]))] = true
+		} else if m := spackSuccessRegexp.FindStringSubmatch(line); m != nil {
+			installed[installedPackageName(m[1])] = true
+		} else if m := spackFailedRegexp.FindStringSubmatch(line); m != nil {
+			failed[m[1]] = true
+		}
+	}
+
+	results := &PackageResults{Built: []string{}, Failed: make([]string, 0, len(failed))}
+
+	for _, pkg := range requested {
+		if !installed[pkg.Name] {
+			continue
+		}
+
+		name := pkg.Name
+		if pkg.Version != "" {
+			name += "@" + pkg.Version
+		}
+
+		results.Built = append(results.Built, name)
+	}
+
+	for name := range failed {
+		results.Failed = append(results.Failed, name)
+	}
+
+	sort.Strings(results.Failed)
+
+	return results, scanner.Err()
+}
+
+// installedPackageName returns the package name from a spack install prefix
+// basename of the form name-version-hash.
+func installedPackageName(nameVersionHash string) string {
+	parts := strings.Split(nameVersionHash, "-")
+	if len(parts) < 3 { //nolint:gomnd
+		return nameVersionHash
+	}
+
+	return strings.Join(parts[:len(parts)-2], "-")
+}
+
+// recordPackageResults parses the builder.out of the failed build in the given
+// S3 location, and records which packages it built in the given status.
+func (b *Builder) recordPackageResults(ctx context.Context, def *Definition, status *Status, s3Path string) {
+	logger := loggerFromContext(ctx)
+
+	rc, err := b.s3.OpenFile(ctx, filepath.Join(s3Path, core.BuilderOut))
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	results, err := parsePackageResults(rc, def.Packages)
+	if err != nil {
+		logger.Warn("could not determine which packages were built", "err", err)
+
+		return
+	}
+
+	b.statusMu.Lock()
+	status.Packages = results
+	b.statusMu.Unlock()
+
+	if len(results.Built) > 0 || len(results.Failed) > 0 {
+		logger.Warn("build failed after installing some packages",
+			"built", strings.Join(results.Built, ","), "failed", strings.Join(results.Failed, ","))
+	}
+}
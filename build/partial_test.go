@@ -0,0 +1,83 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+const exampleSpackFailedOutput = exampleSpackInstallOutput + `==> Installing r-seurat-4-vwxyzab [4/4]
+==> Error: Failed to install r-seurat due to ChildError: ProcessError: Command exited with status 2
+`
+
+func TestPackageResults(t *testing.T) {
+	requested := core.Packages{
+		{Name: "xxhash", Version: "0.8.1"},
+		{Name: "r-seurat", Version: "4"},
+		{Name: "zlib"},
+	}
+
+	Convey("You can find which requested packages spack built before failing", t, func() {
+		results, err := parsePackageResults(strings.NewReader(exampleSpackFailedOutput), requested)
+		So(err, ShouldBeNil)
+		So(results, ShouldResemble, &PackageResults{
+			Built:  []string{"xxhash@0.8.1", "zlib"},
+			Failed: []string{"r-seurat"},
+		})
+
+		results, err = parsePackageResults(strings.NewReader("output"), requested)
+		So(err, ShouldBeNil)
+		So(results, ShouldResemble, &PackageResults{Built: []string{}, Failed: []string{}})
+	})
+
+	Convey("Package names are taken from spack install prefixes", t, func() {
+		So(installedPackageName("py-anndata-3.14-abcdefg"), ShouldEqual, "py-anndata")
+		So(installedPackageName("zlib"), ShouldEqual, "zlib")
+	})
+
+	Convey("A Builder records the package results of failed builds in their status", t, func() {
+		ms3 := &mapS3{files: map[string]string{
+			"users/foo/env/1/" + core.BuilderOut: exampleSpackFailedOutput,
+		}}
+
+		builder, err := New(&config.Config{}, ms3, nil)
+		So(err, ShouldBeNil)
+
+		status := &Status{}
+		builder.recordPackageResults(context.Background(), &Definition{Packages: requested}, status, "users/foo/env/1")
+		So(status.Packages, ShouldResemble, &PackageResults{
+			Built:  []string{"xxhash@0.8.1", "zlib"},
+			Failed: []string{"r-seurat"},
+		})
+
+		status = &Status{}
+		builder.recordPackageResults(context.Background(), &Definition{Packages: requested}, status, "users/foo/env/2")
+		So(status.Packages, ShouldBeNil)
+	})
+}
@@ -0,0 +1,102 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
+)
+
+const ErrNoScriptsSpace = internal.Error("no scripts install target has enough free space")
+
+// ScriptsInstallBase returns the directory of whichever of the given config's
+// ScriptsTargets() the scripts directory of the given environment version was
+// installed in to, or the first target if it isn't installed in any of them.
+// Placements are tracked by where the scripts directories exist, so they can't
+// get out of sync with the filesystem.
+func ScriptsInstallBase(filesystem fsys.FS, conf *config.Config, envPath, name, version string) string {
+	if base, ok := installedScriptsBase(filesystem, conf, envPath, name, version); ok {
+		return base
+	}
+
+	return conf.Module.ScriptsInstallDir
+}
+
+func installedScriptsBase(filesystem fsys.FS, conf *config.Config, envPath, name, version string) (string, bool) {
+	for _, target := range conf.ScriptsTargets() {
+		if filesystem.Exists(ScriptsDirFromNameAndVersion(target.Dir, envPath, name, version)) {
+			return target.Dir, true
+		}
+	}
+
+	return "", false
+}
+
+// ScriptsDir returns the scripts directory of the given environment version,
+// in whichever of the given config's ScriptsTargets() it was installed in to.
+func ScriptsDir(filesystem fsys.FS, conf *config.Config, envPath, name, version string) string {
+	return ScriptsDirFromNameAndVersion(ScriptsInstallBase(filesystem, conf, envPath, name, version),
+		envPath, name, version)
+}
+
+// scriptsDir returns the scripts directory of the given Definition's
+// environment, wherever it was installed.
+func (b *Builder) scriptsDir(def *Definition) string {
+	return ScriptsDir(b.inst.fs, b.config, def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+}
+
+// placeScripts returns the directory to install the given Definition's scripts
+// in to: the one it was previously installed in to if this is a rebuild,
+// otherwise the first of the configured ScriptsTargets() with at least its
+// minimum free space. Returns ErrNoScriptsSpace if none of them have enough.
+func (b *Builder) placeScripts(ctx context.Context, def *Definition) (string, error) {
+	if base, ok := installedScriptsBase(b.inst.fs, b.config, def.EnvironmentPath,
+		def.EnvironmentName, def.EnvironmentVersion); ok {
+		return base, nil
+	}
+
+	for _, target := range b.config.ScriptsTargets() {
+		if target.MinFreeGB == 0 {
+			return target.Dir, nil
+		}
+
+		free, err := b.inst.fs.FreeSpace(target.Dir)
+		if err != nil {
+			loggerFromContext(ctx).Warn("could not check free space of scripts target", "dir", target.Dir, "err", err)
+
+			continue
+		}
+
+		if free >= target.MinFreeBytes() {
+			return target.Dir, nil
+		}
+
+		loggerFromContext(ctx).Info("scripts target is too full", "dir", target.Dir, "free", free)
+	}
+
+	return "", ErrNoScriptsSpace
+}
@@ -0,0 +1,107 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+)
+
+func TestPlacement(t *testing.T) {
+	Convey("Given a Builder with overflow scripts targets", t, func() {
+		const gb = 1 << 30
+
+		var conf config.Config
+		conf.Module.ScriptsInstallDir = "/scripts"
+		conf.Module.ScriptsMinFreeGB = 10
+		conf.Module.ScriptsOverflow = []config.ScriptsTarget{
+			{Dir: "/overflow1", MinFreeGB: 5},
+			{Dir: "/overflow2"},
+		}
+
+		builder, err := New(&conf, &s3mock.MockS3{}, wrmock.NewMockWR(0, 0))
+		So(err, ShouldBeNil)
+
+		mfs := fsmock.New()
+		builder.inst.fs = mfs
+
+		for _, dir := range []string{"/scripts", "/overflow1", "/overflow2"} {
+			So(mfs.MkdirAll(dir, dirPerms), ShouldBeNil)
+		}
+
+		def := getExampleDefinition()
+		ctx := context.Background()
+
+		Convey("scripts are placed in the first target with enough free space", func() {
+			base, err := builder.placeScripts(ctx, def)
+			So(err, ShouldBeNil)
+			So(base, ShouldEqual, "/scripts")
+
+			mfs.SetFreeSpace("/scripts", 9*gb)
+
+			base, err = builder.placeScripts(ctx, def)
+			So(err, ShouldBeNil)
+			So(base, ShouldEqual, "/overflow1")
+
+			mfs.SetFreeSpace("/overflow1", 4*gb)
+
+			base, err = builder.placeScripts(ctx, def)
+			So(err, ShouldBeNil)
+			So(base, ShouldEqual, "/overflow2")
+
+			conf.Module.ScriptsOverflow[1].MinFreeGB = 1
+			mfs.SetFreeSpace("/overflow2", 0)
+
+			_, err = builder.placeScripts(ctx, def)
+			So(err, ShouldEqual, ErrNoScriptsSpace)
+		})
+
+		Convey("installed scripts are found wherever they were placed", func() {
+			So(builder.scriptsDir(def), ShouldEqual, "/scripts/groups/hgi/xxhash/0.8.1-scripts")
+
+			So(mfs.MkdirAll("/overflow1/groups/hgi/xxhash/0.8.1-scripts", dirPerms), ShouldBeNil)
+
+			So(builder.scriptsDir(def), ShouldEqual, "/overflow1/groups/hgi/xxhash/0.8.1-scripts")
+			So(ScriptsInstallBase(mfs, &conf, "groups/hgi/", "xxhash", "0.8.1"), ShouldEqual, "/overflow1")
+
+			base, err := builder.placeScripts(ctx, def)
+			So(err, ShouldBeNil)
+			So(base, ShouldEqual, "/overflow1")
+
+			conf.CVMFS.Repository = "repo"
+			p := newPublisherFromConfig(&conf)
+			So(p, ShouldNotBeNil)
+
+			rel, err := p.relativeScriptsDir(builder.scriptsDir(def))
+			So(err, ShouldBeNil)
+			So(rel, ShouldEqual, "groups/hgi/xxhash/0.8.1-scripts")
+		})
+	})
+}
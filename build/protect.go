@@ -0,0 +1,122 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
+)
+
+const ErrNotInstalled = internal.Error("environment not installed")
+
+// ProtectionBasename is the name of the hidden file in an environment's scripts
+// directory that records that it is protected against removal.
+const ProtectionBasename = ".gsb-protected"
+
+// Protection describes why, when and by whom an environment was protected
+// against removal.
+type Protection struct {
+	Reason    string    `json:"reason,omitempty"`
+	Requester string    `json:"requester,omitempty"`
+	Protected time.Time `json:"protected"`
+}
+
+// Protect marks the installed environment described by def's path, name and
+// version as protected, for the given reason, so that it can't be removed
+// without the configured protection overrideToken, eg. because production
+// pipelines depend on it. def's Requester is recorded as who protected it.
+// Protecting an already protected environment updates its reason. Returns
+// ErrNotInstalled if the environment isn't installed.
+func (b *Builder) Protect(_ context.Context, def *Definition, reason string) error {
+	if err := def.ValidateEnvironment(); err != nil {
+		return err
+	}
+
+	if err := def.validateRequester(); err != nil {
+		return err
+	}
+
+	dir := b.scriptsDir(def)
+	if !b.inst.fs.Exists(dir) {
+		return ErrNotInstalled
+	}
+
+	data, err := json.Marshal(Protection{
+		Reason:    reason,
+		Requester: def.Requester,
+		Protected: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.inst.replaceFile(bytes.NewReader(data), filepath.Join(dir, ProtectionBasename))
+}
+
+// Unprotect removes any protection of the installed environment described by
+// def's path, name and version, so that it can be removed normally.
+func (b *Builder) Unprotect(_ context.Context, def *Definition) error {
+	if err := def.ValidateEnvironment(); err != nil {
+		return err
+	}
+
+	err := b.inst.fs.Remove(filepath.Join(b.scriptsDir(def), ProtectionBasename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// ReadProtection returns the Protection of the given installed environment, or
+// nil if it isn't protected.
+func ReadProtection(filesystem fsys.FS, conf *config.Config, envPath, name, version string) (*Protection, error) {
+	f, err := filesystem.Open(filepath.Join(ScriptsDir(filesystem, conf, envPath, name, version), ProtectionBasename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	protection := new(Protection)
+
+	return protection, json.Unmarshal(data, protection)
+}
@@ -0,0 +1,97 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+)
+
+func TestProtect(t *testing.T) {
+	Convey("Given a Builder and an installed environment", t, func() {
+		var conf config.Config
+		conf.Module.ModuleInstallDir = "/modules"
+		conf.Module.ScriptsInstallDir = "/scripts"
+
+		builder, err := New(&conf, &s3mock.MockS3{}, wrmock.NewMockWR(0, 0))
+		So(err, ShouldBeNil)
+
+		mfs := fsmock.New()
+		builder.inst.fs = mfs
+
+		def := getExampleDefinition()
+		def.Requester = "user"
+		scriptsDir := builder.scriptsDir(def)
+		So(mfs.MkdirAll(scriptsDir, dirPerms), ShouldBeNil)
+
+		readProtection := func() *Protection {
+			p, errr := ReadProtection(mfs, &conf, def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+			So(errr, ShouldBeNil)
+
+			return p
+		}
+
+		So(readProtection(), ShouldBeNil)
+
+		Convey("You can Protect() it, recording why and by whom", func() {
+			before := time.Now()
+
+			So(builder.Protect(context.Background(), def, "used by pipelines"), ShouldBeNil)
+
+			p := readProtection()
+			So(p, ShouldNotBeNil)
+			So(p.Reason, ShouldEqual, "used by pipelines")
+			So(p.Requester, ShouldEqual, "user")
+			So(p.Protected, ShouldHappenOnOrAfter, before.Truncate(time.Second))
+
+			So(builder.Protect(context.Background(), def, "still used"), ShouldBeNil)
+			So(readProtection().Reason, ShouldEqual, "still used")
+
+			Convey("and Unprotect() it again", func() {
+				So(builder.Unprotect(context.Background(), def), ShouldBeNil)
+				So(readProtection(), ShouldBeNil)
+				So(builder.Unprotect(context.Background(), def), ShouldBeNil)
+			})
+		})
+
+		Convey("Protect() fails for invalid or uninstalled environments", func() {
+			def.Requester = "bad user"
+			So(builder.Protect(context.Background(), def, ""), ShouldEqual, ErrInvalidRequester)
+
+			def.Requester = ""
+			def.EnvironmentVersion = ""
+			So(builder.Protect(context.Background(), def, ""), ShouldEqual, ErrInvalidVersion)
+
+			def.EnvironmentVersion = "2"
+			So(builder.Protect(context.Background(), def, ""), ShouldEqual, ErrNotInstalled)
+		})
+	})
+}
@@ -0,0 +1,203 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+const provenanceBuildType = "https://github.com/wtsi-hgi/go-softpack-builder/build/v1"
+
+// Provenance describes how an environment was built, in the style of SLSA
+// build provenance, so that builds can be audited and exactly reproduced. It is
+// recorded in a build's Status when the build is submitted, completed when the
+// build succeeds, and then stored as a provenance.json artefact.
+//
+// InvocationID is the ID of the build (as in its logs), and the
+// ResolvedDependencies are the build and final images, and the custom spack
+// repo, that the build used.
+type Provenance struct {
+	BuildType            string                 `json:"buildType"`
+	BuilderVersion       string                 `json:"builderVersion"`
+	Environment          string                 `json:"environment"`
+	Profile              string                 `json:"profile,omitempty"`
+	ProcessorTarget      string                 `json:"processorTarget"`
+	RLibsStrategy        string                 `json:"rLibsStrategy,omitempty"`
+	Labels               map[string]string      `json:"labels,omitempty"`
+	WRDeployment         string                 `json:"wrDeployment"`
+	InvocationID         string                 `json:"invocationID"`
+	JobID                string                 `json:"jobID,omitempty"`
+	StartedOn            *time.Time             `json:"startedOn,omitempty"`
+	FinishedOn           *time.Time             `json:"finishedOn,omitempty"`
+	ResolvedDependencies []ProvenanceDependency `json:"resolvedDependencies"`
+}
+
+// ProvenanceDependency is something a build used: a Name like "buildImage",
+// its URI (eg. "docker://spack/ubuntu-jammy:v0.21.0", or
+// "git+https://github.com/org/repo" for the custom spack repo), and its Digest
+// keyed on algorithm (eg. "sha256" or "gitCommit"), if known.
+type ProvenanceDependency struct {
+	Name   string            `json:"name"`
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// recordProvenance records the initial Provenance of the build of the given
+// Definition in its status, using the images and repo in the given
+// templateVars.
+func (b *Builder) recordProvenance(def *Definition, vars *templateVars) {
+	status := b.buildStatus(def)
+
+	b.statusMu.Lock()
+	defer b.statusMu.Unlock()
+
+	status.Provenance = &Provenance{
+		BuildType:            provenanceBuildType,
+		BuilderVersion:       GSBVersion,
+		Environment:          status.Name,
+		Profile:              def.Profile,
+		ProcessorTarget:      vars.ProcessorTarget,
+		RLibsStrategy:        vars.RLibsStrategy,
+		Labels:               def.Labels,
+		InvocationID:         status.BuildID,
+		ResolvedDependencies: provenanceDependencies(vars),
+	}
+}
+
+// provenanceDependencies returns the build and final images, and the custom
+// spack repo, of the given templateVars.
+func provenanceDependencies(vars *templateVars) []ProvenanceDependency {
+	deps := []ProvenanceDependency{
+		imageDependency("buildImage", vars.BuildBootstrap, vars.BuildImage),
+		imageDependency("finalImage", vars.FinalBootstrap, vars.FinalImage),
+	}
+
+	switch {
+	case vars.RepoTarball != "":
+		deps = append(deps, ProvenanceDependency{Name: "customSpackRepo", URI: "file://" + vars.RepoTarball})
+	case vars.RepoURL != "":
+		deps = append(deps, ProvenanceDependency{
+			Name:   "customSpackRepo",
+			URI:    "git+" + vars.RepoURL,
+			Digest: map[string]string{"gitCommit": vars.RepoRef},
+		})
+	}
+
+	return deps
+}
+
+// imageDependency returns a ProvenanceDependency for an image bootstrapped
+// with the given agent and From value, with its digest if it is pinned to one.
+func imageDependency(name, bootstrap, image string) ProvenanceDependency {
+	if bootstrap == bootstrapLocalImage {
+		return ProvenanceDependency{Name: name, URI: "file://" + image}
+	}
+
+	dep := ProvenanceDependency{Name: name, URI: bootstrapDocker + "://" + image}
+
+	if _, _, ref := splitImageReference(image); strings.HasPrefix(ref, digestPrefix) {
+		dep.Digest = digestSet(ref)
+	}
+
+	return dep
+}
+
+// digestSet returns the given digest (like "sha256:abc...") keyed on its
+// algorithm.
+func digestSet(digest string) map[string]string {
+	algorithm, hex, _ := strings.Cut(digest, ":")
+
+	return map[string]string{algorithm: hex}
+}
+
+// generateAndUploadProvenance completes the Provenance in the status of the
+// successful build of the given Definition with the wr deployment, job and
+// times of the build, and the digests of its docker images if configured to
+// resolve them, and uploads it to S3 as JSON, which is returned.
+func (b *Builder) generateAndUploadProvenance(ctx context.Context, def *Definition, s3Path string) ([]byte, error) {
+	status := b.buildStatus(def)
+
+	b.statusMu.RLock()
+
+	var prov Provenance
+
+	if status.Provenance != nil {
+		prov = *status.Provenance
+	}
+
+	prov.WRDeployment = status.Deployment
+	prov.JobID = status.JobID
+	prov.StartedOn = status.BuildStart
+	prov.FinishedOn = status.BuildDone
+	prov.ResolvedDependencies = append([]ProvenanceDependency(nil), prov.ResolvedDependencies...)
+
+	b.statusMu.RUnlock()
+
+	if b.config.Images.ResolveDigests {
+		b.resolveProvenanceDigests(ctx, prov.ResolvedDependencies)
+	}
+
+	b.statusMu.Lock()
+	status.Provenance = &prov
+	b.statusMu.Unlock()
+
+	data, err := json.MarshalIndent(prov, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = b.s3.UploadData(ctx, bytes.NewReader(data),
+		filepath.Join(s3Path, core.ProvenanceBasename)); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// resolveProvenanceDigests sets the digests of the given docker image
+// dependencies that don't have one, logging any that can't be resolved.
+func (b *Builder) resolveProvenanceDigests(ctx context.Context, deps []ProvenanceDependency) {
+	for i, dep := range deps {
+		image, ok := strings.CutPrefix(dep.URI, bootstrapDocker+"://")
+		if !ok || dep.Digest != nil {
+			continue
+		}
+
+		digest, err := b.resolveImageDigest(ctx, image)
+		if err != nil {
+			loggerFromContext(ctx).Warn("failed to resolve image digest", "image", image, "err", err)
+
+			continue
+		}
+
+		deps[i].Digest = digestSet(digest)
+	}
+}
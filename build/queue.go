@@ -0,0 +1,163 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+// defaultBuildDuration is how long we assume builds take when estimating queue
+// waits before any builds have finished.
+const defaultBuildDuration = time.Hour
+
+// loadReporter is implemented by Runners that can report how busy wr is,
+// letting us estimate how long queued builds will wait.
+type loadReporter interface {
+	Load() (*wr.Load, error)
+}
+
+// QueueEstimate is a rough estimate of how long a build that wr has queued will
+// wait before it starts running. Queued and Running are the numbers of gsb's
+// build jobs waiting and running in the build's wr deployment, Ahead is the
+// number of queued builds requested before this one, and WaitSeconds is the
+// estimated wait, based on how long recent builds took.
+type QueueEstimate struct {
+	Queued      int
+	Running     int
+	Ahead       int
+	WaitSeconds int
+}
+
+// queueLoads looks up and remembers the wr Load of each deployment, so that it
+// is only queried once per status request.
+type queueLoads map[string]*wr.Load
+
+func (q queueLoads) get(deployment string, runner Runner) *wr.Load {
+	if load, ok := q[deployment]; ok {
+		return load
+	}
+
+	var load *wr.Load
+
+	if lr, ok := runner.(loadReporter); ok {
+		load, _ = lr.Load() //nolint:errcheck
+	}
+
+	q[deployment] = load
+
+	return load
+}
+
+// addQueueEstimate sets the given status's Queue if its wr job is waiting to
+// run and we can find out how busy its wr deployment is.
+func (b *Builder) addQueueEstimate(status *Status, loads queueLoads) {
+	switch status.WR.Status() { //nolint:exhaustive
+	case wr.WRJobStatusReady, wr.WRJobStatusDelayed:
+	default:
+		return
+	}
+
+	load := loads.get(status.Deployment, b.runnerFor(status.Deployment))
+	if load == nil {
+		return
+	}
+
+	ahead := b.queuedAhead(status)
+	if ahead >= load.Queued {
+		ahead = max(load.Queued-1, 0)
+	}
+
+	status.Queue = &QueueEstimate{
+		Queued:      load.Queued,
+		Running:     load.Running,
+		Ahead:       ahead,
+		WaitSeconds: int(estimateWait(ahead, load.Running, b.averageBuildDuration()).Seconds()),
+	}
+}
+
+// queuedAhead returns the number of builds on the same deployment as the given
+// one that are queued in wr and were requested before it.
+func (b *Builder) queuedAhead(status *Status) int {
+	b.statusMu.RLock()
+	defer b.statusMu.RUnlock()
+
+	ahead := 0
+
+	for _, other := range b.statuses {
+		if other.Name == status.Name || other.Deployment != status.Deployment ||
+			other.Stage() != BuildStageQueued || other.Requested == nil || status.Requested == nil {
+			continue
+		}
+
+		if other.Requested.Before(*status.Requested) {
+			ahead++
+		}
+	}
+
+	return ahead
+}
+
+// averageBuildDuration returns the mean time the wr jobs of successful builds
+// took to run, or defaultBuildDuration if none have finished.
+func (b *Builder) averageBuildDuration() time.Duration {
+	b.statusMu.RLock()
+	defer b.statusMu.RUnlock()
+
+	var (
+		total time.Duration
+		n     int
+	)
+
+	for _, status := range b.statuses {
+		if status.BuildStart == nil || status.State() != BuildStateDone {
+			continue
+		}
+
+		total += status.BuildDone.Sub(*status.BuildStart)
+		n++
+	}
+
+	if n == 0 {
+		return defaultBuildDuration
+	}
+
+	return total / time.Duration(n)
+}
+
+// estimateWait estimates how long a queued build will wait to start, given the
+// number of builds queued ahead of it, the number running, and how long builds
+// take. If nothing is running, it is only waiting to be scheduled. Otherwise,
+// since it isn't running, all capacity is in use, and the running builds and
+// those ahead of it will finish in waves.
+func estimateWait(ahead, running int, buildDuration time.Duration) time.Duration {
+	if running == 0 {
+		return 0
+	}
+
+	waves := (ahead + running) / running
+
+	return time.Duration(waves) * buildDuration
+}
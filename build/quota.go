@@ -0,0 +1,441 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const (
+	ErrQuotaExceeded = internal.Error("quota exceeded")
+
+	quotaWindow    = 24 * time.Hour
+	bytesPerGB     = 1e9
+	quotaFilePerms = 0600
+)
+
+// QuotaUsage describes how much of its configured Quota an Account (eg.
+// "users/foo" or "groups/hgi") has used: how many builds it requested in the
+// last day, how many of its builds are running, and how many bytes its
+// installed environments' images take up.
+type QuotaUsage struct {
+	Account          string
+	Quota            config.Quota
+	BuildsPerDay     int
+	ConcurrentBuilds int
+	ImageBytes       int64
+}
+
+// String describes the usage, eg. "users/foo: 3/10 builds in the last day, 1/2
+// concurrent builds, 1.5/100 GB of images installed". Unlimited quotas are
+// shown as "-".
+func (u QuotaUsage) String() string {
+	return fmt.Sprintf("%s: %d/%s builds in the last day, %d/%s concurrent builds, %.1f/%s GB of images installed",
+		u.Account, u.BuildsPerDay, quotaLimit(float64(u.Quota.BuildsPerDay)),
+		u.ConcurrentBuilds, quotaLimit(float64(u.Quota.ConcurrentBuilds)),
+		float64(u.ImageBytes)/bytesPerGB, quotaLimit(u.Quota.ImageGB))
+}
+
+func quotaLimit(limit float64) string {
+	if limit == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%g", limit)
+}
+
+// exceeded returns a description of the first limit the usage has reached, or
+// blank if there's room for another build.
+func (u QuotaUsage) exceeded() string {
+	switch {
+	case u.Quota.BuildsPerDay > 0 && u.BuildsPerDay >= u.Quota.BuildsPerDay:
+		return "builds per day"
+	case u.Quota.ConcurrentBuilds > 0 && u.ConcurrentBuilds >= u.Quota.ConcurrentBuilds:
+		return "concurrent builds"
+	case u.Quota.ImageGB > 0 && float64(u.ImageBytes) >= u.Quota.ImageGB*bytesPerGB:
+		return "installed image size"
+	default:
+		return ""
+	}
+}
+
+// quotaImage records the size of an installed environment's image, and the
+// accounts it counts against.
+type quotaImage struct {
+	Accounts []string
+	Bytes    int64
+}
+
+// quotaState is the usage we persist: the times each account requested builds
+// in the last day, and the installed images keyed on full environment path.
+type quotaState struct {
+	Builds map[string][]time.Time
+	Images map[string]quotaImage
+}
+
+// quotas tracks the usage of the configured quotas, persisting it to a file if
+// it has a path.
+type quotas struct {
+	conf config.Quotas
+
+	mu      sync.Mutex
+	state   quotaState
+	running map[string][]string
+}
+
+// newQuotas returns quotas for the given config, starting with any usage
+// previously persisted to its stateFile. Returns nil if no quotas are
+// configured.
+func newQuotas(conf config.Quotas) (*quotas, error) {
+	if !conf.Enabled() {
+		return nil, nil //nolint:nilnil
+	}
+
+	q := &quotas{
+		conf: conf,
+		state: quotaState{
+			Builds: make(map[string][]time.Time),
+			Images: make(map[string]quotaImage),
+		},
+		running: make(map[string][]string),
+	}
+
+	if conf.StateFile == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(conf.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return q, json.Unmarshal(data, &q.state)
+}
+
+// quotaAccounts returns the accounts that a build of the given Definition
+// counts against: the user who requested it (or whose users/ environment it
+// is, if that isn't known) and the group whose groups/ environment it is.
+func quotaAccounts(def *Definition) []string {
+	var accounts []string
+
+	owner := strings.TrimSuffix(def.EnvironmentPath, "/")
+
+	if def.Requester != "" {
+		accounts = append(accounts, path.Join("users", def.Requester))
+	} else if strings.HasPrefix(owner, "users/") {
+		accounts = append(accounts, owner)
+	}
+
+	if strings.HasPrefix(owner, "groups/") {
+		accounts = append(accounts, owner)
+	}
+
+	return accounts
+}
+
+// reserve returns an error wrapping ErrQuotaExceeded, describing the usage of
+// the accounts of the given Definition, if any of them have no room for
+// another build. A groups/ account that is full is reported along with the
+// contacts of its Owner, who can free up room.
+//
+// Otherwise it records that the build has started, in the same lock so that
+// concurrent requests can't both take the last of a quota, and returns a
+// function that undoes that if the build doesn't go ahead after all.
+func (q *quotas) reserve(def *Definition, owner *Owner) (func(), error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.refreshImages()
+
+	now := time.Now()
+
+	if err := q.check(def, owner, now); err != nil {
+		return nil, err
+	}
+
+	accounts := quotaAccounts(def)
+
+	for _, account := range accounts {
+		q.state.Builds[account] = append(recentBuilds(q.state.Builds[account], now), now)
+	}
+
+	envPath := def.FullEnvironmentPath()
+	_, alreadyRunning := q.running[envPath]
+
+	if !alreadyRunning {
+		q.running[envPath] = accounts
+	}
+
+	persistErr := q.persist()
+
+	return func() { q.unreserve(envPath, accounts, now, alreadyRunning) }, persistErr
+}
+
+// check returns an error wrapping ErrQuotaExceeded if any of the accounts of
+// the given Definition have no room for another build. You must hold the lock.
+func (q *quotas) check(def *Definition, owner *Owner, now time.Time) error {
+	var (
+		exceeded []string
+		report   []string
+	)
+
+	for _, account := range quotaAccounts(def) {
+		usage := q.usage(account, now)
+		report = append(report, usage.String())
+
+		if limit := usage.exceeded(); limit != "" {
+			exceeded = append(exceeded, account+" "+limit+teamContactsNote(account, owner))
+		}
+	}
+
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w (%s); usage: %s", ErrQuotaExceeded,
+		strings.Join(exceeded, ", "), strings.Join(report, "; "))
+}
+
+// unreserve undoes a reserve() of a build of the given environment at the
+// given time.
+func (q *quotas) unreserve(envPath string, accounts []string, started time.Time, alreadyRunning bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, account := range accounts {
+		builds := q.state.Builds[account]
+
+		if i := slices.IndexFunc(builds, started.Equal); i >= 0 {
+			q.state.Builds[account] = slices.Delete(builds, i, i+1)
+		}
+	}
+
+	if !alreadyRunning {
+		delete(q.running, envPath)
+	}
+
+	q.persist() //nolint:errcheck
+}
+
+// teamContactsNote returns a note naming the contacts of the given Owner if it
+// is the given groups/ account and has any.
+func teamContactsNote(account string, owner *Owner) string {
+	if owner == nil || owner.Account != account || !strings.HasPrefix(account, "groups/") ||
+		len(owner.Contacts) == 0 {
+		return ""
+	}
+
+	return " (team contacts: " + strings.Join(owner.Contacts, ", ") + ")"
+}
+
+// usage returns the QuotaUsage of the given account. You must hold the lock.
+func (q *quotas) usage(account string, now time.Time) QuotaUsage {
+	usage := QuotaUsage{Account: account, Quota: q.conf.For(account)}
+
+	for _, t := range q.state.Builds[account] {
+		if now.Sub(t) < quotaWindow {
+			usage.BuildsPerDay++
+		}
+	}
+
+	for _, accounts := range q.running {
+		if slices.Contains(accounts, account) {
+			usage.ConcurrentBuilds++
+		}
+	}
+
+	for _, image := range q.state.Images {
+		if slices.Contains(image.Accounts, account) {
+			usage.ImageBytes += image.Bytes
+		}
+	}
+
+	return usage
+}
+
+// recentBuilds returns the given build times that are within the quota window.
+func recentBuilds(times []time.Time, now time.Time) []time.Time {
+	recent := times[:0]
+
+	for _, t := range times {
+		if now.Sub(t) < quotaWindow {
+			recent = append(recent, t)
+		}
+	}
+
+	return recent
+}
+
+// finish records that the build of the given environment has finished.
+func (q *quotas) finish(envPath string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.running, envPath)
+}
+
+// installed records the size of the installed image of the given Definition.
+func (q *quotas) installed(def *Definition, size int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.refreshImages()
+
+	q.state.Images[def.FullEnvironmentPath()] = quotaImage{Accounts: quotaAccounts(def), Bytes: size}
+
+	return q.persist()
+}
+
+// removed forgets the installed image of the given full environment path.
+func (q *quotas) removed(envPath string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.refreshImages()
+
+	if _, ok := q.state.Images[envPath]; !ok {
+		return nil
+	}
+
+	delete(q.state.Images, envPath)
+
+	return q.persist()
+}
+
+// refreshImages replaces our installed images with those in our stateFile, if
+// any, since ReleaseQuotaImage() may have been used by another process to
+// forget some. You must hold the lock.
+func (q *quotas) refreshImages() {
+	if q.conf.StateFile == "" {
+		return
+	}
+
+	data, err := os.ReadFile(q.conf.StateFile)
+	if err != nil {
+		return
+	}
+
+	var state quotaState
+
+	if json.Unmarshal(data, &state) == nil && state.Images != nil {
+		q.state.Images = state.Images
+	}
+}
+
+// persist writes our state to our stateFile, if any. You must hold the lock.
+func (q *quotas) persist() error {
+	if q.conf.StateFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(q.state)
+	if err != nil {
+		return err
+	}
+
+	tmp := q.conf.StateFile + newSuffix
+
+	if err = os.WriteFile(tmp, data, quotaFilePerms); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, q.conf.StateFile)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// reserveQuotas returns an error wrapping ErrQuotaExceeded if any of the
+// accounts that the build of the given Definition counts against have reached
+// one of their configured quotas. Otherwise it records the start of the build
+// against them, returning a function to call if the build doesn't go ahead.
+func (b *Builder) reserveQuotas(ctx context.Context, def *Definition, owner *Owner) (func(), error) {
+	if b.quotas == nil {
+		return func() {}, nil
+	}
+
+	release, err := b.quotas.reserve(def, owner)
+	if errors.Is(err, ErrQuotaExceeded) {
+		return nil, err
+	} else if err != nil {
+		loggerFromContext(ctx).Warn("failed to save quota usage", "err", err)
+	}
+
+	return release, nil
+}
+
+// recordInstalledImage records the size of the installed image of the given
+// Definition against its accounts' quotas.
+func (b *Builder) recordInstalledImage(ctx context.Context, def *Definition, size int64) {
+	if b.quotas == nil {
+		return
+	}
+
+	if err := b.quotas.installed(def, size); err != nil {
+		loggerFromContext(ctx).Warn("failed to save quota usage", "err", err)
+	}
+}
+
+// ReleaseQuotaImage forgets the installed image of the given full environment
+// path (eg. "users/foo/env-1") in the given config's quotas stateFile, so that
+// it no longer counts against its accounts' imageGB quotas. Does nothing if
+// there are no quotas or stateFile.
+func ReleaseQuotaImage(conf config.Quotas, envPath string) error {
+	if conf.StateFile == "" {
+		return nil
+	}
+
+	q, err := newQuotas(conf)
+	if err != nil || q == nil {
+		return err
+	}
+
+	return q.removed(filepath.Clean(envPath))
+}
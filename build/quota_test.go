@@ -0,0 +1,254 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/coremock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+)
+
+func TestQuotas(t *testing.T) {
+	Convey("Builds count against their requester's and group's quotas", t, func() {
+		def := getExampleDefinition()
+		So(quotaAccounts(def), ShouldResemble, []string{"groups/hgi"})
+
+		def.Requester = "foo"
+		So(quotaAccounts(def), ShouldResemble, []string{"users/foo", "groups/hgi"})
+
+		def.EnvironmentPath = "users/bar"
+		So(quotaAccounts(def), ShouldResemble, []string{"users/foo"})
+
+		def.Requester = ""
+		So(quotaAccounts(def), ShouldResemble, []string{"users/bar"})
+	})
+
+	Convey("Builds per day are limited over the last 24 hours", t, func() {
+		q, err := newQuotas(config.Quotas{User: config.Quota{BuildsPerDay: 2}})
+		So(err, ShouldBeNil)
+
+		def := getExampleDefinition()
+		def.Requester = "foo"
+
+		q.state.Builds["users/foo"] = []time.Time{time.Now().Add(-25 * time.Hour), time.Now()}
+
+		_, err = q.reserve(def, nil)
+		So(err, ShouldBeNil)
+		So(len(q.state.Builds["users/foo"]), ShouldEqual, 2)
+
+		_, err = q.reserve(def, nil)
+		So(err, ShouldWrap, ErrQuotaExceeded)
+		So(err.Error(), ShouldEqual, "quota exceeded (users/foo builds per day); usage: "+
+			"users/foo: 2/2 builds in the last day, 1/- concurrent builds, 0.0/- GB of images installed; "+
+			"groups/hgi: 1/- builds in the last day, 1/- concurrent builds, 0.0/- GB of images installed")
+	})
+
+	Convey("Full group quotas are reported with the team's contacts", t, func() {
+		q, err := newQuotas(config.Quotas{Group: config.Quota{ConcurrentBuilds: 1}})
+		So(err, ShouldBeNil)
+
+		def := getExampleDefinition()
+		_, err = q.reserve(def, nil)
+		So(err, ShouldBeNil)
+
+		owner := &Owner{Account: "groups/hgi", Contacts: []string{"foo", "hgi@example.com"}}
+		_, err = q.reserve(def, owner)
+		So(err, ShouldWrap, ErrQuotaExceeded)
+		So(err.Error(), ShouldStartWith, "quota exceeded (groups/hgi concurrent builds "+
+			"(team contacts: foo, hgi@example.com)); usage: groups/hgi: ")
+
+		_, err = q.reserve(def, &Owner{Account: "groups/hgi"})
+		So(err.Error(), ShouldStartWith, "quota exceeded (groups/hgi concurrent builds); ")
+	})
+
+	Convey("Reservations are atomic, and can be released", t, func() {
+		q, err := newQuotas(config.Quotas{User: config.Quota{ConcurrentBuilds: 1, BuildsPerDay: 1}})
+		So(err, ShouldBeNil)
+
+		var (
+			wg       sync.WaitGroup
+			reserved atomic.Int32
+			releases = make(chan func(), 10)
+		)
+
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				def := getExampleDefinition()
+				def.EnvironmentName = fmt.Sprintf("env%d", i)
+				def.Requester = "foo"
+
+				if release, errr := q.reserve(def, nil); errr == nil {
+					reserved.Add(1)
+					releases <- release
+				}
+			}(i)
+		}
+
+		wg.Wait()
+		So(reserved.Load(), ShouldEqual, 1)
+
+		(<-releases)()
+
+		usage := q.usage("users/foo", time.Now())
+		So(usage.BuildsPerDay, ShouldEqual, 0)
+		So(usage.ConcurrentBuilds, ShouldEqual, 0)
+	})
+
+	Convey("Removed images stop counting against quotas", t, func() {
+		conf := config.Quotas{
+			Group:     config.Quota{ImageGB: 1},
+			StateFile: filepath.Join(t.TempDir(), "quotas.json"),
+		}
+
+		q, err := newQuotas(conf)
+		So(err, ShouldBeNil)
+
+		def := getExampleDefinition()
+		So(q.installed(def, 10), ShouldBeNil)
+		So(q.usage("groups/hgi", time.Now()).ImageBytes, ShouldEqual, 10)
+
+		So(ReleaseQuotaImage(conf, def.FullEnvironmentPath()), ShouldBeNil)
+
+		other := getExampleDefinition()
+		other.EnvironmentName = "other"
+		So(q.installed(other, 5), ShouldBeNil)
+		So(q.usage("groups/hgi", time.Now()).ImageBytes, ShouldEqual, 5)
+
+		q, err = newQuotas(conf)
+		So(err, ShouldBeNil)
+		So(q.usage("groups/hgi", time.Now()).ImageBytes, ShouldEqual, 5)
+
+		So(ReleaseQuotaImage(config.Quotas{}, def.FullEnvironmentPath()), ShouldBeNil)
+	})
+
+	Convey("Without quotas, there are no limits", t, func() {
+		q, err := newQuotas(config.Quotas{})
+		So(err, ShouldBeNil)
+		So(q, ShouldBeNil)
+
+		builder, err := New(&config.Config{}, &s3mock.MockS3{}, wrmock.NewMockWR(0, 0))
+		So(err, ShouldBeNil)
+		release, err := builder.reserveQuotas(context.Background(), getExampleDefinition(), nil)
+		So(err, ShouldBeNil)
+		So(release, ShouldNotBeNil)
+	})
+
+	Convey("Given a Builder with quotas", t, func() {
+		msc := httptest.NewServer(coremock.NewMockCore())
+
+		defer msc.Close()
+
+		builder, conf, ms3, mwr := newTestBuilder(t, func(conf *config.Config) {
+			conf.CoreURL = msc.URL
+			conf.Module.ModuleInstallDir = t.TempDir()
+			conf.Module.ScriptsInstallDir = t.TempDir()
+			conf.Module.WrapperScript = "/path/to/wrapper"
+			conf.Quotas.User.ConcurrentBuilds = 1
+			conf.Quotas.Group.ImageGB = float64(len("image")) / bytesPerGB
+			conf.Quotas.StateFile = filepath.Join(t.TempDir(), "quotas.json")
+		})
+		ms3.Exes = "xxhsum"
+
+		def := getExampleDefinition()
+		def.Requester = "foo"
+
+		usageOf := func(account string) QuotaUsage {
+			builder.quotas.mu.Lock()
+			defer builder.quotas.mu.Unlock()
+
+			return builder.quotas.usage(account, time.Now())
+		}
+
+		other := getExampleDefinition()
+		other.EnvironmentName = "other"
+		other.Requester = "foo"
+
+		Convey("builds over quota are rejected, with a usage report", func() {
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			err = builder.Build(context.Background(), other)
+			So(err, ShouldWrap, ErrQuotaExceeded)
+			So(err.Error(), ShouldStartWith, "quota exceeded (users/foo concurrent builds); usage: "+
+				"users/foo: 1/- builds in the last day, 1/1 concurrent builds, 0.0/- GB of images installed; ")
+			So(len(builder.Status()), ShouldEqual, 1)
+
+			mwr.SetRunning()
+
+			ok := waitFor(func() bool {
+				usage := usageOf("groups/hgi")
+
+				return usage.ImageBytes > 0 && usage.ConcurrentBuilds == 0
+			})
+			So(ok, ShouldBeTrue)
+
+			err = builder.Build(context.Background(), other)
+			So(err, ShouldWrap, ErrQuotaExceeded)
+			So(err.Error(), ShouldStartWith, "quota exceeded (groups/hgi installed image size); ")
+
+			Convey("and usage persists across restarts", func() {
+				builder, err = New(conf, ms3, mwr)
+				So(err, ShouldBeNil)
+
+				usage := usageOf("groups/hgi")
+				So(usage.BuildsPerDay, ShouldEqual, 1)
+				So(usage.ImageBytes, ShouldEqual, len("image"))
+
+				err = builder.Build(context.Background(), other)
+				So(err, ShouldWrap, ErrQuotaExceeded)
+			})
+		})
+
+		Convey("builds that fail to start don't count against quotas", func() {
+			ms3.Fail = true
+
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldWrap, s3mock.ErrS3Mock)
+
+			usage := usageOf("users/foo")
+			So(usage.BuildsPerDay, ShouldEqual, 0)
+			So(usage.ConcurrentBuilds, ShouldEqual, 0)
+
+			ms3.Fail = false
+
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(usageOf("users/foo").BuildsPerDay, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,199 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const (
+	ErrImageDigest = internal.Error("failed to resolve image digest")
+
+	dockerHubRegistry = "registry-1.docker.io"
+	digestPrefix      = "sha256:"
+)
+
+// registryScheme is the scheme used to talk to registries; tests use http.
+var registryScheme = "https" //nolint:gochecknoglobals
+
+// manifestMediaTypes are the manifest types we accept from registries, with
+// manifest lists and indexes first, so that the digest we get is the one that
+// pulling the image by tag would get, regardless of platform.
+var manifestMediaTypes = []string{ //nolint:gochecknoglobals
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// splitImageReference returns the registry host, repository and tag (or
+// digest) of the given docker image reference, defaulting to Docker Hub (with
+// official images getting their implicit "library/" namespace) and "latest".
+func splitImageReference(image string) (string, string, string) {
+	registry := dockerHubRegistry
+
+	if hasRegistryHost(image) {
+		registry, image, _ = strings.Cut(image, "/")
+	} else if !strings.Contains(image, "/") {
+		image = dockerHubNamespace + image
+	}
+
+	if repo, digest, ok := strings.Cut(image, "@"); ok {
+		return registry, repo, digest
+	}
+
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return registry, image[:i], image[i+1:]
+	}
+
+	return registry, image, "latest"
+}
+
+// resolveImageDigest returns the digest (like "sha256:abc...") of the given
+// docker image reference: the one it is pinned to, if any, otherwise the one
+// its registry currently has for its tag, getting an anonymous pull token if
+// the registry asks for one.
+func (b *Builder) resolveImageDigest(ctx context.Context, image string) (string, error) {
+	registry, repo, ref := splitImageReference(image)
+	if strings.HasPrefix(ref, digestPrefix) {
+		return ref, nil
+	}
+
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", registryScheme, registry, repo, ref)
+
+	resp, err := b.registryRequest(ctx, http.MethodHead, manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+
+		token, errt := b.registryToken(ctx, resp.Header.Get("WWW-Authenticate"))
+		if errt != nil {
+			return "", errt
+		}
+
+		if resp, err = b.registryRequest(ctx, http.MethodHead, manifestURL, token); err != nil {
+			return "", err
+		}
+	}
+
+	defer resp.Body.Close()
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if resp.StatusCode != http.StatusOK || digest == "" {
+		return "", fmt.Errorf("%w: %s: %s", ErrImageDigest, image, resp.Status)
+	}
+
+	return digest, nil
+}
+
+func (b *Builder) registryRequest(ctx context.Context, method, reqURL, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return b.coreClient.Do(req)
+}
+
+// registryToken gets an anonymous pull token from the realm of the given
+// Bearer WWW-Authenticate challenge.
+func (b *Builder) registryToken(ctx context.Context, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("%w: unsupported registry auth %q", ErrImageDigest, scheme)
+	}
+
+	values := parseAuthParams(params)
+
+	tokenURL, err := url.Parse(values["realm"])
+	if err != nil {
+		return "", err
+	}
+
+	query := tokenURL.Query()
+
+	for _, key := range []string{"service", "scope"} {
+		if value, ok := values[key]; ok {
+			query.Set(key, value)
+		}
+	}
+
+	tokenURL.RawQuery = query.Encode()
+
+	resp, err := b.registryRequest(ctx, http.MethodGet, tokenURL.String(), "")
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: registry token: %s", ErrImageDigest, resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	if token.Token == "" {
+		return token.AccessToken, nil
+	}
+
+	return token.Token, nil
+}
+
+// parseAuthParams parses the comma separated key="value" parameters of a
+// WWW-Authenticate challenge.
+func parseAuthParams(params string) map[string]string {
+	values := make(map[string]string)
+
+	for _, param := range strings.Split(params, ",") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok {
+			values[key] = strings.Trim(value, `"`)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,114 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+)
+
+const testImageDigest = "sha256:0123456789abcdef"
+
+// newMockRegistry returns a registry that wants a token from its own /token
+// endpoint before it will give the digest of any manifest.
+func newMockRegistry() *httptest.Server {
+	var registry *httptest.Server
+
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if r.URL.Query().Get("scope") != "repository:spack/ubuntu-jammy:pull" {
+				w.WriteHeader(http.StatusForbidden)
+
+				return
+			}
+
+			w.Write([]byte(`{"token":"secret"}`)) //nolint:errcheck
+		case r.Header.Get("Authorization") != "Bearer secret":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+registry.URL+`/token",service="mock",`+
+				`scope="repository:spack/ubuntu-jammy:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Method == http.MethodHead && r.URL.Path == "/v2/spack/ubuntu-jammy/manifests/v0.20.1" &&
+			strings.Contains(r.Header.Get("Accept"), "manifest.list"):
+			w.Header().Set("Docker-Content-Digest", testImageDigest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return registry
+}
+
+func TestRegistry(t *testing.T) {
+	Convey("Image references can be split in to registry, repository and tag or digest", t, func() {
+		for _, test := range []struct {
+			image, registry, repo, ref string
+		}{
+			{"ubuntu", dockerHubRegistry, "library/ubuntu", "latest"},
+			{"ubuntu:22.04", dockerHubRegistry, "library/ubuntu", "22.04"},
+			{"spack/ubuntu-jammy:v0.20.1", dockerHubRegistry, "spack/ubuntu-jammy", "v0.20.1"},
+			{"localhost:5000/spack/ubuntu-jammy", "localhost:5000", "spack/ubuntu-jammy", "latest"},
+			{"ghcr.io/a/b@" + testImageDigest, "ghcr.io", "a/b", testImageDigest},
+		} {
+			registry, repo, ref := splitImageReference(test.image)
+			So(registry, ShouldEqual, test.registry)
+			So(repo, ShouldEqual, test.repo)
+			So(ref, ShouldEqual, test.ref)
+		}
+	})
+
+	Convey("Given a builder and a registry", t, func() {
+		registry := newMockRegistry()
+		defer registry.Close()
+
+		registryScheme = "http"
+		defer func() { registryScheme = "https" }()
+
+		builder, err := New(&config.Config{}, &s3mock.MockS3{}, wrmock.NewMockWR(0, 0))
+		So(err, ShouldBeNil)
+
+		host := strings.TrimPrefix(registry.URL, "http://")
+
+		Convey("you can resolve the digests of images, getting a token if needed", func() {
+			digest, err := builder.resolveImageDigest(context.Background(), host+"/spack/ubuntu-jammy:v0.20.1")
+			So(err, ShouldBeNil)
+			So(digest, ShouldEqual, testImageDigest)
+
+			_, err = builder.resolveImageDigest(context.Background(), host+"/spack/ubuntu-jammy:v0.21.0")
+			So(err, ShouldWrap, ErrImageDigest)
+
+			digest, err = builder.resolveImageDigest(context.Background(), "ubuntu@"+testImageDigest)
+			So(err, ShouldBeNil)
+			So(digest, ShouldEqual, testImageDigest)
+		})
+	})
+}
@@ -0,0 +1,217 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
+)
+
+// RemovalS3Basenames are the files in an environment's S3 build location that
+// are removed along with the environment when the S3 can't list all the files
+// there.
+var RemovalS3Basenames = [...]string{ //nolint:gochecknoglobals
+	core.SingularityDefBasename,
+	core.ExesBasename,
+	core.SoftpackYaml,
+	core.SpackLockFile,
+	core.BuilderOut,
+	core.UsageBasename,
+	core.ImageBasename,
+}
+
+// S3Sizer is implemented by S3s that can report the sizes of all the files
+// within a directory and its subdirectories, keyed on their relative paths.
+type S3Sizer interface {
+	TreeSizes(dir string) (map[string]int64, error)
+}
+
+// RemovedFile is a file that is (or would be) removed along with an
+// environment, and its Size in bytes; -1 if unknown.
+type RemovedFile struct {
+	Path string
+	Size int64
+}
+
+// RemovalReport describes everything that removing an Environment
+// ("users/foo/env-1") deletes: its entry in core, the S3Objects of its build
+// (everything in its S3 build location, including logs),
+// its ModuleFile, its ScriptsDir and the ScriptsFiles in it, any KernelSpecs
+// dirs and its MetadataCache dir. Local files that don't exist are left out.
+// Protection is set if the environment is protected against removal. If
+// DryRun, nothing was actually removed. If the files were moved in to the trash
+// instead of being deleted, TrashID identifies them for restoring.
+type RemovalReport struct {
+	DryRun        bool
+	TrashID       string
+	Environment   string
+	Protection    *Protection
+	S3Objects     []RemovedFile
+	ModuleFile    *RemovedFile
+	ScriptsDir    string
+	ScriptsFiles  []RemovedFile
+	KernelSpecs   []string
+	MetadataCache string
+}
+
+// PlanRemoval returns a RemovalReport of everything that removing the given
+// environment (a path like "users/foo/env") and version would delete from the
+// given filesystem and S3. If sizer is nil, the RemovalS3Basenames in the S3
+// build location are listed, with an unknown size.
+func PlanRemoval(filesystem fsys.FS, conf *config.Config, sizer S3Sizer,
+	envPath, version string) (*RemovalReport, error) {
+	if err := ValidateEnvironmentPath(envPath, version); err != nil {
+		return nil, err
+	}
+
+	envDir, envName := path.Split(envPath)
+	report := &RemovalReport{
+		Environment: envPath + "-" + version,
+		ScriptsDir:  ScriptsDir(filesystem, conf, envDir, envName, version),
+	}
+
+	protection, err := ReadProtection(filesystem, conf, envDir, envName, version)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Protection = protection
+
+	if report.S3Objects, err = plannedS3Removals(sizer, filepath.Join(envPath, version)); err != nil {
+		return nil, err
+	}
+
+	moduleDir := ModuleDirFromName(conf.Module.ModuleInstallDir, envDir, envName)
+	for _, file := range filesIn(filesystem, moduleDir) {
+		if file.Path == filepath.Join(moduleDir, version) {
+			report.ModuleFile = &file
+
+			break
+		}
+	}
+
+	report.ScriptsFiles = filesIn(filesystem, report.ScriptsDir)
+	report.KernelSpecs, report.MetadataCache = plannedCacheRemovals(filesystem, conf, envPath, version)
+
+	return report, nil
+}
+
+// plannedS3Removals returns all the files in the given S3 directory, sorted by
+// path, or the RemovalS3Basenames in it if sizer is nil.
+func plannedS3Removals(sizer S3Sizer, s3Path string) ([]RemovedFile, error) {
+	if sizer == nil {
+		files := make([]RemovedFile, len(RemovalS3Basenames))
+
+		for n, basename := range RemovalS3Basenames {
+			files[n] = RemovedFile{Path: filepath.Join(s3Path, basename), Size: -1}
+		}
+
+		return files, nil
+	}
+
+	sizes, err := sizer.TreeSizes(s3Path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]RemovedFile, 0, len(sizes))
+
+	for rel, size := range sizes {
+		files = append(files, RemovedFile{Path: filepath.Join(s3Path, rel), Size: size})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return files, nil
+}
+
+// filesIn returns the files directly within the given directory, or nil if it
+// doesn't exist.
+func filesIn(filesystem fsys.FS, dir string) []RemovedFile {
+	entries, err := filesystem.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	files := make([]RemovedFile, 0, len(entries))
+
+	for _, entry := range entries {
+		file := RemovedFile{Path: filepath.Join(dir, entry.Name()), Size: -1}
+
+		if info, err := entry.Info(); err == nil {
+			file.Size = info.Size()
+		}
+
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// plannedCacheRemovals returns the existing kernel spec dirs and metadata cache
+// dir of the given environment.
+func plannedCacheRemovals(filesystem fsys.FS, conf *config.Config, envPath, version string) ([]string, string) {
+	var kernelSpecs []string
+
+	if conf.Module.KernelsDir != "" {
+		for _, dir := range KernelSpecDirs(conf.Module.KernelsDir, envPath, version) {
+			if filesystem.Exists(dir) {
+				kernelSpecs = append(kernelSpecs, dir)
+			}
+		}
+	}
+
+	var metadataCache string
+
+	if conf.Server.MetadataCacheDir != "" {
+		if dir := MetadataCacheDir(conf.Server.MetadataCacheDir, envPath, version); filesystem.Exists(dir) {
+			metadataCache = dir
+		}
+	}
+
+	return kernelSpecs, metadataCache
+}
+
+// RemovalPreview returns a dry-run RemovalReport of everything that removing
+// the given environment (a path like "users/foo/env") and version would
+// delete.
+func (b *Builder) RemovalPreview(envPath, version string) (*RemovalReport, error) {
+	sizer, _ := b.s3.(S3Sizer)
+
+	report, err := PlanRemoval(b.inst.fs, b.config, sizer, envPath, version)
+	if err != nil {
+		return nil, err
+	}
+
+	report.DryRun = true
+
+	return report, nil
+}
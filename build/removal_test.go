@@ -0,0 +1,103 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+)
+
+func TestRemovalPreview(t *testing.T) {
+	Convey("Given a Builder and an installed environment", t, func() {
+		var conf config.Config
+		conf.Module.ModuleInstallDir = "/modules"
+		conf.Module.ScriptsInstallDir = "/scripts"
+		conf.Module.KernelsDir = "/kernels"
+
+		ms3 := &s3mock.MockS3{}
+
+		builder, err := New(&conf, ms3, wrmock.NewMockWR(0, 0))
+		So(err, ShouldBeNil)
+
+		mfs := fsmock.New()
+		builder.inst.fs = mfs
+
+		def := getExampleDefinition()
+		envPath := filepath.Join(def.EnvironmentPath, def.EnvironmentName)
+		moduleDir := ModuleDirFromName(conf.Module.ModuleInstallDir, def.EnvironmentPath, def.EnvironmentName)
+		scriptsDir := builder.scriptsDir(def)
+		kernelDir := KernelSpecDirs(conf.Module.KernelsDir, envPath, def.EnvironmentVersion)[0]
+
+		So(mfs.MkdirAll(moduleDir, dirPerms), ShouldBeNil)
+		So(mfs.MkdirAll(scriptsDir, dirPerms), ShouldBeNil)
+		So(mfs.MkdirAll(kernelDir, dirPerms), ShouldBeNil)
+		writeMockFile(mfs, filepath.Join(moduleDir, def.EnvironmentVersion), "module")
+		writeMockFile(mfs, filepath.Join(scriptsDir, core.ExesBasename), "xxhsum\n")
+
+		ms3.Files = map[string]string{
+			filepath.Join(def.getS3Path(), core.ImageBasename):              strings.Repeat("i", 4096),
+			filepath.Join(def.getS3Path(), "logs", "build.log"):             "log",
+			filepath.Join(def.EnvironmentPath, "other", core.ImageBasename): "other",
+		}
+
+		Convey("You can preview what removing it would delete", func() {
+			report, err := builder.RemovalPreview(envPath, def.EnvironmentVersion)
+			So(err, ShouldBeNil)
+			So(report, ShouldResemble, &RemovalReport{
+				DryRun:      true,
+				Environment: def.getRepoPath(),
+				S3Objects: []RemovedFile{
+					{Path: filepath.Join(def.getS3Path(), "logs", "build.log"), Size: 3},
+					{Path: filepath.Join(def.getS3Path(), core.ImageBasename), Size: 4096},
+				},
+				ModuleFile:   &RemovedFile{Path: filepath.Join(moduleDir, def.EnvironmentVersion), Size: 6},
+				ScriptsDir:   scriptsDir,
+				ScriptsFiles: []RemovedFile{{Path: filepath.Join(scriptsDir, core.ExesBasename), Size: 7}},
+				KernelSpecs:  []string{kernelDir},
+			})
+			So(mfs.Exists(filepath.Join(moduleDir, def.EnvironmentVersion)), ShouldBeTrue)
+		})
+
+		Convey("Without S3 sizes, every possible S3 object is listed", func() {
+			report, err := PlanRemoval(mfs, &conf, nil, envPath, def.EnvironmentVersion)
+			So(err, ShouldBeNil)
+			So(len(report.S3Objects), ShouldEqual, len(RemovalS3Basenames))
+			So(report.S3Objects[0].Size, ShouldEqual, -1)
+			So(report.DryRun, ShouldBeFalse)
+		})
+
+		Convey("Invalid environments can't be previewed", func() {
+			_, err := builder.RemovalPreview(envPath, "")
+			So(err, ShouldEqual, ErrInvalidVersion)
+		})
+	})
+}
@@ -0,0 +1,125 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// Rendering is what building a Definition would generate: its SingularityDef,
+// the Module file and Usage README that would be installed, and the
+// SoftpackYML that would be stored in core. Which executables an environment
+// has, and the concrete versions of its packages, are only known once it has
+// been built, so the module file and softpack.yml only include its interpreter
+// executables and its packages at their requested versions.
+type Rendering struct {
+	SingularityDef string
+	Module         string
+	Usage          string
+	SoftpackYML    string
+}
+
+// Render returns the Rendering of the given Definition, without building it or
+// changing anything, so that you can preview what a build would do (eg. while
+// developing template overrides). Returns the same errors as Build() for
+// invalid profiles, processor targets and externals.
+func (b *Builder) Render(ctx context.Context, def *Definition) (*Rendering, error) {
+	if err := def.ValidateEnvironment(); err != nil {
+		return nil, err
+	}
+
+	profile, err := b.config.BuildProfile(def.Profile, def.ProcessorTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := *def
+	rendered.ProcessorTarget = profile.ProcessorTarget
+	rendered.Conflicts = mergeModuleNames(b.config.Module.Conflicts, def.Conflicts)
+	rendered.Prereqs = mergeModuleNames(b.config.Module.Prereqs, def.Prereqs)
+	rendered.Parent = b.findParent(ctx, &rendered)
+
+	singDef, err := b.generateSingularityDef(ctx, &rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	scriptsBase, err := b.placeScripts(ctx, &rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	exes := rendered.Interpreters()
+
+	softpackYML, err := b.requestedSoftpackYML(&rendered, exes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rendering{
+		SingularityDef: singDef,
+		Module:         rendered.ToModule(scriptsBase, b.config.Module.Dependencies, exes),
+		Usage: rendered.ModuleUsage(b.config.Module.LoadPath, b.config.Module.KernelsDir,
+			b.completionsDir(&rendered)),
+		SoftpackYML: softpackYML,
+	}, nil
+}
+
+// requestedSoftpackYML returns the softpack.yml that building the given
+// Definition would generate, if its packages were built at their requested
+// versions and it had the given executables.
+func (b *Builder) requestedSoftpackYML(def *Definition, exes []string) (string, error) {
+	vars := softpackTemplateVars{
+		Description:     descriptionLines(def.Description),
+		Packages:        concreteSpecs(def.Packages),
+		DefaultPackages: concreteSpecs(b.defaultPackages(def)),
+		Exes:            exes,
+		Parent:          def.Parent,
+		ProcessorTarget: def.ProcessorTarget,
+		AutoUpgrade:     def.AutoUpgrade,
+		Labels:          def.Labels,
+	}
+
+	var sb strings.Builder
+
+	if err := softpackTmpl.Execute(&sb, vars); err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
+}
+
+// concreteSpecs returns the names and requested versions of the given packages.
+func concreteSpecs(pkgs []core.Package) []ConcreteSpec {
+	specs := make([]ConcreteSpec, len(pkgs))
+
+	for i, pkg := range pkgs {
+		specs[i] = ConcreteSpec{Name: pkg.Name, Version: pkg.Version}
+	}
+
+	return specs
+}
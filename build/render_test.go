@@ -0,0 +1,93 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+)
+
+func TestRender(t *testing.T) {
+	Convey("Given a Builder", t, func() {
+		builder, _, ms3, _ := newTestBuilder(t, func(conf *config.Config) {
+			conf.Module.ModuleInstallDir = "/modules"
+			conf.Module.ScriptsInstallDir = "/scripts"
+			conf.Module.LoadPath = "HGI/softpack"
+		})
+
+		builder.inst.fs = fsmock.New()
+
+		def := getExampleDefinition()
+		def.Packages = append(def.Packages, core.Package{Name: "zlib"})
+
+		Convey("you can render what building a Definition would generate, without building it", func() {
+			rendering, err := builder.Render(context.Background(), def)
+			So(err, ShouldBeNil)
+			So(rendering.SingularityDef, ShouldContainSubstring, "xxhash@0.8.1 arch=None-None-x86_64_v4")
+			So(rendering.Module, ShouldContainSubstring, "Packages: xxhash@0.8.1, r-seurat@4, py-anndata@3.14, zlib")
+			So(rendering.Module, ShouldContainSubstring, "xxhash/0.8.1-scripts")
+			So(rendering.Usage, ShouldContainSubstring, "module load HGI/softpack/groups/hgi/xxhash/0.8.1")
+			So(rendering.SoftpackYML, ShouldEqual, `description: |
+  some help text
+
+  The following executables are added to your PATH:
+    - R
+    - Rscript
+    - python
+packages:
+  - xxhash@0.8.1
+  - r-seurat@4
+  - py-anndata@3.14
+  - zlib
+processor_target: x86_64_v4
+`)
+
+			So(ms3.Def, ShouldBeBlank)
+			So(builder.Status(), ShouldBeEmpty)
+			So(def.ProcessorTarget, ShouldBeBlank)
+
+			parsed, err := ParseSoftpackYML(strings.NewReader(rendering.SoftpackYML))
+			So(err, ShouldBeNil)
+			So(parsed.Packages, ShouldResemble, def.Packages)
+		})
+
+		Convey("invalid Definitions can't be rendered", func() {
+			def.Profile = "unknown"
+
+			_, err := builder.Render(context.Background(), def)
+			So(err, ShouldWrap, config.ErrUnknownProfile)
+
+			def.EnvironmentVersion = ""
+
+			_, err = builder.Render(context.Background(), def)
+			So(err, ShouldEqual, ErrInvalidVersion)
+		})
+	})
+}
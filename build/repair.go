@@ -0,0 +1,228 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
+)
+
+// RepairReport summarises a run of RepairAll: how many installed environments
+// were Checked, how many of those were Broken, and how many of the broken ones
+// were Repaired or Failed to be repaired. Environments describes each of the
+// broken ones. If DryRun, no repairs were attempted.
+type RepairReport struct {
+	DryRun       bool
+	Checked      int
+	Broken       int
+	Repaired     int
+	Failed       int
+	Environments []RepairResult
+}
+
+// RepairResult describes the Problems found with a broken installed
+// Environment ("users/foo/env-1"), whether it was Repaired, and if not, the
+// Error that prevented it.
+type RepairResult struct {
+	Environment string
+	Problems    []string
+	Repaired    bool
+	Error       string
+}
+
+// RepairAll runs the Verify checks on every environment installed in the
+// configured moduleInstallDir, and unless dryRun, repairs the broken ones by
+// reinstalling them from the S3 build location: the image is downloaded again,
+// and the module file and scripts are regenerated from the environment's
+// softpack.yml and executables list. Environments currently being built are
+// skipped.
+//
+// Returns a report of what was found and done; an error is only returned if the
+// installed environments couldn't be listed.
+func (b *Builder) RepairAll(ctx context.Context, dryRun bool) (*RepairReport, error) {
+	envs, err := b.installedEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{DryRun: dryRun}
+
+	for _, env := range envs {
+		v, errv := b.Verify(ctx, env[0], env[1])
+		if errv != nil {
+			continue
+		}
+
+		report.Checked++
+
+		if len(v.Problems) == 0 {
+			continue
+		}
+
+		report.Broken++
+
+		result := RepairResult{Environment: v.Environment, Problems: v.Problems}
+
+		if !dryRun {
+			b.repairResult(ctx, &result, env[0], env[1])
+
+			if result.Repaired {
+				report.Repaired++
+			} else {
+				report.Failed++
+			}
+		}
+
+		report.Environments = append(report.Environments, result)
+	}
+
+	return report, nil
+}
+
+// installedEnvironments returns the environment path (like "users/foo/env") and
+// version of every module file in the configured moduleInstallDir, sorted.
+func (b *Builder) installedEnvironments() ([][2]string, error) {
+	return installedEnvironmentsIn(b.inst.fs, b.config.Module.ModuleInstallDir)
+}
+
+// installedEnvironmentsIn returns the environment path and version of every
+// module file in the given moduleInstallDir, sorted.
+func installedEnvironmentsIn(filesystem fsys.FS, moduleInstallDir string) ([][2]string, error) {
+	var envs [][2]string
+
+	err := walkModules(filesystem, moduleInstallDir, "", func(envPath, version string) {
+		envs = append(envs, [2]string{envPath, version})
+	})
+
+	sort.Slice(envs, func(i, j int) bool {
+		if envs[i][0] != envs[j][0] {
+			return envs[i][0] < envs[j][0]
+		}
+
+		return envs[i][1] < envs[j][1]
+	})
+
+	return envs, err
+}
+
+// walkModules calls cb with the environment path and version of every valid
+// module file under the given dir, which corresponds to the given envPath
+// relative to the moduleInstallDir. Hidden files, like .version files and
+// archived installations, and symlinks, like default versions, are ignored.
+func walkModules(filesystem fsys.FS, dir, envPath string, cb func(envPath, version string)) error {
+	entries, err := filesystem.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		switch {
+		case strings.HasPrefix(name, "."), entry.Type()&fs.ModeSymlink != 0:
+		case entry.IsDir():
+			if err = walkModules(filesystem, filepath.Join(dir, name), path.Join(envPath, name), cb); err != nil {
+				return err
+			}
+		case ValidateEnvironmentPath(envPath, name) == nil:
+			cb(envPath, name)
+		}
+	}
+
+	return nil
+}
+
+func (b *Builder) repairResult(ctx context.Context, result *RepairResult, envPath, version string) {
+	if err := b.Repair(ctx, envPath, version); err != nil {
+		result.Error = err.Error()
+
+		return
+	}
+
+	result.Repaired = true
+}
+
+// Repair reinstalls the given environment (a path like "users/foo/env") and
+// version from its S3 build location, atomically replacing its image, module
+// file and scripts. The module file is regenerated using the Definition the
+// environment was last requested with since we started, or else one parsed
+// from its softpack.yml with the configured module conflicts and prereqs.
+//
+// Returns ErrEnvironmentBuilding if the environment is currently being built.
+func (b *Builder) Repair(ctx context.Context, envPath, version string) error {
+	def, err := b.repairDefinition(ctx, envPath, version)
+	if err != nil {
+		return err
+	}
+
+	if _, err = b.protectEnvironment(def.FullEnvironmentPath(), &err); err != nil {
+		return err
+	}
+
+	defer b.unprotectEnvironment(def.FullEnvironmentPath())
+
+	s3Path := filepath.Join(envPath, version)
+
+	exes, err := b.getExes(ctx, s3Path)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.installEnvironment(ctx, def, s3Path, exes)
+
+	return err
+}
+
+// repairDefinition returns a Definition with which to reinstall the given
+// environment.
+func (b *Builder) repairDefinition(ctx context.Context, envPath, version string) (*Definition, error) {
+	b.statusMu.RLock()
+	remembered, ok := b.definitions[envPath+"-"+version]
+	b.statusMu.RUnlock()
+
+	var def *Definition
+
+	if ok {
+		stored := *remembered
+		def = &stored
+	} else {
+		var err error
+
+		if def, err = b.readSoftpackYML(ctx, envPath, version); err != nil {
+			return nil, err
+		}
+
+		def.Conflicts = b.config.Module.Conflicts
+		def.Prereqs = b.config.Module.Prereqs
+	}
+
+	def.Force = true
+
+	return def, nil
+}
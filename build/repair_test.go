@@ -0,0 +1,135 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestRepair(t *testing.T) {
+	Convey("Given an installed environment", t, func() {
+		var conf config.Config
+		conf.Module.ModuleInstallDir = t.TempDir()
+		conf.Module.ScriptsInstallDir = t.TempDir()
+		conf.Module.DefaultVersion = config.DefaultVersionLmod
+
+		ms3 := &s3mock.MockS3{
+			Exes: "xxhsum",
+			SoftpackYML: "description: |\n  some help text\n\n" +
+				"  The following executables are added to your PATH:\n    - xxhsum\n" +
+				"packages:\n  - xxhash@0.8.1\n",
+			Readme: "readme",
+			Def:    "groups/hgi/xxhash/1/" + core.SingularityDefBasename,
+			Data:   "def",
+		}
+
+		builder, err := New(&conf, ms3, nil)
+		So(err, ShouldBeNil)
+
+		ctx := context.Background()
+
+		So(builder.Repair(ctx, "groups/hgi/xxhash", "1"), ShouldBeNil)
+
+		scriptsDir := ScriptsDirFromNameAndVersion(conf.Module.ScriptsInstallDir, "groups/hgi", "xxhash", "1")
+		modulePath := filepath.Join(ModuleDirFromName(conf.Module.ModuleInstallDir, "groups/hgi", "xxhash"), "1")
+
+		_, err = os.Lstat(filepath.Join(filepath.Dir(modulePath), "default"))
+		So(err, ShouldBeNil)
+
+		data, err := os.ReadFile(modulePath)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldContainSubstring, `puts stderr "some help text"`)
+		So(string(data), ShouldContainSubstring, `module-whatis "Packages: xxhash@0.8.1"`)
+
+		Convey("you can check it without repairing them", func() {
+			report, errr := builder.RepairAll(ctx, true)
+			So(errr, ShouldBeNil)
+			So(report, ShouldResemble, &RepairReport{DryRun: true, Checked: 1})
+
+			So(os.WriteFile(filepath.Join(scriptsDir, core.ImageBasename), []byte("other"), 0600), ShouldBeNil)
+			So(os.WriteFile(modulePath, []byte("#%Module\n"), 0600), ShouldBeNil)
+
+			report, errr = builder.RepairAll(ctx, true)
+			So(errr, ShouldBeNil)
+			So(report.Checked, ShouldEqual, 1)
+			So(report.Broken, ShouldEqual, 1)
+			So(report.Repaired, ShouldEqual, 0)
+			So(report.Failed, ShouldEqual, 0)
+			So(len(report.Environments), ShouldEqual, 1)
+			So(report.Environments[0].Environment, ShouldEqual, "groups/hgi/xxhash-1")
+			So(len(report.Environments[0].Problems), ShouldEqual, 2)
+			So(report.Environments[0].Repaired, ShouldBeFalse)
+
+			data, err = os.ReadFile(modulePath)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "#%Module\n")
+
+			Convey("and then repair the broken ones", func() {
+				report, errr = builder.RepairAll(ctx, false)
+				So(errr, ShouldBeNil)
+				So(report.Broken, ShouldEqual, 1)
+				So(report.Repaired, ShouldEqual, 1)
+				So(report.Failed, ShouldEqual, 0)
+				So(report.Environments[0].Repaired, ShouldBeTrue)
+
+				data, err = os.ReadFile(filepath.Join(scriptsDir, core.ImageBasename))
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "image")
+
+				data, err = os.ReadFile(modulePath)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldContainSubstring, `module-whatis "Packages: xxhash@0.8.1"`)
+
+				report, errr = builder.RepairAll(ctx, false)
+				So(errr, ShouldBeNil)
+				So(report, ShouldResemble, &RepairReport{Checked: 1})
+			})
+
+			Convey("and failures to repair are reported", func() {
+				ms3.SoftpackYML = ""
+
+				report, errr = builder.RepairAll(ctx, false)
+				So(errr, ShouldBeNil)
+				So(report.Repaired, ShouldEqual, 0)
+				So(report.Failed, ShouldEqual, 1)
+				So(report.Environments[0].Error, ShouldNotBeBlank)
+			})
+		})
+
+		Convey("environments being built aren't repaired", func() {
+			fn, errp := builder.protectEnvironment("groups/hgi/xxhash-1", &err)
+			So(errp, ShouldBeNil)
+			So(fn, ShouldNotBeNil)
+
+			So(builder.Repair(ctx, "groups/hgi/xxhash", "1"), ShouldEqual, ErrEnvironmentBuilding)
+		})
+	})
+}
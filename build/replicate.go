@@ -0,0 +1,284 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/s3"
+)
+
+// replicatedFiles returns the artefacts of the given Definition's successful
+// build that get mirrored to the replica S3 location: its image and
+// executables, and those of the artefacts it sent to core that were also stored
+// in its S3 location.
+func replicatedFiles(def *Definition) []string {
+	files := []string{core.ImageBasename, core.ExesBasename}
+
+	for _, name := range defaultArtefacts {
+		if slices.Contains(coreOnlyArtefacts, name) || (name == core.SpackYAMLBasename && def.SpackYAML == "") {
+			continue
+		}
+
+		files = append(files, name)
+	}
+
+	return files
+}
+
+// ReplicationStatus reports on the mirroring of build artefacts to the
+// configured replica S3 location. Pending is the number of builds whose
+// artefacts haven't been copied yet, and LagSeconds is how long the oldest of
+// those has been waiting. LastError describes why the most recent copy failed,
+// and is cleared by the next successful one.
+type ReplicationStatus struct {
+	Enabled        bool
+	Pending        int
+	LagSeconds     float64
+	LastReplicated *time.Time
+	LastError      string
+}
+
+// replicator copies build artefacts from one S3 to another in the background,
+// straight away, or when its schedule says to, if it has one.
+type replicator struct {
+	src, dst S3
+	backoff  retryBackoff
+	schedule *scheduler
+
+	mu             sync.Mutex
+	pending        map[string]time.Time
+	files          map[string][]string
+	copying        map[string]bool
+	lastReplicated *time.Time
+	lastError      string
+}
+
+// newReplicatorFromConfig returns a replicator that copies from src to the
+// configured replica location, or nil if replication isn't configured.
+func newReplicatorFromConfig(conf *config.Config, src S3) (*replicator, error) {
+	if !conf.Replication.Enabled() {
+		return nil, nil //nolint:nilnil
+	}
+
+	var schedule *scheduler
+
+	if conf.Replication.Schedule.Enabled() {
+		var err error
+
+		if schedule, err = newScheduler(conf.Replication.Schedule, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	dst, err := s3.NewForProfile(conf.Replication.Profile, conf.Replication.BuildBase, conf.Timeouts.S3())
+	if err != nil {
+		return nil, err
+	}
+
+	r := newReplicator(src, dst, retryBackoff{
+		initial: conf.Replication.RetryInterval(),
+		max:     conf.Replication.MaxRetryInterval(),
+	})
+	r.schedule = schedule
+
+	return r, nil
+}
+
+func newReplicator(src, dst S3, backoff retryBackoff) *replicator {
+	return &replicator{
+		src:     src,
+		dst:     dst,
+		backoff: backoff,
+		pending: make(map[string]time.Time),
+		files:   make(map[string][]string),
+		copying: make(map[string]bool),
+	}
+}
+
+// replicate copies the given files of the build in the given S3 path to our dst
+// in the background, retrying with our backoff until they have all been
+// copied. Does nothing more if that build's artefacts are already pending,
+// since the next attempt will copy the latest ones.
+//
+// If we have a schedule, the copy only starts when it next says to.
+func (r *replicator) replicate(ctx context.Context, s3Path string, files []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.files[s3Path] = files
+
+	if _, ok := r.pending[s3Path]; ok {
+		return
+	}
+
+	r.pending[s3Path] = time.Now()
+
+	if r.schedule != nil {
+		r.schedule.trigger()
+
+		return
+	}
+
+	r.startCopying(ctx, s3Path)
+}
+
+// startCopying starts copying the artefacts of the build in the given S3 path
+// in the background. You must hold the lock.
+func (r *replicator) startCopying(ctx context.Context, s3Path string) {
+	r.copying[s3Path] = true
+
+	go r.replicateUntilDone(ctx, s3Path)
+}
+
+// replicatePending starts copying all the pending builds that we haven't
+// started copying yet.
+func (r *replicator) replicatePending(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for s3Path := range r.pending {
+		if !r.copying[s3Path] {
+			r.startCopying(ctx, s3Path)
+		}
+	}
+}
+
+func (r *replicator) replicateUntilDone(ctx context.Context, s3Path string) {
+	logger := loggerFromContext(ctx)
+
+	err := r.backoff.retry(ctx, func() error {
+		return r.copyFiles(ctx, s3Path)
+	}, func(err error, wait time.Duration) {
+		r.mu.Lock()
+		r.lastError = err.Error()
+		r.mu.Unlock()
+
+		logger.Warn("replicating build artefacts failed; will retry", "err", err, "retryIn", wait)
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.pending, s3Path)
+	delete(r.copying, s3Path)
+	delete(r.files, s3Path)
+
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	r.lastReplicated = &now
+	r.lastError = ""
+
+	logger.Debug("replicated build artefacts")
+}
+
+func (r *replicator) copyFiles(ctx context.Context, s3Path string) error {
+	r.mu.Lock()
+	files := r.files[s3Path]
+	r.mu.Unlock()
+
+	for _, file := range files {
+		if err := r.copyFile(ctx, filepath.Join(s3Path, file)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *replicator) copyFile(ctx context.Context, path string) error {
+	data, err := r.src.OpenFile(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	defer data.Close()
+
+	return r.dst.UploadData(ctx, data, path)
+}
+
+func (r *replicator) status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := ReplicationStatus{
+		Enabled:        true,
+		Pending:        len(r.pending),
+		LastReplicated: r.lastReplicated,
+		LastError:      r.lastError,
+	}
+
+	for _, queued := range r.pending {
+		if lag := time.Since(queued).Seconds(); lag > status.LagSeconds {
+			status.LagSeconds = lag
+		}
+	}
+
+	return status
+}
+
+// ReplicationStatus reports on the mirroring of the artefacts of successful
+// builds to the configured replica S3 location. If replication isn't
+// configured, Enabled will be false.
+func (b *Builder) ReplicationStatus() ReplicationStatus {
+	if b.replicator == nil {
+		return ReplicationStatus{}
+	}
+
+	return b.replicator.status()
+}
+
+// ReplicateOnSchedule copies the artefacts of successful builds to the replica
+// location when the configured replication schedule says to, until the given
+// context is cancelled. Does nothing if replication isn't configured or
+// doesn't have a schedule, since builds are then copied straight away.
+func (b *Builder) ReplicateOnSchedule(ctx context.Context) {
+	if b.replicator == nil || b.replicator.schedule == nil {
+		return
+	}
+
+	b.replicator.schedule.run(ctx, false, func() {
+		b.replicator.replicatePending(ctx)
+	})
+}
+
+// replicate mirrors the artefacts of the given Definition's successful build in
+// the given S3 path to the replica location in the background, if replication
+// is configured.
+func (b *Builder) replicate(ctx context.Context, def *Definition, s3Path string) {
+	if b.replicator == nil {
+		return
+	}
+
+	b.replicator.replicate(context.WithoutCancel(ctx), s3Path, replicatedFiles(def))
+}
@@ -0,0 +1,219 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+// mapS3 is an S3 that stores files in memory, and fails uploads while fail is
+// true.
+type mapS3 struct {
+	mu    sync.Mutex
+	files map[string]string
+	fail  bool
+}
+
+func (m *mapS3) UploadData(_ context.Context, data io.Reader, dest string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail {
+		return s3mock.ErrS3Mock
+	}
+
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	m.files[dest] = string(buf)
+
+	return nil
+}
+
+func (m *mapS3) OpenFile(_ context.Context, source string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.files[source]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	return io.NopCloser(strings.NewReader(data)), nil
+}
+
+func (m *mapS3) setFail(fail bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fail = fail
+}
+
+func (m *mapS3) numFiles() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.files)
+}
+
+func TestReplication(t *testing.T) {
+	Convey("Builds replicate their image, executables and the artefacts they stored in S3", t, func() {
+		def := getExampleDefinition()
+		files := replicatedFiles(def)
+		So(files, ShouldContain, core.ImageBasename)
+		So(files, ShouldContain, core.ExesBasename)
+		So(files, ShouldContain, core.SoftpackYaml)
+		So(files, ShouldContain, core.ProvenanceBasename)
+		So(files, ShouldNotContain, core.SpackYAMLBasename)
+		So(files, ShouldNotContain, core.ModuleForCoreBasename)
+
+		def.SpackYAML = "spack:\n  specs: [xxhash]\n"
+		So(replicatedFiles(def), ShouldContain, core.SpackYAMLBasename)
+	})
+
+	Convey("Given source and destination S3s", t, func() {
+		s3Path := "users/foo/env/1"
+		src := &mapS3{files: make(map[string]string)}
+		dst := &mapS3{files: make(map[string]string)}
+		files := replicatedFiles(getExampleDefinition())
+
+		for _, file := range files {
+			src.files[filepath.Join(s3Path, file)] = file + " data"
+		}
+
+		src.files[filepath.Join(s3Path, "other")] = "not replicated"
+
+		r := newReplicator(src, dst, retryBackoff{initial: 10 * time.Millisecond, max: 10 * time.Millisecond})
+		So(r.status(), ShouldResemble, ReplicationStatus{Enabled: true})
+
+		Convey("a replicator copies build artefacts in the background", func() {
+			r.replicate(context.Background(), s3Path, files)
+
+			ok := waitFor(func() bool {
+				return r.status().Pending == 0
+			})
+			So(ok, ShouldBeTrue)
+			So(dst.numFiles(), ShouldEqual, len(files))
+			So(dst.files[filepath.Join(s3Path, "singularity.sif")], ShouldEqual, "singularity.sif data")
+
+			status := r.status()
+			So(status.LastReplicated, ShouldNotBeNil)
+			So(status.LastError, ShouldBeBlank)
+			So(status.LagSeconds, ShouldEqual, 0)
+		})
+
+		Convey("failed copies are retried, with the lag reported meanwhile", func() {
+			dst.setFail(true)
+			r.replicate(context.Background(), s3Path, files)
+
+			ok := waitFor(func() bool {
+				return r.status().LastError != ""
+			})
+			So(ok, ShouldBeTrue)
+
+			status := r.status()
+			So(status.Pending, ShouldEqual, 1)
+			So(status.LagSeconds, ShouldBeGreaterThan, 0)
+			So(status.LastReplicated, ShouldBeNil)
+			So(status.LastError, ShouldEqual, s3mock.ErrS3Mock.Error())
+
+			r.replicate(context.Background(), s3Path, files)
+			So(r.status().Pending, ShouldEqual, 1)
+
+			dst.setFail(false)
+
+			ok = waitFor(func() bool {
+				return r.status().Pending == 0
+			})
+			So(ok, ShouldBeTrue)
+			So(dst.numFiles(), ShouldEqual, len(files))
+			So(r.status().LastError, ShouldBeBlank)
+		})
+	})
+
+	Convey("Given a replicator with a debouncing schedule", t, func() {
+		src := &mapS3{files: make(map[string]string)}
+		dst := &mapS3{files: make(map[string]string)}
+		paths := []string{"users/foo/env/1", "users/foo/env/2"}
+		files := replicatedFiles(getExampleDefinition())
+
+		for _, s3Path := range paths {
+			for _, file := range files {
+				src.files[filepath.Join(s3Path, file)] = file + " data"
+			}
+		}
+
+		schedule, err := newScheduler(config.Schedule{DebounceSeconds: 1}, 0)
+		So(err, ShouldBeNil)
+
+		schedule.debounce = 20 * time.Millisecond
+
+		r := newReplicator(src, dst, retryBackoff{initial: 10 * time.Millisecond, max: 10 * time.Millisecond})
+		r.schedule = schedule
+
+		builder := &Builder{replicator: r}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go builder.ReplicateOnSchedule(ctx)
+
+		Convey("builds are only copied once a burst of them is over", func() {
+			for _, s3Path := range paths {
+				r.replicate(context.Background(), s3Path, files)
+			}
+
+			So(r.status().Pending, ShouldEqual, 2)
+			So(dst.numFiles(), ShouldEqual, 0)
+
+			ok := waitFor(func() bool {
+				return r.status().Pending == 0
+			})
+			So(ok, ShouldBeTrue)
+			So(dst.numFiles(), ShouldEqual, 2*len(files))
+		})
+	})
+
+	Convey("Builders without replication configured report it disabled", t, func() {
+		builder, err := New(&config.Config{}, &s3mock.MockS3{}, nil)
+		So(err, ShouldBeNil)
+		So(builder.ReplicationStatus(), ShouldResemble, ReplicationStatus{})
+
+		builder.replicate(context.Background(), getExampleDefinition(), "users/foo/env/1")
+	})
+}
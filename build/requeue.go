@@ -0,0 +1,53 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import "context"
+
+// rememberDefinition stores a copy of the given Definition, so that its build
+// can be requeued later.
+func (b *Builder) rememberDefinition(def *Definition) {
+	stored := *def
+
+	b.statusMu.Lock()
+	b.definitions[def.FullEnvironmentPath()] = &stored
+	b.statusMu.Unlock()
+}
+
+// Requeue builds the given environment (a full environment path like
+// "users/foo/env-1", as per Status.Name) again, using the Definition it was
+// last requested with. Returns ErrUnknownBuild if it has never been requested,
+// or ErrEnvironmentBuilding if it is currently being built.
+func (b *Builder) Requeue(ctx context.Context, envPath string) error {
+	b.statusMu.RLock()
+	def, ok := b.definitions[envPath]
+	b.statusMu.RUnlock()
+
+	if !ok {
+		return ErrUnknownBuild
+	}
+
+	requeued := *def
+
+	return b.Build(ctx, &requeued)
+}
@@ -0,0 +1,73 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRequeue(t *testing.T) {
+	Convey("Given a Builder", t, func() {
+		builder, _, ms3, mwr := newTestBuilder(t, nil)
+
+		def := getExampleDefinition()
+		envPath := def.FullEnvironmentPath()
+
+		Convey("you can't requeue an environment that was never requested", func() {
+			So(builder.Requeue(context.Background(), envPath), ShouldEqual, ErrUnknownBuild)
+		})
+
+		Convey("you can requeue a requested environment once its build is over", func() {
+			err := builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			So(builder.Requeue(context.Background(), envPath), ShouldEqual, ErrEnvironmentBuilding)
+
+			firstID := builder.Status()[0].BuildID
+
+			mwr.SetComplete()
+
+			So(waitFor(func() bool {
+				return builder.Status()[0].BuildDone != nil
+			}), ShouldBeTrue)
+
+			ms3.Def = ""
+
+			So(waitFor(func() bool {
+				err = builder.Requeue(context.Background(), envPath)
+
+				return !errors.Is(err, ErrEnvironmentBuilding)
+			}), ShouldBeTrue)
+			So(err, ShouldBeNil)
+			So(ms3.Def, ShouldNotBeBlank)
+
+			statuses := builder.Status()
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].BuildID, ShouldNotEqual, firstID)
+		})
+	})
+}
@@ -0,0 +1,90 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	_ "embed"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// RStudioBasename is the name of the script installed in to the scripts
+// directories of R environments built with RStudio requested, that runs
+// RStudio Server against the environment.
+const RStudioBasename = "rstudio"
+
+//go:embed rstudio.tmpl
+var rstudioTmplStr string
+var rstudioTmpl = template.Must(template.New("").Parse(rstudioTmplStr)) //nolint:gochecknoglobals
+
+// WantsRStudio returns true if RStudio was requested and we have R.
+func (d *Definition) WantsRStudio() bool {
+	return d.RStudio && slices.Contains(d.Interpreters(), "R")
+}
+
+// rstudioScript returns the contents of a script that runs the RStudio Server
+// installed in serverDir using the R in the given image, binding in serverDir
+// and the given binds.
+func (d *Definition) rstudioScript(image, serverDir string, binds []string) string {
+	var sb strings.Builder
+
+	rstudioTmpl.Execute(&sb, struct { //nolint:errcheck
+		Environment string
+		Image       string
+		ServerDir   string
+		Binds       []string
+	}{
+		Environment: d.FullEnvironmentPath(),
+		Image:       image,
+		ServerDir:   serverDir,
+		Binds:       binds,
+	})
+
+	return sb.String()
+}
+
+// installRStudio installs an RStudio Server launcher in to the given
+// environment's scripts directory, if it wants one and an RStudio Server
+// installation has been configured.
+func (b *Builder) installRStudio(def *Definition) error {
+	conf := b.config.Module.RStudio
+	if conf.ServerDir == "" || !def.WantsRStudio() {
+		return nil
+	}
+
+	scriptsDir := b.scriptsDir(def)
+	path := filepath.Join(scriptsDir, RStudioBasename)
+
+	script := def.rstudioScript(filepath.Join(scriptsDir, core.ImageBasename), conf.ServerDir, conf.Binds)
+
+	if err := b.inst.replaceFile(strings.NewReader(script), path); err != nil {
+		return err
+	}
+
+	return b.inst.fs.Chmod(path, b.inst.fileMode|execPerms)
+}
@@ -0,0 +1,100 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestRStudio(t *testing.T) {
+	Convey("Given a Definition", t, func() {
+		def := getExampleDefinition()
+
+		Convey("it only wants RStudio if requested and it has R", func() {
+			So(def.WantsRStudio(), ShouldBeFalse)
+
+			def.RStudio = true
+			So(def.WantsRStudio(), ShouldBeTrue)
+
+			def.Packages = def.Packages[:1]
+			So(def.WantsRStudio(), ShouldBeFalse)
+
+			def.Packages = append(def.Packages, core.Package{Name: "r-irkernel"})
+			So(def.WantsRStudio(), ShouldBeTrue)
+
+			def.RStudio = false
+			So(def.WantsRStudio(), ShouldBeFalse)
+		})
+
+		Convey("an RStudio launcher can be installed in to its scripts directory", func() {
+			var conf config.Config
+			conf.Module.ScriptsInstallDir = t.TempDir()
+
+			builder, err := New(&conf, &s3mock.MockS3{}, nil)
+			So(err, ShouldBeNil)
+
+			scriptsDir := ScriptsDirFromNameAndVersion(conf.Module.ScriptsInstallDir,
+				def.EnvironmentPath, def.EnvironmentName, def.EnvironmentVersion)
+			err = os.MkdirAll(scriptsDir, dirPerms)
+			So(err, ShouldBeNil)
+
+			path := filepath.Join(scriptsDir, RStudioBasename)
+
+			def.RStudio = true
+
+			So(builder.installRStudio(def), ShouldBeNil)
+			_, err = os.Stat(path)
+			So(err, ShouldNotBeNil)
+
+			conf.Module.RStudio.ServerDir = "/opt/rstudio-server"
+			conf.Module.RStudio.Binds = []string{"/lustre", "/nfs"}
+
+			So(builder.installRStudio(def), ShouldBeNil)
+
+			info, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(perms|execPerms))
+
+			data, err := os.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `
+	--bind "/opt/rstudio-server" \
+	--bind "/lustre" \
+	--bind "/nfs" \
+	"`+filepath.Join(scriptsDir, core.ImageBasename)+`" \
+	"/opt/rstudio-server/bin/rserver" \
+`)
+			So(string(data), ShouldContainSubstring, "--auth-none=1")
+			So(string(data), ShouldContainSubstring, `--server-user="$USER"`)
+			So(string(data), ShouldContainSubstring, "groups/hgi/xxhash-0.8.1")
+		})
+	})
+}
@@ -0,0 +1,234 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+)
+
+// retryBackoff describes how long to wait between attempts at some background
+// work that keeps failing: initial after the first failure, doubling after
+// each subsequent one, up to max.
+type retryBackoff struct {
+	initial time.Duration
+	max     time.Duration
+}
+
+// wait returns how long to wait after the given number of consecutive
+// failures.
+func (r retryBackoff) wait(failures int) time.Duration {
+	wait := r.initial
+
+	for i := 1; i < failures && wait < r.max; i++ {
+		wait *= 2
+	}
+
+	return min(wait, max(r.max, r.initial))
+}
+
+// retry calls fn until it returns nil, telling failed about each error and
+// how long we'll wait before trying again. Returns the context's error if it
+// is cancelled first.
+func (r retryBackoff) retry(ctx context.Context, fn func() error, failed func(err error, wait time.Duration)) error {
+	for failures := 1; ; failures++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		wait := r.wait(failures)
+		failed(err, wait)
+
+		if err = sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// sleepContext waits for the given duration, returning early with the
+// context's error if it is cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// scheduler runs some background work according to a config.Schedule: every
+// interval, or at the times of its cron expression, and when triggered, if it
+// debounces or throttles triggers.
+type scheduler struct {
+	interval time.Duration
+	cron     *cronSchedule
+	debounce time.Duration
+	throttle time.Duration
+	triggers chan struct{}
+}
+
+// newScheduler returns a scheduler for the given config.Schedule, that runs
+// work every interval if the schedule doesn't have a cron expression. A zero
+// interval means work only runs when triggered.
+func newScheduler(conf config.Schedule, interval time.Duration) (*scheduler, error) {
+	s := &scheduler{
+		interval: interval,
+		debounce: conf.Debounce(),
+		throttle: conf.Throttle(),
+		triggers: make(chan struct{}, 1),
+	}
+
+	if conf.Cron == "" {
+		return s, nil
+	}
+
+	cron, err := parseCron(conf.Cron)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cron = cron
+
+	return s, nil
+}
+
+// trigger asks for the work to be run, once the debounce or throttle wait is
+// over. Triggers are ignored if we neither debounce nor throttle.
+func (s *scheduler) trigger() {
+	select {
+	case s.triggers <- struct{}{}:
+	default:
+	}
+}
+
+// run calls fn according to our schedule until the given context is
+// cancelled, first calling it straight away if immediately is true.
+func (s *scheduler) run(ctx context.Context, immediately bool, fn func()) {
+	var last time.Time
+
+	call := func() {
+		last = time.Now()
+
+		fn()
+	}
+
+	if immediately {
+		call()
+	}
+
+	periodic := s.periodicTimer()
+	defer periodic.Stop()
+
+	delayed := newStoppedTimer()
+	defer delayed.Stop()
+
+	pending := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-periodic.C:
+			call()
+			s.resetPeriodic(periodic)
+		case <-s.triggers:
+			if wait, ok := s.triggeredWait(last, pending); ok {
+				resetTimer(delayed, wait)
+
+				pending = true
+			}
+		case <-delayed.C:
+			pending = false
+
+			call()
+		}
+	}
+}
+
+// periodicTimer returns a timer that fires when the work is next due to run
+// periodically, which never fires if it isn't.
+func (s *scheduler) periodicTimer() *time.Timer {
+	t := newStoppedTimer()
+	s.resetPeriodic(t)
+
+	return t
+}
+
+// resetPeriodic resets the given fired or stopped timer to fire when the work
+// is next due to run periodically, if it is.
+func (s *scheduler) resetPeriodic(t *time.Timer) {
+	if s.cron != nil {
+		now := time.Now()
+
+		if next, ok := s.cron.next(now); ok {
+			t.Reset(next.Sub(now))
+		}
+
+		return
+	}
+
+	if s.interval > 0 {
+		t.Reset(s.interval)
+	}
+}
+
+// triggeredWait returns how long to wait before running the work after a
+// trigger, given when it last ran and if a run is already pending. Returns
+// false if the trigger should not cause a run, or change the pending one.
+func (s *scheduler) triggeredWait(last time.Time, pending bool) (time.Duration, bool) {
+	switch {
+	case s.debounce > 0:
+		return s.debounce, true
+	case s.throttle > 0 && !pending:
+		return max(0, time.Until(last.Add(s.throttle))), true
+	default:
+		return 0, false
+	}
+}
+
+func newStoppedTimer() *time.Timer {
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+
+	return t
+}
+
+// resetTimer resets the given timer to fire after d, whether or not it has
+// already fired.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+
+	t.Reset(d)
+}
@@ -0,0 +1,190 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	Convey("A retryBackoff doubles its wait after each failure, up to its max", t, func() {
+		r := retryBackoff{initial: time.Second, max: 5 * time.Second}
+
+		So(r.wait(1), ShouldEqual, time.Second)
+		So(r.wait(2), ShouldEqual, 2*time.Second)
+		So(r.wait(3), ShouldEqual, 4*time.Second)
+		So(r.wait(4), ShouldEqual, 5*time.Second)
+		So(r.wait(100), ShouldEqual, 5*time.Second)
+
+		r.max = 0
+		So(r.wait(3), ShouldEqual, time.Second)
+	})
+
+	Convey("retry calls a function until it succeeds, reporting each failure", t, func() {
+		r := retryBackoff{initial: time.Millisecond, max: 2 * time.Millisecond}
+		errFail := errors.New("fail")
+		calls := 0
+
+		var waits []time.Duration
+
+		err := r.retry(context.Background(), func() error {
+			calls++
+			if calls < 4 {
+				return errFail
+			}
+
+			return nil
+		}, func(err error, wait time.Duration) {
+			So(err, ShouldEqual, errFail)
+
+			waits = append(waits, wait)
+		})
+		So(err, ShouldBeNil)
+		So(calls, ShouldEqual, 4)
+		So(waits, ShouldResemble, []time.Duration{time.Millisecond, 2 * time.Millisecond, 2 * time.Millisecond})
+
+		Convey("but gives up when its context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			r.initial = time.Hour
+			r.max = time.Hour
+
+			err := r.retry(ctx, func() error {
+				return errFail
+			}, func(error, time.Duration) {
+				cancel()
+			})
+			So(err, ShouldEqual, context.Canceled)
+		})
+	})
+
+}
+
+func TestScheduler(t *testing.T) {
+	Convey("A scheduler calls a function periodically until its context is cancelled", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var calls atomic.Int32
+
+		s, err := newScheduler(config.Schedule{}, time.Millisecond)
+		So(err, ShouldBeNil)
+
+		done := make(chan struct{})
+
+		go func() {
+			s.run(ctx, true, func() {
+				if calls.Add(1) == 3 {
+					cancel()
+				}
+			})
+			close(done)
+		}()
+
+		<-done
+		So(calls.Load(), ShouldBeGreaterThanOrEqualTo, 3)
+	})
+
+	Convey("Given a way to run a scheduler in the background", t, func() {
+		var calls atomic.Int32
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		start := func(s *scheduler, immediately bool) {
+			go s.run(ctx, immediately, func() {
+				calls.Add(1)
+			})
+		}
+
+		Convey("a debouncing scheduler runs once, after a burst of triggers is over", func() {
+			s, err := newScheduler(config.Schedule{DebounceSeconds: 1}, 0)
+			So(err, ShouldBeNil)
+
+			s.debounce = 50 * time.Millisecond
+			start(s, false)
+
+			for i := 0; i < 5; i++ {
+				s.trigger()
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			So(calls.Load(), ShouldEqual, 0)
+			So(waitFor(func() bool { return calls.Load() == 1 }), ShouldBeTrue)
+
+			time.Sleep(100 * time.Millisecond)
+			So(calls.Load(), ShouldEqual, 1)
+		})
+
+		Convey("a throttling scheduler runs at most once per wait, for any number of triggers", func() {
+			s, err := newScheduler(config.Schedule{ThrottleSeconds: 1}, 0)
+			So(err, ShouldBeNil)
+
+			s.throttle = 100 * time.Millisecond
+			start(s, true)
+
+			So(waitFor(func() bool { return calls.Load() == 1 }), ShouldBeTrue)
+
+			for i := 0; i < 5; i++ {
+				s.trigger()
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			So(calls.Load(), ShouldEqual, 1)
+
+			So(waitFor(func() bool { return calls.Load() == 2 }), ShouldBeTrue)
+
+			time.Sleep(150 * time.Millisecond)
+			So(calls.Load(), ShouldEqual, 2)
+		})
+
+		Convey("triggers are ignored without debouncing or throttling", func() {
+			s, err := newScheduler(config.Schedule{}, 0)
+			So(err, ShouldBeNil)
+
+			start(s, false)
+			s.trigger()
+
+			time.Sleep(20 * time.Millisecond)
+			So(calls.Load(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Schedules with invalid cron expressions are rejected", t, func() {
+		_, err := newScheduler(config.Schedule{Cron: "* * *"}, time.Hour)
+		So(err, ShouldEqual, ErrInvalidCron)
+
+		conf := &config.Config{}
+		conf.Images.Schedule.Cron = "61 * * * *"
+
+		_, err = New(conf, &s3mock.MockS3{}, nil)
+		So(err, ShouldEqual, ErrInvalidCron)
+	})
+}
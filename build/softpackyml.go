@@ -0,0 +1,109 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	ErrInvalidSoftpackYML = internal.Error("invalid softpack.yml")
+
+	// exesHeading starts the part of a softpack.yml description that lists the
+	// environment's executables, which softpack.tmpl appends to the requested
+	// description.
+	exesHeading = "The following executables are added to your PATH:"
+)
+
+// softpackYML is the structure of the softpack.yml files generated from
+// softpack.tmpl.
+type softpackYML struct {
+	Description     string            `yaml:"description"`
+	Packages        []string          `yaml:"packages"`
+	Parent          string            `yaml:"parent"`
+	ProcessorTarget string            `yaml:"processor_target"`
+	AutoUpgrade     bool              `yaml:"auto_upgrade"`
+	Labels          map[string]string `yaml:"labels"`
+}
+
+// ParseSoftpackYML reads a softpack.yml, as generated for an environment we
+// built, back in to a Definition with the originally requested Description,
+// the concrete Packages (with their versions), and any Parent, ProcessorTarget,
+// AutoUpgrade opt-in and Labels. The environment path, name and version are not
+// set.
+//
+// Returns an error wrapping ErrInvalidSoftpackYML if the data can't be parsed
+// or has no packages.
+func ParseSoftpackYML(r io.Reader) (*Definition, error) {
+	var syml softpackYML
+
+	if err := yaml.NewDecoder(r).Decode(&syml); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSoftpackYML, err)
+	}
+
+	if len(syml.Packages) == 0 {
+		return nil, fmt.Errorf("%w: no packages", ErrInvalidSoftpackYML)
+	}
+
+	def := &Definition{
+		Description:     softpackYMLDescription(syml.Description),
+		Packages:        make(core.Packages, len(syml.Packages)),
+		Parent:          syml.Parent,
+		ProcessorTarget: syml.ProcessorTarget,
+		AutoUpgrade:     syml.AutoUpgrade,
+		Labels:          syml.Labels,
+	}
+
+	for i, pkg := range syml.Packages {
+		name, version, _ := strings.Cut(pkg, "@")
+		if name == "" {
+			return nil, fmt.Errorf("%w: invalid package %q", ErrInvalidSoftpackYML, pkg)
+		}
+
+		def.Packages[i] = core.Package{Name: name, Version: version}
+	}
+
+	return def, nil
+}
+
+// softpackYMLDescription returns the requested description from a softpack.yml
+// description, which has the environment's executables appended.
+func softpackYMLDescription(desc string) string {
+	if i := strings.Index(desc, exesHeading); i != -1 {
+		desc = desc[:i]
+	}
+
+	lines := strings.Split(strings.TrimRight(desc, " \n"), "\n")
+
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,99 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+func TestParseSoftpackYML(t *testing.T) {
+	Convey("You can parse a softpack.yml generated by softpack.tmpl back in to a Definition", t, func() {
+		vars := softpackTemplateVars{
+			Description: []string{"some help text", "", "over several lines"},
+			Packages: []ConcreteSpec{
+				{Name: "xxhash", Version: "0.8.1"},
+				{Name: "py-anndata", Version: "3.14"},
+				{Name: "r-seurat", Version: "4"},
+			},
+			Exes:            []string{"xxhsum", "R"},
+			Parent:          "users/foo/base-1",
+			ProcessorTarget: "x86_64_v4",
+			AutoUpgrade:     true,
+			Labels:          map[string]string{"tier": "production", "project": "cancer-atlas"},
+		}
+
+		var sb strings.Builder
+
+		err := softpackTmpl.Execute(&sb, vars)
+		So(err, ShouldBeNil)
+		So(sb.String(), ShouldEndWith, "auto_upgrade: true\nlabels:\n"+
+			"  project: \"cancer-atlas\"\n  tier: \"production\"\n")
+
+		def, err := ParseSoftpackYML(strings.NewReader(sb.String()))
+		So(err, ShouldBeNil)
+		So(def, ShouldResemble, &Definition{
+			Description: "some help text\n\nover several lines",
+			Packages: core.Packages{
+				{Name: "xxhash", Version: "0.8.1"},
+				{Name: "py-anndata", Version: "3.14"},
+				{Name: "r-seurat", Version: "4"},
+			},
+			Parent:          "users/foo/base-1",
+			ProcessorTarget: "x86_64_v4",
+			AutoUpgrade:     true,
+			Labels:          map[string]string{"tier": "production", "project": "cancer-atlas"},
+		})
+
+		Convey("including one with no description, exes, versions, parent, target, auto upgrade or labels", func() {
+			sb.Reset()
+
+			err = softpackTmpl.Execute(&sb, softpackTemplateVars{
+				Description: strings.Split("", "\n"),
+				Packages:    []ConcreteSpec{{Name: "xxhash"}},
+			})
+			So(err, ShouldBeNil)
+
+			def, err = ParseSoftpackYML(strings.NewReader(sb.String()))
+			So(err, ShouldBeNil)
+			So(def, ShouldResemble, &Definition{
+				Description: "",
+				Packages:    core.Packages{{Name: "xxhash"}},
+			})
+		})
+	})
+
+	Convey("Invalid softpack.yml files can't be parsed", t, func() {
+		for _, yml := range []string{
+			"description: [",
+			"description: |\n  foo\n",
+			"description: |\n  foo\npackages:\n  - \"@1\"\n",
+		} {
+			_, err := ParseSoftpackYML(strings.NewReader(yml))
+			So(err, ShouldWrap, ErrInvalidSoftpackYML)
+		}
+	})
+}
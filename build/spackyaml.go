@@ -0,0 +1,204 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bytes"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	ErrInvalidSpackYAML = internal.Error("spack.yaml needs a spack section with specs (without arch or target), " +
+		"and no include, repos or mirrors")
+
+	spackYAMLIndent = 2
+	heredocEnd      = "EOF"
+)
+
+// spackYAMLForbidden are the sections of an uploaded spack.yaml that would
+// make a build depend on files or sources other than our configured ones.
+var spackYAMLForbidden = []string{"include", "repos", "mirrors"} //nolint:gochecknoglobals
+
+var specPackageRegexp = regexp.MustCompile(`^([a-z0-9][a-z0-9_-]*)(?:@([^\s+~%^]+))?(?:[\s+~%^]|$)`)
+
+// ParseSpackYAML validates the given spack.yaml of an existing spack
+// environment, returning the packages (names and versions) of its specs.
+// Returns ErrInvalidSpackYAML if it isn't a spack environment we can build.
+func ParseSpackYAML(data string) (core.Packages, error) {
+	spack, err := parseSpackSection(data)
+	if err != nil {
+		return nil, err
+	}
+
+	specs, ok := spack["specs"].([]any)
+	if !ok || len(specs) == 0 {
+		return nil, ErrInvalidSpackYAML
+	}
+
+	pkgs := make(core.Packages, len(specs))
+
+	for i, spec := range specs {
+		pkgs[i], err = specPackage(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pkgs, nil
+}
+
+func parseSpackSection(data string) (map[string]any, error) {
+	var top map[string]any
+
+	if err := yaml.Unmarshal([]byte(data), &top); err != nil || len(top) != 1 {
+		return nil, ErrInvalidSpackYAML
+	}
+
+	spack, ok := top["spack"].(map[string]any)
+	if !ok {
+		return nil, ErrInvalidSpackYAML
+	}
+
+	for _, key := range spackYAMLForbidden {
+		if _, ok := spack[key]; ok {
+			return nil, ErrInvalidSpackYAML
+		}
+	}
+
+	return spack, nil
+}
+
+// specPackage returns the package name and version of the given spack spec,
+// like "py-numpy@1.26 +blas ^openblas".
+func specPackage(spec any) (core.Package, error) {
+	str, ok := spec.(string)
+	if !ok || strings.Contains(str, "arch=") || strings.Contains(str, "target=") {
+		return core.Package{}, ErrInvalidSpackYAML
+	}
+
+	match := specPackageRegexp.FindStringSubmatch(str)
+	if match == nil {
+		return core.Package{}, ErrInvalidSpackYAML
+	}
+
+	return core.Package{Name: match[1], Version: match[2]}, nil
+}
+
+// injectSpackYAML returns the given validated spack.yaml with our view,
+// install tree, concretizer and build settings, configured externals, default
+// packages and the processor target of the given templateVars, ready to build
+// in our image.
+func injectSpackYAML(data string, vars *templateVars) (string, error) {
+	spack, err := parseSpackSection(data)
+	if err != nil {
+		return "", err
+	}
+
+	specs, _ := spack["specs"].([]any) //nolint:errcheck
+
+	for _, pkg := range vars.DefaultPackages {
+		spec := pkg.Name
+		if pkg.Version != "" {
+			spec += "@" + pkg.Version
+		}
+
+		specs = append(specs, spec)
+	}
+
+	for i, spec := range specs {
+		if vars.ProcessorTarget != "" {
+			specs[i] = spec.(string) + " arch=None-None-" + vars.ProcessorTarget //nolint:forcetypeassert
+		}
+	}
+
+	if len(specs) > 0 {
+		spack["specs"] = specs
+	}
+
+	spack["view"] = "/opt/view"
+
+	concretizer := subSection(spack, "concretizer")
+	concretizer["unify"] = true
+
+	if vars.Reuse {
+		concretizer["reuse"] = true
+	}
+
+	config := subSection(spack, "config")
+	config["install_tree"] = "/opt/software"
+
+	if vars.BuildJobs > 0 {
+		config["build_jobs"] = vars.BuildJobs
+	}
+
+	if len(vars.Externals) > 0 {
+		packages := subSection(spack, "packages")
+
+		for _, external := range vars.Externals {
+			packages[external.Name] = map[string]any{
+				"buildable": false,
+				"externals": []any{map[string]any{"spec": external.Spec, "prefix": external.Prefix}},
+			}
+		}
+	}
+
+	return encodeSpackYAML(map[string]any{"spack": spack})
+}
+
+// subSection returns the named map in the given section, creating it if it
+// doesn't exist or isn't a map.
+func subSection(section map[string]any, name string) map[string]any {
+	sub, ok := section[name].(map[string]any)
+	if !ok {
+		sub = make(map[string]any)
+		section[name] = sub
+	}
+
+	return sub
+}
+
+// encodeSpackYAML returns the given spack.yaml as YAML that can be written out
+// by a quoted heredoc in our singularity definition file.
+func encodeSpackYAML(spackYAML map[string]any) (string, error) {
+	var buf bytes.Buffer
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(spackYAMLIndent)
+
+	if err := enc.Encode(spackYAML); err != nil {
+		return "", err
+	}
+
+	if slices.Contains(strings.Split(buf.String(), "\n"), heredocEnd) {
+		return "", ErrInvalidSpackYAML
+	}
+
+	return buf.String(), nil
+}
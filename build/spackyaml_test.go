@@ -0,0 +1,112 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+const exampleSpackYAML = `spack:
+  specs:
+  - xxhash@0.8.1
+  - py-numpy@1.26 +blas ^openblas
+  - r-seurat
+  view: /somewhere/else
+  concretizer:
+    unify: when_possible
+  packages:
+    all:
+      variants: +mpi
+`
+
+func TestSpackYAML(t *testing.T) {
+	Convey("You can ParseSpackYAML() to get the packages of its specs", t, func() {
+		pkgs, err := ParseSpackYAML(exampleSpackYAML)
+		So(err, ShouldBeNil)
+		So(pkgs, ShouldResemble, core.Packages{
+			{Name: "xxhash", Version: "0.8.1"},
+			{Name: "py-numpy", Version: "1.26"},
+			{Name: "r-seurat"},
+		})
+
+		for _, yml := range []string{
+			"",
+			"not: yaml: [",
+			"spack:\n  view: true\n",
+			"spack:\n  specs: []\n",
+			"spack:\n  specs:\n  - xxhash\nother: 1\n",
+			"spack:\n  specs:\n  - xxhash\n  include:\n  - /etc/spack.yaml\n",
+			"spack:\n  specs:\n  - xxhash\n  repos:\n  - /my/repo\n",
+			"spack:\n  specs:\n  - xxhash\n  mirrors:\n    mine: /my/mirror\n",
+			"spack:\n  specs:\n  - xxhash target=zen2\n",
+			"spack:\n  specs:\n  - xxhash arch=linux-ubuntu22.04-zen2\n",
+			"spack:\n  specs:\n  - ^openblas\n",
+			"spack:\n  specs:\n  - $(rm -rf /)\n",
+			"spack:\n  specs:\n  - {name: xxhash}\n",
+		} {
+			_, err = ParseSpackYAML(yml)
+			So(err, ShouldEqual, ErrInvalidSpackYAML)
+		}
+	})
+
+	Convey("Our settings are injected in to a spack.yaml", t, func() {
+		vars := &templateVars{
+			ProcessorTarget: "x86_64_v4",
+			BuildJobs:       4,
+			Reuse:           true,
+			Externals:       []config.External{{Name: "slurm", Spec: "slurm@23", Prefix: "/usr"}},
+		}
+
+		yml, err := injectSpackYAML(exampleSpackYAML, vars)
+		So(err, ShouldBeNil)
+		So(yml, ShouldEqual, `spack:
+  concretizer:
+    reuse: true
+    unify: true
+  config:
+    build_jobs: 4
+    install_tree: /opt/software
+  packages:
+    all:
+      variants: +mpi
+    slurm:
+      buildable: false
+      externals:
+        - prefix: /usr
+          spec: slurm@23
+  specs:
+    - xxhash@0.8.1 arch=None-None-x86_64_v4
+    - py-numpy@1.26 +blas ^openblas arch=None-None-x86_64_v4
+    - r-seurat arch=None-None-x86_64_v4
+  view: /opt/view
+`)
+
+		_, err = injectSpackYAML("spack:\n  specs:\n  - xxhash\n  description: |\n    a\nEOF\n", vars)
+		So(err, ShouldNotBeNil)
+	})
+}
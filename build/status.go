@@ -0,0 +1,370 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+// BuildState is the overall state of a build, as used to filter statuses.
+type BuildState string
+
+const (
+	// BuildStateBuilding means the build has been requested but not finished.
+	BuildStateBuilding BuildState = "building"
+
+	// BuildStateFailed means the build's wr job finished buried, or the build
+	// failed afterwards.
+	BuildStateFailed BuildState = "failed"
+
+	// BuildStateDone means the build's wr job finished successfully.
+	BuildStateDone BuildState = "done"
+)
+
+// BuildStage is a more detailed version of BuildState.
+type BuildStage string
+
+const (
+	// BuildStageRequested means the build hasn't been added to wr yet.
+	BuildStageRequested BuildStage = "requested"
+
+	// BuildStageQueued means the build's wr job hasn't started running yet.
+	BuildStageQueued BuildStage = "queued"
+
+	// BuildStageBuilding means the build's wr job is running.
+	BuildStageBuilding BuildStage = "building"
+
+	// BuildStageInstallingModule means the build's wr job succeeded, and the
+	// environment's module and scripts are being installed.
+	BuildStageInstallingModule BuildStage = "installing-module"
+
+	// BuildStageUploadingArtefacts means the environment has been installed,
+	// and its artefacts are being sent to core.
+	BuildStageUploadingArtefacts BuildStage = "uploading-artefacts"
+
+	// BuildStageFailed is the same as BuildStateFailed.
+	BuildStageFailed BuildStage = "failed"
+
+	// BuildStageDone is the same as BuildStateDone.
+	BuildStageDone BuildStage = "done"
+)
+
+// buildWaitPollInterval is how often WaitForBuild() checks if a build has
+// finished.
+var buildWaitPollInterval = time.Second //nolint:gochecknoglobals
+
+// StatusSort is a field that statuses can be sorted on.
+type StatusSort string
+
+const (
+	StatusSortRequested  StatusSort = "requested"
+	StatusSortBuildStart StatusSort = "buildstart"
+
+	ErrInvalidBuildState = internal.Error("invalid build state")
+	ErrInvalidStatusSort = internal.Error("invalid status sort")
+	ErrInvalidPage       = internal.Error("limit and offset must not be negative")
+	ErrUnknownBuild      = internal.Error("no build known for environment")
+)
+
+// State returns the overall state of the build.
+func (s *Status) State() BuildState {
+	switch {
+	case s.BuildDone == nil:
+		return BuildStateBuilding
+	case s.Failure != wr.FailureNone || s.Error != "":
+		return BuildStateFailed
+	default:
+		return BuildStateDone
+	}
+}
+
+// Stage returns the current stage of the build. While gsb is installing a
+// successfully built environment, this is its Step, even though its State() is
+// already done.
+func (s *Status) Stage() BuildStage {
+	switch {
+	case s.Step != "" && s.State() == BuildStateDone:
+		return s.Step
+	case s.BuildDone != nil:
+		return BuildStage(s.State())
+	case s.BuildStart != nil:
+		return BuildStageBuilding
+	case s.JobID != "":
+		return BuildStageQueued
+	default:
+		return BuildStageRequested
+	}
+}
+
+// StatusQuery describes which statuses QueryStatus() should return, and in what
+// order. Blank and zero values mean no filtering.
+//
+// Only statuses in the given State, whose Name starts with PathPrefix, that
+// were last requested by Requester, that have all the given Labels, and that
+// were Requested at or after Since are returned. They are sorted by SortBy
+// (default StatusSortRequested, with unset times first), in Descending order if
+// set, and then Offset statuses are skipped and at most Limit are returned.
+type StatusQuery struct {
+	State      BuildState
+	PathPrefix string
+	Requester  string
+	Labels     map[string]string
+	Since      time.Time
+	SortBy     StatusSort
+	Descending bool
+	Offset     int
+	Limit      int
+}
+
+// Validate returns an error if the State or SortBy are unknown, or if Offset or
+// Limit are negative.
+func (q *StatusQuery) Validate() error {
+	switch q.State {
+	case "", BuildStateBuilding, BuildStateFailed, BuildStateDone:
+	default:
+		return ErrInvalidBuildState
+	}
+
+	switch q.SortBy {
+	case "", StatusSortRequested, StatusSortBuildStart:
+	default:
+		return ErrInvalidStatusSort
+	}
+
+	if q.Offset < 0 || q.Limit < 0 {
+		return ErrInvalidPage
+	}
+
+	return nil
+}
+
+func (q *StatusQuery) matches(status *Status) bool {
+	if q.State != "" && status.State() != q.State {
+		return false
+	}
+
+	if !strings.HasPrefix(status.Name, q.PathPrefix) {
+		return false
+	}
+
+	if q.Requester != "" && status.Requester != q.Requester {
+		return false
+	}
+
+	for key, value := range q.Labels {
+		if status.Labels[key] != value {
+			return false
+		}
+	}
+
+	return q.Since.IsZero() || (status.Requested != nil && !status.Requested.Before(q.Since))
+}
+
+func (q *StatusQuery) filter(statuses []Status) []Status {
+	filtered := statuses[:0]
+
+	for i := range statuses {
+		if q.matches(&statuses[i]) {
+			filtered = append(filtered, statuses[i])
+		}
+	}
+
+	return filtered
+}
+
+func (q *StatusQuery) sort(statuses []Status) {
+	sortTime := func(s *Status) *time.Time { return s.Requested }
+
+	if q.SortBy == StatusSortBuildStart {
+		sortTime = func(s *Status) *time.Time { return s.BuildStart }
+	}
+
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if q.Descending {
+			i, j = j, i
+		}
+
+		return timeBefore(sortTime(&statuses[i]), sortTime(&statuses[j]), statuses[i].Name < statuses[j].Name)
+	})
+}
+
+// timeBefore returns true if a is before b, treating nil as earliest, and
+// returning tieBreak if they're the same.
+func timeBefore(a, b *time.Time, tieBreak bool) bool {
+	switch {
+	case a == nil && b == nil:
+		return tieBreak
+	case a == nil:
+		return true
+	case b == nil:
+		return false
+	case a.Equal(*b):
+		return tieBreak
+	default:
+		return a.Before(*b)
+	}
+}
+
+func (q *StatusQuery) page(statuses []Status) []Status {
+	if q.Offset >= len(statuses) {
+		return []Status{}
+	}
+
+	statuses = statuses[q.Offset:]
+
+	if q.Limit > 0 && q.Limit < len(statuses) {
+		statuses = statuses[:q.Limit]
+	}
+
+	return statuses
+}
+
+// QueryStatus returns the statuses of known builds that match the query, sorted
+// and paged as it describes. The wr details of the returned builds that haven't
+// finished yet are retrieved from wr at the time of this call, along with wr's
+// load if any are still queued.
+func (b *Builder) QueryStatus(q StatusQuery) ([]Status, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	statuses := q.filter(b.statusSnapshot())
+	q.sort(statuses)
+	statuses = q.page(statuses)
+
+	loads := make(queueLoads)
+
+	for i := range statuses {
+		b.addLiveWRDetails(&statuses[i], loads)
+	}
+
+	return statuses, nil
+}
+
+// StatusDetail is the full status of a single build, including its state and
+// stage, and the S3 locations of its artefacts (keyed on their basenames).
+// Artefacts are only listed once the build has reached the stage where they
+// should exist.
+type StatusDetail struct {
+	Status
+	State     BuildState
+	Stage     BuildStage
+	Artefacts map[string]string
+}
+
+// StatusDetail returns the StatusDetail for the build of the given environment
+// (eg. "users/foo/env") and version. The wr details of the build are retrieved
+// from wr at the time of this call if it hasn't finished yet. Returns
+// ErrUnknownBuild if that environment hasn't been built since we started.
+func (b *Builder) StatusDetail(envPath, version string) (*StatusDetail, error) {
+	b.statusMu.RLock()
+	status, ok := b.statuses[envPath+"-"+version]
+
+	var s Status
+
+	if ok {
+		s = *status
+	}
+
+	b.statusMu.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownBuild
+	}
+
+	b.addLiveWRDetails(&s, make(queueLoads))
+
+	return &StatusDetail{
+		Status:    s,
+		State:     s.State(),
+		Stage:     s.Stage(),
+		Artefacts: b.artefactLocations(envPath, version, s.Stage()),
+	}, nil
+}
+
+// artefactLocations returns the S3 URLs of the artefacts that should exist for
+// a build of the given environment and version in the given stage.
+func (b *Builder) artefactLocations(envPath, version string, stage BuildStage) map[string]string {
+	var basenames []string
+
+	switch stage {
+	case BuildStageRequested:
+		return map[string]string{}
+	case BuildStageQueued, BuildStageBuilding:
+		basenames = []string{core.SingularityDefBasename}
+	case BuildStageFailed:
+		basenames = []string{core.SingularityDefBasename, core.BuilderOut}
+	case BuildStageDone:
+		basenames = []string{core.SingularityDefBasename, core.BuilderOut, core.ExesBasename,
+			core.SpackLockFile, core.SoftpackYaml, core.UsageBasename, core.ImageBasename}
+	}
+
+	base := "s3://" + path.Join(b.config.S3.BuildBase, envPath, version)
+	artefacts := make(map[string]string, len(basenames))
+
+	for _, basename := range basenames {
+		artefacts[basename] = base + "/" + basename
+	}
+
+	return artefacts
+}
+
+// WaitForBuild waits until the build of the given environment (eg.
+// "users/foo/env") and version has completely finished, including installing
+// it and sending its artefacts to core, then returns its StatusDetail. Builds
+// held while draining for maintenance are waited on until they've been started
+// and finished. Returns ErrUnknownBuild if that environment hasn't been built
+// since we started, or the context's error if it is done first.
+func (b *Builder) WaitForBuild(ctx context.Context, envPath, version string) (*StatusDetail, error) {
+	ticker := time.NewTicker(buildWaitPollInterval)
+	defer ticker.Stop()
+
+	for b.buildPending(envPath + "-" + version) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return b.StatusDetail(envPath, version)
+}
+
+// buildPending returns true if the build of the given full environment path
+// (like "users/foo/env-1") is running or held for maintenance.
+func (b *Builder) buildPending(envPath string) bool {
+	b.mu.Lock()
+	running := b.runningEnvironments[envPath]
+	b.mu.Unlock()
+
+	return running || b.maintenance.isQueued(envPath)
+}
@@ -0,0 +1,215 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+func TestQueryStatus(t *testing.T) {
+	Convey("Given a Builder that knows about some builds", t, func() {
+		mwr := wrmock.NewMockWR(0, 0)
+		builder, err := New(&config.Config{}, &s3mock.MockS3{}, mwr)
+		So(err, ShouldBeNil)
+
+		now := time.Now()
+		at := func(minutes int) *time.Time {
+			tm := now.Add(time.Duration(minutes) * time.Minute)
+
+			return &tm
+		}
+
+		for _, status := range []*Status{
+			{Name: "users/a/env-1", Requested: at(0), Requester: "a",
+				Labels: map[string]string{"project": "atlas", "tier": "production"}},
+			{Name: "users/a/env-2", Requested: at(1), BuildStart: at(5), BuildDone: at(6),
+				Labels: map[string]string{"project": "atlas"}},
+			{Name: "users/b/env-1", Requested: at(2), BuildStart: at(3), BuildDone: at(4),
+				Failure: wr.FailureBuild},
+			{Name: "groups/g/env-1", Requested: at(3), BuildStart: at(4)},
+		} {
+			builder.statuses[status.Name] = status
+		}
+
+		names := func(q StatusQuery) []string {
+			statuses, errq := builder.QueryStatus(q)
+			So(errq, ShouldBeNil)
+
+			n := make([]string, len(statuses))
+
+			for i, status := range statuses {
+				n[i] = status.Name
+			}
+
+			return n
+		}
+
+		Convey("Status() returns them all in the order they were requested", func() {
+			statuses := builder.Status()
+			So(len(statuses), ShouldEqual, 4)
+			So(statuses[0].Name, ShouldEqual, "users/a/env-1")
+			So(statuses[3].Name, ShouldEqual, "groups/g/env-1")
+		})
+
+		Convey("You can filter them by state, path prefix, requester, labels and request time", func() {
+			So(names(StatusQuery{State: BuildStateBuilding}), ShouldResemble,
+				[]string{"users/a/env-1", "groups/g/env-1"})
+			So(names(StatusQuery{State: BuildStateFailed}), ShouldResemble, []string{"users/b/env-1"})
+			So(names(StatusQuery{State: BuildStateDone}), ShouldResemble, []string{"users/a/env-2"})
+			So(names(StatusQuery{PathPrefix: "users/a/"}), ShouldResemble,
+				[]string{"users/a/env-1", "users/a/env-2"})
+			So(names(StatusQuery{Requester: "a"}), ShouldResemble, []string{"users/a/env-1"})
+			So(names(StatusQuery{Labels: map[string]string{"project": "atlas"}}), ShouldResemble,
+				[]string{"users/a/env-1", "users/a/env-2"})
+			So(names(StatusQuery{Labels: map[string]string{"project": "atlas", "tier": "production"}}),
+				ShouldResemble, []string{"users/a/env-1"})
+			So(names(StatusQuery{Labels: map[string]string{"tier": "dev"}}), ShouldBeEmpty)
+			So(names(StatusQuery{Since: *at(2)}), ShouldResemble, []string{"users/b/env-1", "groups/g/env-1"})
+			So(names(StatusQuery{PathPrefix: "users/", State: BuildStateBuilding}), ShouldResemble,
+				[]string{"users/a/env-1"})
+		})
+
+		Convey("You can sort them", func() {
+			So(names(StatusQuery{Descending: true}), ShouldResemble,
+				[]string{"groups/g/env-1", "users/b/env-1", "users/a/env-2", "users/a/env-1"})
+			So(names(StatusQuery{SortBy: StatusSortBuildStart}), ShouldResemble,
+				[]string{"users/a/env-1", "users/b/env-1", "groups/g/env-1", "users/a/env-2"})
+			So(names(StatusQuery{SortBy: StatusSortBuildStart, Descending: true}), ShouldResemble,
+				[]string{"users/a/env-2", "groups/g/env-1", "users/b/env-1", "users/a/env-1"})
+		})
+
+		Convey("You can page through them", func() {
+			So(names(StatusQuery{Limit: 2}), ShouldResemble, []string{"users/a/env-1", "users/a/env-2"})
+			So(names(StatusQuery{Offset: 2, Limit: 1}), ShouldResemble, []string{"users/b/env-1"})
+			So(names(StatusQuery{Offset: 3, Limit: 2}), ShouldResemble, []string{"groups/g/env-1"})
+			So(names(StatusQuery{Offset: 4}), ShouldBeEmpty)
+		})
+
+		Convey("You can get the details of a single build", func() {
+			builder.config.S3.BuildBase = "spack/builds"
+			builder.statuses["users/b/env-1"].Error = ErrBuildFailed
+
+			detail, errd := builder.StatusDetail("users/b/env", "1")
+			So(errd, ShouldBeNil)
+			So(detail.Name, ShouldEqual, "users/b/env-1")
+			So(detail.State, ShouldEqual, BuildStateFailed)
+			So(detail.Stage, ShouldEqual, BuildStageFailed)
+			So(detail.Failure, ShouldEqual, wr.FailureBuild)
+			So(detail.Error, ShouldEqual, ErrBuildFailed)
+			So(detail.Artefacts, ShouldResemble, map[string]string{
+				core.SingularityDefBasename: "s3://spack/builds/users/b/env/1/" + core.SingularityDefBasename,
+				core.BuilderOut:             "s3://spack/builds/users/b/env/1/" + core.BuilderOut,
+			})
+
+			detail, errd = builder.StatusDetail("users/a/env", "2")
+			So(errd, ShouldBeNil)
+			So(detail.Stage, ShouldEqual, BuildStageDone)
+			So(len(detail.Artefacts), ShouldEqual, 7)
+			So(detail.Artefacts[core.ImageBasename], ShouldEqual, "s3://spack/builds/users/a/env/2/"+core.ImageBasename)
+
+			detail, errd = builder.StatusDetail("users/a/env", "1")
+			So(errd, ShouldBeNil)
+			So(detail.Stage, ShouldEqual, BuildStageRequested)
+			So(detail.Artefacts, ShouldBeEmpty)
+
+			builder.statuses["users/a/env-1"].JobID = "abc123"
+			detail, errd = builder.StatusDetail("users/a/env", "1")
+			So(errd, ShouldBeNil)
+			So(detail.Stage, ShouldEqual, BuildStageQueued)
+			So(detail.WR, ShouldNotBeNil)
+
+			detail, errd = builder.StatusDetail("groups/g/env", "1")
+			So(errd, ShouldBeNil)
+			So(detail.State, ShouldEqual, BuildStateBuilding)
+			So(detail.Stage, ShouldEqual, BuildStageBuilding)
+
+			_, errd = builder.StatusDetail("users/a/env", "3")
+			So(errd, ShouldEqual, ErrUnknownBuild)
+		})
+
+		Convey("Queued builds have an estimated wait based on wr's load", func() {
+			builder.statuses["users/a/env-1"].JobID = "abc123"
+
+			detail, errd := builder.StatusDetail("users/a/env", "1")
+			So(errd, ShouldBeNil)
+			So(detail.Queue, ShouldBeNil)
+
+			mwr.ReturnStatus = wr.WRJobStatusReady
+			mwr.QueueLoad = &wr.Load{Queued: 3, Running: 2}
+
+			detail, errd = builder.StatusDetail("users/a/env", "1")
+			So(errd, ShouldBeNil)
+			So(detail.Queue, ShouldResemble, &QueueEstimate{Queued: 3, Running: 2, WaitSeconds: 60})
+
+			builder.statuses["users/b/env-1"].JobID = "abc123"
+			builder.statuses["users/b/env-1"].BuildStart = nil
+			builder.statuses["users/b/env-1"].BuildDone = nil
+
+			statuses, errq := builder.QueryStatus(StatusQuery{PathPrefix: "users/b/"})
+			So(errq, ShouldBeNil)
+			So(statuses[0].Queue, ShouldResemble, &QueueEstimate{Queued: 3, Running: 2, Ahead: 1, WaitSeconds: 60})
+
+			mwr.QueueLoad = &wr.Load{Queued: 2, Running: 1}
+			statuses, errq = builder.QueryStatus(StatusQuery{PathPrefix: "users/b/"})
+			So(errq, ShouldBeNil)
+			So(statuses[0].Queue, ShouldResemble, &QueueEstimate{Queued: 2, Running: 1, Ahead: 1, WaitSeconds: 120})
+
+			mwr.ReturnStatus = wr.WRJobStatusRunning
+			detail, errd = builder.StatusDetail("users/a/env", "1")
+			So(errd, ShouldBeNil)
+			So(detail.Queue, ShouldBeNil)
+		})
+
+		Convey("Wait estimates assume full capacity while builds are queued", func() {
+			So(estimateWait(0, 0, time.Hour), ShouldEqual, 0)
+			So(estimateWait(5, 0, time.Hour), ShouldEqual, 0)
+			So(estimateWait(0, 1, time.Hour), ShouldEqual, time.Hour)
+			So(estimateWait(1, 1, time.Hour), ShouldEqual, 2*time.Hour)
+			So(estimateWait(3, 4, time.Hour), ShouldEqual, time.Hour)
+			So(estimateWait(4, 4, time.Hour), ShouldEqual, 2*time.Hour)
+
+			builder.statuses = map[string]*Status{}
+			So(builder.averageBuildDuration(), ShouldEqual, defaultBuildDuration)
+		})
+
+		Convey("Invalid queries are rejected", func() {
+			_, err = builder.QueryStatus(StatusQuery{State: "foo"})
+			So(err, ShouldEqual, ErrInvalidBuildState)
+
+			_, err = builder.QueryStatus(StatusQuery{SortBy: "foo"})
+			So(err, ShouldEqual, ErrInvalidStatusSort)
+
+			_, err = builder.QueryStatus(StatusQuery{Offset: -1})
+			So(err, ShouldEqual, ErrInvalidPage)
+		})
+	})
+}
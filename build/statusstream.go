@@ -0,0 +1,98 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"sync"
+)
+
+// statusChangeBuffer is how many StatusChanges a subscriber can fall behind by
+// before it starts missing them.
+const statusChangeBuffer = 64
+
+// statusSubscribers fans out StatusChanges to subscribers.
+type statusSubscribers struct {
+	mu         sync.Mutex
+	subs       map[chan StatusChange]bool
+	lastStages map[string]BuildStage
+}
+
+func newStatusSubscribers() statusSubscribers {
+	return statusSubscribers{
+		subs:       make(map[chan StatusChange]bool),
+		lastStages: make(map[string]BuildStage),
+	}
+}
+
+// publish sends the given change to all subscribers, without blocking on any
+// that have fallen behind. Returns false, without sending, if the last change
+// published for that environment was to the same stage.
+func (s *statusSubscribers) publish(change StatusChange) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := change.Status.Name
+
+	if stage, ok := s.lastStages[name]; ok && stage == change.Stage {
+		return false
+	}
+
+	s.lastStages[name] = change.Stage
+
+	for sub := range s.subs {
+		select {
+		case sub <- change:
+		default:
+		}
+	}
+
+	return true
+}
+
+func (s *statusSubscribers) subscribe(ctx context.Context) <-chan StatusChange {
+	sub := make(chan StatusChange, statusChangeBuffer)
+
+	s.mu.Lock()
+	s.subs[sub] = true
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		s.mu.Lock()
+		delete(s.subs, sub)
+		close(sub)
+		s.mu.Unlock()
+	}()
+
+	return sub
+}
+
+// SubscribeStatusChanges returns a channel that receives a StatusChange every
+// time a build's wr job is queued, starts building, or finishes, until the
+// given context is cancelled, when the channel is closed. Changes are dropped
+// if you fall too far behind in receiving them.
+func (b *Builder) SubscribeStatusChanges(ctx context.Context) <-chan StatusChange {
+	return b.statusSubs.subscribe(ctx)
+}
@@ -0,0 +1,79 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+)
+
+func TestStatusStream(t *testing.T) {
+	Convey("You can subscribe to status changes", t, func() {
+		builder, err := New(&config.Config{}, &mapS3{files: map[string]string{}}, nil)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		changes := builder.SubscribeStatusChanges(ctx)
+
+		status := &Status{Name: "users/foo/env-1", JobID: "job1"}
+		builder.notifyStatusChange(context.Background(), status)
+		builder.notifyStatusChange(context.Background(), status)
+
+		now := time.Now()
+		status.BuildStart = &now
+		builder.notifyStatusChange(context.Background(), status)
+
+		change := <-changes
+		So(change.Stage, ShouldEqual, BuildStageQueued)
+		So(change.Status.JobID, ShouldEqual, "job1")
+
+		change = <-changes
+		So(change.Stage, ShouldEqual, BuildStageBuilding)
+
+		status.BuildDone = &now
+		status.Step = BuildStageInstallingModule
+		builder.notifyStatusChange(context.Background(), status)
+
+		change = <-changes
+		So(change.Stage, ShouldEqual, BuildStageInstallingModule)
+
+		builder.setStep(context.Background(), status, BuildStageUploadingArtefacts)
+
+		change = <-changes
+		So(change.Stage, ShouldEqual, BuildStageUploadingArtefacts)
+
+		builder.setStep(context.Background(), status, "")
+
+		change = <-changes
+		So(change.Stage, ShouldEqual, BuildStageDone)
+
+		cancel()
+
+		_, ok := <-changes
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,118 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// SubmittedDefinition is the singularity.def generated for the latest build of
+// an Environment (like "users/foo/env-1"), so that users can review exactly
+// what will be built without waiting for the build to finish. BuildID is the
+// ID of that build, and Generated is when the definition was generated.
+// Variables are the values the singularity.def template was rendered with;
+// they're only known for builds submitted since gsb last started.
+type SubmittedDefinition struct {
+	Environment    string
+	BuildID        string
+	Generated      *time.Time
+	SingularityDef string
+	Variables      json.RawMessage
+}
+
+// rememberSingularityDef stores the given singularity.def generated for the
+// given Definition, along with the templateVars it was generated from, for
+// SubmittedDefinition().
+func (b *Builder) rememberSingularityDef(def *Definition, singDef string, vars *templateVars) {
+	varsJSON, err := json.Marshal(vars)
+	if err != nil {
+		varsJSON = nil
+	}
+
+	status := b.buildStatus(def)
+	now := time.Now()
+
+	b.statusMu.Lock()
+	defer b.statusMu.Unlock()
+
+	b.singDefs[status.Name] = &SubmittedDefinition{
+		Environment:    status.Name,
+		BuildID:        status.BuildID,
+		Generated:      &now,
+		SingularityDef: singDef,
+		Variables:      varsJSON,
+	}
+}
+
+// SubmittedDefinition returns the singularity.def generated for the latest
+// build of the given environment (a path like "users/foo/env") and version,
+// which is available as soon as the build has been submitted. If it wasn't
+// submitted since we started, the singularity.def is read from the
+// environment's S3 build location instead, without its Variables. Returns
+// ErrUnknownBuild if there's no singularity.def for the environment.
+func (b *Builder) SubmittedDefinition(ctx context.Context, envPath, version string) (*SubmittedDefinition, error) {
+	if err := ValidateEnvironmentPath(envPath, version); err != nil {
+		return nil, err
+	}
+
+	name := envPath + "-" + version
+
+	b.statusMu.RLock()
+	sd, ok := b.singDefs[name]
+	b.statusMu.RUnlock()
+
+	if ok {
+		stored := *sd
+
+		return &stored, nil
+	}
+
+	rc, err := b.s3.OpenFile(ctx, filepath.Join(envPath, version, core.SingularityDefBasename))
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
+		return nil, ErrUnknownBuild
+	}
+
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, ErrUnknownBuild
+	}
+
+	return &SubmittedDefinition{Environment: name, SingularityDef: string(data)}, nil
+}
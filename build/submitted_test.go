@@ -0,0 +1,83 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+func TestSubmittedDefinition(t *testing.T) {
+	Convey("Given a Builder", t, func() {
+		builder, _, ms3, _ := newTestBuilder(t, nil)
+
+		def := getExampleDefinition()
+		envPath := filepath.Join(def.EnvironmentPath, def.EnvironmentName)
+
+		_, err := builder.SubmittedDefinition(context.Background(), envPath, def.EnvironmentVersion)
+		So(err, ShouldEqual, ErrUnknownBuild)
+
+		Convey("you can get the singularity.def of a build as soon as it is submitted", func() {
+			err = builder.Build(context.Background(), def)
+			So(err, ShouldBeNil)
+
+			sd, err := builder.SubmittedDefinition(context.Background(), envPath, def.EnvironmentVersion)
+			So(err, ShouldBeNil)
+			So(sd.Environment, ShouldEqual, def.FullEnvironmentPath())
+			So(sd.BuildID, ShouldEqual, builder.Status()[0].BuildID)
+			So(sd.Generated, ShouldNotBeNil)
+			So(sd.SingularityDef, ShouldEqual, ms3.Data)
+			So(sd.SingularityDef, ShouldContainSubstring, "xxhash@0.8.1")
+
+			var vars map[string]any
+
+			So(json.Unmarshal(sd.Variables, &vars), ShouldBeNil)
+			So(vars["ProcessorTarget"], ShouldEqual, "x86_64_v4")
+			So(vars["BuildImage"], ShouldEqual, "spack/ubuntu-jammy:v0.20.1")
+		})
+
+		Convey("otherwise it is read from S3, without its variables", func() {
+			ms3.Files = map[string]string{
+				filepath.Join(envPath, def.EnvironmentVersion, core.SingularityDefBasename): "Bootstrap: docker",
+			}
+
+			sd, err := builder.SubmittedDefinition(context.Background(), envPath, def.EnvironmentVersion)
+			So(err, ShouldBeNil)
+			So(sd, ShouldResemble, &SubmittedDefinition{
+				Environment:    def.FullEnvironmentPath(),
+				SingularityDef: "Bootstrap: docker",
+			})
+		})
+
+		Convey("invalid environments are rejected", func() {
+			_, err = builder.SubmittedDefinition(context.Background(), envPath, "")
+			So(err, ShouldEqual, ErrInvalidVersion)
+		})
+	})
+}
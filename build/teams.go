@@ -0,0 +1,161 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const ErrTeamLookup = internal.Error("failed to look up team contacts")
+
+// Owner is the account that owns an environment (eg. "users/foo" or
+// "groups/hgi"), and the Contacts to notify about its builds: the user of a
+// users/ environment, or the configured team contacts of a groups/ environment
+// (none if its team isn't known).
+type Owner struct {
+	Account  string
+	Contacts []string
+}
+
+// teamContacts looks up the contacts of the teams that own groups/
+// environments, caching those looked up from the configured URL.
+type teamContacts struct {
+	conf   config.Teams
+	client *http.Client
+
+	mu     sync.Mutex
+	cached map[string]cachedContacts
+}
+
+type cachedContacts struct {
+	contacts  []string
+	fetchedAt time.Time
+}
+
+// newTeamContacts returns a teamContacts for the given config, or nil if no
+// teams are configured.
+func newTeamContacts(conf config.Teams, client *http.Client) *teamContacts {
+	if conf.URL == "" && len(conf.Contacts) == 0 {
+		return nil
+	}
+
+	return &teamContacts{conf: conf, client: client, cached: make(map[string]cachedContacts)}
+}
+
+// owner returns the Owner of the given Definition's environment.
+func (b *Builder) owner(ctx context.Context, def *Definition) *Owner {
+	account := path.Clean(def.EnvironmentPath)
+	kind, name, _ := strings.Cut(account, "/")
+
+	owner := &Owner{Account: account}
+
+	switch {
+	case kind == "users":
+		owner.Contacts = []string{name}
+	case kind == "groups" && b.teams != nil:
+		owner.Contacts = b.teams.contacts(ctx, name)
+	}
+
+	return owner
+}
+
+// contacts returns the configured contacts of the given group's team, or
+// those looked up from the URL if it isn't configured. Failed lookups are
+// logged, and the last successfully looked up contacts are used instead.
+func (t *teamContacts) contacts(ctx context.Context, group string) []string {
+	if contacts, ok := t.conf.Contacts[group]; ok {
+		return contacts
+	}
+
+	if t.conf.URL == "" {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cached, ok := t.cached[group]
+	if ok && time.Since(cached.fetchedAt) < t.conf.RefreshInterval() {
+		return cached.contacts
+	}
+
+	contacts, err := t.lookup(ctx, group)
+	if err != nil {
+		loggerFromContext(ctx).Warn(string(ErrTeamLookup), "group", group, "err", err)
+
+		contacts = cached.contacts
+	}
+
+	t.cached[group] = cachedContacts{contacts: contacts, fetchedAt: time.Now()}
+
+	return contacts
+}
+
+// lookup gets and validates the YAML list of contacts of the given group's
+// team from the URL. Returns no contacts if the URL says there's no such team.
+func (t *teamContacts) lookup(ctx context.Context, group string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(t.conf.URL, "/")+"/"+url.PathEscape(group), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrTeamLookup, resp.Status)
+	}
+
+	var contacts []string
+
+	if err = yaml.NewDecoder(resp.Body).Decode(&contacts); err != nil {
+		return nil, err
+	}
+
+	if err = config.ValidateContacts(contacts); err != nil {
+		return nil, err
+	}
+
+	return contacts, nil
+}
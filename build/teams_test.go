@@ -0,0 +1,134 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestTeams(t *testing.T) {
+	Convey("Given a builder with team contacts", t, func() {
+		var lookups atomic.Int32
+
+		remote := "- bar\n- team@example.com\n"
+		status := http.StatusOK
+
+		teamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lookups.Add(1)
+
+			if r.URL.Path != "/teams/other" {
+				w.WriteHeader(http.StatusNotFound)
+
+				return
+			}
+
+			w.WriteHeader(status)
+			w.Write([]byte(remote)) //nolint:errcheck
+		}))
+
+		defer teamServer.Close()
+
+		builder, conf, _, mwr := newTestBuilder(t, func(conf *config.Config) {
+			conf.Teams.Contacts = map[string][]string{"hgi": {"foo", "hgi@example.com"}}
+		})
+
+		ctx := context.Background()
+		def := getExampleDefinition()
+
+		Convey("users/ environments are owned by their user", func() {
+			def.EnvironmentPath = "users/foo/"
+			So(builder.owner(ctx, def), ShouldResemble, &Owner{Account: "users/foo", Contacts: []string{"foo"}})
+		})
+
+		Convey("groups/ environments are owned by their team", func() {
+			So(builder.owner(ctx, def), ShouldResemble,
+				&Owner{Account: "groups/hgi", Contacts: []string{"foo", "hgi@example.com"}})
+
+			def.EnvironmentPath = "groups/other"
+			So(builder.owner(ctx, def), ShouldResemble, &Owner{Account: "groups/other"})
+		})
+
+		Convey("the contacts of unconfigured teams are looked up from the URL, and cached", func() {
+			conf.Teams.URL = teamServer.URL + "/teams/"
+
+			builder, err := New(conf, &s3mock.MockS3{}, mwr)
+			So(err, ShouldBeNil)
+
+			def.EnvironmentPath = "groups/other"
+			So(builder.owner(ctx, def).Contacts, ShouldResemble, []string{"bar", "team@example.com"})
+			So(builder.owner(ctx, def).Contacts, ShouldResemble, []string{"bar", "team@example.com"})
+			So(lookups.Load(), ShouldEqual, 1)
+
+			def.EnvironmentPath = "groups/hgi"
+			So(builder.owner(ctx, def).Contacts, ShouldResemble, []string{"foo", "hgi@example.com"})
+			So(lookups.Load(), ShouldEqual, 1)
+
+			def.EnvironmentPath = "groups/unknown"
+			So(builder.owner(ctx, def).Contacts, ShouldBeNil)
+			So(lookups.Load(), ShouldEqual, 2)
+
+			Convey("and looked up again after the refresh interval, keeping the old contacts on failure", func() {
+				def.EnvironmentPath = "groups/other"
+				builder.teams.cached["other"] = cachedContacts{contacts: []string{"bar"}}
+				status = http.StatusInternalServerError
+
+				So(builder.owner(ctx, def).Contacts, ShouldResemble, []string{"bar"})
+				So(lookups.Load(), ShouldEqual, 3)
+
+				builder.teams.cached["other"] = cachedContacts{contacts: []string{"bar"}}
+				status = http.StatusOK
+				remote = "- bad contact\n"
+
+				So(builder.owner(ctx, def).Contacts, ShouldResemble, []string{"bar"})
+				So(lookups.Load(), ShouldEqual, 4)
+			})
+		})
+
+		Convey("builds record their owner, which is given to hooks", func() {
+			out := filepath.Join(t.TempDir(), "owner")
+			conf.PreBuildHooks = []config.Hook{{Name: "owner", Command: `echo "$GSB_OWNER $GSB_CONTACTS" > ` + out}}
+
+			builder, err := New(conf, &s3mock.MockS3{}, mwr)
+			So(err, ShouldBeNil)
+
+			So(builder.Build(ctx, def), ShouldBeNil)
+			So(builder.Status()[0].Owner, ShouldResemble,
+				&Owner{Account: "groups/hgi", Contacts: []string{"foo", "hgi@example.com"}})
+
+			data, errr := os.ReadFile(out)
+			So(errr, ShouldBeNil)
+			So(string(data), ShouldEqual, "groups/hgi foo,hgi@example.com\n")
+		})
+	})
+}
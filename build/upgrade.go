@@ -0,0 +1,294 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const ErrUpgradesDisabled = internal.Error("upgrades not configured")
+
+// upgrader creates new versions of environments; *core.Core is one.
+type upgrader interface {
+	Create(ctx context.Context, path, desc string, pkgs core.Packages) error
+}
+
+// newUpgraderFromConfig returns a core client to create proposed upgrades
+// with, or nil if upgrades aren't configured.
+func newUpgraderFromConfig(conf *config.Config) (upgrader, error) {
+	if !conf.Upgrades.Enabled() {
+		return nil, nil //nolint:nilnil
+	}
+
+	return core.New(conf)
+}
+
+// UpgradeProposal describes a new version of an environment proposed because
+// newer versions of some of its root packages are available. Environment is
+// the version that would be upgraded (like "users/foo/env-1"), and Error says
+// why the new version couldn't be created, if it couldn't.
+type UpgradeProposal struct {
+	Environment string
+	Upgrades    []Upgrade
+	Error       string
+}
+
+// ProposeUpgrades looks at the latest installed version of every environment
+// that opted in to AutoUpgrade, and if any of its root packages have a newer
+// version available in the configured spack versionsFile, asks core to create
+// a new version of the environment with those packages upgraded, and notifies
+// the environment's owner by running the configured upgrades notify hook.
+//
+// The new version will also opt in to AutoUpgrade. An environment won't have
+// another new version proposed until the proposed one has been requested.
+//
+// Returns ErrUpgradesDisabled if upgrades aren't configured, or
+// ErrNoVersionsFile if there's no versionsFile configured.
+func (b *Builder) ProposeUpgrades(ctx context.Context) ([]UpgradeProposal, error) {
+	if b.upgrader == nil {
+		return nil, ErrUpgradesDisabled
+	}
+
+	if b.config.Spack.VersionsFile == "" {
+		return nil, ErrNoVersionsFile
+	}
+
+	latest, err := b.latestVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	envs, err := b.latestInstalledVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	var proposals []UpgradeProposal
+
+	for _, env := range envs {
+		if proposal := b.proposeUpgrade(ctx, env[0], env[1], latest); proposal != nil {
+			proposals = append(proposals, *proposal)
+		}
+	}
+
+	return proposals, nil
+}
+
+// latestInstalledVersions returns the environment path and newest installed
+// version of every installed environment, sorted by path.
+func (b *Builder) latestInstalledVersions() ([][2]string, error) {
+	envs, err := b.installedEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	newest := make(map[string]string)
+
+	for _, env := range envs {
+		if current, ok := newest[env[0]]; !ok || compareVersions(env[1], current) > 0 {
+			newest[env[0]] = env[1]
+		}
+	}
+
+	latest := make([][2]string, 0, len(newest))
+
+	for envPath, version := range newest {
+		latest = append(latest, [2]string{envPath, version})
+	}
+
+	sort.Slice(latest, func(i, j int) bool { return latest[i][0] < latest[j][0] })
+
+	return latest, nil
+}
+
+// proposeUpgrade proposes an upgrade of the given environment version if it
+// opted in and has outdated root packages, returning nil if not.
+func (b *Builder) proposeUpgrade(ctx context.Context, envPath, version string,
+	latest map[string]string) *UpgradeProposal {
+	if b.upgradeProposed(envPath) {
+		return nil
+	}
+
+	def, err := b.readSoftpackYML(ctx, envPath, version)
+	if err != nil || !def.AutoUpgrade {
+		return nil
+	}
+
+	roots, err := b.rootPackages(ctx, filepath.Join(envPath, version))
+	if err != nil {
+		return nil
+	}
+
+	upgrades := outdatedRoots(roots, latest)
+	if len(upgrades) == 0 {
+		return nil
+	}
+
+	proposal := &UpgradeProposal{Environment: def.FullEnvironmentPath(), Upgrades: upgrades}
+	logger := loggerFromContext(ctx).With("envPath", proposal.Environment)
+
+	if err = b.upgrader.Create(ctx, envPath, def.Description, upgradedPackages(def.Packages, upgrades)); err != nil {
+		proposal.Error = err.Error()
+
+		logger.Error("failed to propose upgrade", "err", err)
+
+		return proposal
+	}
+
+	b.mu.Lock()
+	b.proposedUpgrades[envPath] = true
+	b.mu.Unlock()
+
+	logger.Info("proposed upgrade", "upgrades", len(upgrades))
+
+	if err = b.notifyUpgrade(ctx, def, proposal); err != nil {
+		logger.Error("failed to notify owner of upgrade", "err", err)
+	}
+
+	return proposal
+}
+
+// readSoftpackYML returns the Definition in the softpack.yml of the given
+// environment (a path like "users/foo/env") and version in S3.
+func (b *Builder) readSoftpackYML(ctx context.Context, envPath, version string) (*Definition, error) {
+	rc, err := b.s3.OpenFile(ctx, filepath.Join(envPath, version, core.SoftpackYaml))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rc.Close()
+
+	def, err := ParseSoftpackYML(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	def.EnvironmentPath, def.EnvironmentName = path.Split(envPath)
+	def.EnvironmentVersion = version
+
+	return def, nil
+}
+
+// upgradedPackages returns the given packages with the versions of those
+// named in the upgrades changed to the latest.
+func upgradedPackages(pkgs core.Packages, upgrades []Upgrade) core.Packages {
+	upgraded := make(core.Packages, len(pkgs))
+
+	for i, pkg := range pkgs {
+		for _, upgrade := range upgrades {
+			if upgrade.Name == pkg.Name {
+				pkg.Version = upgrade.Latest
+			}
+		}
+
+		upgraded[i] = pkg
+	}
+
+	return upgraded
+}
+
+// notifyUpgrade runs the configured upgrades notify hook, if any, giving it the
+// proposal as JSON on stdin, and in addition to the usual hook environment
+// variables for the upgraded environment version (including GSB_OWNER, the
+// environment's "users/foo" or "groups/bar", and GSB_CONTACTS),
+// GSB_UPGRADES (like "xxhash@0.8.1->0.8.2").
+func (b *Builder) notifyUpgrade(ctx context.Context, def *Definition, proposal *UpgradeProposal) error {
+	hook := b.config.Upgrades.Notify
+	if hook.Command == "" {
+		return nil
+	}
+
+	if hook.Name == "" {
+		hook.Name = "upgrade"
+	}
+
+	proposalJSON, err := json.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+
+	upgrades := make([]string, len(proposal.Upgrades))
+
+	for i, upgrade := range proposal.Upgrades {
+		upgrades[i] = upgrade.Name + "@" + upgrade.Version + "->" + upgrade.Latest
+	}
+
+	stdout, stderr, err := b.execHook(ctx, hook, def, proposalJSON,
+		"GSB_UPGRADES="+strings.Join(upgrades, ","),
+	)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(stdout)+string(stderr)))
+	}
+
+	return nil
+}
+
+// upgradeProposed returns true if we proposed an upgrade of the given
+// environment path that hasn't been requested yet.
+func (b *Builder) upgradeProposed(envPath string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.proposedUpgrades[envPath]
+}
+
+// takeProposedUpgrade returns true if the given Definition is for an
+// environment we proposed an upgrade of, forgetting the proposal.
+func (b *Builder) takeProposedUpgrade(def *Definition) bool {
+	envPath := filepath.Join(def.EnvironmentPath, def.EnvironmentName)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	proposed := b.proposedUpgrades[envPath]
+	delete(b.proposedUpgrades, envPath)
+
+	return proposed
+}
+
+// ProposeUpgradesPeriodically calls ProposeUpgrades() every
+// upgrades.intervalHours (or at the times of the upgrades.schedule cron
+// expression, if set), until the given context is cancelled. Does nothing if
+// upgrades aren't configured.
+func (b *Builder) ProposeUpgradesPeriodically(ctx context.Context) {
+	if !b.config.Upgrades.Enabled() {
+		return
+	}
+
+	b.upgradeProposals.run(ctx, false, func() {
+		if _, err := b.ProposeUpgrades(ctx); err != nil {
+			loggerFromContext(ctx).Error("failed to propose upgrades", "err", err)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+type createdEnv struct {
+	path, desc string
+	pkgs       core.Packages
+}
+
+type mockUpgrader struct {
+	created []createdEnv
+	err     error
+}
+
+func (m *mockUpgrader) Create(_ context.Context, path, desc string, pkgs core.Packages) error {
+	m.created = append(m.created, createdEnv{path, desc, pkgs})
+
+	return m.err
+}
+
+func TestUpgrades(t *testing.T) {
+	Convey("Given an installed environment", t, func() {
+		var conf config.Config
+		conf.Module.ModuleInstallDir = t.TempDir()
+		conf.Module.ScriptsInstallDir = t.TempDir()
+
+		ms3 := &s3mock.MockS3{
+			Exes:        "xxhsum",
+			SoftpackYML: "description: some help text\npackages:\n  - xxhash@0.8.1\n  - r-seurat@4\n",
+			Def:         "groups/hgi/xxhash/1/" + core.SingularityDefBasename,
+			Data:        "def",
+		}
+
+		builder, err := New(&conf, ms3, nil)
+		So(err, ShouldBeNil)
+
+		ctx := context.Background()
+
+		So(builder.Repair(ctx, "groups/hgi/xxhash", "1"), ShouldBeNil)
+
+		Convey("you can't propose upgrades without configuring them", func() {
+			_, err = builder.ProposeUpgrades(ctx)
+			So(err, ShouldEqual, ErrUpgradesDisabled)
+		})
+
+		Convey("with upgrades configured", func() {
+			conf.Upgrades.IntervalHours = 24
+			conf.Spack.VersionsFile = filepath.Join(t.TempDir(), "versions.json")
+			So(os.WriteFile(conf.Spack.VersionsFile, []byte(`[
+				{"name": "xxhash", "versions": ["0.8.2", "0.8.1"]},
+				{"name": "r-seurat", "versions": ["4"]}
+			]`), 0600), ShouldBeNil)
+
+			mu := &mockUpgrader{}
+			builder.upgrader = mu
+
+			Convey("environments that didn't opt in are left alone", func() {
+				proposals, errp := builder.ProposeUpgrades(ctx)
+				So(errp, ShouldBeNil)
+				So(proposals, ShouldBeNil)
+				So(mu.created, ShouldBeNil)
+			})
+
+			Convey("opted in environments get a new version proposed once", func() {
+				ms3.SoftpackYML += "auto_upgrade: true\n"
+
+				notified := filepath.Join(t.TempDir(), "notified")
+				conf.Upgrades.Notify = config.Hook{
+					Command: `echo "$GSB_HOOK $GSB_OWNER $GSB_UPGRADES" > ` + notified,
+				}
+
+				proposals, errp := builder.ProposeUpgrades(ctx)
+				So(errp, ShouldBeNil)
+				So(proposals, ShouldResemble, []UpgradeProposal{{
+					Environment: "groups/hgi/xxhash-1",
+					Upgrades:    []Upgrade{{Name: "xxhash", Version: "0.8.1", Latest: "0.8.2"}},
+				}})
+				So(mu.created, ShouldResemble, []createdEnv{{
+					path: "groups/hgi/xxhash",
+					desc: "some help text",
+					pkgs: core.Packages{{Name: "xxhash", Version: "0.8.2"}, {Name: "r-seurat", Version: "4"}},
+				}})
+
+				data, errr := os.ReadFile(notified)
+				So(errr, ShouldBeNil)
+				So(string(data), ShouldEqual, "upgrade groups/hgi xxhash@0.8.1->0.8.2\n")
+
+				proposals, errp = builder.ProposeUpgrades(ctx)
+				So(errp, ShouldBeNil)
+				So(proposals, ShouldBeNil)
+				So(len(mu.created), ShouldEqual, 1)
+
+				Convey("and the proposed version opts in when requested", func() {
+					def := &Definition{EnvironmentPath: "groups/hgi/", EnvironmentName: "xxhash"}
+					So(builder.takeProposedUpgrade(def), ShouldBeTrue)
+					So(builder.takeProposedUpgrade(def), ShouldBeFalse)
+
+					proposals, errp = builder.ProposeUpgrades(ctx)
+					So(errp, ShouldBeNil)
+					So(len(proposals), ShouldEqual, 1)
+				})
+			})
+
+			Convey("failures to create the new version are reported", func() {
+				ms3.SoftpackYML += "auto_upgrade: true\n"
+				mu.err = errors.New("core unavailable")
+
+				proposals, errp := builder.ProposeUpgrades(ctx)
+				So(errp, ShouldBeNil)
+				So(len(proposals), ShouldEqual, 1)
+				So(proposals[0].Error, ShouldEqual, "core unavailable")
+				So(builder.upgradeProposed("groups/hgi/xxhash"), ShouldBeFalse)
+			})
+		})
+	})
+}
@@ -0,0 +1,252 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const (
+	uploadEndpoint         = "/upload"
+	defaultUploadRetryWait = time.Second
+)
+
+// artefactSender sends the artefacts of environments to core.
+type artefactSender struct {
+	conf      *config.Config
+	client    *http.Client
+	retryWait time.Duration
+}
+
+func newArtefactSender(conf *config.Config, client *http.Client) *artefactSender {
+	return &artefactSender{conf: conf, client: client, retryWait: defaultUploadRetryWait}
+}
+
+// SendArtefacts sends the given artefacts, keyed on their names, to the
+// configured core for the given environment (eg. "users/foo/env-1"), the same
+// way builds do.
+func SendArtefacts(ctx context.Context, conf *config.Config, envPath string, artefacts map[string]io.Reader) error {
+	return newArtefactSender(conf, &http.Client{Timeout: conf.Timeouts.Core()}).send(ctx, artefacts, envPath)
+}
+
+// send sends the given artefacts to core for the environment at the given
+// path, in chunks if configured.
+func (a *artefactSender) send(ctx context.Context, artifacts map[string]io.Reader, //nolint:misspell
+	envPath string) error {
+	if a.conf.Artefacts.Upload.Chunked() {
+		return a.sendInChunks(ctx, artifacts, envPath) //nolint:misspell
+	}
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	errCh := make(chan error, 1)
+
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+
+	go func() {
+		errCh <- sendFormFiles(artifacts, writer, pw) //nolint:misspell
+	}()
+
+	defer pw.Close()
+
+	uploadURL := strings.TrimSuffix(a.conf.CoreURL, "/") + uploadEndpoint + "?" + url.QueryEscape(envPath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, pr)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp, err := a.client.Do(req)
+	loggerFromContext(ctx).Debug("addArtifactsToRepo",
+		"url", a.conf.CoreURL+uploadEndpoint+"?"+url.QueryEscape(envPath), "err", err)
+
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var sb strings.Builder
+
+		io.Copy(&sb, resp.Body) //nolint:errcheck
+
+		return internal.Error(sb.String())
+	}
+
+	return <-errCh
+}
+
+func sendFormFiles(artifacts map[string]io.Reader, //nolint:misspell
+	writer *multipart.Writer, writerInput io.Closer) error {
+	for name, r := range artifacts { //nolint:misspell
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(part, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return writerInput.Close()
+}
+
+// sendInChunks uploads each of the given artefacts to core in chunks, with
+// limited parallelism, then sends core a manifest to confirm the upload.
+func (a *artefactSender) sendInChunks(ctx context.Context, artefacts map[string]io.Reader,
+	envPath string) error {
+	c, err := core.New(a.conf)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(artefacts))
+
+	for name := range artefacts {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	files := make([]core.UploadedFile, len(names))
+	errs := make([]error, len(names))
+	sem := make(chan struct{}, a.conf.Artefacts.Upload.MaxParallel())
+
+	var wg sync.WaitGroup
+
+	for i, name := range names {
+		wg.Add(1)
+
+		go func(i int, name string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+
+				return
+			}
+
+			defer func() { <-sem }()
+
+			files[i], errs[i] = a.uploadArtefact(ctx, c, envPath, name, artefacts[name])
+		}(i, name)
+	}
+
+	wg.Wait()
+
+	if err = errors.Join(errs...); err != nil {
+		return err
+	}
+
+	return c.ConfirmUpload(ctx, envPath, files)
+}
+
+// uploadArtefact sends the data in the given reader to core in chunks,
+// returning a description of what was sent.
+func (a *artefactSender) uploadArtefact(ctx context.Context, c *core.Core, envPath, name string,
+	r io.Reader) (core.UploadedFile, error) {
+	file := core.UploadedFile{Name: name}
+	hash := sha256.New()
+	buf := make([]byte, a.conf.Artefacts.Upload.ChunkSize())
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return file, err
+		}
+
+		if n > 0 || file.Size == 0 {
+			if uerr := a.uploadChunk(ctx, c, envPath, name, file.Size, buf[:n]); uerr != nil {
+				return file, uerr
+			}
+
+			hash.Write(buf[:n])
+			file.Size += int64(n)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	return file, nil
+}
+
+// uploadChunk sends the given chunk of an artefact to core at the given offset,
+// retrying on failure. Retries resume from however much of the chunk core says
+// it already has.
+func (a *artefactSender) uploadChunk(ctx context.Context, c *core.Core, envPath, name string, offset int64,
+	chunk []byte) error {
+	err := c.PutChunk(ctx, envPath, name, offset, chunk)
+
+	for retry := 0; err != nil && retry < a.conf.Artefacts.Upload.MaxRetries(); retry++ {
+		loggerFromContext(ctx).Warn("retrying artefact chunk upload", "name", name, "offset", offset, "err", err)
+
+		if err = sleepContext(ctx, a.retryWait); err != nil {
+			return err
+		}
+
+		if size, serr := c.UploadedSize(ctx, envPath, name); serr == nil && size > offset &&
+			size <= offset+int64(len(chunk)) {
+			chunk = chunk[size-offset:]
+			offset = size
+
+			if len(chunk) == 0 {
+				return nil
+			}
+		}
+
+		err = c.PutChunk(ctx, envPath, name, offset, chunk)
+	}
+
+	return err
+}
@@ -0,0 +1,153 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"bufio"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	usageSpoolExt    = ".tsv"
+	usageFieldsCount = 4
+)
+
+// Usage summarises the logged uses of an environment's executables.
+type Usage struct {
+	Environment string
+	Count       int
+	Users       int
+	LastUsed    time.Time
+	Exes        map[string]int
+}
+
+// usageCounter aggregates usage log lines in to Usages.
+type usageCounter struct {
+	usages map[string]*Usage
+	users  map[string]map[string]bool
+}
+
+func newUsageCounter() *usageCounter {
+	return &usageCounter{
+		usages: make(map[string]*Usage),
+		users:  make(map[string]map[string]bool),
+	}
+}
+
+// add parses a usage log line of the form "timestamp\tenv\texe\tuser" and
+// counts it. Malformed lines are ignored.
+func (u *usageCounter) add(line string) {
+	fields := strings.Split(line, "\t")
+	if len(fields) != usageFieldsCount {
+		return
+	}
+
+	secs, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return
+	}
+
+	env, exe, user := fields[1], fields[2], fields[3]
+
+	usage, ok := u.usages[env]
+	if !ok {
+		usage = &Usage{Environment: env, Exes: make(map[string]int)}
+		u.usages[env] = usage
+		u.users[env] = make(map[string]bool)
+	}
+
+	usage.Count++
+	usage.Exes[exe]++
+	u.users[env][user] = true
+	usage.Users = len(u.users[env])
+
+	if used := time.Unix(secs, 0); used.After(usage.LastUsed) {
+		usage.LastUsed = used
+	}
+}
+
+// sorted returns the counted Usages sorted by Environment.
+func (u *usageCounter) sorted() []Usage {
+	usages := make([]Usage, 0, len(u.usages))
+
+	for _, usage := range u.usages {
+		usages = append(usages, *usage)
+	}
+
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Environment < usages[j].Environment
+	})
+
+	return usages
+}
+
+// Usage returns the number of times each environment's executables have been
+// used, aggregated from the logs in the configured usage spool directory.
+// Returns nil if no spool directory has been configured.
+func (b *Builder) Usage() ([]Usage, error) {
+	spoolDir := b.config.Module.UsageLog.SpoolDir
+	if spoolDir == "" {
+		return nil, nil
+	}
+
+	entries, err := b.inst.fs.ReadDir(spoolDir)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := newUsageCounter()
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != usageSpoolExt {
+			continue
+		}
+
+		if err = b.countUsageFile(counter, filepath.Join(spoolDir, entry.Name())); err != nil {
+			return nil, err
+		}
+	}
+
+	return counter.sorted(), nil
+}
+
+func (b *Builder) countUsageFile(counter *usageCounter, path string) error {
+	f, err := b.inst.fs.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		counter.add(scanner.Text())
+	}
+
+	return scanner.Err()
+}
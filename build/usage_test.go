@@ -0,0 +1,101 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+)
+
+func TestUsage(t *testing.T) {
+	Convey("Given a Builder with a usage spool directory", t, func() {
+		conf := &config.Config{}
+		conf.Module.UsageLog.SpoolDir = "/spool"
+
+		b, err := New(conf, &s3mock.MockS3{}, wrmock.NewMockWR(0, 0))
+		So(err, ShouldBeNil)
+
+		mfs := fsmock.New()
+		b.inst.fs = mfs
+
+		Convey("Usage() errors if the spool directory doesn't exist", func() {
+			_, err = b.Usage()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Usage() aggregates the logs in the spool directory", func() {
+			So(mfs.MkdirAll("/spool/subdir", 0755), ShouldBeNil)
+
+			writeMockFile(mfs, "/spool/user1.tsv", "100\tusers/a/env-1\tx\tuser1\n"+
+				"300\tusers/a/env-1\ty\tuser1\n"+
+				"not a valid line\n"+
+				"200\tgroups/b/env-2\tz\tuser1\n")
+			writeMockFile(mfs, "/spool/user2.tsv", "250\tusers/a/env-1\tx\tuser2\n")
+			writeMockFile(mfs, "/spool/other.txt", "400\tusers/a/env-1\tx\tuser3\n")
+
+			usages, err := b.Usage()
+			So(err, ShouldBeNil)
+			So(usages, ShouldResemble, []Usage{
+				{
+					Environment: "groups/b/env-2",
+					Count:       1,
+					Users:       1,
+					LastUsed:    time.Unix(200, 0),
+					Exes:        map[string]int{"z": 1},
+				},
+				{
+					Environment: "users/a/env-1",
+					Count:       3,
+					Users:       2,
+					LastUsed:    time.Unix(300, 0),
+					Exes:        map[string]int{"x": 2, "y": 1},
+				},
+			})
+		})
+
+		Convey("Usage() returns nothing without a spool directory", func() {
+			conf.Module.UsageLog.SpoolDir = ""
+
+			usages, err := b.Usage()
+			So(err, ShouldBeNil)
+			So(usages, ShouldBeNil)
+		})
+	})
+}
+
+func writeMockFile(mfs *fsmock.MockFS, path, contents string) {
+	f, err := mfs.OpenFile(path, os.O_CREATE|os.O_WRONLY, perms)
+	So(err, ShouldBeNil)
+
+	_, err = f.Write([]byte(contents))
+	So(err, ShouldBeNil)
+	So(f.Close(), ShouldBeNil)
+}
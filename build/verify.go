@@ -0,0 +1,244 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// ImageChecksumBasename is the name of the file installed alongside an
+// environment's image in its scripts directory, holding the hex encoded sha256
+// of the image.
+const ImageChecksumBasename = "." + core.ImageBasename + ".sha256"
+
+// verifiedArtefacts are the basenames of the artefacts sent to core that are
+// also kept in the S3 build location.
+var verifiedArtefacts = [...]string{ //nolint:gochecknoglobals
+	core.SoftpackYaml,
+	core.UsageBasename,
+	core.SpackLockFile,
+	core.SingularityDefBasename,
+	core.BuilderOut,
+}
+
+// Verification describes the Problems found with an installed Environment
+// ("users/foo/env-1"). An environment without any is as gsb installed it.
+type Verification struct {
+	Environment string
+	Problems    []string
+}
+
+func (v *Verification) addProblem(msg string, a ...any) {
+	v.Problems = append(v.Problems, fmt.Sprintf(msg, a...))
+}
+
+// Verify checks the installation of the given environment (a path like
+// "users/foo/env", as per StatusDetail()) and version, reporting any drift
+// from what gsb installed, eg. due to manual edits of the filesystem: that
+// its module file parses and adds its scripts directory to the PATH, that its
+// image exists and matches the checksum recorded when it was installed, that
+// all its executables resolve, and that the artefacts sent to core exist in
+// S3.
+func (b *Builder) Verify(ctx context.Context, envPath, version string) (*Verification, error) {
+	if err := ValidateEnvironmentPath(envPath, version); err != nil {
+		return nil, err
+	}
+
+	dir, name := path.Split(envPath)
+	scriptsDir := ScriptsDir(b.inst.fs, b.config, dir, name, version)
+	modulePath := filepath.Join(ModuleDirFromName(b.config.Module.ModuleInstallDir, dir, name), version)
+	s3Path := filepath.Join(envPath, version)
+
+	v := &Verification{Environment: envPath + "-" + version}
+
+	b.verifyModule(v, modulePath, scriptsDir)
+	b.verifyImage(v, scriptsDir)
+
+	exes, err := b.getExes(ctx, s3Path)
+	if err != nil {
+		v.addProblem("could not get executables list from S3: %s", err)
+	}
+
+	b.verifyExes(v, scriptsDir, exes)
+	b.verifyArtefacts(ctx, v, s3Path)
+
+	return v, nil
+}
+
+func (b *Builder) verifyModule(v *Verification, modulePath, scriptsDir string) {
+	data, err := b.readInstalledFile(modulePath)
+	if err != nil {
+		v.addProblem("module file unreadable: %s", err)
+
+		return
+	}
+
+	if problem := tclProblem(data); problem != "" {
+		v.addProblem("module file doesn't parse: %s", problem)
+	}
+
+	if !addsToPath(data, scriptsDir) {
+		v.addProblem("module file doesn't add %s to PATH", scriptsDir)
+	}
+}
+
+// addsToPath returns true if the given module file data prepends the given
+// directory to the PATH.
+func addsToPath(data []byte, dir string) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		p, found := strings.CutPrefix(strings.TrimSpace(line), "prepend-path PATH ")
+		if found && filepath.Clean(strings.Trim(p, `"`)) == dir {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *Builder) readInstalledFile(p string) ([]byte, error) {
+	f, err := b.inst.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// tclProblem returns a description of why the given module file data isn't
+// valid tcl, checking its header and that its braces, brackets and quotes are
+// balanced. Returns blank if there's no problem.
+func tclProblem(data []byte) string {
+	if !bytes.HasPrefix(data, []byte("#%Module")) {
+		return "missing #%Module header"
+	}
+
+	var (
+		closers []byte
+		quoted  bool
+	)
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+
+		switch {
+		case c == '\\':
+			i++
+		case c == '"' && (len(closers) == 0 || closers[len(closers)-1] != '}'):
+			quoted = !quoted
+		case quoted:
+		case c == '{':
+			closers = append(closers, '}')
+		case c == '[':
+			closers = append(closers, ']')
+		case c == '}' || c == ']':
+			if len(closers) == 0 || closers[len(closers)-1] != c {
+				return fmt.Sprintf("unexpected %c", c)
+			}
+
+			closers = closers[:len(closers)-1]
+		}
+	}
+
+	if quoted {
+		return "unterminated quote"
+	}
+
+	if len(closers) > 0 {
+		return fmt.Sprintf("missing %c", closers[len(closers)-1])
+	}
+
+	return ""
+}
+
+func (b *Builder) verifyImage(v *Verification, scriptsDir string) {
+	img, err := b.openInstalledImage(filepath.Join(scriptsDir, core.ImageBasename))
+	if err != nil {
+		v.addProblem("image unreadable: %s", err)
+
+		return
+	}
+
+	defer img.Close()
+
+	sum := img.SHA256
+	if sum == "" {
+		h := sha256.New()
+
+		if _, err = io.Copy(h, img); err != nil {
+			v.addProblem("image unreadable: %s", err)
+
+			return
+		}
+
+		sum = hex.EncodeToString(h.Sum(nil))
+	}
+
+	recorded, err := b.readInstalledFile(filepath.Join(scriptsDir, ImageChecksumBasename))
+	if err != nil {
+		v.addProblem("no recorded image checksum: %s", err)
+
+		return
+	}
+
+	if want := strings.TrimSpace(string(recorded)); sum != want {
+		v.addProblem("image checksum %s doesn't match recorded %s", sum, want)
+	}
+}
+
+func (b *Builder) verifyExes(v *Verification, scriptsDir string, exes []string) {
+	for _, exe := range exes {
+		f, err := b.inst.fs.Open(filepath.Join(scriptsDir, exe))
+		if err != nil {
+			v.addProblem("executable %s doesn't resolve: %s", exe, err)
+
+			continue
+		}
+
+		f.Close()
+	}
+}
+
+func (b *Builder) verifyArtefacts(ctx context.Context, v *Verification, s3Path string) {
+	for _, basename := range verifiedArtefacts {
+		f, err := b.s3.OpenFile(ctx, filepath.Join(s3Path, basename))
+		if err != nil {
+			v.addProblem("core artefact %s not found in S3: %s", basename, err)
+
+			continue
+		}
+
+		f.Close()
+	}
+}
@@ -0,0 +1,130 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestVerify(t *testing.T) {
+	Convey("Given an installed environment", t, func() {
+		var conf config.Config
+		conf.Module.ModuleInstallDir = t.TempDir()
+		conf.Module.ScriptsInstallDir = t.TempDir()
+
+		def := getExampleDefinition()
+		envPath := filepath.Join(def.EnvironmentPath, def.EnvironmentName)
+		s3Path := filepath.Join(envPath, def.EnvironmentVersion)
+
+		ms3 := &s3mock.MockS3{
+			Exes:        "xxhsum\nR",
+			SoftpackYML: "softpack",
+			Readme:      "readme",
+			Def:         filepath.Join(s3Path, core.SingularityDefBasename),
+			Data:        "def",
+		}
+
+		builder, err := New(&conf, ms3, nil)
+		So(err, ShouldBeNil)
+
+		err = builder.inst.installModule(conf.Module.ScriptsInstallDir, conf.Module.ModuleInstallDir, def,
+			strings.NewReader(def.ToModule(conf.Module.ScriptsInstallDir, nil, []string{"xxhsum", "R"})),
+			strings.NewReader("image"), []string{"xxhsum", "R"}, "")
+		So(err, ShouldBeNil)
+
+		scriptsDir := ScriptsDirFromNameAndVersion(conf.Module.ScriptsInstallDir, def.EnvironmentPath,
+			def.EnvironmentName, def.EnvironmentVersion)
+		modulePath := filepath.Join(ModuleDirFromName(conf.Module.ModuleInstallDir, def.EnvironmentPath,
+			def.EnvironmentName), def.EnvironmentVersion)
+
+		verify := func() []string {
+			v, errv := builder.Verify(context.Background(), envPath, def.EnvironmentVersion)
+			So(errv, ShouldBeNil)
+			So(v.Environment, ShouldEqual, def.FullEnvironmentPath())
+
+			return v.Problems
+		}
+
+		Convey("it verifies without problems", func() {
+			So(verify(), ShouldBeEmpty)
+		})
+
+		Convey("manual changes are reported", func() {
+			So(os.WriteFile(filepath.Join(scriptsDir, core.ImageBasename), []byte("other"), 0600), ShouldBeNil)
+			So(os.Remove(filepath.Join(scriptsDir, "R")), ShouldBeNil)
+
+			f, errf := os.OpenFile(modulePath, os.O_APPEND|os.O_WRONLY, 0)
+			So(errf, ShouldBeNil)
+			_, errf = f.WriteString("proc broken {\n")
+			So(errf, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+
+			ms3.Readme = ""
+
+			problems := verify()
+			So(len(problems), ShouldEqual, 4)
+			So(problems[0], ShouldEqual, "module file doesn't parse: missing }")
+			So(problems[1], ShouldStartWith, "image checksum ")
+			So(problems[1], ShouldEndWith, " doesn't match recorded "+
+				"6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d")
+			So(problems[2], ShouldStartWith, "executable R doesn't resolve: ")
+			So(problems[3], ShouldStartWith, "core artefact README.md not found in S3: ")
+		})
+
+		Convey("missing installations are reported", func() {
+			So(os.RemoveAll(scriptsDir), ShouldBeNil)
+			So(os.Remove(modulePath), ShouldBeNil)
+
+			problems := verify()
+			So(len(problems), ShouldEqual, 4)
+			So(problems[0], ShouldStartWith, "module file unreadable: ")
+			So(problems[1], ShouldStartWith, "image unreadable: ")
+		})
+
+		Convey("invalid environments can't be verified", func() {
+			_, err = builder.Verify(context.Background(), "foo", "1")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Module files must be balanced tcl", t, func() {
+		for data, problem := range map[string]string{
+			"#%Module\nputs stderr \"a { [ \\\" b\"\nproc x { } {\n\tputs \"x\"\n}\n": "",
+			"module-whatis \"x\"\n":    "missing #%Module header",
+			"#%Module\nputs \"x\n":     "unterminated quote",
+			"#%Module\nproc x { } {\n": "missing }",
+			"#%Module\n[x}\n":          "unexpected }",
+		} {
+			So(tclProblem([]byte(data)), ShouldEqual, problem)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"sort"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/s3"
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+const (
+	backendMock  = "mock"
+	moduleFormat = "tcl"
+)
+
+// GSBVersion and GSBCommit are the version of gsb and the git commit it was
+// built from, as recorded in the Provenance of builds and reported by
+// VersionInfo(). The gsb command sets them.
+var (
+	GSBVersion string //nolint:gochecknoglobals
+	GSBCommit  string //nolint:gochecknoglobals
+)
+
+// VersionInfo describes this gsb: its Version, the git Commit it was built
+// from, and the Features it has, so that clients can adapt their behaviour to
+// it, and bug reports can include exactly which gsb was used.
+type VersionInfo struct {
+	Version  string
+	Commit   string
+	Features Features
+}
+
+// Features describes the backends and optional features of a gsb.
+//
+// S3 is the kind of S3 backend ("s3", or "mock" when developing) and Runner
+// the kind of build runner ("wr" or "mock"), with WRDeployments naming the
+// additional wr deployments builds can be routed to. ModuleFormat is the
+// format of the module files we install ("tcl"), and DefaultVersion is the
+// format ("tcl" or "lmod") of the files we maintain to set the default version
+// of modules, if any. Profiles and ProcessorTargets are the build profiles and
+// processor targets that requests can ask for.
+//
+// The rest say if the corresponding optional features are configured.
+type Features struct {
+	S3               string
+	Runner           string
+	WRDeployments    []string
+	ModuleFormat     string
+	DefaultVersion   string
+	Profiles         []string
+	ProcessorTargets []string
+	AirGapped        bool
+	ChunkedUploads   bool
+	CVMFS            bool
+	Replication      bool
+	Quotas           bool
+	Upgrades         bool
+	StatusWebhook    bool
+}
+
+// VersionInfo returns our version, commit and features.
+func (b *Builder) VersionInfo() VersionInfo {
+	return VersionInfo{
+		Version:  GSBVersion,
+		Commit:   GSBCommit,
+		Features: b.features(),
+	}
+}
+
+func (b *Builder) features() Features {
+	return Features{
+		S3:               backendType(b.s3),
+		Runner:           backendType(b.runners[config.DefaultWRDeployment]),
+		WRDeployments:    b.wrDeployments(),
+		ModuleFormat:     moduleFormat,
+		DefaultVersion:   b.config.Module.DefaultVersion,
+		Profiles:         b.profileNames(),
+		ProcessorTargets: b.config.Spack.ProcessorTargets,
+		AirGapped:        b.config.AirGapped.Enabled,
+		ChunkedUploads:   b.config.Artefacts.Upload.Chunked(),
+		CVMFS:            b.config.CVMFS.Enabled(),
+		Replication:      b.config.Replication.Enabled(),
+		Quotas:           b.config.Quotas.Enabled(),
+		Upgrades:         b.config.Upgrades.Enabled(),
+		StatusWebhook:    b.config.StatusWebhook.Enabled(),
+	}
+}
+
+// backendType returns "s3" or "wr" if the given S3 or Runner is a real one,
+// otherwise "mock".
+func backendType(backend any) string {
+	switch backend.(type) {
+	case *s3.S3:
+		return "s3"
+	case *wr.Runner:
+		return "wr"
+	default:
+		return backendMock
+	}
+}
+
+func (b *Builder) wrDeployments() []string {
+	names := make([]string, len(b.config.WRDeployments))
+
+	for i, deployment := range b.config.WRDeployments {
+		names[i] = deployment.Name
+	}
+
+	return names
+}
+
+// profileNames returns the sorted names of the configured build profiles,
+// including the default profile, which doesn't have to be configured.
+func (b *Builder) profileNames() []string {
+	names := []string{config.DefaultProfile}
+
+	for name := range b.config.Profiles {
+		if name != config.DefaultProfile {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
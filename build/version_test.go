@@ -0,0 +1,67 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+)
+
+func TestVersionInfo(t *testing.T) {
+	Convey("Given a builder, you can get its version and features", t, func() {
+		var conf config.Config
+		conf.Module.DefaultVersion = config.DefaultVersionLmod
+		conf.Profiles = map[string]config.Profile{"gpu": {}}
+		conf.WRDeployments = []config.WRDeployment{{Name: "gpu"}}
+		conf.Spack.ProcessorTargets = []string{"x86_64_v3", "x86_64_v4"}
+		conf.Quotas.User.BuildsPerDay = 10
+
+		builder, err := New(&conf, &s3mock.MockS3{}, wrmock.NewMockWR(0, 0))
+		So(err, ShouldBeNil)
+
+		GSBVersion, GSBCommit = "v1.2.3", "abc123"
+		defer func() { GSBVersion, GSBCommit = "", "" }()
+
+		So(builder.VersionInfo(), ShouldResemble, VersionInfo{
+			Version: "v1.2.3",
+			Commit:  "abc123",
+			Features: Features{
+				S3:               "mock",
+				Runner:           "mock",
+				WRDeployments:    []string{"gpu"},
+				ModuleFormat:     "tcl",
+				DefaultVersion:   "lmod",
+				Profiles:         []string{"default", "gpu"},
+				ProcessorTargets: []string{"x86_64_v3", "x86_64_v4"},
+				Quotas:           true,
+			},
+		})
+
+		So(backendType(builder.runners["gpu"]), ShouldEqual, "wr")
+	})
+}
@@ -0,0 +1,274 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
+
+const (
+	ErrStatusWebhook = internal.Error("core rejected status change")
+
+	webhookQueuePerms = 0600
+)
+
+// StatusChange describes a build changing Stage, with the build's Status at
+// that time. It is sent to subscribers, and POSTed as JSON to the configured
+// status webhook.
+type StatusChange struct {
+	Stage  BuildStage
+	Status Status
+}
+
+// statusWebhook delivers StatusChanges to core in the background. Changes for
+// each environment are delivered in order, and each is retried with our backoff
+// until core accepts it, so every change is delivered at least once. Changes
+// not yet delivered are persisted to queueFile, if set, and delivered after a
+// restart.
+type statusWebhook struct {
+	url       string
+	client    *http.Client
+	backoff   retryBackoff
+	queueFile string
+
+	ctx  context.Context //nolint:containedctx
+	stop context.CancelFunc
+
+	mu     sync.Mutex
+	queues map[string][]StatusChange
+}
+
+// newStatusWebhookFromConfig returns a statusWebhook for the configured
+// endpoint, or nil if the status webhook isn't configured. Any changes
+// persisted to the configured queueFile by a previous run start being
+// delivered straight away.
+func newStatusWebhookFromConfig(conf *config.Config, client *http.Client) (*statusWebhook, error) {
+	if !conf.StatusWebhook.Enabled() {
+		return nil, nil //nolint:nilnil
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+
+	w := &statusWebhook{
+		url:    strings.TrimSuffix(conf.CoreURL, "/") + "/" + strings.TrimPrefix(conf.StatusWebhook.Endpoint, "/"),
+		client: client,
+		backoff: retryBackoff{
+			initial: conf.StatusWebhook.RetryInterval(),
+			max:     conf.StatusWebhook.MaxRetryInterval(),
+		},
+		queueFile: conf.StatusWebhook.QueueFile,
+		ctx:       ctx,
+		stop:      stop,
+		queues:    make(map[string][]StatusChange),
+	}
+
+	if err := w.load(); err != nil {
+		stop()
+
+		return nil, err
+	}
+
+	for name := range w.queues {
+		go w.deliverUntilEmpty(ctx, name)
+	}
+
+	return w, nil
+}
+
+// load reads the queues persisted to our queueFile, if any.
+func (w *statusWebhook) load() error {
+	if w.queueFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(w.queueFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &w.queues)
+}
+
+// persist writes our queues to our queueFile, if any. You must hold the lock.
+func (w *statusWebhook) persist() error {
+	if w.queueFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(w.queues)
+	if err != nil {
+		return err
+	}
+
+	tmp := w.queueFile + newSuffix
+
+	if err = os.WriteFile(tmp, data, webhookQueuePerms); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, w.queueFile)
+}
+
+// notify queues the given change for delivery.
+func (w *statusWebhook) notify(ctx context.Context, change StatusChange) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name := change.Status.Name
+	w.queues[name] = append(w.queues[name], change)
+
+	w.persistOrWarn(ctx)
+
+	if len(w.queues[name]) == 1 {
+		go w.deliverUntilEmpty(ctx, name)
+	}
+}
+
+// persistOrWarn persists our queues, logging a warning if that fails, since
+// the changes can still be delivered while we're running. You must hold the
+// lock.
+func (w *statusWebhook) persistOrWarn(ctx context.Context) {
+	if err := w.persist(); err != nil {
+		loggerFromContext(ctx).Warn("failed to persist status webhook queue", "err", err)
+	}
+}
+
+// deliverUntilEmpty delivers the queued changes of the given environment in
+// order until there are none left, or we're stopped.
+func (w *statusWebhook) deliverUntilEmpty(ctx context.Context, name string) {
+	logger := loggerFromContext(ctx)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	defer context.AfterFunc(w.ctx, cancel)()
+
+	for {
+		w.mu.Lock()
+		change := w.queues[name][0]
+		w.mu.Unlock()
+
+		if err := w.backoff.retry(ctx, func() error {
+			return w.deliver(ctx, change)
+		}, func(err error, wait time.Duration) {
+			logger.Warn("delivering status change to core failed; will retry",
+				"stage", change.Stage, "err", err, "retryIn", wait)
+		}); err != nil {
+			return
+		}
+
+		if w.delivered(ctx, name) {
+			return
+		}
+	}
+}
+
+// delivered removes the first queued change of the given environment, and
+// returns true if there are none left.
+func (w *statusWebhook) delivered(ctx context.Context, name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.queues[name] = w.queues[name][1:]
+
+	empty := len(w.queues[name]) == 0
+	if empty {
+		delete(w.queues, name)
+	}
+
+	w.persistOrWarn(ctx)
+
+	return empty
+}
+
+// close stops delivering changes. Changes not yet delivered remain in our
+// queueFile, if any, for the next run to deliver.
+func (w *statusWebhook) close() {
+	w.stop()
+}
+
+func (w *statusWebhook) deliver(ctx context.Context, change StatusChange) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s", ErrStatusWebhook, resp.Status)
+	}
+
+	return nil
+}
+
+// notifyStatusChange publishes the current stage of the given status to
+// subscribers, and tells core about it in the background if the status webhook
+// is configured, if the stage has changed since it was last published.
+func (b *Builder) notifyStatusChange(ctx context.Context, status *Status) {
+	b.statusMu.RLock()
+	change := StatusChange{Stage: status.Stage(), Status: *status}
+	b.statusMu.RUnlock()
+
+	if !b.statusSubs.publish(change) || b.statusWebhook == nil {
+		return
+	}
+
+	b.statusWebhook.notify(context.WithoutCancel(ctx), change)
+}
+
+// Stop stops the Builder's background work that shouldn't outlive the server,
+// such as delivering status changes to core. Undelivered changes are left in
+// the status webhook's queueFile, if configured, for the next run to deliver.
+func (b *Builder) Stop() {
+	if b.statusWebhook != nil {
+		b.statusWebhook.close()
+	}
+}
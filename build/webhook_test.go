@@ -0,0 +1,216 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+)
+
+// webhookCore is a core-like http.Handler that records the StatusChanges
+// POSTed to it, after rejecting the first failFirst requests.
+type webhookCore struct {
+	mu        sync.Mutex
+	failFirst int
+	requests  int
+	paths     []string
+	changes   []StatusChange
+}
+
+func (c *webhookCore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.requests++
+	if c.requests <= c.failFirst {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	var change StatusChange
+
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	c.paths = append(c.paths, r.URL.Path)
+	c.changes = append(c.changes, change)
+}
+
+func (c *webhookCore) requestCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.requests
+}
+
+func (c *webhookCore) stages() []BuildStage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stages := make([]BuildStage, len(c.changes))
+
+	for i, change := range c.changes {
+		stages[i] = change.Stage
+	}
+
+	return stages
+}
+
+func TestStatusWebhook(t *testing.T) {
+	Convey("Without a configured status webhook, status changes aren't sent anywhere", t, func() {
+		builder, err := New(&config.Config{}, &mapS3{files: map[string]string{}}, nil)
+		So(err, ShouldBeNil)
+		So(builder.statusWebhook, ShouldBeNil)
+
+		builder.notifyStatusChange(context.Background(), &Status{Name: "users/foo/env-1"})
+	})
+
+	Convey("Given a Builder with a status webhook on core", t, func() {
+		wc := &webhookCore{failFirst: 2}
+		server := httptest.NewServer(wc)
+
+		defer server.Close()
+
+		var conf config.Config
+		conf.CoreURL = server.URL + "/softpack/"
+		conf.StatusWebhook.Endpoint = "/build-status"
+
+		builder, err := New(&conf, &mapS3{files: map[string]string{}}, nil)
+		So(err, ShouldBeNil)
+		So(builder.statusWebhook, ShouldNotBeNil)
+
+		builder.statusWebhook.backoff = retryBackoff{initial: time.Millisecond, max: time.Millisecond}
+
+		Convey("stage changes are delivered in order, at least once, retrying failures", func() {
+			status := &Status{Name: "users/foo/env-1", BuildID: "abc"}
+			now := time.Now()
+
+			status.JobID = "job1"
+			builder.notifyStatusChange(context.Background(), status)
+			builder.notifyStatusChange(context.Background(), status)
+
+			status.BuildStart = &now
+			builder.notifyStatusChange(context.Background(), status)
+
+			status.BuildDone = &now
+			builder.notifyStatusChange(context.Background(), status)
+
+			status.Error = ErrBuildFailed
+			builder.notifyStatusChange(context.Background(), status)
+
+			ok := waitFor(func() bool {
+				return len(wc.stages()) == 4
+			})
+			So(ok, ShouldBeTrue)
+			So(wc.stages(), ShouldResemble, []BuildStage{
+				BuildStageQueued, BuildStageBuilding, BuildStageDone, BuildStageFailed,
+			})
+
+			wc.mu.Lock()
+			defer wc.mu.Unlock()
+
+			So(wc.requests, ShouldEqual, 6)
+			So(wc.paths[0], ShouldEqual, "/softpack/build-status")
+			So(wc.changes[0].Status.Name, ShouldEqual, "users/foo/env-1")
+			So(wc.changes[0].Status.JobID, ShouldEqual, "job1")
+			So(wc.changes[0].Status.BuildStart, ShouldBeNil)
+			So(wc.changes[3].Status.Error, ShouldEqual, ErrBuildFailed)
+		})
+
+		Convey("undelivered changes survive a Stop in the queueFile, and are delivered by the next Builder", func() {
+			wc.mu.Lock()
+			wc.failFirst = math.MaxInt
+			wc.mu.Unlock()
+
+			conf.StatusWebhook.QueueFile = filepath.Join(t.TempDir(), "queue.json")
+
+			builder, err := New(&conf, &mapS3{files: map[string]string{}}, nil)
+			So(err, ShouldBeNil)
+
+			builder.statusWebhook.backoff = retryBackoff{initial: time.Millisecond, max: 2 * time.Millisecond}
+
+			status := &Status{Name: "users/foo/env-1", BuildID: "abc"}
+			builder.notifyStatusChange(context.Background(), status)
+
+			now := time.Now()
+			status.BuildStart = &now
+			builder.notifyStatusChange(context.Background(), status)
+
+			ok := waitFor(func() bool {
+				return wc.requestCount() > 2
+			})
+			So(ok, ShouldBeTrue)
+
+			builder.Stop()
+
+			requests := wc.requestCount()
+
+			<-time.After(20 * time.Millisecond)
+			So(wc.requestCount(), ShouldBeLessThanOrEqualTo, requests+1)
+
+			var queues map[string][]StatusChange
+
+			data, err := os.ReadFile(conf.StatusWebhook.QueueFile)
+			So(err, ShouldBeNil)
+			So(json.Unmarshal(data, &queues), ShouldBeNil)
+			So(queues["users/foo/env-1"], ShouldHaveLength, 2)
+
+			wc.mu.Lock()
+			wc.failFirst = 0
+			wc.mu.Unlock()
+
+			builder, err = New(&conf, &mapS3{files: map[string]string{}}, nil)
+			So(err, ShouldBeNil)
+
+			defer builder.Stop()
+
+			ok = waitFor(func() bool {
+				return len(wc.stages()) == 2
+			})
+			So(ok, ShouldBeTrue)
+			So(wc.stages(), ShouldResemble, []BuildStage{BuildStageRequested, BuildStageBuilding})
+
+			ok = waitFor(func() bool {
+				data, err = os.ReadFile(conf.StatusWebhook.QueueFile)
+
+				return err == nil && string(data) == "{}"
+			})
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
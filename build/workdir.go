@@ -0,0 +1,177 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// buildsDirName is the directory within an environment version's S3 location
+// that holds the working directories of its individual builds.
+const buildsDirName = ".builds"
+
+// failureLogsDir is the directory within a failed build's working directory
+// that its wr job copies the spack-stage logs of the failed packages to.
+const failureLogsDir = "logs"
+
+// builtFiles are the artefacts of a successful build job, copied from its
+// working directory to the environment version's S3 location.
+var builtFiles = [...]string{ //nolint:gochecknoglobals
+	core.SingularityDefBasename,
+	core.BuilderOut,
+	core.ExesBasename,
+	core.SpackLockFile,
+	core.ImageBasename,
+}
+
+// s3Remover is implemented by S3s that can remove files, letting us clean up
+// build working directories.
+type s3Remover interface {
+	RemoveFile(path string) error
+}
+
+// S3PrefixRemover is implemented by S3s that can remove everything within a
+// directory, including files whose names aren't known in advance.
+type S3PrefixRemover interface {
+	RemovePrefix(dir string) error
+}
+
+// s3Copier is implemented by S3s that can copy files within S3 themselves,
+// letting us promote multi-GB images without downloading and re-uploading them.
+type s3Copier interface {
+	CopyFile(ctx context.Context, source, dest string) error
+}
+
+// s3Lister is implemented by S3s that can list the files in a directory,
+// letting us find the package build logs of failed builds.
+type s3Lister interface {
+	ListFiles(dir string) ([]string, error)
+}
+
+// buildWorkPath returns the S3 working directory for the build with the given
+// ID of the environment version at the given s3Path, so that concurrent builds
+// of the same version don't write over each other's files.
+func buildWorkPath(s3Path, buildID string) string {
+	return filepath.Join(s3Path, buildsDirName, buildID)
+}
+
+// promoteBuild copies the given files from the build working directory
+// workPath to s3Path, then removes the whole of workPath if our S3 supports
+// that, or else just the given files from it if it can do that. Files that
+// don't exist in workPath are skipped if skipMissing, otherwise cause an error.
+func (b *Builder) promoteBuild(ctx context.Context, workPath, s3Path string, files []string,
+	skipMissing bool) error {
+	logger := loggerFromContext(ctx)
+
+	for _, file := range files {
+		if err := b.copyS3File(ctx, filepath.Join(workPath, file), filepath.Join(s3Path, file)); err != nil {
+			if skipMissing && ctx.Err() == nil {
+				logger.Debug("build file not promoted", "file", file, "err", err)
+
+				continue
+			}
+
+			return err
+		}
+	}
+
+	b.removeWorkDir(ctx, workPath, files)
+
+	return nil
+}
+
+// removeWorkDir removes the whole of the build working directory workPath if
+// our S3 supports that, or else just the given files from it (or the usual
+// builtFiles, if files is nil) if it can do that. Failures are only logged.
+func (b *Builder) removeWorkDir(ctx context.Context, workPath string, files []string) {
+	logger := loggerFromContext(ctx)
+
+	if pr, ok := b.s3.(S3PrefixRemover); ok {
+		if err := pr.RemovePrefix(workPath); err != nil {
+			logger.Warn("failed to remove build working directory", "err", err)
+		}
+
+		return
+	}
+
+	remover, ok := b.s3.(s3Remover)
+	if !ok {
+		return
+	}
+
+	if files == nil {
+		files = builtFiles[:]
+	}
+
+	for _, file := range files {
+		if err := remover.RemoveFile(filepath.Join(workPath, file)); err != nil {
+			logger.Warn("failed to remove build working file", "file", file, "err", err)
+		}
+	}
+}
+
+// copyS3File copies source to dest within our S3, server-side if our S3
+// supports that.
+func (b *Builder) copyS3File(ctx context.Context, source, dest string) error {
+	if copier, ok := b.s3.(s3Copier); ok {
+		return copier.CopyFile(ctx, source, dest)
+	}
+
+	rc, err := b.s3.OpenFile(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+
+	return b.s3.UploadData(ctx, rc, dest)
+}
+
+// failureLogs returns the paths, relative to workPath, of the package build
+// logs that a failed build's wr job saved. Returns nothing if our S3 can't list
+// files.
+func (b *Builder) failureLogs(ctx context.Context, workPath string) []string {
+	lister, ok := b.s3.(s3Lister)
+	if !ok {
+		return nil
+	}
+
+	names, err := lister.ListFiles(filepath.Join(workPath, failureLogsDir))
+	if err != nil {
+		loggerFromContext(ctx).Warn("failed to list package build logs", "err", err)
+
+		return nil
+	}
+
+	logs := make([]string, len(names))
+
+	for i, name := range names {
+		logs[i] = filepath.Join(failureLogsDir, name)
+	}
+
+	return logs
+}
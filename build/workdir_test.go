@@ -0,0 +1,157 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package build
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// removingS3 is a mapS3 that can also remove files.
+type removingS3 struct {
+	*mapS3
+}
+
+func (r removingS3) RemoveFile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.files, path)
+
+	return nil
+}
+
+// prefixRemovingS3 is a mapS3 that can also remove whole directories.
+type prefixRemovingS3 struct {
+	*mapS3
+}
+
+func (r prefixRemovingS3) RemovePrefix(dir string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for path := range r.files {
+		if strings.HasPrefix(path, dir+"/") {
+			delete(r.files, path)
+		}
+	}
+
+	return nil
+}
+
+// copyingS3 is a mapS3 that copies files itself, and can't be downloaded
+// from.
+type copyingS3 struct {
+	*mapS3
+}
+
+func (c copyingS3) OpenFile(context.Context, string) (io.ReadCloser, error) {
+	return nil, fs.ErrPermission
+}
+
+func (c copyingS3) CopyFile(_ context.Context, source, dest string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, ok := c.files[source]
+	if !ok {
+		return fs.ErrNotExist
+	}
+
+	c.files[dest] = data
+
+	return nil
+}
+
+func TestPromoteBuild(t *testing.T) {
+	Convey("Given a Builder with files in a build working directory", t, func() {
+		workPath := buildWorkPath("users/foo/env/1", "abc")
+		So(workPath, ShouldEqual, "users/foo/env/1/.builds/abc")
+
+		ms3 := &mapS3{files: map[string]string{
+			workPath + "/" + core.SingularityDefBasename: "def data",
+			workPath + "/" + core.BuilderOut:             "log data",
+		}}
+
+		builder, err := New(&config.Config{}, ms3, nil)
+		So(err, ShouldBeNil)
+
+		files := []string{core.SingularityDefBasename, core.BuilderOut, core.ImageBasename}
+
+		Convey("you can't promote them if some are missing", func() {
+			err = builder.promoteBuild(context.Background(), workPath, "users/foo/env/1", files, false)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("you can promote those that exist, leaving them in place if the S3 can't remove", func() {
+			err = builder.promoteBuild(context.Background(), workPath, "users/foo/env/1", files, true)
+			So(err, ShouldBeNil)
+			So(ms3.files["users/foo/env/1/"+core.SingularityDefBasename], ShouldEqual, "def data")
+			So(ms3.files["users/foo/env/1/"+core.BuilderOut], ShouldEqual, "log data")
+			So(ms3.numFiles(), ShouldEqual, 4)
+		})
+
+		Convey("promoted files are removed from the working directory if the S3 can remove", func() {
+			builder.s3 = removingS3{ms3}
+
+			err = builder.promoteBuild(context.Background(), workPath, "users/foo/env/1", files, true)
+			So(err, ShouldBeNil)
+			So(ms3.files, ShouldResemble, map[string]string{
+				"users/foo/env/1/" + core.SingularityDefBasename: "def data",
+				"users/foo/env/1/" + core.BuilderOut:             "log data",
+			})
+		})
+
+		Convey("files are copied within S3 if the S3 can do that", func() {
+			builder.s3 = copyingS3{ms3}
+
+			err = builder.promoteBuild(context.Background(), workPath, "users/foo/env/1", files, true)
+			So(err, ShouldBeNil)
+			So(ms3.files["users/foo/env/1/"+core.SingularityDefBasename], ShouldEqual, "def data")
+			So(ms3.files["users/foo/env/1/"+core.BuilderOut], ShouldEqual, "log data")
+
+			err = builder.promoteBuild(context.Background(), workPath, "users/foo/env/1", files, false)
+			So(err, ShouldEqual, fs.ErrNotExist)
+		})
+
+		Convey("the whole working directory is removed if the S3 can remove directories", func() {
+			ms3.files[workPath+"/logs/xxhash-build-out.txt"] = "package log"
+			builder.s3 = prefixRemovingS3{ms3}
+
+			err = builder.promoteBuild(context.Background(), workPath, "users/foo/env/1", files, true)
+			So(err, ShouldBeNil)
+			So(ms3.files, ShouldResemble, map[string]string{
+				"users/foo/env/1/" + core.SingularityDefBasename: "def data",
+				"users/foo/env/1/" + core.BuilderOut:             "log data",
+			})
+		})
+	})
+}
@@ -0,0 +1,171 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+package build
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
+)
+
+const fakeSingularity = `#!/bin/bash
+[ "$1" = exec ] || exit 255
+shift
+
+while [ "$1" = --bind ]; do
+	echo "$2" >> "$(dirname "$0")/binds"
+	shift 2
+done
+
+[ "$(cat "$1")" = image ] || exit 255
+
+exec "$(dirname "$0")/image/$2" "${@:3}"
+`
+
+func TestWrapper(t *testing.T) {
+	Convey("Given a fake singularity and image", t, func() {
+		binDir := t.TempDir()
+		writeExecutable(t, filepath.Join(binDir, "singularity"), fakeSingularity)
+		writeExecutable(t, filepath.Join(binDir, "image", "args"),
+			"#!/bin/bash\nprintf '[%s]\\n' \"$@\"\ncat\nexit 3\n")
+		writeExecutable(t, filepath.Join(binDir, "image", "sleeper"),
+			"#!/bin/bash\ntrap 'exit 42' TERM\necho ready\nsleep 10 &\nwait\n")
+
+		t.Setenv("PATH", binDir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+		scriptsBase, modulesBase := t.TempDir(), t.TempDir()
+		def := getExampleDefinition()
+		scriptsDir := ScriptsDirFromNameAndVersion(scriptsBase, def.EnvironmentPath, def.EnvironmentName,
+			def.EnvironmentVersion)
+
+		inst := newInstaller(fsys.OS{})
+		inst.wrapperBinds = []string{"/lustre", "/path with spaces"}
+
+		install := func() {
+			err := inst.installModule(scriptsBase, modulesBase, def, strings.NewReader("module"),
+				strings.NewReader("image"), []string{"args", "sleeper"}, "")
+			So(err, ShouldBeNil)
+		}
+
+		runArgs := func(exe string) string {
+			cmd := exec.Command(exe, "a b", "", "*", "--flag")
+			cmd.Stdin = strings.NewReader("input\n")
+
+			out, err := cmd.Output()
+
+			var exitErr *exec.ExitError
+			So(errors.As(err, &exitErr), ShouldBeTrue)
+			So(exitErr.ExitCode(), ShouldEqual, 3)
+
+			return string(out)
+		}
+
+		Convey("the generated wrapper passes through argv, stdin and exit codes", func() {
+			install()
+
+			link, err := os.Readlink(filepath.Join(scriptsDir, "args"))
+			So(err, ShouldBeNil)
+			So(link, ShouldEqual, WrapperBasename)
+
+			So(runArgs(filepath.Join(scriptsDir, "args")), ShouldEqual, "[a b]\n[]\n[*]\n[--flag]\ninput\n")
+
+			binds, err := os.ReadFile(filepath.Join(binDir, "binds"))
+			So(err, ShouldBeNil)
+			So(string(binds), ShouldEqual, "/lustre\n/path with spaces\n")
+
+			Convey("even when invoked via a symlink elsewhere", func() {
+				userLink := filepath.Join(t.TempDir(), "args")
+				So(os.Symlink(filepath.Join(scriptsDir, "args"), userLink), ShouldBeNil)
+
+				So(runArgs(userLink), ShouldEqual, "[a b]\n[]\n[*]\n[--flag]\ninput\n")
+			})
+		})
+
+		Convey("the generated wrapper passes signals to the exe", func() {
+			install()
+
+			cmd := exec.Command(filepath.Join(scriptsDir, "sleeper"))
+
+			stdout, err := cmd.StdoutPipe()
+			So(err, ShouldBeNil)
+			So(cmd.Start(), ShouldBeNil)
+
+			line, err := bufio.NewReader(stdout).ReadString('\n')
+			So(err, ShouldBeNil)
+			So(line, ShouldEqual, "ready\n")
+
+			So(cmd.Process.Signal(syscall.SIGTERM), ShouldBeNil)
+
+			err = cmd.Wait()
+
+			var exitErr *exec.ExitError
+			So(errors.As(err, &exitErr), ShouldBeTrue)
+			So(exitErr.ExitCode(), ShouldEqual, 42)
+		})
+
+		Convey("the generated wrapper works with usage logging", func() {
+			inst.usageSpoolDir = t.TempDir()
+
+			install()
+
+			So(runArgs(filepath.Join(scriptsDir, "args")), ShouldEqual, "[a b]\n[]\n[*]\n[--flag]\ninput\n")
+
+			entries, err := os.ReadDir(inst.usageSpoolDir)
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+		})
+
+		Convey("no wrapper is generated if one is configured", func() {
+			err := inst.installModule(scriptsBase, modulesBase, def, strings.NewReader("module"),
+				strings.NewReader("image"), []string{"args"}, "/path/to/wrapper")
+			So(err, ShouldBeNil)
+
+			_, err = os.Stat(filepath.Join(scriptsDir, WrapperBasename))
+			So(err, ShouldNotBeNil)
+
+			_, err = os.Stat(filepath.Join(scriptsDir, core.ImageBasename))
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func writeExecutable(t *testing.T, path, contents string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), dirPerms); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(contents), 0700); err != nil { //nolint:gosec
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,298 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/gsbclient"
+)
+
+const (
+	adminRequestTimeout = 30 * time.Second
+	adminRepairTimeout  = 4 * time.Hour
+)
+
+// Options for this sub-command.
+var (
+	adminURL          string
+	adminRepairDryRun bool
+)
+
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Administer a running gsb server",
+	Long: `Administer a running gsb server.
+
+These sub-commands talk to the admin endpoints of the gsb server at --url
+(defaulting to $GSB_URL, or else the listenURL in your config).
+
+If the server has a server.adminToken configured, you must supply the same
+token, either in $GSB_ADMIN_TOKEN, or as server.adminToken in your config.
+`,
+}
+
+var adminPauseCmd = &cobra.Command{
+	Use:   "pause",
+	Short: "Reject new builds",
+	Long: `Reject new builds.
+
+New build requests will be rejected until you resume. Running builds carry on.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		setMaintenance(cmd.Context(), build.MaintenancePaused)
+	},
+}
+
+var adminDrainCmd = &cobra.Command{
+	Use:   "drain",
+	Short: "Queue new builds",
+	Long: `Queue new builds.
+
+Running builds carry on, and new build requests are queued until you resume.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		setMaintenance(cmd.Context(), build.MaintenanceDraining)
+	},
+}
+
+var adminResumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "Accept builds again",
+	Long: `Accept builds again.
+
+Ends a pause or drain, starting any builds that were queued.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		setMaintenance(cmd.Context(), build.MaintenanceOff)
+	},
+}
+
+var adminRequeueCmd = &cobra.Command{
+	Use:   "requeue",
+	Short: "Build an environment again",
+	Long: `Build an environment again.
+
+Builds the given environment again, using the definition it was last requested
+with since the server started. It must not currently be building.
+
+Usage: gsb admin requeue softpack/env/path version
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := envNameFromArgs(args).Get("name")
+
+		adminRequest(cmd.Context(), func(ctx context.Context, client *gsbclient.Client) error {
+			return client.Requeue(ctx, name)
+		})
+	},
+}
+
+var adminCancelCmd = &cobra.Command{
+	Use:   "cancel",
+	Short: "Cancel a running build",
+	Long: `Cancel a running build.
+
+Stops gsb waiting on and installing the running build of the given environment,
+and kills and removes its wr job. If the job couldn't be stopped, an error is
+reported and the environment can't be built again until a cancel succeeds.
+
+Usage: gsb admin cancel softpack/env/path version
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := envNameFromArgs(args).Get("name")
+
+		adminRequest(cmd.Context(), func(ctx context.Context, client *gsbclient.Client) error {
+			return client.Cancel(ctx, name)
+		})
+	},
+}
+
+var adminRepairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Verify and repair all installed environments",
+	Long: `Verify and repair all installed environments.
+
+Runs the same checks as 'gsb verify' on every environment installed in the
+server's moduleInstallDir, and reinstalls the broken ones from their S3 build
+location: their images are downloaded again, and their module files and scripts
+are regenerated. Environments that are currently being built are skipped.
+
+With --dry-run, only reports the broken environments without repairing them.
+
+Prints each broken environment's problems, and whether it was repaired, followed
+by a summary. Exits non-zero if any environment is left broken.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithTimeout(cmd.Context(), adminRepairTimeout)
+		defer cancel()
+
+		report, err := adminClient().Repair(ctx, adminRepairDryRun)
+		if err != nil {
+			die("request failed: %s", err)
+		}
+
+		printRepairReport(report)
+
+		if report.Broken > report.Repaired {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(adminCmd)
+
+	adminCmd.AddCommand(adminPauseCmd, adminDrainCmd, adminResumeCmd, adminRequeueCmd, adminCancelCmd,
+		adminRepairCmd)
+
+	adminCmd.PersistentFlags().StringVarP(&adminURL, "url", "u", os.Getenv("GSB_URL"), "URL to running GSB server")
+
+	adminRepairCmd.Flags().BoolVarP(&adminRepairDryRun, "dry-run", "n", false,
+		"only report broken environments, don't repair them")
+}
+
+// printRepairReport prints the problems of each broken environment in the given
+// report, what happened when repairing it, and a summary.
+func printRepairReport(report *build.RepairReport) {
+	for _, env := range report.Environments {
+		cliPrint("%s:\n", env.Environment)
+
+		for _, problem := range env.Problems {
+			cliPrint("  %s\n", problem)
+		}
+
+		switch {
+		case env.Repaired:
+			cliPrint("  => repaired\n")
+		case env.Error != "":
+			cliPrint("  => repair failed: %s\n", env.Error)
+		}
+	}
+
+	cliPrint("checked %d, broken %d, repaired %d, failed %d\n",
+		report.Checked, report.Broken, report.Repaired, report.Failed)
+}
+
+// envNameFromArgs returns the query for the environment path and version in
+// the given args, dying if they're invalid.
+func envNameFromArgs(args []string) url.Values {
+	if len(args) != numArgs {
+		die("environment path and version required")
+	}
+
+	envPath := cleanEnvPath(args[0])
+
+	if envPath != args[0] {
+		die("invalid environment path")
+	}
+
+	if err := build.ValidateEnvironmentPath(envPath, args[1]); err != nil {
+		die(err.Error())
+	}
+
+	return url.Values{"name": {envPath + "-" + args[1]}}
+}
+
+// setMaintenance changes the server's maintenance mode and prints the
+// resulting MaintenanceStatus, dying if the request wasn't successful.
+func setMaintenance(ctx context.Context, mode build.MaintenanceMode) {
+	ctx, cancel := context.WithTimeout(ctx, adminRequestTimeout)
+	defer cancel()
+
+	status, err := adminClient().SetMaintenance(ctx, mode)
+	if err != nil {
+		die("request failed: %s", err)
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		die("failed to read response: %s", err)
+	}
+
+	cliPrint("%s\n", data)
+}
+
+// adminRequest calls the given function with a client for the server that has
+// our admin token, dying if it returns an error.
+func adminRequest(ctx context.Context, request func(context.Context, *gsbclient.Client) error) {
+	ctx, cancel := context.WithTimeout(ctx, adminRequestTimeout)
+	defer cancel()
+
+	if err := request(ctx, adminClient()); err != nil {
+		die("request failed: %s", err)
+	}
+
+	info("done")
+}
+
+// adminClient returns a client for the server with our admin token.
+func adminClient() *gsbclient.Client {
+	return gsbclient.New(adminURLAndToken())
+}
+
+// adminURLAndToken returns the server URL and admin token from our --url and
+// $GSB_ADMIN_TOKEN, falling back on the config for any that aren't set.
+func adminURLAndToken() (string, string) {
+	token := os.Getenv("GSB_ADMIN_TOKEN")
+	if token == "" {
+		token = loadConfig().Server.AdminToken
+	}
+
+	return serverURL(adminURL), token
+}
+
+// serverURL returns the given URL of a gsb server, or if blank, one for the
+// listenURL in the config.
+func serverURL(given string) string {
+	if given == "" {
+		given = loadConfig().ListenURL
+	}
+
+	if given == "" {
+		die("no server URL; supply --url")
+	}
+
+	if !strings.Contains(given, "://") {
+		given = "http://" + given
+	}
+
+	return strings.TrimSuffix(given, "/")
+}
+
+func loadConfig() *config.Config {
+	conf, err := config.GetConfig(configPath)
+	if err != nil {
+		die("could not load config: %s", err)
+	}
+
+	return conf
+}
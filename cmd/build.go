@@ -25,6 +25,7 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -59,7 +60,7 @@ Allows manual builds without a softpack client.`,
 		path := readInput("Enter environment path: ", buildPath)
 		desc := readInput("Enter environment description (single line): ", buildDescription)
 		pkgs := getPackageList(buildPackagesPath)
-		err = c.Create(path, desc, pkgs)
+		err = c.Create(context.Background(), path, desc, pkgs)
 		if err != nil {
 			die("failed to create environment (but it might be queued for later): %s", err)
 		}
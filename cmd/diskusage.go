@@ -0,0 +1,120 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/gsbclient"
+)
+
+const (
+	diskUsageTimeout    = 10 * adminRequestTimeout
+	defaultDiskUsageTop = 20
+	bytesPerKiB         = 1024
+)
+
+// Options for this sub-command.
+var (
+	diskUsageURL string
+	diskUsageTop int
+)
+
+var diskUsageCmd = &cobra.Command{
+	Use:   "disk-usage",
+	Short: "Report the disk usage of installed environments",
+	Long: `Report the disk usage of installed environments.
+
+Asks the gsb server at --url (defaulting to $GSB_URL, or else the listenURL in
+your config) for the installed size (image plus scripts) of every environment,
+wherever its scripts were placed.
+
+Prints the total, then the usage of each user and group, and then the --top
+largest environments, biggest first. Use --top 0 to list all of them.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := context.WithTimeout(cmd.Context(), diskUsageTimeout)
+		defer cancel()
+
+		report, err := gsbclient.New(serverURL(diskUsageURL), "").DiskUsage(ctx)
+		if err != nil {
+			die("request failed: %s", err)
+		}
+
+		printDiskUsageReport(report, diskUsageTop)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(diskUsageCmd)
+
+	diskUsageCmd.Flags().StringVarP(&diskUsageURL, "url", "u", os.Getenv("GSB_URL"), "URL to running GSB server")
+	diskUsageCmd.Flags().IntVarP(&diskUsageTop, "top", "t", defaultDiskUsageTop,
+		"number of the largest environments to list")
+}
+
+// printDiskUsageReport prints the total, per-owner and top per-environment
+// usage in the given report.
+func printDiskUsageReport(report *build.DiskUsageReport, top int) {
+	cliPrint("total: %s in %d environments\n\n", humanBytes(report.Bytes), len(report.Environments))
+
+	for _, owner := range report.Owners {
+		cliPrint("%10s  %s (%d environments)\n", humanBytes(owner.Bytes), owner.Owner, owner.Environments)
+	}
+
+	envs := report.Environments
+	if top > 0 && top < len(envs) {
+		envs = envs[:top]
+	}
+
+	if len(envs) > 0 {
+		cliPrint("\n")
+	}
+
+	for _, env := range envs {
+		cliPrint("%10s  %s (image %s)\n", humanBytes(env.Bytes), env.Environment, humanBytes(env.ImageBytes))
+	}
+}
+
+// humanBytes returns the given number of bytes in the largest binary unit that
+// leaves at least 1 of them, eg. "1.5 GiB".
+func humanBytes(n int64) string {
+	if n < bytesPerKiB {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	size := float64(n)
+	unit := -1
+
+	for size >= bytesPerKiB && unit < len("KMGTPE")-1 {
+		size /= bytesPerKiB
+		unit++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", size, "KMGTPE"[unit])
+}
@@ -0,0 +1,144 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package cmd
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// Options for this sub-command.
+var (
+	doctorPath    string
+	doctorVersion string
+	doctorPackage string
+	doctorScratch string
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check a gsb deployment works end to end",
+	Long: `Check a gsb deployment works end to end.
+
+Using your config, builds a tiny throwaway environment (by default, one
+containing just zlib) at the --path environment path, exercising the whole
+stack: it generates and uploads a singularity definition to S3, submits the
+build to wr and waits for it to complete, checks the build artefacts appear in
+S3, then installs the module and image and verifies the installation.
+
+The environment is installed to a --scratch directory (a temporary directory
+that is deleted afterwards by default) instead of your configured module and
+scripts install dirs, and nothing is sent to core, so it won't be visible to
+users. It will, however, be built in S3 under the --path.
+
+A pass/fail checklist is printed, and the command exits non-zero if any check
+failed.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		conf := loadConfig()
+
+		scratch, cleanup := doctorScratchDir()
+		defer cleanup()
+
+		conf.Module.ModuleInstallDir = filepath.Join(scratch, "modules")
+		conf.Module.ScriptsInstallDir = filepath.Join(scratch, "scripts")
+		conf.Module.ScriptsMinFreeGB = 0
+		conf.Module.ScriptsOverflow = nil
+
+		b, err := build.New(conf, nil, nil)
+		if err != nil {
+			die("could not create a builder: %s", err)
+		}
+
+		dir, name := path.Split(doctorPath)
+
+		checks := b.Doctor(cmd.Context(), &build.Definition{
+			EnvironmentPath:    dir,
+			EnvironmentName:    name,
+			EnvironmentVersion: doctorVersion,
+			Packages:           core.Packages{{Name: doctorPackage}},
+		})
+
+		if !printDoctorChecks(checks) {
+			cleanup()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+
+	doctorCmd.Flags().StringVarP(&doctorPath, "path", "p", "users/gsb-doctor/doctor",
+		"environment path to build the throwaway environment at")
+	doctorCmd.Flags().StringVarP(&doctorVersion, "version", "v", "1",
+		"version of the throwaway environment")
+	doctorCmd.Flags().StringVar(&doctorPackage, "package", "zlib",
+		"spack package the throwaway environment contains")
+	doctorCmd.Flags().StringVarP(&doctorScratch, "scratch", "s", "",
+		"directory to install to and leave in place (defaults to a temporary directory)")
+}
+
+// doctorScratchDir returns the --scratch directory, or else a new temporary
+// directory, along with a function that removes the latter.
+func doctorScratchDir() (string, func()) {
+	if doctorScratch != "" {
+		return doctorScratch, func() {}
+	}
+
+	dir, err := os.MkdirTemp("", "gsb-doctor")
+	if err != nil {
+		die("could not create scratch directory: %s", err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// printDoctorChecks prints a checklist of the given checks, returning true if
+// they all passed.
+func printDoctorChecks(checks []build.DoctorCheck) bool {
+	ok := true
+
+	for _, check := range checks {
+		switch {
+		case check.Passed():
+			cliPrint("[PASS] %s\n", check.Name)
+		case check.Skipped:
+			ok = false
+
+			cliPrint("[SKIP] %s\n", check.Name)
+		default:
+			ok = false
+
+			cliPrint("[FAIL] %s: %s\n", check.Name, check.Err)
+		}
+	}
+
+	return ok
+}
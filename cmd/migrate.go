@@ -0,0 +1,240 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
+)
+
+const (
+	defaultMigrateJournal = "gsb-migrate-journal.jsonl"
+	migrateJournalPerms   = 0600
+)
+
+// Options for this sub-command.
+var (
+	migrateFrom     string
+	migrateRenames  []string
+	migrateDryRun   bool
+	migrateJournal  string
+	migrateRollback bool
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move installed environments to a new layout",
+	Long: `Move installed environments to a new layout.
+
+When you change your config's moduleInstallDir, scriptsInstallDir or
+scriptsOverflow (eg. for a new loadPath), existing environments need moving to
+match. Give the config they were installed with as --from; the config from
+--config (or the default location) describes the new layout.
+
+Every environment installed in the old moduleInstallDir has its scripts
+directory moved to the corresponding new scripts target, and its module file
+moved to the new moduleInstallDir, rewritten to add the new scripts directory to
+the PATH. Default versions are updated in the old and new module directories.
+
+Environments can also be moved to new paths with --rename old=new (which can be
+given more than once), eg. --rename groups/old=groups/new moves every
+environment in groups/old to groups/new. Core, at the new config's coreURL, is
+told about each renamed environment.
+
+Nothing is changed if any environment would be moved on top of an existing one.
+With --dry-run, the moves are only printed.
+
+Each step of each move is appended to a journal at --journal (by default
+gsb-migrate-journal.jsonl next to the --from config) before it is carried out,
+and again once it is done, so it records partial moves even if the migration
+fails or is interrupted part way through. To undo the migration, run again with
+the same configs and --rollback, which undoes every step in the journal that
+hasn't already been rolled back, instead of moving anything new.
+
+Don't migrate while the gsb server is running.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if migrateFrom == "" {
+			die("--from is required")
+		}
+
+		from, err := config.GetConfig(migrateFrom)
+		if err != nil {
+			die("could not load --from config: %s", err)
+		}
+
+		to, err := config.GetConfig(configPath)
+		if err != nil {
+			die("could not load config: %s", err)
+		}
+
+		if migrateJournal == "" {
+			migrateJournal = filepath.Join(filepath.Dir(migrateFrom), defaultMigrateJournal)
+		}
+
+		if migrateRollback {
+			rollbackMigration(cmd.Context(), from, to)
+
+			return
+		}
+
+		migrate(cmd.Context(), from, to)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().StringVarP(&migrateFrom, "from", "f", "",
+		"path to the config the environments were installed with")
+	migrateCmd.Flags().StringArrayVarP(&migrateRenames, "rename", "r", nil,
+		"move environments in an old path to a new one, as old=new")
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false,
+		"print what would be moved without moving anything")
+	migrateCmd.Flags().StringVarP(&migrateJournal, "journal", "j", "",
+		"path to append the journal of what was moved to, or read it from with --rollback "+
+			"(default "+defaultMigrateJournal+" next to the --from config)")
+	migrateCmd.Flags().BoolVar(&migrateRollback, "rollback", false,
+		"undo the migration recorded in the --journal")
+}
+
+func migrate(ctx context.Context, from, to *config.Config) {
+	renames := make([]build.Rename, len(migrateRenames))
+
+	for n, r := range migrateRenames {
+		rename, err := build.ParseRename(r)
+		if err != nil {
+			die("%s: %s", err, r)
+		}
+
+		renames[n] = rename
+	}
+
+	cr := migrationCore(to, len(renames) > 0)
+
+	var f *os.File
+
+	if !migrateDryRun {
+		f = openMigrationJournal()
+		defer f.Close()
+	}
+
+	journal, err := build.Migrate(ctx, fsys.OS{}, from, to, renames, cr, migrateDryRun, journalWriter(f))
+	if journal != nil {
+		printMigrations(journal)
+	}
+
+	if err != nil {
+		die("migration failed: %s; see the journal at %s", err, migrateJournal)
+	}
+}
+
+// migrationCore returns a core to tell about renamed environments, dying if
+// there are renames but no coreURL configured.
+func migrationCore(conf *config.Config, renaming bool) build.CoreRenamer {
+	if !renaming {
+		return nil
+	}
+
+	c, err := core.New(conf)
+	if err != nil {
+		die("renaming environments needs a coreURL: %s", err)
+	}
+
+	return c
+}
+
+func printMigrations(journal *build.MigrationJournal) {
+	verb := "moved"
+	if journal.DryRun {
+		verb = "would move"
+	}
+
+	for _, mig := range journal.Migrations {
+		cliPrint("%s %s to %s\n  module: %s -> %s\n  scripts: %s -> %s\n", verb,
+			mig.Environment, mig.NewEnvironment, mig.ModuleFrom, mig.ModuleTo, mig.ScriptsFrom, mig.ScriptsTo)
+	}
+
+	cliPrint("%s %d environments\n", verb, len(journal.Migrations))
+}
+
+// openMigrationJournal opens the --journal for appending, dying on failure.
+func openMigrationJournal() *os.File {
+	f, err := os.OpenFile(migrateJournal, os.O_WRONLY|os.O_APPEND|os.O_CREATE, migrateJournalPerms)
+	if err != nil {
+		die("could not open journal: %s", err)
+	}
+
+	info("journaling to %s", migrateJournal)
+
+	return f
+}
+
+// journalWriter returns the given file as a writer, or nil if it is nil.
+func journalWriter(f *os.File) io.Writer {
+	if f == nil {
+		return nil
+	}
+
+	return f
+}
+
+func rollbackMigration(ctx context.Context, from, to *config.Config) {
+	r, err := os.Open(migrateJournal)
+	if err != nil {
+		die("could not read journal: %s", err)
+	}
+
+	journal, err := build.ReadMigrationJournal(r)
+	r.Close()
+
+	if err != nil {
+		die("invalid journal: %s", err)
+	}
+
+	renamed := false
+
+	for _, step := range journal.Steps {
+		renamed = renamed || step.Migration.Environment != step.Migration.NewEnvironment
+	}
+
+	f := openMigrationJournal()
+	defer f.Close()
+
+	steps := len(journal.Steps)
+
+	if err = build.RollbackMigration(ctx, fsys.OS{}, from, to, journal, migrationCore(to, renamed), f); err != nil {
+		die("rollback failed: %s", err)
+	}
+
+	cliPrint("rolled back %d steps\n", steps)
+}
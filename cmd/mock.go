@@ -0,0 +1,192 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/coremock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/gitmock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+	"github.com/wtsi-hgi/go-softpack-builder/remove"
+)
+
+const (
+	mockListenURL   = "localhost:7080"
+	mockPollTime    = 10 * time.Millisecond
+	mockJobDuration = 100 * time.Millisecond
+	mockExes        = "xxhsum"
+)
+
+// sandboxS3 is an in-memory S3 that returns what was uploaded to it, falling
+// back on the canned artefacts of an s3mock.MockS3, so that concurrent builds
+// don't interfere with each other.
+type sandboxS3 struct {
+	*s3mock.MockS3
+
+	mu    sync.RWMutex
+	files map[string]string
+}
+
+func newSandboxS3() *sandboxS3 {
+	return &sandboxS3{
+		MockS3: &s3mock.MockS3{Exes: mockExes},
+		files:  make(map[string]string),
+	}
+}
+
+// UploadData implements build.S3.
+func (s *sandboxS3) UploadData(ctx context.Context, data io.Reader, dest string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[dest] = string(buf)
+
+	return nil
+}
+
+// OpenFile implements build.S3.
+func (s *sandboxS3) OpenFile(ctx context.Context, source string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	data, ok := s.files[source]
+	s.mu.RUnlock()
+
+	if ok {
+		return io.NopCloser(strings.NewReader(data)), nil
+	}
+
+	return s.MockS3.OpenFile(ctx, source)
+}
+
+// RemoveFile deletes a file uploaded to us, so that environments can be
+// removed.
+func (s *sandboxS3) RemoveFile(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.files, path)
+
+	return nil
+}
+
+// RemovePrefix implements build.S3PrefixRemover, so that build working
+// directories are cleaned up.
+func (s *sandboxS3) RemovePrefix(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := filepath.Clean(dir) + "/"
+
+	for path := range s.files {
+		if strings.HasPrefix(path, prefix) {
+			delete(s.files, path)
+		}
+	}
+
+	return nil
+}
+
+// mockConfig returns the config at configPath, or a default one listening on
+// mockListenURL if that doesn't exist.
+func mockConfig() *config.Config {
+	conf, err := config.GetConfig(configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &config.Config{ListenURL: mockListenURL}
+	}
+
+	if err != nil {
+		die("could not load config: %s", err)
+	}
+
+	return conf
+}
+
+// newMockBuilder returns a Builder that uses in-process fake S3, wr, core and
+// spack repo services, and installs to a temporary directory, so that builds
+// "complete" almost instantly with canned artefacts. The config is altered to
+// point at the fakes and to disable other external services. The returned
+// function stops the fakes and removes the temporary directory.
+func newMockBuilder(conf *config.Config) (*remove.Builder, func()) {
+	dir, err := os.MkdirTemp("", "gsb-mock")
+	if err != nil {
+		die("could not create mock install directory: %s", err)
+	}
+
+	gm, _ := gitmock.New()
+	gitServer := httptest.NewServer(gm)
+	coreServer := httptest.NewServer(coremock.NewMockCore())
+
+	conf.CustomSpackRepo = gitServer.URL
+	conf.CoreURL = coreServer.URL
+	conf.S3.CredentialsBroker = ""
+	conf.Module.ModuleInstallDir = filepath.Join(dir, "modules")
+	conf.Module.ScriptsInstallDir = filepath.Join(dir, "scripts")
+	conf.Module.KernelsDir = ""
+	conf.Module.UsageLog.SpoolDir = ""
+	conf.Module.Group = ""
+	conf.Module.ACL = nil
+	conf.WRDeployments = nil
+	conf.Replication = config.Replication{}
+	conf.CVMFS = config.CVMFS{}
+	conf.AirGapped = config.AirGapped{}
+	conf.Quotas.StateFile = ""
+	conf.StatusWebhook.QueueFile = ""
+
+	mwr := wrmock.NewMockWR(mockPollTime, mockJobDuration)
+	mwr.SetComplete()
+
+	s3s := newSandboxS3()
+
+	b, err := build.New(conf, s3s, mwr)
+	if err != nil {
+		die("could not create a mock builder: %s", err)
+	}
+
+	return remove.NewBuilder(b, conf, s3s), func() {
+		gitServer.Close()
+		coreServer.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 
 	"github.com/spf13/cobra"
+	"github.com/wtsi-hgi/go-softpack-builder/build"
 	"github.com/wtsi-hgi/go-softpack-builder/config"
 	"github.com/wtsi-hgi/go-softpack-builder/remove"
 	"github.com/wtsi-hgi/go-softpack-builder/s3"
@@ -12,6 +14,12 @@ import (
 
 const numArgs = 2
 
+// Options for this sub-command.
+var (
+	removeOverrideToken string
+	removeDryRun        bool
+)
+
 var removeCmd = &cobra.Command{
 	Use:   "remove",
 	Short: "Remove an environment",
@@ -20,6 +28,22 @@ var removeCmd = &cobra.Command{
 Remove an existing environment; it's entry in the Core artefacts repo, the
 module files and the singularity image and symlinks.
 
+Environments that have been protected (via the server's
+/environments/protect endpoint) are not removed unless you supply the
+protection overrideToken from the config with --override.
+
+If the config's trash dir is set, the files and S3 artefacts are moved in to the
+trash instead of being deleted, and can be put back with 'gsb restore' until
+the trash retention has passed.
+
+The environment is removed from core last, once its files have been moved in to
+the trash (or aside, to be deleted afterwards), and they are put back if
+removing it from core fails.
+
+With --dry-run, nothing is removed; instead everything that would be removed is
+listed: the core entry, the S3 objects (with their sizes), the module file, the
+files in the scripts directory, and any kernel specs and cached metadata.
+
 Usage: gsb remove softpack/env/path version
 `,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -40,7 +64,7 @@ Usage: gsb remove softpack/env/path version
 			die("could not load config: %s", err)
 		}
 
-		s, err := s3.New(conf.S3.BuildBase)
+		s, err := s3.New(conf.S3.BuildBase, conf.Timeouts.S3())
 		if err != nil {
 			die(err.Error())
 		}
@@ -51,6 +75,22 @@ Usage: gsb remove softpack/env/path version
 			die("invalid environment path")
 		}
 
+		if err = build.ValidateEnvironmentPath(envPath, args[1]); err != nil {
+			die(err.Error())
+		}
+
+		if removeDryRun {
+			report, errr := remove.Remove(context.Background(), conf, s, envPath, args[1],
+				remove.Options{DryRun: true})
+			if errr != nil {
+				die(errr.Error())
+			}
+
+			printRemovalReport(report)
+
+			return
+		}
+
 		cliPrint(
 			"Will now remove environment %s-%s from artefacts repo and modules.\n"+
 				"Are you sure you sure you wish to proceed? [yN]: ",
@@ -66,14 +106,67 @@ Usage: gsb remove softpack/env/path version
 			return
 		}
 
-		if err := remove.Remove(conf, s, envPath, args[1]); err != nil {
+		report, err := remove.Remove(context.Background(), conf, s, envPath, args[1],
+			remove.Options{OverrideToken: removeOverrideToken})
+		if err != nil {
 			die(err.Error())
 		}
+
+		if report.TrashID != "" {
+			info("moved to the trash; undo with: gsb restore %s", report.TrashID)
+		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(removeCmd)
+
+	removeCmd.Flags().StringVar(&removeOverrideToken, "override", "",
+		"protection override token, to remove a protected environment")
+	removeCmd.Flags().BoolVarP(&removeDryRun, "dry-run", "n", false,
+		"only list what would be removed, don't remove anything")
+}
+
+// printRemovalReport prints everything in the given report that would be
+// removed.
+func printRemovalReport(report *build.RemovalReport) {
+	cliPrint("core entry: %s\n", report.Environment)
+
+	if report.Protection != nil {
+		cliPrint("protected: %s\n", report.Protection.Reason)
+	}
+
+	for _, obj := range report.S3Objects {
+		cliPrint("S3 object: %s (%s)\n", obj.Path, humanSize(obj.Size))
+	}
+
+	if report.ModuleFile != nil {
+		cliPrint("module file: %s (%s)\n", report.ModuleFile.Path, humanSize(report.ModuleFile.Size))
+	}
+
+	cliPrint("scripts dir: %s\n", report.ScriptsDir)
+
+	for _, file := range report.ScriptsFiles {
+		cliPrint("  %s (%s)\n", file.Path, humanSize(file.Size))
+	}
+
+	for _, dir := range report.KernelSpecs {
+		cliPrint("kernel spec: %s\n", dir)
+	}
+
+	if report.MetadataCache != "" {
+		cliPrint("metadata cache: %s\n", report.MetadataCache)
+	}
+}
+
+// humanSize returns humanBytes() of the given size, or "unknown size" if it's
+// negative.
+func humanSize(n int64) string {
+	if n < 0 {
+		return "unknown size"
+	}
+
+	return humanBytes(n)
 }
 
 // cleanEnvPath strips out any attempts to manipulate the envPath in order to
@@ -0,0 +1,100 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/remove"
+	"github.com/wtsi-hgi/go-softpack-builder/s3"
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore a removed environment from the trash",
+	Long: `Restore a removed environment from the trash.
+
+If your config's trash dir is set, 'gsb remove' moves environments in to the
+trash instead of deleting them, and they are kept there for the trash
+retentionDays.
+
+Without arguments, lists the environments in the trash and their IDs. Given an
+ID, puts that environment's module file, scripts directory, kernel specs and S3
+artefacts back where they were. This fails if the environment has been
+installed again since it was removed.
+
+Before anything is put back, the artefacts the environment's build sent to core
+are sent to it again from the trash, so that core has the environment again.
+
+Usage: gsb restore [id]
+`,
+	Run: func(_ *cobra.Command, args []string) {
+		if len(args) > 1 {
+			die("unexpected arguments")
+		}
+
+		conf, err := config.GetConfig(configPath)
+		if err != nil {
+			die("could not load config: %s", err)
+		}
+
+		if len(args) == 0 {
+			listTrash(conf)
+
+			return
+		}
+
+		s, err := s3.New(conf.S3.BuildBase, conf.Timeouts.S3())
+		if err != nil {
+			die(err.Error())
+		}
+
+		entry, err := remove.Restore(context.Background(), conf, s, args[0])
+		if err != nil {
+			die(err.Error())
+		}
+
+		info("restored %s", entry.Environment)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(restoreCmd)
+}
+
+// listTrash prints the ID, removal time and environment of each environment in
+// the configured trash.
+func listTrash(conf *config.Config) {
+	entries, err := remove.Trashed(conf)
+	if err != nil {
+		die(err.Error())
+	}
+
+	for _, entry := range entries {
+		cliPrint("%s  %s  %s\n", entry.ID, entry.Removed.Format(time.DateTime), entry.Environment)
+	}
+}
@@ -24,17 +24,23 @@
 package cmd
 
 import (
+	"context"
 	"log/slog"
 	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/wtsi-hgi/go-softpack-builder/build"
 	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/remove"
+	"github.com/wtsi-hgi/go-softpack-builder/s3"
 	"github.com/wtsi-hgi/go-softpack-builder/server"
 )
 
 // Options for this sub-command.
-var debug bool
+var (
+	debug bool
+	mock  bool
+)
 
 var serverCmd = &cobra.Command{
 	Use:   "server",
@@ -57,13 +63,42 @@ Have a config file ~/.softpack/builder/gsb-config.yml that looks like this:
 s3:
   binaryCache: "spack"
   buildBase: "spack/builds"
+  credentialsBroker: "/path/to/mint-build-credentials"
 
 module:
   moduleInstallDir:  "/path/to/tcl_modules/softpack"
   scriptsInstallDir: "/different/path/for/images_and_scripts"
+  scriptsMinFreeGB: 0
+  scriptsOverflow:
+    - dir: "/another/filesystem/for/images_and_scripts"
+      minFreeGB: 100
   loadPath: "softpack"
   dependencies:
     - "/path/to/modules/singularity/3.10.0"
+  wrapper:
+    binds:
+      - "/lustre"
+  filePerms: "0664"
+  dirPerms: "0775"
+  group: "softpack"
+  setgid: true
+  acl:
+    - "g:softpack-admins:rwx"
+    - "d:g:softpack-admins:rwx"
+  usageLog:
+    spoolDir: "/path/to/usage/spool"
+    syslog: false
+  kernelsDir: "/path/to/jupyter/kernels"
+  completions: true
+  defaultVersion: "tcl"
+  conflicts:
+    - "openmpi"
+  prereqs:
+    - "cuda/12.2"
+  rstudio:
+    serverDir: "/usr/lib/rstudio-server"
+    binds:
+      - "/lustre"
 
 customSpackRepo: "https://github.com/org/spack-repo.git"
 
@@ -72,10 +107,164 @@ spack:
   buildImage: "spack/ubuntu-jammy:v0.20.1"
   finalImage: "ubuntu:22.04"
   processorTarget: "x86_64_v3"
+  processorTargets:
+    - "x86_64_v3"
+    - "x86_64_v4"
+  baseImages:
+    - name: "r-tidyverse"
+      packages:
+        - "r"
+        - "r-tidyverse"
+  versionsFile: "/path/to/spack_versions.json"
+  buildJobs: 4
+  mirrors:
+    - name: "upstream"
+      url: "https://binaries.spack.io/v0.21.0"
+      type: "binary"
+      trustKeys: true
+    - name: "sources"
+      url: "https://spack-mirror.example.org"
+      type: "source"
+  externals:
+    - name: "slurm"
+      spec: "slurm@23.02.6"
+      prefix: "/usr"
+  minCacheHitRate: 0.5
+  defaultPackages:
+    - "ca-certificates-mozilla"
+    - "site-profile@1.0"
   reindexHours: 24
 
+singularity:
+  fakeroot: false
+  flags:
+    - "--disable-cache"
+  tmpDir: ""
+
+profiles:
+  gpu:
+    buildImage: "spack/ubuntu-jammy-cuda:v0.20.1"
+    memory: "64G"
+    time: "12h"
+    cpus: 8
+    disk: 100
+    buildJobs: 16
+    limitGroups:
+      - "gpu:4"
+
 coreURL: "http://x.y.z:9837/upload"
 listenURL: "0.0.0.0:2456"
+wrRetries: 2
+wrLimitGroups:
+  zen4:
+    - "zen4:10"
+wrDeployments:
+  - name: "gpu-dc"
+    deployment: "production"
+    managerHost: "gpu-manager.example.com"
+    managerPort: 11301
+    profiles:
+      - "gpu"
+    arches:
+      - "zen4"
+    pathPrefixes:
+      - "groups/gpu-lab/"
+server:
+  maxRequestBytes: 1048576
+  maxPackages: 1000
+  rateLimit: 1
+  rateBurst: 10
+  maintenanceFile: "/path/to/gsb-maintenance"
+  adminToken: "long-random-secret"
+tls:
+  certFile: "/path/to/cert.pem"
+  keyFile: "/path/to/key.pem"
+  clientCAFile: "/path/to/core-ca.pem"
+timeouts:
+  s3Seconds: 3600
+  coreSeconds: 300
+  buildMinutes: 240
+  stallMinutes: 30
+  retryStalls: true
+cvmfs:
+  repository: "softpack.example.org"
+  dir: "/cvmfs/softpack.example.org"
+replication:
+  buildBase: "spack-dr/builds"
+  profile: "dr"
+  retrySeconds: 300
+  maxRetrySeconds: 3600
+  schedule:
+    cron: ""
+    debounceSeconds: 0
+    throttleSeconds: 0
+statusWebhook:
+  endpoint: "/build-status"
+  retrySeconds: 30
+  maxRetrySeconds: 600
+  queueFile: "/path/to/gsb-status-webhook.json"
+images:
+  registry: "mirror.example.org"
+  localDir: "/software/hgi/softpack/images"
+  refreshHours: 24
+  resolveDigests: false
+airGapped:
+  enabled: false
+  repoTarball: "/software/hgi/softpack/custom-spack-repo.tar.gz"
+quotas:
+  user:
+    buildsPerDay: 20
+    concurrentBuilds: 3
+    imageGB: 200
+  group:
+    imageGB: 1000
+  overrides:
+    groups/hgi:
+      imageGB: 5000
+  stateFile: "/path/to/gsb-quotas.json"
+hooks:
+  - name: "reindex"
+    command: "s3cmd sync /path/to/index s3://spack/index"
+  - name: "scan"
+    command: "/path/to/scan-image \"$GSB_SCRIPTS_DIR/singularity.sif\""
+    timeoutSeconds: 600
+preBuildHooks:
+  - name: "denylist"
+    command: "/path/to/check-packages"
+brokenPackages:
+  url: "https://example.com/broken-packages.yml"
+  refreshMinutes: 60
+  packages:
+    - spec: "r-seurat@5.0.0"
+      reason: "it crashes on our cluster, use 4.4"
+teams:
+  url: "https://example.com/teams"
+  refreshMinutes: 60
+  contacts:
+    hgi:
+      - "foo"
+      - "hgi@example.com"
+templates:
+  - name: "single-cell-r"
+    description: "R with Seurat and Signac for single cell analysis"
+    packages:
+      - "r-seurat@4.3.0"
+      - "r-signac"
+    profile: ""
+upgrades:
+  intervalHours: 24
+  notify:
+    command: "/path/to/email-owner"
+artefacts:
+  extra:
+    - name: "LICENSE"
+      path: "/path/to/site/LICENSE"
+  suppress:
+    - "builder.out"
+  upload:
+    chunkSizeMB: 0
+    parallelism: 2
+    retries: 3
 
 ---
 
@@ -85,19 +274,84 @@ Where:
   binary cache and has the gpg files copied to it.
 - buildBase is the bucket and optional sub "directory" that builds will occur
   in.
+- credentialsBroker is optional. By default builds get a copy of the S3
+  credentials in /home/ubuntu/.aws on the build machines. If this command is
+  set, it is run with sh for each build instead, with $GSB_BUILD_PATH set to the
+  build's S3 location and $GSB_BINARY_CACHE to binaryCache, and should print
+  short-lived credentials (eg. from STS) scoped to those locations, as AWS
+  credential_process JSON: {"AccessKeyId": "...", "SecretAccessKey": "...",
+  "SessionToken": "...", "Expiration": "..."}. Builds then only get
+  /home/ubuntu/.aws/config, and read the brokered credentials from a file in
+  their temporary directory that doesn't end up in the image. The credentials
+  are not part of the wr job: gsb puts them in a gsb-credentials file in the
+  build's S3 working directory, which the job moves out of S3 when it starts,
+  and the command is run again for fresh credentials each time a failed job is
+  retried. The gpg signing keys are still copied in to builds.
 - moduleInstallDir is the absolute base path that modules will be installed to
   following a build. This directory needs to be accessible by your users.
   Directories and files that gsb creates within will be world readable and
-  executable.
+  executable, unless you configure otherwise with the options below.
 - scriptsInstallDir is like moduleInstallDir, but will contain the images and
   wrapper script symlinks for your builds. These are kept separately from the
   tcl module files, because having large files alongside the tcl file will slow
   down the module system.
+- scriptsMinFreeGB and scriptsOverflow are optional. If scriptsInstallDir has
+  less than scriptsMinFreeGB GB free (0 means don't check), new builds are
+  instead installed in to the first scriptsOverflow dir with at least its
+  minFreeGB free, and the module adds that location to the PATH. If none have
+  enough space, the build fails. Rebuilds stay where they were, and removal,
+  verification and everything else finds environments in whichever of these
+  dirs they were installed in to.
 - loadPath is the base that users "module load".
 - dependencies are any module dependencies that need to be loaded because that
   software won't be part of the environments being built. Users will at least
   need singularity, since the modules created by softpack run singularity
   images.
+- wrapperScript is optional: the absolute path of your own script that exes
+  are symlinked to (see wrapper.example). If unset, gsb installs a wrapper in
+  each scripts directory that execs singularity exec on the environment's image,
+  passing through all args, stdin, the tty and signals, and exiting with the
+  exe's exit code. wrapper binds are any host paths that gsb's wrapper binds in
+  to the image.
+- filePerms and dirPerms are the octal permissions given to the files and
+  directories gsb installs. They default to "0644" and "0755".
+- group is an optional group that installed files and directories will be
+  owned by.
+- setgid, if true, sets the setgid bit on installed directories, so that
+  files created within them by others inherit their group.
+- acl is an optional list of POSIX ACL entries (in setfacl -m format) applied
+  to installed files and directories. Default entries (starting "d:") are only
+  applied to directories. The setfacl command must be in your PATH.
+- usageLog is optional. If spoolDir is set, each time a user runs one of an
+  environment's executables a line (unix time, environment, executable and
+  user, tab separated) is appended to a [user].tsv file in that directory,
+  which must be world writable (eg. mode 1777). If syslog is true, the same
+  details are logged with "logger -t gsb-usage". Logging happens in a small
+  script installed in each scripts directory that then sources your
+  wrapperScript, so your wrapperScript must be a bash script.
+- kernelsDir is optional. If set, environments containing py-ipykernel or
+  r-irkernel get Jupyter kernel specs (that run the kernel via the
+  environment's wrapper scripts) installed in a subdirectory of it, and their
+  usage README describes them. Point your JupyterHub at it by making it a
+  directory named "kernels" inside a directory in JUPYTER_PATH.
+- completions, if true, installs completion.bash and completion.zsh scripts in
+  each scripts directory that users can source (as the usage README describes)
+  to tab complete the environment's executables. The first time an executable
+  is completed, the bash completion script it installed inside the image (in
+  share/bash-completion/completions), if any, is loaded from there.
+- defaultVersion is optional. If set to "tcl", a .version file, or if "lmod", a
+  "default" symlink, in each environment's module directory names its newest
+  installed version as the default, so that eg. "module load
+  softpack/groups/hgi/xxhash" loads the newest version. It is updated
+  atomically whenever a version is installed or removed.
+- conflicts and prereqs are optional module names that every environment's
+  module file declares as conflicts (modules that can't be loaded at the same
+  time) or prereqs (modules that must be loaded first), in addition to those in
+  build requests.
+- rstudio is optional. serverDir is the host path of an RStudio Server
+  installation (containing bin/rserver) that is bound in to environment images
+  to provide RStudio for R environments built with "rstudio" set. binds are
+  any additional host paths users will need access to from within RStudio.
 - customSpackRepo is your own repository of Spack packages containing your own
   custom recipies. It will be used in addition to Spack's build-in repo during
   builds.
@@ -111,10 +365,257 @@ Where:
   installed inside (it should be the same OS as buildImage).
 - processorTarget should match the lowest common denominator CPU for the
   machines where builds will be used. For example, x86_64_v3.
+- processorTargets are optional; the targets build requests may choose instead
+  of their profile's processorTarget.
+- baseImages are optional shared "base environment" images, which need
+  images.localDir. When the server starts, it adds a wr job that builds each
+  base image that hasn't been built yet, installing the listed packages with
+  spack on top of buildImage, in to a SIF file in images.localDir (named after
+  the base image and a hash of its packages, buildImage and processorTarget, so
+  changing those results in a new build). Once built, builds that use
+  buildImage and request all of a base image's packages will start from it
+  instead, so the packages already installed in it won't be rebuilt. If more
+  than one matches, the one with the most packages is used. Base images are
+  built with your ~/.aws credentials, which are removed from the image
+  afterwards.
+- versionsFile is optional. It should be the output of
+  "spack list --format version_json" for your builtin and custom repos, kept
+  up to date by you (eg. with a cron job), and enables upgrade advice.
+- buildJobs is optional, and is the number of parallel jobs spack uses to build
+  each package (its build_jobs config) for profiles without their own buildJobs
+  or cpus. It defaults to spack's own default.
+- mirrors are optional additional spack mirrors that builds can get sources or
+  binaries from, as well as the s3.binaryCache (whose mirror is named
+  "s3cache"), eg. a site source mirror or an upstream binary cache for your
+  version of spack. Each needs a unique name of letters, digits, - and _, and a
+  url. type is "source" or "binary" to only use the mirror for those, or blank
+  for both. If unsigned is true, its binaries don't have to be signed. If
+  trustKeys is true, the signing keys it publishes are trusted. keyFile is the
+  optional path, on your wr workers, of a public key file to trust for it.
+- externals are optional system-provided packages, eg. slurm or CUDA driver
+  libraries, that build requests can declare instead of having spack build
+  them. Each needs a unique name and the prefix it is installed at, and spec is
+  its spack spec, defaulting to the name.
+- minCacheHitRate is optional. If the fraction of packages installed from the
+  binary cache by recent successful builds drops below this, a warning is
+  logged and the health endpoint reports it, since it usually means the cache's
+  index is broken.
+- defaultPackages is optional, and lists packages (as "name" or
+  "name@version", with unique names) added to every environment, eg. a site
+  profile package or CA certificates, so baseline tooling is always present.
+  Environments that request one themselves get their requested version instead.
+  They're listed under site_packages in softpack.yml, separately from the
+  requested packages, and their executables aren't listed in the description.
+- singularity is optional, and configures how build jobs run
+  "singularity build". If fakeroot is true, it is run with --fakeroot instead
+  of with sudo. flags are extra flags to pass to it. tmpDir is the directory
+  bound to /tmp during the build, where spack does its work, and defaults to
+  the wr job's $TMPDIR. It is created if necessary, may use shell variables,
+  and should be unique to each job (eg. "/scratch/gsb-$$").
+- profiles are optional named sets of build settings that build requests can
+  choose between by including "profile": "[name]". buildImage, finalImage and
+  processorTarget default to those of the spack section; memory, time, cpus and
+  disk (in GB) are the resources wr will reserve for the build, defaulting to
+  wr's own learned values. buildJobs is the number of parallel jobs spack uses
+  to build each package, defaulting to the profile's cpus, or else to the spack
+  section's buildJobs. limitGroups are the wr limit groups its build jobs are
+  in, instead of the default "s3cache" group shared by all builds, so that you
+  can partition your capacity, eg. "gpu:4" to run at most 4 gpu builds at
+  once. A profile can have its own singularity section, which replaces the
+  top-level one. Base images are only used by profiles whose buildImage is the
+  spack section's. A profile named "default" is used by requests that don't
+  specify one. Requests for an unknown profile get a 400 response.
 - coreURL is the URL of a running softpack core service, that will be used to
   send build artefacts to so that it can store them in a softpack environements
   git repository and make them visible on the softpack frontend.
 - listenURL is the address gsb will listen on for new build requests from core.
+- wrRetries is the number of times a build that failed for a transient reason
+  will be retried. Defaults to 2; set to -1 to disable retries.
+- wrLimitGroups are optional extra wr limit groups, per processor target, that
+  build jobs for that target (the profile's, or the request's override) are also
+  in, eg. to limit how many builds run at once on a particular architecture.
+- wrDeployments are optional additional wr deployments (eg. one per datacentre
+  or architecture) that builds can be routed to. Builds using one of a
+  deployment's profiles, or whose processor target (the profile's, or the
+  request's override) is one of its arches, or whose environment path starts
+  with one of its pathPrefixes, are run by that deployment; the first matching
+  one is used, and builds that don't match any run in your usual wr
+  deployment. deployment is the wr deployment name, and managerHost and
+  managerPort say where its manager is running, defaulting to those in your wr
+  config. Build statuses record the name of the deployment used in their
+  Deployment field, which is "default" for your usual one.
+- server options are optional, and limit the build requests gsb will accept.
+  maxRequestBytes (default 1MiB) and maxPackages (default 1000) limit the size
+  of each request; larger requests get a 413 response. If rateLimit is set,
+  each client IP may only make rateLimit build requests per second on average,
+  with bursts of up to rateBurst requests; further requests get a 429
+  response. Make sure rateBurst is large enough for core to resend all its
+  queued environments when gsb starts. maintenanceFile is where the
+  maintenance mode (see the /maintenance endpoints) is saved, so that gsb stays
+  in maintenance if restarted, with builds queued while draining saved beside
+  it in maintenanceFile.queue; if unset, gsb always starts out of maintenance.
+  If adminToken is set, the admin endpoints (/maintenance/*,
+  /environments/cancel, /environments/requeue and /environments/repair)
+  require an "Authorization: Bearer [adminToken]" header; the gsb admin
+  commands send it for you.
+- tls options are optional. If certFile and keyFile are set, gsb's endpoints
+  will be served over https using that certificate. Alternatively, set
+  autocertHosts to a list of your host names to automatically get certificates
+  from Let's Encrypt (this requires listenURL to use port 443), optionally
+  caching them in autocertCacheDir. If clientCAFile is also set, clients (ie.
+  core) must present a certificate signed by one of the CAs in that file; this
+  can't be combined with autocertHosts, since Let's Encrypt's validation
+  requests don't present client certificates. Remember to use an https URL when configuring core to talk to gsb.
+- timeouts are optional, and are the maximum number of seconds that each S3
+  operation (including downloading a whole file, such as a built image) and
+  each request to core may take before gsb gives up on it. They default to
+  3600 and 300 respectively; set them to -1 to disable the timeout.
+  buildMinutes is the maximum number of minutes a build may run for, and
+  stallMinutes the maximum number of minutes a build may go without writing
+  anything to its builder.out (eg. because it hung on a network fetch); builds
+  exceeding either are killed, instead of running until wr's time limit.
+  Neither is limited by default. Killed builds say why at the end of their
+  builder.out, and have a Failure of "resource" (timed out) or "stall". If
+  retryStalls is true, stalled builds are retried like transient failures.
+- cvmfs is optional. If repository is set, after each environment is installed
+  its scripts directory (containing the image and wrapper scripts) is
+  published to that CernVM-FS repository, at the same relative location under
+  dir (which defaults to /cvmfs/[repository]), so it becomes available on grid
+  sites. By default this is done with cvmfs_server transaction, cp and
+  cvmfs_server publish, so gsb must run on the repository's publisher machine.
+  Alternatively, set publishCommand to your own sh command, which will be given
+  the environment variables GSB_CVMFS_REPO, GSB_SCRIPTS_DIR and GSB_CVMFS_DEST.
+  Failure to publish doesn't fail the build; the Publication in the build's
+  status says how publication went.
+- replication is optional. If buildBase is set, after each successful build
+  the image and other artefacts in S3 are copied in the background to that
+  bucket and optional sub "directory" (eg. at a DR site), using the named
+  ~/.s3cfg profile (eg. one for a different region; defaults to your usual
+  one). Failed copies are retried after retrySeconds (default 300), doubling
+  the wait after each failure up to maxRetrySeconds (default 3600). The health
+  endpoint reports how far behind replication is. Builds are copied straight
+  away unless a schedule is set: with debounceSeconds, a burst of successful
+  builds is copied together once there have been none for that long; with
+  throttleSeconds (which can't be combined with debounceSeconds), copies start
+  at most once per that many seconds; and with cron, a standard 5 field cron
+  expression in local time (eg. "0 1 * * *" for 1am every day), pending builds
+  are copied at the times it matches.
+- statusWebhook is optional. If endpoint is set, whenever a build's wr job is
+  queued, starts building, or finishes (done or failed), a JSON object with the
+  build's new Stage and its Status (as returned by the status endpoint) is
+  POSTed to that path under coreURL, so core doesn't have to poll. Changes to
+  each environment are sent in order, and a failed delivery is retried until
+  core accepts it with a 2xx response, so core may receive a change more than
+  once. The first retry is after retrySeconds (default 30), doubling the wait
+  after each failure up to maxRetrySeconds (default 600). Undelivered changes
+  are saved to queueFile, if set, and delivered when gsb next starts; without
+  it they are lost if gsb stops.
+- images is optional, and helps avoid Docker Hub's rate limits. If registry is
+  set, images that don't name a registry host (eg. "ubuntu:22.04") are pulled
+  from that registry mirror instead. If localDir is set, at start up and then
+  every refreshHours (default 24), or at the times of the schedule's cron
+  expression (as for replication), a wr job is added to the default deployment
+  that pulls all the configured spack, profile and base images to SIF files in
+  that directory, and builds bootstrap from those local copies once they
+  exist. localDir must be on a filesystem shared with the wr workers. If
+  resolveDigests is true, the digests of the build and final images pulled from
+  registries are looked up when builds succeed, for their provenance.
+- airGapped is optional. If enabled is true, builds are done without internet
+  access: their images must come from the images registry mirror or localDir,
+  and spack.mirrors must include a source (or untyped) mirror in S3,
+  pre-populated with the sources of everything you build. Instead of cloning
+  the customSpackRepo, builds use repoTarball, the path on your wr workers of a
+  tar.gz of the repo with its repo.yaml at the top level. gsb won't start
+  without these, and build requests that need an image that isn't available
+  offline get a 400 response.
+- quotas are optional, and limit the builds of each user and group. A build
+  counts against the user who requested it (see requester above, or the user
+  of a users/ environment if that isn't known) and the group of a groups/
+  environment. buildsPerDay limits how many builds may be requested in any 24
+  hours, concurrentBuilds how many may be running at once, and imageGB the
+  total size of the images of their installed environments; unset or 0 means
+  no limit. user and group are the defaults, and overrides replace them for
+  particular users or groups, named like "users/foo" or "groups/hgi". Build
+  requests by or for anyone who has reached a quota get a 429 response whose
+  message reports their usage, and the contacts of a full group's team (see
+  teams below). Usage is saved to stateFile, if set, so that it
+  survives restarts. Removing an environment with gsb remove frees its image
+  usage, once it's purged if trash is enabled; this needs the stateFile.
+- hooks are optional commands run, in order, after every build finishes,
+  whether it succeeded or not, eg. to reindex, notify or scan. Each gets the
+  build's status as JSON on stdin, and the environment variables GSB_HOOK,
+  GSB_ENVIRONMENT (eg. users/foo/bar-1), GSB_ENV_PATH, GSB_ENV_NAME,
+  GSB_ENV_VERSION, GSB_REQUESTER, GSB_S3_PATH, GSB_SCRIPTS_DIR, GSB_OWNER (eg.
+  users/foo or groups/hgi), GSB_CONTACTS (the owner's comma separated contacts;
+  see teams below), GSB_OUTCOME (succeeded, failed or cancelled) and
+  GSB_ERROR. A hook that takes longer than
+  its timeoutSeconds (default 60; negative for none) is killed. A failed hook is
+  logged but doesn't stop later ones or affect the build. The result of each
+  is in the build's status Hooks.
+- preBuildHooks are optional commands run, in order, on every build request
+  before it is queued, eg. to enforce a package denylist, naming policy or
+  minimum description length. Each gets the request's definition as JSON on
+  stdin (eg. {"EnvironmentName":"bar","Description":"...","Packages":
+  [{"name":"xxhash","version":"0.8.1"}],...}) and the same environment
+  variables as hooks (apart from GSB_OUTCOME and GSB_ERROR). A hook that exits
+  0 accepts the request, and may change it by printing a replacement
+  definition as JSON, though not its environment path, name, version or
+  requester. A hook that exits non-zero rejects it, each line of its output
+  being a reason, and the request gets a 403 response with a JSON body like
+  {"Error":"...","Hook":"denylist","Reasons":["r-seurat is denied"]}. A hook
+  that can't be run, times out or prints invalid JSON gets the request a 500
+  response.
+- brokenPackages is an optional denylist of package versions known not to
+  build or work on your cluster, checked after any preBuildHooks, so users find
+  out straight away instead of after a failed build. Each spec is a package
+  name, optionally followed by @ and a version glob (eg. "r-seurat@5.0.*"); a
+  spec without a version matches every version, but packages requested without
+  a version only match those. Requests for broken packages get a 403 response
+  like a rejecting pre-build hook, with "Hook":"brokenPackages" and a reason
+  like "r-seurat@5.0.0 is known to be broken: it crashes on our cluster, use
+  4.4". If url is set, more are fetched from it every refreshMinutes (default
+  60), as a YAML list in the same format as packages; if a fetch fails, the
+  previously fetched list is used until the next refresh.
+- teams are optional, and say who owns groups/ environments, so that group
+  builds aren't ownerless. contacts lists the usernames or email addresses of
+  each group's team, keyed on group name. If url is set, the contacts of other
+  groups are looked up with a GET to url/[group], which should return them as
+  a YAML list (or a 404 for groups without a team), and are cached for
+  refreshMinutes (default 60); if a lookup fails, the previous contacts are
+  used. The owner of a users/ environment is its user. Build statuses (and so
+  status webhook notifications) include the Owner's Account and Contacts,
+  hooks get them as GSB_OWNER and GSB_CONTACTS, and full group quotas are
+  reported with the team's contacts.
+- templates are optional curated starting points for environments that users
+  can list with a GET to /templates, and build from by POSTing a build request
+  with an extra "template" name to /templates/build. Each has a unique name,
+  an optional description, packages (as "name" or "name@version") and an
+  optional build profile (which must be in profiles).
+- upgrades are optional. If intervalHours is more than 0, or a schedule cron
+  expression is set (as for replication; both need coreURL and a spack
+  versionsFile), every intervalHours or at the cron times, gsb looks at the
+  latest installed version of each environment that opted in with "autoUpgrade"
+  in its build request, and if any of its packages have a newer version in the
+  versionsFile, asks core to create a new version of the environment with those
+  packages upgraded. It then runs the notify command, if any, like a hook, with
+  the proposal as JSON on stdin and the extra environment variable GSB_UPGRADES
+  (eg. xxhash@0.8.1->0.8.2), so you can tell the owner (GSB_OWNER and
+  GSB_CONTACTS). The new version also opts in, and another won't be proposed
+  until it has been requested.
+- artefacts are optional. Each extra artefact is a file at path, read for each
+  build, that is sent to core with the artefacts of successful builds under the
+  given unique plain file name, eg. a site-specific licence notice or
+  institutional metadata. Suppress lists default artefacts (builder.out,
+  spack.lock, singularity.def, README.md, spack.yaml or provenance.json) not
+  to send; softpack.yml and the module can't be suppressed.
+  Upload is optional and only for a core that supports chunked uploads. If
+  chunkSizeMB is more than 0, instead of sending all the artefacts in one
+  request, each is PUT to core's /upload-chunk endpoint in chunks of that size
+  (with envPath, name and offset query parameters), with up to parallelism
+  (default 2) artefacts sent at once. A failed chunk is retried up to retries
+  (default 3) times, resuming from the size core reports for a GET of
+  /upload-chunk. Finally a manifest of each artefact's name, size and sha256 is
+  POSTed to /upload-manifest for core to confirm before it stores them.
 
 At start up, it asks core to resend any queued environments to us, so that you
 can safely restart this service without losing any environment build requests.
@@ -123,6 +624,15 @@ It also runs spack buildcache update-index (examine all files in S3 and produce
 a new index.json summarising the available cached builds). It does this at most
 once every reindexHours hours, but only if there has been a new build in the
 past reindexHours, and only if a reindex is not still ongoing.
+
+With --mock, gsb runs as a sandbox for developing against, eg. a frontend,
+without any cloud infrastructure: S3, wr, core and the spack repo are replaced
+with in-process fakes, so builds "complete" almost instantly with canned
+artefacts, and environments are installed to a temporary directory that is
+deleted on exit. Your config is optional in this mode (without one, gsb listens
+on localhost:7080), and its replication, cvmfs, airGapped, credentialsBroker,
+wrDeployments, quotas stateFile, statusWebhook queueFile and module install
+dirs, kernelsDir, usageLog spoolDir, group and acl options are ignored.
 `,
 	Run: func(_ *cobra.Command, _ []string) {
 		if debug {
@@ -132,15 +642,9 @@ past reindexHours, and only if a reindex is not still ongoing.
 			slog.SetDefault(slog.New(h))
 		}
 
-		conf, err := config.GetConfig(configPath)
-		if err != nil {
-			die("could not load config: %s", err)
-		}
-
-		b, err := build.New(conf, nil, nil)
-		if err != nil {
-			die("could not create a builder: %s", err)
-		}
+		conf, b, cleanup := serverBuilder()
+		defer cleanup()
+		defer b.Stop()
 
 		s := server.New(b, conf)
 		defer s.Stop()
@@ -162,4 +666,49 @@ func init() {
 
 	serverCmd.Flags().BoolVar(&debug, "debug", false,
 		"turn on debug logging output")
+	serverCmd.Flags().BoolVar(&mock, "mock", false,
+		"use fake S3, wr and core services, for development")
+}
+
+// serverBuilder returns our config and a Builder using it, or a sandboxed one
+// if --mock, along with a function to call when done with them.
+func serverBuilder() (*config.Config, *remove.Builder, func()) {
+	build.GSBVersion = Version
+	build.GSBCommit = commit()
+
+	if mock {
+		conf := mockConfig()
+		b, cleanup := newMockBuilder(conf)
+
+		slog.Warn("running in mock mode; builds will not really happen")
+
+		return conf, b, cleanup
+	}
+
+	conf, err := config.GetConfig(configPath)
+	if err != nil {
+		die("could not load config: %s", err)
+	}
+
+	s, err := s3.New(conf.S3.BuildBase, conf.Timeouts.S3())
+	if err != nil {
+		die("could not create an S3 client: %s", err)
+	}
+
+	b, err := build.New(conf, nil, nil)
+	if err != nil {
+		die("could not create a builder: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err = b.BuildBaseImages(ctx); err != nil {
+		slog.Error("failed to add base image build job", "err", err)
+	}
+
+	go b.RefreshImagesPeriodically(ctx)
+	go b.ProposeUpgradesPeriodically(ctx)
+	go b.ReplicateOnSchedule(ctx)
+
+	return conf, remove.NewBuilder(b, conf, s), cancel
 }
@@ -0,0 +1,90 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/gsbclient"
+)
+
+// Options for this sub-command.
+var verifyURL string
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify an installed environment",
+	Long: `Verify an installed environment.
+
+Asks the gsb server at --url (defaulting to $GSB_URL, or else the listenURL in
+your config) to check the installation of the given environment: that its
+module file parses and adds its scripts directory to the PATH, that its image
+exists and matches the checksum recorded when it was installed, that all its
+executables resolve, and that the artefacts sent to core exist in S3.
+
+Any problems found, eg. due to manual edits of the filesystem, are printed, and
+the command exits non-zero.
+
+Usage: gsb verify softpack/env/path version
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := envNameFromArgs(args).Get("name")
+		verification := getVerification(cmd.Context(), args[0], args[1])
+
+		if len(verification.Problems) == 0 {
+			info("%s is installed correctly", name)
+
+			return
+		}
+
+		for _, problem := range verification.Problems {
+			cliPrint("%s\n", problem)
+		}
+
+		os.Exit(1)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVarP(&verifyURL, "url", "u", os.Getenv("GSB_URL"), "URL to running GSB server")
+}
+
+// getVerification gets the Verification of the given environment from the
+// server, dying on failure.
+func getVerification(ctx context.Context, envPath, version string) *build.Verification {
+	ctx, cancel := context.WithTimeout(ctx, adminRequestTimeout)
+	defer cancel()
+
+	verification, err := gsbclient.New(serverURL(verifyURL), "").Verify(ctx, envPath, version)
+	if err != nil {
+		die("request failed: %s", err)
+	}
+
+	return verification
+}
@@ -24,6 +24,8 @@
 package cmd
 
 import (
+	rdebug "runtime/debug"
+
 	"github.com/spf13/cobra"
 )
 
@@ -32,6 +34,11 @@ import (
 // `git describe --tags --always --long --dirty`" .
 var Version string
 
+// Commit gets set during build to the git commit gsb was built from:
+// go build -ldflags "-X github.com/wtsi-hgi/go-softpack-builder/cmd.Commit=
+// `git rev-parse HEAD`" .
+var Commit string
+
 // versionCmd represents the version command.
 var versionCmd = &cobra.Command{
 	Use:   "version",
@@ -45,3 +52,24 @@ var versionCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(versionCmd)
 }
+
+// commit returns Commit, or if that wasn't set, the commit that go build
+// recorded, if any.
+func commit() string {
+	if Commit != "" {
+		return Commit
+	}
+
+	info, ok := rdebug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,155 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package cmd
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+// Options for this sub-command.
+var (
+	wrCleanEnv        string
+	wrCleanVersion    string
+	wrCleanOlderThan  time.Duration
+	wrCleanAll        bool
+	wrCleanDeployment string
+)
+
+var wrCmd = &cobra.Command{
+	Use:   "wr",
+	Short: "Manage gsb's wr jobs",
+	Long: `Manage gsb's wr jobs.
+
+Use the sub-commands to manage the jobs gsb has added to your wr deployment.
+Only jobs added by gsb are affected; any other jobs in the deployment are left
+alone.`,
+}
+
+var wrCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove gsb's incomplete wr jobs",
+	Long: `Remove gsb's incomplete wr jobs.
+
+Removes gsb's buried (or otherwise incomplete) build jobs from your wr
+deployment. Running jobs are not affected.
+
+Supply one of:
+
+--env and --version to remove the jobs of all builds of an environment version, eg.
+  gsb wr clean --env users/user/myenv --version 1
+--older-than to remove jobs that got buried more than the given duration ago,
+  eg. gsb wr clean --older-than 168h
+--all to remove all of gsb's incomplete jobs.
+
+Jobs are removed from the default wr deployment and each of the configured
+wrDeployments, unless you name just one of them with --deployment (use
+"default" for the default deployment).
+`,
+	Run: func(_ *cobra.Command, _ []string) {
+		conf, err := config.GetConfig(configPath)
+		if err != nil {
+			die("could not load config: %s", err)
+		}
+
+		if wrCleanEnv == "" && wrCleanOlderThan <= 0 && !wrCleanAll {
+			die("one of --env, --older-than or --all is required")
+		}
+
+		for name, runner := range wrCleanRunners(conf) {
+			switch {
+			case wrCleanEnv != "":
+				err = cleanWREnv(conf, runner)
+			case wrCleanOlderThan > 0:
+				err = cleanWROlderThan(runner)
+			default:
+				err = runner.CleanupAll()
+			}
+
+			if err != nil {
+				die("failed to clean wr jobs in deployment %s: %s", name, err)
+			}
+		}
+	},
+}
+
+// wrCleanRunners returns Runners for the wr deployments to clean, keyed on
+// their names: the one named by --deployment, or else the default deployment
+// and all the configured wrDeployments.
+func wrCleanRunners(conf *config.Config) map[string]*wr.Runner {
+	runners := map[string]*wr.Runner{config.DefaultWRDeployment: wr.New(conf.WRDeployment)}
+
+	for _, deployment := range conf.WRDeployments {
+		runners[deployment.Name] = wr.NewRemote(deployment.Deployment, deployment.ManagerHost, deployment.ManagerPort)
+	}
+
+	if wrCleanDeployment == "" {
+		return runners
+	}
+
+	runner, ok := runners[wrCleanDeployment]
+	if !ok {
+		die("unknown wr deployment: %s", wrCleanDeployment)
+	}
+
+	return map[string]*wr.Runner{wrCleanDeployment: runner}
+}
+
+func init() {
+	RootCmd.AddCommand(wrCmd)
+	wrCmd.AddCommand(wrCleanCmd)
+
+	wrCleanCmd.Flags().StringVar(&wrCleanEnv, "env", "", "environment path, eg. users/user/myenv")
+	wrCleanCmd.Flags().StringVar(&wrCleanVersion, "version", "", "environment version")
+	wrCleanCmd.Flags().DurationVar(&wrCleanOlderThan, "older-than", 0,
+		"remove jobs buried more than this long ago")
+	wrCleanCmd.Flags().BoolVar(&wrCleanAll, "all", false, "remove all of gsb's incomplete jobs")
+	wrCleanCmd.Flags().StringVar(&wrCleanDeployment, "deployment", "",
+		"only clean the wr deployment with this configured name (default all)")
+}
+
+func cleanWREnv(conf *config.Config, runner *wr.Runner) error {
+	if wrCleanVersion == "" {
+		die("--version is required with --env")
+	}
+
+	if err := build.ValidateEnvironmentPath(wrCleanEnv, wrCleanVersion); err != nil {
+		die("%s", err)
+	}
+
+	return runner.CleanupEnv(filepath.Join(conf.S3.BuildBase, wrCleanEnv, wrCleanVersion))
+}
+
+func cleanWROlderThan(runner *wr.Runner) error {
+	n, err := runner.CleanupOlderThan(wrCleanOlderThan)
+
+	info("removed %d jobs", n)
+
+	return err
+}
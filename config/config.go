@@ -24,38 +24,1070 @@
 package config
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/wtsi-hgi/go-softpack-builder/internal"
 	yaml "gopkg.in/yaml.v3"
 )
 
+const (
+	ErrAirGappedImages    = internal.Error("airGapped builds need images.registry or images.localDir")
+	ErrAirGappedMirror    = internal.Error("airGapped builds need a spack.mirrors source mirror in S3")
+	ErrAirGappedRepo      = internal.Error("airGapped builds with a customSpackRepo need airGapped.repoTarball")
+	ErrArtefact           = internal.Error("artefacts.extra need unique plain file names and paths")
+	ErrArtefactUpload     = internal.Error("artefacts.upload options can't be negative")
+	ErrBaseImage          = internal.Error("spack.baseImages need images.localDir, unique plain names and packages")
+	ErrBrokenPackage      = internal.Error("brokenPackages need unique name[@version glob] specs, refreshMinutes >= 0")
+	ErrDefaultPackage     = internal.Error("spack.defaultPackages need unique, valid package specs")
+	ErrDefaultVersion     = internal.Error("module.defaultVersion must be tcl or lmod")
+	ErrExternal           = internal.Error("spack.externals need unique names and prefixes")
+	ErrHook               = internal.Error("hooks need unique names and commands")
+	ErrInvalidMode        = internal.Error("permissions must be between 0000 and 0777")
+	ErrLimitGroup         = internal.Error("wr limit groups must be like name or name:limit")
+	ErrMirror             = internal.Error("spack.mirrors need unique valid names (not s3cache), urls and types")
+	ErrModuleName         = internal.Error("module conflicts and prereqs must be valid module names")
+	ErrQuota              = internal.Error("quotas can't be negative, and overrides need users/ or groups/ names")
+	ErrRLibsStrategy      = internal.Error("spack.rLibsStrategy must be symlink, envfile or none")
+	ErrSchedule           = internal.Error("schedules can't both debounce and throttle, or have negative seconds")
+	ErrStatusWebhook      = internal.Error("statusWebhook.endpoint requires coreURL")
+	ErrTeams              = internal.Error("teams need valid group names and contacts, refreshMinutes >= 0")
+	ErrTLSCertKey         = internal.Error("tls.certFile and tls.keyFile must be supplied together")
+	ErrTrash              = internal.Error("trash.retentionDays can't be negative")
+	ErrBuildTimeout       = internal.Error("timeouts.buildMinutes and stallMinutes can't be negative")
+	ErrTLSCertAndAutocert = internal.Error("tls.certFile and tls.autocertHosts are mutually exclusive")
+	ErrScriptsTarget      = internal.Error("module.scriptsOverflow needs scriptsInstallDir, unique dirs, minFreeGB >= 0")
+	ErrTemplate           = internal.Error("templates need unique names, packages and known profiles")
+	ErrUpgrades           = internal.Error("upgrades need coreURL and spack.versionsFile")
+	ErrTLSClientCA        = internal.Error("tls.clientCAFile requires tls to be enabled")
+	ErrTLSClientCAAuto    = internal.Error("tls.clientCAFile can't be used with tls.autocertHosts")
+	ErrUnknownExternal    = internal.Error("external package not in spack.externals")
+	ErrUnknownProfile     = internal.Error("unknown build profile")
+	ErrUnknownTarget      = internal.Error("processor target not in spack.processorTargets")
+	ErrWRDeploymentName   = internal.Error("wrDeployments must have unique names other than \"default\"")
+	ErrXvfbPackage        = internal.Error("spack.xvfbPackages need unique, valid package name globs")
+
+	// BinaryCacheMirror is the name of the spack mirror of s3.binaryCache
+	// that builds push to.
+	BinaryCacheMirror = "s3cache"
+
+	// DefaultProfile is the name of the profile used by builds that don't
+	// specify one.
+	DefaultProfile = "default"
+
+	// DefaultLimitGroup is the wr limit group that build jobs are in if their
+	// profile doesn't configure any limitGroups.
+	DefaultLimitGroup = "s3cache"
+
+	// DefaultWRDeployment is the name of the wr deployment configured by
+	// wrDeployment, used by builds that aren't routed to any of wrDeployments.
+	DefaultWRDeployment = "default"
+
+	// DefaultCVMFSPublishCommand is the sh command used to publish an installed
+	// environment to CernVM-FS if cvmfs.publishCommand isn't configured. It
+	// replaces the destination with a copy of the scripts directory inside a
+	// transaction, aborting the transaction if anything fails.
+	DefaultCVMFSPublishCommand = `cvmfs_server transaction "$GSB_CVMFS_REPO" && ` +
+		`mkdir -p "$(dirname "$GSB_CVMFS_DEST")" && rm -rf "$GSB_CVMFS_DEST" && ` +
+		`cp -a "$GSB_SCRIPTS_DIR" "$GSB_CVMFS_DEST" && cvmfs_server publish "$GSB_CVMFS_REPO" || ` +
+		`{ cvmfs_server abort -f "$GSB_CVMFS_REPO"; exit 1; }`
+
+	// DefaultVersionTcl is the module.defaultVersion that has a tcl .version
+	// file name the default version of each environment.
+	DefaultVersionTcl = "tcl"
+
+	// DefaultVersionLmod is the module.defaultVersion that has an Lmod
+	// "default" symlink point to the default version of each environment.
+	DefaultVersionLmod = "lmod"
+
+	// RLibsSymlink is the (default) spack.rLibsStrategy that shortens the
+	// overly long (>128K) R_LIBS env var of R builds by patching spack to strip
+	// its install path placeholders, symlinking /__spac to where they led.
+	RLibsSymlink = "symlink"
+
+	// RLibsEnvFile is the spack.rLibsStrategy that moves R_LIBS out of the
+	// environment of R builds in to an Renviron file, sourced by R via
+	// R_ENVIRON.
+	RLibsEnvFile = "envfile"
+
+	// RLibsNone is the spack.rLibsStrategy that leaves R_LIBS alone.
+	RLibsNone = "none"
+)
+
+// BaseImage describes a shared "base environment": an image containing a common
+// stack of spack Packages (eg. R and tidyverse) that gsb builds once, from
+// spack.buildImage in to images.localDir, and then uses as the starting point
+// of builds that need those packages.
+type BaseImage struct {
+	Name     string   `yaml:"name"`
+	Packages []string `yaml:"packages"`
+}
+
+// Template is a curated starting point for environments, eg. a "single-cell R
+// stack": a Description, the spack Packages (as "name" or "name@version") and
+// optionally the build Profile, that build requests based on it are pre-filled
+// with.
+type Template struct {
+	Name        string   `yaml:"name"`
+	Description string   `yaml:"description"`
+	Packages    []string `yaml:"packages"`
+	Profile     string   `yaml:"profile"`
+}
+
+// Mirror is an additional spack mirror that builds can get sources or binaries
+// from, eg. a site source mirror, or an upstream binary cache for your version
+// of spack. Type is "source" or "binary" to only use it for those, or blank for
+// both. If Unsigned, its binaries don't have to be signed. If TrustKeys, the
+// signing keys it publishes are trusted. KeyFile is the optional path, on the
+// wr workers, of a public key file to trust for it.
+type Mirror struct {
+	Name      string `yaml:"name"`
+	URL       string `yaml:"url"`
+	Type      string `yaml:"type"`
+	Unsigned  bool   `yaml:"unsigned"`
+	TrustKeys bool   `yaml:"trustKeys"`
+	KeyFile   string `yaml:"keyFile"`
+}
+
+// External is a system-provided package, eg. slurm, installed at Prefix on the
+// machines the built images run on, that build requests can declare instead of
+// having spack build it. Spec is its spack spec, eg. "slurm@23.02.6", and
+// defaults to Name.
+type External struct {
+	Name   string `yaml:"name"`
+	Spec   string `yaml:"spec"`
+	Prefix string `yaml:"prefix"`
+}
+
+// Profile is a named combination of build options that build requests can
+// choose between. Blank images and processor target default to those in the
+// spack section, a nil Singularity to the singularity section, and blank wr
+// resources to gsb's defaults. Memory and Time are in wr's formats, eg. "43G"
+// and "8h", and Disk is in GB. BuildJobs is the number of parallel jobs spack
+// uses to build each package; see Jobs(). LimitGroups are the wr limit groups
+// its build jobs are in (eg. "gpu:2" to run at most 2 at once), instead of
+// DefaultLimitGroup; see Config.LimitGroups().
+type Profile struct {
+	BuildImage      string            `yaml:"buildImage"`
+	FinalImage      string            `yaml:"finalImage"`
+	ProcessorTarget string            `yaml:"processorTarget"`
+	Memory          string            `yaml:"memory"`
+	Time            string            `yaml:"time"`
+	CPUs            int               `yaml:"cpus"`
+	Disk            int               `yaml:"disk"`
+	BuildJobs       int               `yaml:"buildJobs"`
+	LimitGroups     []string          `yaml:"limitGroups"`
+	Singularity     *SingularityBuild `yaml:"singularity"`
+}
+
+// Jobs returns the number of parallel jobs spack should use to build each
+// package: BuildJobs if set, otherwise the number of CPUs wr reserves for the
+// build. 0 means use spack's default. Profile() sets BuildJobs from the spack
+// section for profiles without BuildJobs or CPUs.
+func (p Profile) Jobs() int {
+	if p.BuildJobs > 0 {
+		return p.BuildJobs
+	}
+
+	return p.CPUs
+}
+
+// SingularityBuild configures how build jobs run `singularity build`. If
+// Fakeroot, singularity is run with --fakeroot instead of with sudo. Flags are
+// extra flags for singularity build, eg. "--disable-cache". TmpDir is the
+// directory bound to /tmp during the build, which defaults to the wr job's
+// $TMPDIR; it may use shell variables, and should be unique to each job.
+type SingularityBuild struct {
+	Fakeroot bool     `yaml:"fakeroot"`
+	Flags    []string `yaml:"flags"`
+	TmpDir   string   `yaml:"tmpDir"`
+}
+
+// WRDeployment is an additional wr deployment that builds can be routed to, eg.
+// one in another datacentre or with different hardware. Deployment is the wr
+// deployment name (eg. "production"), and ManagerHost and ManagerPort, if set,
+// say where its manager is, instead of wr's own config.
+//
+// Builds that use one of the listed Profiles, or whose profile has one of the
+// listed Arches as its processor target, or whose environment path starts with
+// one of the PathPrefixes, are routed to this deployment.
+type WRDeployment struct {
+	Name         string   `yaml:"name"`
+	Deployment   string   `yaml:"deployment"`
+	ManagerHost  string   `yaml:"managerHost"`
+	ManagerPort  int      `yaml:"managerPort"`
+	Profiles     []string `yaml:"profiles"`
+	Arches       []string `yaml:"arches"`
+	PathPrefixes []string `yaml:"pathPrefixes"`
+}
+
+// matches returns true if a build of the given environment path with the given
+// profile should be routed to this deployment.
+func (w WRDeployment) matches(profileName, arch, envPath string) bool {
+	if slices.Contains(w.Profiles, profileName) || slices.Contains(w.Arches, arch) {
+		return true
+	}
+
+	for _, prefix := range w.PathPrefixes {
+		if strings.HasPrefix(envPath, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Config holds our config options.
 type Config struct {
 	S3 struct {
-		BinaryCache string `yaml:"binaryCache"`
-		BuildBase   string `yaml:"buildBase"`
+		BinaryCache       string `yaml:"binaryCache"`
+		BuildBase         string `yaml:"buildBase"`
+		CredentialsBroker string `yaml:"credentialsBroker"`
 	} `yaml:"s3"`
 	Module struct {
-		ModuleInstallDir  string   `yaml:"moduleInstallDir"`
-		ScriptsInstallDir string   `yaml:"scriptsInstallDir"`
-		LoadPath          string   `yaml:"loadPath"`
-		Dependencies      []string `yaml:"dependencies"`
-		WrapperScript     string   `yaml:"wrapperScript"`
+		ModuleInstallDir  string          `yaml:"moduleInstallDir"`
+		ScriptsInstallDir string          `yaml:"scriptsInstallDir"`
+		ScriptsMinFreeGB  int             `yaml:"scriptsMinFreeGB"`
+		ScriptsOverflow   []ScriptsTarget `yaml:"scriptsOverflow"`
+		LoadPath          string          `yaml:"loadPath"`
+		Dependencies      []string        `yaml:"dependencies"`
+		WrapperScript     string          `yaml:"wrapperScript"`
+		KernelsDir        string          `yaml:"kernelsDir"`
+		Completions       bool            `yaml:"completions"`
+		DefaultVersion    string          `yaml:"defaultVersion"`
+		Conflicts         []string        `yaml:"conflicts"`
+		Prereqs           []string        `yaml:"prereqs"`
+		ValidateCommand   string          `yaml:"validateCommand"`
+		RStudio           struct {
+			ServerDir string   `yaml:"serverDir"`
+			Binds     []string `yaml:"binds"`
+		} `yaml:"rstudio"`
+		FilePerms string   `yaml:"filePerms"`
+		DirPerms  string   `yaml:"dirPerms"`
+		Group     string   `yaml:"group"`
+		SetGID    bool     `yaml:"setgid"`
+		ACL       []string `yaml:"acl"`
+		UsageLog  struct {
+			SpoolDir string `yaml:"spoolDir"`
+			Syslog   bool   `yaml:"syslog"`
+		} `yaml:"usageLog"`
+		Wrapper struct {
+			Binds []string `yaml:"binds"`
+		} `yaml:"wrapper"`
 	} `yaml:"module"`
 	CustomSpackRepo string `yaml:"customSpackRepo"`
 	Spack           struct {
-		BuildImage      string `yaml:"buildImage"`
-		FinalImage      string `yaml:"finalImage"`
-		ProcessorTarget string `yaml:"processorTarget"`
+		BuildImage       string      `yaml:"buildImage"`
+		FinalImage       string      `yaml:"finalImage"`
+		ProcessorTarget  string      `yaml:"processorTarget"`
+		ProcessorTargets []string    `yaml:"processorTargets"`
+		BaseImages       []BaseImage `yaml:"baseImages"`
+		VersionsFile     string      `yaml:"versionsFile"`
+		BuildJobs        int         `yaml:"buildJobs"`
+		Mirrors          []Mirror    `yaml:"mirrors"`
+		Externals        []External  `yaml:"externals"`
+		MinCacheHitRate  float64     `yaml:"minCacheHitRate"`
+		DefaultPackages  []string    `yaml:"defaultPackages"`
+		RLibsStrategy    string      `yaml:"rLibsStrategy"`
+		XvfbPackages     []string    `yaml:"xvfbPackages"`
 	} `yaml:"spack"`
-	CoreURL      string `yaml:"coreURL"`
-	ListenURL    string `yaml:"listenURL"`
-	WRDeployment string `yaml:"wrDeployment"`
+	CoreURL       string              `yaml:"coreURL"`
+	ListenURL     string              `yaml:"listenURL"`
+	WRDeployment  string              `yaml:"wrDeployment"`
+	WRDeployments []WRDeployment      `yaml:"wrDeployments"`
+	WRRetries     int                 `yaml:"wrRetries"`
+	WRLimitGroups map[string][]string `yaml:"wrLimitGroups"`
+	Singularity   *SingularityBuild   `yaml:"singularity"`
+	Server        struct {
+		MaxRequestBytes  int64   `yaml:"maxRequestBytes"`
+		MaxPackages      int     `yaml:"maxPackages"`
+		RateLimit        float64 `yaml:"rateLimit"`
+		RateBurst        int     `yaml:"rateBurst"`
+		MaintenanceFile  string  `yaml:"maintenanceFile"`
+		AdminToken       string  `yaml:"adminToken"`
+		MetadataCacheDir string  `yaml:"metadataCacheDir"`
+	} `yaml:"server"`
+	TLS           TLS                `yaml:"tls"`
+	Timeouts      Timeouts           `yaml:"timeouts"`
+	Replication   Replication        `yaml:"replication"`
+	StatusWebhook StatusWebhook      `yaml:"statusWebhook"`
+	Images        Images             `yaml:"images"`
+	AirGapped     AirGapped          `yaml:"airGapped"`
+	CVMFS         CVMFS              `yaml:"cvmfs"`
+	Profiles      map[string]Profile `yaml:"profiles"`
+	Quotas        Quotas             `yaml:"quotas"`
+	Hooks         []Hook             `yaml:"hooks"`
+	PreBuildHooks []Hook             `yaml:"preBuildHooks"`
+	Templates     []Template         `yaml:"templates"`
+	Upgrades      Upgrades           `yaml:"upgrades"`
+	Artefacts     Artefacts          `yaml:"artefacts"`
+	Broken        BrokenPackages     `yaml:"brokenPackages"`
+	Teams         Teams              `yaml:"teams"`
+	Protection    Protection         `yaml:"protection"`
+	Trash         Trash              `yaml:"trash"`
+}
+
+// Profile returns the named profile, with blank images and processor target
+// filled in from the spack section, and a nil Singularity from the singularity
+// section. Build jobs come from the spack section if the profile has neither
+// them nor CPUs. A blank name means DefaultProfile, which doesn't have to be
+// configured. Returns ErrUnknownProfile if the name isn't configured.
+func (c *Config) Profile(name string) (Profile, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+
+	profile, ok := c.Profiles[name]
+	if !ok && name != DefaultProfile {
+		return profile, ErrUnknownProfile
+	}
+
+	if profile.BuildImage == "" {
+		profile.BuildImage = c.Spack.BuildImage
+	}
+
+	if profile.FinalImage == "" {
+		profile.FinalImage = c.Spack.FinalImage
+	}
+
+	if profile.ProcessorTarget == "" {
+		profile.ProcessorTarget = c.Spack.ProcessorTarget
+	}
+
+	if profile.Singularity == nil {
+		profile.Singularity = c.Singularity
+	}
+
+	if profile.BuildJobs == 0 && profile.CPUs == 0 {
+		profile.BuildJobs = c.Spack.BuildJobs
+	}
+
+	return profile, nil
+}
+
+// BuildProfile is like Profile(), but if processorTarget isn't blank or the
+// profile's own, the profile's is overridden with it. Returns ErrUnknownTarget
+// if such an override isn't one of spack.processorTargets.
+func (c *Config) BuildProfile(name, processorTarget string) (Profile, error) {
+	profile, err := c.Profile(name)
+	if err != nil || processorTarget == "" || processorTarget == profile.ProcessorTarget {
+		return profile, err
+	}
+
+	if !slices.Contains(c.Spack.ProcessorTargets, processorTarget) {
+		return profile, ErrUnknownTarget
+	}
+
+	profile.ProcessorTarget = processorTarget
+
+	return profile, nil
+}
+
+// WRDeploymentFor returns the name of the first of our WRDeployments that a
+// build of the given environment path using the named profile and processor
+// target (blank for the profile's) should be routed to, or DefaultWRDeployment
+// if there isn't one.
+func (c *Config) WRDeploymentFor(profileName, processorTarget, envPath string) string {
+	if profileName == "" {
+		profileName = DefaultProfile
+	}
+
+	profile, _ := c.Profile(profileName) //nolint:errcheck
+
+	if processorTarget != "" {
+		profile.ProcessorTarget = processorTarget
+	}
+
+	for _, deployment := range c.WRDeployments {
+		if deployment.matches(profileName, profile.ProcessorTarget, envPath) {
+			return deployment.Name
+		}
+	}
+
+	return DefaultWRDeployment
+}
+
+// LimitGroups returns the wr limit groups that build jobs using the given profile
+// (as returned by BuildProfile()) should be in: the profile's LimitGroups, or
+// DefaultLimitGroup if it has none, followed by those configured in
+// wrLimitGroups for its processor target.
+func (c *Config) LimitGroups(profile Profile) []string {
+	groups := profile.LimitGroups
+	if len(groups) == 0 {
+		groups = []string{DefaultLimitGroup}
+	}
+
+	groups = slices.Clone(groups)
+
+	for _, group := range c.WRLimitGroups[profile.ProcessorTarget] {
+		if !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// TLS holds the options for serving gsb's endpoints over https. Either supply
+// a CertFile and KeyFile, or AutocertHosts to get certificates automatically
+// from Let's Encrypt. If ClientCAFile is set, clients must present a
+// certificate signed by one of the CAs in that file; this can't be combined
+// with AutocertHosts, as Let's Encrypt's TLS-ALPN-01 challenges are done
+// without client certificates.
+type TLS struct {
+	CertFile         string   `yaml:"certFile"`
+	KeyFile          string   `yaml:"keyFile"`
+	AutocertHosts    []string `yaml:"autocertHosts"`
+	AutocertCacheDir string   `yaml:"autocertCacheDir"`
+	ClientCAFile     string   `yaml:"clientCAFile"`
+}
+
+// Enabled returns true if TLS has been configured.
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || len(t.AutocertHosts) > 0
+}
+
+const (
+	defaultS3TimeoutSeconds      = 3600
+	defaultCoreTimeoutSeconds    = 300
+	defaultReplicationRetry      = 300
+	defaultReplicationMaxRetry   = 3600
+	defaultStatusWebhookRetry    = 30
+	defaultStatusWebhookMaxRetry = 600
+	defaultImageRefreshHours     = 24
+	defaultBrokenRefreshMinutes  = 60
+	defaultTeamsRefreshMinutes   = 60
+	defaultTrashRetentionDays    = 30
+	defaultHookTimeout           = 60
+	defaultUploadParallelism     = 2
+	defaultUploadRetries         = 3
+	bytesPerMB                   = 1 << 20
+	bytesPerGB                   = 1 << 30
+)
+
+// Timeouts holds the maximum number of seconds that individual S3 operations
+// (including streaming the data of a downloaded file) and requests to core may
+// take. 0 means use the default of an hour for S3 and 5 minutes for core; a
+// negative number means no timeout.
+//
+// BuildMinutes is the maximum time a build may run for, and StallMinutes the
+// maximum time a running build may go without writing to its builder.out,
+// before it is killed. 0 (the default) means no limit. Builds killed for
+// stalling are retried (up to wrRetries times) if RetryStalls is true.
+type Timeouts struct {
+	S3Seconds    int  `yaml:"s3Seconds"`
+	CoreSeconds  int  `yaml:"coreSeconds"`
+	BuildMinutes int  `yaml:"buildMinutes"`
+	StallMinutes int  `yaml:"stallMinutes"`
+	RetryStalls  bool `yaml:"retryStalls"`
+}
+
+// S3 returns the S3 timeout as a Duration. Returns 0 for no timeout.
+func (t Timeouts) S3() time.Duration {
+	return timeoutDuration(t.S3Seconds, defaultS3TimeoutSeconds)
+}
+
+// Core returns the core timeout as a Duration. Returns 0 for no timeout.
+func (t Timeouts) Core() time.Duration {
+	return timeoutDuration(t.CoreSeconds, defaultCoreTimeoutSeconds)
+}
+
+// Build returns the maximum duration of a build. Returns 0 for no limit.
+func (t Timeouts) Build() time.Duration {
+	return time.Duration(t.BuildMinutes) * time.Minute
+}
+
+// Stall returns how long a build may go without output before it is considered
+// stalled. Returns 0 for no stall detection.
+func (t Timeouts) Stall() time.Duration {
+	return time.Duration(t.StallMinutes) * time.Minute
+}
+
+func timeoutDuration(seconds, defaultSeconds int) time.Duration {
+	switch {
+	case seconds < 0:
+		return 0
+	case seconds == 0:
+		seconds = defaultSeconds
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// StatusWebhook holds the options for telling core whenever a build changes
+// stage. Endpoint is the path, under CoreURL, that changes are POSTed to, and
+// failed deliveries are retried after RetrySeconds, backing off to
+// MaxRetrySeconds. Undelivered changes are saved to QueueFile, if set, so that
+// they survive restarts.
+type StatusWebhook struct {
+	Endpoint        string `yaml:"endpoint"`
+	RetrySeconds    int    `yaml:"retrySeconds"`
+	MaxRetrySeconds int    `yaml:"maxRetrySeconds"`
+	QueueFile       string `yaml:"queueFile"`
+}
+
+// Enabled returns true if the status webhook has been configured.
+func (s StatusWebhook) Enabled() bool {
+	return s.Endpoint != ""
+}
+
+// RetryInterval returns how long to wait before retrying a failed delivery,
+// defaulting to 30 seconds.
+func (s StatusWebhook) RetryInterval() time.Duration {
+	if s.RetrySeconds <= 0 {
+		return defaultStatusWebhookRetry * time.Second
+	}
+
+	return time.Duration(s.RetrySeconds) * time.Second
+}
+
+// MaxRetryInterval returns the longest we back off to between retries of a
+// delivery that keeps failing, defaulting to 10 minutes.
+func (s StatusWebhook) MaxRetryInterval() time.Duration {
+	if s.MaxRetrySeconds <= 0 {
+		return defaultStatusWebhookMaxRetry * time.Second
+	}
+
+	return time.Duration(s.MaxRetrySeconds) * time.Second
+}
+
+// Hook is a named shell Command run after every build, eg. to reindex a
+// buildcache, notify people or scan the image, or before every build, eg. to
+// check the build request against site policy. It may take up to
+// TimeoutSeconds, defaulting to a minute; a negative number means no timeout.
+type Hook struct {
+	Name           string `yaml:"name"`
+	Command        string `yaml:"command"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+}
+
+// Timeout returns the hook's timeout as a Duration. Returns 0 for no timeout.
+func (h Hook) Timeout() time.Duration {
+	return timeoutDuration(h.TimeoutSeconds, defaultHookTimeout)
+}
+
+// Upgrades holds the options for proposing new versions of environments that
+// have opted in to auto upgrades, when newer versions of their root packages
+// appear in the spack versionsFile. Every IntervalHours (or at the times of the
+// Schedule's cron expression, if set), such environments have a new version
+// created via core, and their owner is notified by running the Notify hook, if
+// it has a command.
+type Upgrades struct {
+	IntervalHours int      `yaml:"intervalHours"`
+	Notify        Hook     `yaml:"notify"`
+	Schedule      Schedule `yaml:"schedule"`
+}
+
+// Schedule says when some background work runs, instead of its plain interval.
+// If Cron is set, the work runs at the times it matches: it's a cron expression
+// with the usual 5 numeric fields (minute, hour, day of month, month and day of
+// week, in local time), eg. "30 2 * * *" for 2:30am every day.
+//
+// Work that is triggered by events (eg. replicating each successful build) is
+// instead done DebounceSeconds after the last of a burst of them, if set, or
+// at most once every ThrottleSeconds, if set, with events during that wait
+// handled together at its end.
+type Schedule struct {
+	Cron            string `yaml:"cron"`
+	DebounceSeconds int    `yaml:"debounceSeconds"`
+	ThrottleSeconds int    `yaml:"throttleSeconds"`
+}
+
+// Enabled returns true if any part of the schedule has been configured.
+func (s Schedule) Enabled() bool {
+	return s.Cron != "" || s.DebounceSeconds > 0 || s.ThrottleSeconds > 0
+}
+
+// Debounce returns how long to wait after the last of a burst of events.
+func (s Schedule) Debounce() time.Duration {
+	return time.Duration(s.DebounceSeconds) * time.Second
+}
+
+// Throttle returns the least time between runs due to events.
+func (s Schedule) Throttle() time.Duration {
+	return time.Duration(s.ThrottleSeconds) * time.Second
+}
+
+func (s Schedule) validate() error {
+	if s.DebounceSeconds < 0 || s.ThrottleSeconds < 0 || (s.DebounceSeconds > 0 && s.ThrottleSeconds > 0) {
+		return ErrSchedule
+	}
+
+	return nil
+}
+
+// Protection holds the options for environments protected against removal: the
+// OverrideToken that must be supplied to remove one anyway. If blank,
+// protected environments can't be removed until they're unprotected.
+type Protection struct {
+	OverrideToken string `yaml:"overrideToken"`
+}
+
+// Overridden returns true if the given token matches our OverrideToken, which
+// must be set.
+func (p Protection) Overridden(token string) bool {
+	return p.OverrideToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.OverrideToken)) == 1
+}
+
+// Trash holds the options for keeping removed environments so that they can be
+// restored: the Dir (on the same filesystem as the module and scripts install
+// dirs) that their files are moved in to instead of being deleted, and how many
+// RetentionDays (default 30) they are kept there for. If Dir is blank, removed
+// environments are deleted immediately.
+type Trash struct {
+	Dir           string `yaml:"dir"`
+	RetentionDays int    `yaml:"retentionDays"`
+}
+
+// Enabled returns true if a trash Dir is configured.
+func (t Trash) Enabled() bool {
+	return t.Dir != ""
+}
+
+// Retention returns how long removed environments are kept in the trash.
+func (t Trash) Retention() time.Duration {
+	if t.RetentionDays <= 0 {
+		return defaultTrashRetentionDays * 24 * time.Hour
+	}
+
+	return time.Duration(t.RetentionDays) * 24 * time.Hour
+}
+
+// Artefacts holds the options for changing the set of build artefacts sent to
+// core for successful builds: Extra files to add, and the names of default
+// artefacts (like "builder.out") to Suppress, and how to Upload them.
+type Artefacts struct {
+	Extra    []ExtraArtefact `yaml:"extra"`
+	Suppress []string        `yaml:"suppress"`
+	Upload   ArtefactUpload  `yaml:"upload"`
+}
+
+// ArtefactUpload holds the options for uploading artefacts to a core that
+// supports chunked uploads, instead of sending them all in a single multipart
+// request. If ChunkSizeMB is more than 0, each artefact is sent in chunks of
+// that size, each chunk retried up to Retries times (default 3), resuming from
+// however much of it core got, with no more than Parallelism (default 2)
+// artefacts sent at once.
+type ArtefactUpload struct {
+	ChunkSizeMB int `yaml:"chunkSizeMB"`
+	Parallelism int `yaml:"parallelism"`
+	Retries     int `yaml:"retries"`
+}
+
+// Chunked returns true if chunked uploads have been configured.
+func (u ArtefactUpload) Chunked() bool {
+	return u.ChunkSizeMB > 0
+}
+
+// ChunkSize returns the configured chunk size in bytes.
+func (u ArtefactUpload) ChunkSize() int {
+	return u.ChunkSizeMB * bytesPerMB
+}
+
+// MaxParallel returns the maximum number of artefacts to upload at once.
+func (u ArtefactUpload) MaxParallel() int {
+	if u.Parallelism == 0 {
+		return defaultUploadParallelism
+	}
+
+	return u.Parallelism
+}
+
+// MaxRetries returns the number of times to retry a failed chunk upload.
+func (u ArtefactUpload) MaxRetries() int {
+	if u.Retries == 0 {
+		return defaultUploadRetries
+	}
+
+	return u.Retries
+}
+
+// ExtraArtefact is a local file at Path, read when each build's artefacts are
+// sent, that is sent to core as an artefact with the file Name, eg. a
+// site-specific LICENSE notice.
+type ExtraArtefact struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+}
+
+func (a Artefacts) validate() error {
+	names := make(map[string]bool, len(a.Extra))
+
+	for _, extra := range a.Extra {
+		if !IsPlainFileName(extra.Name) || extra.Path == "" || names[extra.Name] {
+			return ErrArtefact
+		}
+
+		names[extra.Name] = true
+	}
+
+	if a.Upload.ChunkSizeMB < 0 || a.Upload.Parallelism < 0 || a.Upload.Retries < 0 {
+		return ErrArtefactUpload
+	}
+
+	return nil
+}
+
+// IsPlainFileName returns true if the given name is a file name that isn't
+// hidden and has no directory component.
+func IsPlainFileName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// Enabled returns true if proposing upgrades has been configured.
+func (u Upgrades) Enabled() bool {
+	return u.IntervalHours > 0 || u.Schedule.Cron != ""
+}
+
+// Interval returns how long to wait between checking for upgrades.
+func (u Upgrades) Interval() time.Duration {
+	return time.Duration(u.IntervalHours) * time.Hour
+}
+
+// Replication holds the options for mirroring the artefacts of successful
+// builds to a secondary S3 location, eg. at a DR site. BuildBase is the bucket
+// and optional sub "directory" to copy to, and Profile the ~/.s3cfg profile to
+// access it with (eg. one for another region); blank means the default. Failed
+// copies are retried after RetrySeconds, backing off to MaxRetrySeconds.
+//
+// Builds are copied straight away, unless the Schedule says to debounce or
+// throttle them, or to copy them at the times of its cron expression.
+type Replication struct {
+	BuildBase       string   `yaml:"buildBase"`
+	Profile         string   `yaml:"profile"`
+	RetrySeconds    int      `yaml:"retrySeconds"`
+	MaxRetrySeconds int      `yaml:"maxRetrySeconds"`
+	Schedule        Schedule `yaml:"schedule"`
+}
+
+// Enabled returns true if replication has been configured.
+func (r Replication) Enabled() bool {
+	return r.BuildBase != ""
+}
+
+// RetryInterval returns how long to wait before retrying a failed copy,
+// defaulting to 5 minutes.
+func (r Replication) RetryInterval() time.Duration {
+	if r.RetrySeconds <= 0 {
+		return defaultReplicationRetry * time.Second
+	}
+
+	return time.Duration(r.RetrySeconds) * time.Second
+}
+
+// MaxRetryInterval returns the longest we back off to between retries of a
+// copy that keeps failing, defaulting to an hour.
+func (r Replication) MaxRetryInterval() time.Duration {
+	if r.MaxRetrySeconds <= 0 {
+		return defaultReplicationMaxRetry * time.Second
+	}
+
+	return time.Duration(r.MaxRetrySeconds) * time.Second
+}
+
+// BrokenPackages holds a denylist of package versions known not to build or
+// work on our cluster, checked when builds are requested, so that users find
+// out straight away instead of after a failed build. Packages are listed
+// directly, and URL, if set, is fetched every RefreshMinutes (default 60) for
+// more, as a YAML list in the same format.
+type BrokenPackages struct {
+	URL            string          `yaml:"url"`
+	RefreshMinutes int             `yaml:"refreshMinutes"`
+	Packages       []BrokenPackage `yaml:"packages"`
+}
+
+// BrokenPackage is a Spec like "r-seurat@5.0.0", where the version may be a
+// glob like "5.0.*", or left off to match every version of the package, and the
+// Reason it's broken, eg. "use 4.4 instead".
+type BrokenPackage struct {
+	Spec   string `yaml:"spec"`
+	Reason string `yaml:"reason"`
+}
+
+// NameAndVersion splits the Spec into its package name and version glob.
+func (b BrokenPackage) NameAndVersion() (string, string) {
+	name, version, _ := strings.Cut(b.Spec, "@")
+
+	return name, version
+}
+
+// RefreshInterval returns how long to wait between fetches of the URL,
+// defaulting to 1 hour.
+func (b BrokenPackages) RefreshInterval() time.Duration {
+	if b.RefreshMinutes <= 0 {
+		return defaultBrokenRefreshMinutes * time.Minute
+	}
+
+	return time.Duration(b.RefreshMinutes) * time.Minute
+}
+
+func (b BrokenPackages) validate() error {
+	if b.RefreshMinutes < 0 {
+		return ErrBrokenPackage
+	}
+
+	if b.URL != "" {
+		if _, err := url.Parse(b.URL); err != nil {
+			return fmt.Errorf("invalid brokenPackages.url: %w", err)
+		}
+	}
+
+	return ValidateBrokenPackages(b.Packages)
+}
+
+// Teams holds the contacts (usernames or email addresses) of the teams that own
+// groups/ environments, so that they can be notified about and held accountable
+// for their group's builds. Contacts are listed directly, keyed on group name,
+// and URL, if set, is used to look up the contacts of other groups with a GET
+// to URL/[group], which should return them as a YAML list (or a 404 for groups
+// without a team). Looked up contacts are cached for RefreshMinutes (default
+// 60).
+type Teams struct {
+	URL            string              `yaml:"url"`
+	RefreshMinutes int                 `yaml:"refreshMinutes"`
+	Contacts       map[string][]string `yaml:"contacts"`
+}
+
+// RefreshInterval returns how long looked up contacts are cached for,
+// defaulting to 1 hour.
+func (t Teams) RefreshInterval() time.Duration {
+	if t.RefreshMinutes <= 0 {
+		return defaultTeamsRefreshMinutes * time.Minute
+	}
+
+	return time.Duration(t.RefreshMinutes) * time.Minute
+}
+
+func (t Teams) validate() error {
+	if t.RefreshMinutes < 0 {
+		return ErrTeams
+	}
+
+	if t.URL != "" {
+		if _, err := url.Parse(t.URL); err != nil {
+			return fmt.Errorf("invalid teams.url: %w", err)
+		}
+	}
+
+	for group, contacts := range t.Contacts {
+		if !IsPlainFileName(group) {
+			return ErrTeams
+		}
+
+		if err := ValidateContacts(contacts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ValidateContacts returns ErrTeams if any of the given team contacts are blank
+// or contain whitespace or commas.
+func ValidateContacts(contacts []string) error {
+	for _, contact := range contacts {
+		if contact == "" || strings.ContainsAny(contact, " \t\r\n,") {
+			return ErrTeams
+		}
+	}
+
+	return nil
+}
+
+// ValidateBrokenPackages returns ErrBrokenPackage if any of the given
+// BrokenPackages have a blank package name or invalid version glob, or the same
+// Spec as another.
+func ValidateBrokenPackages(pkgs []BrokenPackage) error {
+	seen := make(map[string]bool, len(pkgs))
+
+	for _, pkg := range pkgs {
+		name, version := pkg.NameAndVersion()
+		if name == "" || seen[pkg.Spec] || strings.ContainsAny(name, " \t/") {
+			return ErrBrokenPackage
+		}
+
+		if _, err := path.Match(version, ""); err != nil {
+			return ErrBrokenPackage
+		}
+
+		seen[pkg.Spec] = true
+	}
+
+	return nil
+}
+
+// Quota limits the builds of a user or group. BuildsPerDay is how many builds
+// may be requested in any 24 hours, ConcurrentBuilds how many may be running at
+// once, and ImageGB the total size of the images of their installed
+// environments. Zero means no limit.
+type Quota struct {
+	BuildsPerDay     int     `yaml:"buildsPerDay"`
+	ConcurrentBuilds int     `yaml:"concurrentBuilds"`
+	ImageGB          float64 `yaml:"imageGB"`
+}
+
+// Quotas holds the default Quota of every User and Group, and Overrides of
+// those for particular users or groups, keyed like "users/foo" or
+// "groups/hgi". Usage is saved to StateFile, if set, so that it survives
+// restarts.
+type Quotas struct {
+	User      Quota            `yaml:"user"`
+	Group     Quota            `yaml:"group"`
+	Overrides map[string]Quota `yaml:"overrides"`
+	StateFile string           `yaml:"stateFile"`
+}
+
+// Enabled returns true if any quota has been configured.
+func (q Quotas) Enabled() bool {
+	return q.User != Quota{} || q.Group != Quota{} || len(q.Overrides) > 0
+}
+
+// For returns the Quota of the given account (eg. "users/foo" or
+// "groups/hgi"): its override, if any, or else the default user or group
+// Quota.
+func (q Quotas) For(account string) Quota {
+	if quota, ok := q.Overrides[account]; ok {
+		return quota
+	}
+
+	if strings.HasPrefix(account, "groups/") {
+		return q.Group
+	}
+
+	return q.User
+}
+
+func (q Quotas) validate() error {
+	quotas := []Quota{q.User, q.Group}
+
+	for account, quota := range q.Overrides {
+		if !strings.HasPrefix(account, "users/") && !strings.HasPrefix(account, "groups/") {
+			return ErrQuota
+		}
+
+		quotas = append(quotas, quota)
+	}
+
+	for _, quota := range quotas {
+		if quota.BuildsPerDay < 0 || quota.ConcurrentBuilds < 0 || quota.ImageGB < 0 {
+			return ErrQuota
+		}
+	}
+
+	return nil
+}
+
+// Images holds the options for avoiding Docker Hub (and its rate limits) when
+// bootstrapping builds. If Registry is set, images without a registry host
+// (eg. "ubuntu:22.04") are pulled from that registry mirror instead.
+//
+// If LocalDir is set, gsb periodically adds a wr job that pulls all the
+// configured spack, profile and base images to SIF files in that directory,
+// every RefreshHours, or at the times of the Schedule's cron expression, if
+// set. Builds bootstrap from those local SIF files, when they exist, instead of
+// pulling the images. LocalDir must be on a filesystem shared between gsb and
+// the wr workers.
+//
+// If ResolveDigests is set, the digests of the build and final images pulled
+// from registries are looked up for the provenance recorded for each build.
+type Images struct {
+	Registry       string   `yaml:"registry"`
+	LocalDir       string   `yaml:"localDir"`
+	RefreshHours   int      `yaml:"refreshHours"`
+	ResolveDigests bool     `yaml:"resolveDigests"`
+	Schedule       Schedule `yaml:"schedule"`
+}
+
+// RefreshInterval returns how long to wait between refreshes of the images in
+// LocalDir, defaulting to 1 day.
+func (i Images) RefreshInterval() time.Duration {
+	if i.RefreshHours <= 0 {
+		return defaultImageRefreshHours * time.Hour
+	}
+
+	return time.Duration(i.RefreshHours) * time.Hour
+}
+
+// AirGapped holds the options for builds that have no outbound internet
+// access. If Enabled, build images must come from the images registry mirror
+// or local copies, sources from a spack.mirrors mirror in S3, and the custom
+// spack repo from RepoTarball instead of being cloned. RepoTarball is the path,
+// on the wr workers, of a tar.gz of the repo with its repo.yaml at the top
+// level.
+type AirGapped struct {
+	Enabled     bool   `yaml:"enabled"`
+	RepoTarball string `yaml:"repoTarball"`
+}
+
+func (c *Config) validateAirGapped() error {
+	if !c.AirGapped.Enabled {
+		return nil
+	}
+
+	if c.Images.Registry == "" && c.Images.LocalDir == "" {
+		return ErrAirGappedImages
+	}
+
+	if !slices.ContainsFunc(c.Spack.Mirrors, func(mirror Mirror) bool {
+		return mirror.Type != "binary" && strings.HasPrefix(mirror.URL, "s3://")
+	}) {
+		return ErrAirGappedMirror
+	}
+
+	if c.CustomSpackRepo != "" && c.AirGapped.RepoTarball == "" {
+		return ErrAirGappedRepo
+	}
+
+	return nil
+}
+
+// CVMFS holds the options for publishing installed environments to a
+// CernVM-FS repository, so they are available on grid sites. If Repository is
+// set, after each environment is installed PublishCommand is run with sh to
+// copy its scripts directory (containing the image and wrapper scripts) to the
+// same relative location under Dir, which defaults to /cvmfs/[Repository].
+//
+// The command is given the environment variables GSB_CVMFS_REPO,
+// GSB_SCRIPTS_DIR (the installed scripts directory) and GSB_CVMFS_DEST (where
+// it should be published to), and defaults to DefaultCVMFSPublishCommand.
+type CVMFS struct {
+	Repository     string `yaml:"repository"`
+	Dir            string `yaml:"dir"`
+	PublishCommand string `yaml:"publishCommand"`
+}
+
+// Enabled returns true if CVMFS publication has been configured.
+func (c CVMFS) Enabled() bool {
+	return c.Repository != ""
+}
+
+// PublishDir returns the directory environments are published under.
+func (c CVMFS) PublishDir() string {
+	if c.Dir == "" {
+		return filepath.Join("/cvmfs", c.Repository)
+	}
+
+	return c.Dir
+}
+
+// Command returns the command to publish an environment with.
+func (c CVMFS) Command() string {
+	if c.PublishCommand == "" {
+		return DefaultCVMFSPublishCommand
+	}
+
+	return c.PublishCommand
 }
 
 // GetConfig returns a config based on the given config file path. If it's
@@ -98,6 +1130,119 @@ func Parse(r io.Reader) (*Config, error) {
 		}
 	}
 
+	for name, perms := range map[string]string{
+		"module.filePerms": c.Module.FilePerms,
+		"module.dirPerms":  c.Module.DirPerms,
+	} {
+		if _, err := ParseMode(perms); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+
+	if err := ValidateModuleNames(c.Module.Conflicts, c.Module.Prereqs); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateScriptsTargets(); err != nil {
+		return nil, err
+	}
+
+	switch c.Module.DefaultVersion {
+	case "", DefaultVersionTcl, DefaultVersionLmod:
+	default:
+		return nil, ErrDefaultVersion
+	}
+
+	switch c.Spack.RLibsStrategy {
+	case "", RLibsSymlink, RLibsEnvFile, RLibsNone:
+	default:
+		return nil, ErrRLibsStrategy
+	}
+
+	if err := c.TLS.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateWRDeployments(); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateMirrors(); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateLimitGroups(); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateExternals(); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateAirGapped(); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateDefaultPackages(); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateXvfbPackages(); err != nil {
+		return nil, err
+	}
+
+	if c.Timeouts.BuildMinutes < 0 || c.Timeouts.StallMinutes < 0 {
+		return nil, ErrBuildTimeout
+	}
+
+	if err := c.Quotas.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateTemplates(); err != nil {
+		return nil, err
+	}
+
+	if err := c.validateBaseImages(); err != nil {
+		return nil, err
+	}
+
+	if c.Upgrades.Enabled() && (c.CoreURL == "" || c.Spack.VersionsFile == "") {
+		return nil, ErrUpgrades
+	}
+
+	if err := c.Artefacts.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := c.Teams.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := c.Broken.validate(); err != nil {
+		return nil, err
+	}
+
+	if c.Trash.RetentionDays < 0 {
+		return nil, ErrTrash
+	}
+
+	for _, schedule := range []Schedule{c.Images.Schedule, c.Upgrades.Schedule, c.Replication.Schedule} {
+		if err := schedule.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hooks := range [][]Hook{c.Hooks, c.PreBuildHooks} {
+		if err := validateHooks(hooks); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.StatusWebhook.Enabled() && c.CoreURL == "" {
+		return nil, ErrStatusWebhook
+	}
+
 	if c.CoreURL != "" {
 		if _, err := url.Parse(c.CoreURL); err != nil {
 			return nil, fmt.Errorf("invalid coreURL: %w", err)
@@ -106,3 +1251,293 @@ func Parse(r io.Reader) (*Config, error) {
 
 	return c, nil
 }
+
+func (t TLS) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return ErrTLSCertKey
+	}
+
+	if t.CertFile != "" && len(t.AutocertHosts) > 0 {
+		return ErrTLSCertAndAutocert
+	}
+
+	if t.ClientCAFile != "" && !t.Enabled() {
+		return ErrTLSClientCA
+	}
+
+	if t.ClientCAFile != "" && len(t.AutocertHosts) > 0 {
+		return ErrTLSClientCAAuto
+	}
+
+	return nil
+}
+
+func (c *Config) validateWRDeployments() error {
+	names := map[string]bool{DefaultWRDeployment: true}
+
+	for _, deployment := range c.WRDeployments {
+		if deployment.Name == "" || names[deployment.Name] {
+			return ErrWRDeploymentName
+		}
+
+		names[deployment.Name] = true
+	}
+
+	return nil
+}
+
+var moduleNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.+@/-]+$`) //nolint:gochecknoglobals
+
+// ValidateModuleNames returns ErrModuleName if any of the given module names
+// (eg. "openmpi" or "mpi/openmpi/4.1") contain characters that aren't safe to
+// use in a tcl module file.
+func ValidateModuleNames(names ...[]string) error {
+	for _, list := range names {
+		for _, name := range list {
+			if !moduleNameRegexp.MatchString(name) {
+				return ErrModuleName
+			}
+		}
+	}
+
+	return nil
+}
+
+var limitGroupRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+(:[0-9]+)?$`) //nolint:gochecknoglobals
+
+func (c *Config) validateLimitGroups() error {
+	lists := make([][]string, 0, len(c.Profiles)+len(c.WRLimitGroups))
+
+	for _, profile := range c.Profiles {
+		lists = append(lists, profile.LimitGroups)
+	}
+
+	for _, groups := range c.WRLimitGroups {
+		lists = append(lists, groups)
+	}
+
+	for _, groups := range lists {
+		for _, group := range groups {
+			if !limitGroupRegexp.MatchString(group) {
+				return ErrLimitGroup
+			}
+		}
+	}
+
+	return nil
+}
+
+var mirrorNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`) //nolint:gochecknoglobals
+
+func (c *Config) validateMirrors() error {
+	names := map[string]bool{BinaryCacheMirror: true}
+
+	for _, mirror := range c.Spack.Mirrors {
+		if !mirrorNameRegexp.MatchString(mirror.Name) || names[mirror.Name] || mirror.URL == "" ||
+			!slices.Contains([]string{"", "source", "binary"}, mirror.Type) {
+			return ErrMirror
+		}
+
+		names[mirror.Name] = true
+	}
+
+	return nil
+}
+
+func (c *Config) validateXvfbPackages() error {
+	globs := make(map[string]bool, len(c.Spack.XvfbPackages))
+
+	for _, glob := range c.Spack.XvfbPackages {
+		if _, err := path.Match(glob, ""); err != nil || glob == "" || strings.Contains(glob, "@") || globs[glob] {
+			return ErrXvfbPackage
+		}
+
+		globs[glob] = true
+	}
+
+	return nil
+}
+
+// NeedsXvfb returns true if a build of packages with the given names needs a
+// virtual X server, which is the case if any of the names match one of our
+// spack.xvfbPackages globs. If there are none configured, every build is
+// considered to need one.
+func (c *Config) NeedsXvfb(names ...string) bool {
+	if len(c.Spack.XvfbPackages) == 0 {
+		return true
+	}
+
+	for _, name := range names {
+		for _, glob := range c.Spack.XvfbPackages {
+			if matched, _ := path.Match(glob, name); matched { //nolint:errcheck
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c *Config) validateExternals() error {
+	names := make(map[string]bool, len(c.Spack.Externals))
+
+	for _, external := range c.Spack.Externals {
+		if external.Name == "" || external.Prefix == "" || names[external.Name] {
+			return ErrExternal
+		}
+
+		names[external.Name] = true
+	}
+
+	return nil
+}
+
+// validDefaultPackage matches spack "name" or "name@version" specs that are
+// safe to put in the spack.yaml of every build.
+var validDefaultPackage = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*(@[A-Za-z0-9.:=][A-Za-z0-9._:,=+-]*)?$`) //nolint:gochecknoglobals,lll
+
+func (c *Config) validateDefaultPackages() error {
+	names := make(map[string]bool, len(c.Spack.DefaultPackages))
+
+	for _, spec := range c.Spack.DefaultPackages {
+		name, _, _ := strings.Cut(spec, "@")
+		if !validDefaultPackage.MatchString(spec) || names[name] {
+			return ErrDefaultPackage
+		}
+
+		names[name] = true
+	}
+
+	return nil
+}
+
+func (c *Config) validateTemplates() error {
+	names := make(map[string]bool, len(c.Templates))
+
+	for _, template := range c.Templates {
+		if template.Name == "" || len(template.Packages) == 0 || names[template.Name] {
+			return ErrTemplate
+		}
+
+		if _, err := c.Profile(template.Profile); err != nil {
+			return ErrTemplate
+		}
+
+		names[template.Name] = true
+	}
+
+	return nil
+}
+
+func (c *Config) validateBaseImages() error {
+	names := make(map[string]bool, len(c.Spack.BaseImages))
+
+	for _, base := range c.Spack.BaseImages {
+		if c.Images.LocalDir == "" || !IsPlainFileName(base.Name) || len(base.Packages) == 0 || names[base.Name] {
+			return ErrBaseImage
+		}
+
+		names[base.Name] = true
+	}
+
+	return nil
+}
+
+func validateHooks(hooks []Hook) error {
+	names := make(map[string]bool, len(hooks))
+
+	for _, hook := range hooks {
+		if hook.Name == "" || hook.Command == "" || names[hook.Name] {
+			return ErrHook
+		}
+
+		names[hook.Name] = true
+	}
+
+	return nil
+}
+
+// ScriptsTarget is a directory that environment scripts and images can be
+// installed in to, as long as the filesystem it is on will still have at least
+// MinFreeGB free afterwards.
+type ScriptsTarget struct {
+	Dir       string `yaml:"dir"`
+	MinFreeGB int    `yaml:"minFreeGB"`
+}
+
+// MinFreeBytes returns MinFreeGB in bytes.
+func (t ScriptsTarget) MinFreeBytes() uint64 {
+	return uint64(t.MinFreeGB) * bytesPerGB
+}
+
+// ScriptsTargets returns module.scriptsInstallDir (with its
+// scriptsMinFreeGB) followed by the module.scriptsOverflow targets, in the
+// order they should be tried.
+func (c *Config) ScriptsTargets() []ScriptsTarget {
+	targets := []ScriptsTarget{{Dir: c.Module.ScriptsInstallDir, MinFreeGB: c.Module.ScriptsMinFreeGB}}
+
+	return append(targets, c.Module.ScriptsOverflow...)
+}
+
+func (c *Config) validateScriptsTargets() error {
+	if len(c.Module.ScriptsOverflow) > 0 && c.Module.ScriptsInstallDir == "" {
+		return ErrScriptsTarget
+	}
+
+	dirs := make(map[string]bool)
+
+	for _, target := range c.ScriptsTargets() {
+		dir := filepath.Clean(target.Dir)
+
+		if target.MinFreeGB < 0 || (target.Dir == "" && len(c.Module.ScriptsOverflow) > 0) || dirs[dir] {
+			return ErrScriptsTarget
+		}
+
+		dirs[dir] = true
+	}
+
+	return nil
+}
+
+// Externals returns the configured spack.externals with the given names, with
+// their Specs defaulted. Returns ErrUnknownExternal if any aren't configured.
+func (c *Config) Externals(names []string) ([]External, error) {
+	externals := make([]External, 0, len(names))
+
+	for _, name := range names {
+		i := slices.IndexFunc(c.Spack.Externals, func(external External) bool {
+			return external.Name == name
+		})
+		if i == -1 {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownExternal, name)
+		}
+
+		external := c.Spack.Externals[i]
+		if external.Spec == "" {
+			external.Spec = external.Name
+		}
+
+		externals = append(externals, external)
+	}
+
+	return externals, nil
+}
+
+// ParseMode parses an octal permissions string like "0664" in to a FileMode.
+// Returns 0 for a blank string.
+func ParseMode(perms string) (fs.FileMode, error) {
+	if perms == "" {
+		return 0, nil
+	}
+
+	mode, err := strconv.ParseUint(perms, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	if mode > uint64(fs.ModePerm) {
+		return 0, ErrInvalidMode
+	}
+
+	return fs.FileMode(mode), nil
+}
@@ -24,7 +24,10 @@
 package config
 
 import (
+	"io/fs"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/wtsi-hgi/go-softpack-builder/internal/tests"
@@ -45,11 +48,686 @@ func TestConfig(t *testing.T) {
 		So(config.Module.LoadPath, ShouldEqual, "HGI/softpack")
 		So(config.Module.WrapperScript, ShouldEqual, "/path/to/wrapper/script")
 		So(config.Module.Dependencies, ShouldResemble, []string{"/software/modules/ISG/singularity/3.10.0"})
+		So(config.Module.FilePerms, ShouldEqual, "0664")
+		So(config.Module.DirPerms, ShouldEqual, "0775")
+		So(config.Module.Group, ShouldEqual, "root")
+		So(config.Module.SetGID, ShouldBeTrue)
+		So(config.Module.ACL, ShouldResemble, []string{"g:hgi-admins:rwx", "d:g:hgi-admins:rwx"})
+		So(config.Module.UsageLog.SpoolDir, ShouldEqual, "/software/hgi/softpack/usage")
+		So(config.Module.UsageLog.Syslog, ShouldBeTrue)
 		So(config.CustomSpackRepo, ShouldEqual, "https://github.com/org/spack")
 		So(config.Spack.BuildImage, ShouldEqual, "spack/ubuntu-jammy:latest")
 		So(config.Spack.FinalImage, ShouldEqual, "ubuntu:22.04")
 		So(config.Spack.ProcessorTarget, ShouldEqual, "x86_64_v4")
+		So(config.Spack.BaseImages, ShouldResemble, []BaseImage{
+			{Name: "r-tidyverse", Packages: []string{"r", "r-tidyverse"}},
+		})
 		So(config.CoreURL, ShouldEqual, "http://x.y.z:9837/softpack")
 		So(config.ListenURL, ShouldEqual, "localhost:2456")
+		So(config.Server.MaxRequestBytes, ShouldEqual, 65536)
+		So(config.Server.MaxPackages, ShouldEqual, 100)
+		So(config.Server.RateLimit, ShouldEqual, 0.5)
+		So(config.Server.RateBurst, ShouldEqual, 5)
+		So(config.WRRetries, ShouldEqual, 3)
+		So(config.WRDeployments, ShouldResemble, []WRDeployment{
+			{
+				Name:        "gpu-dc",
+				Deployment:  "production",
+				ManagerHost: "gpu-manager.example.com",
+				ManagerPort: 11301,
+				Profiles:    []string{"gpu"},
+			},
+			{
+				Name:         "arm",
+				Deployment:   "production",
+				Arches:       []string{"neoverse_v1"},
+				PathPrefixes: []string{"groups/arm/"},
+			},
+		})
+		So(config.TLS, ShouldResemble, TLS{
+			CertFile:     "/path/to/cert.pem",
+			KeyFile:      "/path/to/key.pem",
+			ClientCAFile: "/path/to/ca.pem",
+		})
+		So(config.TLS.Enabled(), ShouldBeTrue)
+		So(config.Profiles, ShouldResemble, map[string]Profile{
+			"gpu": {
+				BuildImage:  "spack/ubuntu-jammy-cuda:latest",
+				Memory:      "64G",
+				Time:        "12h",
+				CPUs:        8,
+				Singularity: &SingularityBuild{Fakeroot: true},
+			},
+			"bigmem": {Memory: "200G", Disk: 500},
+		})
+		So(config.Singularity, ShouldResemble, &SingularityBuild{Flags: []string{"--disable-cache"}})
+		So(config.Timeouts.S3(), ShouldEqual, 10*time.Minute)
+		So(config.Timeouts.Core(), ShouldEqual, 0)
+		So(config.Timeouts.Build(), ShouldEqual, 4*time.Hour)
+		So(config.Timeouts.Stall(), ShouldEqual, 30*time.Minute)
+		So(config.Timeouts.RetryStalls, ShouldBeTrue)
+		So(config.Replication, ShouldResemble, Replication{
+			BuildBase:       "spack-dr/builds",
+			Profile:         "dr",
+			RetrySeconds:    60,
+			MaxRetrySeconds: 600,
+			Schedule:        Schedule{ThrottleSeconds: 30},
+		})
+		So(config.Replication.Schedule.Enabled(), ShouldBeTrue)
+		So(config.Replication.Schedule.Throttle(), ShouldEqual, 30*time.Second)
+		So(config.Replication.Schedule.Debounce(), ShouldEqual, 0)
+		So(config.Replication.Enabled(), ShouldBeTrue)
+		So(config.Replication.RetryInterval(), ShouldEqual, time.Minute)
+		So(config.Replication.MaxRetryInterval(), ShouldEqual, 10*time.Minute)
+		So(config.CVMFS.Enabled(), ShouldBeTrue)
+		So(config.CVMFS.Repository, ShouldEqual, "softpack.example.org")
+		So(config.CVMFS.PublishDir(), ShouldEqual, "/cvmfs/softpack.example.org/envs")
+		So(config.CVMFS.Command(), ShouldEqual, DefaultCVMFSPublishCommand)
+	})
+
+	Convey("Profiles default to the spack options", t, func() {
+		configData, err := tests.TestData.Open("testdata/config.yml")
+		So(err, ShouldBeNil)
+
+		config, err := Parse(configData)
+		So(err, ShouldBeNil)
+
+		profile, err := config.Profile("")
+		So(err, ShouldBeNil)
+		So(profile, ShouldResemble, Profile{
+			BuildImage:      "spack/ubuntu-jammy:latest",
+			FinalImage:      "ubuntu:22.04",
+			ProcessorTarget: "x86_64_v4",
+			Singularity:     config.Singularity,
+			BuildJobs:       4,
+		})
+		So(profile.Jobs(), ShouldEqual, 4)
+
+		profile, err = config.Profile("gpu")
+		So(err, ShouldBeNil)
+		So(profile, ShouldResemble, Profile{
+			BuildImage:      "spack/ubuntu-jammy-cuda:latest",
+			FinalImage:      "ubuntu:22.04",
+			ProcessorTarget: "x86_64_v4",
+			Memory:          "64G",
+			Time:            "12h",
+			CPUs:            8,
+			Singularity:     &SingularityBuild{Fakeroot: true},
+		})
+		So(profile.Jobs(), ShouldEqual, 8)
+
+		profile.BuildJobs = 16
+		So(profile.Jobs(), ShouldEqual, 16)
+
+		_, err = config.Profile("legacy-os")
+		So(err, ShouldEqual, ErrUnknownProfile)
+
+		Convey("and can have their processor target overridden from an allowlist", func() {
+			So(config.Spack.ProcessorTargets, ShouldResemble, []string{"x86_64_v3", "x86_64_v4", "neoverse_v1"})
+
+			profile, err = config.BuildProfile("gpu", "")
+			So(err, ShouldBeNil)
+			So(profile.ProcessorTarget, ShouldEqual, "x86_64_v4")
+
+			profile, err = config.BuildProfile("gpu", "x86_64_v3")
+			So(err, ShouldBeNil)
+			So(profile.ProcessorTarget, ShouldEqual, "x86_64_v3")
+			So(profile.BuildImage, ShouldEqual, "spack/ubuntu-jammy-cuda:latest")
+
+			_, err = config.BuildProfile("", "zen4")
+			So(err, ShouldEqual, ErrUnknownTarget)
+
+			_, err = config.BuildProfile("legacy-os", "x86_64_v3")
+			So(err, ShouldEqual, ErrUnknownProfile)
+
+			config.Spack.ProcessorTargets = nil
+
+			profile, err = config.BuildProfile("", "x86_64_v4")
+			So(err, ShouldBeNil)
+			So(profile.ProcessorTarget, ShouldEqual, "x86_64_v4")
+		})
+	})
+
+	Convey("Builds are routed to wr deployments by profile, arch or path", t, func() {
+		configData, err := tests.TestData.Open("testdata/config.yml")
+		So(err, ShouldBeNil)
+
+		config, err := Parse(configData)
+		So(err, ShouldBeNil)
+
+		So(config.WRDeploymentFor("", "", "users/foo/env"), ShouldEqual, DefaultWRDeployment)
+		So(config.WRDeploymentFor("bigmem", "", "users/foo/env"), ShouldEqual, DefaultWRDeployment)
+		So(config.WRDeploymentFor("gpu", "", "users/foo/env"), ShouldEqual, "gpu-dc")
+		So(config.WRDeploymentFor("gpu", "", "groups/arm/env"), ShouldEqual, "gpu-dc")
+		So(config.WRDeploymentFor("", "", "groups/arm/env"), ShouldEqual, "arm")
+
+		config.Profiles["arm"] = Profile{ProcessorTarget: "neoverse_v1"}
+		So(config.WRDeploymentFor("arm", "", "users/foo/env"), ShouldEqual, "arm")
+		So(config.WRDeploymentFor("", "neoverse_v1", "users/foo/env"), ShouldEqual, "arm")
+
+		for _, yml := range []string{
+			"wrDeployments:\n  - deployment: production\n",
+			"wrDeployments:\n  - name: default\n",
+			"wrDeployments:\n  - name: a\n  - name: a\n",
+		} {
+			_, err = Parse(strings.NewReader(yml))
+			So(err, ShouldEqual, ErrWRDeploymentName)
+		}
+	})
+
+	Convey("Spack mirrors are validated", t, func() {
+		config, err := Parse(strings.NewReader("spack:\n  mirrors:\n" +
+			"    - name: source\n      url: https://mirror.example.org/spack\n      type: source\n" +
+			"    - name: upstream\n      url: https://binaries.spack.io/v0.21.0\n      trustKeys: true\n"))
+		So(err, ShouldBeNil)
+		So(config.Spack.Mirrors, ShouldResemble, []Mirror{
+			{Name: "source", URL: "https://mirror.example.org/spack", Type: "source"},
+			{Name: "upstream", URL: "https://binaries.spack.io/v0.21.0", TrustKeys: true},
+		})
+
+		for _, mirror := range []string{
+			"name: s3cache\n      url: s3://cache",
+			"name: a\n      url: x\n    - name: a\n      url: y",
+			"name: a b\n      url: x",
+			"name: a\n",
+			"url: x",
+			"name: a\n      url: x\n      type: both",
+		} {
+			_, err = Parse(strings.NewReader("spack:\n  mirrors:\n    - " + mirror + "\n"))
+			So(err, ShouldEqual, ErrMirror)
+		}
+	})
+
+	Convey("A status webhook needs a coreURL", t, func() {
+		_, err := Parse(strings.NewReader("statusWebhook:\n  endpoint: /build-status\n"))
+		So(err, ShouldEqual, ErrStatusWebhook)
+
+		config, err := Parse(strings.NewReader("coreURL: http://core/\nstatusWebhook:\n  endpoint: /build-status\n"))
+		So(err, ShouldBeNil)
+		So(config.StatusWebhook.Enabled(), ShouldBeTrue)
+		So(config.StatusWebhook.RetryInterval(), ShouldEqual, 30*time.Second)
+		So(config.StatusWebhook.MaxRetryInterval(), ShouldEqual, 10*time.Minute)
+
+		config.StatusWebhook.MaxRetrySeconds = 60
+		So(config.StatusWebhook.MaxRetryInterval(), ShouldEqual, time.Minute)
+	})
+
+	Convey("Module conflicts and prereqs must be module names", t, func() {
+		config, err := Parse(strings.NewReader("module:\n  conflicts:\n    - openmpi\n" +
+			"  prereqs:\n    - mpi/openmpi-4.1+cuda@1\n"))
+		So(err, ShouldBeNil)
+		So(config.Module.Conflicts, ShouldResemble, []string{"openmpi"})
+		So(config.Module.Prereqs, ShouldResemble, []string{"mpi/openmpi-4.1+cuda@1"})
+
+		for _, name := range []string{`"a b"`, `"a;b"`, `"a\nb"`, `"[a]"`} {
+			_, err = Parse(strings.NewReader("module:\n  prereqs:\n    - " + name + "\n"))
+			So(err, ShouldEqual, ErrModuleName)
+		}
+	})
+
+	Convey("The module default version style is validated", t, func() {
+		for _, style := range []string{DefaultVersionTcl, DefaultVersionLmod} {
+			config, err := Parse(strings.NewReader("module:\n  defaultVersion: " + style + "\n"))
+			So(err, ShouldBeNil)
+			So(config.Module.DefaultVersion, ShouldEqual, style)
+		}
+
+		_, err := Parse(strings.NewReader("module:\n  defaultVersion: latest\n"))
+		So(err, ShouldEqual, ErrDefaultVersion)
+	})
+
+	Convey("Builds can be limited to using xvfb when they include certain packages", t, func() {
+		config, err := Parse(strings.NewReader("spack:\n  processorTarget: x86_64_v3\n"))
+		So(err, ShouldBeNil)
+		So(config.NeedsXvfb("xxhash"), ShouldBeTrue)
+
+		config, err = Parse(strings.NewReader("spack:\n  xvfbPackages:\n    - r-rgl\n    - py-pyqt*\n"))
+		So(err, ShouldBeNil)
+		So(config.NeedsXvfb("xxhash"), ShouldBeFalse)
+		So(config.NeedsXvfb(), ShouldBeFalse)
+		So(config.NeedsXvfb("xxhash", "r-rgl"), ShouldBeTrue)
+		So(config.NeedsXvfb("py-pyqt5"), ShouldBeTrue)
+
+		for _, pkgs := range []string{"    - r-rgl\n    - r-rgl\n", "    - r-rgl@1\n", "    - \"[\"\n"} {
+			_, err = Parse(strings.NewReader("spack:\n  xvfbPackages:\n" + pkgs))
+			So(err, ShouldEqual, ErrXvfbPackage)
+		}
+	})
+
+	Convey("The R_LIBS strategy must be a known one", t, func() {
+		for _, strategy := range []string{RLibsSymlink, RLibsEnvFile, RLibsNone} {
+			config, err := Parse(strings.NewReader("spack:\n  rLibsStrategy: " + strategy + "\n"))
+			So(err, ShouldBeNil)
+			So(config.Spack.RLibsStrategy, ShouldEqual, strategy)
+		}
+
+		_, err := Parse(strings.NewReader("spack:\n  rLibsStrategy: shorten\n"))
+		So(err, ShouldEqual, ErrRLibsStrategy)
+	})
+
+	Convey("Quotas are validated, and can be looked up by account", t, func() {
+		config, err := Parse(strings.NewReader("quotas:\n" +
+			"  user:\n    buildsPerDay: 10\n    concurrentBuilds: 2\n" +
+			"  group:\n    imageGB: 500\n" +
+			"  overrides:\n    users/foo:\n      buildsPerDay: 20\n"))
+		So(err, ShouldBeNil)
+		So(config.Quotas.Enabled(), ShouldBeTrue)
+		So(config.Quotas.For("users/bar"), ShouldResemble, Quota{BuildsPerDay: 10, ConcurrentBuilds: 2})
+		So(config.Quotas.For("users/foo"), ShouldResemble, Quota{BuildsPerDay: 20})
+		So(config.Quotas.For("groups/hgi"), ShouldResemble, Quota{ImageGB: 500})
+
+		config, err = Parse(strings.NewReader("coreURL: http://core\n"))
+		So(err, ShouldBeNil)
+		So(config.Quotas.Enabled(), ShouldBeFalse)
+
+		for _, quotas := range []string{
+			"  user:\n    buildsPerDay: -1\n",
+			"  overrides:\n    groups/hgi:\n      imageGB: -1\n",
+			"  overrides:\n    foo:\n      buildsPerDay: 1\n",
+		} {
+			_, err = Parse(strings.NewReader("quotas:\n" + quotas))
+			So(err, ShouldEqual, ErrQuota)
+		}
+	})
+
+	Convey("wr limit groups can be configured per profile and processor target", t, func() {
+		config, err := Parse(strings.NewReader("profiles:\n  gpu:\n    limitGroups: [gpu:2]\n" +
+			"wrLimitGroups:\n  neoverse_v1: [arm, gpu:2]\n"))
+		So(err, ShouldBeNil)
+
+		profile, err := config.Profile("")
+		So(err, ShouldBeNil)
+		So(config.LimitGroups(profile), ShouldResemble, []string{DefaultLimitGroup})
+
+		profile, err = config.Profile("gpu")
+		So(err, ShouldBeNil)
+		So(config.LimitGroups(profile), ShouldResemble, []string{"gpu:2"})
+
+		profile.ProcessorTarget = "neoverse_v1"
+		So(config.LimitGroups(profile), ShouldResemble, []string{"gpu:2", "arm"})
+		So(config.Profiles["gpu"].LimitGroups, ShouldResemble, []string{"gpu:2"})
+
+		for _, yml := range []string{
+			"profiles:\n  gpu:\n    limitGroups: [\"\"]\n",
+			"profiles:\n  gpu:\n    limitGroups: [gpu:x]\n",
+			"wrLimitGroups:\n  x86_64_v4: [\"a b\"]\n",
+			"wrLimitGroups:\n  x86_64_v4: [\"a\\\"\"]\n",
+		} {
+			_, err = Parse(strings.NewReader(yml))
+			So(err, ShouldEqual, ErrLimitGroup)
+		}
+	})
+
+	Convey("Templates are validated", t, func() {
+		config, err := Parse(strings.NewReader("profiles:\n  gpu:\n    cpus: 8\n" +
+			"templates:\n" +
+			"  - name: single-cell-r\n    description: R for single cell\n" +
+			"    packages:\n      - r-seurat@4\n      - r-signac\n" +
+			"  - name: cuda\n    packages:\n      - cuda\n    profile: gpu\n"))
+		So(err, ShouldBeNil)
+
+		So(config.Templates, ShouldResemble, []Template{
+			{Name: "single-cell-r", Description: "R for single cell", Packages: []string{"r-seurat@4", "r-signac"}},
+			{Name: "cuda", Packages: []string{"cuda"}, Profile: "gpu"},
+		})
+
+		for _, template := range []string{
+			"name: a\n    packages: [x]\n  - name: a\n    packages: [y]",
+			"name: a\n",
+			"packages: [x]",
+			"name: a\n    packages: [x]\n    profile: unknown",
+		} {
+			_, err = Parse(strings.NewReader("templates:\n  - " + template + "\n"))
+			So(err, ShouldEqual, ErrTemplate)
+		}
+	})
+
+	Convey("Base images need a local images dir, and unique plain names with packages", t, func() {
+		config, err := Parse(strings.NewReader("images:\n  localDir: /images\nspack:\n  baseImages:\n" +
+			"    - name: r\n      packages: [r, r-tidyverse]\n"))
+		So(err, ShouldBeNil)
+		So(config.Spack.BaseImages, ShouldResemble, []BaseImage{{Name: "r", Packages: []string{"r", "r-tidyverse"}}})
+
+		_, err = Parse(strings.NewReader("spack:\n  baseImages:\n    - name: r\n      packages: [r]\n"))
+		So(err, ShouldEqual, ErrBaseImage)
+
+		for _, base := range []string{
+			"name: r\n      packages: [r]\n    - name: r\n      packages: [python]",
+			"name: r\n",
+			"packages: [r]",
+			"name: ../r\n      packages: [r]",
+		} {
+			_, err = Parse(strings.NewReader("images:\n  localDir: /images\nspack:\n  baseImages:\n    - " + base + "\n"))
+			So(err, ShouldEqual, ErrBaseImage)
+		}
+	})
+
+	Convey("Upgrades need core and a versions file", t, func() {
+		config, err := Parse(strings.NewReader("coreURL: http://core\nspack:\n  versionsFile: /v.json\n" +
+			"upgrades:\n  intervalHours: 24\n  notify:\n    command: notify.sh\n"))
+		So(err, ShouldBeNil)
+		So(config.Upgrades.Enabled(), ShouldBeTrue)
+		So(config.Upgrades.Interval(), ShouldEqual, 24*time.Hour)
+		So(config.Upgrades.Notify.Command, ShouldEqual, "notify.sh")
+
+		for _, yml := range []string{
+			"upgrades:\n  intervalHours: 24\nspack:\n  versionsFile: /v.json\n",
+			"upgrades:\n  intervalHours: 24\ncoreURL: http://core\n",
+		} {
+			_, err = Parse(strings.NewReader(yml))
+			So(err, ShouldEqual, ErrUpgrades)
+		}
+
+		config, err = Parse(strings.NewReader("coreURL: http://core\n"))
+		So(err, ShouldBeNil)
+		So(config.Upgrades.Enabled(), ShouldBeFalse)
+	})
+
+	Convey("Upgrades can be scheduled with a cron expression instead of an interval", t, func() {
+		config, err := Parse(strings.NewReader("coreURL: http://core\nspack:\n  versionsFile: /v.json\n" +
+			"upgrades:\n  schedule:\n    cron: \"0 3 * * 1\"\n"))
+		So(err, ShouldBeNil)
+		So(config.Upgrades.Enabled(), ShouldBeTrue)
+		So(config.Upgrades.Schedule.Cron, ShouldEqual, "0 3 * * 1")
+	})
+
+	Convey("Schedules can't both debounce and throttle, or be negative", t, func() {
+		for _, yml := range []string{
+			"replication:\n  buildBase: dr\n  schedule:\n    debounceSeconds: 1\n    throttleSeconds: 1\n",
+			"replication:\n  buildBase: dr\n  schedule:\n    debounceSeconds: -1\n",
+			"images:\n  schedule:\n    throttleSeconds: -1\n",
+		} {
+			_, err := Parse(strings.NewReader(yml))
+			So(err, ShouldEqual, ErrSchedule)
+		}
+
+		config, err := Parse(strings.NewReader("images:\n  localDir: /images\n  schedule:\n    cron: \"0 2 * * *\"\n"))
+		So(err, ShouldBeNil)
+		So(config.Images.Schedule, ShouldResemble, Schedule{Cron: "0 2 * * *"})
+		So(config.Images.Schedule.Enabled(), ShouldBeTrue)
+	})
+
+	Convey("Extra artefacts need unique plain file names and paths", t, func() {
+		config, err := Parse(strings.NewReader("artefacts:\n  extra:\n    - name: LICENSE\n      path: /l\n" +
+			"  suppress:\n    - builder.out\n"))
+		So(err, ShouldBeNil)
+		So(config.Artefacts.Extra, ShouldResemble, []ExtraArtefact{{Name: "LICENSE", Path: "/l"}})
+		So(config.Artefacts.Suppress, ShouldResemble, []string{"builder.out"})
+
+		for _, extra := range []string{
+			"    - name: a/b\n      path: /l\n",
+			"    - name: .hidden\n      path: /l\n",
+			"    - name: LICENSE\n",
+			"    - name: LICENSE\n      path: /l\n    - name: LICENSE\n      path: /m\n",
+		} {
+			_, err = Parse(strings.NewReader("artefacts:\n  extra:\n" + extra))
+			So(err, ShouldEqual, ErrArtefact)
+		}
+
+		So(config.Artefacts.Upload.Chunked(), ShouldBeFalse)
+		So(config.Artefacts.Upload.MaxParallel(), ShouldEqual, 2)
+		So(config.Artefacts.Upload.MaxRetries(), ShouldEqual, 3)
+
+		config, err = Parse(strings.NewReader("artefacts:\n  upload:\n    chunkSizeMB: 8\n    parallelism: 4\n" +
+			"    retries: 5\n"))
+		So(err, ShouldBeNil)
+		So(config.Artefacts.Upload.Chunked(), ShouldBeTrue)
+		So(config.Artefacts.Upload.ChunkSize(), ShouldEqual, 8<<20)
+		So(config.Artefacts.Upload.MaxParallel(), ShouldEqual, 4)
+		So(config.Artefacts.Upload.MaxRetries(), ShouldEqual, 5)
+
+		_, err = Parse(strings.NewReader("artefacts:\n  upload:\n    retries: -1\n"))
+		So(err, ShouldEqual, ErrArtefactUpload)
+
+		_, err = Parse(strings.NewReader("timeouts:\n  stallMinutes: -1\n"))
+		So(err, ShouldEqual, ErrBuildTimeout)
+
+		So(IsPlainFileName("LICENSE"), ShouldBeTrue)
+		So(IsPlainFileName(""), ShouldBeFalse)
+		So(IsPlainFileName(`a\b`), ShouldBeFalse)
+	})
+
+	Convey("Default packages need unique, valid names", t, func() {
+		config, err := Parse(strings.NewReader("spack:\n  defaultPackages:\n    - ca-certificates-mozilla\n" +
+			"    - site-profile@1.0\n"))
+		So(err, ShouldBeNil)
+		So(config.Spack.DefaultPackages, ShouldResemble, []string{"ca-certificates-mozilla", "site-profile@1.0"})
+
+		for _, pkgs := range []string{
+			"    - \"@1.0\"\n",
+			"    - a b\n",
+			"    - \"x$(touch /tmp/pwned)\"\n",
+			"    - \"site-profile@1.0;reboot\"\n",
+			"    - site-profile@1.0\n    - site-profile@2.0\n",
+		} {
+			_, err = Parse(strings.NewReader("spack:\n  defaultPackages:\n" + pkgs))
+			So(err, ShouldEqual, ErrDefaultPackage)
+		}
+	})
+
+	Convey("Broken packages are validated, and have a default refresh interval", t, func() {
+		config, err := Parse(strings.NewReader("brokenPackages:\n  url: http://denylist\n  packages:\n" +
+			"    - spec: r-seurat@5.0.*\n      reason: use 4.4\n    - spec: xxhash\n"))
+		So(err, ShouldBeNil)
+		So(config.Broken.URL, ShouldEqual, "http://denylist")
+		So(config.Broken.RefreshInterval(), ShouldEqual, time.Hour)
+		So(config.Broken.Packages, ShouldResemble, []BrokenPackage{
+			{Spec: "r-seurat@5.0.*", Reason: "use 4.4"}, {Spec: "xxhash"},
+		})
+
+		name, version := config.Broken.Packages[0].NameAndVersion()
+		So(name, ShouldEqual, "r-seurat")
+		So(version, ShouldEqual, "5.0.*")
+
+		config, err = Parse(strings.NewReader("brokenPackages:\n  refreshMinutes: 5\n"))
+		So(err, ShouldBeNil)
+		So(config.Broken.RefreshInterval(), ShouldEqual, 5*time.Minute)
+
+		for _, yml := range []string{
+			"brokenPackages:\n  refreshMinutes: -1\n",
+			"brokenPackages:\n  packages:\n    - spec: \"@1.0\"\n",
+			"brokenPackages:\n  packages:\n    - spec: a@[1\n",
+			"brokenPackages:\n  packages:\n    - spec: a@1\n    - spec: a@1\n",
+		} {
+			_, err = Parse(strings.NewReader(yml))
+			So(err, ShouldEqual, ErrBrokenPackage)
+		}
+	})
+
+	Convey("Teams are validated, and have a default refresh interval", t, func() {
+		config, err := Parse(strings.NewReader("teams:\n  url: http://teams/\n  contacts:\n" +
+			"    hgi:\n      - foo\n      - hgi@example.com\n"))
+		So(err, ShouldBeNil)
+		So(config.Teams.Contacts, ShouldResemble, map[string][]string{"hgi": {"foo", "hgi@example.com"}})
+		So(config.Teams.RefreshInterval(), ShouldEqual, time.Hour)
+
+		for _, yml := range []string{
+			"teams:\n  refreshMinutes: -1\n",
+			"teams:\n  contacts:\n    a/b:\n      - foo\n",
+			"teams:\n  contacts:\n    hgi:\n      - \"\"\n",
+			"teams:\n  contacts:\n    hgi:\n      - foo,bar\n",
+			"teams:\n  contacts:\n    hgi:\n      - foo bar\n",
+		} {
+			_, err = Parse(strings.NewReader(yml))
+			So(err, ShouldEqual, ErrTeams)
+		}
+	})
+
+	Convey("Trash is optional, and has a default retention", t, func() {
+		config, err := Parse(strings.NewReader("trash:\n  retentionDays: 7\n"))
+		So(err, ShouldBeNil)
+		So(config.Trash.Enabled(), ShouldBeFalse)
+
+		config, err = Parse(strings.NewReader("trash:\n  dir: /trash\n"))
+		So(err, ShouldBeNil)
+		So(config.Trash.Enabled(), ShouldBeTrue)
+		So(config.Trash.Retention(), ShouldEqual, 30*24*time.Hour)
+
+		config, err = Parse(strings.NewReader("trash:\n  dir: /trash\n  retentionDays: 7\n"))
+		So(err, ShouldBeNil)
+		So(config.Trash.Retention(), ShouldEqual, 7*24*time.Hour)
+
+		_, err = Parse(strings.NewReader("trash:\n  retentionDays: -1\n"))
+		So(err, ShouldEqual, ErrTrash)
+	})
+
+	Convey("Scripts install targets are validated", t, func() {
+		config, err := Parse(strings.NewReader("module:\n  scriptsInstallDir: /s\n  scriptsMinFreeGB: 10\n" +
+			"  scriptsOverflow:\n    - dir: /o\n      minFreeGB: 5\n"))
+		So(err, ShouldBeNil)
+		So(config.ScriptsTargets(), ShouldResemble, []ScriptsTarget{{Dir: "/s", MinFreeGB: 10}, {Dir: "/o", MinFreeGB: 5}})
+		So(config.ScriptsTargets()[1].MinFreeBytes(), ShouldEqual, 5<<30)
+
+		for _, yml := range []string{
+			"module:\n  scriptsOverflow:\n    - dir: /o\n",
+			"module:\n  scriptsInstallDir: /s\n  scriptsOverflow:\n    - dir: /s/\n",
+			"module:\n  scriptsInstallDir: /s\n  scriptsOverflow:\n    - minFreeGB: 1\n",
+			"module:\n  scriptsInstallDir: /s\n  scriptsMinFreeGB: -1\n",
+		} {
+			_, err = Parse(strings.NewReader(yml))
+			So(err, ShouldEqual, ErrScriptsTarget)
+		}
+	})
+
+	Convey("Hooks are validated, and have default timeouts", t, func() {
+		config, err := Parse(strings.NewReader("hooks:\n" +
+			"  - name: reindex\n    command: spack buildcache update-index\n" +
+			"  - name: scan\n    command: scan.sh\n    timeoutSeconds: 600\n" +
+			"  - name: notify\n    command: notify.sh\n    timeoutSeconds: -1\n"))
+		So(err, ShouldBeNil)
+		So(len(config.Hooks), ShouldEqual, 3)
+		So(config.Hooks[0].Name, ShouldEqual, "reindex")
+		So(config.Hooks[0].Timeout(), ShouldEqual, time.Minute)
+		So(config.Hooks[1].Timeout(), ShouldEqual, 10*time.Minute)
+		So(config.Hooks[2].Timeout(), ShouldEqual, 0)
+
+		for _, hook := range []string{
+			"name: a\n    command: x\n  - name: a\n    command: y",
+			"name: a\n",
+			"command: x",
+		} {
+			_, err = Parse(strings.NewReader("hooks:\n  - " + hook + "\n"))
+			So(err, ShouldEqual, ErrHook)
+
+			_, err = Parse(strings.NewReader("preBuildHooks:\n  - " + hook + "\n"))
+			So(err, ShouldEqual, ErrHook)
+		}
+
+		config, err = Parse(strings.NewReader("preBuildHooks:\n  - name: reindex\n    command: policy.sh\n"))
+		So(err, ShouldBeNil)
+		So(len(config.PreBuildHooks), ShouldEqual, 1)
+	})
+
+	Convey("Spack externals are validated, and can be looked up by name", t, func() {
+		config, err := Parse(strings.NewReader("spack:\n  externals:\n" +
+			"    - name: slurm\n      spec: slurm@23.02.6\n      prefix: /usr\n" +
+			"    - name: cuda\n      prefix: /usr/local/cuda\n"))
+		So(err, ShouldBeNil)
+
+		externals, err := config.Externals([]string{"cuda", "slurm"})
+		So(err, ShouldBeNil)
+		So(externals, ShouldResemble, []External{
+			{Name: "cuda", Spec: "cuda", Prefix: "/usr/local/cuda"},
+			{Name: "slurm", Spec: "slurm@23.02.6", Prefix: "/usr"},
+		})
+
+		externals, err = config.Externals(nil)
+		So(err, ShouldBeNil)
+		So(externals, ShouldBeEmpty)
+
+		_, err = config.Externals([]string{"slurm", "lsf"})
+		So(err, ShouldWrap, ErrUnknownExternal)
+
+		for _, external := range []string{
+			"name: a\n      prefix: /x\n    - name: a\n      prefix: /y",
+			"name: a\n",
+			"prefix: /x",
+		} {
+			_, err = Parse(strings.NewReader("spack:\n  externals:\n    - " + external + "\n"))
+			So(err, ShouldEqual, ErrExternal)
+		}
+	})
+
+	Convey("Air-gapped builds need offline sources of everything", t, func() {
+		const (
+			airGapped = "airGapped:\n  enabled: true\n"
+			images    = "images:\n  registry: mirror.example.org\n"
+			mirrors   = "spack:\n  mirrors:\n    - name: sources\n      url: s3://spack-sources\n" +
+				"      type: source\n"
+			repo = "customSpackRepo: https://github.com/org/spack\n"
+		)
+
+		for yml, expectedErr := range map[string]error{
+			airGapped:                           ErrAirGappedImages,
+			airGapped + images:                  ErrAirGappedMirror,
+			airGapped + images + repo + mirrors: ErrAirGappedRepo,
+			airGapped + images + strings.ReplaceAll(mirrors, "source\n", "binary\n"): ErrAirGappedMirror,
+		} {
+			_, err := Parse(strings.NewReader(yml))
+			So(err, ShouldEqual, expectedErr)
+		}
+
+		config, err := Parse(strings.NewReader(airGapped + "  repoTarball: /path/to/repo.tar.gz\n" +
+			images + repo + mirrors))
+		So(err, ShouldBeNil)
+		So(config.AirGapped, ShouldResemble, AirGapped{Enabled: true, RepoTarball: "/path/to/repo.tar.gz"})
+
+		_, err = Parse(strings.NewReader(repo + mirrors))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Timeouts have defaults", t, func() {
+		config, err := Parse(strings.NewReader("coreURL: \"http://x.y.z\"\n"))
+		So(err, ShouldBeNil)
+		So(config.Timeouts.S3(), ShouldEqual, time.Hour)
+		So(config.Timeouts.Core(), ShouldEqual, 5*time.Minute)
+		So(config.Timeouts.Build(), ShouldEqual, 0)
+		So(config.Timeouts.Stall(), ShouldEqual, 0)
+		So(config.Replication.Enabled(), ShouldBeFalse)
+		So(config.Replication.RetryInterval(), ShouldEqual, 5*time.Minute)
+		So(config.Replication.MaxRetryInterval(), ShouldEqual, time.Hour)
+		So(config.CVMFS.Enabled(), ShouldBeFalse)
+
+		config.CVMFS = CVMFS{Repository: "repo.example.org", PublishCommand: "publish.sh"}
+		So(config.CVMFS.PublishDir(), ShouldEqual, "/cvmfs/repo.example.org")
+		So(config.CVMFS.Command(), ShouldEqual, "publish.sh")
+	})
+
+	Convey("Invalid TLS options are rejected", t, func() {
+		for yml, expected := range map[string]error{
+			"tls:\n  certFile: a\n": ErrTLSCertKey,
+			"tls:\n  keyFile: a\n":  ErrTLSCertKey,
+			"tls:\n  certFile: a\n  keyFile: b\n  autocertHosts: [c]\n": ErrTLSCertAndAutocert,
+			"tls:\n  clientCAFile: a\n":                                 ErrTLSClientCA,
+			"tls:\n  autocertHosts: [c]\n  clientCAFile: a\n":           ErrTLSClientCAAuto,
+		} {
+			_, err := Parse(strings.NewReader(yml))
+			So(err, ShouldEqual, expected)
+		}
+
+		config, err := Parse(strings.NewReader("tls:\n  autocertHosts: [a.example.com]\n"))
+		So(err, ShouldBeNil)
+		So(config.TLS.Enabled(), ShouldBeTrue)
+	})
+
+	Convey("Invalid permissions are rejected", t, func() {
+		for _, perms := range [...]string{"abc", "0999", "1777"} {
+			_, err := Parse(strings.NewReader("module:\n  dirPerms: \"" + perms + "\"\n"))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "invalid module.dirPerms")
+		}
+	})
+
+	Convey("ParseMode parses octal permissions", t, func() {
+		mode, err := ParseMode("0664")
+		So(err, ShouldBeNil)
+		So(mode, ShouldEqual, fs.FileMode(0664))
+
+		mode, err = ParseMode("")
+		So(err, ShouldBeNil)
+		So(mode, ShouldEqual, 0)
+
+		_, err = ParseMode("1777")
+		So(err, ShouldEqual, ErrInvalidMode)
 	})
 }
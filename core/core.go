@@ -30,7 +30,9 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/wtsi-hgi/go-softpack-builder/config"
@@ -42,6 +44,8 @@ const (
 	ExesBasename           = "executables"
 	SoftpackYaml           = "softpack.yml"
 	SpackLockFile          = "spack.lock"
+	SpackYAMLBasename      = "spack.yaml"
+	ProvenanceBasename     = "provenance.json"
 	BuilderOut             = "builder.out"
 	ModuleForCoreBasename  = "module"
 	UsageBasename          = "README.md"
@@ -52,6 +56,10 @@ const (
 	resendEndpoint = "/resend-pending-builds"
 	createEndpoint = "/create-environment"
 	deleteEndpoint = "/delete-environment"
+	renameEndpoint = "/rename-environment"
+
+	uploadChunkEndpoint    = "/upload-chunk"
+	uploadManifestEndpoint = "/upload-manifest"
 )
 
 // EnvironmentResponse is the kind of return value we get from the core.
@@ -62,17 +70,20 @@ type EnvironmentResponse struct {
 
 // Core is used to interact with a real softpack-core service.
 type Core struct {
-	url string
+	url    string
+	client *http.Client
 }
 
 // New creates a new Core struct, to contact the core via its configured URL.
+// Requests to core will time out after the configured core timeout.
 func New(conf *config.Config) (*Core, error) {
 	if conf == nil || conf.CoreURL == "" {
 		return nil, internal.Error(ErrNoCoreURL)
 	}
 
 	return &Core{
-		url: strings.TrimSuffix(conf.CoreURL, "/"),
+		url:    strings.TrimSuffix(conf.CoreURL, "/"),
+		client: &http.Client{Timeout: conf.Timeouts.Core()},
 	}, nil
 }
 
@@ -84,9 +95,9 @@ func toJSON(thing any) io.Reader {
 	return &buf
 }
 
-func (c *Core) doCoreRequest(endpoint string, content io.Reader) (*http.Response, error) {
+func (c *Core) doCoreRequest(ctx context.Context, endpoint string, content io.Reader) (*http.Response, error) {
 	req, err := http.NewRequestWithContext(
-		context.Background(),
+		ctx,
 		http.MethodPost,
 		c.url+endpoint,
 		content,
@@ -97,7 +108,7 @@ func (c *Core) doCoreRequest(endpoint string, content io.Reader) (*http.Response
 
 	req.Header.Add("Content-Type", "application/json")
 
-	return http.DefaultClient.Do(req)
+	return c.client.Do(req)
 }
 
 // ResendResponse is the response that the core service sends when a resend
@@ -116,12 +127,14 @@ func (rr *ResendResponse) FullSuccess() bool {
 // ResendPendingBuilds posts to core's resend-pending-builds endpoint and
 // returns an error if the post failed, or core did not respond with a full
 // success.
-func (c *Core) ResendPendingBuilds() error {
-	resp, err := c.doCoreRequest(resendEndpoint, strings.NewReader(""))
+func (c *Core) ResendPendingBuilds(ctx context.Context) error {
+	resp, err := c.doCoreRequest(ctx, resendEndpoint, strings.NewReader(""))
 	if err != nil {
 		return err
 	}
 
+	defer resp.Body.Close()
+
 	var rr ResendResponse
 
 	err = json.NewDecoder(resp.Body).Decode(&rr)
@@ -144,8 +157,8 @@ type environmentInput struct {
 }
 
 // Create contacts the core to schedule an environment build.
-func (c *Core) Create(path, desc string, pkgs Packages) error {
-	return handleResponse(c.doCoreRequest(createEndpoint, toJSON(environmentInput{
+func (c *Core) Create(ctx context.Context, path, desc string, pkgs Packages) error {
+	return handleResponse(c.doCoreRequest(ctx, createEndpoint, toJSON(environmentInput{
 		Name:        filepath.Base(path),
 		Path:        filepath.Dir(path),
 		Description: desc,
@@ -179,9 +192,121 @@ type deleteEnvironmentInput struct {
 }
 
 // Delete contacts the core to delete an environment.
-func (c *Core) Delete(path string) error {
-	return handleResponse(c.doCoreRequest(deleteEndpoint, toJSON(deleteEnvironmentInput{
+func (c *Core) Delete(ctx context.Context, path string) error {
+	return handleResponse(c.doCoreRequest(ctx, deleteEndpoint, toJSON(deleteEnvironmentInput{
 		Name: filepath.Base(path),
 		Path: filepath.Dir(path),
 	})))
 }
+
+type renameEnvironmentInput struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	NewName string `json:"newName"`
+	NewPath string `json:"newPath"`
+}
+
+// Rename contacts the core to say that the environment at the given path (eg.
+// "users/foo/env-1") has been moved to newPath.
+func (c *Core) Rename(ctx context.Context, path, newPath string) error {
+	return handleResponse(c.doCoreRequest(ctx, renameEndpoint, toJSON(renameEnvironmentInput{
+		Name:    filepath.Base(path),
+		Path:    filepath.Dir(path),
+		NewName: filepath.Base(newPath),
+		NewPath: filepath.Dir(newPath),
+	})))
+}
+
+// UploadManifest is sent to core after all of an environment's artefacts have
+// been uploaded in chunks, so it can confirm it has all of them intact.
+type UploadManifest struct {
+	Files []UploadedFile `json:"files"`
+}
+
+// UploadedFile describes an artefact uploaded in chunks.
+type UploadedFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// uploadedSize is the response core gives when asked how much of an artefact
+// it has.
+type uploadedSize struct {
+	Size int64 `json:"size"`
+}
+
+func uploadQuery(envPath, name string) url.Values {
+	return url.Values{"envPath": {envPath}, "name": {name}}
+}
+
+// doUploadRequest makes a request with the given method and query to one of
+// core's upload endpoints, returning the response body, or an error containing
+// it if core didn't respond OK.
+func (c *Core) doUploadRequest(ctx context.Context, method, endpoint string, query url.Values,
+	body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url+endpoint+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, internal.Error(string(data))
+	}
+
+	return data, nil
+}
+
+// PutChunk sends a chunk of the named artefact of the environment at the given
+// path to core, which discards anything it had for the artefact beyond offset
+// before storing the chunk.
+func (c *Core) PutChunk(ctx context.Context, envPath, name string, offset int64, chunk []byte) error {
+	query := uploadQuery(envPath, name)
+	query.Set("offset", strconv.FormatInt(offset, 10))
+
+	_, err := c.doUploadRequest(ctx, http.MethodPut, uploadChunkEndpoint, query, bytes.NewReader(chunk))
+
+	return err
+}
+
+// UploadedSize asks core how many bytes of the named artefact of the
+// environment at the given path it has.
+func (c *Core) UploadedSize(ctx context.Context, envPath, name string) (int64, error) {
+	data, err := c.doUploadRequest(ctx, http.MethodGet, uploadChunkEndpoint, uploadQuery(envPath, name), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var size uploadedSize
+
+	err = json.Unmarshal(data, &size)
+
+	return size.Size, err
+}
+
+// ConfirmUpload sends core the manifest of the environment's artefacts that
+// were uploaded with PutChunk(), which it checks against what it received
+// before adding them to the environment.
+func (c *Core) ConfirmUpload(ctx context.Context, envPath string, files []UploadedFile) error {
+	data, err := json.Marshal(UploadManifest{Files: files})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.doUploadRequest(ctx, http.MethodPost, uploadManifestEndpoint, url.Values{"envPath": {envPath}},
+		bytes.NewReader(data))
+
+	return err
+}
@@ -24,15 +24,80 @@
 package core
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/coremock"
 )
 
+func TestCoreContext(t *testing.T) {
+	Convey("Requests to core are abandoned if their context is done", t, func() {
+		block := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+			<-block
+		}))
+
+		defer server.Close()
+		defer close(block)
+
+		core, err := New(&config.Config{CoreURL: server.URL})
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		err = core.Delete(ctx, "users/foo/env-1")
+		So(err, ShouldNotBeNil)
+		So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+	})
+}
+
+func TestCoreUpload(t *testing.T) {
+	Convey("Artefacts can be uploaded to core in chunks", t, func() {
+		mc := coremock.NewMockCore()
+		server := httptest.NewServer(mc)
+
+		defer server.Close()
+
+		core, err := New(&config.Config{CoreURL: server.URL})
+		So(err, ShouldBeNil)
+
+		ctx := context.Background()
+		envPath := "users/foo/env-1"
+
+		So(core.PutChunk(ctx, envPath, "file", 0, []byte("abc")), ShouldBeNil)
+		So(core.PutChunk(ctx, envPath, "file", 3, []byte("def")), ShouldBeNil)
+
+		size, err := core.UploadedSize(ctx, envPath, "file")
+		So(err, ShouldBeNil)
+		So(size, ShouldEqual, 6)
+
+		So(core.PutChunk(ctx, envPath, "file", 10, []byte("ghi")), ShouldNotBeNil)
+
+		sum := sha256.Sum256([]byte("abcdef"))
+
+		err = core.ConfirmUpload(ctx, envPath, []UploadedFile{{Name: "file", Size: 6, SHA256: "wrong"}})
+		So(err, ShouldNotBeNil)
+
+		err = core.ConfirmUpload(ctx, envPath, []UploadedFile{{Name: "file", Size: 6,
+			SHA256: hex.EncodeToString(sum[:])}})
+		So(err, ShouldBeNil)
+
+		data, ok := mc.GetFile(envPath + "/file")
+		So(ok, ShouldBeTrue)
+		So(data, ShouldEqual, "abcdef")
+	})
+}
+
 func TestCore(t *testing.T) {
 	Convey("Given a path, description and packages", t, func() {
 		path := "users/foo/env"
@@ -78,31 +143,31 @@ func TestCore(t *testing.T) {
 
 		Convey("You can create an environment", func() {
 			So(buildRequests, ShouldEqual, 0)
-			err = core.Create(path, desc, pkgs)
+			err = core.Create(context.Background(), path, desc, pkgs)
 			So(err, ShouldBeNil)
 			So(buildRequests, ShouldEqual, 1)
 
 			repoPath := path + "-1"
 
-			defer core.Delete(repoPath) //nolint:errcheck
+			defer core.Delete(context.Background(), repoPath) //nolint:errcheck
 
 			Convey("Then remove it", func() {
-				err = core.Delete(repoPath)
+				err = core.Delete(context.Background(), repoPath)
 				So(err, ShouldBeNil)
 
-				err = core.Delete(repoPath)
+				err = core.Delete(context.Background(), repoPath)
 				So(err, ShouldNotBeNil)
 			})
 
 			Convey("Then retrigger its creation", func() {
-				err = core.ResendPendingBuilds()
+				err = core.ResendPendingBuilds(context.Background())
 				So(err, ShouldBeNil)
 				postRetriggerBuildRequests := buildRequests
 				So(postRetriggerBuildRequests, ShouldBeGreaterThan, 1)
 
 				Convey("Unless the builder is down", func() {
 					fakeBuildServer.Close()
-					err = core.ResendPendingBuilds()
+					err = core.ResendPendingBuilds(context.Background())
 					So(err, ShouldNotBeNil)
 					So(err.Error(), ShouldEqual, ErrSomeResendsFailed)
 					So(buildRequests, ShouldEqual, postRetriggerBuildRequests)
@@ -111,7 +176,7 @@ func TestCore(t *testing.T) {
 		})
 
 		Convey("You can't create an environment with empty path", func() {
-			err := core.Create("", desc, pkgs)
+			err := core.Create(context.Background(), "", desc, pkgs)
 			So(err, ShouldNotBeNil)
 		})
 	})
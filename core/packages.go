@@ -23,25 +23,49 @@
 
 package core
 
-import "github.com/wtsi-hgi/go-softpack-builder/internal"
+import (
+	"regexp"
+
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+)
 
 const (
-	ErrNoPackages    = internal.Error("packages required")
-	ErrNoPackageName = internal.Error("package names required")
+	ErrNoPackages            = internal.Error("packages required")
+	ErrNoPackageName         = internal.Error("package names required")
+	ErrInvalidPackageName    = internal.Error("invalid package name")
+	ErrInvalidPackageVersion = internal.Error("invalid package version")
 )
 
+// validPackageName matches spack package names. Names end up in shell scripts
+// and tcl module files, so nothing that could be interpreted by either is
+// allowed.
+var validPackageName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`) //nolint:gochecknoglobals
+
+// validPackageVersion matches spack versions, including ranges (eg. "1.2:"),
+// lists (eg. "1.2,1.4") and git versions (eg. "git.v1.0=1.0").
+var validPackageVersion = regexp.MustCompile(`^[A-Za-z0-9.:=][A-Za-z0-9._:,=+-]*$`) //nolint:gochecknoglobals
+
 // Package describes the name and optional version of a spack package.
 type Package struct {
 	Name    string `json:"name"`
 	Version string `json:"version"`
 }
 
-// Validate returns an error if Name isn't set.
+// Validate returns an error if Name isn't set, or if Name or Version contain
+// characters that aren't valid in spack package names and versions.
 func (p *Package) Validate() error {
 	if p.Name == "" {
 		return ErrNoPackageName
 	}
 
+	if !validPackageName.MatchString(p.Name) {
+		return ErrInvalidPackageName
+	}
+
+	if p.Version != "" && !validPackageVersion.MatchString(p.Version) {
+		return ErrInvalidPackageVersion
+	}
+
 	return nil
 }
 
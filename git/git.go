@@ -55,8 +55,8 @@ const (
 	ErrNoHash      = Error("no hash found")
 )
 
-func getURL(url string) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+func getURL(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -66,8 +66,8 @@ func getURL(url string) (*http.Response, error) {
 
 // GetLatestCommit gets the latest head commit hash for the given remote git
 // repo.
-func GetLatestCommit(url string) (string, error) {
-	resp, err := getURL(url + refsPath + refsQuery)
+func GetLatestCommit(ctx context.Context, url string) (string, error) {
+	resp, err := getURL(ctx, url+refsPath+refsQuery)
 	if err != nil {
 		return "", err
 	}
@@ -78,7 +78,7 @@ func GetLatestCommit(url string) (string, error) {
 		return getLatestCommitFromSmartResponse(resp.Body)
 	}
 
-	return getLatestCommitFromBasicResponse(url, resp.Body)
+	return getLatestCommitFromBasicResponse(ctx, url, resp.Body)
 }
 
 // getLatestCommitFromSmartResponse parses a response that looks like:
@@ -174,8 +174,8 @@ func isAtoF(c rune) bool {
 //
 // /HEAD
 // ref: refs/heads/master
-func getLatestCommitFromBasicResponse(url string, r io.Reader) (string, error) {
-	headRef, err := getBasicHeadRef(url)
+func getLatestCommitFromBasicResponse(ctx context.Context, url string, r io.Reader) (string, error) {
+	headRef, err := getBasicHeadRef(ctx, url)
 	if err != nil {
 		return "", err
 	}
@@ -196,8 +196,8 @@ func getLatestCommitFromBasicResponse(url string, r io.Reader) (string, error) {
 	}
 }
 
-func getBasicHeadRef(url string) (string, error) {
-	resp, err := getURL(url + headPath)
+func getBasicHeadRef(ctx context.Context, url string) (string, error) {
+	resp, err := getURL(ctx, url+headPath)
 	if err != nil {
 		return "", err
 	}
@@ -24,6 +24,7 @@
 package git
 
 import (
+	"context"
 	"net/http/httptest"
 	"os"
 	"testing"
@@ -38,7 +39,7 @@ func TestGetLatestCommit(t *testing.T) {
 		ts := httptest.NewServer(mg)
 
 		Convey("you can retrieve latest commit hash on primary branch from a dumb server", func() {
-			commit, err := GetLatestCommit(ts.URL)
+			commit, err := GetLatestCommit(context.Background(), ts.URL)
 			So(err, ShouldBeNil)
 			So(commit, ShouldEqual, commitHash)
 		})
@@ -46,7 +47,7 @@ func TestGetLatestCommit(t *testing.T) {
 		Convey("you can retrieve latest commit hash on primary branch from a smart server", func() {
 			mg.Smart = true
 
-			commit, err := GetLatestCommit(ts.URL)
+			commit, err := GetLatestCommit(context.Background(), ts.URL)
 			So(err, ShouldBeNil)
 			So(commit, ShouldEqual, commitHash)
 		})
@@ -62,7 +63,7 @@ func TestGetLatestCommit(t *testing.T) {
 	}
 
 	Convey("Given a URL to a real git server you can retrieve the latest hash from the primary branch", t, func() {
-		commit, err := GetLatestCommit(repoURL)
+		commit, err := GetLatestCommit(context.Background(), repoURL)
 		So(err, ShouldBeNil)
 		So(commit, ShouldEqual, repoCommit)
 	})
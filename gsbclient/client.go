@@ -0,0 +1,640 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+// Package gsbclient is a client for the endpoints of a gsb server, so that
+// core and other Go tools can request and monitor builds without making their
+// own HTTP calls.
+package gsbclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
+	"github.com/wtsi-hgi/go-softpack-builder/server"
+)
+
+const (
+	ErrBadRequest      = internal.Error("bad request")
+	ErrUnauthorized    = internal.Error("admin token required")
+	ErrNotFound        = internal.Error("not found")
+	ErrConflict        = internal.Error("conflict")
+	ErrTooManyRequests = internal.Error("too many requests")
+	ErrUnavailable     = internal.Error("service unavailable")
+	ErrNotImplemented  = internal.Error("not implemented")
+
+	defaultRetries   = 3
+	defaultRetryWait = time.Second
+	sseDataPrefix    = "data: "
+	maxSSELineBytes  = 16 * 1024 * 1024
+)
+
+// ResponseError is returned when the server responds with an unsuccessful
+// status code. It Is() the Err* constant corresponding to its StatusCode, if
+// any.
+type ResponseError struct {
+	StatusCode int
+	Message    string
+}
+
+// Error implements error.
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is lets you errors.Is() a ResponseError against our Err* constants.
+func (e *ResponseError) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return target == ErrBadRequest
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusTooManyRequests:
+		return target == ErrTooManyRequests
+	case http.StatusServiceUnavailable:
+		return target == ErrUnavailable
+	case http.StatusNotImplemented:
+		return target == ErrNotImplemented
+	}
+
+	return false
+}
+
+// Client talks to a gsb server. Requests that only get information are retried
+// up to Retries times, waiting RetryWait between attempts, if they fail to
+// connect or the server responds that it is temporarily unavailable; requests
+// that change anything are never retried.
+type Client struct {
+	HTTPClient *http.Client
+	Retries    int
+	RetryWait  time.Duration
+
+	url   string
+	token string
+}
+
+// New returns a Client for the gsb server at the given URL (like
+// "http://localhost:7080"). The admin token is only needed for the admin
+// endpoints of servers that have one configured.
+func New(serverURL, adminToken string) *Client {
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "http://" + serverURL
+	}
+
+	return &Client{
+		HTTPClient: http.DefaultClient,
+		Retries:    defaultRetries,
+		RetryWait:  defaultRetryWait,
+		url:        strings.TrimSuffix(serverURL, "/"),
+		token:      adminToken,
+	}
+}
+
+// Build requests a build of the environment described by the given Request,
+// returning once it has been queued. Builds rejected by a pre-build hook return
+// a *build.PolicyRejection.
+func (c *Client) Build(ctx context.Context, req *server.Request) error {
+	_, err := c.post(ctx, "/environments/build", nil, req)
+
+	return err
+}
+
+// BuildAndWait is like Build(), but waits until the build has completely
+// finished, or the timeout (in whole seconds; 0 for the server's default) has
+// passed, and returns its StatusDetail. If the timeout passed, the detail's
+// State will be build.BuildStateBuilding.
+func (c *Client) BuildAndWait(ctx context.Context, req *server.Request,
+	timeout time.Duration) (*build.StatusDetail, error) {
+	query := url.Values{"wait": {"true"}}
+
+	if timeout > 0 {
+		query.Set("timeout", strconv.Itoa(int(timeout.Seconds())))
+	}
+
+	body, err := c.post(ctx, "/environments/build", query, req)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := new(build.StatusDetail)
+
+	return detail, json.Unmarshal(body, detail)
+}
+
+// BuildTemplate requests a build of an environment based on the template named
+// in the given TemplateRequest.
+func (c *Client) BuildTemplate(ctx context.Context, req *server.TemplateRequest) error {
+	_, err := c.post(ctx, "/templates/build", nil, req)
+
+	return err
+}
+
+// Clone requests a build of a copy of the built environment named in the given
+// CloneRequest.
+func (c *Client) Clone(ctx context.Context, req *server.CloneRequest) error {
+	_, err := c.post(ctx, "/environments/clone", nil, req)
+
+	return err
+}
+
+// Render returns what building the given Request would generate, without
+// building it.
+func (c *Client) Render(ctx context.Context, req *server.Request) (*build.Rendering, error) {
+	body, err := c.post(ctx, "/render", nil, req)
+	if err != nil {
+		return nil, err
+	}
+
+	rendering := new(build.Rendering)
+
+	return rendering, json.Unmarshal(body, rendering)
+}
+
+// Templates returns the templates configured on the server.
+func (c *Client) Templates(ctx context.Context) ([]config.Template, error) {
+	var templates []config.Template
+
+	return templates, c.getJSON(ctx, "/templates", nil, &templates)
+}
+
+// Status returns the statuses of the builds that match the given query.
+func (c *Client) Status(ctx context.Context, q build.StatusQuery) ([]build.Status, error) {
+	var statuses []build.Status
+
+	return statuses, c.getJSON(ctx, "/environments/status", statusQueryValues(q), &statuses)
+}
+
+// statusQueryValues converts a StatusQuery to the URL query parameters the
+// server understands.
+func statusQueryValues(q build.StatusQuery) url.Values {
+	values := url.Values{}
+
+	setIfNotBlank := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+
+	setIfNotBlank("state", string(q.State))
+	setIfNotBlank("path", q.PathPrefix)
+	setIfNotBlank("requester", q.Requester)
+	setIfNotBlank("sort", string(q.SortBy))
+
+	for key, value := range q.Labels {
+		values.Add("label", key+"="+value)
+	}
+
+	if q.Descending {
+		values.Set("order", "desc")
+	}
+
+	if !q.Since.IsZero() {
+		values.Set("since", q.Since.Format(time.RFC3339))
+	}
+
+	if q.Limit > 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	if q.Offset > 0 {
+		values.Set("offset", strconv.Itoa(q.Offset))
+	}
+
+	return values
+}
+
+// StatusDetail returns the full status of the build of the given environment
+// (like "users/foo/env") and version.
+func (c *Client) StatusDetail(ctx context.Context, envPath, version string) (*build.StatusDetail, error) {
+	detail := new(build.StatusDetail)
+
+	return detail, c.getJSON(ctx, "/environments/status/"+envPath+"/"+version, nil, detail)
+}
+
+// StatusChanges returns a channel that receives a StatusChange every time a
+// build on the server changes stage, until the given context is cancelled or
+// the connection is lost, when the channel is closed.
+func (c *Client) StatusChanges(ctx context.Context) (<-chan build.StatusChange, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/environments/status/stream", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan build.StatusChange)
+
+	go func() {
+		defer close(changes)
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(nil, maxSSELineBytes)
+
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), sseDataPrefix)
+			if !ok {
+				continue
+			}
+
+			var change build.StatusChange
+
+			if json.Unmarshal([]byte(data), &change) != nil {
+				continue
+			}
+
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changes, nil
+}
+
+// LogTail returns the recent log lines of the build of the given full
+// environment path (like "users/foo/env-1").
+func (c *Client) LogTail(ctx context.Context, envPath string) ([]string, error) {
+	var lines []string
+
+	return lines, c.getJSON(ctx, "/environments/log-tail", url.Values{"name": {envPath}}, &lines)
+}
+
+// Usage returns how often each installed environment has been used.
+func (c *Client) Usage(ctx context.Context) ([]build.Usage, error) {
+	var usage []build.Usage
+
+	return usage, c.getJSON(ctx, "/environments/usage", nil, &usage)
+}
+
+// DiskUsage returns the installed size of every environment, aggregated by
+// owner.
+func (c *Client) DiskUsage(ctx context.Context) (*build.DiskUsageReport, error) {
+	report := new(build.DiskUsageReport)
+
+	return report, c.getJSON(ctx, "/environments/disk-usage", nil, report)
+}
+
+// PackageAnalytics returns how many installed environments each package and
+// version is in.
+func (c *Client) PackageAnalytics(ctx context.Context) (*build.PackageReport, error) {
+	report := new(build.PackageReport)
+
+	return report, c.getJSON(ctx, "/analytics/packages", nil, report)
+}
+
+// Deprecate marks an installed environment version as deprecated.
+func (c *Client) Deprecate(ctx context.Context, req *server.DeprecateRequest) error {
+	_, err := c.post(ctx, "/environments/deprecate", nil, req)
+
+	return err
+}
+
+// Protect protects an installed environment version against removal.
+func (c *Client) Protect(ctx context.Context, req *server.ProtectRequest) error {
+	_, err := c.post(ctx, "/environments/protect", nil, req)
+
+	return err
+}
+
+// Unprotect removes an installed environment version's protection against
+// removal. This is an admin endpoint.
+func (c *Client) Unprotect(ctx context.Context, req *server.ProtectRequest) error {
+	_, err := c.post(ctx, "/environments/unprotect", nil, req)
+
+	return err
+}
+
+// Remove removes an installed environment version, returning a report of what
+// was removed. Protected environments are only removed if the request has the
+// right OverrideToken, otherwise the error Is() ErrConflict. This is an admin
+// endpoint.
+func (c *Client) Remove(ctx context.Context, req *server.RemoveRequest) (*build.RemovalReport, error) {
+	body, err := c.post(ctx, "/environments/remove", nil, req)
+	if err != nil {
+		return nil, err
+	}
+
+	report := new(build.RemovalReport)
+
+	return report, json.Unmarshal(body, report)
+}
+
+// Image returns the singularity image of the given environment and version.
+// You must close it when you're done.
+func (c *Client) Image(ctx context.Context, envPath, version string) (io.ReadCloser, error) {
+	resp, err := c.get(ctx, envEndpoint(envPath, version, "/image"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// envEndpoint returns the endpoint for the given environment, version and
+// suffix.
+func envEndpoint(envPath, version, suffix string) string {
+	return "/environments/" + path.Join(envPath, version) + suffix
+}
+
+// Artefacts returns a gzipped tar of the build artefacts of the given
+// environment and version.
+func (c *Client) Artefacts(ctx context.Context, envPath, version string) ([]byte, error) {
+	resp, err := c.get(ctx, envEndpoint(envPath, version, "/artifacts.tar.gz"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// Outdated returns the packages of the given environment and version that have
+// newer versions available. Returns an error that Is() ErrNotImplemented if
+// the server has no versionsFile configured.
+func (c *Client) Outdated(ctx context.Context, envPath, version string) ([]build.Upgrade, error) {
+	var upgrades []build.Upgrade
+
+	return upgrades, c.getJSON(ctx, envEndpoint(envPath, version, "/outdated"), nil, &upgrades)
+}
+
+// Verify checks the installation of the given environment and version.
+func (c *Client) Verify(ctx context.Context, envPath, version string) (*build.Verification, error) {
+	verification := new(build.Verification)
+
+	return verification, c.getJSON(ctx, envEndpoint(envPath, version, "/verify"), nil, verification)
+}
+
+// Metadata returns the softpack.yml and spack.lock of the given built
+// environment and version.
+func (c *Client) Metadata(ctx context.Context, envPath, version string) (*build.Metadata, error) {
+	metadata := new(build.Metadata)
+
+	return metadata, c.getJSON(ctx, envEndpoint(envPath, version, "/metadata"), nil, metadata)
+}
+
+// SubmittedDefinition returns the singularity.def generated for the latest
+// build of the given environment and version, which is available as soon as the
+// build has been submitted.
+func (c *Client) SubmittedDefinition(ctx context.Context, envPath, version string) (*build.SubmittedDefinition,
+	error) {
+	sd := new(build.SubmittedDefinition)
+
+	return sd, c.getJSON(ctx, envEndpoint(envPath, version, "/definition"), nil, sd)
+}
+
+// RemovalPreview returns a report of everything that removing the given
+// environment and version would delete, without removing anything.
+func (c *Client) RemovalPreview(ctx context.Context, envPath, version string) (*build.RemovalReport, error) {
+	report := new(build.RemovalReport)
+
+	return report, c.getJSON(ctx, envEndpoint(envPath, version, "/removal"), nil, report)
+}
+
+// Health returns the state of the server.
+func (c *Client) Health(ctx context.Context) (*server.Health, error) {
+	health := new(server.Health)
+
+	return health, c.getJSON(ctx, "/health", nil, health)
+}
+
+// Version returns the server's version, git commit and enabled features.
+func (c *Client) Version(ctx context.Context) (*build.VersionInfo, error) {
+	info := new(build.VersionInfo)
+
+	return info, c.getJSON(ctx, "/version", nil, info)
+}
+
+// ActiveBuilds returns the builds the server is doing right now, and those held
+// for maintenance.
+func (c *Client) ActiveBuilds(ctx context.Context) ([]build.ActiveBuild, error) {
+	var active []build.ActiveBuild
+
+	return active, c.getJSON(ctx, "/builds/active", nil, &active)
+}
+
+// SetMaintenance changes the server's maintenance mode. This is an admin
+// endpoint.
+func (c *Client) SetMaintenance(ctx context.Context, mode build.MaintenanceMode) (*build.MaintenanceStatus, error) {
+	var endpoint string
+
+	switch mode {
+	case build.MaintenancePaused:
+		endpoint = "/maintenance/pause"
+	case build.MaintenanceDraining:
+		endpoint = "/maintenance/drain"
+	case build.MaintenanceOff:
+		endpoint = "/maintenance/resume"
+	default:
+		return nil, build.ErrUnknownMaintenanceMode
+	}
+
+	body, err := c.post(ctx, endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	status := new(build.MaintenanceStatus)
+
+	return status, json.Unmarshal(body, status)
+}
+
+// Cancel stops the running build of the given full environment path (like
+// "users/foo/env-1"), returning once its wr job has been killed and removed.
+// This is an admin endpoint.
+func (c *Client) Cancel(ctx context.Context, envPath string) error {
+	_, err := c.post(ctx, "/environments/cancel", url.Values{"name": {envPath}}, nil)
+
+	return err
+}
+
+// Requeue builds the given full environment path (like "users/foo/env-1")
+// again. This is an admin endpoint.
+func (c *Client) Requeue(ctx context.Context, envPath string) error {
+	_, err := c.post(ctx, "/environments/requeue", url.Values{"name": {envPath}}, nil)
+
+	return err
+}
+
+// Repair verifies all installed environments, repairing the broken ones unless
+// dryRun. This is an admin endpoint.
+func (c *Client) Repair(ctx context.Context, dryRun bool) (*build.RepairReport, error) {
+	var query url.Values
+	if dryRun {
+		query = url.Values{"dryrun": {"true"}}
+	}
+
+	body, err := c.post(ctx, "/environments/repair", query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	report := new(build.RepairReport)
+
+	return report, json.Unmarshal(body, report)
+}
+
+// getJSON GETs the given endpoint and decodes the JSON response in to v.
+func (c *Client) getJSON(ctx context.Context, endpoint string, query url.Values, v any) error {
+	resp, err := c.get(ctx, endpoint, query)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// get GETs the given endpoint, retrying on temporary failures.
+func (c *Client) get(ctx context.Context, endpoint string, query url.Values) (*http.Response, error) {
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	for attempt := 0; ; attempt++ {
+		resp, err = c.do(ctx, http.MethodGet, endpoint, query, nil)
+		if err == nil || attempt >= c.Retries || !temporary(err) {
+			return resp, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.RetryWait):
+		}
+	}
+}
+
+// temporary returns true if the given error from do() is worth retrying.
+func temporary(err error) bool {
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+
+	switch respErr.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// post POSTs the given value as JSON, if not nil, to the given endpoint, and
+// returns the response body.
+func (c *Client) post(ctx context.Context, endpoint string, query url.Values, v any) ([]byte, error) {
+	var body io.Reader
+
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+
+		body = bytes.NewReader(data)
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, endpoint, query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// do makes a request to the given endpoint, returning the response if it was
+// successful, otherwise an error.
+func (c *Client) do(ctx context.Context, method, endpoint string, query url.Values,
+	body io.Reader) (*http.Response, error) {
+	u := c.url + endpoint
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	return nil, responseError(resp)
+}
+
+// responseError returns an error describing the given unsuccessful response.
+// Policy rejections are returned as a *build.PolicyRejection.
+func responseError(resp *http.Response) error {
+	msg, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusForbidden && resp.Header.Get("Content-Type") == "application/json" {
+		rejection := new(build.PolicyRejection)
+
+		if json.Unmarshal(msg, rejection) == nil {
+			return rejection
+		}
+	}
+
+	return &ResponseError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
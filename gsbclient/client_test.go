@@ -0,0 +1,331 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package gsbclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/buildermock"
+	"github.com/wtsi-hgi/go-softpack-builder/remove"
+	"github.com/wtsi-hgi/go-softpack-builder/server"
+)
+
+func TestClient(t *testing.T) {
+	Convey("Given a gsb server", t, func() {
+		mb := new(buildermock.MockBuilder)
+
+		var conf config.Config
+		conf.Server.AdminToken = "secret"
+		conf.Templates = []config.Template{{Name: "tmpl", Packages: []string{"zlib"}}}
+
+		l, err := server.NewListener("")
+		So(err, ShouldBeNil)
+
+		s := server.New(mb, &conf)
+		defer s.Stop()
+
+		go func() {
+			s.Start(l) //nolint:errcheck
+		}()
+
+		client := New(l.Addr().String(), "secret")
+		ctx := context.Background()
+
+		req := &server.Request{Name: "users/user/myenv", Version: "1", Requester: "user",
+			Labels: map[string]string{"project": "atlas"}}
+		req.Model.Packages = []core.Package{{Name: "xxhash", Version: "0.8.1"}}
+
+		Convey("you can request builds and get their status", func() {
+			So(client.Build(ctx, req), ShouldBeNil)
+			So(len(mb.Received), ShouldEqual, 1)
+			So(mb.Received[0].EnvironmentName, ShouldEqual, "myenv")
+			So(mb.Received[0].Requester, ShouldEqual, "user")
+			So(mb.Received[0].Labels, ShouldResemble, map[string]string{"project": "atlas"})
+
+			mb.Requested = []time.Time{time.Now()}
+
+			statuses, errs := client.Status(ctx, build.StatusQuery{State: build.BuildStateBuilding,
+				Requester: "user", Labels: map[string]string{"project": "atlas"}, Descending: true, Limit: 5})
+			So(errs, ShouldBeNil)
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].Name, ShouldEqual, "users/user/myenv-1")
+			So(mb.LastQuery, ShouldResemble, build.StatusQuery{State: build.BuildStateBuilding,
+				Requester: "user", Labels: map[string]string{"project": "atlas"}, Descending: true, Limit: 5})
+
+			detail, errs := client.StatusDetail(ctx, "users/user/myenv", "1")
+			So(errs, ShouldBeNil)
+			So(detail.Name, ShouldEqual, "users/user/myenv-1")
+
+			_, errs = client.StatusDetail(ctx, "users/user/other", "1")
+			So(errs, ShouldWrap, ErrNotFound)
+
+			detail, errs = client.BuildAndWait(ctx, req, time.Minute)
+			So(errs, ShouldBeNil)
+			So(detail.State, ShouldEqual, build.BuildStateBuilding)
+
+			So(client.BuildTemplate(ctx, &server.TemplateRequest{Template: "tmpl", Request: *req}), ShouldBeNil)
+			So(len(mb.Received), ShouldEqual, 3)
+			So(mb.Received[2].Packages, ShouldResemble, core.Packages{{Name: "zlib"}, {Name: "xxhash", Version: "0.8.1"}})
+
+			mb.SoftpackYMLs = map[string]string{"users/user/myenv-1": "packages:\n  - xxhash@0.8.1\n"}
+			So(client.Clone(ctx, &server.CloneRequest{Source: "users/user/myenv", SourceVersion: "1",
+				Request: server.Request{Name: "users/user/copy", Version: "1"}}), ShouldBeNil)
+			So(len(mb.Received), ShouldEqual, 4)
+			So(mb.Received[3].Packages, ShouldResemble, core.Packages{{Name: "xxhash", Version: "0.8.1"}})
+
+			templates, errs := client.Templates(ctx)
+			So(errs, ShouldBeNil)
+			So(templates, ShouldResemble, conf.Templates)
+		})
+
+		Convey("rejected builds return meaningful errors", func() {
+			mb.BuildErr = &build.PolicyRejection{Hook: "denylist", Reasons: []string{"no"}}
+
+			err = client.Build(ctx, req)
+			So(errors.Is(err, build.ErrPolicyRejected), ShouldBeTrue)
+
+			var rejection *build.PolicyRejection
+			So(errors.As(err, &rejection), ShouldBeTrue)
+			So(rejection.Reasons, ShouldResemble, []string{"no"})
+
+			mb.BuildErr = build.ErrBuildsPaused
+			So(client.Build(ctx, req), ShouldWrap, ErrUnavailable)
+
+			req.Name = "../bad"
+			So(client.Build(ctx, req), ShouldWrap, ErrBadRequest)
+		})
+
+		Convey("you can get information about environments", func() {
+			mb.LogTails = map[string][]string{"users/user/myenv-1": {"a", "b"}}
+			mb.Images = map[string]string{"users/user/myenv-1": "image"}
+			mb.Bundles = map[string][]byte{"users/user/myenv-1": []byte("tar")}
+			mb.Problems = map[string][]string{"users/user/myenv-1": {"broken"}}
+
+			lines, errs := client.LogTail(ctx, "users/user/myenv-1")
+			So(errs, ShouldBeNil)
+			So(lines, ShouldResemble, []string{"a", "b"})
+
+			rc, errs := client.Image(ctx, "users/user/myenv", "1")
+			So(errs, ShouldBeNil)
+
+			data, errs := io.ReadAll(rc)
+			So(errs, ShouldBeNil)
+			So(rc.Close(), ShouldBeNil)
+			So(string(data), ShouldEqual, "image")
+
+			data, errs = client.Artefacts(ctx, "users/user/myenv", "1")
+			So(errs, ShouldBeNil)
+			So(string(data), ShouldEqual, "tar")
+
+			_, errs = client.Outdated(ctx, "users/user/myenv", "1")
+			So(errs, ShouldWrap, ErrNotImplemented)
+
+			verification, errs := client.Verify(ctx, "users/user/myenv", "1")
+			So(errs, ShouldBeNil)
+			So(verification.Problems, ShouldResemble, []string{"broken"})
+
+			_, errs = client.Metadata(ctx, "users/user/myenv", "1")
+			So(errs, ShouldWrap, ErrNotFound)
+
+			mb.SoftpackYMLs = map[string]string{"users/user/myenv-1": "yml"}
+
+			metadata, errs := client.Metadata(ctx, "users/user/myenv", "1")
+			So(errs, ShouldBeNil)
+			So(metadata.SoftpackYML, ShouldEqual, "yml")
+
+			_, errs = client.SubmittedDefinition(ctx, "users/user/myenv", "1")
+			So(errs, ShouldWrap, ErrNotFound)
+
+			mb.Submitted = map[string]*build.SubmittedDefinition{"users/user/myenv-1": {SingularityDef: "def"}}
+
+			sd, errs := client.SubmittedDefinition(ctx, "users/user/myenv", "1")
+			So(errs, ShouldBeNil)
+			So(sd.SingularityDef, ShouldEqual, "def")
+
+			removal, errs := client.RemovalPreview(ctx, "users/user/myenv", "1")
+			So(errs, ShouldBeNil)
+			So(removal.DryRun, ShouldBeTrue)
+			So(removal.Environment, ShouldEqual, "users/user/myenv-1")
+
+			usage, errs := client.Usage(ctx)
+			So(errs, ShouldBeNil)
+			So(usage, ShouldResemble, []build.Usage{})
+
+			disk, errs := client.DiskUsage(ctx)
+			So(errs, ShouldBeNil)
+			So(disk.Owners, ShouldBeEmpty)
+
+			packages, errs := client.PackageAnalytics(ctx)
+			So(errs, ShouldBeNil)
+			So(packages.Packages, ShouldBeEmpty)
+
+			So(client.Deprecate(ctx, &server.DeprecateRequest{Name: "users/user/myenv", Version: "1"}), ShouldBeNil)
+			So(mb.Deprecated, ShouldResemble, map[string]string{"users/user/myenv-1": ""})
+
+			So(client.Protect(ctx, &server.ProtectRequest{Name: "users/user/myenv", Version: "1",
+				Reason: "pipelines"}), ShouldBeNil)
+			So(mb.Protected, ShouldResemble, map[string]string{"users/user/myenv-1": "pipelines"})
+			So(client.Unprotect(ctx, &server.ProtectRequest{Name: "users/user/myenv", Version: "1"}), ShouldBeNil)
+			So(mb.Protected, ShouldBeEmpty)
+
+			health, errs := client.Health(ctx)
+			So(errs, ShouldBeNil)
+			So(health.Maintenance.Mode, ShouldEqual, build.MaintenanceMode(""))
+
+			mb.Version = build.VersionInfo{Version: "v1.2.3"}
+
+			info, errs := client.Version(ctx)
+			So(errs, ShouldBeNil)
+			So(info.Version, ShouldEqual, "v1.2.3")
+
+			mb.Active = []build.ActiveBuild{{Environment: "users/user/myenv-1", Stage: build.BuildStageQueued}}
+
+			active, errs := client.ActiveBuilds(ctx)
+			So(errs, ShouldBeNil)
+			So(active, ShouldResemble, mb.Active)
+
+			mb.Rendering = &build.Rendering{SingularityDef: "def", SoftpackYML: "yml"}
+
+			req := &server.Request{Name: "users/user/myenv", Version: "1"}
+			req.Model.Packages = core.Packages{{Name: "xxhash"}}
+
+			rendering, errs := client.Render(ctx, req)
+			So(errs, ShouldBeNil)
+			So(rendering, ShouldResemble, mb.Rendering)
+			So(len(mb.Rendered), ShouldEqual, 1)
+			So(mb.Rendered[0].EnvironmentName, ShouldEqual, "myenv")
+		})
+
+		Convey("you can stream status changes", func() {
+			mb.Changes = make(chan build.StatusChange)
+
+			sctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			changes, errs := client.StatusChanges(sctx)
+			So(errs, ShouldBeNil)
+
+			mb.Changes <- build.StatusChange{Stage: build.BuildStageQueued, Status: build.Status{Name: "users/user/myenv-1"}}
+
+			change := <-changes
+			So(change.Stage, ShouldEqual, build.BuildStageQueued)
+			So(change.Status.Name, ShouldEqual, "users/user/myenv-1")
+
+			cancel()
+
+			for range changes { //nolint:revive
+			}
+		})
+
+		Convey("you can use the admin endpoints with the admin token", func() {
+			status, errs := client.SetMaintenance(ctx, build.MaintenanceDraining)
+			So(errs, ShouldBeNil)
+			So(status.Mode, ShouldEqual, build.MaintenanceDraining)
+
+			_, errs = client.SetMaintenance(ctx, "bad")
+			So(errs, ShouldEqual, build.ErrUnknownMaintenanceMode)
+
+			So(client.Cancel(ctx, "users/user/myenv-1"), ShouldWrap, ErrNotFound)
+
+			mb.Received = []*build.Definition{{EnvironmentPath: "users/user/", EnvironmentName: "myenv",
+				EnvironmentVersion: "1"}}
+			mb.Requested = []time.Time{time.Now()}
+
+			So(client.Cancel(ctx, "users/user/myenv-1"), ShouldBeNil)
+			So(mb.Cancelled, ShouldResemble, []string{"users/user/myenv-1"})
+			So(client.Requeue(ctx, "users/user/myenv-1"), ShouldBeNil)
+			So(mb.Requeued, ShouldResemble, []string{"users/user/myenv-1"})
+
+			report, errs := client.Repair(ctx, true)
+			So(errs, ShouldBeNil)
+			So(report.DryRun, ShouldBeTrue)
+
+			_, errs = New(l.Addr().String(), "").Repair(ctx, true)
+			So(errs, ShouldWrap, ErrUnauthorized)
+
+			removal, errs := client.Remove(ctx, &server.RemoveRequest{Name: "users/user/myenv", Version: "1"})
+			So(errs, ShouldBeNil)
+			So(removal.Environment, ShouldEqual, "users/user/myenv-1")
+			So(mb.Removed, ShouldResemble, []string{"users/user/myenv-1"})
+
+			_, errs = client.Remove(ctx, &server.RemoveRequest{Name: "myenv", Version: "1"})
+			So(errs, ShouldWrap, ErrBadRequest)
+
+			mb.RemoveErr = remove.ErrProtected
+
+			_, errs = client.Remove(ctx, &server.RemoveRequest{Name: "users/user/myenv", Version: "1"})
+			So(errs, ShouldWrap, ErrConflict)
+
+			_, errs = New(l.Addr().String(), "").Remove(ctx,
+				&server.RemoveRequest{Name: "users/user/myenv", Version: "1"})
+			So(errs, ShouldWrap, ErrUnauthorized)
+		})
+	})
+
+	Convey("Requests for information are retried when the server is unavailable", t, func() {
+		var requests atomic.Int32
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) < 3 {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+
+				return
+			}
+
+			w.Write([]byte("[]")) //nolint:errcheck
+		}))
+		defer srv.Close()
+
+		client := New(srv.URL, "")
+		client.RetryWait = time.Millisecond
+
+		usage, err := client.Usage(context.Background())
+		So(err, ShouldBeNil)
+		So(usage, ShouldResemble, []build.Usage{})
+		So(requests.Load(), ShouldEqual, 3)
+
+		requests.Store(0)
+		client.Retries = 1
+
+		_, err = client.Usage(context.Background())
+		So(err, ShouldWrap, ErrUnavailable)
+		So(requests.Load(), ShouldEqual, 2)
+
+		requests.Store(0)
+
+		So(client.Build(context.Background(), &server.Request{}), ShouldWrap, ErrUnavailable)
+		So(requests.Load(), ShouldEqual, 1)
+	})
+}
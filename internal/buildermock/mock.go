@@ -24,7 +24,15 @@
 package buildermock
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/wtsi-hgi/go-softpack-builder/build"
@@ -32,15 +40,47 @@ import (
 
 // MockBuilder can be used to test a server.Server without having real builder.
 type MockBuilder struct {
-	Received  []*build.Definition
-	Requested []time.Time
+	Received     []*build.Definition
+	Requested    []time.Time
+	Usages       []build.Usage
+	UsageErr     error
+	Deprecated   map[string]string
+	Protected    map[string]string
+	ProtectErr   error
+	Removed      []string
+	RemoveErr    error
+	LogTails     map[string][]string
+	LastQuery    build.StatusQuery
+	BuildErr     error
+	Replication  build.ReplicationStatus
+	Cache        build.BinaryCacheStatus
+	Images       map[string]string
+	Bundles      map[string][]byte
+	Upgrades     map[string][]build.Upgrade
+	Changes      chan build.StatusChange
+	Maint        build.MaintenanceStatus
+	Cancelled    []string
+	Requeued     []string
+	Problems     map[string][]string
+	SoftpackYMLs map[string]string
+	Unfinished   bool
+	Disk         *build.DiskUsageReport
+	DiskErr      error
+	Packages     *build.PackageReport
+	PackagesErr  error
+	Version      build.VersionInfo
+	Active       []build.ActiveBuild
+	Submitted    map[string]*build.SubmittedDefinition
+	Rendered     []*build.Definition
+	Rendering    *build.Rendering
+	RenderErr    error
 }
 
-// Build adds the given def to our slice of Received.
-func (m *MockBuilder) Build(def *build.Definition) error { //nolint:unparam
+// Build adds the given def to our slice of Received, and returns our BuildErr.
+func (m *MockBuilder) Build(_ context.Context, def *build.Definition) error {
 	m.Received = append(m.Received, def)
 
-	return nil
+	return m.BuildErr
 }
 
 // Status returns a status for everything sent to Build, assuming you pushed
@@ -61,3 +101,362 @@ func (m *MockBuilder) Status() []build.Status {
 
 	return statuses
 }
+
+// QueryStatus records the query as our LastQuery, and returns an error if it is
+// invalid, or else the same as Status(), without filtering.
+func (m *MockBuilder) QueryStatus(q build.StatusQuery) ([]build.Status, error) {
+	m.LastQuery = q
+
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	return m.Status(), nil
+}
+
+// StatusDetail returns a StatusDetail for the matching status returned by
+// Status(), or build.ErrUnknownBuild.
+func (m *MockBuilder) StatusDetail(envPath, version string) (*build.StatusDetail, error) {
+	for _, status := range m.Status() {
+		if status.Name == envPath+"-"+version {
+			return &build.StatusDetail{
+				Status: status,
+				State:  status.State(),
+				Stage:  status.Stage(),
+			}, nil
+		}
+	}
+
+	return nil, build.ErrUnknownBuild
+}
+
+// Usage returns our Usages and UsageErr.
+func (m *MockBuilder) Usage() ([]build.Usage, error) {
+	return m.Usages, m.UsageErr
+}
+
+// DiskUsage returns our Disk report, or an empty one, and DiskErr.
+func (m *MockBuilder) DiskUsage() (*build.DiskUsageReport, error) {
+	if m.Disk == nil {
+		return &build.DiskUsageReport{Owners: []build.OwnerDiskUsage{}, Environments: []build.EnvironmentDiskUsage{}},
+			m.DiskErr
+	}
+
+	return m.Disk, m.DiskErr
+}
+
+// PackageAnalytics returns our Packages report, or an empty one, and
+// PackagesErr.
+func (m *MockBuilder) PackageAnalytics(_ context.Context) (*build.PackageReport, error) {
+	if m.Packages == nil {
+		return &build.PackageReport{Packages: []build.PackageCount{}}, m.PackagesErr
+	}
+
+	return m.Packages, m.PackagesErr
+}
+
+// VersionInfo returns our Version.
+func (m *MockBuilder) VersionInfo() build.VersionInfo {
+	return m.Version
+}
+
+// Deprecate records the given def's full environment path in our Deprecated
+// map, with the replacement as the value.
+func (m *MockBuilder) Deprecate(_ context.Context, def *build.Definition, replacement string) error {
+	if m.Deprecated == nil {
+		m.Deprecated = make(map[string]string)
+	}
+
+	m.Deprecated[def.FullEnvironmentPath()] = replacement
+
+	return nil
+}
+
+// Protect records the given def's full environment path in our Protected map,
+// with the reason as the value, unless we have a ProtectErr to return.
+func (m *MockBuilder) Protect(_ context.Context, def *build.Definition, reason string) error {
+	if m.ProtectErr != nil {
+		return m.ProtectErr
+	}
+
+	if m.Protected == nil {
+		m.Protected = make(map[string]string)
+	}
+
+	m.Protected[def.FullEnvironmentPath()] = reason
+
+	return nil
+}
+
+// Unprotect deletes the given def's full environment path from our Protected
+// map.
+func (m *MockBuilder) Unprotect(_ context.Context, def *build.Definition) error {
+	delete(m.Protected, def.FullEnvironmentPath())
+
+	return nil
+}
+
+// LogTail returns the lines in our LogTails map for the given envPath, or
+// build.ErrNoLogTail if there aren't any.
+func (m *MockBuilder) LogTail(envPath string) ([]string, error) {
+	lines, ok := m.LogTails[envPath]
+	if !ok {
+		return nil, build.ErrNoLogTail
+	}
+
+	return lines, nil
+}
+
+// ReplicationStatus returns our Replication.
+func (m *MockBuilder) ReplicationStatus() build.ReplicationStatus {
+	return m.Replication
+}
+
+// BinaryCacheStatus returns our Cache.
+func (m *MockBuilder) BinaryCacheStatus() build.BinaryCacheStatus {
+	return m.Cache
+}
+
+// ImageModTime is the modification time of the images returned by Image().
+var ImageModTime = time.Date(2024, 2, 12, 12, 0, 0, 0, time.UTC) //nolint:gochecknoglobals
+
+type seekableImage struct {
+	*bytes.Reader
+}
+
+func (seekableImage) Close() error { return nil }
+
+// ArtefactsBundle returns the data in our Bundles for the given envPath and
+// version (keyed like "users/foo/env-1"), or build.ErrNoArtefacts.
+func (m *MockBuilder) ArtefactsBundle(_ context.Context, envPath, version string) ([]byte, error) {
+	bundle, ok := m.Bundles[envPath+"-"+version]
+	if !ok {
+		return nil, build.ErrNoArtefacts
+	}
+
+	return bundle, nil
+}
+
+// Outdated returns the Upgrades for the given envPath and version (keyed like
+// "users/foo/env-1"), or build.ErrNoVersionsFile if we have no Upgrades at
+// all, or an error wrapping build.ErrNoArtefacts if we have none for that key.
+func (m *MockBuilder) Outdated(_ context.Context, envPath, version string) ([]build.Upgrade, error) {
+	if m.Upgrades == nil {
+		return nil, build.ErrNoVersionsFile
+	}
+
+	upgrades, ok := m.Upgrades[envPath+"-"+version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", build.ErrNoArtefacts, envPath)
+	}
+
+	return upgrades, nil
+}
+
+// Verify returns a Verification with the Problems for the given envPath and
+// version (keyed like "users/foo/env-1").
+func (m *MockBuilder) Verify(_ context.Context, envPath, version string) (*build.Verification, error) {
+	return &build.Verification{
+		Environment: envPath + "-" + version,
+		Problems:    m.Problems[envPath+"-"+version],
+	}, nil
+}
+
+// RemovalPreview returns an otherwise empty dry-run RemovalReport for the
+// given envPath and version.
+func (m *MockBuilder) RemovalPreview(envPath, version string) (*build.RemovalReport, error) {
+	return &build.RemovalReport{DryRun: true, Environment: envPath + "-" + version}, nil
+}
+
+// Remove records the given envPath and version (like "users/foo/env-1") in our
+// Removed slice and returns an otherwise empty RemovalReport for it, unless we
+// have a RemoveErr to return.
+func (m *MockBuilder) Remove(_ context.Context, envPath, version, _ string) (*build.RemovalReport, error) {
+	if m.RemoveErr != nil {
+		return nil, m.RemoveErr
+	}
+
+	m.Removed = append(m.Removed, envPath+"-"+version)
+
+	return &build.RemovalReport{Environment: envPath + "-" + version}, nil
+}
+
+// Metadata returns a Metadata with the softpack.yml in our SoftpackYMLs for the
+// given envPath and version (keyed like "users/foo/env-1"), or
+// build.ErrNoArtefacts.
+func (m *MockBuilder) Metadata(_ context.Context, envPath, version string) (*build.Metadata, error) {
+	yml, ok := m.SoftpackYMLs[envPath+"-"+version]
+	if !ok {
+		return nil, build.ErrNoArtefacts
+	}
+
+	return &build.Metadata{Environment: envPath + "-" + version, SoftpackYML: yml, SpackLock: "{}"}, nil
+}
+
+// SubmittedDefinition returns the one of our Submitted for the given envPath
+// and version (keyed like "users/foo/env-1"), or build.ErrUnknownBuild.
+func (m *MockBuilder) SubmittedDefinition(_ context.Context, envPath, version string) (*build.SubmittedDefinition,
+	error) {
+	sd, ok := m.Submitted[envPath+"-"+version]
+	if !ok {
+		return nil, build.ErrUnknownBuild
+	}
+
+	return sd, nil
+}
+
+// WaitForBuild returns the same as StatusDetail(), unless we're Unfinished, in
+// which case it waits until the given context is done and returns its error.
+func (m *MockBuilder) WaitForBuild(ctx context.Context, envPath, version string) (*build.StatusDetail, error) {
+	if m.Unfinished {
+		<-ctx.Done()
+
+		return nil, ctx.Err()
+	}
+
+	return m.StatusDetail(envPath, version)
+}
+
+// RepairAll returns a RepairReport of the environments with Problems. Unless
+// dryRun, they are reported as repaired and our Problems are cleared.
+func (m *MockBuilder) RepairAll(_ context.Context, dryRun bool) (*build.RepairReport, error) {
+	report := &build.RepairReport{DryRun: dryRun}
+
+	names := make([]string, 0, len(m.Problems))
+
+	for name := range m.Problems {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		report.Checked++
+		report.Broken++
+
+		if !dryRun {
+			report.Repaired++
+		}
+
+		report.Environments = append(report.Environments, build.RepairResult{
+			Environment: name,
+			Problems:    m.Problems[name],
+			Repaired:    !dryRun,
+		})
+	}
+
+	if !dryRun {
+		m.Problems = nil
+	}
+
+	return report, nil
+}
+
+// Image returns a seekable Image containing the data in our Images for the
+// given envPath and version (keyed like "users/foo/env-1"), or
+// build.ErrNoImage. Images whose data starts "s3:" are returned like those
+// found in S3 instead: not seekable and without size or sha256.
+func (m *MockBuilder) Image(_ context.Context, envPath, version string) (*build.Image, error) {
+	data, ok := m.Images[envPath+"-"+version]
+	if !ok {
+		return nil, build.ErrNoImage
+	}
+
+	if strings.HasPrefix(data, "s3:") {
+		return &build.Image{ReadCloser: io.NopCloser(strings.NewReader(data)), Size: -1}, nil
+	}
+
+	sum := sha256.Sum256([]byte(data))
+
+	return &build.Image{
+		ReadCloser: seekableImage{bytes.NewReader([]byte(data))},
+		Size:       int64(len(data)),
+		ModTime:    ImageModTime,
+		SHA256:     hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// SubscribeStatusChanges returns a channel that receives whatever is sent on
+// our Changes, until the given context is cancelled.
+func (m *MockBuilder) SubscribeStatusChanges(ctx context.Context) <-chan build.StatusChange {
+	sub := make(chan build.StatusChange)
+
+	go func() {
+		defer close(sub)
+
+		for {
+			select {
+			case change := <-m.Changes:
+				select {
+				case sub <- change:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return sub
+}
+
+// ActiveBuilds returns our Active.
+func (m *MockBuilder) ActiveBuilds() []build.ActiveBuild {
+	return m.Active
+}
+
+// Render adds the given def to our slice of Rendered, and returns our Rendering
+// and RenderErr.
+func (m *MockBuilder) Render(_ context.Context, def *build.Definition) (*build.Rendering, error) {
+	m.Rendered = append(m.Rendered, def)
+
+	return m.Rendering, m.RenderErr
+}
+
+// Maintenance returns our Maint.
+func (m *MockBuilder) Maintenance() build.MaintenanceStatus {
+	return m.Maint
+}
+
+// SetMaintenance sets the Mode of our Maint and returns it.
+func (m *MockBuilder) SetMaintenance(_ context.Context, mode build.MaintenanceMode) (build.MaintenanceStatus, error) {
+	m.Maint.Mode = mode
+
+	return m.Maint, nil
+}
+
+// Cancel records the given envPath in our Cancelled slice if it matches the Name
+// of one of our Status(), or else returns build.ErrBuildNotRunning.
+func (m *MockBuilder) Cancel(envPath string) error {
+	if !m.known(envPath) {
+		return build.ErrBuildNotRunning
+	}
+
+	m.Cancelled = append(m.Cancelled, envPath)
+
+	return nil
+}
+
+func (m *MockBuilder) known(envPath string) bool {
+	for _, status := range m.Status() {
+		if status.Name == envPath {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Requeue records the given envPath in our Requeued slice and returns our
+// BuildErr if it matches the Name of one of our Status(), or else returns
+// build.ErrUnknownBuild.
+func (m *MockBuilder) Requeue(_ context.Context, envPath string) error {
+	if !m.known(envPath) {
+		return build.ErrUnknownBuild
+	}
+
+	m.Requeued = append(m.Requeued, envPath)
+
+	return m.BuildErr
+}
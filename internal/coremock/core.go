@@ -24,27 +24,45 @@
 package coremock
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"sync"
 )
 
+const (
+	resendEndpoint         = "/resend-pending-builds"
+	uploadChunkEndpoint    = "/upload-chunk"
+	uploadManifestEndpoint = "/upload-manifest"
+)
+
 // MockCore can be used to bring up a simplified core-like service that you can
-// upload and get files from.
+// upload and get files from. Files uploaded in chunks only appear in Files once
+// their manifest has been confirmed. Chunks counts chunk uploads, and the next
+// ChunkFailures of them will only store half their data before failing.
 type MockCore struct {
-	mu    sync.RWMutex
-	Err   error
-	Files map[string]string
+	mu            sync.RWMutex
+	Err           error
+	Files         map[string]string
+	ChunkFailures int
+	Chunks        int
+	chunked       map[string][]byte
 }
 
 // NewMockCore returns a new MockCore with an empty set of Files.
 func NewMockCore() *MockCore {
 	return &MockCore{
-		Files: make(map[string]string),
+		Files:   make(map[string]string),
+		chunked: make(map[string][]byte),
 	}
 }
 
@@ -73,6 +91,21 @@ func (m *MockCore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	switch r.URL.Path {
+	case resendEndpoint:
+		io.WriteString(w, `{"Message":"no pending builds"}`) //nolint:errcheck
+
+		return
+	case uploadChunkEndpoint:
+		m.handleChunk(w, r)
+
+		return
+	case uploadManifestEndpoint:
+		m.handleManifest(w, r)
+
+		return
+	}
+
 	mr, err := r.MultipartReader()
 	if err != nil {
 		return
@@ -95,7 +128,7 @@ func (m *MockCore) readFileFromQuery(mr *multipart.Reader, envPath string) {
 			return
 		}
 
-		name := p.FileName()
+		name := fileName(p)
 
 		buf, err := io.ReadAll(p)
 		if err != nil {
@@ -105,3 +138,91 @@ func (m *MockCore) readFileFromQuery(mr *multipart.Reader, envPath string) {
 		m.setFile(filepath.Join(envPath, name), string(buf))
 	}
 }
+
+// fileName returns the filename of the given part, including any directories,
+// which p.FileName() would strip.
+func fileName(p *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return p.FileName()
+	}
+
+	return filepath.Clean(params["filename"])
+}
+
+func (m *MockCore) handleChunk(w http.ResponseWriter, r *http.Request) {
+	key := filepath.Join(r.URL.Query().Get("envPath"), r.URL.Query().Get("name"))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.Method == http.MethodGet {
+		fmt.Fprintf(w, `{"size":%d}`, len(m.chunked[key]))
+
+		return
+	}
+
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset > len(m.chunked[key]) {
+		http.Error(w, "bad offset", http.StatusBadRequest)
+
+		return
+	}
+
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	m.Chunks++
+
+	if m.ChunkFailures > 0 {
+		m.ChunkFailures--
+		m.chunked[key] = append(m.chunked[key][:offset], buf[:len(buf)/2]...)
+
+		http.Error(w, "connection dropped", http.StatusInternalServerError)
+
+		return
+	}
+
+	m.chunked[key] = append(m.chunked[key][:offset], buf...)
+}
+
+func (m *MockCore) handleManifest(w http.ResponseWriter, r *http.Request) {
+	envPath := r.URL.Query().Get("envPath")
+
+	var manifest struct {
+		Files []struct {
+			Name   string
+			Size   int
+			SHA256 string
+		}
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, file := range manifest.Files {
+		data := m.chunked[filepath.Join(envPath, file.Name)]
+		sum := sha256.Sum256(data)
+
+		if len(data) != file.Size || hex.EncodeToString(sum[:]) != file.SHA256 {
+			http.Error(w, "incomplete upload of "+file.Name, http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	for _, file := range manifest.Files {
+		key := filepath.Join(envPath, file.Name)
+		m.Files[key] = string(m.chunked[key])
+
+		delete(m.chunked, key)
+	}
+}
@@ -0,0 +1,553 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package fsmock
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is a file, directory or symlink in a MockFS.
+type entry struct {
+	mode    fs.FileMode
+	gid     int
+	acl     []string
+	data    []byte
+	target  string
+	modTime time.Time
+}
+
+// MockFS is an in-memory implementation of fsys.FS that can be used to test
+// install and remove logic without touching the real filesystem. Paths can be
+// made unwritable with Deny() to simulate permission failures, and given a
+// limited amount of free space with SetFreeSpace().
+type MockFS struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+	denied  map[string]bool
+	free    map[string]uint64
+}
+
+// New returns a new, empty MockFS containing only the root directory.
+func New() *MockFS {
+	return &MockFS{
+		entries: map[string]*entry{"/": {mode: fs.ModeDir | 0755}},
+		denied:  make(map[string]bool),
+		free:    make(map[string]uint64),
+	}
+}
+
+// SetFreeSpace makes FreeSpace() report the given number of bytes for the
+// given path. Other paths have effectively unlimited free space.
+func (m *MockFS) SetFreeSpace(path string, bytes uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.free[filepath.Clean(path)] = bytes
+}
+
+// FreeSpace implements fsys.FS.
+func (m *MockFS) FreeSpace(path string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = filepath.Clean(path)
+
+	if _, ok := m.entries[path]; !ok {
+		return 0, pathError("statfs", path, fs.ErrNotExist)
+	}
+
+	if free, ok := m.free[path]; ok {
+		return free, nil
+	}
+
+	return math.MaxUint64, nil
+}
+
+// Deny makes the given path unwritable: attempts to create or remove things
+// inside it, or to change it, will fail with a permission error.
+func (m *MockFS) Deny(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.denied[filepath.Clean(path)] = true
+}
+
+// Allow undoes a previous Deny().
+func (m *MockFS) Allow(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.denied, filepath.Clean(path))
+}
+
+// ReadFile returns the contents of the file at the given path.
+func (m *MockFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[filepath.Clean(name)]
+	if !ok || e.mode.IsDir() {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	}
+
+	return e.data, nil
+}
+
+// Readlink returns the target of the symlink at the given path.
+func (m *MockFS) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[filepath.Clean(name)]
+	if !ok || e.mode&fs.ModeSymlink == 0 {
+		return "", pathError("readlink", name, fs.ErrNotExist)
+	}
+
+	return e.target, nil
+}
+
+// Mode returns the mode of the given path.
+func (m *MockFS) Mode(name string) (fs.FileMode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[filepath.Clean(name)]
+	if !ok {
+		return 0, pathError("stat", name, fs.ErrNotExist)
+	}
+
+	return e.mode, nil
+}
+
+// Group returns the gid set on the given path with Chown().
+func (m *MockFS) Group(name string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[filepath.Clean(name)]
+	if !ok {
+		return 0, pathError("stat", name, fs.ErrNotExist)
+	}
+
+	return e.gid, nil
+}
+
+// ACL returns the ACL entries set on the given path with SetACL().
+func (m *MockFS) ACL(name string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[filepath.Clean(name)]
+	if !ok {
+		return nil, pathError("getfacl", name, fs.ErrNotExist)
+	}
+
+	return e.acl, nil
+}
+
+// Exists implements fsys.FS, returning true if something exists at the given
+// path.
+func (m *MockFS) Exists(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.entries[filepath.Clean(name)]
+
+	return ok
+}
+
+// MkdirAll implements fsys.FS.
+func (m *MockFS) MkdirAll(path string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mkdirAll(filepath.Clean(path), perm)
+}
+
+// mkdirAll must be called with the lock held.
+func (m *MockFS) mkdirAll(path string, perm fs.FileMode) error {
+	if e, ok := m.entries[path]; ok {
+		if e.mode.IsDir() {
+			return nil
+		}
+
+		return pathError("mkdir", path, fs.ErrExist)
+	}
+
+	if err := m.mkdirAll(filepath.Dir(path), perm); err != nil {
+		return err
+	}
+
+	if err := m.checkParentWritable("mkdir", path); err != nil {
+		return err
+	}
+
+	m.entries[path] = &entry{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+
+	return nil
+}
+
+// Chmod implements fsys.FS.
+func (m *MockFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.changeableEntry("chmod", name)
+	if err != nil {
+		return err
+	}
+
+	e.mode = e.mode.Type() | mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)
+
+	return nil
+}
+
+// Chown implements fsys.FS. Only the gid is recorded, and a gid of -1 leaves it
+// unchanged.
+func (m *MockFS) Chown(name string, _, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.changeableEntry("chown", name)
+	if err != nil {
+		return err
+	}
+
+	if gid != -1 {
+		e.gid = gid
+	}
+
+	return nil
+}
+
+// SetACL implements fsys.FS, appending the given entries to those previously
+// set on the path.
+func (m *MockFS) SetACL(name string, entries []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.changeableEntry("setfacl", name)
+	if err != nil {
+		return err
+	}
+
+	e.acl = append(e.acl, entries...)
+
+	return nil
+}
+
+// changeableEntry returns the entry at the given path, or an error if it
+// doesn't exist or has been denied. Must be called with the lock held.
+func (m *MockFS) changeableEntry(op, name string) (*entry, error) {
+	name = filepath.Clean(name)
+
+	e, ok := m.entries[name]
+	if !ok {
+		return nil, pathError(op, name, fs.ErrNotExist)
+	}
+
+	if m.denied[name] {
+		return nil, pathError(op, name, fs.ErrPermission)
+	}
+
+	return e, nil
+}
+
+// Open implements fsys.FS.
+func (m *MockFS) Open(name string) (io.ReadCloser, error) {
+	data, err := m.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// OpenFile implements fsys.FS. Only writing is supported; the returned
+// WriteCloser's data is stored in the MockFS when it is closed.
+func (m *MockFS) OpenFile(name string, flag int, perm fs.FileMode) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+
+	if err := m.checkParentWritable("open", name); err != nil {
+		return nil, err
+	}
+
+	if e, ok := m.entries[name]; ok {
+		if flag&os.O_EXCL != 0 {
+			return nil, pathError("open", name, fs.ErrExist)
+		}
+
+		if e.mode.IsDir() {
+			return nil, pathError("open", name, fs.ErrInvalid)
+		}
+	} else if flag&os.O_CREATE == 0 {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	}
+
+	m.entries[name] = &entry{mode: perm.Perm(), modTime: time.Now()}
+
+	return &file{fs: m, name: name}, nil
+}
+
+// Symlink implements fsys.FS.
+func (m *MockFS) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newname = filepath.Clean(newname)
+
+	if err := m.checkParentWritable("symlink", newname); err != nil {
+		return err
+	}
+
+	if _, ok := m.entries[newname]; ok {
+		return pathError("symlink", newname, fs.ErrExist)
+	}
+
+	m.entries[newname] = &entry{mode: fs.ModeSymlink | 0777, target: oldname, modTime: time.Now()}
+
+	return nil
+}
+
+// Rename implements fsys.FS. Renaming a directory moves everything in it.
+func (m *MockFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+
+	if _, ok := m.entries[oldpath]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+
+	for _, p := range [...]string{oldpath, newpath} {
+		if err := m.checkParentWritable("rename", p); err != nil {
+			return err
+		}
+	}
+
+	if e, ok := m.entries[newpath]; ok && e.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+	}
+
+	moved := make(map[string]*entry)
+
+	for p, e := range m.entries {
+		if p == oldpath {
+			moved[newpath] = e
+		} else if rest, ok := strings.CutPrefix(p, oldpath+string(filepath.Separator)); ok {
+			moved[filepath.Join(newpath, rest)] = e
+		} else {
+			continue
+		}
+
+		delete(m.entries, p)
+	}
+
+	for p, e := range moved {
+		m.entries[p] = e
+	}
+
+	return nil
+}
+
+// Remove implements fsys.FS.
+func (m *MockFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+
+	e, ok := m.entries[name]
+	if !ok {
+		return pathError("remove", name, fs.ErrNotExist)
+	}
+
+	if err := m.checkParentWritable("remove", name); err != nil {
+		return err
+	}
+
+	if e.mode.IsDir() && len(m.children(name)) > 0 {
+		return pathError("remove", name, fs.ErrExist)
+	}
+
+	delete(m.entries, name)
+
+	return nil
+}
+
+// RemoveAll implements fsys.FS.
+func (m *MockFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = filepath.Clean(path)
+
+	if _, ok := m.entries[path]; !ok {
+		return nil
+	}
+
+	if err := m.checkParentWritable("unlinkat", path); err != nil {
+		return err
+	}
+
+	for p := range m.entries {
+		if p == path || strings.HasPrefix(p, path+string(filepath.Separator)) {
+			delete(m.entries, p)
+		}
+	}
+
+	return nil
+}
+
+// ReadDir implements fsys.FS.
+func (m *MockFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+
+	e, ok := m.entries[name]
+	if !ok {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	}
+
+	if !e.mode.IsDir() {
+		return nil, pathError("readdirent", name, fs.ErrInvalid)
+	}
+
+	children := m.children(name)
+	entries := make([]fs.DirEntry, len(children))
+
+	for n, child := range children {
+		entries[n] = fs.FileInfoToDirEntry(&fileInfo{name: filepath.Base(child), entry: *m.entries[child]})
+	}
+
+	return entries, nil
+}
+
+// CheckWritable implements fsys.FS.
+func (m *MockFS) CheckWritable(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path = filepath.Clean(path)
+
+	if _, ok := m.entries[path]; !ok {
+		return fs.ErrNotExist
+	}
+
+	if m.denied[path] {
+		return fs.ErrPermission
+	}
+
+	return nil
+}
+
+// checkParentWritable returns an error if the parent directory of the given
+// path doesn't exist or has been denied. Must be called with the lock held.
+func (m *MockFS) checkParentWritable(op, path string) error {
+	parent := filepath.Dir(path)
+	if parent == path {
+		return nil
+	}
+
+	e, ok := m.entries[parent]
+	if !ok || !e.mode.IsDir() {
+		return pathError(op, path, fs.ErrNotExist)
+	}
+
+	if m.denied[parent] {
+		return pathError(op, path, fs.ErrPermission)
+	}
+
+	return nil
+}
+
+// children returns the sorted paths of the direct children of the given
+// directory. Must be called with the lock held.
+func (m *MockFS) children(dir string) []string {
+	var children []string
+
+	for p := range m.entries {
+		if p != dir && filepath.Dir(p) == dir {
+			children = append(children, p)
+		}
+	}
+
+	sort.Strings(children)
+
+	return children
+}
+
+func pathError(op, path string, err error) error {
+	return &fs.PathError{Op: op, Path: path, Err: err}
+}
+
+// file is the io.WriteCloser returned by MockFS.OpenFile().
+type file struct {
+	bytes.Buffer
+	fs   *MockFS
+	name string
+}
+
+// Close stores the written data in the MockFS.
+func (f *file) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	e, ok := f.fs.entries[f.name]
+	if !ok {
+		return pathError("close", f.name, fs.ErrClosed)
+	}
+
+	e.data = f.Bytes()
+
+	return nil
+}
+
+// fileInfo implements fs.FileInfo for entries.
+type fileInfo struct {
+	name string
+	entry
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return int64(len(f.data)) }
+func (f *fileInfo) Mode() fs.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *fileInfo) Sys() any           { return nil }
@@ -0,0 +1,144 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package fsys
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// FS describes the filesystem operations used to install and remove
+// environments, so that they can be carried out on something other than the
+// real filesystem, eg. an in-memory one during testing.
+type FS interface {
+	MkdirAll(path string, perm fs.FileMode) error
+	Chmod(name string, mode fs.FileMode) error
+	Chown(name string, uid, gid int) error
+	SetACL(name string, entries []string) error
+	Open(name string) (io.ReadCloser, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (io.WriteCloser, error)
+	Symlink(oldname, newname string) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	ReadDir(name string) ([]fs.DirEntry, error)
+	CheckWritable(path string) error
+	Exists(name string) bool
+	FreeSpace(path string) (uint64, error)
+}
+
+// OS implements FS using the real filesystem.
+type OS struct{}
+
+// MkdirAll calls os.MkdirAll.
+func (OS) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// Chmod calls os.Chmod.
+func (OS) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+// Chown calls os.Chown.
+func (OS) Chown(name string, uid, gid int) error {
+	return os.Chown(name, uid, gid)
+}
+
+// SetACL modifies the POSIX ACL of the given path by running `setfacl -m` with
+// the given entries, eg. "g:group:rwx".
+func (OS) SetACL(name string, entries []string) error {
+	out, err := exec.Command("setfacl", "-m", strings.Join(entries, ","), name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("setfacl failed for %s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// Open calls os.Open.
+func (OS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+// OpenFile calls os.OpenFile.
+func (OS) OpenFile(name string, flag int, perm fs.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+// Symlink calls os.Symlink.
+func (OS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+// Rename calls os.Rename.
+func (OS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Remove calls os.Remove.
+func (OS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// RemoveAll calls os.RemoveAll.
+func (OS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// ReadDir calls os.ReadDir.
+func (OS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// CheckWritable returns an error if the current user can't write to the given
+// path.
+func (OS) CheckWritable(path string) error {
+	return unix.Access(path, unix.W_OK)
+}
+
+// Exists returns true if os.Lstat() finds something at the given path.
+func (OS) Exists(name string) bool {
+	_, err := os.Lstat(name)
+
+	return err == nil
+}
+
+// FreeSpace returns the number of bytes available to unprivileged users on the
+// filesystem containing the given path.
+func (OS) FreeSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil //nolint:unconvert
+}
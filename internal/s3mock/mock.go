@@ -24,9 +24,11 @@
 package s3mock
 
 import (
+	"context"
 	"io"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/wtsi-hgi/go-softpack-builder/core"
 	"github.com/wtsi-hgi/go-softpack-builder/internal"
@@ -35,27 +37,44 @@ import (
 const ErrS3Mock = internal.Error("Mock S3 error")
 
 // MockS3 can be used to test a build.Builder by implementing the build.S3
-// interface.
+// interface. Everything uploaded is kept in Files, keyed on path.
 type MockS3 struct {
 	Data        string
 	Def         string
 	SoftpackYML string
 	Readme      string
 	Fail        bool
+	NoLog       bool
 	Exes        string
+	Logs        map[string]string
+	Files       map[string]string
+
+	mu sync.Mutex
 }
 
 // UploadData implements the build.S3 interface.
-func (m *MockS3) UploadData(data io.Reader, dest string) error {
+func (m *MockS3) UploadData(ctx context.Context, data io.Reader, dest string) error {
 	if m.Fail {
 		return ErrS3Mock
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	buff, err := io.ReadAll(data)
 	if err != nil {
 		return err
 	}
 
+	m.mu.Lock()
+	if m.Files == nil {
+		m.Files = make(map[string]string)
+	}
+
+	m.Files[dest] = string(buff)
+	m.mu.Unlock()
+
 	switch filepath.Ext(dest) {
 	case ".def":
 		m.Data = string(buff)
@@ -70,12 +89,16 @@ func (m *MockS3) UploadData(data io.Reader, dest string) error {
 }
 
 // OpenFile implements the build.S3 interface.
-func (m *MockS3) OpenFile(source string) (io.ReadCloser, error) {
+func (m *MockS3) OpenFile(ctx context.Context, source string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if filepath.Base(source) == core.ExesBasename {
 		return io.NopCloser(strings.NewReader(m.Exes)), nil
 	}
 
-	if filepath.Base(source) == core.BuilderOut {
+	if filepath.Base(source) == core.BuilderOut && !m.NoLog {
 		return io.NopCloser(strings.NewReader("output")), nil
 	}
 
@@ -87,5 +110,105 @@ func (m *MockS3) OpenFile(source string) (io.ReadCloser, error) {
 		return io.NopCloser(strings.NewReader("image")), nil
 	}
 
+	if filepath.Base(source) == core.SoftpackYaml && m.SoftpackYML != "" {
+		return io.NopCloser(strings.NewReader(m.SoftpackYML)), nil
+	}
+
+	if filepath.Base(source) == core.UsageBasename && m.Readme != "" {
+		return io.NopCloser(strings.NewReader(m.Readme)), nil
+	}
+
+	if log, ok := m.Logs[filepath.Base(source)]; ok && filepath.Base(filepath.Dir(source)) == "logs" {
+		return io.NopCloser(strings.NewReader(log)), nil
+	}
+
+	if filepath.Base(source) == core.SingularityDefBasename && source == m.Def {
+		return io.NopCloser(strings.NewReader(m.Data)), nil
+	}
+
+	m.mu.Lock()
+	data, ok := m.Files[source]
+	m.mu.Unlock()
+
+	if ok {
+		return io.NopCloser(strings.NewReader(data)), nil
+	}
+
 	return nil, io.ErrUnexpectedEOF
 }
+
+// CopyFile implements the build.s3Copier interface, behaving like OpenFile()ing
+// the source and UploadData()ing it to the dest.
+func (m *MockS3) CopyFile(ctx context.Context, source, dest string) error {
+	rc, err := m.OpenFile(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	defer rc.Close()
+
+	return m.UploadData(ctx, rc, dest)
+}
+
+// RemoveFile deletes the given path from our Files. Like deleting from a real
+// bucket, removing something that isn't there is not an error.
+func (m *MockS3) RemoveFile(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.Files, path)
+
+	return nil
+}
+
+// RemovePrefix implements the build.S3PrefixRemover interface, deleting all our
+// Files within the given directory and its subdirectories.
+func (m *MockS3) RemovePrefix(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix := filepath.Clean(dir) + "/"
+
+	for path := range m.Files {
+		if strings.HasPrefix(path, prefix) {
+			delete(m.Files, path)
+		}
+	}
+
+	return nil
+}
+
+// ListFiles implements the build.s3Lister interface, returning the names of
+// the Logs when asked about a logs directory.
+func (m *MockS3) ListFiles(dir string) ([]string, error) {
+	if filepath.Base(dir) != "logs" {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(m.Logs))
+
+	for name := range m.Logs {
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// TreeSizes implements the build.S3Sizer interface, returning the sizes of our
+// Files within the given directory and its subdirectories, keyed on their paths
+// relative to it.
+func (m *MockS3) TreeSizes(dir string) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix := filepath.Clean(dir) + "/"
+	sizes := make(map[string]int64)
+
+	for path, data := range m.Files {
+		if rel, ok := strings.CutPrefix(path, prefix); ok {
+			sizes[rel] = int64(len(data))
+		}
+	}
+
+	return sizes, nil
+}
@@ -24,6 +24,7 @@
 package wrmock
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -34,6 +35,13 @@ import (
 type MockWR struct {
 	Cmd                   string
 	Fail                  bool
+	FailTransient         bool
+	KeepFailing           bool
+	StdErr                string
+	Kicks                 int
+	Kills                 int
+	KillErr               error
+	QueueLoad             *wr.Load
 	PollForStatusInterval time.Duration
 	JobDuration           time.Duration
 
@@ -85,7 +93,7 @@ func (m *MockWR) GetLastCmd() string {
 }
 
 // WaitForRunning implements build.Runner interface.
-func (m *MockWR) WaitForRunning(string) error { //nolint:unparam
+func (m *MockWR) WaitForRunning(ctx context.Context, _ string) error {
 	for {
 		m.RLock()
 		rs := m.ReturnStatus
@@ -95,21 +103,98 @@ func (m *MockWR) WaitForRunning(string) error { //nolint:unparam
 			return nil
 		}
 
-		<-time.After(m.PollForStatusInterval)
+		select {
+		case <-time.After(m.PollForStatusInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
 // Wait implements build.Runner interface.
-func (m *MockWR) Wait(string) (wr.WRJobStatus, error) { //nolint:unparam
-	<-time.After(m.JobDuration)
+func (m *MockWR) Wait(ctx context.Context, _ string) (wr.WRJobStatus, error) {
+	select {
+	case <-time.After(m.JobDuration):
+	case <-ctx.Done():
+		return wr.WRJobStatusInvalid, ctx.Err()
+	}
+
+	m.Lock()
+	defer m.Unlock()
 
 	if m.Fail {
+		m.ReturnStatus = wr.WRJobStatusBuried
+
 		return wr.WRJobStatusBuried, nil
 	}
 
+	m.ReturnStatus = wr.WRJobStatusComplete
+
 	return wr.WRJobStatusComplete, nil
 }
 
+// Kick implements build.Runner interface. It counts the kicks, and the kicked
+// job will then succeed, unless KeepFailing is set.
+func (m *MockWR) Kick(string) error { //nolint:unparam
+	m.Lock()
+	defer m.Unlock()
+
+	m.Kicks++
+	m.Fail = m.KeepFailing
+	m.ReturnStatus = wr.WRJobStatusRunning
+
+	return nil
+}
+
+// Kill implements build.Runner interface. It counts the kills, and returns
+// KillErr if set, otherwise the job no longer exists afterwards.
+func (m *MockWR) Kill(context.Context, string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.KillErr != nil {
+		return m.KillErr
+	}
+
+	m.Kills++
+	m.ReturnStatus = wr.WRJobStatusInvalid
+
+	return nil
+}
+
+// DetailedStatus implements build.Runner interface.
+func (m *MockWR) DetailedStatus(string) (*wr.JobDetails, error) { //nolint:unparam
+	m.RLock()
+	defer m.RUnlock()
+
+	details := &wr.JobDetails{State: m.ReturnStatus.String()}
+
+	if m.ReturnStatus == wr.WRJobStatusComplete || m.ReturnStatus == wr.WRJobStatusBuried {
+		details.Exited = true
+	}
+
+	if m.ReturnStatus == wr.WRJobStatusBuried {
+		details.Exitcode = 1
+		details.FailReason = "command exited non-zero"
+
+		if m.FailTransient {
+			details.FailReason = "lost contact with runner"
+		}
+
+		details.StdErr = m.StdErr
+	}
+
+	return details, nil
+}
+
+// Load returns our QueueLoad, letting a build.Builder estimate queue waits.
+func (m *MockWR) Load() (*wr.Load, error) { //nolint:unparam
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.QueueLoad, nil
+}
+
 // Status implements build.Runner interface.
 func (m *MockWR) Status(string) (wr.WRJobStatus, error) { //nolint:unparam
 	m.RLock()
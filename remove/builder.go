@@ -0,0 +1,29 @@
+package remove
+
+import (
+	"context"
+
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+)
+
+// Builder is a build.Builder that can also Remove() environments, eg. for a
+// server's removal endpoint.
+type Builder struct {
+	*build.Builder
+	conf *config.Config
+	s3r  s3Remover
+}
+
+// NewBuilder returns a Builder that removes environments with Remove(), using
+// the given config and S3.
+func NewBuilder(b *build.Builder, conf *config.Config, s3r s3Remover) *Builder {
+	return &Builder{Builder: b, conf: conf, s3r: s3r}
+}
+
+// Remove removes the given environment (a path like "users/foo/env") and
+// version like Remove() does, returning a report of what was removed.
+// Protected environments are only removed given the right overrideToken.
+func (b *Builder) Remove(ctx context.Context, envPath, version, overrideToken string) (*build.RemovalReport, error) {
+	return Remove(ctx, b.conf, b.s3r, envPath, version, Options{OverrideToken: overrideToken})
+}
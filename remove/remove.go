@@ -1,8 +1,10 @@
 package remove
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -10,27 +12,33 @@ import (
 	"github.com/wtsi-hgi/go-softpack-builder/build"
 	"github.com/wtsi-hgi/go-softpack-builder/config"
 	"github.com/wtsi-hgi/go-softpack-builder/core"
-	"golang.org/x/sys/unix"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
 )
 
-var s3BasenamesForDeletion = [...]string{ //nolint:gochecknoglobals
-	core.SingularityDefBasename,
-	core.ExesBasename,
-	core.SoftpackYaml,
-	core.SpackLockFile,
-	core.BuilderOut,
-	core.UsageBasename,
-	core.ImageBasename,
-}
-
 type Error string
 
 func (e Error) Error() string {
 	return string(e)
 }
 
+const (
+	ErrProtected = Error("environment is protected against removal")
+
+	stagedSuffix = ".removing"
+)
+
+// Options changes how Remove() behaves. OverrideToken allows the removal of a
+// protected environment, if it matches the configured protection
+// overrideToken. DryRun only reports what would be removed.
+type Options struct {
+	OverrideToken string
+	DryRun        bool
+}
+
 type s3Remover interface {
 	RemoveFile(string) error
+	OpenFile(ctx context.Context, source string) (io.ReadCloser, error)
+	UploadData(ctx context.Context, data io.Reader, dest string) error
 }
 
 const graphQLDeleteEnvironment = `mutation ($name: String!, $envPath: String!) {
@@ -60,16 +68,136 @@ type graphQLDeleteEnvironmentMutation struct {
 }
 
 // Remove will attempt to remove an environments artefacts from Core, S3, and
-// the installed locations.
-func Remove(conf *config.Config, s3r s3Remover, envPath, version string) error {
+// the installed locations. The context applies to the request to Core. It
+// returns a report of everything that was removed, or with Options.DryRun,
+// everything that would be removed, without removing anything.
+//
+// The environment is removed from core last, and its installed files are put
+// back if that fails. If the config's trash is enabled, the installed files and
+// S3 artefacts are moved in to the trash instead of being deleted, so that they
+// can be put back with Restore() using the report's TrashID, and trash older
+// than the configured retention is purged. The environment's installed image stops
+// counting against the configured quotas when it is deleted or purged.
+//
+// Environments that have been protected are not removed, returning an error
+// that Is() ErrProtected, unless the given Options has the right
+// OverrideToken.
+func Remove(ctx context.Context, conf *config.Config, s3r s3Remover, envPath, version string,
+	opts Options) (*build.RemovalReport, error) {
+	return removeFrom(ctx, fsys.OS{}, conf, s3r, envPath, version, opts)
+}
+
+// removeFrom does the work of Remove(), removing installed files from the
+// given filesystem.
+func removeFrom(ctx context.Context, fs fsys.FS, conf *config.Config, s3r s3Remover, envPath, version string,
+	opts Options) (*build.RemovalReport, error) {
+	sizer, _ := s3r.(build.S3Sizer)
+
+	report, err := build.PlanRemoval(fs, conf, sizer, envPath, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.DryRun {
+		report.DryRun = true
+
+		return report, nil
+	}
+
 	envDir, envName := filepath.Split(envPath)
 	modulePath := build.ModuleDirFromName(conf.Module.ModuleInstallDir, envDir, envName)
-	scriptPath := build.ScriptsDirFromNameAndVersion(conf.Module.ScriptsInstallDir, envDir, envName, version)
 
-	if err := checkWriteAccess(modulePath, scriptPath); err != nil {
-		return err
+	if err = checkWriteAccess(fs, modulePath, report.ScriptsDir); err != nil {
+		return nil, err
+	}
+
+	if err = checkProtection(conf, report, opts.OverrideToken); err != nil {
+		return nil, err
+	}
+
+	if conf.Trash.Enabled() {
+		return trashAndRemoveFromCore(ctx, fs, conf, s3r, report, envPath, version, modulePath)
+	}
+
+	staged, err := stageLocalFiles(fs, modulePath, version, report.ScriptsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = removeFromCore(ctx, conf, envPath, version); err != nil {
+		return nil, errors.Join(err, staged.unstage(fs))
+	}
+
+	if err = removeEverywhere(fs, conf, s3r, report, envPath, version, modulePath, staged); err != nil {
+		return nil, err
+	}
+
+	releaseQuotaImage(conf, report.Environment)
+
+	return report, nil
+}
+
+// trashAndRemoveFromCore moves the environment described by the given report
+// in to the trash, then removes it from core, putting it back if that fails.
+func trashAndRemoveFromCore(ctx context.Context, fs fsys.FS, conf *config.Config, s3r s3Remover,
+	report *build.RemovalReport, envPath, version, modulePath string) (*build.RemovalReport, error) {
+	if err := trashEverything(ctx, fs, conf, s3r, report, envPath, version, modulePath); err != nil {
+		return nil, err
+	}
+
+	if err := removeFromCore(ctx, conf, envPath, version); err != nil {
+		return nil, errors.Join(err, untrashID(ctx, fs, conf, s3r, report.TrashID))
+	}
+
+	purgeExpiredTrash(fs, conf, s3r)
+
+	return report, nil
+}
+
+// stagedFiles records where stageLocalFiles() moved an environment's module
+// file and scripts dir.
+type stagedFiles struct {
+	moduleFile, stagedModule  string
+	scriptsDir, stagedScripts string
+}
+
+// stageLocalFiles moves the module file of the given version in the given
+// module dir, and the given scripts dir, to hidden names beside them, so that
+// they are no longer used but can be put back if removal from core fails.
+func stageLocalFiles(fs fsys.FS, modulePath, version, scriptsDir string) (*stagedFiles, error) {
+	staged := &stagedFiles{
+		moduleFile:    filepath.Join(modulePath, version),
+		stagedModule:  filepath.Join(modulePath, "."+version+stagedSuffix),
+		scriptsDir:    scriptsDir,
+		stagedScripts: filepath.Join(filepath.Dir(scriptsDir), "."+filepath.Base(scriptsDir)+stagedSuffix),
+	}
+
+	if err := fs.Rename(staged.moduleFile, staged.stagedModule); err != nil {
+		return nil, err
+	}
+
+	if err := fs.Rename(staged.scriptsDir, staged.stagedScripts); err != nil {
+		return nil, errors.Join(err, fs.Rename(staged.stagedModule, staged.moduleFile))
 	}
 
+	return staged, nil
+}
+
+// unstage moves the staged files back to where they were.
+func (s *stagedFiles) unstage(fs fsys.FS) error {
+	return errors.Join(fs.Rename(s.stagedScripts, s.scriptsDir), fs.Rename(s.stagedModule, s.moduleFile))
+}
+
+// releaseQuotaImage stops the installed image of the given environment counting
+// against its quotas, only logging any failure to do so.
+func releaseQuotaImage(conf *config.Config, environment string) {
+	if err := build.ReleaseQuotaImage(conf.Quotas, environment); err != nil {
+		slog.Warn("failed to release quota usage", "env", environment, "err", err)
+	}
+}
+
+// removeFromCore deletes the given environment from core.
+func removeFromCore(ctx context.Context, conf *config.Config, envPath, version string) error {
 	slog.Info(fmt.Sprintf("removing env %s from core\n", envPath))
 
 	core, err := core.New(conf)
@@ -77,19 +205,29 @@ func Remove(conf *config.Config, s3r s3Remover, envPath, version string) error {
 		return err
 	}
 
-	err = core.Delete(envPath + "-" + version)
-	if err != nil {
+	return core.Delete(ctx, envPath+"-"+version)
+}
+
+// removeEverywhere removes the environment described by the given report,
+// whose local files have been staged, from the given filesystem and S3.
+func removeEverywhere(fs fsys.FS, conf *config.Config, s3r s3Remover, report *build.RemovalReport,
+	envPath, version, modulePath string, staged *stagedFiles) error {
+	if err := removeLocalFiles(fs, conf, modulePath, staged); err != nil {
+		return err
+	}
+
+	if err := removeKernelSpecs(fs, conf.Module.KernelsDir, envPath, version); err != nil {
 		return err
 	}
 
-	if err := removeLocalFiles(modulePath, version, scriptPath); err != nil {
+	if err := removeMetadataCache(fs, conf.Server.MetadataCacheDir, envPath, version); err != nil {
 		return err
 	}
 
-	return removeFromS3(s3r, modulePath)
+	return removeFromS3(s3r, report.S3Objects, filepath.Join(envPath, version))
 }
 
-func checkWriteAccess(modulePath, scriptPath string) error {
+func checkWriteAccess(fs fsys.FS, modulePath, scriptPath string) error {
 	for _, p := range [...]string{
 		filepath.Dir(modulePath),
 		modulePath,
@@ -97,7 +235,7 @@ func checkWriteAccess(modulePath, scriptPath string) error {
 		filepath.Dir(scriptPath),
 		scriptPath,
 	} {
-		if err := unix.Access(p, unix.W_OK); err != nil {
+		if err := fs.CheckWritable(p); err != nil {
 			return Error(fmt.Sprintf("no write access to dir (%s): %s", p, err))
 		}
 	}
@@ -105,26 +243,82 @@ func checkWriteAccess(modulePath, scriptPath string) error {
 	return nil
 }
 
-func removeLocalFiles(modulePath, version, scriptPath string) error {
-	if err := removeAndParentIfEmpty(modulePath, version); err != nil {
+// checkProtection returns an error that Is() ErrProtected if the environment
+// of the given report is protected and the given token doesn't override that.
+func checkProtection(conf *config.Config, report *build.RemovalReport, token string) error {
+	if report.Protection == nil {
+		return nil
+	}
+
+	if conf.Protection.Overridden(token) {
+		slog.Warn("removing protected environment", "env", report.Environment,
+			"reason", report.Protection.Reason)
+
+		return nil
+	}
+
+	return fmt.Errorf("%w (%s); supply the override token to remove it anyway", ErrProtected, report.Protection.Reason)
+}
+
+func removeLocalFiles(fs fsys.FS, conf *config.Config, modulePath string, staged *stagedFiles) error {
+	if err := removeAndParentIfEmpty(fs, conf, modulePath, staged.stagedModule); err != nil {
 		return err
 	}
 
-	return removeAllNoDescend(scriptPath)
+	return removeAllNoDescend(fs, staged.stagedScripts)
 }
 
-func removeAndParentIfEmpty(modulePath, version string) error {
-	if err := os.Remove(filepath.Join(modulePath, version)); err != nil {
+// removeKernelSpecs removes any Jupyter kernel specs installed for the
+// environment in the given kernels directory.
+func removeKernelSpecs(fs fsys.FS, kernelsDir, envPath, version string) error {
+	if kernelsDir == "" {
+		return nil
+	}
+
+	for _, dir := range build.KernelSpecDirs(kernelsDir, envPath, version) {
+		if err := fs.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeMetadataCache removes any cached metadata of the environment in the
+// given metadata cache directory.
+func removeMetadataCache(fs fsys.FS, cacheDir, envPath, version string) error {
+	if cacheDir == "" {
+		return nil
+	}
+
+	return fs.RemoveAll(build.MetadataCacheDir(cacheDir, envPath, version))
+}
+
+// removeAndParentIfEmpty removes the given module file, updating the
+// environment's default version if configured, then removes the environment's
+// module directory if that leaves it empty.
+func removeAndParentIfEmpty(fs fsys.FS, conf *config.Config, modulePath, moduleFile string) error {
+	if err := fs.Remove(moduleFile); err != nil {
+		return err
+	}
+
+	return tidyModuleDir(fs, conf, modulePath)
+}
+
+// tidyModuleDir updates the default version in the given environment module
+// directory if configured, then removes the directory if it's empty.
+func tidyModuleDir(fs fsys.FS, conf *config.Config, modulePath string) error {
+	if err := build.UpdateDefaultVersion(fs, conf, modulePath); err != nil {
 		return err
 	}
 
-	os.Remove(modulePath) // error deliberately ignored.
+	fs.Remove(modulePath) // error deliberately ignored.
 
 	return nil
 }
 
-func removeAllNoDescend(path string) error {
-	files, err := os.ReadDir(path)
+func removeAllNoDescend(fs fsys.FS, path string) error {
+	files, err := fs.ReadDir(path)
 	if err != nil {
 		return err
 	}
@@ -134,23 +328,31 @@ func removeAllNoDescend(path string) error {
 
 		slog.Info(fmt.Sprintf("Removing file: %s\n", toRemove))
 
-		if err := os.Remove(toRemove); err != nil {
+		if err := fs.Remove(toRemove); err != nil {
 			return err
 		}
 	}
 
 	slog.Info(fmt.Sprintf("Removing directory: %s\n", path))
 
-	return os.Remove(path)
+	return fs.Remove(path)
 }
 
-func removeFromS3(s3r s3Remover, path string) error {
-	for _, file := range s3BasenamesForDeletion {
-		toRemove := filepath.Join(path, file)
+// removeFromS3 removes everything in the given S3 build location if our S3
+// supports that, so that files created since the removal was planned aren't
+// left behind. Otherwise it removes the given objects, ignoring any that don't
+// exist.
+func removeFromS3(s3r s3Remover, objects []build.RemovedFile, s3Path string) error {
+	if pr, ok := s3r.(build.S3PrefixRemover); ok {
+		slog.Info(fmt.Sprintf("Removing everything from S3 in: %s\n", s3Path))
+
+		return pr.RemovePrefix(s3Path)
+	}
 
-		slog.Info(fmt.Sprintf("Removing file from S3: %s\n", toRemove))
+	for _, obj := range objects {
+		slog.Info(fmt.Sprintf("Removing file from S3: %s\n", obj.Path))
 
-		if err := s3r.RemoveFile(toRemove); err != nil && !errors.Is(err, os.ErrNotExist) {
+		if err := s3r.RemoveFile(obj.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
 			return err
 		}
 	}
@@ -1,6 +1,7 @@
 package remove
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"log/slog"
@@ -16,16 +17,12 @@ import (
 	"github.com/wtsi-hgi/go-softpack-builder/build"
 	"github.com/wtsi-hgi/go-softpack-builder/config"
 	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
 )
 
 const groupsDir = "groups"
 
-type mockS3 struct{}
-
-func (mockS3) RemoveFile(_ string) error {
-	return nil
-}
-
 func TestRemove(t *testing.T) {
 	programLevel := new(slog.LevelVar)
 
@@ -46,7 +43,7 @@ func TestRemove(t *testing.T) {
 
 		conf.CoreURL = mockCore.URL
 
-		s3Mock := new(mockS3)
+		s3Mock := new(s3mock.MockS3)
 
 		Convey("Remove() call fails if the environments module dir or script dir is not removable", func() {
 			for _, p := range [...]string{
@@ -59,7 +56,7 @@ func TestRemove(t *testing.T) {
 				err := os.Chmod(p, 0)
 				So(err, ShouldBeNil)
 
-				err = Remove(conf, s3Mock, envPath, version)
+				_, err = Remove(context.Background(), conf, s3Mock, envPath, version, Options{})
 				So(err, ShouldNotBeNil)
 				So(err.Error(), ShouldEqual, "no write access to dir ("+p+"): permission denied")
 
@@ -79,7 +76,7 @@ func TestRemove(t *testing.T) {
 			err = os.RemoveAll(removing)
 			So(err, ShouldBeNil)
 
-			err = Remove(conf, s3Mock, envPath, version)
+			_, err = Remove(context.Background(), conf, s3Mock, envPath, version, Options{})
 			So(err, ShouldNotBeNil)
 			So(err.Error(), ShouldEqual, "no write access to dir ("+removing+"): no such file or directory")
 
@@ -87,19 +84,35 @@ func TestRemove(t *testing.T) {
 			So(err, ShouldNotBeNil)
 		})
 
+		Convey("Remove() call fails if the environment path or version is invalid", func() {
+			_, err := Remove(context.Background(), conf, s3Mock, filepath.Join(groupsDir, group, "..", env), version,
+				Options{})
+			So(err, ShouldEqual, build.ErrInvalidEnvPath)
+
+			_, err = Remove(context.Background(), conf, s3Mock, envPath, "../"+version, Options{})
+			So(err, ShouldEqual, build.ErrInvalidVersionFormat)
+		})
+
 		Convey("Remove() call fails if environment is not successfully removed from Core", func() {
 			response = core.EnvironmentResponse{
 				Error: "No environment with this name found in this location.",
 			}
 
-			err := Remove(conf, s3Mock, envPath, version)
+			_, err := Remove(context.Background(), conf, s3Mock, envPath, version, Options{})
 			So(err, ShouldNotBeNil)
 			So(err.Error(), ShouldEqual, "No environment with this name found in this location.")
 
 			conf.CoreURL = "http://invalid-url:1234/"
 
-			err = Remove(conf, s3Mock, envPath, version)
+			_, err = Remove(context.Background(), conf, s3Mock, envPath, version, Options{})
 			So(err, ShouldNotBeNil)
+
+			_, err = os.Stat(filepath.Join(conf.Module.ModuleInstallDir, groupsDir, group, env, version))
+			So(err, ShouldBeNil)
+
+			_, err = os.Stat(filepath.Join(conf.Module.ScriptsInstallDir, groupsDir, group, env,
+				version+build.ScriptsDirSuffix))
+			So(err, ShouldBeNil)
 		})
 
 		Convey("Can use Remove() to delete an existing environment", func() {
@@ -111,7 +124,12 @@ func TestRemove(t *testing.T) {
 			scriptsPath := filepath.Join(conf.Module.ScriptsInstallDir, groupsDir, group,
 				env, version+build.ScriptsDirSuffix)
 
-			err := Remove(conf, s3Mock, envPath, version)
+			conf.Quotas.Group.ImageGB = 1
+			conf.Quotas.StateFile = filepath.Join(t.TempDir(), "quotas.json")
+			So(os.WriteFile(conf.Quotas.StateFile, []byte(`{"Images":{"`+envPath+`-`+version+
+				`":{"Accounts":["groups/`+group+`"],"Bytes":5}}}`), 0600), ShouldBeNil)
+
+			_, err := Remove(context.Background(), conf, s3Mock, envPath, version, Options{})
 			So(err, ShouldBeNil)
 
 			_, err = os.Stat(modulePath)
@@ -119,6 +137,25 @@ func TestRemove(t *testing.T) {
 
 			_, err = os.Stat(scriptsPath)
 			So(err, ShouldWrap, os.ErrNotExist)
+
+			data, err := os.ReadFile(conf.Quotas.StateFile)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldNotContainSubstring, env)
+		})
+
+		Convey("A Builder can Remove() an existing environment", func() {
+			response = core.EnvironmentResponse{
+				Message: "Successfully deleted the environment",
+			}
+
+			modulePath := filepath.Join(conf.Module.ModuleInstallDir, groupsDir, group, env)
+
+			report, err := NewBuilder(nil, conf, s3Mock).Remove(context.Background(), envPath, version, "")
+			So(err, ShouldBeNil)
+			So(report.Environment, ShouldEqual, envPath+"-"+version)
+
+			_, err = os.Stat(modulePath)
+			So(err, ShouldWrap, os.ErrNotExist)
 		})
 
 		Convey("Remove() only deletes the environment matching the version specified", func() {
@@ -135,7 +172,7 @@ func TestRemove(t *testing.T) {
 			oldScriptsPath := filepath.Join(scriptsPath, version+build.ScriptsDirSuffix)
 			newScriptsPath := filepath.Join(scriptsPath, newVersion+build.ScriptsDirSuffix)
 
-			err := Remove(conf, s3Mock, envPath, version)
+			_, err := Remove(context.Background(), conf, s3Mock, envPath, version, Options{})
 			So(err, ShouldBeNil)
 
 			_, err = os.Stat(filepath.Join(modulePath, version))
@@ -150,6 +187,164 @@ func TestRemove(t *testing.T) {
 			_, err = os.Stat(newScriptsPath)
 			So(err, ShouldBeNil)
 		})
+
+		Convey("Permission failures can be simulated with an in-memory filesystem", func() {
+			response = core.EnvironmentResponse{
+				Message: "Successfully deleted the environment",
+			}
+
+			mfs := fsmock.New()
+			modulePath := filepath.Join(conf.Module.ModuleInstallDir, groupsDir, group, env)
+			scriptsPath := filepath.Join(conf.Module.ScriptsInstallDir, groupsDir, group,
+				env, version+build.ScriptsDirSuffix)
+
+			So(mfs.MkdirAll(modulePath, 0755), ShouldBeNil)
+			So(mfs.MkdirAll(scriptsPath, 0755), ShouldBeNil)
+
+			f, err := mfs.OpenFile(filepath.Join(modulePath, version), os.O_CREATE|os.O_WRONLY, 0644)
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+
+			mfs.Deny(scriptsPath)
+
+			_, err = removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "no write access to dir ("+scriptsPath+"): permission denied")
+			So(mfs.Exists(filepath.Join(modulePath, version)), ShouldBeTrue)
+
+			mfs.Allow(scriptsPath)
+
+			conf.Module.KernelsDir = "/kernels"
+			conf.Server.MetadataCacheDir = "/metadata"
+			metadataDir := build.MetadataCacheDir(conf.Server.MetadataCacheDir, envPath, version)
+			So(mfs.MkdirAll(metadataDir, 0755), ShouldBeNil)
+			conf.Module.DefaultVersion = config.DefaultVersionLmod
+			So(mfs.Symlink(version, filepath.Join(modulePath, "default")), ShouldBeNil)
+			kernelDir := build.KernelSpecDirs(conf.Module.KernelsDir, envPath, version)[0]
+			So(mfs.MkdirAll(kernelDir, 0755), ShouldBeNil)
+
+			_, err = removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{})
+			So(err, ShouldBeNil)
+			So(mfs.Exists(modulePath), ShouldBeFalse)
+			So(mfs.Exists(scriptsPath), ShouldBeFalse)
+			So(mfs.Exists(kernelDir), ShouldBeFalse)
+			So(mfs.Exists(conf.Module.KernelsDir), ShouldBeTrue)
+			So(mfs.Exists(metadataDir), ShouldBeFalse)
+		})
+
+		Convey("A dry run reports what would be removed, without removing anything", func() {
+			response = core.EnvironmentResponse{
+				Message: "Successfully deleted the environment",
+			}
+
+			mfs := fsmock.New()
+			modulePath := filepath.Join(conf.Module.ModuleInstallDir, groupsDir, group, env)
+			scriptsPath := filepath.Join(conf.Module.ScriptsInstallDir, groupsDir, group,
+				env, version+build.ScriptsDirSuffix)
+			s3Path := filepath.Join(envPath, version)
+
+			So(mfs.MkdirAll(modulePath, 0755), ShouldBeNil)
+			So(mfs.MkdirAll(scriptsPath, 0755), ShouldBeNil)
+
+			conf.Server.MetadataCacheDir = "/metadata"
+			metadataDir := build.MetadataCacheDir(conf.Server.MetadataCacheDir, envPath, version)
+			So(mfs.MkdirAll(metadataDir, 0755), ShouldBeNil)
+
+			for path, content := range map[string]string{
+				filepath.Join(modulePath, version):                      "#%Module",
+				filepath.Join(scriptsPath, core.SingularityDefBasename): "",
+				filepath.Join(scriptsPath, core.ImageBasename):          "image",
+			} {
+				f, err := mfs.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+				So(err, ShouldBeNil)
+				_, err = io.WriteString(f, content)
+				So(err, ShouldBeNil)
+				So(f.Close(), ShouldBeNil)
+			}
+
+			s3Mock.Files = map[string]string{
+				filepath.Join(s3Path, core.ImageBasename):       strings.Repeat("i", 1024),
+				filepath.Join(s3Path, core.SoftpackYaml):        strings.Repeat("y", 20),
+				filepath.Join(s3Path, "logs", "build.log"):      "log",
+				filepath.Join(envPath, "2", core.ImageBasename): "other version",
+			}
+
+			report, err := removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{DryRun: true})
+			So(err, ShouldBeNil)
+			So(report, ShouldResemble, &build.RemovalReport{
+				DryRun:      true,
+				Environment: envPath + "-" + version,
+				S3Objects: []build.RemovedFile{
+					{Path: filepath.Join(s3Path, "logs", "build.log"), Size: 3},
+					{Path: filepath.Join(s3Path, core.ImageBasename), Size: 1024},
+					{Path: filepath.Join(s3Path, core.SoftpackYaml), Size: 20},
+				},
+				ModuleFile: &build.RemovedFile{Path: filepath.Join(modulePath, version), Size: 8},
+				ScriptsDir: scriptsPath,
+				ScriptsFiles: []build.RemovedFile{
+					{Path: filepath.Join(scriptsPath, core.SingularityDefBasename), Size: 0},
+					{Path: filepath.Join(scriptsPath, core.ImageBasename), Size: 5},
+				},
+				MetadataCache: metadataDir,
+			})
+			So(mfs.Exists(filepath.Join(modulePath, version)), ShouldBeTrue)
+			So(mfs.Exists(metadataDir), ShouldBeTrue)
+			So(len(s3Mock.Files), ShouldEqual, 4)
+
+			s3Mock.Files[filepath.Join(s3Path, ".builds", "abc", "builder.out")] = "new build"
+
+			report, err = removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{})
+			So(err, ShouldBeNil)
+			So(report.DryRun, ShouldBeFalse)
+			So(report.ModuleFile, ShouldNotBeNil)
+			So(mfs.Exists(modulePath), ShouldBeFalse)
+			So(s3Mock.Files, ShouldResemble, map[string]string{
+				filepath.Join(envPath, "2", core.ImageBasename): "other version",
+			})
+		})
+
+		Convey("Protected environments can only be removed with the override token", func() {
+			response = core.EnvironmentResponse{
+				Message: "Successfully deleted the environment",
+			}
+
+			mfs := fsmock.New()
+			modulePath := filepath.Join(conf.Module.ModuleInstallDir, groupsDir, group, env)
+			scriptsPath := filepath.Join(conf.Module.ScriptsInstallDir, groupsDir, group,
+				env, version+build.ScriptsDirSuffix)
+
+			So(mfs.MkdirAll(modulePath, 0755), ShouldBeNil)
+			So(mfs.MkdirAll(scriptsPath, 0755), ShouldBeNil)
+
+			for path, content := range map[string]string{
+				filepath.Join(modulePath, version):                   "",
+				filepath.Join(scriptsPath, build.ProtectionBasename): `{"reason":"used by pipelines"}`,
+			} {
+				f, err := mfs.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+				So(err, ShouldBeNil)
+				_, err = io.WriteString(f, content)
+				So(err, ShouldBeNil)
+				So(f.Close(), ShouldBeNil)
+			}
+
+			_, err := removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{})
+			So(err, ShouldWrap, ErrProtected)
+			So(err.Error(), ShouldContainSubstring, "(used by pipelines)")
+			So(mfs.Exists(filepath.Join(modulePath, version)), ShouldBeTrue)
+
+			_, err = removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{OverrideToken: "secret"})
+			So(err, ShouldWrap, ErrProtected)
+
+			conf.Protection.OverrideToken = "secret"
+
+			_, err = removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{OverrideToken: "wrong"})
+			So(err, ShouldWrap, ErrProtected)
+
+			_, err = removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{OverrideToken: "secret"})
+			So(err, ShouldBeNil)
+			So(mfs.Exists(modulePath), ShouldBeFalse)
+			So(mfs.Exists(scriptsPath), ShouldBeFalse)
+		})
 	})
 }
 
@@ -0,0 +1,475 @@
+package remove
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsys"
+)
+
+const (
+	ErrNoTrash         = Error("no trash dir configured")
+	ErrNotInTrash      = Error("no such removed environment in the trash")
+	ErrRestoreConflict = Error("environment has been installed again since it was removed")
+
+	// TrashS3Dir is the directory in the S3 build location that the artefacts
+	// of removed environments are moved in to.
+	TrashS3Dir = "trash"
+
+	trashManifestBasename = "trash.json"
+	trashModuleBasename   = "module"
+	trashScriptsDir       = "scripts"
+	trashKernelsDir       = "kernels"
+	trashIDTimeFormat     = "20060102T150405"
+	trashDirPerms         = 0750
+	trashFilePerms        = 0640
+)
+
+// TrashEntry describes an environment that Remove() moved in to the trash: its
+// ID in the trash, the Environment ("users/foo/env-1"), when it was Removed,
+// and where its ModuleFile, ScriptsDir, KernelSpecs dirs and S3Objects (in its
+// S3Path build location) were, so that Restore() can put them back. Each of
+// those is only recorded once it has been moved in to the trash.
+type TrashEntry struct {
+	ID          string
+	Environment string
+	Removed     time.Time
+	ModuleFile  string
+	ScriptsDir  string
+	KernelSpecs []string
+	S3Path      string
+	S3Objects   []string
+}
+
+// trashID returns a unique ID for the given environment removed at the given
+// time, that sorts by time and is safe to use as a directory name.
+func trashID(environment string, removed time.Time) string {
+	return removed.UTC().Format(trashIDTimeFormat) + "-" + strings.ReplaceAll(environment, "/", "_")
+}
+
+// trashEverything moves the environment described by the given report in to a
+// new entry in the configured trash dir, setting the report's TrashID. If that
+// fails part-way, everything moved so far is put back.
+func trashEverything(ctx context.Context, fs fsys.FS, conf *config.Config, s3r s3Remover,
+	report *build.RemovalReport, envPath, version, modulePath string) error {
+	entry := &TrashEntry{
+		Environment: report.Environment,
+		Removed:     time.Now(),
+		S3Path:      filepath.Join(envPath, version),
+	}
+	entry.ID = trashID(entry.Environment, entry.Removed)
+	entryDir := filepath.Join(conf.Trash.Dir, entry.ID)
+
+	if err := fs.MkdirAll(filepath.Join(entryDir, trashKernelsDir), trashDirPerms); err != nil {
+		return err
+	}
+
+	if err := moveToTrash(ctx, fs, conf, s3r, report, entry, entryDir, envPath, version, modulePath); err != nil {
+		slog.Error("failed to move environment to trash; putting it back", "env", entry.Environment, "err", err)
+
+		return errors.Join(err, untrash(ctx, fs, conf, s3r, entry, entryDir))
+	}
+
+	report.TrashID = entry.ID
+
+	return nil
+}
+
+// moveToTrash does the moves of trashEverything(), rewriting the given entry's
+// manifest after each one, so that if we're interrupted, whatever was moved can
+// still be restored.
+func moveToTrash(ctx context.Context, fs fsys.FS, conf *config.Config, s3r s3Remover,
+	report *build.RemovalReport, entry *TrashEntry, entryDir, envPath, version, modulePath string) error {
+	record := func() error { return writeTrashManifest(fs, entryDir, entry) }
+
+	if err := record(); err != nil {
+		return err
+	}
+
+	if err := trashLocalFiles(fs, conf, entry, entryDir, report, version, modulePath, record); err != nil {
+		return err
+	}
+
+	if err := removeMetadataCache(fs, conf.Server.MetadataCacheDir, envPath, version); err != nil {
+		return err
+	}
+
+	return trashS3Objects(ctx, s3r, entry, report.S3Objects, record)
+}
+
+// trashLocalFiles moves the module file, scripts dir and kernel specs described
+// by the given report in to the given entry's entryDir, recording each in the
+// entry once it is moved.
+func trashLocalFiles(fs fsys.FS, conf *config.Config, entry *TrashEntry, entryDir string,
+	report *build.RemovalReport, version, modulePath string, record func() error) error {
+	moduleFile := filepath.Join(modulePath, version)
+
+	slog.Info(fmt.Sprintf("Moving to trash: %s\n", moduleFile))
+
+	if err := fs.Rename(moduleFile, filepath.Join(entryDir, trashModuleBasename)); err != nil {
+		return err
+	}
+
+	entry.ModuleFile = moduleFile
+
+	if err := record(); err != nil {
+		return err
+	}
+
+	if err := tidyModuleDir(fs, conf, modulePath); err != nil {
+		return err
+	}
+
+	slog.Info(fmt.Sprintf("Moving to trash: %s\n", report.ScriptsDir))
+
+	if err := fs.Rename(report.ScriptsDir, filepath.Join(entryDir, trashScriptsDir)); err != nil {
+		return err
+	}
+
+	entry.ScriptsDir = report.ScriptsDir
+
+	if err := record(); err != nil {
+		return err
+	}
+
+	for _, dir := range report.KernelSpecs {
+		if err := fs.Rename(dir, filepath.Join(entryDir, trashKernelsDir, filepath.Base(dir))); err != nil {
+			return err
+		}
+
+		entry.KernelSpecs = append(entry.KernelSpecs, dir)
+
+		if err := record(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trashS3Objects moves the given S3 objects in to the S3 trash dir of the given
+// entry, recording each in the entry once it is moved. Objects of unknown size
+// that don't exist are skipped.
+func trashS3Objects(ctx context.Context, s3r s3Remover, entry *TrashEntry, objects []build.RemovedFile,
+	record func() error) error {
+	for _, obj := range objects {
+		slog.Info(fmt.Sprintf("Moving to trash in S3: %s\n", obj.Path))
+
+		err := moveS3Object(ctx, s3r, obj.Path, trashS3Path(entry, obj.Path))
+		if err != nil && obj.Size < 0 {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		entry.S3Objects = append(entry.S3Objects, obj.Path)
+
+		if err = record(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trashS3Path returns where the given S3 object is kept in the given trash
+// entry, keeping its path relative to the entry's S3Path.
+func trashS3Path(entry *TrashEntry, s3Path string) string {
+	return filepath.Join(TrashS3Dir, entry.ID, strings.TrimPrefix(s3Path, entry.S3Path+"/"))
+}
+
+// moveS3Object copies the S3 object at source to dest, then removes source.
+func moveS3Object(ctx context.Context, s3r s3Remover, source, dest string) error {
+	rc, err := s3r.OpenFile(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	err = s3r.UploadData(ctx, rc, dest)
+	rc.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return s3r.RemoveFile(source)
+}
+
+func writeTrashManifest(fs fsys.FS, entryDir string, entry *TrashEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.OpenFile(filepath.Join(entryDir, trashManifestBasename),
+		os.O_CREATE|os.O_TRUNC|os.O_WRONLY, trashFilePerms)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, bytes.NewReader(data)); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
+
+func readTrashManifest(fs fsys.FS, entryDir string) (*TrashEntry, error) {
+	f, err := fs.Open(filepath.Join(entryDir, trashManifestBasename))
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	entry := new(TrashEntry)
+
+	return entry, json.NewDecoder(f).Decode(entry)
+}
+
+// Trashed returns the environments in the configured trash dir that can be
+// restored, oldest first.
+func Trashed(conf *config.Config) ([]*TrashEntry, error) {
+	return trashedIn(fsys.OS{}, conf)
+}
+
+// trashedIn does the work of Trashed() on the given filesystem.
+func trashedIn(fs fsys.FS, conf *config.Config) ([]*TrashEntry, error) {
+	if !conf.Trash.Enabled() {
+		return nil, ErrNoTrash
+	}
+
+	dirs, err := fs.ReadDir(conf.Trash.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []*TrashEntry
+
+	for _, dir := range dirs {
+		entry, err := readTrashManifest(fs, filepath.Join(conf.Trash.Dir, dir.Name()))
+		if err != nil {
+			slog.Warn("skipping unreadable trash entry", "id", dir.Name(), "err", err)
+
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Restore puts back the files and S3 artefacts of the environment with the
+// given ID that Remove() moved in to the configured trash, returning what was
+// restored. The artefacts its build sent to core are sent again first, so that
+// core has the environment again.
+//
+// Returns ErrNotInTrash if there's no such ID (eg. because it was purged), and
+// ErrRestoreConflict if the environment has been installed again since.
+func Restore(ctx context.Context, conf *config.Config, s3r s3Remover, id string) (*TrashEntry, error) {
+	return restoreFrom(ctx, fsys.OS{}, conf, s3r, id)
+}
+
+// restoreFrom does the work of Restore() on the given filesystem.
+func restoreFrom(ctx context.Context, fs fsys.FS, conf *config.Config, s3r s3Remover,
+	id string) (*TrashEntry, error) {
+	if !conf.Trash.Enabled() {
+		return nil, ErrNoTrash
+	}
+
+	if id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		return nil, ErrNotInTrash
+	}
+
+	entryDir := filepath.Join(conf.Trash.Dir, id)
+
+	entry, err := readTrashManifest(fs, entryDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotInTrash
+	} else if err != nil {
+		return nil, err
+	}
+
+	if fs.Exists(entry.ModuleFile) || fs.Exists(entry.ScriptsDir) {
+		return nil, ErrRestoreConflict
+	}
+
+	if err = resendToCore(ctx, fs, conf, s3r, entry, entryDir); err != nil {
+		return nil, err
+	}
+
+	return entry, untrash(ctx, fs, conf, s3r, entry, entryDir)
+}
+
+// resendToCore sends core, from the trash, the artefacts of the given entry
+// that its build sent: its module file, and its S3 objects other than its
+// image and list of executables.
+func resendToCore(ctx context.Context, fs fsys.FS, conf *config.Config, s3r s3Remover, entry *TrashEntry,
+	entryDir string) error {
+	artefacts := make(map[string]io.Reader)
+
+	if entry.ModuleFile != "" {
+		module, err := fs.Open(filepath.Join(entryDir, trashModuleBasename))
+		if err != nil {
+			return err
+		}
+
+		defer module.Close()
+
+		artefacts[core.ModuleForCoreBasename] = module
+	}
+
+	for _, obj := range entry.S3Objects {
+		name := strings.TrimPrefix(obj, entry.S3Path+"/")
+		if name == core.ImageBasename || name == core.ExesBasename {
+			continue
+		}
+
+		rc, errr := s3r.OpenFile(ctx, trashS3Path(entry, obj))
+		if errr != nil {
+			return errr
+		}
+
+		defer rc.Close()
+
+		artefacts[name] = rc
+	}
+
+	slog.Info(fmt.Sprintf("Resending to core: %s\n", entry.Environment))
+
+	return build.SendArtefacts(ctx, conf, entry.Environment, artefacts)
+}
+
+// untrashID puts back the environment with the given ID in the trash.
+func untrashID(ctx context.Context, fs fsys.FS, conf *config.Config, s3r s3Remover, id string) error {
+	entryDir := filepath.Join(conf.Trash.Dir, id)
+
+	entry, err := readTrashManifest(fs, entryDir)
+	if err != nil {
+		return err
+	}
+
+	return untrash(ctx, fs, conf, s3r, entry, entryDir)
+}
+
+// untrash moves the files and S3 objects of the given entry out of the trash
+// back to where they were, then removes the entry.
+func untrash(ctx context.Context, fs fsys.FS, conf *config.Config, s3r s3Remover, entry *TrashEntry,
+	entryDir string) error {
+	if err := restoreLocalFiles(fs, conf, entry, entryDir); err != nil {
+		return err
+	}
+
+	for _, obj := range entry.S3Objects {
+		slog.Info(fmt.Sprintf("Restoring from trash in S3: %s\n", obj))
+
+		if err := moveS3Object(ctx, s3r, trashS3Path(entry, obj), obj); err != nil {
+			return err
+		}
+	}
+
+	return fs.RemoveAll(entryDir)
+}
+
+// restoreLocalFiles moves the module file, scripts dir and kernel specs of the
+// given entry out of its entryDir back to where they were.
+func restoreLocalFiles(fs fsys.FS, conf *config.Config, entry *TrashEntry, entryDir string) error {
+	for _, move := range [...][2]string{
+		{filepath.Join(entryDir, trashModuleBasename), entry.ModuleFile},
+		{filepath.Join(entryDir, trashScriptsDir), entry.ScriptsDir},
+	} {
+		if move[1] == "" {
+			continue
+		}
+
+		if err := fs.MkdirAll(filepath.Dir(move[1]), trashDirPerms); err != nil {
+			return err
+		}
+
+		slog.Info(fmt.Sprintf("Restoring from trash: %s\n", move[1]))
+
+		if err := fs.Rename(move[0], move[1]); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range entry.KernelSpecs {
+		if err := fs.Rename(filepath.Join(entryDir, trashKernelsDir, filepath.Base(dir)), dir); err != nil {
+			return err
+		}
+	}
+
+	if entry.ModuleFile == "" {
+		return nil
+	}
+
+	return build.UpdateDefaultVersion(fs, conf, filepath.Dir(entry.ModuleFile))
+}
+
+// PurgeTrash permanently deletes the environments in the configured trash that
+// were removed longer ago than the configured retention, returning them.
+func PurgeTrash(conf *config.Config, s3r s3Remover) ([]*TrashEntry, error) {
+	return purgeTrashIn(fsys.OS{}, conf, s3r, time.Now())
+}
+
+// purgeTrashIn does the work of PurgeTrash() on the given filesystem, purging
+// entries removed longer than the retention before now.
+func purgeTrashIn(fs fsys.FS, conf *config.Config, s3r s3Remover, now time.Time) ([]*TrashEntry, error) {
+	entries, err := trashedIn(fs, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []*TrashEntry
+
+	for _, entry := range entries {
+		if now.Sub(entry.Removed) < conf.Trash.Retention() {
+			continue
+		}
+
+		for _, obj := range entry.S3Objects {
+			if err = s3r.RemoveFile(trashS3Path(entry, obj)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return purged, err
+			}
+		}
+
+		if err = fs.RemoveAll(filepath.Join(conf.Trash.Dir, entry.ID)); err != nil {
+			return purged, err
+		}
+
+		releaseQuotaImage(conf, entry.Environment)
+
+		purged = append(purged, entry)
+	}
+
+	return purged, nil
+}
+
+// purgeExpiredTrash purges expired trash, only logging any failure to do so.
+func purgeExpiredTrash(fs fsys.FS, conf *config.Config, s3r s3Remover) {
+	purged, err := purgeTrashIn(fs, conf, s3r, time.Now())
+	if err != nil {
+		slog.Warn("failed to purge expired trash", "err", err)
+	}
+
+	for _, entry := range purged {
+		slog.Info("purged from trash", "env", entry.Environment, "id", entry.ID)
+	}
+}
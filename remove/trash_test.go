@@ -0,0 +1,262 @@
+package remove
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/fsmock"
+	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
+)
+
+func TestTrash(t *testing.T) {
+	Convey("With the trash enabled and an installed environment", t, func() {
+		var (
+			coreDown  bool
+			resent    []string
+			resentEnv string
+		)
+
+		mockCore := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if coreDown {
+				w.Write([]byte(`{"error": "core down"}`)) //nolint:errcheck
+
+				return
+			}
+
+			if r.URL.Path == "/upload" {
+				resentEnv = r.URL.RawQuery
+
+				if mr, err := r.MultipartReader(); err == nil {
+					for p, errp := mr.NextPart(); errp == nil; p, errp = mr.NextPart() {
+						resent = append(resent, p.FileName())
+					}
+				}
+			}
+
+			w.Write([]byte(`{"message": "Successfully deleted the environment"}`)) //nolint:errcheck
+		}))
+		defer mockCore.Close()
+
+		conf := new(config.Config)
+		conf.CoreURL = mockCore.URL
+		conf.Module.ModuleInstallDir = "/modules"
+		conf.Module.ScriptsInstallDir = "/scripts"
+		conf.Module.KernelsDir = "/kernels"
+		conf.Trash.Dir = "/trash"
+		conf.Quotas.Group.ImageGB = 1
+		conf.Quotas.StateFile = filepath.Join(t.TempDir(), "quotas.json")
+
+		quotaState := `{"Images":{"groups/hgi/xxhash-1":{"Accounts":["groups/hgi"],"Bytes":5}}}`
+		So(os.WriteFile(conf.Quotas.StateFile, []byte(quotaState), 0600), ShouldBeNil)
+
+		envPath, version := "groups/hgi/xxhash", "1"
+		s3Path := filepath.Join(envPath, version)
+		modulePath := filepath.Join(conf.Module.ModuleInstallDir, envPath)
+		moduleFile := filepath.Join(modulePath, version)
+		scriptsPath := filepath.Join(conf.Module.ScriptsInstallDir, envPath, version+build.ScriptsDirSuffix)
+		kernelDir := build.KernelSpecDirs(conf.Module.KernelsDir, envPath, version)[0]
+
+		mfs := fsmock.New()
+		So(mfs.MkdirAll(modulePath, 0755), ShouldBeNil)
+		So(mfs.MkdirAll(scriptsPath, 0755), ShouldBeNil)
+		So(mfs.MkdirAll(kernelDir, 0755), ShouldBeNil)
+
+		for path, content := range map[string]string{
+			moduleFile: "#%Module",
+			filepath.Join(scriptsPath, core.ImageBasename): "image",
+		} {
+			f, err := mfs.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+			So(err, ShouldBeNil)
+			_, err = f.Write([]byte(content))
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+		}
+
+		s3Mock := &s3mock.MockS3{Files: map[string]string{
+			filepath.Join(s3Path, core.ImageBasename): "image",
+			filepath.Join(s3Path, core.SoftpackYaml):  "yml",
+		}}
+
+		Convey("Remove() moves it in to the trash instead of deleting it", func() {
+			report, err := removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{})
+			So(err, ShouldBeNil)
+			So(report.TrashID, ShouldEndWith, "-groups_hgi_xxhash-1")
+
+			So(mfs.Exists(modulePath), ShouldBeFalse)
+			So(mfs.Exists(scriptsPath), ShouldBeFalse)
+			So(mfs.Exists(kernelDir), ShouldBeFalse)
+			So(mfs.Exists(filepath.Join(conf.Trash.Dir, report.TrashID, trashScriptsDir, core.ImageBasename)),
+				ShouldBeTrue)
+			So(s3Mock.Files, ShouldResemble, map[string]string{
+				filepath.Join(TrashS3Dir, report.TrashID, core.ImageBasename): "image",
+				filepath.Join(TrashS3Dir, report.TrashID, core.SoftpackYaml):  "yml",
+			})
+
+			entries, err := trashedIn(mfs, conf)
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].ID, ShouldEqual, report.TrashID)
+			So(entries[0].Environment, ShouldEqual, "groups/hgi/xxhash-1")
+			So(entries[0].KernelSpecs, ShouldResemble, []string{kernelDir})
+
+			Convey("from which it can be restored, sending its artefacts to core again", func() {
+				entry, err := restoreFrom(context.Background(), mfs, conf, s3Mock, report.TrashID)
+				So(err, ShouldBeNil)
+				So(entry.Environment, ShouldEqual, "groups/hgi/xxhash-1")
+				So(resentEnv, ShouldEqual, url.QueryEscape("groups/hgi/xxhash-1"))
+				sort.Strings(resent)
+				So(resent, ShouldResemble, []string{core.ModuleForCoreBasename, core.SoftpackYaml})
+
+				data, err := mfs.ReadFile(moduleFile)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "#%Module")
+				So(mfs.Exists(filepath.Join(scriptsPath, core.ImageBasename)), ShouldBeTrue)
+				So(mfs.Exists(kernelDir), ShouldBeTrue)
+				So(mfs.Exists(filepath.Join(conf.Trash.Dir, report.TrashID)), ShouldBeFalse)
+				So(s3Mock.Files, ShouldResemble, map[string]string{
+					filepath.Join(s3Path, core.ImageBasename): "image",
+					filepath.Join(s3Path, core.SoftpackYaml):  "yml",
+				})
+
+				_, err = restoreFrom(context.Background(), mfs, conf, s3Mock, report.TrashID)
+				So(err, ShouldEqual, ErrNotInTrash)
+			})
+
+			Convey("but not if it has been installed again", func() {
+				So(mfs.MkdirAll(scriptsPath, 0755), ShouldBeNil)
+
+				_, err = restoreFrom(context.Background(), mfs, conf, s3Mock, report.TrashID)
+				So(err, ShouldEqual, ErrRestoreConflict)
+			})
+
+			Convey("and it is purged once the retention has passed, freeing its quota usage", func() {
+				purged, err := purgeTrashIn(mfs, conf, s3Mock, time.Now())
+				So(err, ShouldBeNil)
+				So(purged, ShouldBeEmpty)
+
+				data, err := os.ReadFile(conf.Quotas.StateFile)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, quotaState)
+
+				purged, err = purgeTrashIn(mfs, conf, s3Mock, time.Now().Add(conf.Trash.Retention()))
+				So(err, ShouldBeNil)
+				So(len(purged), ShouldEqual, 1)
+				So(mfs.Exists(filepath.Join(conf.Trash.Dir, report.TrashID)), ShouldBeFalse)
+				So(s3Mock.Files, ShouldBeEmpty)
+
+				data, err = os.ReadFile(conf.Quotas.StateFile)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldNotContainSubstring, "xxhash")
+
+				_, err = restoreFrom(context.Background(), mfs, conf, s3Mock, report.TrashID)
+				So(err, ShouldEqual, ErrNotInTrash)
+			})
+		})
+
+		Convey("A failure to remove it from core puts it back", func() {
+			coreDown = true
+
+			_, err := removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "core down")
+
+			So(mfs.Exists(moduleFile), ShouldBeTrue)
+			So(mfs.Exists(filepath.Join(scriptsPath, core.ImageBasename)), ShouldBeTrue)
+			So(mfs.Exists(kernelDir), ShouldBeTrue)
+			So(s3Mock.Files, ShouldContainKey, filepath.Join(s3Path, core.ImageBasename))
+
+			entries, err := trashedIn(mfs, conf)
+			So(err, ShouldBeNil)
+			So(entries, ShouldBeEmpty)
+		})
+
+		Convey("A failure part-way through moving it in to the trash puts it back", func() {
+			failing := &failingS3{MockS3: s3Mock, failBase: core.SoftpackYaml}
+
+			_, err := removeFrom(context.Background(), mfs, conf, failing, envPath, version, Options{})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, s3mock.ErrS3Mock.Error())
+
+			data, err := mfs.ReadFile(moduleFile)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "#%Module")
+			So(mfs.Exists(filepath.Join(scriptsPath, core.ImageBasename)), ShouldBeTrue)
+			So(mfs.Exists(kernelDir), ShouldBeTrue)
+			So(s3Mock.Files, ShouldResemble, map[string]string{
+				filepath.Join(s3Path, core.ImageBasename): "image",
+				filepath.Join(s3Path, core.SoftpackYaml):  "yml",
+			})
+
+			entries, err := trashedIn(mfs, conf)
+			So(err, ShouldBeNil)
+			So(entries, ShouldBeEmpty)
+
+			report, err := removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{})
+			So(err, ShouldBeNil)
+
+			_, err = restoreFrom(context.Background(), mfs, conf, s3Mock, report.TrashID)
+			So(err, ShouldBeNil)
+			So(mfs.Exists(moduleFile), ShouldBeTrue)
+		})
+
+		Convey("A failure to resend its artefacts to core leaves it in the trash", func() {
+			report, err := removeFrom(context.Background(), mfs, conf, s3Mock, envPath, version, Options{})
+			So(err, ShouldBeNil)
+
+			mockCore.Close()
+
+			_, err = restoreFrom(context.Background(), mfs, conf, s3Mock, report.TrashID)
+			So(err, ShouldNotBeNil)
+			So(mfs.Exists(moduleFile), ShouldBeFalse)
+
+			entries, err := trashedIn(mfs, conf)
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+		})
+
+		Convey("Invalid IDs can't be restored", func() {
+			for _, id := range []string{"", "..", "../modules", "a/b"} {
+				_, err := restoreFrom(context.Background(), mfs, conf, s3Mock, id)
+				So(err, ShouldEqual, ErrNotInTrash)
+			}
+		})
+
+		Convey("Nothing can be restored without a trash dir", func() {
+			conf.Trash.Dir = ""
+
+			_, err := restoreFrom(context.Background(), mfs, conf, s3Mock, "id")
+			So(err, ShouldEqual, ErrNoTrash)
+
+			_, err = trashedIn(mfs, conf)
+			So(err, ShouldEqual, ErrNoTrash)
+		})
+	})
+}
+
+// failingS3 is a MockS3 that fails to upload files with the given basename in
+// to the trash.
+type failingS3 struct {
+	*s3mock.MockS3
+	failBase string
+}
+
+func (f *failingS3) UploadData(ctx context.Context, data io.Reader, dest string) error {
+	if strings.HasPrefix(dest, TrashS3Dir+"/") && filepath.Base(dest) == f.failBase {
+		return s3mock.ErrS3Mock
+	}
+
+	return f.MockS3.UploadData(ctx, data, dest)
+}
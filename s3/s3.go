@@ -24,25 +24,49 @@
 package s3
 
 import (
+	"context"
 	"errors"
 	"io"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/VertebrateResequencing/muxfys"
 	"github.com/minio/minio-go"
+	"github.com/wtsi-hgi/go-softpack-builder/internal"
 )
 
+const ErrRemoveRoot = internal.Error("refusing to remove the whole bucket path")
+
+// removeBatchSize is the number of files RemovePrefix() deletes at once.
+const removeBatchSize = 100
+
 // S3 lets you upload data to S3 and retrieve it.
 type S3 struct {
 	*muxfys.S3Accessor
+	timeout time.Duration
+	client  *minio.Client
+	bucket  string
 }
 
 // New returns an S3 that gets your S3 credentials from ~/.s3cfg. The bucketPath
 // will be checked for accessibility. Only the first "directory" of the path,
 // actual bucket name, will be checked and stored as a root for the other method
 // paths.
-func New(bucketPath string) (*S3, error) {
-	config, err := muxfys.S3ConfigFromEnvironment("", bucketPath)
+//
+// UploadData() and OpenFile() operations will be abandoned if they take longer
+// than the given timeout. A timeout of 0 means no timeout.
+func New(bucketPath string, timeout time.Duration) (*S3, error) {
+	return NewForProfile("", bucketPath, timeout)
+}
+
+// NewForProfile is like New(), but gets your S3 credentials and region from the
+// given profile section of ~/.s3cfg. A blank profile means the default.
+func NewForProfile(profile, bucketPath string, timeout time.Duration) (*S3, error) {
+	config, err := muxfys.S3ConfigFromEnvironment(profile, bucketPath)
 	if err != nil {
 		return nil, err
 	}
@@ -52,21 +76,159 @@ func New(bucketPath string) (*S3, error) {
 		return nil, err
 	}
 
-	return &S3{S3Accessor: accessor}, nil
+	client, bucket, err := newCopyClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3{S3Accessor: accessor, timeout: timeout, client: client, bucket: bucket}, nil
+}
+
+// newCopyClient returns a minio client for the S3 and bucket in the given
+// config, made the same way as muxfys makes its own, along with the bucket's
+// name. muxfys can only copy files of up to 5GiB, so we use this for CopyFile().
+func newCopyClient(config *muxfys.S3Config) (*minio.Client, string, error) {
+	u, err := url.Parse(config.Target)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bucket, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	secure := u.Scheme == "https"
+
+	var client *minio.Client
+
+	if config.Region != "" {
+		client, err = minio.NewWithRegion(u.Host, config.AccessKey, config.SecretKey, secure, config.Region)
+	} else {
+		client, err = minio.NewV2(u.Host, config.AccessKey, config.SecretKey, secure)
+	}
+
+	return client, bucket, err
+}
+
+func (s *S3) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, s.timeout)
 }
 
-// UploadData uploads the given data to bucket/dest.
-func (s *S3) UploadData(data io.Reader, dest string) error {
+// UploadData uploads the given data to bucket/dest. Returns the context's error
+// if it is cancelled or our timeout expires before the upload completes.
+func (s *S3) UploadData(ctx context.Context, data io.Reader, dest string) error {
 	dest = s.RemotePath(dest)
 
-	return s.S3Accessor.UploadData(data, dest)
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- s.S3Accessor.UploadData(&ctxReader{ctx: ctx, r: data}, dest)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// OpenFile lets you stream the given S3 bucket/source object.
-func (s *S3) OpenFile(source string) (io.ReadCloser, error) {
+// OpenFile lets you stream the given S3 bucket/source object. Reads from the
+// returned ReadCloser will fail once the context is cancelled or our timeout
+// expires, so you must finish reading within the timeout. Close() it when
+// you're done.
+func (s *S3) OpenFile(ctx context.Context, source string) (io.ReadCloser, error) {
 	source = s.RemotePath(source)
 
-	return s.S3Accessor.OpenFile(source, 0)
+	ctx, cancel := s.withTimeout(ctx)
+
+	type opened struct {
+		rc  io.ReadCloser
+		err error
+	}
+
+	openCh := make(chan opened, 1)
+
+	go func() {
+		rc, err := s.S3Accessor.OpenFile(source, 0)
+		openCh <- opened{rc, err}
+	}()
+
+	select {
+	case o := <-openCh:
+		if o.err != nil {
+			cancel()
+
+			return nil, o.err
+		}
+
+		return &ctxReadCloser{ctxReader: ctxReader{ctx: ctx, r: o.rc}, c: o.rc, cancel: cancel}, nil
+	case <-ctx.Done():
+		cancel()
+
+		return nil, ctx.Err()
+	}
+}
+
+// CopyFile copies bucket/source to bucket/dest within S3, without the data
+// passing through us; large files are copied in parts. Returns the context's
+// error if it is cancelled or our timeout expires before the copy completes.
+func (s *S3) CopyFile(ctx context.Context, source, dest string) error {
+	dst, err := minio.NewDestinationInfo(s.bucket, s.RemotePath(dest), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	src := minio.NewSourceInfo(s.bucket, s.RemotePath(source), nil)
+
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- s.client.ComposeObject(dst, []minio.SourceInfo{src})
+	}()
+
+	select {
+	case err = <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ctxReader is an io.Reader that stops returning data once its context is
+// done.
+type ctxReader struct {
+	ctx context.Context //nolint:containedctx
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(p)
+}
+
+// ctxReadCloser is a ctxReader that also closes the underlying reader and
+// releases its context on Close().
+type ctxReadCloser struct {
+	ctxReader
+	c      io.Closer
+	cancel context.CancelFunc
+}
+
+func (c *ctxReadCloser) Close() error {
+	c.cancel()
+
+	return c.c.Close()
 }
 
 func (s *S3) RemoveFile(path string) error {
@@ -82,3 +244,227 @@ func (s *S3) RemoveFile(path string) error {
 
 	return nil
 }
+
+// ListFiles returns the basenames of the files directly within the given
+// directory.
+func (s *S3) ListFiles(dir string) ([]string, error) {
+	sizes, err := s.FileSizes(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(sizes))
+
+	for name := range sizes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// FileSizes returns the sizes in bytes of the files directly within the given
+// directory, keyed on their basenames.
+func (s *S3) FileSizes(dir string) (map[string]int64, error) {
+	entries, err := s.ListEntries(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64, len(entries))
+
+	for _, entry := range entries {
+		if !entry.IsDir {
+			sizes[filepath.Base(entry.Path)] = entry.Size
+		}
+	}
+
+	return sizes, nil
+}
+
+// Entry describes a file, or a directory if IsDir, in S3. Path is relative to
+// our bucket path. Directories have no Size or MTime.
+type Entry struct {
+	Path  string
+	Size  int64
+	MTime time.Time
+	IsDir bool
+}
+
+// ListEntries returns the files and subdirectories directly within the given
+// directory, sorted by Path.
+func (s *S3) ListEntries(dir string) ([]Entry, error) {
+	prefix := s.dirPrefix(dir)
+
+	attrs, err := s.S3Accessor.ListEntries(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(attrs))
+
+	for _, attr := range attrs {
+		if attr.Name != prefix {
+			entries = append(entries, s.entry(attr))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	return entries, nil
+}
+
+// Stat returns the Entry of the file at the given path, or os.ErrNotExist if
+// there isn't one.
+func (s *S3) Stat(path string) (*Entry, error) {
+	remote := s.RemotePath(path)
+
+	attrs, err := s.S3Accessor.ListEntries(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attr := range attrs {
+		if attr.Name == remote {
+			entry := s.entry(attr)
+
+			return &entry, nil
+		}
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// Exists returns true if there's a file at the given path.
+func (s *S3) Exists(path string) (bool, error) {
+	_, err := s.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// dirPrefix returns the remote path of the given directory, with a trailing
+// slash unless it's the root of the bucket.
+func (s *S3) dirPrefix(dir string) string {
+	prefix := strings.TrimSuffix(s.RemotePath(dir), "/")
+	if prefix == "" || prefix == "." {
+		return ""
+	}
+
+	return prefix + "/"
+}
+
+// entry converts the given muxfys attributes in to an Entry.
+func (s *S3) entry(attr muxfys.RemoteAttr) Entry {
+	path := strings.TrimPrefix(attr.Name, s.dirPrefix(""))
+
+	if strings.HasSuffix(path, "/") {
+		return Entry{Path: strings.TrimSuffix(path, "/"), IsDir: true}
+	}
+
+	return Entry{Path: path, Size: attr.Size, MTime: attr.MTime}
+}
+
+// TreeSizes returns the sizes in bytes of all the files within the given
+// directory and its subdirectories, keyed on their paths relative to it.
+func (s *S3) TreeSizes(dir string) (map[string]int64, error) {
+	prefix := s.dirPrefix(dir)
+	sizes := make(map[string]int64)
+
+	return sizes, s.walkFiles(prefix, func(name string, size int64) {
+		sizes[strings.TrimPrefix(name, prefix)] = size
+	})
+}
+
+// walkFiles calls cb with the full remote path and size of every file within
+// the given prefix, recursing in to subdirectories.
+func (s *S3) walkFiles(prefix string, cb func(name string, size int64)) error {
+	entries, err := s.S3Accessor.ListEntries(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		switch {
+		case entry.Name == prefix:
+			continue
+		case strings.HasSuffix(entry.Name, "/"):
+			if err := s.walkFiles(entry.Name, cb); err != nil {
+				return err
+			}
+		default:
+			cb(entry.Name, entry.Size)
+		}
+	}
+
+	return nil
+}
+
+// RemovePrefix removes every file within the given directory and its
+// subdirectories, including ones whose names we don't know in advance (like
+// the logs of individual packages). Once they've all been listed (which the S3
+// client pages through for us), they're deleted concurrently in batches of
+// removeBatchSize. Removing a directory that doesn't exist is not an error.
+//
+// Returns ErrRemoveRoot if dir is blank, since that would remove everything in
+// our bucket path.
+func (s *S3) RemovePrefix(dir string) error {
+	if strings.Trim(dir, "/.") == "" {
+		return ErrRemoveRoot
+	}
+
+	prefix := s.dirPrefix(dir)
+
+	var batch []string
+
+	err := s.walkFiles(prefix, func(name string, _ int64) {
+		batch = append(batch, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	for len(batch) > 0 {
+		n := min(len(batch), removeBatchSize)
+
+		if err := s.deleteFiles(batch[:n]); err != nil {
+			return err
+		}
+
+		batch = batch[n:]
+	}
+
+	return nil
+}
+
+// deleteFiles concurrently deletes the given remote paths, ignoring any that
+// don't exist, and returns the first error encountered.
+func (s *S3) deleteFiles(paths []string) error {
+	errCh := make(chan error, len(paths))
+
+	for _, path := range paths {
+		go func(path string) {
+			err := s.S3Accessor.DeleteFile(path)
+			if err != nil && s.ErrorIsNotExists(err) {
+				err = nil
+			}
+
+			errCh <- err
+		}(path)
+	}
+
+	var firstErr error
+
+	for range paths {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
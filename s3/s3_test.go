@@ -24,14 +24,43 @@
 package s3
 
 import (
+	"context"
 	"io"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+func TestCtxReader(t *testing.T) {
+	Convey("ctxReaders stop reading once their context is done", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := &ctxReader{ctx: ctx, r: strings.NewReader("data")}
+
+		buf := make([]byte, 2)
+		n, err := r.Read(buf)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+
+		cancel()
+
+		_, err = r.Read(buf)
+		So(err, ShouldEqual, context.Canceled)
+	})
+}
+
+func TestRemovePrefix(t *testing.T) {
+	Convey("RemovePrefix refuses to remove the whole bucket path", t, func() {
+		s3 := new(S3)
+
+		for _, dir := range []string{"", "/", "."} {
+			So(s3.RemovePrefix(dir), ShouldEqual, ErrRemoveRoot)
+		}
+	})
+}
+
 func TestS3(t *testing.T) {
 	s3bucketPath := os.Getenv("GSB_S3_TEST_PATH")
 	if s3bucketPath == "" {
@@ -43,7 +72,7 @@ func TestS3(t *testing.T) {
 	basePath := strings.Join(strings.Split(s3bucketPath[1:], "/")[1:], "/")
 
 	Convey("Given a New S3 object that uses config on disk", t, func() {
-		s3, err := New(s3bucketPath)
+		s3, err := New(s3bucketPath, 0)
 		So(err, ShouldBeNil)
 		So(s3, ShouldNotBeNil)
 
@@ -51,18 +80,67 @@ func TestS3(t *testing.T) {
 			basename := "test.txt"
 			testData := "test"
 
-			err = s3.UploadData(strings.NewReader(testData), basename)
+			err = s3.UploadData(context.Background(), strings.NewReader(testData), basename)
 			So(err, ShouldBeNil)
 
 			defer s3.DeleteFile(basePath + "/" + basename) //nolint:errcheck
 
-			entries, err := s3.ListEntries(basePath + "/")
+			entries, err := s3.ListEntries("")
 			So(err, ShouldBeNil)
 			So(len(entries), ShouldEqual, 1)
-			So(entries[0].Name, ShouldEqual, basePath+"/"+basename)
+			So(entries[0].Path, ShouldEqual, basename)
+			So(entries[0].Size, ShouldEqual, 4)
+			So(entries[0].IsDir, ShouldBeFalse)
+
+			Convey("And stat it", func() {
+				entry, err := s3.Stat(basename)
+				So(err, ShouldBeNil)
+				So(entry.Size, ShouldEqual, 4)
+				So(entry.MTime, ShouldHappenWithin, time.Hour, time.Now())
+
+				exists, err := s3.Exists(basename)
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeTrue)
+
+				_, err = s3.Stat(basename + ".missing")
+				So(err, ShouldEqual, os.ErrNotExist)
+
+				exists, err = s3.Exists(basename[:2])
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeFalse)
+			})
+
+			Convey("And get the sizes of everything in a directory tree", func() {
+				nested := "sub/nested.txt"
+
+				err = s3.UploadData(context.Background(), strings.NewReader(testData), nested)
+				So(err, ShouldBeNil)
+
+				defer s3.DeleteFile(basePath + "/" + nested) //nolint:errcheck
+
+				sizes, err := s3.TreeSizes("")
+				So(err, ShouldBeNil)
+				So(sizes, ShouldResemble, map[string]int64{basename: 4, nested: 4})
+			})
+
+			Convey("And remove everything in a directory tree", func() {
+				for _, path := range []string{"sub/a.txt", "sub/logs/b.txt"} {
+					err = s3.UploadData(context.Background(), strings.NewReader(testData), path)
+					So(err, ShouldBeNil)
+				}
+
+				So(s3.RemovePrefix("sub"), ShouldBeNil)
+				So(s3.RemovePrefix("sub"), ShouldBeNil)
+
+				sizes, err := s3.TreeSizes("")
+				So(err, ShouldBeNil)
+				So(sizes, ShouldResemble, map[string]int64{basename: 4})
+
+				So(s3.RemovePrefix(""), ShouldEqual, ErrRemoveRoot)
+			})
 
 			Convey("And then open it", func() {
-				f, err := s3.OpenFile(basename)
+				f, err := s3.OpenFile(context.Background(), basename)
 				So(err, ShouldBeNil)
 
 				defer f.Close()
@@ -75,7 +153,7 @@ func TestS3(t *testing.T) {
 					err = s3.RemoveFile(basename)
 					So(err, ShouldBeNil)
 
-					_, err = s3.OpenFile(basename)
+					_, err = s3.OpenFile(context.Background(), basename)
 					So(err, ShouldNotBeNil)
 				})
 			})
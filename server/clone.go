@@ -0,0 +1,120 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+// A CloneRequest is a Request for a build of a copy of the successfully built
+// environment Source (a path like "users/foo/env") at SourceVersion, as the
+// Request's Name and Version. The source's packages, at the concrete versions
+// it was built with, are copied except for those named in RemovePackages. The
+// Request's packages are added to them, replacing any of the same name, and its
+// description, processor target and labels default to the source's.
+type CloneRequest struct {
+	Source         string   `json:"source"`
+	SourceVersion  string   `json:"sourceVersion"`
+	RemovePackages []string `json:"removePackages,omitempty"`
+	Request
+}
+
+// apply pre-fills our Request from the given Definition of the source
+// environment.
+func (c *CloneRequest) apply(source *build.Definition) {
+	pkgs := make([]core.Package, 0, len(source.Packages)+len(c.Model.Packages))
+
+	for _, pkg := range source.Packages {
+		if slices.Contains(c.RemovePackages, pkg.Name) ||
+			slices.ContainsFunc(c.Model.Packages, func(p core.Package) bool { return p.Name == pkg.Name }) {
+			continue
+		}
+
+		pkgs = append(pkgs, pkg)
+	}
+
+	c.Model.Packages = append(pkgs, c.Model.Packages...)
+
+	if c.Model.Description == "" {
+		c.Model.Description = source.Description
+	}
+
+	if c.ProcessorTarget == "" {
+		c.ProcessorTarget = source.ProcessorTarget
+	}
+
+	if c.Labels == nil {
+		c.Labels = source.Labels
+	}
+}
+
+func (s *Server) handleEnvClone(w http.ResponseWriter, r *http.Request) {
+	if !s.allowBuildRequest(w, r) {
+		return
+	}
+
+	req := new(CloneRequest)
+	if !decodeRequestJSON(w, r, req) {
+		return
+	}
+
+	if err := build.ValidateEnvironmentPath(req.Source, req.SourceVersion); err != nil {
+		http.Error(w, fmt.Sprintf("invalid source: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	metadata, err := s.b.Metadata(r.Context(), req.Source, req.SourceVersion)
+	if errors.Is(err, build.ErrNoArtefacts) {
+		http.Error(w, fmt.Sprintf("%s: %s-%s", err, req.Source, req.SourceVersion), http.StatusNotFound)
+
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("error getting source: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	source, err := build.ParseSoftpackYML(strings.NewReader(metadata.SoftpackYML))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading source: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	req.apply(source)
+
+	if tooManyPackages(w, &req.Request, s.maxPackages) {
+		return
+	}
+
+	s.build(w, r, &req.Request)
+}
@@ -0,0 +1,605 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wtsi-hgi/go-softpack-builder/build"
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/wr"
+)
+
+const (
+	endpointOpenAPI = "/openapi.json"
+	openAPIVersion  = "3.0.3"
+	apiVersion      = "1"
+
+	contentTypeJSON   = "application/json"
+	contentTypeText   = "text/plain"
+	contentTypeStream = "text/event-stream"
+	contentTypeBinary = "application/octet-stream"
+	contentTypeGzip   = "application/gzip"
+
+	paramEnvPath = "{envPath}"
+	paramVersion = "{version}"
+)
+
+// apiParam is a query or path parameter of an apiOperation, with a JSON schema
+// type of "string", "integer" or "boolean".
+type apiParam struct {
+	name        string
+	in          string
+	typ         string
+	description string
+}
+
+// apiResponse is a possible response of an apiOperation. A nil body with a
+// JSON contentType means an empty body.
+type apiResponse struct {
+	description string
+	contentType string
+	body        any
+}
+
+// apiOperation describes one of our endpoints and the method it responds to.
+// The request body, if any, is JSON of the type of the example body. Admin
+// operations need the admin token, if one is configured.
+type apiOperation struct {
+	method    string
+	path      string
+	summary   string
+	params    []apiParam
+	body      any
+	responses map[int]apiResponse
+	admin     bool
+}
+
+var (
+	envPathParams = []apiParam{ //nolint:gochecknoglobals
+		{paramEnvPath, "path", "string", "environment path, like users/foo/env; may contain slashes"},
+		{paramVersion, "path", "string", "environment version"},
+	}
+	nameParam = apiParam{"name", "query", "string", //nolint:gochecknoglobals
+		"full environment path, like users/foo/env-1"}
+	buildParams = []apiParam{ //nolint:gochecknoglobals
+		{"wait", "query", "boolean", "wait for the build to finish"},
+		{"timeout", "query", "integer", "seconds to wait for the build to finish (default 3600)"},
+	}
+)
+
+// apiOperations describes our REST API, from which our OpenAPI document is
+// generated and our routes are made. Each needs a handler in handlers().
+func apiOperations() []apiOperation { //nolint:funlen
+	buildResponses := map[int]apiResponse{
+		http.StatusOK: {"build queued; or finished, if waited on", contentTypeJSON, build.StatusDetail{}},
+		http.StatusAccepted: {"build didn't finish before the wait timed out", contentTypeJSON,
+			build.StatusDetail{}},
+		http.StatusBadRequest:          textResponse("invalid request"),
+		http.StatusForbidden:           {"rejected by a pre-build hook", contentTypeJSON, policyRejectionResponse{}},
+		http.StatusTooManyRequests:     textResponse("rate limit or quota exceeded"),
+		http.StatusServiceUnavailable:  textResponse("builds are paused"),
+		http.StatusInternalServerError: textResponse("build failed to start"),
+	}
+
+	templateBuildResponses := make(map[int]apiResponse, len(buildResponses)+1)
+
+	for code, resp := range buildResponses {
+		templateBuildResponses[code] = resp
+	}
+
+	templateBuildResponses[http.StatusNotFound] = textResponse("unknown template")
+
+	cloneResponses := make(map[int]apiResponse, len(buildResponses)+1)
+
+	for code, resp := range buildResponses {
+		cloneResponses[code] = resp
+	}
+
+	cloneResponses[http.StatusNotFound] = textResponse("source environment not built")
+
+	return []apiOperation{
+		{
+			method: http.MethodPost, path: endpointEnvsBuild, summary: "Build an environment",
+			params: buildParams, body: Request{}, responses: buildResponses,
+		},
+		{
+			method: http.MethodPost, path: endpointEnvsClone, summary: "Build a copy of a built environment",
+			params: buildParams, body: CloneRequest{}, responses: cloneResponses,
+		},
+		{
+			method: http.MethodGet, path: endpointEnvsStatus, summary: "Query the status of builds",
+			params: []apiParam{
+				{"state", "query", "string", "building, failed or done"},
+				{"path", "query", "string", "environment path prefix"},
+				{"requester", "query", "string", "user who requested the build"},
+				{"label", "query", "string", "key=value label the build must have; may be repeated"},
+				{"since", "query", "string", "RFC 3339 time the build was requested at or after"},
+				{"sort", "query", "string", "requested or buildstart"},
+				{"order", "query", "string", "asc or desc"},
+				{"limit", "query", "integer", "maximum number of statuses"},
+				{"offset", "query", "integer", "number of statuses to skip"},
+			},
+			responses: map[int]apiResponse{
+				http.StatusOK:         {"matching statuses", contentTypeJSON, []build.Status{}},
+				http.StatusBadRequest: textResponse("invalid query"),
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointStatusStream, summary: "Stream build status changes",
+			responses: map[int]apiResponse{
+				http.StatusOK: {"Server-Sent Events with a JSON StatusChange as their data",
+					contentTypeStream, build.StatusChange{}},
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointEnvsStatus + "/" + paramEnvPath + "/" + paramVersion,
+			summary: "Get the full status of a build", params: envPathParams,
+			responses: map[int]apiResponse{
+				http.StatusOK:         {"the build's status", contentTypeJSON, build.StatusDetail{}},
+				http.StatusBadRequest: textResponse("invalid environment"),
+				http.StatusNotFound:   textResponse("unknown build"),
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointEnvsUsage, summary: "Get usage of installed environments",
+			responses: map[int]apiResponse{
+				http.StatusOK: {"usage of each environment", contentTypeJSON, []build.Usage{}},
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointEnvsDiskUsage,
+			summary: "Get the installed size of environments, by owner",
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {"size of each environment and owner", contentTypeJSON, build.DiskUsageReport{}},
+				http.StatusInternalServerError: textResponse("installed environments couldn't be listed"),
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointAnalytics,
+			summary: "Get how many installed environments each package and version is in",
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {"environments per package and version", contentTypeJSON, build.PackageReport{}},
+				http.StatusInternalServerError: textResponse("installed environments couldn't be listed"),
+			},
+		},
+		{
+			method: http.MethodPost, path: endpointEnvsDeprecate, summary: "Deprecate an installed environment",
+			body: DeprecateRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:         {"deprecated", contentTypeJSON, nil},
+				http.StatusBadRequest: textResponse("invalid request"),
+			},
+		},
+		{
+			method: http.MethodPost, path: endpointEnvsProtect, summary: "Protect an installed environment against removal",
+			body: ProtectRequest{},
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {"protected", contentTypeJSON, nil},
+				http.StatusBadRequest:          textResponse("invalid request"),
+				http.StatusNotFound:            textResponse("environment not installed"),
+				http.StatusInternalServerError: textResponse("environment couldn't be protected"),
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointEnvsLogTail, summary: "Get the recent log lines of a build",
+			params: []apiParam{nameParam},
+			responses: map[int]apiResponse{
+				http.StatusOK:       {"log lines", contentTypeJSON, []string{}},
+				http.StatusNotFound: textResponse("no logs for the build"),
+			},
+		},
+		{
+			method: http.MethodGet, path: envEndpoint(endpointImageSuffix), summary: "Download an environment's image",
+			params: envPathParams,
+			responses: map[int]apiResponse{
+				http.StatusOK:       {"the singularity image", contentTypeBinary, nil},
+				http.StatusNotFound: textResponse("no image"),
+			},
+		},
+		{
+			method: http.MethodGet, path: envEndpoint(endpointArtefactsSuffix),
+			summary: "Download an environment's build artefacts", params: envPathParams,
+			responses: map[int]apiResponse{
+				http.StatusOK:       {"a tar.gz of the artefacts", contentTypeGzip, nil},
+				http.StatusNotFound: textResponse("no artefacts"),
+			},
+		},
+		{
+			method: http.MethodGet, path: envEndpoint(endpointOutdatedSuffix),
+			summary: "Get an environment's packages that have newer versions", params: envPathParams,
+			responses: map[int]apiResponse{
+				http.StatusOK:             {"outdated packages", contentTypeJSON, []build.Upgrade{}},
+				http.StatusNotFound:       textResponse("environment not built"),
+				http.StatusNotImplemented: textResponse("no versionsFile configured"),
+			},
+		},
+		{
+			method: http.MethodGet, path: envEndpoint(endpointVerifySuffix),
+			summary: "Verify an environment's installation", params: envPathParams,
+			responses: map[int]apiResponse{
+				http.StatusOK: {"any problems found", contentTypeJSON, build.Verification{}},
+			},
+		},
+		{
+			method: http.MethodGet, path: envEndpoint(endpointDefinitionSuffix),
+			summary: "Get the singularity.def generated for an environment's latest build", params: envPathParams,
+			responses: map[int]apiResponse{
+				http.StatusOK:       {"the singularity.def", contentTypeJSON, build.SubmittedDefinition{}},
+				http.StatusNotFound: textResponse("no build submitted"),
+			},
+		},
+		{
+			method: http.MethodGet, path: envEndpoint(endpointMetadataSuffix),
+			summary: "Get a built environment's softpack.yml and spack.lock", params: envPathParams,
+			responses: map[int]apiResponse{
+				http.StatusOK:       {"the environment's metadata", contentTypeJSON, build.Metadata{}},
+				http.StatusNotFound: textResponse("environment not built"),
+			},
+		},
+		{
+			method: http.MethodGet, path: envEndpoint(endpointRemovalSuffix),
+			summary: "Preview everything that removing an environment would delete", params: envPathParams,
+			responses: map[int]apiResponse{
+				http.StatusOK: {"what would be removed", contentTypeJSON, build.RemovalReport{}},
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointHealth, summary: "Get the state of the service",
+			responses: map[int]apiResponse{
+				http.StatusOK: {"the service's state", contentTypeJSON, Health{}},
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointBuildsActive, summary: "List the builds happening right now",
+			responses: map[int]apiResponse{
+				http.StatusOK: {"running and held builds", contentTypeJSON, []build.ActiveBuild{}},
+			},
+		},
+		{
+			method: http.MethodPost, path: endpointRender, summary: "Render the files a build would generate, without building",
+			body: Request{},
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {"the generated files", contentTypeJSON, build.Rendering{}},
+				http.StatusBadRequest:          textResponse("invalid request"),
+				http.StatusInternalServerError: textResponse("files couldn't be rendered"),
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointVersion, summary: "Get gsb's version and enabled features",
+			responses: map[int]apiResponse{
+				http.StatusOK: {"version, git commit and features", contentTypeJSON, build.VersionInfo{}},
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointTemplates, summary: "List environment templates",
+			responses: map[int]apiResponse{
+				http.StatusOK: {"configured templates", contentTypeJSON, []config.Template{}},
+			},
+		},
+		{
+			method: http.MethodPost, path: endpointTemplatesBuild, summary: "Build an environment from a template",
+			params: buildParams, body: TemplateRequest{}, responses: templateBuildResponses,
+		},
+		maintenanceOperation("pause", "Reject new builds"),
+		maintenanceOperation("drain", "Queue new builds"),
+		maintenanceOperation("resume", "Accept builds again"),
+		{
+			method: http.MethodPost, path: endpointEnvsCancel, summary: "Cancel a running build",
+			params: []apiParam{nameParam}, admin: true,
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {"cancelled", contentTypeJSON, nil},
+				http.StatusNotFound:            textResponse("build not running"),
+				http.StatusInternalServerError: textResponse("the build's wr job couldn't be stopped"),
+			},
+		},
+		{
+			method: http.MethodPost, path: endpointEnvsRequeue, summary: "Build an environment again",
+			params: []apiParam{nameParam}, admin: true,
+			responses: map[int]apiResponse{
+				http.StatusOK:                 {"requeued", contentTypeJSON, nil},
+				http.StatusNotFound:           textResponse("unknown build"),
+				http.StatusConflict:           textResponse("environment is building"),
+				http.StatusServiceUnavailable: textResponse("builds are paused"),
+			},
+		},
+		{
+			method: http.MethodPost, path: endpointEnvsRepair, summary: "Verify and repair installed environments",
+			params: []apiParam{{"dryrun", "query", "boolean", "only report broken environments"}}, admin: true,
+			responses: map[int]apiResponse{
+				http.StatusOK: {"what was found and repaired", contentTypeJSON, build.RepairReport{}},
+			},
+		},
+		{
+			method: http.MethodPost, path: endpointEnvsUnprotect, summary: "Remove an environment's protection against removal",
+			body: ProtectRequest{}, admin: true,
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {"unprotected", contentTypeJSON, nil},
+				http.StatusBadRequest:          textResponse("invalid request"),
+				http.StatusInternalServerError: textResponse("environment couldn't be unprotected"),
+			},
+		},
+		{
+			method: http.MethodPost, path: endpointEnvsRemove, summary: "Remove an installed environment",
+			body: RemoveRequest{}, admin: true,
+			responses: map[int]apiResponse{
+				http.StatusOK:                  {"what was removed", contentTypeJSON, build.RemovalReport{}},
+				http.StatusBadRequest:          textResponse("invalid request"),
+				http.StatusConflict:            textResponse("environment is protected"),
+				http.StatusInternalServerError: textResponse("environment couldn't be removed"),
+			},
+		},
+		{
+			method: http.MethodGet, path: endpointOpenAPI, summary: "Get this OpenAPI document",
+			responses: map[int]apiResponse{
+				http.StatusOK: {"the OpenAPI document", contentTypeJSON, nil},
+			},
+		},
+	}
+}
+
+func textResponse(description string) apiResponse {
+	return apiResponse{description: description, contentType: contentTypeText}
+}
+
+func envEndpoint(suffix string) string {
+	return endpointEnvs + "/" + paramEnvPath + "/" + paramVersion + suffix
+}
+
+func maintenanceOperation(action, summary string) apiOperation {
+	return apiOperation{
+		method: http.MethodPost, path: endpointMaintenance + "/" + action, summary: summary, admin: true,
+		responses: map[int]apiResponse{
+			http.StatusOK: {"the resulting maintenance status", contentTypeJSON, build.MaintenanceStatus{}},
+		},
+	}
+}
+
+// openAPIDocument returns an OpenAPI document describing our apiOperations.
+func openAPIDocument() map[string]any {
+	g := &schemaGenerator{schemas: make(map[string]any), names: make(map[reflect.Type]string)}
+	paths := make(map[string]map[string]any)
+
+	for _, op := range apiOperations() {
+		if paths[op.path] == nil {
+			paths[op.path] = make(map[string]any)
+		}
+
+		paths[op.path][strings.ToLower(op.method)] = g.operation(op)
+	}
+
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":   "go-softpack-builder",
+			"version": apiVersion,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]any{
+				"adminToken": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// operation returns the OpenAPI operation object for the given apiOperation.
+func (g *schemaGenerator) operation(op apiOperation) map[string]any {
+	operation := map[string]any{"summary": op.summary}
+
+	if len(op.params) > 0 {
+		params := make([]map[string]any, len(op.params))
+
+		for i, param := range op.params {
+			params[i] = map[string]any{
+				"name":        strings.Trim(param.name, "{}"),
+				"in":          param.in,
+				"required":    param.in == "path",
+				"description": param.description,
+				"schema":      map[string]any{"type": param.typ},
+			}
+		}
+
+		operation["parameters"] = params
+	}
+
+	if op.body != nil {
+		operation["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{contentTypeJSON: map[string]any{"schema": g.schema(reflect.TypeOf(op.body))}},
+		}
+	}
+
+	responses := make(map[string]any, len(op.responses)+1)
+
+	for code, resp := range op.responses {
+		responses[strconv.Itoa(code)] = g.response(resp)
+	}
+
+	if op.admin {
+		operation["security"] = []map[string]any{{"adminToken": []string{}}}
+		responses[strconv.Itoa(http.StatusUnauthorized)] = g.response(textResponse("admin token required"))
+	}
+
+	operation["responses"] = responses
+
+	return operation
+}
+
+func (g *schemaGenerator) response(resp apiResponse) map[string]any {
+	response := map[string]any{"description": resp.description}
+
+	var schema map[string]any
+
+	switch {
+	case resp.body != nil:
+		schema = g.schema(reflect.TypeOf(resp.body))
+	case resp.contentType == contentTypeJSON:
+		return response
+	case resp.contentType == contentTypeBinary || resp.contentType == contentTypeGzip:
+		schema = map[string]any{"type": "string", "format": "binary"}
+	default:
+		schema = map[string]any{"type": "string"}
+	}
+
+	response["content"] = map[string]any{resp.contentType: map[string]any{"schema": schema}}
+
+	return response
+}
+
+// schemaGenerator generates JSON schemas for Go types as encoding/json would
+// encode them, collecting named struct types as reusable schemas.
+type schemaGenerator struct {
+	schemas map[string]any
+	names   map[reflect.Type]string
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})       //nolint:gochecknoglobals
+	wrJobStatusType = reflect.TypeOf(wr.WRJobStatus(0)) //nolint:gochecknoglobals
+)
+
+// schema returns the schema of the given type.
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any { //nolint:gocyclo,cyclop
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	if t == wrJobStatusType {
+		return map[string]any{"type": "string"}
+	}
+
+	switch t.Kind() { //nolint:exhaustive
+	case reflect.Pointer:
+		return nullable(g.schema(t.Elem()))
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8,
+		reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+
+		return g.ref(t)
+	default:
+		return map[string]any{}
+	}
+}
+
+// nullable returns the given schema, allowing it to also be null.
+func nullable(schema map[string]any) map[string]any {
+	if _, ok := schema["$ref"]; ok {
+		return map[string]any{"nullable": true, "allOf": []any{schema}}
+	}
+
+	schema["nullable"] = true
+
+	return schema
+}
+
+// ref returns a reference to the schema of the given named struct type,
+// generating it first if necessary.
+func (g *schemaGenerator) ref(t reflect.Type) map[string]any {
+	name, ok := g.names[t]
+	if !ok {
+		name = t.Name()
+
+		if _, taken := g.schemas[name]; taken {
+			name = strings.ReplaceAll(t.String(), ".", "_")
+		}
+
+		g.names[t] = name
+		g.schemas[name] = nil // reserve the name while generating recursively
+		g.schemas[name] = g.object(t)
+	}
+
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+// object returns the schema of the given struct type.
+func (g *schemaGenerator) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+
+	g.addProperties(t, properties)
+
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+// addProperties adds the schemas of the JSON fields of the given struct type to
+// the given properties, including those of embedded structs.
+func (g *schemaGenerator) addProperties(t reflect.Type, properties map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.addProperties(field.Type, properties)
+
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = g.schema(field.Type)
+	}
+}
+
+// handleOpenAPI responds with our OpenAPI document.
+func handleOpenAPI(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+
+	if err := json.NewEncoder(w).Encode(openAPIDocument()); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising OpenAPI document: %s", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,70 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// handleRender responds to a POST of a Request with the build.Rendering of
+// what building it would generate, without building anything.
+func (s *Server) handleRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "render requests must be POSTed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxRequestBytes)
+
+	req, ok := decodeBuildRequest(w, r, s.maxPackages)
+	if !ok {
+		return
+	}
+
+	def, err := definitionFromRequest(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error validating request: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	rendering, err := s.b.Render(r.Context(), def)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if isBadBuildConfig(err) {
+			status = http.StatusBadRequest
+		}
+
+		http.Error(w, fmt.Sprintf("error rendering build: %s", err), status)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(rendering); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising rendering: %s", err), http.StatusInternalServerError)
+	}
+}
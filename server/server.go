@@ -24,27 +24,69 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/wtsi-hgi/go-softpack-builder/build"
 	"github.com/wtsi-hgi/go-softpack-builder/config"
 	"github.com/wtsi-hgi/go-softpack-builder/core"
+	"github.com/wtsi-hgi/go-softpack-builder/remove"
 	"gopkg.in/tylerb/graceful.v1"
 )
 
 const (
-	endpointEnvs            = "/environments"
-	endpointEnvsBuild       = endpointEnvs + "/build"
-	endpointEnvsStatus      = endpointEnvs + "/status"
-	stopTimeout             = 10 * time.Second
-	readHeaderTimeout       = 20 * time.Second
-	waitUntilStartedTimeout = 30 * time.Second
+	endpointEnvs             = "/environments"
+	endpointEnvsBuild        = endpointEnvs + "/build"
+	endpointEnvsStatus       = endpointEnvs + "/status"
+	endpointStatusStream     = endpointEnvsStatus + "/stream"
+	endpointEnvsUsage        = endpointEnvs + "/usage"
+	endpointEnvsDiskUsage    = endpointEnvs + "/disk-usage"
+	endpointEnvsDeprecate    = endpointEnvs + "/deprecate"
+	endpointEnvsProtect      = endpointEnvs + "/protect"
+	endpointEnvsUnprotect    = endpointEnvs + "/unprotect"
+	endpointEnvsRemove       = endpointEnvs + "/remove"
+	endpointEnvsLogTail      = endpointEnvs + "/log-tail"
+	endpointEnvsCancel       = endpointEnvs + "/cancel"
+	endpointEnvsRequeue      = endpointEnvs + "/requeue"
+	endpointEnvsRepair       = endpointEnvs + "/repair"
+	endpointEnvsClone        = endpointEnvs + "/clone"
+	endpointHealth           = "/health"
+	endpointBuildsActive     = "/builds/active"
+	endpointVersion          = "/version"
+	endpointRender           = "/render"
+	endpointAnalytics        = "/analytics/packages"
+	endpointTemplates        = "/templates"
+	endpointTemplatesBuild   = endpointTemplates + "/build"
+	endpointMaintenance      = "/maintenance"
+	endpointImageSuffix      = "/image"
+	endpointArtefactsSuffix  = "/artifacts.tar.gz"
+	endpointOutdatedSuffix   = "/outdated"
+	endpointVerifySuffix     = "/verify"
+	endpointMetadataSuffix   = "/metadata"
+	endpointRemovalSuffix    = "/removal"
+	endpointDefinitionSuffix = "/definition"
+	stopTimeout              = 10 * time.Second
+	readHeaderTimeout        = 20 * time.Second
+	waitUntilStartedTimeout  = 30 * time.Second
+	streamKeepAlive          = 30 * time.Second
+	defaultBuildWaitTimeout  = time.Hour
 )
 
 type Error string
@@ -53,39 +95,184 @@ func (e Error) Error() string {
 	return string(e)
 }
 
+const (
+	ErrInvalidOrder         = Error("order must be asc or desc")
+	ErrInvalidWaitTimeout   = Error("timeout must be a positive number of seconds")
+	ErrPackagesAndSpackYAML = Error("give either model packages or a spackYAML, not both")
+)
+
 // Builder interface describes anything that can Build() a singularity image
 // given a build.Definition.
 type Builder interface {
-	Build(*build.Definition) error
-	Status() []build.Status
+	Build(ctx context.Context, def *build.Definition) error
+	QueryStatus(q build.StatusQuery) ([]build.Status, error)
+	StatusDetail(envPath, version string) (*build.StatusDetail, error)
+	Usage() ([]build.Usage, error)
+	Deprecate(ctx context.Context, def *build.Definition, replacement string) error
+	Protect(ctx context.Context, def *build.Definition, reason string) error
+	Unprotect(ctx context.Context, def *build.Definition) error
+	LogTail(envPath string) ([]string, error)
+	ReplicationStatus() build.ReplicationStatus
+	BinaryCacheStatus() build.BinaryCacheStatus
+	Image(ctx context.Context, envPath, version string) (*build.Image, error)
+	ArtefactsBundle(ctx context.Context, envPath, version string) ([]byte, error)
+	Outdated(ctx context.Context, envPath, version string) ([]build.Upgrade, error)
+	SubscribeStatusChanges(ctx context.Context) <-chan build.StatusChange
+	Maintenance() build.MaintenanceStatus
+	SetMaintenance(ctx context.Context, mode build.MaintenanceMode) (build.MaintenanceStatus, error)
+	Cancel(envPath string) error
+	Requeue(ctx context.Context, envPath string) error
+	Verify(ctx context.Context, envPath, version string) (*build.Verification, error)
+	RemovalPreview(envPath, version string) (*build.RemovalReport, error)
+	Remove(ctx context.Context, envPath, version, overrideToken string) (*build.RemovalReport, error)
+	Metadata(ctx context.Context, envPath, version string) (*build.Metadata, error)
+	SubmittedDefinition(ctx context.Context, envPath, version string) (*build.SubmittedDefinition, error)
+	WaitForBuild(ctx context.Context, envPath, version string) (*build.StatusDetail, error)
+	RepairAll(ctx context.Context, dryRun bool) (*build.RepairReport, error)
+	DiskUsage() (*build.DiskUsageReport, error)
+	PackageAnalytics(ctx context.Context) (*build.PackageReport, error)
+	VersionInfo() build.VersionInfo
+	ActiveBuilds() []build.ActiveBuild
+	Render(ctx context.Context, def *build.Definition) (*build.Rendering, error)
+}
+
+// Health is the JSON returned by a GET to /health, describing the state of
+// the service.
+type Health struct {
+	Replication build.ReplicationStatus
+	BinaryCache build.BinaryCacheStatus
+	Maintenance build.MaintenanceStatus
 }
 
 // A Request object contains all of the information required to build an
-// environment.
+// environment. Set Force to rebuild and replace an already installed version,
+// Profile to build with one of the configured build profiles, ProcessorTarget to
+// override its processor target with one of those allowed, FatTargets to also
+// build for those targets in the same image, RStudio to get an RStudio Server
+// launcher for an R environment, TestCommand to have the build fail unless
+// that command succeeds in the built image, Externals to use those
+// configured system-provided packages instead of building them, Conflicts and
+// Prereqs to declare modules that the environment's module can't be loaded
+// with, or needs loading first, and Requester to the username of the user
+// who asked core for the build. Artefacts are extra files (name to content) to
+// send to core with the build's artefacts, and SuppressArtefacts names default
+// artefacts not to send. SpackYAML is the spack.yaml of an existing spack
+// environment to build instead of the Model's Packages. Labels are arbitrary
+// key/value pairs (eg. "project": "cancer-atlas") recorded with the build, that
+// statuses can be filtered on and hooks can see.
 type Request struct {
-	Name    string
-	Version string `json:"version,omitempty"`
-	Model   struct {
+	Name              string
+	Version           string            `json:"version,omitempty"`
+	Force             bool              `json:"force,omitempty"`
+	Profile           string            `json:"profile,omitempty"`
+	ProcessorTarget   string            `json:"processorTarget,omitempty"`
+	FatTargets        []string          `json:"fatTargets,omitempty"`
+	RStudio           bool              `json:"rstudio,omitempty"`
+	TestCommand       string            `json:"testCommand,omitempty"`
+	Externals         []string          `json:"externals,omitempty"`
+	Conflicts         []string          `json:"conflicts,omitempty"`
+	Prereqs           []string          `json:"prereqs,omitempty"`
+	Requester         string            `json:"requester,omitempty"`
+	AutoUpgrade       bool              `json:"autoUpgrade,omitempty"`
+	Artefacts         map[string]string `json:"artefacts,omitempty"`
+	SuppressArtefacts []string          `json:"suppressArtefacts,omitempty"`
+	SpackYAML         string            `json:"spackYAML,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Model             struct {
 		Description string
 		Packages    []core.Package
 	}
 }
 
+// A DeprecateRequest names an installed environment version to deprecate, and
+// optionally the full path of an environment that should be used instead.
+type DeprecateRequest struct {
+	Name        string
+	Version     string
+	Replacement string
+}
+
+// A ProtectRequest names an installed environment version to protect against
+// removal (or unprotect), along with why and by whom.
+type ProtectRequest struct {
+	Name      string
+	Version   string
+	Reason    string
+	Requester string
+}
+
+// A RemoveRequest names an installed environment version to remove, along with
+// the protection override token needed if it is protected.
+type RemoveRequest struct {
+	Name          string
+	Version       string
+	OverrideToken string
+}
+
 type Server struct {
-	b         Builder
-	srv       *graceful.Server
-	c         *core.Core
-	startedCh chan struct{}
+	b               Builder
+	srvMu           sync.Mutex
+	srv             *graceful.Server
+	c               *core.Core
+	startedCh       chan struct{}
+	limiter         *rateLimiter
+	maxRequestBytes int64
+	maxPackages     int
+	tlsOpts         config.TLS
+	adminToken      string
+	templates       []config.Template
 }
 
 // New takes a Builder that will be sent a Definition when the returned Handler
 // receives request JSON POSTed to /environments/build, and uses the Builder to
 // get status information for builds when it receives a GET request to
-// /environments/status. It uses the config to get your core URL, and if set
-// will trigger the core service to resend pending builds to us after Start().
+// /environments/status (or the details of a single build with a GET to
+// /environments/status/[path]/[version]), and usage counts for environments when it receives a
+// GET request to /environments/usage. DeprecateRequest JSON POSTed to
+// /environments/deprecate has the Builder deprecate an environment,
+// ProtectRequest JSON POSTed to /environments/protect protects one against
+// removal, and a GET
+// to /environments/log-tail?name=[env] returns the recent log lines of a build.
+// A GET to /environments/[path]/[version]/image downloads an environment's
+// singularity image, to /environments/[path]/[version]/verify checks its
+// installation, to /environments/[path]/[version]/metadata returns its
+// softpack.yml and spack.lock, and to /environments/[path]/[version]/removal
+// previews what removing it would delete. A GET to /analytics/packages reports how many
+// installed environments each package is in. A GET to /health returns a Health
+// describing the state of the service, and to /version returns the Builder's
+// build.VersionInfo. A GET to /templates lists the configured templates, and a
+// TemplateRequest POSTed to /templates/build builds an environment based on
+// one.
+// POSTs to /maintenance/pause, /maintenance/drain and /maintenance/resume change
+// the Builder's maintenance mode, and POSTs to /environments/cancel?name=[env]
+// and /environments/requeue?name=[env] cancel or rebuild a build, and a POST to
+// /environments/repair verifies and repairs all installed environments (only
+// reporting problems with ?dryrun=true), a ProtectRequest POSTed to
+// /environments/unprotect removes protection, and a RemoveRequest POSTed to
+// /environments/remove has the Builder remove an environment; these admin
+// endpoints require the config's server adminToken, if set.
+// It uses the config to get your core URL, and if set will trigger the core
+// service to resend pending builds to us after Start().
+//
+// Build requests are limited in size and number of packages, and optionally
+// rate limited per client IP, according to the config's server options.
 func New(b Builder, c *config.Config) *Server {
 	s := &Server{
-		b: b,
+		b:               b,
+		limiter:         newRateLimiter(c.Server.RateLimit, c.Server.RateBurst),
+		maxRequestBytes: c.Server.MaxRequestBytes,
+		maxPackages:     c.Server.MaxPackages,
+		tlsOpts:         c.TLS,
+		adminToken:      c.Server.AdminToken,
+		templates:       c.Templates,
+	}
+
+	if s.maxRequestBytes <= 0 {
+		s.maxRequestBytes = defaultMaxRequestBytes
+	}
+
+	if s.maxPackages <= 0 {
+		s.maxPackages = defaultMaxPackages
 	}
 
 	cor, err := core.New(c)
@@ -104,8 +291,19 @@ func New(b Builder, c *config.Config) *Server {
 //
 // If we had been configured with core details, core will be asked to resend its
 // queued environments.
+//
+// If TLS was configured, the endpoints will be served over https.
 func (s *Server) Start(l net.Listener) error {
-	s.srv = &graceful.Server{
+	tc, err := tlsConfig(s.tlsOpts)
+	if err != nil {
+		return err
+	}
+
+	if tc != nil {
+		l = tls.NewListener(l, tc)
+	}
+
+	srv := &graceful.Server{
 		Timeout: stopTimeout,
 
 		Server: &http.Server{
@@ -114,13 +312,17 @@ func (s *Server) Start(l net.Listener) error {
 		},
 	}
 
+	s.srvMu.Lock()
+	s.srv = srv
+	s.srvMu.Unlock()
+
 	errCh := make(chan error, 1)
 
 	go func() {
-		errCh <- s.srv.Serve(l)
+		errCh <- srv.Serve(l)
 	}()
 
-	err := s.resendPendingBuildsIfCoreConfigured()
+	err = s.resendPendingBuildsIfCoreConfigured()
 	if err != nil {
 		slog.Error("error getting core to resend builds", "err", err)
 	}
@@ -128,25 +330,131 @@ func (s *Server) Start(l net.Listener) error {
 	return <-errCh
 }
 
+// endpointsHandler routes requests to the handlers of our apiOperations.
+// Requests for paths with a parameterised environment go to the operation with
+// the matching suffix.
 func (s *Server) endpointsHandler() http.HandlerFunc {
+	routes := s.routes()
+	envPrefix := envEndpoint("")
+	statusDetail := routes[endpointEnvsStatus+"/"+paramEnvPath+"/"+paramVersion]
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.URL.Path {
-		case endpointEnvsBuild:
-			handleEnvBuild(s.b, w, r)
-		case endpointEnvsStatus:
-			handleEnvStatus(s.b, w)
-		default:
-			http.Error(w, fmt.Sprintf("go-softpack-builder: no such endpoint: %s", r.URL.Path), http.StatusNotFound)
+		if handler, ok := routes[r.URL.Path]; ok {
+			handler(w, r)
+
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, endpointEnvsStatus+"/") {
+			statusDetail(w, r)
+
+			return
 		}
+
+		if strings.HasPrefix(r.URL.Path, endpointEnvs+"/") {
+			for path, handler := range routes {
+				suffix, ok := strings.CutPrefix(path, envPrefix)
+				if ok && strings.HasSuffix(r.URL.Path, suffix) {
+					handler(w, r)
+
+					return
+				}
+			}
+		}
+
+		http.Error(w, fmt.Sprintf("go-softpack-builder: no such endpoint: %s", r.URL.Path), http.StatusNotFound)
 	})
 }
 
+// routes returns our handlers keyed on the paths of the apiOperations they
+// implement, with admin operations needing the admin token.
+func (s *Server) routes() map[string]http.HandlerFunc {
+	handlers := s.handlers()
+	routes := make(map[string]http.HandlerFunc, len(handlers))
+
+	for _, op := range apiOperations() {
+		handler, ok := handlers[op.path]
+		if !ok {
+			continue
+		}
+
+		if op.admin {
+			handler = s.adminOnlyHandler(handler)
+		}
+
+		routes[op.path] = handler
+	}
+
+	return routes
+}
+
+// handlers returns the handler of each of our apiOperations, keyed on its path.
+func (s *Server) handlers() map[string]http.HandlerFunc { //nolint:funlen
+	return map[string]http.HandlerFunc{
+		endpointEnvsBuild:    s.handleEnvBuild,
+		endpointEnvsClone:    s.handleEnvClone,
+		endpointEnvsStatus:   func(w http.ResponseWriter, r *http.Request) { handleEnvStatus(s.b, w, r) },
+		endpointStatusStream: func(w http.ResponseWriter, r *http.Request) { handleEnvStatusStream(s.b, w, r) },
+		endpointEnvsStatus + "/" + paramEnvPath + "/" + paramVersion: func(w http.ResponseWriter, r *http.Request) {
+			handleEnvStatusDetail(s.b, w, r)
+		},
+		endpointEnvsUsage:     func(w http.ResponseWriter, _ *http.Request) { handleEnvUsage(s.b, w) },
+		endpointEnvsDiskUsage: func(w http.ResponseWriter, _ *http.Request) { handleEnvDiskUsage(s.b, w) },
+		endpointAnalytics:     func(w http.ResponseWriter, r *http.Request) { handlePackageAnalytics(s.b, w, r) },
+		endpointEnvsDeprecate: func(w http.ResponseWriter, r *http.Request) { handleEnvDeprecate(s.b, w, r) },
+		endpointEnvsProtect:   func(w http.ResponseWriter, r *http.Request) { handleEnvProtect(s.b, w, r, false) },
+		endpointEnvsUnprotect: func(w http.ResponseWriter, r *http.Request) { handleEnvProtect(s.b, w, r, true) },
+		endpointEnvsRemove:    func(w http.ResponseWriter, r *http.Request) { handleEnvRemove(s.b, w, r) },
+		endpointEnvsLogTail:   func(w http.ResponseWriter, r *http.Request) { handleEnvLogTail(s.b, w, r) },
+		envEndpoint(endpointImageSuffix): func(w http.ResponseWriter, r *http.Request) {
+			handleEnvImage(s.b, w, r)
+		},
+		envEndpoint(endpointArtefactsSuffix): func(w http.ResponseWriter, r *http.Request) {
+			handleEnvArtefacts(s.b, w, r)
+		},
+		envEndpoint(endpointOutdatedSuffix): func(w http.ResponseWriter, r *http.Request) {
+			handleEnvOutdated(s.b, w, r)
+		},
+		envEndpoint(endpointVerifySuffix): func(w http.ResponseWriter, r *http.Request) {
+			handleEnvVerify(s.b, w, r)
+		},
+		envEndpoint(endpointMetadataSuffix): func(w http.ResponseWriter, r *http.Request) {
+			handleEnvMetadata(s.b, w, r)
+		},
+		envEndpoint(endpointDefinitionSuffix): func(w http.ResponseWriter, r *http.Request) {
+			handleEnvDefinition(s.b, w, r)
+		},
+		envEndpoint(endpointRemovalSuffix): func(w http.ResponseWriter, r *http.Request) {
+			handleEnvRemovalPreview(s.b, w, r)
+		},
+		endpointHealth:         func(w http.ResponseWriter, _ *http.Request) { handleHealth(s.b, w) },
+		endpointVersion:        func(w http.ResponseWriter, _ *http.Request) { handleVersion(s.b, w) },
+		endpointBuildsActive:   func(w http.ResponseWriter, _ *http.Request) { handleBuildsActive(s.b, w) },
+		endpointRender:         s.handleRender,
+		endpointTemplates:      func(w http.ResponseWriter, _ *http.Request) { s.handleTemplates(w) },
+		endpointTemplatesBuild: s.handleTemplateBuild,
+		endpointOpenAPI:        func(w http.ResponseWriter, _ *http.Request) { handleOpenAPI(w) },
+		endpointMaintenance + "/pause": func(w http.ResponseWriter, r *http.Request) {
+			handleMaintenance(s.b, w, r, build.MaintenancePaused)
+		},
+		endpointMaintenance + "/drain": func(w http.ResponseWriter, r *http.Request) {
+			handleMaintenance(s.b, w, r, build.MaintenanceDraining)
+		},
+		endpointMaintenance + "/resume": func(w http.ResponseWriter, r *http.Request) {
+			handleMaintenance(s.b, w, r, build.MaintenanceOff)
+		},
+		endpointEnvsCancel:  func(w http.ResponseWriter, r *http.Request) { handleEnvCancel(s.b, w, r) },
+		endpointEnvsRequeue: func(w http.ResponseWriter, r *http.Request) { handleEnvRequeue(s.b, w, r) },
+		endpointEnvsRepair:  func(w http.ResponseWriter, r *http.Request) { handleEnvRepair(s.b, w, r) },
+	}
+}
+
 func (s *Server) resendPendingBuildsIfCoreConfigured() error {
 	if s.c == nil {
 		return nil
 	}
 
-	err := s.c.ResendPendingBuilds()
+	err := s.c.ResendPendingBuilds(context.Background())
 	close(s.startedCh)
 
 	return err
@@ -182,9 +490,415 @@ func NewListener(listenURL string) (net.Listener, error) {
 	return net.Listen("tcp", listenURL)
 }
 
-func handleEnvBuild(b Builder, w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleEnvBuild(w http.ResponseWriter, r *http.Request) {
+	if !s.allowBuildRequest(w, r) {
+		return
+	}
+
+	req, ok := decodeBuildRequest(w, r, s.maxPackages)
+	if !ok {
+		return
+	}
+
+	s.build(w, r, req)
+}
+
+// allowBuildRequest limits the size of r's body, and returns true if the
+// client hasn't exceeded our rate limit, otherwise writing an error response.
+func (s *Server) allowBuildRequest(w http.ResponseWriter, r *http.Request) bool {
+	if s.limiter != nil && !s.limiter.allow(clientIP(r)) {
+		http.Error(w, "too many build requests", http.StatusTooManyRequests)
+
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxRequestBytes)
+
+	return true
+}
+
+// build has the Builder build the given Request, writing an error response if
+// that fails. If the request URL has the query parameter wait=true, it then
+// waits for the build to finish (see waitForBuild()).
+func (s *Server) build(w http.ResponseWriter, r *http.Request, req *Request) {
+	wait, timeout, err := parseBuildWait(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error parsing query: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	def, err := definitionFromRequest(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error validating request: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if err = s.b.Build(r.Context(), def); err != nil {
+		var rejection *build.PolicyRejection
+		if errors.As(err, &rejection) {
+			writePolicyRejection(w, rejection)
+
+			return
+		}
+
+		status := http.StatusInternalServerError
+		if errors.Is(err, build.ErrBuildsPaused) {
+			status = http.StatusServiceUnavailable
+		} else if errors.Is(err, build.ErrQuotaExceeded) {
+			status = http.StatusTooManyRequests
+		} else if isBadBuildConfig(err) {
+			status = http.StatusBadRequest
+		}
+
+		http.Error(w, fmt.Sprintf("error starting build: %s", err), status)
+
+		return
+	}
+
+	if wait {
+		s.waitForBuild(w, r, path.Join(def.EnvironmentPath, def.EnvironmentName), def.EnvironmentVersion, timeout)
+	}
+}
+
+// definitionFromRequest returns the validated build.Definition of the given
+// Request.
+func definitionFromRequest(req *Request) (*build.Definition, error) {
+	def := new(build.Definition)
+	def.EnvironmentPath, def.EnvironmentName = path.Split(req.Name)
+	def.EnvironmentVersion = req.Version
+	def.Description = req.Model.Description
+	def.Packages = req.Model.Packages
+	def.Force = req.Force
+	def.Profile = req.Profile
+	def.ProcessorTarget = req.ProcessorTarget
+	def.FatTargets = req.FatTargets
+	def.RStudio = req.RStudio
+	def.TestCommand = req.TestCommand
+	def.Externals = req.Externals
+	def.Conflicts = req.Conflicts
+	def.Prereqs = req.Prereqs
+	def.Requester = req.Requester
+	def.AutoUpgrade = req.AutoUpgrade
+	def.ExtraArtefacts = req.Artefacts
+	def.SuppressArtefacts = req.SuppressArtefacts
+	def.Labels = req.Labels
+
+	if err := setSpackYAML(def, req); err != nil {
+		return nil, err
+	}
+
+	return def, def.Validate()
+}
+
+// isBadBuildConfig returns true if the given error from the Builder was caused
+// by a Definition asking for a profile, processor target, external or image
+// that isn't configured or available.
+func isBadBuildConfig(err error) bool {
+	return errors.Is(err, config.ErrUnknownProfile) || errors.Is(err, config.ErrUnknownTarget) ||
+		errors.Is(err, build.ErrFatTarget) || errors.Is(err, build.ErrImageNotOffline) ||
+		errors.Is(err, config.ErrUnknownExternal)
+}
+
+// parseBuildWait parses the wait (a bool) and timeout (in seconds, default
+// defaultBuildWaitTimeout) URL query parameters of a build request.
+func parseBuildWait(query url.Values) (bool, time.Duration, error) {
+	var wait bool
+
+	if v := query.Get("wait"); v != "" {
+		var err error
+
+		if wait, err = strconv.ParseBool(v); err != nil {
+			return false, 0, err
+		}
+	}
+
+	v := query.Get("timeout")
+	if v == "" {
+		return wait, defaultBuildWaitTimeout, nil
+	}
+
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds <= 0 {
+		return false, 0, ErrInvalidWaitTimeout
+	}
+
+	return wait, time.Duration(seconds) * time.Second, nil
+}
+
+// waitForBuild responds with the StatusDetail of the build of the given
+// environment and version once it has finished. If it doesn't finish within the
+// timeout, it responds with its current StatusDetail and an Accepted status
+// code instead.
+func (s *Server) waitForBuild(w http.ResponseWriter, r *http.Request, envPath, version string,
+	timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	code := http.StatusOK
+
+	detail, err := s.b.WaitForBuild(ctx, envPath, version)
+	if errors.Is(err, context.DeadlineExceeded) {
+		code = http.StatusAccepted
+		detail, err = s.b.StatusDetail(envPath, version)
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error waiting for build: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	data, err := json.Marshal(detail)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error serialising status: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data) //nolint:errcheck
+}
+
+// policyRejectionResponse is the body of the response to a build request that
+// a pre-build hook rejected.
+type policyRejectionResponse struct {
+	Error   string
+	Hook    string
+	Reasons []string
+}
+
+// writePolicyRejection writes a 403 response with a JSON body describing the
+// given rejection.
+func writePolicyRejection(w http.ResponseWriter, rejection *build.PolicyRejection) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+
+	json.NewEncoder(w).Encode(policyRejectionResponse{ //nolint:errcheck,errchkjson
+		Error:   rejection.Error(),
+		Hook:    rejection.Hook,
+		Reasons: rejection.Reasons,
+	})
+}
+
+// decodeBuildRequest decodes the Request in the body of r, writing an error
+// response and returning false if that fails, or if the Request has more than
+// maxPackages packages.
+func decodeBuildRequest(w http.ResponseWriter, r *http.Request, maxPackages int) (*Request, bool) {
 	req := new(Request)
 
+	if !decodeRequestJSON(w, r, req) || tooManyPackages(w, req, maxPackages) {
+		return nil, false
+	}
+
+	return req, true
+}
+
+// decodeRequestJSON decodes the JSON body of r into v, writing an error
+// response and returning false if that fails.
+func decodeRequestJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		status := http.StatusBadRequest
+
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		http.Error(w, fmt.Sprintf("error parsing request: %s", err), status)
+
+		return false
+	}
+
+	return true
+}
+
+// tooManyPackages returns true, writing an error response, if the Request has
+// more than maxPackages packages.
+func tooManyPackages(w http.ResponseWriter, req *Request, maxPackages int) bool {
+	if len(req.Model.Packages) > maxPackages {
+		http.Error(w, fmt.Sprintf("too many packages: maximum is %d", maxPackages),
+			http.StatusRequestEntityTooLarge)
+
+		return true
+	}
+
+	return false
+}
+
+func handleEnvStatus(b Builder, w http.ResponseWriter, r *http.Request) {
+	q, err := parseStatusQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error parsing query: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	statuses, err := b.QueryStatus(q)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error querying status: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(statuses)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error serialising status: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleEnvStatusStream streams the Builder's StatusChanges to the client as
+// Server-Sent Events, each with a JSON StatusChange as its data, until the
+// client disconnects. A comment is sent when nothing else has been for a while,
+// to keep the connection alive through proxies.
+func handleEnvStatusStream(b Builder, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+
+		return
+	}
+
+	changes := b.SubscribeStatusChanges(r.Context())
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var event string
+
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(change)
+			if err != nil {
+				continue
+			}
+
+			event = fmt.Sprintf("event: status\ndata: %s\n\n", data)
+		case <-keepAlive.C:
+			event = ": keep-alive\n\n"
+		}
+
+		if _, err := io.WriteString(w, event); err != nil {
+			return
+		}
+
+		flusher.Flush()
+		keepAlive.Reset(streamKeepAlive)
+	}
+}
+
+// handleEnvStatusDetail responds with the StatusDetail of the build in the
+// request path, which is like /environments/status/users/foo/env/1.
+func handleEnvStatusDetail(b Builder, w http.ResponseWriter, r *http.Request) {
+	envPath, version := path.Split(strings.TrimPrefix(r.URL.Path, endpointEnvsStatus+"/"))
+	envPath = strings.TrimSuffix(envPath, "/")
+
+	if err := build.ValidateEnvironmentPath(envPath, version); err != nil {
+		http.Error(w, fmt.Sprintf("error validating request: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	detail, err := b.StatusDetail(envPath, version)
+	if errors.Is(err, build.ErrUnknownBuild) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("error getting status: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(detail); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising status: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// parseStatusQuery converts the state, path, requester, label (key=value, which
+// may be repeated), since (RFC 3339), sort, order ("asc" or "desc"), limit and
+// offset URL query parameters in to a StatusQuery.
+func parseStatusQuery(values url.Values) (build.StatusQuery, error) {
+	q := build.StatusQuery{
+		State:      build.BuildState(values.Get("state")),
+		PathPrefix: values.Get("path"),
+		Requester:  values.Get("requester"),
+		SortBy:     build.StatusSort(values.Get("sort")),
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return q, ErrInvalidOrder
+	}
+
+	var err error
+
+	if q.Labels, err = parseLabels(values["label"]); err != nil {
+		return q, err
+	}
+
+	if since := values.Get("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return q, err
+		}
+	}
+
+	if q.Limit, err = atoiOrZero(values.Get("limit")); err != nil {
+		return q, err
+	}
+
+	q.Offset, err = atoiOrZero(values.Get("offset"))
+
+	return q, err
+}
+
+// parseLabels parses the given "key=value" labels, returning nil if there are
+// none.
+func parseLabels(labels []string) (map[string]string, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+
+	parsed := make(map[string]string, len(labels))
+
+	for _, label := range labels {
+		key, value, err := build.ParseLabel(label)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, label)
+		}
+
+		parsed[key] = value
+	}
+
+	return parsed, nil
+}
+
+func atoiOrZero(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return strconv.Atoi(s)
+}
+
+func handleEnvDeprecate(b Builder, w http.ResponseWriter, r *http.Request) {
+	req := new(DeprecateRequest)
+
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 		http.Error(w, fmt.Sprintf("error parsing request: %s", err), http.StatusBadRequest)
 
@@ -194,25 +908,543 @@ func handleEnvBuild(b Builder, w http.ResponseWriter, r *http.Request) {
 	def := new(build.Definition)
 	def.EnvironmentPath, def.EnvironmentName = path.Split(req.Name)
 	def.EnvironmentVersion = req.Version
-	def.Description = req.Model.Description
-	def.Packages = req.Model.Packages
 
-	if err := def.Validate(); err != nil {
+	if err := def.ValidateEnvironment(); err != nil {
 		http.Error(w, fmt.Sprintf("error validating request: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if err := build.ValidateReplacement(req.Replacement); err != nil {
+		http.Error(w, fmt.Sprintf("error validating request: %s", err), http.StatusBadRequest)
+
+		return
 	}
 
-	if err := b.Build(def); err != nil {
-		http.Error(w, fmt.Sprintf("error starting build: %s", err), http.StatusInternalServerError)
+	if err := b.Deprecate(r.Context(), def, req.Replacement); err != nil {
+		http.Error(w, fmt.Sprintf("error deprecating environment: %s", err), http.StatusInternalServerError)
 	}
 }
 
-func handleEnvStatus(b Builder, w http.ResponseWriter) {
-	err := json.NewEncoder(w).Encode(b.Status())
+func handleEnvProtect(b Builder, w http.ResponseWriter, r *http.Request, unprotect bool) {
+	req := new(ProtectRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("error parsing request: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	def := new(build.Definition)
+	def.EnvironmentPath, def.EnvironmentName = path.Split(req.Name)
+	def.EnvironmentVersion = req.Version
+	def.Requester = req.Requester
+
+	if err := def.ValidateEnvironment(); err != nil {
+		http.Error(w, fmt.Sprintf("error validating request: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	var err error
+
+	if unprotect {
+		err = b.Unprotect(r.Context(), def)
+	} else {
+		err = b.Protect(r.Context(), def, req.Reason)
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, build.ErrNotInstalled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, build.ErrInvalidRequester):
+		http.Error(w, fmt.Sprintf("error validating request: %s", err), http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("error protecting environment: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func handleEnvUsage(b Builder, w http.ResponseWriter) {
+	usage, err := b.Usage()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("error serialising status: %s", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("error getting usage: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if usage == nil {
+		usage = []build.Usage{}
+	}
+
+	if err = json.NewEncoder(w).Encode(usage); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising usage: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// setSpackYAML sets the SpackYAML of the given Definition from the given
+// Request, along with the Packages of its specs.
+func setSpackYAML(def *build.Definition, req *Request) error {
+	if req.SpackYAML == "" {
+		return nil
+	}
+
+	if len(req.Model.Packages) > 0 {
+		return ErrPackagesAndSpackYAML
+	}
+
+	pkgs, err := build.ParseSpackYAML(req.SpackYAML)
+	if err != nil {
+		return err
+	}
+
+	def.SpackYAML = req.SpackYAML
+	def.Packages = pkgs
+
+	return nil
+}
+
+// handleEnvDiskUsage returns the installed size of every environment,
+// aggregated by owner.
+func handleEnvDiskUsage(b Builder, w http.ResponseWriter) {
+	report, err := b.DiskUsage()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting disk usage: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising disk usage: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func handlePackageAnalytics(b Builder, w http.ResponseWriter, r *http.Request) {
+	report, err := b.PackageAnalytics(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting package analytics: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising package analytics: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleEnvImage streams the image of the environment in the URL path. Images
+// read from their installed location support range requests, and have an
+// ETag and Digest header derived from their sha256.
+func handleEnvImage(b Builder, w http.ResponseWriter, r *http.Request) {
+	envPath, version, ok := envPathAndVersion(w, r, endpointImageSuffix)
+	if !ok {
+		return
+	}
+
+	img, err := b.Image(r.Context(), envPath, version)
+	if errors.Is(err, build.ErrNoImage) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("error opening image: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	defer img.Close()
+
+	setImageHeaders(w, img, path.Base(envPath)+"-"+version+".sif")
+
+	if rs, ok := img.ReadCloser.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", img.ModTime, rs)
+
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "none")
+
+	if _, err = io.Copy(w, img); err != nil {
+		slog.Warn("error streaming image", "env", envPath, "version", version, "err", err)
+	}
+}
+
+// envPathAndVersion returns the environment path and version in a URL path
+// like "/environments/users/foo/env/1[suffix]". If they're invalid, writes a
+// bad request error and returns false.
+func envPathAndVersion(w http.ResponseWriter, r *http.Request, suffix string) (string, string, bool) {
+	envPath, version := path.Split(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, endpointEnvs+"/"), suffix))
+	envPath = strings.TrimSuffix(envPath, "/")
+
+	if err := build.ValidateEnvironmentPath(envPath, version); err != nil {
+		http.Error(w, fmt.Sprintf("error validating request: %s", err), http.StatusBadRequest)
+
+		return "", "", false
+	}
+
+	return envPath, version, true
+}
+
+// handleEnvArtefacts sends a tar.gz of the build artefacts of the environment
+// in the URL path.
+func handleEnvArtefacts(b Builder, w http.ResponseWriter, r *http.Request) {
+	envPath, version, ok := envPathAndVersion(w, r, endpointArtefactsSuffix)
+	if !ok {
+		return
+	}
+
+	bundle, err := b.ArtefactsBundle(r.Context(), envPath, version)
+	if errors.Is(err, build.ErrNoArtefacts) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("error bundling artefacts: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": path.Base(envPath) + "-" + version + "-artifacts.tar.gz"}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(bundle)))
+
+	if _, err = w.Write(bundle); err != nil {
+		slog.Warn("error sending artefacts", "env", envPath, "version", version, "err", err)
+	}
+}
+
+// handleEnvOutdated returns the packages of the environment in the URL path
+// that have newer versions available.
+func handleEnvOutdated(b Builder, w http.ResponseWriter, r *http.Request) {
+	envPath, version, ok := envPathAndVersion(w, r, endpointOutdatedSuffix)
+	if !ok {
+		return
+	}
+
+	upgrades, err := b.Outdated(r.Context(), envPath, version)
+
+	switch {
+	case errors.Is(err, build.ErrNoVersionsFile):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+
+		return
+	case errors.Is(err, build.ErrNoArtefacts):
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("error getting upgrade advice: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(upgrades); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising upgrades: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleEnvVerify returns the Verification of the installed environment in the
+// URL path.
+func handleEnvVerify(b Builder, w http.ResponseWriter, r *http.Request) {
+	envPath, version, ok := envPathAndVersion(w, r, endpointVerifySuffix)
+	if !ok {
+		return
+	}
+
+	verification, err := b.Verify(r.Context(), envPath, version)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error verifying environment: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(verification); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising verification: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleEnvRemovalPreview returns a dry-run build.RemovalReport of what
+// removing the environment in the URL path would delete.
+func handleEnvRemovalPreview(b Builder, w http.ResponseWriter, r *http.Request) {
+	envPath, version, ok := envPathAndVersion(w, r, endpointRemovalSuffix)
+	if !ok {
+		return
+	}
+
+	report, err := b.RemovalPreview(envPath, version)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error previewing removal: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising removal report: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleEnvRemove removes the environment named in the RemoveRequest body,
+// returning a build.RemovalReport of what was removed.
+func handleEnvRemove(b Builder, w http.ResponseWriter, r *http.Request) {
+	req := new(RemoveRequest)
+
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, fmt.Sprintf("error parsing request: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if err := build.ValidateEnvironmentPath(req.Name, req.Version); err != nil {
+		http.Error(w, fmt.Sprintf("error validating request: %s", err), http.StatusBadRequest)
+
+		return
+	}
+
+	report, err := b.Remove(r.Context(), req.Name, req.Version, req.OverrideToken)
+
+	switch {
+	case err == nil:
+	case errors.Is(err, remove.ErrProtected):
+		http.Error(w, err.Error(), http.StatusConflict)
+
+		return
+	default:
+		http.Error(w, fmt.Sprintf("error removing environment: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising removal report: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleEnvMetadata returns the Metadata of the built environment in the URL
+// path.
+func handleEnvMetadata(b Builder, w http.ResponseWriter, r *http.Request) {
+	envPath, version, ok := envPathAndVersion(w, r, endpointMetadataSuffix)
+	if !ok {
+		return
+	}
+
+	metadata, err := b.Metadata(r.Context(), envPath, version)
+	if errors.Is(err, build.ErrNoArtefacts) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("error getting metadata: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(metadata); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising metadata: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleEnvDefinition returns the SubmittedDefinition of the environment in
+// the URL path.
+func handleEnvDefinition(b Builder, w http.ResponseWriter, r *http.Request) {
+	envPath, version, ok := envPathAndVersion(w, r, endpointDefinitionSuffix)
+	if !ok {
+		return
+	}
+
+	sd, err := b.SubmittedDefinition(r.Context(), envPath, version)
+	if errors.Is(err, build.ErrUnknownBuild) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("error getting definition: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(sd); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising definition: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func setImageHeaders(w http.ResponseWriter, img *build.Image, filename string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+	if img.SHA256 == "" {
+		return
+	}
+
+	w.Header().Set("ETag", `"`+img.SHA256+`"`)
+
+	if sum, err := hex.DecodeString(img.SHA256); err == nil {
+		w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+	}
+}
+
+func handleHealth(b Builder, w http.ResponseWriter) {
+	health := Health{
+		Replication: b.ReplicationStatus(),
+		BinaryCache: b.BinaryCacheStatus(),
+		Maintenance: b.Maintenance(),
+	}
+
+	if err := json.NewEncoder(w).Encode(health); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising health: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleVersion responds with the Builder's VersionInfo.
+func handleVersion(b Builder, w http.ResponseWriter) {
+	if err := json.NewEncoder(w).Encode(b.VersionInfo()); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising version: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleBuildsActive responds with the Builder's ActiveBuilds, always as an
+// array.
+func handleBuildsActive(b Builder, w http.ResponseWriter) {
+	active := b.ActiveBuilds()
+	if active == nil {
+		active = []build.ActiveBuild{}
+	}
+
+	if err := json.NewEncoder(w).Encode(active); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising active builds: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleMaintenance changes the Builder's maintenance mode to the given one in
+// response to a POST, responding with the resulting MaintenanceStatus.
+func handleMaintenance(b Builder, w http.ResponseWriter, r *http.Request, mode build.MaintenanceMode) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "maintenance changes must be POSTed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	status, err := b.SetMaintenance(r.Context(), mode)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error changing maintenance mode: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising maintenance status: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// adminOnlyHandler wraps the given handler with adminOnly().
+func (s *Server) adminOnlyHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.adminOnly(w, r, func() { handler(w, r) })
+	}
+}
+
+// adminOnly calls handler if we have no admin token, or the request
+// authorises itself with it; otherwise it responds with a 401.
+func (s *Server) adminOnly(w http.ResponseWriter, r *http.Request, handler func()) {
+	if s.adminToken != "" && subtle.ConstantTimeCompare(
+		[]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+
+		return
+	}
+
+	handler()
+}
+
+// handleEnvCancel cancels the running build of the environment given by the
+// name query parameter in response to a POST, only responding with success
+// once its wr job has been stopped.
+func handleEnvCancel(b Builder, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "cancellations must be POSTed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	err := b.Cancel(r.URL.Query().Get("name"))
+	if errors.Is(err, build.ErrBuildNotRunning) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("error cancelling build: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleEnvRequeue builds the environment given by the name query parameter
+// again in response to a POST.
+func handleEnvRequeue(b Builder, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "requeues must be POSTed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	err := b.Requeue(r.Context(), r.URL.Query().Get("name"))
+
+	switch {
+	case errors.Is(err, build.ErrUnknownBuild):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, build.ErrEnvironmentBuilding):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, build.ErrBuildsPaused):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case err != nil:
+		http.Error(w, fmt.Sprintf("error requeueing build: %s", err), http.StatusInternalServerError)
+	}
+}
+
+// handleEnvRepair verifies all installed environments in response to a POST,
+// repairing broken ones unless the dryrun query parameter is true, and responds
+// with the resulting RepairReport.
+func handleEnvRepair(b Builder, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "repairs must be POSTed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	report, err := b.RepairAll(r.Context(), r.URL.Query().Get("dryrun") == "true")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error repairing environments: %s", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising repair report: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func handleEnvLogTail(b Builder, w http.ResponseWriter, r *http.Request) {
+	lines, err := b.LogTail(r.URL.Query().Get("name"))
+	if errors.Is(err, build.ErrNoLogTail) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	if lines == nil {
+		lines = []string{}
+	}
+
+	if err = json.NewEncoder(w).Encode(lines); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising log lines: %s", err), http.StatusInternalServerError)
 	}
 }
 
 func (s *Server) Stop() {
-	s.srv.Stop(stopTimeout)
+	s.srvMu.Lock()
+	srv := s.srv
+	s.srvMu.Unlock()
+
+	if srv == nil {
+		return
+	}
+
+	srv.Stop(stopTimeout)
 }
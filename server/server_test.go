@@ -24,10 +24,24 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -42,6 +56,7 @@ import (
 	"github.com/wtsi-hgi/go-softpack-builder/internal/gitmock"
 	"github.com/wtsi-hgi/go-softpack-builder/internal/s3mock"
 	"github.com/wtsi-hgi/go-softpack-builder/internal/wrmock"
+	"github.com/wtsi-hgi/go-softpack-builder/remove"
 )
 
 func TestServerMock(t *testing.T) {
@@ -73,6 +88,195 @@ func TestServerMock(t *testing.T) {
 			},
 		})
 
+		Convey("Force requests are passed through to the Definition", func() {
+			resp, err := http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+				strings.NewReader(`{
+					"name": "users/user/myenv",
+					"version": "0.8.1",
+					"force": true,
+					"model": {
+						"description": "help text",
+						"packages": [{"name": "xxhash", "version": "0.8.1"}]
+					}
+				}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(len(mb.Received), ShouldEqual, 2)
+			So(mb.Received[0].Force, ShouldBeFalse)
+			So(mb.Received[1].Force, ShouldBeTrue)
+		})
+
+		Convey("Requests can wait for their build to finish", func() {
+			now := time.Now()
+			mb.Requested = []time.Time{now, now}
+			body := `{"name": "users/user/myenv", "version": "0.8.1", "model": {"packages": [{"name": "xxhash"}]}}`
+
+			resp, err := http.Post(addr+endpointEnvsBuild+"?wait=true", "application/json", //nolint:noctx
+				strings.NewReader(body))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "application/json")
+
+			var detail build.StatusDetail
+
+			So(json.NewDecoder(resp.Body).Decode(&detail), ShouldBeNil)
+			So(detail.Name, ShouldEqual, "users/user/myenv-0.8.1")
+			So(detail.State, ShouldEqual, build.BuildStateBuilding)
+
+			Convey("responding with the current status if they time out", func() {
+				mb.Unfinished = true
+
+				resp, err = http.Post(addr+endpointEnvsBuild+"?wait=1&timeout=1", "application/json", //nolint:noctx
+					strings.NewReader(body))
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusAccepted)
+				So(json.NewDecoder(resp.Body).Decode(&detail), ShouldBeNil)
+				So(detail.Name, ShouldEqual, "users/user/myenv-0.8.1")
+			})
+
+			Convey("but not with invalid timeouts", func() {
+				for _, query := range []string{"?wait=maybe", "?wait=true&timeout=0", "?wait=true&timeout=1h"} {
+					resp, err = http.Post(addr+endpointEnvsBuild+query, "application/json", //nolint:noctx
+						strings.NewReader(body))
+					So(err, ShouldBeNil)
+					So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				}
+
+				So(len(mb.Received), ShouldEqual, 2)
+			})
+		})
+
+		Convey("Build options in requests are passed through to the Definition", func() {
+			body := `{
+				"name": "users/user/myenv",
+				"version": "0.8.1",
+				"profile": "gpu",
+				"processorTarget": "x86_64_v3",
+				"fatTargets": ["x86_64_v4"],
+				"rstudio": true,
+				"testCommand": "python -c 'import anndata'",
+				"externals": ["slurm"],
+				"conflicts": ["openmpi"],
+				"prereqs": ["cuda/12.2"],
+				"requester": "user",
+				"autoUpgrade": true,
+				"artefacts": {"LICENSE": "site licence"},
+				"suppressArtefacts": ["builder.out"],
+				"model": {
+					"description": "help text",
+					"packages": [{"name": "xxhash", "version": "0.8.1"}]
+				}
+			}`
+
+			resp, err := http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+				strings.NewReader(body))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(len(mb.Received), ShouldEqual, 2)
+			So(mb.Received[0].Profile, ShouldEqual, "")
+			So(mb.Received[1].Profile, ShouldEqual, "gpu")
+			So(mb.Received[1].ProcessorTarget, ShouldEqual, "x86_64_v3")
+			So(mb.Received[1].FatTargets, ShouldResemble, []string{"x86_64_v4"})
+			So(mb.Received[0].RStudio, ShouldBeFalse)
+			So(mb.Received[1].RStudio, ShouldBeTrue)
+			So(mb.Received[1].TestCommand, ShouldEqual, "python -c 'import anndata'")
+			So(mb.Received[1].Externals, ShouldResemble, []string{"slurm"})
+			So(mb.Received[1].Conflicts, ShouldResemble, []string{"openmpi"})
+			So(mb.Received[1].Prereqs, ShouldResemble, []string{"cuda/12.2"})
+			So(mb.Received[1].Requester, ShouldEqual, "user")
+			So(mb.Received[0].AutoUpgrade, ShouldBeFalse)
+			So(mb.Received[1].AutoUpgrade, ShouldBeTrue)
+			So(mb.Received[1].ExtraArtefacts, ShouldResemble, map[string]string{"LICENSE": "site licence"})
+			So(mb.Received[1].SuppressArtefacts, ShouldResemble, []string{"builder.out"})
+
+			Convey("and unknown profiles are bad requests", func() {
+				mb.BuildErr = config.ErrUnknownProfile
+
+				resp, err = http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+					strings.NewReader(body))
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+				for _, buildErr := range []error{config.ErrUnknownTarget, build.ErrFatTarget,
+					build.ErrImageNotOffline, config.ErrUnknownExternal} {
+					mb.BuildErr = buildErr
+
+					resp, err = http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+						strings.NewReader(body))
+					So(err, ShouldBeNil)
+					So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				}
+			})
+
+			Convey("and requests can give a spack.yaml instead of packages", func() {
+				spackYAML := `"spackYAML": "spack:\n  specs:\n  - py-numpy@1.26 +blas\n",`
+				noPkgs := strings.Replace(body, `"packages": [{"name": "xxhash", "version": "0.8.1"}]`,
+					`"packages": []`, 1)
+
+				resp, err = http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+					strings.NewReader(strings.Replace(noPkgs, `"model": {`, spackYAML+`"model": {`, 1)))
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(len(mb.Received), ShouldEqual, 3)
+				So(mb.Received[2].SpackYAML, ShouldEqual, "spack:\n  specs:\n  - py-numpy@1.26 +blas\n")
+				So(mb.Received[2].Packages, ShouldResemble, core.Packages{{Name: "py-numpy", Version: "1.26"}})
+
+				resp, err = http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+					strings.NewReader(strings.Replace(body, `"model": {`, spackYAML+`"model": {`, 1)))
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+				resp, err = http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+					strings.NewReader(strings.Replace(noPkgs, `"model": {`,
+						`"spackYAML": "spack:\n  repos: [/x]\n", "model": {`, 1)))
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				So(len(mb.Received), ShouldEqual, 3)
+			})
+
+			Convey("and requests suppressing required artefacts are bad requests", func() {
+				resp, err = http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+					strings.NewReader(strings.Replace(body, `["builder.out"]`, `["softpack.yml"]`, 1)))
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+				So(len(mb.Received), ShouldEqual, 2)
+			})
+
+			Convey("and builds rejected by policy get the reasons", func() {
+				mb.BuildErr = &build.PolicyRejection{Hook: "denylist", Reasons: []string{"a is denied", "b is denied"}}
+
+				resp, err = http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+					strings.NewReader(body))
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusForbidden)
+				So(resp.Header.Get("Content-Type"), ShouldEqual, "application/json")
+
+				var rejection policyRejectionResponse
+
+				So(json.NewDecoder(resp.Body).Decode(&rejection), ShouldBeNil)
+				So(rejection, ShouldResemble, policyRejectionResponse{
+					Error:   "build rejected by policy (denylist): a is denied; b is denied",
+					Hook:    "denylist",
+					Reasons: []string{"a is denied", "b is denied"},
+				})
+			})
+
+			Convey("and builds over quota are rejected with a usage report", func() {
+				mb.BuildErr = fmt.Errorf("%w (users/user builds per day); usage: users/user: "+
+					"1/1 builds in the last day", build.ErrQuotaExceeded)
+
+				resp, err = http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+					strings.NewReader(body))
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusTooManyRequests)
+
+				msg, errr := io.ReadAll(resp.Body)
+				So(errr, ShouldBeNil)
+				So(string(msg), ShouldEqual, "error starting build: quota exceeded (users/user builds per day); "+
+					"usage: users/user: 1/1 builds in the last day\n")
+			})
+		})
+
 		Convey("Unless the request is invalid", func() {
 			for _, test := range [...]struct {
 				InputJSON   string
@@ -90,6 +294,30 @@ func TestServerMock(t *testing.T) {
 						}`,
 					OutputError: "error validating request: invalid environment path\n",
 				},
+				{
+					InputJSON: `
+						{
+							"name": "users/../../etc/myenv",
+							"version": "0.8.1",
+							"model": {
+								"description": "help text",
+								"packages": [{"name": "xxhash", "version": "0.8.1"}]
+							}
+						}`,
+					OutputError: "error validating request: invalid environment path\n",
+				},
+				{
+					InputJSON: `
+						{
+							"name": "users/user/myenv",
+							"version": "../0.8.1",
+							"model": {
+								"description": "help text",
+								"packages": [{"name": "xxhash", "version": "0.8.1"}]
+							}
+						}`,
+					OutputError: "error validating request: invalid environment version\n",
+				},
 				{
 					InputJSON: `
 					{
@@ -124,6 +352,32 @@ func TestServerMock(t *testing.T) {
 					}`,
 					OutputError: "error validating request: package names required\n",
 				},
+				{
+					InputJSON: `
+					{
+						"name": "groups/hgi/myenv",
+						"version": "0.8.1",
+						"conflicts": ["openmpi\"; exec rm -rf ~; \""],
+						"model": {
+							"description": "help text",
+							"packages": [{"name": "xxhash", "version": "0.8.1"}]
+						}
+					}`,
+					OutputError: "error validating request: module conflicts and prereqs must be valid module names\n",
+				},
+				{
+					InputJSON: `
+					{
+						"name": "groups/hgi/myenv",
+						"version": "0.8.1",
+						"requester": "user name",
+						"model": {
+							"description": "help text",
+							"packages": [{"name": "xxhash", "version": "0.8.1"}]
+						}
+					}`,
+					OutputError: "error validating request: invalid requester\n",
+				},
 			} {
 				resp, err := http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
 					strings.NewReader(test.InputJSON))
@@ -134,36 +388,1273 @@ func TestServerMock(t *testing.T) {
 				So(erra, ShouldBeNil)
 				So(string(body), ShouldEqual, test.OutputError)
 			}
+
+			So(len(mb.Received), ShouldEqual, 1)
 		})
 
-		Convey("After which you can get the queued/building/built status for it", func() {
-			mb.Requested = append(mb.Requested, time.Now())
-			resp, err := http.Get(addr + endpointEnvsStatus) //nolint:noctx
+		Convey("You can get usage counts for environments", func() {
+			resp, err := http.Get(addr + endpointEnvsUsage) //nolint:noctx
 			So(err, ShouldBeNil)
 			So(resp.StatusCode, ShouldEqual, http.StatusOK)
-			var statuses []build.Status
-			err = json.NewDecoder(resp.Body).Decode(&statuses)
+
+			body, err := io.ReadAll(resp.Body)
 			So(err, ShouldBeNil)
-			So(len(statuses), ShouldEqual, 1)
-			So(statuses[0].Name, ShouldEqual, "users/user/myenv-0.8.1")
-			So(*statuses[0].Requested, ShouldHappenWithin, 0*time.Microsecond, mb.Requested[0])
+			So(string(body), ShouldEqual, "[]\n")
 
-			postToBuildEndpoint(addr, "users/user/myotherenv", "1")
+			mb.Usages = []build.Usage{{Environment: "users/user/myenv-0.8.1", Count: 2, Users: 1}}
 
-			mb.Requested = append(mb.Requested, time.Now())
+			resp, err = http.Get(addr + endpointEnvsUsage) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
 
-			resp, err = http.Get(addr + endpointEnvsStatus) //nolint:noctx
+			var usages []build.Usage
+			err = json.NewDecoder(resp.Body).Decode(&usages)
+			So(err, ShouldBeNil)
+			So(len(usages), ShouldEqual, 1)
+			So(usages[0].Environment, ShouldEqual, "users/user/myenv-0.8.1")
+			So(usages[0].Count, ShouldEqual, 2)
+
+			mb.UsageErr = build.ErrInvalidJSON
+
+			resp, err = http.Get(addr + endpointEnvsUsage) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusInternalServerError)
+		})
+
+		Convey("You can get the disk usage of environments", func() {
+			mb.Disk = &build.DiskUsageReport{
+				Bytes:  3,
+				Owners: []build.OwnerDiskUsage{{Owner: "users/user", Environments: 1, Bytes: 3}},
+				Environments: []build.EnvironmentDiskUsage{
+					{Environment: "users/user/myenv-0.8.1", Owner: "users/user", Bytes: 3, ImageBytes: 2},
+				},
+			}
+
+			resp, err := http.Get(addr + endpointEnvsDiskUsage) //nolint:noctx
 			So(err, ShouldBeNil)
 			So(resp.StatusCode, ShouldEqual, http.StatusOK)
-			statuses = []build.Status{}
-			err = json.NewDecoder(resp.Body).Decode(&statuses)
+
+			var report build.DiskUsageReport
+			err = json.NewDecoder(resp.Body).Decode(&report)
 			So(err, ShouldBeNil)
-			So(len(statuses), ShouldEqual, 2)
-			So(statuses[0].Name, ShouldEqual, "users/user/myenv-0.8.1")
-			So(statuses[1].Name, ShouldEqual, "users/user/myotherenv-1")
-			So(*statuses[1].Requested, ShouldHappenWithin, 0*time.Microsecond, mb.Requested[1])
+			So(&report, ShouldResemble, mb.Disk)
+
+			mb.DiskErr = build.ErrInvalidJSON
+
+			resp, err = http.Get(addr + endpointEnvsDiskUsage) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusInternalServerError)
 		})
-	})
+
+		Convey("You can get package analytics", func() {
+			mb.Packages = &build.PackageReport{
+				Environments: 2,
+				Packages: []build.PackageCount{{
+					Name: "xxhash", Environments: 2, Roots: 1,
+					Versions: []build.VersionCount{{Version: "0.8.1", Environments: 2}},
+				}},
+			}
+
+			resp, err := http.Get(addr + endpointAnalytics) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var report build.PackageReport
+			err = json.NewDecoder(resp.Body).Decode(&report)
+			So(err, ShouldBeNil)
+			So(&report, ShouldResemble, mb.Packages)
+
+			mb.PackagesErr = build.ErrInvalidJSON
+
+			resp, err = http.Get(addr + endpointAnalytics) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusInternalServerError)
+		})
+
+		Convey("You can get gsb's version and features", func() {
+			mb.Version = build.VersionInfo{
+				Version:  "v1.2.3",
+				Commit:   "abc123",
+				Features: build.Features{S3: "s3", Runner: "wr", ModuleFormat: "tcl", Quotas: true},
+			}
+
+			resp, err := http.Get(addr + endpointVersion) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var info build.VersionInfo
+			err = json.NewDecoder(resp.Body).Decode(&info)
+			So(err, ShouldBeNil)
+			So(info, ShouldResemble, mb.Version)
+		})
+
+		Convey("You can see which builds are active right now", func() {
+			resp, err := http.Get(addr + endpointBuildsActive) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			body, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(strings.TrimSpace(string(body)), ShouldEqual, "[]")
+
+			mb.Active = []build.ActiveBuild{
+				{Environment: "users/user/myenv-0.8.1", Stage: build.BuildStageBuilding, JobID: "abc", ElapsedSeconds: 60},
+			}
+
+			resp, err = http.Get(addr + endpointBuildsActive) //nolint:noctx
+			So(err, ShouldBeNil)
+
+			var active []build.ActiveBuild
+			err = json.NewDecoder(resp.Body).Decode(&active)
+			So(err, ShouldBeNil)
+			So(active, ShouldResemble, mb.Active)
+		})
+
+		Convey("You can render what a build would generate, without building it", func() {
+			mb.Rendering = &build.Rendering{SingularityDef: "def", Module: "module", Usage: "usage", SoftpackYML: "yml"}
+			body := `{"name":"users/user/myenv","version":"0.8.1","model":{"packages":[{"name":"xxhash"}]}}`
+			received := len(mb.Received)
+
+			resp, err := http.Post(addr+endpointRender, "application/json", //nolint:noctx
+				strings.NewReader(body))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var rendering build.Rendering
+			err = json.NewDecoder(resp.Body).Decode(&rendering)
+			So(err, ShouldBeNil)
+			So(rendering, ShouldResemble, *mb.Rendering)
+			So(len(mb.Rendered), ShouldEqual, 1)
+			So(mb.Rendered[0].EnvironmentPath, ShouldEqual, "users/user/")
+			So(mb.Rendered[0].Packages, ShouldResemble, core.Packages{{Name: "xxhash"}})
+			So(len(mb.Received), ShouldEqual, received)
+
+			mb.RenderErr = config.ErrUnknownProfile
+
+			resp, err = http.Post(addr+endpointRender, "application/json", //nolint:noctx
+				strings.NewReader(body))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			resp, err = http.Post(addr+endpointRender, "application/json", //nolint:noctx
+				strings.NewReader(`{"name":"users/user/myenv","version":""}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			resp, err = http.Get(addr + endpointRender) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+			So(len(mb.Rendered), ShouldEqual, 2)
+		})
+
+		Convey("You can get the recent log lines of a build", func() {
+			mb.LogTails = map[string][]string{"users/user/myenv-0.8.1": {"line1", "line2"}}
+
+			resp, err := http.Get(addr + endpointEnvsLogTail + "?name=users/user/myenv-0.8.1") //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var lines []string
+			err = json.NewDecoder(resp.Body).Decode(&lines)
+			So(err, ShouldBeNil)
+			So(lines, ShouldResemble, []string{"line1", "line2"})
+
+			resp, err = http.Get(addr + endpointEnvsLogTail + "?name=users/user/other-1") //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("You can get the health of the service", func() {
+			lastReplicated := time.Now().Truncate(time.Second)
+			mb.Replication = build.ReplicationStatus{
+				Enabled:        true,
+				Pending:        2,
+				LagSeconds:     90,
+				LastReplicated: &lastReplicated,
+				LastError:      "upload failed",
+			}
+			mb.Cache = build.BinaryCacheStatus{RecentBuilds: 3, FromCache: 9, FromSource: 1, HitRate: 0.9}
+
+			resp, err := http.Get(addr + endpointHealth) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var health Health
+			err = json.NewDecoder(resp.Body).Decode(&health)
+			So(err, ShouldBeNil)
+			So(health.Replication.Pending, ShouldEqual, 2)
+			So(health.Replication.LagSeconds, ShouldEqual, 90)
+			So(health.Replication.LastReplicated.Equal(lastReplicated), ShouldBeTrue)
+			So(health.Replication.LastError, ShouldEqual, "upload failed")
+			So(health.BinaryCache, ShouldResemble, mb.Cache)
+		})
+
+		Convey("You can pause, drain and resume builds for maintenance", func() {
+			resp, err := http.Get(addr + endpointMaintenance + "/pause") //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+			So(mb.Maint.Mode, ShouldEqual, build.MaintenanceMode(""))
+
+			for endpoint, mode := range map[string]build.MaintenanceMode{
+				"/pause":  build.MaintenancePaused,
+				"/drain":  build.MaintenanceDraining,
+				"/resume": build.MaintenanceOff,
+			} {
+				resp, err = http.Post(addr+endpointMaintenance+endpoint, "", nil) //nolint:noctx
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+				var status build.MaintenanceStatus
+				err = json.NewDecoder(resp.Body).Decode(&status)
+				So(err, ShouldBeNil)
+				So(status.Mode, ShouldEqual, mode)
+
+				resp, err = http.Get(addr + endpointHealth) //nolint:noctx
+				So(err, ShouldBeNil)
+
+				var health Health
+				err = json.NewDecoder(resp.Body).Decode(&health)
+				So(err, ShouldBeNil)
+				So(health.Maintenance.Mode, ShouldEqual, mode)
+			}
+
+			mb.BuildErr = build.ErrBuildsPaused
+
+			resp, err = http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv", "version": "0.8.1", `+
+					`"model": {"description": "help text", "packages": [{"name": "xxhash"}]}}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+		})
+
+		Convey("You can cancel and requeue builds", func() {
+			mb.Requested = []time.Time{time.Now()}
+
+			resp, err := http.Get(addr + endpointEnvsCancel + "?name=users/user/myenv-0.8.1") //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+
+			for endpoint, expected := range map[string]*[]string{
+				endpointEnvsCancel:  &mb.Cancelled,
+				endpointEnvsRequeue: &mb.Requeued,
+			} {
+				resp, err = http.Post(addr+endpoint+"?name=users/user/myenv-0.8.1", "", nil) //nolint:noctx
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+				So(*expected, ShouldResemble, []string{"users/user/myenv-0.8.1"})
+
+				resp, err = http.Post(addr+endpoint+"?name=users/user/other-1", "", nil) //nolint:noctx
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+			}
+
+			mb.BuildErr = build.ErrEnvironmentBuilding
+
+			resp, err = http.Post(addr+endpointEnvsRequeue+"?name=users/user/myenv-0.8.1", "", nil) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("You can verify and repair all installed environments", func() {
+			mb.Problems = map[string][]string{"users/user/myenv-0.8.1": {"image unreadable: missing"}}
+
+			resp, err := http.Get(addr + endpointEnvsRepair) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+
+			expected := build.RepairReport{
+				DryRun:  true,
+				Checked: 1,
+				Broken:  1,
+				Environments: []build.RepairResult{
+					{Environment: "users/user/myenv-0.8.1", Problems: []string{"image unreadable: missing"}},
+				},
+			}
+
+			for _, dryRun := range []bool{true, false} {
+				u := addr + endpointEnvsRepair
+				if dryRun {
+					u += "?dryrun=true"
+				}
+
+				resp, err = http.Post(u, "", nil) //nolint:noctx
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+				var report build.RepairReport
+				err = json.NewDecoder(resp.Body).Decode(&report)
+				So(err, ShouldBeNil)
+				So(report, ShouldResemble, expected)
+
+				expected.DryRun = false
+				expected.Repaired = 1
+				expected.Environments[0].Repaired = true
+			}
+
+			So(mb.Problems, ShouldBeNil)
+		})
+
+		Convey("You can stream build status changes as Server-Sent Events", func() {
+			mb.Changes = make(chan build.StatusChange)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+endpointStatusStream, nil)
+			So(err, ShouldBeNil)
+
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "text/event-stream")
+
+			defer resp.Body.Close()
+
+			mb.Changes <- build.StatusChange{
+				Stage:  build.BuildStageBuilding,
+				Status: build.Status{Name: "users/user/myenv-0.8.1", JobID: "abc"},
+			}
+
+			reader := bufio.NewReader(resp.Body)
+
+			line, err := reader.ReadString('\n')
+			So(err, ShouldBeNil)
+			So(line, ShouldEqual, "event: status\n")
+
+			line, err = reader.ReadString('\n')
+			So(err, ShouldBeNil)
+			So(line, ShouldStartWith, "data: ")
+
+			var change build.StatusChange
+			err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &change)
+			So(err, ShouldBeNil)
+			So(change.Stage, ShouldEqual, build.BuildStageBuilding)
+			So(change.Status.Name, ShouldEqual, "users/user/myenv-0.8.1")
+			So(change.Status.JobID, ShouldEqual, "abc")
+
+			line, err = reader.ReadString('\n')
+			So(err, ShouldBeNil)
+			So(line, ShouldEqual, "\n")
+		})
+
+		Convey("You can deprecate an environment", func() {
+			resp, err := http.Post(addr+endpointEnvsDeprecate, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv", "version": "0.8.1", `+
+					`"replacement": "users/user/myenv-0.8.2"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(mb.Deprecated, ShouldResemble, map[string]string{"users/user/myenv-0.8.1": "users/user/myenv-0.8.2"})
+
+			resp, err = http.Post(addr+endpointEnvsDeprecate, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			body, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "error validating request: environment version required\n")
+
+			resp, err = http.Post(addr+endpointEnvsDeprecate, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv", "version": "0.8.1", "replacement": "users/x/[exec rm]"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("You can protect an environment against removal, and unprotect it", func() {
+			resp, err := http.Post(addr+endpointEnvsProtect, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv", "version": "0.8.1", `+
+					`"reason": "used by pipelines", "requester": "user"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(mb.Protected, ShouldResemble, map[string]string{"users/user/myenv-0.8.1": "used by pipelines"})
+
+			resp, err = http.Post(addr+endpointEnvsUnprotect, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv", "version": "0.8.1"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(mb.Protected, ShouldBeEmpty)
+
+			resp, err = http.Post(addr+endpointEnvsProtect, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			mb.ProtectErr = build.ErrNotInstalled
+
+			resp, err = http.Post(addr+endpointEnvsProtect, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv", "version": "0.8.1"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("You can remove an environment, unless it's protected", func() {
+			resp, err := http.Post(addr+endpointEnvsRemove, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv", "version": "0.8.1"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(mb.Removed, ShouldResemble, []string{"users/user/myenv-0.8.1"})
+
+			report := new(build.RemovalReport)
+			So(json.NewDecoder(resp.Body).Decode(report), ShouldBeNil)
+			So(report.Environment, ShouldEqual, "users/user/myenv-0.8.1")
+
+			resp, err = http.Post(addr+endpointEnvsRemove, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/../myenv", "version": "0.8.1"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			mb.RemoveErr = fmt.Errorf("%w (pipelines)", remove.ErrProtected)
+
+			resp, err = http.Post(addr+endpointEnvsRemove, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv", "version": "0.8.1"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+
+			mb.RemoveErr = io.ErrUnexpectedEOF
+
+			resp, err = http.Post(addr+endpointEnvsRemove, "application/json", //nolint:noctx
+				strings.NewReader(`{"name": "users/user/myenv", "version": "0.8.1"}`))
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusInternalServerError)
+			So(mb.Removed, ShouldHaveLength, 1)
+		})
+
+		Convey("After which you can get the queued/building/built status for it", func() {
+			mb.Requested = append(mb.Requested, time.Now())
+			resp, err := http.Get(addr + endpointEnvsStatus) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			var statuses []build.Status
+			err = json.NewDecoder(resp.Body).Decode(&statuses)
+			So(err, ShouldBeNil)
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].Name, ShouldEqual, "users/user/myenv-0.8.1")
+			So(*statuses[0].Requested, ShouldHappenWithin, 0*time.Microsecond, mb.Requested[0])
+
+			postToBuildEndpoint(addr, "users/user/myotherenv", "1")
+
+			mb.Requested = append(mb.Requested, time.Now())
+
+			resp, err = http.Get(addr + endpointEnvsStatus) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			statuses = []build.Status{}
+			err = json.NewDecoder(resp.Body).Decode(&statuses)
+			So(err, ShouldBeNil)
+			So(len(statuses), ShouldEqual, 2)
+			So(statuses[0].Name, ShouldEqual, "users/user/myenv-0.8.1")
+			So(statuses[1].Name, ShouldEqual, "users/user/myotherenv-1")
+			So(*statuses[1].Requested, ShouldHappenWithin, 0*time.Microsecond, mb.Requested[1])
+		})
+
+		Convey("You can get the status details of a single build", func() {
+			mb.Requested = append(mb.Requested, time.Now())
+
+			resp, err := http.Get(addr + endpointEnvsStatus + "/users/user/myenv/0.8.1") //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var detail build.StatusDetail
+			err = json.NewDecoder(resp.Body).Decode(&detail)
+			So(err, ShouldBeNil)
+			So(detail.Name, ShouldEqual, "users/user/myenv-0.8.1")
+			So(detail.State, ShouldEqual, build.BuildStateBuilding)
+			So(detail.Stage, ShouldEqual, build.BuildStageRequested)
+
+			resp, err = http.Get(addr + endpointEnvsStatus + "/users/user/myenv/2") //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			resp, err = http.Get(addr + endpointEnvsStatus + "/users/user/../myenv/2") //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldNotEqual, http.StatusOK)
+
+			resp, err = http.Get(addr + endpointEnvsStatus + "/users/myenv/2") //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("You can download the image of an environment", func() {
+			mb.Images = map[string]string{
+				"users/user/myenv-0.8.1": "image data",
+				"users/user/myenv-2":     "s3: image data",
+			}
+			imageURL := addr + endpointEnvs + "/users/user/myenv/0.8.1" + endpointImageSuffix
+
+			resp, err := http.Get(imageURL) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			body, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "image data")
+
+			etag := `"` + fmt.Sprintf("%x", sha256.Sum256(body)) + `"`
+			So(resp.Header.Get("ETag"), ShouldEqual, etag)
+			So(resp.Header.Get("Digest"), ShouldStartWith, "sha-256=")
+			So(resp.Header.Get("Accept-Ranges"), ShouldEqual, "bytes")
+			So(resp.Header.Get("Content-Disposition"), ShouldEqual, "attachment; filename=myenv-0.8.1.sif")
+			So(resp.Header.Get("Last-Modified"), ShouldEqual, buildermock.ImageModTime.Format(http.TimeFormat))
+
+			req, err := http.NewRequest(http.MethodGet, imageURL, nil) //nolint:noctx
+			So(err, ShouldBeNil)
+			req.Header.Set("Range", "bytes=6-")
+
+			resp, err = http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusPartialContent)
+
+			body, err = io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "data")
+
+			req.Header.Del("Range")
+			req.Header.Set("If-None-Match", etag)
+
+			resp, err = http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotModified)
+
+			resp, err = http.Get(addr + endpointEnvs + "/users/user/myenv/2" + endpointImageSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("ETag"), ShouldBeBlank)
+			So(resp.Header.Get("Accept-Ranges"), ShouldEqual, "none")
+
+			body, err = io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "s3: image data")
+
+			resp, err = http.Get(addr + endpointEnvs + "/users/user/myenv/3" + endpointImageSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			resp, err = http.Get(addr + endpointEnvs + "/users/myenv/3" + endpointImageSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("You can download the artefacts of an environment", func() {
+			mb.Bundles = map[string][]byte{"users/user/myenv-0.8.1": []byte("bundle data")}
+
+			resp, err := http.Get(addr + endpointEnvs + "/users/user/myenv/0.8.1" + endpointArtefactsSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "application/gzip")
+			So(resp.Header.Get("Content-Disposition"), ShouldEqual,
+				`attachment; filename=myenv-0.8.1-artifacts.tar.gz`)
+
+			body, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, "bundle data")
+
+			resp, err = http.Get(addr + endpointEnvs + "/users/user/myenv/2" + endpointArtefactsSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			resp, err = http.Get(addr + endpointEnvs + "/users/myenv/2" + endpointArtefactsSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("You can get upgrade advice for an environment", func() {
+			outdatedURL := addr + endpointEnvs + "/users/user/myenv/0.8.1" + endpointOutdatedSuffix
+
+			resp, err := http.Get(outdatedURL) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotImplemented)
+
+			mb.Upgrades = map[string][]build.Upgrade{
+				"users/user/myenv-0.8.1": {{Name: "xxhash", Version: "0.8.1", Latest: "0.8.2"}},
+			}
+
+			resp, err = http.Get(outdatedURL) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var upgrades []build.Upgrade
+			err = json.NewDecoder(resp.Body).Decode(&upgrades)
+			So(err, ShouldBeNil)
+			So(upgrades, ShouldResemble, mb.Upgrades["users/user/myenv-0.8.1"])
+
+			resp, err = http.Get(addr + endpointEnvs + "/users/user/myenv/2" + endpointOutdatedSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("You can verify an installed environment", func() {
+			verifyURL := addr + endpointEnvs + "/users/user/myenv/0.8.1" + endpointVerifySuffix
+			mb.Problems = map[string][]string{"users/user/myenv-0.8.1": {"image unreadable: missing"}}
+
+			resp, err := http.Get(verifyURL) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var v build.Verification
+			err = json.NewDecoder(resp.Body).Decode(&v)
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, build.Verification{
+				Environment: "users/user/myenv-0.8.1",
+				Problems:    []string{"image unreadable: missing"},
+			})
+
+			resp, err = http.Get(addr + endpointEnvs + "/users/myenv/2" + endpointVerifySuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("You can get the metadata of a built environment", func() {
+			metadataURL := addr + endpointEnvs + "/users/user/myenv/0.8.1" + endpointMetadataSuffix
+
+			resp, err := http.Get(metadataURL) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			mb.SoftpackYMLs = map[string]string{"users/user/myenv-0.8.1": "packages:\n  - xxhash@0.8.1\n"}
+
+			resp, err = http.Get(metadataURL) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var m build.Metadata
+			err = json.NewDecoder(resp.Body).Decode(&m)
+			So(err, ShouldBeNil)
+			So(m, ShouldResemble, build.Metadata{
+				Environment: "users/user/myenv-0.8.1",
+				SoftpackYML: "packages:\n  - xxhash@0.8.1\n",
+				SpackLock:   "{}",
+			})
+
+			resp, err = http.Get(addr + endpointEnvs + "/users/myenv/2" + endpointMetadataSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("You can get the singularity.def submitted for an environment", func() {
+			definitionURL := addr + endpointEnvs + "/users/user/myenv/0.8.1" + endpointDefinitionSuffix
+
+			resp, err := http.Get(definitionURL) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusNotFound)
+
+			mb.Submitted = map[string]*build.SubmittedDefinition{
+				"users/user/myenv-0.8.1": {
+					Environment:    "users/user/myenv-0.8.1",
+					BuildID:        "abc",
+					SingularityDef: "Bootstrap: docker",
+					Variables:      json.RawMessage(`{"ProcessorTarget":"x86_64_v3"}`),
+				},
+			}
+
+			resp, err = http.Get(definitionURL) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var sd build.SubmittedDefinition
+			err = json.NewDecoder(resp.Body).Decode(&sd)
+			So(err, ShouldBeNil)
+			So(&sd, ShouldResemble, mb.Submitted["users/user/myenv-0.8.1"])
+
+			resp, err = http.Get(addr + endpointEnvs + "/users/myenv/2" + endpointDefinitionSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("You can preview the removal of an environment", func() {
+			resp, err := http.Get(addr + endpointEnvs + "/users/user/myenv/0.8.1" + endpointRemovalSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var report build.RemovalReport
+			err = json.NewDecoder(resp.Body).Decode(&report)
+			So(err, ShouldBeNil)
+			So(report, ShouldResemble, build.RemovalReport{DryRun: true, Environment: "users/user/myenv-0.8.1"})
+
+			resp, err = http.Get(addr + endpointEnvs + "/users/myenv/2" + endpointRemovalSuffix) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Status query parameters are passed to the Builder", func() {
+			since := "2024-02-12T11:58:49Z"
+			resp, err := http.Get(addr + endpointEnvsStatus + "?state=failed&path=users/user/" + //nolint:noctx
+				"&requester=user&label=tier=production&label=project=atlas&since=" + since +
+				"&sort=buildstart&order=desc&limit=10&offset=20")
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			sinceTime, err := time.Parse(time.RFC3339, since)
+			So(err, ShouldBeNil)
+			So(mb.LastQuery, ShouldResemble, build.StatusQuery{
+				State:      build.BuildStateFailed,
+				PathPrefix: "users/user/",
+				Requester:  "user",
+				Labels:     map[string]string{"tier": "production", "project": "atlas"},
+				Since:      sinceTime,
+				SortBy:     build.StatusSortBuildStart,
+				Descending: true,
+				Offset:     20,
+				Limit:      10,
+			})
+
+			for _, query := range [...]string{
+				"state=foo", "sort=foo", "order=foo", "since=yesterday", "limit=a", "offset=-1", "label=tier",
+				"label=tier=a%20b",
+			} {
+				resp, err = http.Get(addr + endpointEnvsStatus + "?" + query) //nolint:noctx
+				So(err, ShouldBeNil)
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			}
+		})
+	})
+}
+
+func TestServerLimits(t *testing.T) {
+	Convey("Given a server configured with build request limits", t, func() {
+		mb := new(buildermock.MockBuilder)
+
+		l, err := NewListener("")
+		So(err, ShouldBeNil)
+		addr := "http://" + l.Addr().String()
+
+		conf := &config.Config{}
+		conf.Server.MaxRequestBytes = 400
+		conf.Server.MaxPackages = 2
+		conf.Server.RateLimit = 0.001
+		conf.Server.RateBurst = 3
+
+		s := New(mb, conf)
+		defer s.Stop()
+		go func() {
+			s.Start(l) //nolint:errcheck
+		}()
+
+		post := func(body string) int {
+			resp, errp := http.Post(addr+endpointEnvsBuild, "application/json", //nolint:noctx
+				strings.NewReader(body))
+			So(errp, ShouldBeNil)
+
+			return resp.StatusCode
+		}
+
+		Convey("Requests that are too large are rejected", func() {
+			So(post(`{"name": "users/user/myenv", "version": "1", "model": {"description": "`+
+				strings.Repeat("a", 400)+`", "packages": [{"name": "xxhash"}]}}`),
+				ShouldEqual, http.StatusRequestEntityTooLarge)
+
+			So(post(`{"name": "users/user/myenv", "version": "1", "model": {"description": "d", `+
+				`"packages": [{"name": "a"}, {"name": "b"}, {"name": "c"}]}}`),
+				ShouldEqual, http.StatusRequestEntityTooLarge)
+
+			So(post(`{"name": "users/user/myenv", "version": "1", "model": {"description": "d", `+
+				`"packages": [{"name": "a"}, {"name": "b"}]}}`), ShouldEqual, http.StatusOK)
+
+			So(len(mb.Received), ShouldEqual, 1)
+		})
+
+		Convey("Too many requests from the same client are rejected", func() {
+			for i := 0; i < 3; i++ {
+				So(post(`{}`), ShouldEqual, http.StatusBadRequest)
+			}
+
+			So(post(`{}`), ShouldEqual, http.StatusTooManyRequests)
+
+			resp, err := http.Get(addr + endpointEnvsStatus) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		})
+	})
+
+	Convey("Rate limiters refill their buckets over time", t, func() {
+		So(newRateLimiter(0, 10), ShouldBeNil)
+
+		now := time.Now()
+		rl := newRateLimiter(2, 0)
+		rl.now = func() time.Time { return now }
+
+		So(rl.allow("a"), ShouldBeTrue)
+		So(rl.allow("a"), ShouldBeTrue)
+		So(rl.allow("a"), ShouldBeFalse)
+		So(rl.allow("b"), ShouldBeTrue)
+
+		now = now.Add(500 * time.Millisecond)
+
+		So(rl.allow("a"), ShouldBeTrue)
+		So(rl.allow("a"), ShouldBeFalse)
+
+		now = now.Add(time.Hour)
+
+		So(rl.allow("a"), ShouldBeTrue)
+		So(rl.allow("a"), ShouldBeTrue)
+		So(rl.allow("a"), ShouldBeFalse)
+	})
+}
+
+func TestServerTemplates(t *testing.T) {
+	Convey("Given a server configured with templates", t, func() {
+		mb := new(buildermock.MockBuilder)
+
+		l, err := NewListener("")
+		So(err, ShouldBeNil)
+		addr := "http://" + l.Addr().String()
+
+		conf := &config.Config{}
+		conf.Server.MaxPackages = 3
+		conf.Templates = []config.Template{
+			{Name: "single-cell-r", Description: "R for single cell", Packages: []string{"r-seurat@4", "r-signac"}},
+			{Name: "cuda", Packages: []string{"cuda"}, Profile: "gpu"},
+		}
+
+		s := New(mb, conf)
+		defer s.Stop()
+		go func() {
+			s.Start(l) //nolint:errcheck
+		}()
+
+		post := func(body string) *http.Response {
+			resp, errp := http.Post(addr+endpointTemplatesBuild, "application/json", //nolint:noctx
+				strings.NewReader(body))
+			So(errp, ShouldBeNil)
+
+			return resp
+		}
+
+		Convey("you can list them", func() {
+			resp, errg := http.Get(addr + endpointTemplates) //nolint:noctx
+			So(errg, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			var templates []config.Template
+
+			So(json.NewDecoder(resp.Body).Decode(&templates), ShouldBeNil)
+			So(templates, ShouldResemble, conf.Templates)
+		})
+
+		Convey("you can build environments based on them", func() {
+			resp := post(`{"template": "single-cell-r", "name": "users/user/sc", "version": "1",
+				"requester": "user", "model": {"packages": [{"name": "r-seurat", "version": "5"},
+				{"name": "py-anndata"}]}}`)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(len(mb.Received), ShouldEqual, 1)
+			So(mb.Received[0], ShouldResemble, &build.Definition{
+				EnvironmentPath:    "users/user/",
+				EnvironmentName:    "sc",
+				EnvironmentVersion: "1",
+				Description:        "R for single cell",
+				Packages: []core.Package{
+					{Name: "r-signac"},
+					{Name: "r-seurat", Version: "5"},
+					{Name: "py-anndata"},
+				},
+				Requester: "user",
+			})
+
+			resp = post(`{"template": "cuda", "name": "users/user/gpu", "version": "1",
+				"profile": "other", "model": {"description": "mine"}}`)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(mb.Received[1].Description, ShouldEqual, "mine")
+			So(mb.Received[1].Profile, ShouldEqual, "other")
+			So(mb.Received[1].Packages, ShouldResemble, core.Packages{{Name: "cuda"}})
+
+			resp = post(`{"template": "cuda", "name": "users/user/gpu2", "version": "1"}`)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(mb.Received[2].Profile, ShouldEqual, "gpu")
+		})
+
+		Convey("unknown templates and invalid requests are rejected", func() {
+			So(post(`{"template": "other", "name": "users/user/sc", "version": "1"}`).StatusCode,
+				ShouldEqual, http.StatusNotFound)
+			So(post(`{"template": "single-cell-r", "name": "users/user/sc", "version": "1",
+				"model": {"packages": [{"name": "a"}, {"name": "b"}]}}`).StatusCode,
+				ShouldEqual, http.StatusRequestEntityTooLarge)
+			So(post(`{"template": "single-cell-r", "name": "users/user/../sc", "version": "1"}`).StatusCode,
+				ShouldEqual, http.StatusBadRequest)
+			So(post(`{`).StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(mb.Received, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestServerClone(t *testing.T) {
+	Convey("Given a server and a built environment", t, func() {
+		mb := new(buildermock.MockBuilder)
+		mb.SoftpackYMLs = map[string]string{
+			"users/user/myenv-1": "description: |\n  my env\n\n  The following executables are added to your PATH:\n" +
+				"    - xxhsum\npackages:\n  - xxhash@0.8.1\n  - zlib@1.3\n  - py-anndata@0.10\n" +
+				"processor_target: x86_64_v3\nlabels:\n  project: atlas\n",
+		}
+
+		l, err := NewListener("")
+		So(err, ShouldBeNil)
+		addr := "http://" + l.Addr().String()
+
+		conf := &config.Config{}
+		conf.Server.MaxPackages = 3
+
+		s := New(mb, conf)
+		defer s.Stop()
+		go func() {
+			s.Start(l) //nolint:errcheck
+		}()
+
+		post := func(body string) *http.Response {
+			resp, errp := http.Post(addr+endpointEnvsClone, "application/json", //nolint:noctx
+				strings.NewReader(body))
+			So(errp, ShouldBeNil)
+
+			return resp
+		}
+
+		Convey("you can build a copy of it", func() {
+			resp := post(`{"source": "users/user/myenv", "sourceVersion": "1", "name": "users/other/copy",
+				"version": "1", "requester": "other"}`)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(len(mb.Received), ShouldEqual, 1)
+			So(mb.Received[0], ShouldResemble, &build.Definition{
+				EnvironmentPath:    "users/other/",
+				EnvironmentName:    "copy",
+				EnvironmentVersion: "1",
+				Description:        "my env",
+				Packages: core.Packages{
+					{Name: "xxhash", Version: "0.8.1"},
+					{Name: "zlib", Version: "1.3"},
+					{Name: "py-anndata", Version: "0.10"},
+				},
+				ProcessorTarget: "x86_64_v3",
+				Requester:       "other",
+				Labels:          map[string]string{"project": "atlas"},
+			})
+		})
+
+		Convey("you can change its packages and description", func() {
+			resp := post(`{"source": "users/user/myenv", "sourceVersion": "1", "name": "users/user/myenv",
+				"version": "2", "removePackages": ["py-anndata"], "model": {"description": "newer",
+				"packages": [{"name": "zlib", "version": "1.3.1"}, {"name": "r-seurat"}]}}`)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(len(mb.Received), ShouldEqual, 1)
+			So(mb.Received[0].Description, ShouldEqual, "newer")
+			So(mb.Received[0].Packages, ShouldResemble, core.Packages{
+				{Name: "xxhash", Version: "0.8.1"},
+				{Name: "zlib", Version: "1.3.1"},
+				{Name: "r-seurat"},
+			})
+		})
+
+		Convey("unbuilt sources and invalid requests are rejected", func() {
+			So(post(`{"source": "users/user/other", "sourceVersion": "1", "name": "users/user/copy",
+				"version": "1"}`).StatusCode, ShouldEqual, http.StatusNotFound)
+			So(post(`{"source": "users/user/../myenv", "sourceVersion": "1", "name": "users/user/copy",
+				"version": "1"}`).StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(post(`{"source": "users/user/myenv", "sourceVersion": "1", "name": "users/user/copy",
+				"version": "1", "model": {"packages": [{"name": "a"}]}}`).StatusCode,
+				ShouldEqual, http.StatusRequestEntityTooLarge)
+			So(post(`{"source": "users/user/myenv", "sourceVersion": "1", "name": "users/user/../copy",
+				"version": "1"}`).StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(post(`{`).StatusCode, ShouldEqual, http.StatusBadRequest)
+			So(mb.Received, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestServerAdminToken(t *testing.T) {
+	Convey("Given a server configured with an admin token", t, func() {
+		mb := new(buildermock.MockBuilder)
+
+		l, err := NewListener("")
+		So(err, ShouldBeNil)
+		addr := "http://" + l.Addr().String()
+
+		conf := &config.Config{}
+		conf.Server.AdminToken = "secret"
+
+		s := New(mb, conf)
+		defer s.Stop()
+		go func() {
+			s.Start(l) //nolint:errcheck
+		}()
+
+		post := func(endpoint, token string) int {
+			req, errr := http.NewRequest(http.MethodPost, addr+endpoint, nil) //nolint:noctx
+			So(errr, ShouldBeNil)
+
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			resp, errr := http.DefaultClient.Do(req)
+			So(errr, ShouldBeNil)
+
+			return resp.StatusCode
+		}
+
+		Convey("Admin endpoints require the token", func() {
+			for _, endpoint := range []string{
+				endpointMaintenance + "/pause",
+				endpointEnvsCancel + "?name=users/user/myenv-1",
+				endpointEnvsRequeue + "?name=users/user/myenv-1",
+				endpointEnvsRepair,
+				endpointEnvsUnprotect,
+				endpointEnvsRemove,
+			} {
+				So(post(endpoint, ""), ShouldEqual, http.StatusUnauthorized)
+				So(post(endpoint, "wrong"), ShouldEqual, http.StatusUnauthorized)
+			}
+
+			So(mb.Maint.Mode, ShouldEqual, build.MaintenanceMode(""))
+
+			So(post(endpointMaintenance+"/pause", "secret"), ShouldEqual, http.StatusOK)
+			So(mb.Maint.Mode, ShouldEqual, build.MaintenancePaused)
+
+			So(post(endpointEnvsCancel+"?name=users/user/myenv-1", "secret"), ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Other endpoints don't", func() {
+			resp, err := http.Get(addr + endpointHealth) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		})
+	})
+}
+
+func TestServerOpenAPI(t *testing.T) {
+	Convey("Given a server", t, func() {
+		mb := new(buildermock.MockBuilder)
+
+		l, err := NewListener("")
+		So(err, ShouldBeNil)
+		addr := "http://" + l.Addr().String()
+
+		conf := &config.Config{}
+		conf.Server.AdminToken = "secret"
+
+		s := New(mb, conf)
+		defer s.Stop()
+		go func() {
+			s.Start(l) //nolint:errcheck
+		}()
+
+		Convey("You can get an OpenAPI document describing its endpoints", func() {
+			resp, err := http.Get(addr + endpointOpenAPI) //nolint:noctx
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, "application/json")
+
+			var doc struct {
+				OpenAPI string
+				Paths   map[string]map[string]struct {
+					Parameters []struct{ Name, In string }
+					Security   []map[string][]string
+					Responses  map[string]any
+				}
+				Components struct {
+					Schemas map[string]struct {
+						Properties map[string]map[string]any
+					}
+				}
+			}
+
+			So(json.NewDecoder(resp.Body).Decode(&doc), ShouldBeNil)
+			So(doc.OpenAPI, ShouldEqual, openAPIVersion)
+			So(len(doc.Paths), ShouldEqual, 33)
+
+			buildOp := doc.Paths[endpointEnvsBuild]["post"]
+			So(buildOp.Parameters[0].Name, ShouldEqual, "wait")
+			So(buildOp.Responses, ShouldContainKey, "403")
+			So(buildOp.Security, ShouldBeNil)
+
+			So(doc.Paths[envEndpoint(endpointImageSuffix)]["get"].Parameters[0].Name, ShouldEqual, "envPath")
+			So(doc.Paths[endpointEnvsCancel]["post"].Security, ShouldResemble,
+				[]map[string][]string{{"adminToken": {}}})
+
+			request := doc.Components.Schemas["Request"].Properties
+			So(request, ShouldContainKey, "Name")
+			So(request, ShouldContainKey, "processorTarget")
+			So(request["Model"]["properties"], ShouldContainKey, "Packages")
+
+			detail := doc.Components.Schemas["StatusDetail"].Properties
+			So(detail, ShouldContainKey, "Name")
+			So(detail, ShouldContainKey, "Artefacts")
+			So(detail["Requested"], ShouldResemble, map[string]any{
+				"type": "string", "format": "date-time", "nullable": true,
+			})
+			So(detail["WRState"], ShouldResemble, map[string]any{"type": "string"})
+			So(doc.Components.Schemas["Package"].Properties, ShouldContainKey, "version")
+		})
+
+		Convey("Every operation it describes exists, and only admin ones need the token", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			for _, op := range apiOperations() {
+				u := addr + strings.NewReplacer(paramEnvPath, "users/user/myenv", paramVersion, "1").Replace(op.path)
+
+				req, errr := http.NewRequestWithContext(ctx, op.method, u, nil)
+				So(errr, ShouldBeNil)
+
+				resp, errr := http.DefaultClient.Do(req)
+				So(errr, ShouldBeNil)
+
+				if resp.Header.Get("Content-Type") != "text/event-stream" {
+					body, _ := io.ReadAll(resp.Body) //nolint:errcheck
+					So(string(body), ShouldNotContainSubstring, "no such endpoint")
+				}
+
+				resp.Body.Close()
+
+				if op.admin {
+					So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+				} else {
+					So(resp.StatusCode, ShouldNotEqual, http.StatusUnauthorized)
+				}
+			}
+		})
+
+		Convey("Every route has an operation describing it, and vice versa", func() {
+			handlers := s.handlers()
+			paths := make(map[string]bool, len(handlers))
+
+			for _, op := range apiOperations() {
+				So(handlers, ShouldContainKey, op.path)
+
+				paths[op.path] = true
+			}
+
+			for path := range handlers {
+				So(paths, ShouldContainKey, path)
+			}
+
+			So(len(s.routes()), ShouldEqual, len(handlers))
+		})
+	})
+}
+
+func TestServerTLS(t *testing.T) {
+	Convey("Given certificates and a server configured for TLS", t, func() {
+		dir := t.TempDir()
+		ca, caKey, caFile := writeTestCert(t, dir, "ca", nil, nil)
+		_, _, serverCertFile := writeTestCert(t, dir, "server", ca, caKey)
+		_, _, clientCertFile := writeTestCert(t, dir, "client", ca, caKey)
+
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+
+		conf := &config.Config{}
+		conf.TLS.CertFile = serverCertFile
+		conf.TLS.KeyFile = keyPath(serverCertFile)
+
+		startServer := func() string {
+			l, err := NewListener("")
+			So(err, ShouldBeNil)
+
+			s := New(new(buildermock.MockBuilder), conf)
+			Reset(s.Stop)
+
+			go func() {
+				s.Start(l) //nolint:errcheck
+			}()
+
+			return "https://" + l.Addr().String()
+		}
+
+		get := func(addr string, certs ...tls.Certificate) (*http.Response, error) {
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs}, //nolint:gosec
+			}}
+
+			return client.Get(addr + endpointEnvsStatus) //nolint:noctx
+		}
+
+		Convey("you can make https requests", func() {
+			addr := startServer()
+
+			resp, err := get(addr)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			_, err = http.Get(addr + endpointEnvsStatus) //nolint:noctx
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("you can require client certificates", func() {
+			conf.TLS.ClientCAFile = caFile
+			addr := startServer()
+
+			_, err := get(addr)
+			So(err, ShouldNotBeNil)
+
+			clientCert, err := tls.LoadX509KeyPair(clientCertFile, keyPath(clientCertFile))
+			So(err, ShouldBeNil)
+
+			resp, err := get(addr, clientCert)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Start() fails with bad TLS files", func() {
+			conf.TLS.KeyFile = caFile
+
+			l, err := NewListener("")
+			So(err, ShouldBeNil)
+
+			err = New(new(buildermock.MockBuilder), conf).Start(l)
+			So(err, ShouldNotBeNil)
+
+			conf.TLS.KeyFile = keyPath(serverCertFile)
+			conf.TLS.ClientCAFile = keyPath(serverCertFile)
+
+			err = New(new(buildermock.MockBuilder), conf).Start(l)
+			So(err, ShouldEqual, ErrNoClientCAs)
+		})
+	})
+}
+
+// writeTestCert creates a certificate for 127.0.0.1 signed by the given parent,
+// or a self-signed CA if parent is nil, and writes it and its key to PEM files
+// in dir. Returns the certificate, its key and the path to the certificate
+// file; the key file path can be got with keyPath().
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	So(err, ShouldBeNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	So(err, ShouldBeNil)
+
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	So(err, ShouldBeNil)
+
+	certFile := filepath.Join(dir, name+".pem")
+
+	So(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), ShouldBeNil)
+	So(os.WriteFile(keyPath(certFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		0600), ShouldBeNil)
+
+	return cert, key, certFile
+}
+
+func keyPath(certFile string) string {
+	return strings.TrimSuffix(certFile, ".pem") + ".key"
 }
 
 func TestServerReal(t *testing.T) {
@@ -193,7 +1684,7 @@ func TestServerReal(t *testing.T) {
 		So(err, ShouldBeNil)
 		addr := "http://" + l.Addr().String()
 
-		s := New(builder, &config.Config{})
+		s := New(remove.NewBuilder(builder, &conf, ms3), &config.Config{})
 		defer s.Stop()
 
 		go func() {
@@ -210,6 +1701,9 @@ func TestServerReal(t *testing.T) {
 			So(*statuses[0].Requested, ShouldHappenAfter, buildSubmitted)
 			So(statuses[0].BuildStart, ShouldBeNil)
 			So(statuses[0].BuildDone, ShouldBeNil)
+			So(statuses[0].JobID, ShouldEqual, "abc123")
+			So(statuses[0].WR, ShouldNotBeNil)
+			So(statuses[0].WR.State, ShouldEqual, "invalid")
 
 			runT := time.Now()
 			mwr.SetRunning()
@@ -220,6 +1714,7 @@ func TestServerReal(t *testing.T) {
 			buildStart := *statuses[0].BuildStart
 			So(buildStart, ShouldHappenAfter, runT)
 			So(statuses[0].BuildDone, ShouldBeNil)
+			So(statuses[0].WR.State, ShouldEqual, "running")
 
 			<-time.After(mwr.JobDuration)
 			statuses = getTestStatuses(addr)
@@ -250,9 +1745,9 @@ func TestServerReal(t *testing.T) {
 					Version: "2",
 				},
 			}
-			err = c.Create(path, desc, pkgs)
+			err = c.Create(context.Background(), path, desc, pkgs)
 			So(err, ShouldNotBeNil)
-			defer c.Delete(path + "-1") //nolint:errcheck
+			defer c.Delete(context.Background(), path+"-1") //nolint:errcheck
 
 			mb := new(buildermock.MockBuilder)
 			So(len(mb.Received), ShouldEqual, 0)
@@ -0,0 +1,105 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"github.com/wtsi-hgi/go-softpack-builder/core"
+)
+
+const ErrUnknownTemplate = Error("unknown template")
+
+// A TemplateRequest is a Request for a build based on the named Template. The
+// Request's packages are added to the template's, replacing any of the same
+// name, and its description and profile default to the template's.
+type TemplateRequest struct {
+	Template string `json:"template"`
+	Request
+}
+
+// apply pre-fills our Request from the given template.
+func (t *TemplateRequest) apply(template config.Template) {
+	pkgs := make([]core.Package, 0, len(template.Packages)+len(t.Model.Packages))
+
+	for _, spec := range template.Packages {
+		name, version, _ := strings.Cut(spec, "@")
+
+		if !slices.ContainsFunc(t.Model.Packages, func(pkg core.Package) bool { return pkg.Name == name }) {
+			pkgs = append(pkgs, core.Package{Name: name, Version: version})
+		}
+	}
+
+	t.Model.Packages = append(pkgs, t.Model.Packages...)
+
+	if t.Model.Description == "" {
+		t.Model.Description = template.Description
+	}
+
+	if t.Profile == "" {
+		t.Profile = template.Profile
+	}
+}
+
+func (s *Server) handleTemplates(w http.ResponseWriter) {
+	templates := s.templates
+	if templates == nil {
+		templates = []config.Template{}
+	}
+
+	if err := json.NewEncoder(w).Encode(templates); err != nil {
+		http.Error(w, fmt.Sprintf("error serialising templates: %s", err), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleTemplateBuild(w http.ResponseWriter, r *http.Request) {
+	if !s.allowBuildRequest(w, r) {
+		return
+	}
+
+	req := new(TemplateRequest)
+	if !decodeRequestJSON(w, r, req) {
+		return
+	}
+
+	i := slices.IndexFunc(s.templates, func(template config.Template) bool { return template.Name == req.Template })
+	if i == -1 {
+		http.Error(w, fmt.Sprintf("%s: %s", ErrUnknownTemplate, req.Template), http.StatusNotFound)
+
+		return
+	}
+
+	req.apply(s.templates[i])
+
+	if tooManyPackages(w, &req.Request, s.maxPackages) {
+		return
+	}
+
+	s.build(w, r, &req.Request)
+}
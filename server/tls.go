@@ -0,0 +1,99 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/wtsi-hgi/go-softpack-builder/config"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const ErrNoClientCAs = Error("no certificates found in tls.clientCAFile")
+
+// tlsConfig returns a tls.Config based on the given options, or nil if TLS
+// isn't enabled.
+func tlsConfig(opts config.TLS) (*tls.Config, error) {
+	if !opts.Enabled() {
+		return nil, nil
+	}
+
+	var tc *tls.Config
+
+	if len(opts.AutocertHosts) > 0 {
+		tc = autocertConfig(opts)
+	} else {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tc = &tls.Config{Certificates: []tls.Certificate{cert}} //nolint:gosec
+	}
+
+	tc.MinVersion = tls.VersionTLS12
+
+	if opts.ClientCAFile == "" {
+		return tc, nil
+	}
+
+	return tc, requireClientCerts(tc, opts.ClientCAFile)
+}
+
+// autocertConfig returns a tls.Config that gets certificates for the configured
+// hosts from Let's Encrypt. For the ACME challenge to work, we must be
+// listening on port 443.
+func autocertConfig(opts config.TLS) *tls.Config {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(opts.AutocertHosts...),
+	}
+
+	if opts.AutocertCacheDir != "" {
+		m.Cache = autocert.DirCache(opts.AutocertCacheDir)
+	}
+
+	return m.TLSConfig()
+}
+
+// requireClientCerts makes tc require clients to present a certificate signed
+// by one of the CAs in the given PEM file.
+func requireClientCerts(tc *tls.Config, caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return ErrNoClientCAs
+	}
+
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return nil
+}
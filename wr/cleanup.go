@@ -0,0 +1,170 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package wr
+
+import (
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// CleanupEnv removes the incomplete (eg. buried) wr jobs that aren't running
+// of the builds of the environment version whose artefacts are at the given
+// s3Path (eg. "builds/users/foo/env/1"), whether they were built in working
+// directories within s3Path or directly in s3Path. See IsEnvRepGroup().
+func (r *Runner) CleanupEnv(s3Path string) error {
+	return r.removeIncomplete(func(job *JobDetails) bool {
+		return IsEnvRepGroup(job.RepGroup, s3Path)
+	})
+}
+
+// CleanupAll removes all of gsb's incomplete wr jobs that aren't running,
+// including those added with the LegacyRepGroupPrefix, leaving any other jobs
+// in the deployment alone.
+func (r *Runner) CleanupAll() error {
+	return r.removeIncomplete(func(*JobDetails) bool { return true })
+}
+
+// removeIncomplete removes those of gsb's incomplete wr jobs that aren't
+// running for which the given function returns true.
+func (r *Runner) removeIncomplete(selected func(*JobDetails) bool) error {
+	jobs, err := r.gsbJobs()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		switch job.Status() { //nolint:exhaustive
+		case WRJobStatusReserved, WRJobStatusRunning, WRJobStatusComplete:
+			continue
+		}
+
+		if !selected(job) {
+			continue
+		}
+
+		if err := r.remove(job.Key, "-y"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsEnvRepGroup returns true if the given rep_grp is that of a gsb build job of
+// the environment version whose artefacts are at the given s3Path: one that was
+// built in a working directory within s3Path (as Builder does), or directly in
+// s3Path (as older versions of gsb did).
+func IsEnvRepGroup(repGroup, s3Path string) bool {
+	s3Path = strings.TrimSuffix(s3Path, "/")
+
+	for _, prefix := range []string{RepGroupPrefix, LegacyRepGroupPrefix} {
+		path, found := strings.CutPrefix(repGroup, prefix)
+		if found && (path == s3Path || strings.HasPrefix(path, s3Path+"/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CleanupOlderThan removes gsb's incomplete wr jobs that exited (ie. got
+// buried) more than the given age ago. Returns the number of jobs removed.
+func (r *Runner) CleanupOlderThan(age time.Duration) (int, error) {
+	jobs, err := r.gsbJobs()
+	if err != nil {
+		return 0, err
+	}
+
+	ids := gsbJobsEndedBefore(jobs, time.Now().Add(-age))
+
+	for n, id := range ids {
+		if err := r.remove(id, "-y"); err != nil {
+			return n, err
+		}
+	}
+
+	return len(ids), nil
+}
+
+// gsbJobs returns the details of the jobs in our deployment with either of
+// gsb's rep_grp prefixes. wr's search (-z) matches rep_grps containing the
+// identifier, so searching for the LegacyRepGroupPrefix also finds jobs with
+// the current RepGroupPrefix, as well as any other jobs we filter out.
+func (r *Runner) gsbJobs() ([]*JobDetails, error) {
+	cmd := exec.Command("wr", "status", "--deployment", r.deployment, "-o", //nolint:gosec
+		"json", "-z", "-i", LegacyRepGroupPrefix)
+
+	out, err := r.runWRCmd(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := parseWRJSONStatuses(out)
+	if err != nil {
+		return nil, err
+	}
+
+	gsbJobs := make([]*JobDetails, 0, len(jobs))
+
+	for _, job := range jobs {
+		if job != nil && isGSBRepGroup(job.RepGroup) {
+			gsbJobs = append(gsbJobs, job)
+		}
+	}
+
+	return gsbJobs, nil
+}
+
+// isGSBRepGroup returns true if the given rep_grp starts with the
+// RepGroupPrefix or LegacyRepGroupPrefix.
+func isGSBRepGroup(repGroup string) bool {
+	return strings.HasPrefix(repGroup, RepGroupPrefix) || strings.HasPrefix(repGroup, LegacyRepGroupPrefix)
+}
+
+// gsbJobsEndedBefore returns the internal IDs of the given jobs that are gsb
+// jobs and ended before the given time.
+func gsbJobsEndedBefore(jobs []*JobDetails, before time.Time) []string {
+	var ids []string
+
+	for _, job := range jobs {
+		if job == nil || job.Ended == nil || !isGSBRepGroup(job.RepGroup) {
+			continue
+		}
+
+		if *job.Ended < before.Unix() {
+			ids = append(ids, job.Key)
+		}
+	}
+
+	return ids
+}
+
+func (r *Runner) remove(identifier string, flags ...string) error {
+	args := append([]string{"remove", "--deployment", r.deployment, "-i", identifier}, flags...)
+
+	_, err := r.runWRCmd(exec.Command("wr", args...)) //nolint:gosec
+
+	return err
+}
@@ -0,0 +1,122 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package wr
+
+import "strings"
+
+// Failure classifies why a wr job got buried.
+type Failure string
+
+const (
+	// FailureNone means the job did not fail.
+	FailureNone Failure = ""
+
+	// FailureTransient means the job failed for a reason unrelated to what it
+	// was running, such as losing contact with its host or a network problem,
+	// and might succeed if retried.
+	FailureTransient Failure = "transient"
+
+	// FailureResource means the job exceeded its memory, disk or time limits.
+	FailureResource Failure = "resource"
+
+	// FailureBuild means the job's command itself failed.
+	FailureBuild Failure = "build"
+
+	// FailureStall means the build was killed because it stopped producing
+	// output, eg. because it hung waiting on a network fetch.
+	FailureStall Failure = "stall"
+)
+
+const (
+	// stallMarker and timeoutMarker start the messages a build job writes to
+	// its stderr when its watchdog kills it for stalling or running too long.
+	stallMarker   = "gsb watchdog: build stalled"
+	timeoutMarker = "gsb watchdog: build timed out"
+
+	// watchdogInterval is how often, in seconds, the watchdog checks on a
+	// build.
+	watchdogInterval = 60
+)
+
+// transientFailReasons are wr FailReasons that aren't the fault of the cmd.
+var transientFailReasons = [...]string{ //nolint:gochecknoglobals
+	"lost contact with runner",
+	"runner received a signal to stop",
+	"mount failed",
+	"failed to upload files to remote file system",
+	"command failed to complete normally",
+}
+
+// resourceFailReasons are wr FailReasons due to exceeding resource limits.
+var resourceFailReasons = [...]string{ //nolint:gochecknoglobals
+	"command used too much RAM",
+	"ran out of disk space",
+	"command used too much time",
+	"resource requirements cannot be met",
+}
+
+// transientErrors are strings that, if found in a job's stderr, suggest it
+// failed due to a network or storage hiccup.
+var transientErrors = [...]string{ //nolint:gochecknoglobals
+	"toomanyrequests",
+	"TLS handshake timeout",
+	"Temporary failure in name resolution",
+	"Connection reset by peer",
+	"Transport endpoint is not connected",
+	"i/o timeout",
+}
+
+// Classify returns the kind of failure that caused the job to be buried, based
+// on wr's FailReason and the job's StdErr. Builds killed for running longer than
+// their BuildOptions.MaxMinutes are resource failures. Returns FailureNone if
+// the job isn't buried.
+func (j *JobDetails) Classify() Failure {
+	if j.Status() != WRJobStatusBuried {
+		return FailureNone
+	}
+
+	if strings.Contains(j.StdErr, stallMarker) {
+		return FailureStall
+	}
+
+	if containsAny(j.FailReason, resourceFailReasons[:]) || strings.Contains(j.StdErr, timeoutMarker) {
+		return FailureResource
+	}
+
+	if containsAny(j.FailReason, transientFailReasons[:]) || containsAny(j.StdErr, transientErrors[:]) {
+		return FailureTransient
+	}
+
+	return FailureBuild
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, substr := range substrs {
+		if strings.Contains(s, substr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+/*******************************************************************************
+ * Copyright (c) 2024 Genome Research Ltd.
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining
+ * a copy of this software and associated documentation files (the
+ * "Software"), to deal in the Software without restriction, including
+ * without limitation the rights to use, copy, modify, merge, publish,
+ * distribute, sublicense, and/or sell copies of the Software, and to
+ * permit persons to whom the Software is furnished to do so, subject to
+ * the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+ * IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+ * CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+ * TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+ * SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ ******************************************************************************/
+
+package wr
+
+// Load describes how busy wr is with gsb's build jobs: Queued is the number
+// that are waiting to run (ready or delayed), and Running the number that are
+// running (which is the build capacity available to gsb when there are queued
+// jobs).
+type Load struct {
+	Queued  int
+	Running int
+}
+
+// Load returns the current Load of gsb's jobs in our deployment.
+func (r *Runner) Load() (*Load, error) {
+	jobs, err := r.gsbJobs()
+	if err != nil {
+		return nil, err
+	}
+
+	return loadOf(jobs), nil
+}
+
+func loadOf(jobs []*JobDetails) *Load {
+	load := new(Load)
+
+	for _, job := range jobs {
+		if job == nil {
+			continue
+		}
+
+		switch job.Status() { //nolint:exhaustive
+		case WRJobStatusReady, WRJobStatusDelayed:
+			load.Queued++
+		case WRJobStatusReserved, WRJobStatusRunning:
+			load.Running++
+		}
+	}
+
+	return load
+}
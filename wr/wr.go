@@ -26,9 +26,15 @@ package wr
 import (
 	"bufio"
 	"bytes"
+	"context"
 	_ "embed"
+	"encoding/json"
+	"fmt"
 	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -47,9 +53,77 @@ const (
 	WRJobStatusComplete
 )
 
+var statusNames = [...]string{ //nolint:gochecknoglobals
+	WRJobStatusInvalid:  "invalid",
+	WRJobStatusDelayed:  "delayed",
+	WRJobStatusReady:    "ready",
+	WRJobStatusReserved: "reserved",
+	WRJobStatusRunning:  "running",
+	WRJobStatusLost:     "lost",
+	WRJobStatusBuried:   "buried",
+	WRJobStatusComplete: "complete",
+}
+
+// String returns the wr name for the status, eg. "running".
+func (s WRJobStatus) String() string {
+	if s < 0 || int(s) >= len(statusNames) {
+		return statusNames[WRJobStatusInvalid]
+	}
+
+	return statusNames[s]
+}
+
+// MarshalJSON encodes the status as its wr name, eg. "running".
+func (s WRJobStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON decodes a status from its wr name. Unknown names decode as
+// WRJobStatusInvalid. For compatibility with older clients, the status's
+// integer value is also accepted.
+func (s *WRJobStatus) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*s = statusStringToType(name)
+
+		return nil
+	}
+
+	var i int
+	if err := json.Unmarshal(data, &i); err != nil {
+		return err
+	}
+
+	*s = WRJobStatus(i)
+
+	return nil
+}
+
 const (
+	// RepGroupPrefix is the prefix of the rep_grp of every job gsb adds to wr,
+	// letting us tell gsb's jobs apart from any others in the deployment.
+	RepGroupPrefix = "gsb-singularity_build-"
+
+	// LegacyRepGroupPrefix is the prefix of the rep_grp of jobs added by
+	// versions of gsb from before RepGroupPrefix was introduced. Cleanups also
+	// consider these to be gsb's jobs.
+	LegacyRepGroupPrefix = "singularity_build-"
+
+	// ImageRefreshRepGroup is the rep_grp of the jobs gsb adds to wr to
+	// refresh its local copies of build images.
+	ImageRefreshRepGroup = "gsb-image_refresh"
+
+	// BaseImageRepGroup is the rep_grp of the jobs gsb adds to wr to build
+	// its shared base environment images.
+	BaseImageRepGroup = "gsb-base_image"
+
 	plainStatusCols     = 2
 	defaultPollDuration = 5 * time.Second
+	defaultTmpDir       = "$TMPDIR"
+	imagePullMemory     = "4G"
+	imagePullTime       = "1h"
+	baseImageMemory     = "16G"
+	baseImageTime       = "12h"
 )
 
 type Error struct {
@@ -66,17 +140,103 @@ func init() { //nolint:gochecknoinits
 	wrTmpl = template.Must(template.New("").Parse(wrTmplStr))
 }
 
+// Resources are the resources a wr job will reserve. Memory and Time are in wr's
+// formats, eg. "43G" and "8h", and Disk is in GB. Blank or zero values mean use
+// the Runner's defaults.
+type Resources struct {
+	Memory string
+	Time   string
+	CPUs   int
+	Disk   int
+}
+
+// BuildOptions are optional extras for a build job.
+//
+// If TestCmd is not blank, it is run with bash inside the built image, and the
+// build fails if it exits non-zero. Its output is appended to builder.out.
+//
+// If Credentials, the job expects an AWS credentials file named
+// gsb-credentials in s3Path when it starts, and moves it to
+// gsb-aws/credentials in the build's /tmp, so that the credentials are neither
+// part of the job nor left in S3.
+//
+// If Requester is not blank, it should be the username of the user who
+// requested the build. It is passed to the job in its environment as
+// GSB_REQUESTER, so the job can be attributed to them.
+//
+// If MaxMinutes is not 0, the build is killed if it runs for longer than that
+// many minutes. If StallMinutes is not 0, the build is killed if it stalls,
+// writing nothing to builder.out for that many minutes. Killed builds fail with
+// a message saying why in their builder.out and stderr, so that Classify() can
+// tell they timed out or stalled.
+//
+// If Fakeroot, singularity is run with --fakeroot instead of with sudo.
+// BuildFlags are extra flags for `singularity build`, eg. "--disable-cache".
+// TmpDir is the directory (which may use shell variables) bound to /tmp during
+// the build, created if necessary; it defaults to the job's $TMPDIR, and should
+// otherwise be unique to the job.
+//
+// LimitGroups are the wr limit groups the job is in, eg. "gpu", or "gpu:2" to
+// also set that group's limit. If there are none, the job isn't limited.
+type BuildOptions struct {
+	Resources
+	TestCmd      string
+	Credentials  bool
+	Requester    string
+	MaxMinutes   int
+	StallMinutes int
+	Fakeroot     bool
+	BuildFlags   []string
+	TmpDir       string
+	LimitGroups  []string
+}
+
 // SingularityBuildInS3WRInput returns wr input that could be piped to `wr add`
 // and that would run a singularity build where the working directory is a fuse
-// mount of the given s3Path.
-func SingularityBuildInS3WRInput(s3Path, hash string) (string, error) {
+// mount of the given s3Path, with the given options.
+func SingularityBuildInS3WRInput(s3Path, hash string, opts BuildOptions) (string, error) {
 	var w strings.Builder
 
+	opts.TestCmd = escapeTestCmd(opts.TestCmd)
+	opts.Requester = escapeJSON(opts.Requester)
+
+	flags := make([]string, len(opts.BuildFlags))
+	for i, flag := range opts.BuildFlags {
+		flags[i] = escapeJSON(flag)
+	}
+
+	tmp := defaultTmpDir
+	if opts.TmpDir != "" {
+		tmp = escapeJSON(opts.TmpDir)
+	}
+
+	limitGroups := make([]string, len(opts.LimitGroups))
+	for i, group := range opts.LimitGroups {
+		limitGroups[i] = escapeJSON(group)
+	}
+
+	opts.LimitGroups = limitGroups
+
 	if err := wrTmpl.Execute(&w, struct {
-		S3Path, Hash string
+		S3Path, Hash, RepGroup, Tmp string
+		CustomTmpDir                bool
+		Flags                       []string
+		Watchdog                    bool
+		WatchdogInterval            int
+		StallMarker, TimeoutMarker  string
+		BuildOptions
 	}{
 		s3Path,
 		hash,
+		RepGroup(s3Path),
+		tmp,
+		opts.TmpDir != "",
+		flags,
+		opts.MaxMinutes > 0 || opts.StallMinutes > 0,
+		watchdogInterval,
+		stallMarker,
+		timeoutMarker,
+		opts,
 	}); err != nil {
 		return "", err
 	}
@@ -84,9 +244,118 @@ func SingularityBuildInS3WRInput(s3Path, hash string) (string, error) {
 	return w.String(), nil
 }
 
+// escapeTestCmd returns the given command single-quoted for the shell, and
+// escaped for inclusion in a JSON string. Returns blank for a blank command.
+func escapeTestCmd(cmd string) string {
+	if cmd == "" {
+		return ""
+	}
+
+	return escapeJSON(shellQuote(cmd))
+}
+
+// shellQuote returns the given string single-quoted for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// escapeJSON returns the given string escaped for inclusion in a JSON string.
+func escapeJSON(s string) string {
+	quoted, _ := json.Marshal(s) //nolint:errchkjson
+
+	return string(quoted[1 : len(quoted)-1])
+}
+
+// RepGroup returns the rep_grp that the build job for the given s3Path will
+// have.
+func RepGroup(s3Path string) string {
+	return RepGroupPrefix + s3Path
+}
+
+// ImagePull describes an image to be pulled by PullImagesWRInput(). Source is a
+// singularity URI (eg. "docker://ubuntu:22.04") and Dest the path of the SIF
+// file to create.
+type ImagePull struct {
+	Source string
+	Dest   string
+}
+
+// PullImagesWRInput returns wr input that could be piped to `wr add` and that
+// would pull each of the given images with singularity, replacing their Dest
+// files atomically so that builds never see a partial image. All the pulls are
+// attempted, but the job fails if any of them do.
+func PullImagesWRInput(pulls []ImagePull) (string, error) {
+	cmds := []string{"failed=0"}
+
+	for _, pull := range pulls {
+		dest := shellQuote(pull.Dest)
+		tmp := shellQuote(pull.Dest + ".tmp")
+
+		cmds = append(cmds, fmt.Sprintf("{ mkdir -p %s && singularity pull --force %s %s && mv %s %s || failed=1; }",
+			shellQuote(filepath.Dir(pull.Dest)), tmp, shellQuote(pull.Source), tmp, dest))
+	}
+
+	return imageJobWRInput(cmds, ImageRefreshRepGroup, imagePullMemory, imagePullTime)
+}
+
+// imageJobWRInput returns wr input for a job that runs the given commands,
+// exiting with $failed.
+func imageJobWRInput(cmds []string, repGroup, memory, walltime string) (string, error) {
+	input, err := json.Marshal(struct {
+		Cmd      string `json:"cmd"`
+		RepGroup string `json:"rep_grp"`
+		Memory   string `json:"memory"`
+		Time     string `json:"time"`
+	}{
+		Cmd:      strings.Join(append(cmds, "exit $failed"), "; "),
+		RepGroup: repGroup,
+		Memory:   memory,
+		Time:     walltime,
+	})
+
+	return string(input), err
+}
+
+// ImageBuild describes an image to be built by BuildImagesWRInput(). Def is
+// the path of a singularity definition file and Dest the path of the SIF file
+// to create.
+type ImageBuild struct {
+	Def  string
+	Dest string
+}
+
+// BuildImagesWRInput returns wr input that could be piped to `wr add` and that
+// would build each of the given images with singularity, run with the given
+// flags, and with sudo unless fakeroot. Dest files are replaced atomically so
+// that builds never see a partial image. All the builds are attempted, but the
+// job fails if any of them do.
+func BuildImagesWRInput(builds []ImageBuild, fakeroot bool, flags []string) (string, error) {
+	singularity := "sudo singularity build"
+	if fakeroot {
+		singularity = "singularity build --fakeroot"
+	}
+
+	for _, flag := range flags {
+		singularity += " " + shellQuote(flag)
+	}
+
+	cmds := []string{"failed=0"}
+
+	for _, build := range builds {
+		dest := shellQuote(build.Dest)
+		tmp := shellQuote(build.Dest + ".tmp")
+
+		cmds = append(cmds, fmt.Sprintf("{ mkdir -p %s && %s --force %s %s && mv %s %s || failed=1; }",
+			shellQuote(filepath.Dir(build.Dest)), singularity, tmp, shellQuote(build.Def), tmp, dest))
+	}
+
+	return imageJobWRInput(cmds, BaseImageRepGroup, baseImageMemory, baseImageTime)
+}
+
 // Runner lets you Run() a wr add command.
 type Runner struct {
 	deployment   string
+	env          []string
 	memory       string
 	pollDuration time.Duration
 }
@@ -119,9 +388,30 @@ func (r *Runner) Add(wrInput string) (string, error) {
 	return r.runWRCmd(cmd)
 }
 
+// NewRemote returns a Runner like New(), but that uses the manager of the
+// given deployment running on the given host and port, instead of the one in
+// wr's own config. A blank host or 0 port leaves that to wr's config.
+func NewRemote(deployment, managerHost string, managerPort int) *Runner {
+	r := New(deployment)
+
+	if managerHost != "" {
+		r.env = append(r.env, "WR_MANAGERHOST="+managerHost)
+	}
+
+	if managerPort != 0 {
+		r.env = append(r.env, "WR_MANAGERPORT="+strconv.Itoa(managerPort))
+	}
+
+	return r
+}
+
 func (r *Runner) runWRCmd(cmd *exec.Cmd) (string, error) {
 	var stdout, stderr bytes.Buffer
 
+	if len(r.env) > 0 {
+		cmd.Env = append(os.Environ(), r.env...)
+	}
+
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
@@ -146,7 +436,8 @@ func (r *Runner) runWRCmd(cmd *exec.Cmd) (string, error) {
 }
 
 // WaitForRunning waits until the given wr job either starts running, or exits.
-func (r *Runner) WaitForRunning(id string) error {
+// Returns the context's error if it is cancelled first.
+func (r *Runner) WaitForRunning(ctx context.Context, id string) error {
 	var err error
 
 	cb := func(status WRJobStatus, cbErr error) bool {
@@ -155,7 +446,9 @@ func (r *Runner) WaitForRunning(id string) error {
 		return err != nil || statusIsStarted(status) || statusIsExited(status)
 	}
 
-	r.pollStatus(id, cb)
+	if ctxErr := r.pollStatus(ctx, id, cb); ctxErr != nil {
+		return ctxErr
+	}
 
 	return err
 }
@@ -172,19 +465,28 @@ func statusIsExited(status WRJobStatus) bool {
 // if you want to stop polling now.
 type pollStatusCallback = func(WRJobStatus, error) bool
 
-func (r *Runner) pollStatus(id string, cb pollStatusCallback) {
+// pollStatus calls cb with the status of the given job every pollDuration until
+// cb returns true, or the context is cancelled, in which case the context's
+// error is returned.
+func (r *Runner) pollStatus(ctx context.Context, id string, cb pollStatusCallback) error {
 	ticker := time.NewTicker(r.pollDuration)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if cb(r.Status(id)) {
-			return
+	for {
+		select {
+		case <-ticker.C:
+			if cb(r.Status(id)) {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
-// Wait waits for the given wr job to exit.
-func (r *Runner) Wait(id string) (WRJobStatus, error) {
+// Wait waits for the given wr job to exit. Returns the context's error if it is
+// cancelled first.
+func (r *Runner) Wait(ctx context.Context, id string) (WRJobStatus, error) {
 	var (
 		status WRJobStatus
 		err    error
@@ -197,11 +499,58 @@ func (r *Runner) Wait(id string) (WRJobStatus, error) {
 		return err != nil || statusIsExited(status)
 	}
 
-	r.pollStatus(id, cb)
+	if ctxErr := r.pollStatus(ctx, id, cb); ctxErr != nil {
+		return status, ctxErr
+	}
 
 	return status, err
 }
 
+// Kick retries the buried wr job with the given internal ID.
+func (r *Runner) Kick(id string) error {
+	cmd := exec.Command("wr", "kick", "--deployment", r.deployment, "-i", id, "-y") //nolint:gosec
+
+	_, err := r.runWRCmd(cmd)
+
+	return err
+}
+
+// Kill stops the wr job with the given internal ID, if it's running, waiting
+// for it to exit, then removes it from wr so that it won't be retried. Does
+// nothing if the job is complete or doesn't exist. Returns the context's error
+// if it is cancelled before the job exits.
+func (r *Runner) Kill(ctx context.Context, id string) error {
+	status, err := r.Status(id)
+	if err != nil {
+		return err
+	}
+
+	switch status { //nolint:exhaustive
+	case WRJobStatusInvalid, WRJobStatusComplete:
+		return nil
+	case WRJobStatusReserved, WRJobStatusRunning, WRJobStatusLost:
+		if err = r.kill(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return r.remove(id, "-y")
+}
+
+// kill kills the running wr job with the given internal ID and waits for it to
+// exit.
+func (r *Runner) kill(ctx context.Context, id string) error {
+	cmd := exec.Command("wr", "kill", "--deployment", r.deployment, "-i", id, "-y") //nolint:gosec
+
+	if _, err := r.runWRCmd(cmd); err != nil {
+		return err
+	}
+
+	_, err := r.Wait(ctx, id)
+
+	return err
+}
+
 // Status returns the status of the wr job with the given internal ID.
 //
 // Returns WRJobStatusInvalid if the ID wasn't found. Returns WRJobStatusBuried
@@ -221,6 +570,90 @@ func (r *Runner) Status(id string) (WRJobStatus, error) {
 	return parseWRStatus(out, id)
 }
 
+// JobDetails holds the details of a wr job as reported by
+// `wr status -o json --std`, including its state, exit code, resource usage and
+// output. PeakRAM and PeakDisk are in MB, Walltime and CPUtime are in seconds,
+// and Started and Ended are unix timestamps.
+type JobDetails struct {
+	Key        string
+	RepGroup   string
+	State      string
+	Exited     bool
+	Exitcode   int
+	FailReason string
+	PeakRAM    int
+	PeakDisk   int64
+	Walltime   float64
+	CPUtime    float64
+	Started    *int64
+	Ended      *int64
+	Host       string
+	Attempts   int
+	StdErr     string
+	StdOut     string
+}
+
+// Status returns the WRJobStatus corresponding to our State.
+func (j *JobDetails) Status() WRJobStatus {
+	return statusStringToType(j.State)
+}
+
+// Output returns the job's captured StdOut followed by its StdErr, which for a
+// failed build job includes the end of its builder.out. This is available from
+// wr even if the job couldn't write to its S3 mount.
+func (j *JobDetails) Output() string {
+	if j.StdOut == "" || j.StdErr == "" {
+		return j.StdOut + j.StdErr
+	}
+
+	return j.StdOut + "\n" + j.StdErr
+}
+
+// DetailedStatus returns the details of the wr job with the given internal ID.
+//
+// Returns details with an invalid status if the ID wasn't found. Only returns
+// an error if there was a problem getting the details.
+func (r *Runner) DetailedStatus(id string) (*JobDetails, error) {
+	cmd := exec.Command("wr", "status", "--deployment", r.deployment, "-o", //nolint:gosec
+		"json", "--std", "-i", id, "-y")
+
+	out, err := r.runWRCmd(cmd)
+	if err != nil {
+		slog.Error("wr status command failed", "err", err)
+
+		return nil, err
+	}
+
+	return parseWRJSONStatus(out)
+}
+
+func parseWRJSONStatus(wrStatusOutput string) (*JobDetails, error) {
+	jobs, err := parseWRJSONStatuses(wrStatusOutput)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jobs) == 0 || jobs[0] == nil {
+		return &JobDetails{}, nil
+	}
+
+	return jobs[0], nil
+}
+
+func parseWRJSONStatuses(wrStatusOutput string) ([]*JobDetails, error) {
+	if wrStatusOutput == "" {
+		return nil, nil
+	}
+
+	var jobs []*JobDetails
+
+	if err := json.Unmarshal([]byte(wrStatusOutput), &jobs); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
 func parseWRStatus(wrStatusOutput, id string) (WRJobStatus, error) {
 	scanner := bufio.NewScanner(strings.NewReader(wrStatusOutput))
 	for scanner.Scan() {
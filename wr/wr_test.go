@@ -25,11 +25,13 @@ package wr
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -47,7 +49,7 @@ func TestWR(t *testing.T) {
 
 	Convey("You can generate a wr input", t, func() {
 		const hash = "0110"
-		wrInput, err := SingularityBuildInS3WRInput(s3Path, hash)
+		wrInput, err := SingularityBuildInS3WRInput(s3Path, hash, BuildOptions{LimitGroups: []string{"s3cache"}})
 		So(err, ShouldBeNil)
 		So(wrInput, ShouldEqual, `{"cmd": "echo doing build with hash `+hash+`; `+
 			`if sudo singularity build --bind $TMPDIR:/tmp $TMPDIR/singularity.sif singularity.def `+
@@ -55,10 +57,10 @@ func TestWR(t *testing.T) {
 			`sudo singularity run $TMPDIR/singularity.sif cat /opt/spack-environment/executables > $TMPDIR/executables && `+
 			`sudo singularity run $TMPDIR/singularity.sif cat /opt/spack-environment/spack.lock > $TMPDIR/spack.lock && `+
 			`mv $TMPDIR/singularity.sif $TMPDIR/builder.out $TMPDIR/executables $TMPDIR/spack.lock .; `+
-			`else mv $TMPDIR/builder.out .; mkdir logs; `+
+			`else tail -n 100 $TMPDIR/builder.out >&2; mv $TMPDIR/builder.out .; mkdir logs; `+
 			`sudo find $TMPDIR/root/spack-stage/ -maxdepth 2 -iname \"*.txt\" -exec cp {} logs/ \\; ; `+
 			`false; fi", `+
-			`"retries": 0, "rep_grp": "singularity_build-spack/builds/users/user/myenv", "limit_grps": ["s3cache"], `+
+			`"retries": 0, "rep_grp": "gsb-singularity_build-spack/builds/users/user/myenv", "limit_grps": ["s3cache"], `+
 			`"mounts": [{"Targets": [{"Path":"spack/builds/users/user/myenv","Write":true,"Cache":true}]}]}`)
 
 		var m map[string]any
@@ -66,6 +68,361 @@ func TestWR(t *testing.T) {
 		So(err, ShouldBeNil)
 	})
 
+	Convey("You can generate a wr input in any number of limit groups", t, func() {
+		wrInput, err := SingularityBuildInS3WRInput(s3Path, "0110", BuildOptions{
+			LimitGroups: []string{"s3cache", "gpu:2"},
+		})
+		So(err, ShouldBeNil)
+		So(wrInput, ShouldContainSubstring, `"limit_grps": ["s3cache", "gpu:2"], `)
+
+		var m map[string]any
+		err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&m)
+		So(err, ShouldBeNil)
+		So(m["limit_grps"], ShouldResemble, []any{"s3cache", "gpu:2"})
+
+		wrInput, err = SingularityBuildInS3WRInput(s3Path, "0110", BuildOptions{})
+		So(err, ShouldBeNil)
+		So(wrInput, ShouldNotContainSubstring, "limit_grps")
+	})
+
+	Convey("You can generate a wr input with resources", t, func() {
+		wrInput, err := SingularityBuildInS3WRInput(s3Path, "0110", BuildOptions{
+			Resources: Resources{Memory: "64G", Time: "12h", CPUs: 8},
+		})
+		So(err, ShouldBeNil)
+		So(wrInput, ShouldEndWith, `"Cache":true}]}], "memory": "64G", "time": "12h", "cpus": 8}`)
+
+		var m map[string]any
+		err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&m)
+		So(err, ShouldBeNil)
+		So(m["memory"], ShouldEqual, "64G")
+		So(m["cpus"], ShouldEqual, 8)
+	})
+
+	Convey("You can generate a wr input with singularity build options", t, func() {
+		wrInput, err := SingularityBuildInS3WRInput(s3Path, "0110", BuildOptions{
+			Resources:   Resources{Disk: 100},
+			Fakeroot:    true,
+			BuildFlags:  []string{"--disable-cache", `--tmpdir "$TMPDIR/sing"`},
+			TmpDir:      "/scratch/gsb-$$",
+			Credentials: true,
+		})
+		So(err, ShouldBeNil)
+
+		var m map[string]any
+		err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&m)
+		So(err, ShouldBeNil)
+		So(m["disk"], ShouldEqual, 100)
+
+		cmd, ok := m["cmd"].(string)
+		So(ok, ShouldBeTrue)
+		So(cmd, ShouldStartWith, "mkdir -p /scratch/gsb-$$; mkdir -m 700 /scratch/gsb-$$/gsb-aws && ")
+		So(cmd, ShouldContainSubstring, `; if singularity build --fakeroot --disable-cache --tmpdir "$TMPDIR/sing" `+
+			"--bind /scratch/gsb-$$:/tmp $TMPDIR/singularity.sif singularity.def")
+		So(cmd, ShouldContainSubstring, "then singularity run $TMPDIR/singularity.sif cat")
+		So(cmd, ShouldContainSubstring, "mkdir logs; find /scratch/gsb-$$/root/spack-stage/ ")
+		So(cmd, ShouldNotContainSubstring, "sudo")
+	})
+
+	Convey("You can generate a wr input with a test command", t, func() {
+		const testCmd = `python -c 'import "anndata"'`
+
+		wrInput, err := SingularityBuildInS3WRInput(s3Path, "0110", BuildOptions{TestCmd: testCmd})
+		So(err, ShouldBeNil)
+
+		var m map[string]any
+		err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&m)
+		So(err, ShouldBeNil)
+
+		cmd, ok := m["cmd"].(string)
+		So(ok, ShouldBeTrue)
+		So(cmd, ShouldContainSubstring, "singularity.def &> $TMPDIR/builder.out && "+
+			"echo running test command >> $TMPDIR/builder.out && "+
+			"singularity exec $TMPDIR/singularity.sif bash -c ")
+		So(cmd, ShouldContainSubstring, " >> $TMPDIR/builder.out 2>&1; then ")
+
+		_, quoted, _ := strings.Cut(cmd, "bash -c ")
+		quoted, _, _ = strings.Cut(quoted, " >> $TMPDIR/builder.out 2>&1; then ")
+
+		out, err := exec.Command("bash", "-c", "printf %s "+quoted).Output()
+		So(err, ShouldBeNil)
+		So(string(out), ShouldEqual, testCmd)
+	})
+
+	Convey("You can generate a wr input with a watchdog that kills slow or stalled builds", t, func() {
+		wrInput, err := SingularityBuildInS3WRInput(s3Path, "0110", BuildOptions{MaxMinutes: 240, StallMinutes: 30})
+		So(err, ShouldBeNil)
+
+		var m map[string]any
+		err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&m)
+		So(err, ShouldBeNil)
+
+		cmd, ok := m["cmd"].(string)
+		So(ok, ShouldBeTrue)
+		So(cmd, ShouldContainSubstring, "singularity.def &> $TMPDIR/builder.out & gsbpid=$!; ")
+		So(cmd, ShouldContainSubstring, `if [ -n "$(find $TMPDIR/builder.out -mmin +30)" ]; `+
+			`then echo "gsb watchdog: build stalled: no output for 30 minutes" > $TMPDIR/gsb-watchdog; `+
+			"sudo kill $gsbpid; break; fi; ")
+		So(cmd, ShouldContainSubstring, "if [ $(( ($(date +%s) - gsbstart) / 60 )) -ge 240 ]; "+
+			`then echo "gsb watchdog: build timed out: ran for more than 240 minutes" > $TMPDIR/gsb-watchdog; `)
+		So(cmd, ShouldContainSubstring, "wait $gsbpid; gsbrc=$?; kill $gsbwatchdog 2> /dev/null; "+
+			"if [ $gsbrc -eq 0 ]; then ")
+		So(cmd, ShouldContainSubstring, "else [ -f $TMPDIR/gsb-watchdog ] && "+
+			"cat $TMPDIR/gsb-watchdog >> $TMPDIR/builder.out; tail -n 100 $TMPDIR/builder.out >&2; ")
+		So(exec.Command("bash", "-n", "-c", cmd).Run(), ShouldBeNil)
+
+		wrInput, err = SingularityBuildInS3WRInput(s3Path, "0110", BuildOptions{StallMinutes: 30, Fakeroot: true})
+		So(err, ShouldBeNil)
+		So(wrInput, ShouldContainSubstring, "> $TMPDIR/gsb-watchdog; kill $gsbpid; break; fi; done)")
+		So(wrInput, ShouldNotContainSubstring, "gsbstart) / 60")
+	})
+
+	Convey("You can generate a wr input with credentials", t, func() {
+		wrInput, err := SingularityBuildInS3WRInput(s3Path, "0110", BuildOptions{Credentials: true})
+		So(err, ShouldBeNil)
+		So(wrInput, ShouldStartWith, `{"cmd": "mkdir -m 700 $TMPDIR/gsb-aws && `+
+			`mv gsb-credentials $TMPDIR/gsb-aws/credentials; echo doing build with hash 0110; `)
+
+		var m map[string]any
+		err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&m)
+		So(err, ShouldBeNil)
+		So(m["env"], ShouldBeNil)
+
+		wrInput, err = SingularityBuildInS3WRInput(s3Path, "0110", BuildOptions{
+			Credentials: true,
+			Requester:   "user@example.com",
+		})
+		So(err, ShouldBeNil)
+
+		err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&m)
+		So(err, ShouldBeNil)
+		So(m["env"], ShouldResemble, []any{"GSB_REQUESTER=user@example.com"})
+	})
+
+	Convey("You can generate a wr input attributed to the requesting user", t, func() {
+		wrInput, err := SingularityBuildInS3WRInput(s3Path, "0110", BuildOptions{Requester: "user"})
+		So(err, ShouldBeNil)
+
+		var m map[string]any
+		err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&m)
+		So(err, ShouldBeNil)
+		So(m["env"], ShouldResemble, []any{"GSB_REQUESTER=user"})
+	})
+
+	Convey("You can generate a wr input that pulls images", t, func() {
+		binDir := t.TempDir()
+		imagesDir := filepath.Join(t.TempDir(), "it's images")
+
+		err := os.WriteFile(filepath.Join(binDir, "singularity"),
+			[]byte("#!/bin/sh\n[ \"$4\" = docker://bad ] && exit 1\necho \"$4\" > \"$3\"\n"), 0700) //nolint:gosec
+		So(err, ShouldBeNil)
+
+		wrInput, err := PullImagesWRInput([]ImagePull{
+			{Source: "docker://ubuntu:22.04", Dest: filepath.Join(imagesDir, "ubuntu_22.04.sif")},
+			{Source: "docker://bad", Dest: filepath.Join(imagesDir, "bad.sif")},
+			{Source: "docker://mirror/spack/ubuntu-jammy:latest", Dest: filepath.Join(imagesDir, "spack.sif")},
+		})
+		So(err, ShouldBeNil)
+
+		var m map[string]any
+		err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&m)
+		So(err, ShouldBeNil)
+		So(m["rep_grp"], ShouldEqual, ImageRefreshRepGroup)
+
+		cmd, ok := m["cmd"].(string)
+		So(ok, ShouldBeTrue)
+
+		bash := exec.Command("bash", "-c", cmd)
+		bash.Env = append(os.Environ(), "PATH="+binDir+":"+os.Getenv("PATH"))
+		err = bash.Run()
+		So(err, ShouldNotBeNil)
+
+		entries, err := os.ReadDir(imagesDir)
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldEqual, 2)
+
+		data, err := os.ReadFile(filepath.Join(imagesDir, "spack.sif"))
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "docker://mirror/spack/ubuntu-jammy:latest\n")
+	})
+
+	Convey("You can generate a wr input that builds images", t, func() {
+		binDir := t.TempDir()
+		imagesDir := filepath.Join(t.TempDir(), "it's images")
+
+		err := os.WriteFile(filepath.Join(binDir, "singularity"),
+			[]byte("#!/bin/sh\n[ \"$5\" = bad.def ] && exit 1\necho \"$@\" > \"$4\"\n"), 0700) //nolint:gosec
+		So(err, ShouldBeNil)
+
+		wrInput, err := BuildImagesWRInput([]ImageBuild{
+			{Def: "r.def", Dest: filepath.Join(imagesDir, "base-r.sif")},
+			{Def: "bad.def", Dest: filepath.Join(imagesDir, "base-bad.sif")},
+		}, true, nil)
+		So(err, ShouldBeNil)
+
+		var m map[string]any
+		err = json.NewDecoder(strings.NewReader(wrInput)).Decode(&m)
+		So(err, ShouldBeNil)
+		So(m["rep_grp"], ShouldEqual, BaseImageRepGroup)
+
+		cmd, ok := m["cmd"].(string)
+		So(ok, ShouldBeTrue)
+
+		bash := exec.Command("bash", "-c", cmd)
+		bash.Env = append(os.Environ(), "PATH="+binDir+":"+os.Getenv("PATH"))
+		err = bash.Run()
+		So(err, ShouldNotBeNil)
+
+		entries, err := os.ReadDir(imagesDir)
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldEqual, 1)
+
+		data, err := os.ReadFile(filepath.Join(imagesDir, "base-r.sif"))
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "build --fakeroot --force "+filepath.Join(imagesDir, "base-r.sif.tmp")+" r.def\n")
+
+		wrInput, err = BuildImagesWRInput([]ImageBuild{{Def: "r.def", Dest: "/images/base-r.sif"}},
+			false, []string{"--disable-cache"})
+		So(err, ShouldBeNil)
+		So(wrInput, ShouldContainSubstring,
+			"sudo singularity build '--disable-cache' --force '/images/base-r.sif.tmp' 'r.def'")
+	})
+
+	Convey("You can parse wr's JSON status output", t, func() {
+		details, err := parseWRJSONStatus(`[{"Cmd":"false","State":"buried","Exited":true,"Exitcode":1,` +
+			`"FailReason":"command exited non-zero","PeakRAM":42,"PeakDisk":3,"Walltime":3.5,"CPUtime":2.5,` +
+			`"Started":1707739135,"Ended":1707739140,"Host":"host1","Attempts":1,"StdErr":"oops"}]`)
+		So(err, ShouldBeNil)
+		So(details.Status(), ShouldEqual, WRJobStatusBuried)
+		So(details.Exited, ShouldBeTrue)
+		So(details.Exitcode, ShouldEqual, 1)
+		So(details.FailReason, ShouldEqual, "command exited non-zero")
+		So(details.PeakRAM, ShouldEqual, 42)
+		So(details.PeakDisk, ShouldEqual, 3)
+		So(details.Walltime, ShouldEqual, 3.5)
+		So(details.CPUtime, ShouldEqual, 2.5)
+		So(*details.Started, ShouldEqual, 1707739135)
+		So(*details.Ended, ShouldEqual, 1707739140)
+		So(details.StdErr, ShouldEqual, "oops")
+		So(details.Output(), ShouldEqual, "oops")
+		details.StdOut = "out"
+		So(details.Output(), ShouldEqual, "out\noops")
+		details.StdOut = ""
+		So(details.Host, ShouldEqual, "host1")
+		So(details.Attempts, ShouldEqual, 1)
+
+		details, err = parseWRJSONStatus("[]")
+		So(err, ShouldBeNil)
+		So(details.Status(), ShouldEqual, WRJobStatusInvalid)
+
+		_, err = parseWRJSONStatus("{")
+		So(err, ShouldNotBeNil)
+
+		So(WRJobStatusRunning.String(), ShouldEqual, "running")
+		So(WRJobStatus(99).String(), ShouldEqual, "invalid")
+
+		data, err := json.Marshal(map[string]WRJobStatus{"a": WRJobStatusBuried, "b": WRJobStatusInvalid})
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, `{"a":"buried","b":"invalid"}`)
+
+		var statuses map[string]WRJobStatus
+		err = json.Unmarshal([]byte(`{"a":"buried","b":"unknown","c":4}`), &statuses)
+		So(err, ShouldBeNil)
+		So(statuses, ShouldResemble, map[string]WRJobStatus{
+			"a": WRJobStatusBuried, "b": WRJobStatusInvalid, "c": WRJobStatusRunning,
+		})
+
+		err = json.Unmarshal([]byte(`{"a":true}`), &statuses)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("You can classify why a job was buried", t, func() {
+		for _, test := range [...]struct {
+			details  JobDetails
+			expected Failure
+		}{
+			{JobDetails{State: "complete"}, FailureNone},
+			{JobDetails{State: "buried", FailReason: "command exited non-zero"}, FailureBuild},
+			{JobDetails{State: "buried", FailReason: "command used too much RAM"}, FailureResource},
+			{JobDetails{State: "buried", FailReason: "lost contact with runner"}, FailureTransient},
+			{JobDetails{State: "buried", FailReason: "command exited non-zero",
+				StdErr: "FATAL: toomanyrequests: You have reached your pull rate limit."}, FailureTransient},
+			{JobDetails{State: "buried", FailReason: "command exited non-zero",
+				StdErr: "gsb watchdog: build stalled: no output for 30 minutes"}, FailureStall},
+			{JobDetails{State: "buried", FailReason: "command exited non-zero",
+				StdErr: "gsb watchdog: build timed out: ran for more than 240 minutes"}, FailureResource},
+		} {
+			So(test.details.Classify(), ShouldEqual, test.expected)
+		}
+	})
+
+	Convey("You can summarise the load of gsb's jobs", t, func() {
+		So(loadOf(nil), ShouldResemble, &Load{})
+		So(loadOf([]*JobDetails{
+			{State: "ready"}, {State: "delayed"}, {State: "running"}, {State: "reserved"},
+			{State: "buried"}, {State: "ready"}, nil,
+		}), ShouldResemble, &Load{Queued: 3, Running: 2})
+	})
+
+	Convey("You can select old gsb jobs for cleanup", t, func() {
+		now := time.Now()
+		old := now.Add(-2 * time.Hour).Unix()
+		recent := now.Add(-time.Minute).Unix()
+
+		ids := gsbJobsEndedBefore([]*JobDetails{
+			{Key: "a", RepGroup: RepGroup("some/path"), Ended: &old},
+			{Key: "b", RepGroup: RepGroup("some/other/path"), Ended: &recent},
+			{Key: "c", RepGroup: RepGroup("some/queued/path")},
+			{Key: "d", RepGroup: "not_gsb", Ended: &old},
+			{Key: "e", RepGroup: LegacyRepGroupPrefix + "some/legacy/path", Ended: &old},
+			nil,
+		}, now.Add(-time.Hour))
+		So(ids, ShouldResemble, []string{"a", "e"})
+
+		So(isGSBRepGroup(RepGroup("some/path")), ShouldBeTrue)
+		So(isGSBRepGroup(LegacyRepGroupPrefix+"some/path"), ShouldBeTrue)
+		So(isGSBRepGroup("my_singularity_build-x"), ShouldBeFalse)
+	})
+
+	Convey("You can tell which rep_grps are of an environment version's builds", t, func() {
+		So(IsEnvRepGroup(RepGroup("builds/users/foo/env/1/.builds/abc"), "builds/users/foo/env/1"), ShouldBeTrue)
+		So(IsEnvRepGroup(RepGroup("builds/users/foo/env/1"), "builds/users/foo/env/1/"), ShouldBeTrue)
+		So(IsEnvRepGroup(LegacyRepGroupPrefix+"builds/users/foo/env/1", "builds/users/foo/env/1"), ShouldBeTrue)
+		So(IsEnvRepGroup(RepGroup("builds/users/foo/env/10/.builds/abc"), "builds/users/foo/env/1"), ShouldBeFalse)
+		So(IsEnvRepGroup(RepGroup("builds/users/foo/env/2"), "builds/users/foo/env/1"), ShouldBeFalse)
+		So(IsEnvRepGroup("builds/users/foo/env/1", "builds/users/foo/env/1"), ShouldBeFalse)
+	})
+
+	Convey("Waits return early if their context is cancelled", t, func() {
+		runner := New("development")
+		runner.pollDuration = time.Hour
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := runner.WaitForRunning(ctx, "id")
+		So(err, ShouldEqual, context.Canceled)
+
+		_, err = runner.Wait(ctx, "id")
+		So(err, ShouldEqual, context.Canceled)
+	})
+
+	Convey("Remote runners tell wr where their manager is", t, func() {
+		cmd := exec.Command("sh", "-c", "echo $WR_MANAGERHOST:$WR_MANAGERPORT")
+
+		out, err := NewRemote("production", "manager.example.com", 11301).runWRCmd(cmd)
+		So(err, ShouldBeNil)
+		So(out, ShouldEqual, "manager.example.com:11301")
+
+		t.Setenv("WR_MANAGERPORT", "1021")
+
+		cmd = exec.Command("sh", "-c", "echo $WR_MANAGERHOST:$WR_MANAGERPORT")
+
+		out, err = NewRemote("production", "other.example.com", 0).runWRCmd(cmd)
+		So(err, ShouldBeNil)
+		So(out, ShouldEqual, "other.example.com:1021")
+	})
+
 	gsbWR := os.Getenv("GSB_WR_TEST")
 	if gsbWR == "" {
 		SkipConvey("Skipping WR run test, set GSB_WR_TEST to enable", t, func() {})
@@ -82,9 +439,9 @@ func TestWR(t *testing.T) {
 		runArgs, repGrp := uniqueRunArgs("sleep 2s", "")
 		jobID, err := runner.Add(runArgs)
 		So(err, ShouldBeNil)
-		err = runner.WaitForRunning(jobID)
+		err = runner.WaitForRunning(context.Background(), jobID)
 		So(err, ShouldBeNil)
-		status, err := runner.Wait(jobID)
+		status, err := runner.Wait(context.Background(), jobID)
 		So(err, ShouldBeNil)
 		So(status, ShouldEqual, WRJobStatusComplete)
 		So(time.Since(now), ShouldBeGreaterThan, 2*time.Second)
@@ -95,18 +452,18 @@ func TestWR(t *testing.T) {
 		jobID2, err := runner.Add(runArgs)
 		So(err, ShouldBeNil)
 		So(jobID2, ShouldEqual, jobID)
-		err = runner.WaitForRunning(jobID)
+		err = runner.WaitForRunning(context.Background(), jobID)
 		So(err, ShouldBeNil)
-		status, err = runner.Wait(jobID)
+		status, err = runner.Wait(context.Background(), jobID)
 		So(err, ShouldBeNil)
 		So(status, ShouldEqual, WRJobStatusComplete)
 
 		runArgs, _ = uniqueRunArgs("false", "")
 		jobID, err = runner.Add(runArgs)
 		So(err, ShouldBeNil)
-		err = runner.WaitForRunning(jobID)
+		err = runner.WaitForRunning(context.Background(), jobID)
 		So(err, ShouldBeNil)
-		status, err = runner.Wait(jobID)
+		status, err = runner.Wait(context.Background(), jobID)
 		So(err, ShouldBeNil)
 		So(status, ShouldEqual, WRJobStatusBuried)
 	})
@@ -123,7 +480,7 @@ func TestWR(t *testing.T) {
 		runningCh := make(chan time.Time)
 		errCh := make(chan error, 1)
 		go func() {
-			errCh <- runner.WaitForRunning(jobID)
+			errCh <- runner.WaitForRunning(context.Background(), jobID)
 			runningCh <- time.Now()
 		}()
 
@@ -134,7 +491,7 @@ func TestWR(t *testing.T) {
 		err = cmd.Run()
 		So(err, ShouldBeNil)
 
-		status, err := runner.Wait(jobID)
+		status, err := runner.Wait(context.Background(), jobID)
 		So(err, ShouldBeNil)
 		endTime := time.Now()
 		So(status, ShouldEqual, WRJobStatusComplete)